@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/roboll/helmfile/pkg/app"
 	"github.com/roboll/helmfile/pkg/helmexec"
 	"github.com/roboll/helmfile/pkg/maputil"
+	"github.com/roboll/helmfile/pkg/postrender"
 	"github.com/roboll/helmfile/pkg/state"
 	"github.com/urfave/cli"
 	"go.uber.org/zap"
@@ -36,6 +38,14 @@ func configureLogging(c *cli.Context) error {
 		// https://github.com/urfave/cli/blob/master/CHANGELOG.md#1190---2016-11-19
 		c.App.Metadata = make(map[string]interface{})
 	}
+	if !c.GlobalBool("disable-log-redaction") {
+		redactor, err := helmexec.NewRedactor(c.GlobalStringSlice("redact-pattern")...)
+		if err != nil {
+			return fmt.Errorf("invalid --redact-pattern: %v", err)
+		}
+		logger = redactor.WrapLogger(logger)
+		c.App.Metadata["redactor"] = redactor
+	}
 	c.App.Metadata["logger"] = logger
 	return nil
 }
@@ -53,15 +63,19 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "file, f",
-			Usage: "load config from file or directory. defaults to `helmfile.yaml` or `helmfile.d`(means `helmfile.d/*.yaml`) in this preference",
+			Usage: "load config from file or directory. defaults to `helmfile.yaml` or `helmfile.d`(means `helmfile.d/*.yaml`) in this preference. `-` reads it from stdin",
 		},
 		cli.StringFlag{
 			Name:  "environment, e",
-			Usage: "specify the environment name. defaults to `default`",
+			Usage: "specify the environment name, or multiple names merged in the order like base,prod. defaults to `default`",
 		},
 		cli.StringSliceFlag{
 			Name:  "state-values-set",
-			Usage: "set state values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)",
+			Usage: "set state values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2). Keys can contain indices of lists like hosts[0].name. Numbers, booleans and null are converted like helm's --set",
+		},
+		cli.StringSliceFlag{
+			Name:  "state-values-set-string",
+			Usage: "set STRING state values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2). Values are never converted, like helm's --set-string",
 		},
 		cli.StringSliceFlag{
 			Name:  "state-values-file",
@@ -75,6 +89,135 @@ func main() {
 			Name:  "kube-context",
 			Usage: "Set kubectl context. Uses current context by default",
 		},
+		cli.StringSliceFlag{
+			Name:  "environment-kube-context",
+			Usage: "Set kubectl context per environment in the form of ENV=CONTEXT (can specify multiple). --kube-context takes precedence over it",
+		},
+		cli.BoolFlag{
+			Name:  "restrict-file-access",
+			Usage: "Deny helmfiles and their templates access to files outside of the directory containing the helmfile and the ones specified by --allow-dir",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-dir",
+			Usage: "Allow access to files in the directory when --restrict-file-access is enabled (can specify multiple)",
+		},
+		cli.StringSliceFlag{
+			Name:  "rewrite-chart",
+			Usage: "Rewrite chart references of all the releases in the form of OLD_PREFIX=NEW_PREFIX (can specify multiple). e.g. --rewrite-chart stable/=mymirror/",
+		},
+		cli.BoolFlag{
+			Name:  "use-lock",
+			Usage: "Pin releases to the charts and versions recorded in the lock file by 'helmfile deps'. Fails when a release is missing in the lock file",
+		},
+		cli.BoolFlag{
+			Name:  "discover-environment-values",
+			Usage: "Merge environments/ENV/*.yaml next to each helmfile into the values of the environment ENV, in the lexical order of their names",
+		},
+		cli.BoolFlag{
+			Name:  "discover-environment-secrets",
+			Usage: "Decrypt secrets.ENV.yaml next to each helmfile via vals and merge it into the values of the environment ENV, taking precedence over the values in the helmfile",
+		},
+		cli.BoolFlag{
+			Name:  "strict-release-merge",
+			Usage: "Fail instead of warning when a release is defined with different charts across parts of a helmfile separated by ---",
+		},
+		cli.BoolFlag{
+			Name:  "merge-helmfile-dir",
+			Usage: "Load all the helmfiles in the helmfile directory as one helmfile, so that their releases can need each other",
+		},
+		cli.BoolFlag{
+			Name:  "nested-bases",
+			Usage: "Evaluate bases of bases recursively, in all the helmfiles including nested ones, instead of failing on them",
+		},
+		cli.BoolFlag{
+			Name:  "inherit-helm-defaults",
+			Usage: "Apply the helmDefaults of each helmfile to its sub-helmfiles, whose own helmDefaults take precedence",
+		},
+		cli.BoolFlag{
+			Name:  "skip-broken-sub-helmfiles",
+			Usage: "Warn and skip the sub-helmfiles failed to load, instead of failing, to process the remaining ones",
+		},
+		cli.StringFlag{
+			Name:  "chart-cache-dir",
+			Usage: "Keep the charts downloaded for releases with exact versions in the directory across runs, so that they are not downloaded again",
+		},
+		cli.BoolFlag{
+			Name:  "clear-chart-cache",
+			Usage: "Remove all the charts in --chart-cache-dir before running the command",
+		},
+		cli.IntFlag{
+			Name:  "chart-fetch-retries",
+			Usage: "Retry fetching a chart or updating repositories up to this number of times when it failed transiently, like by a 5xx response or a timeout",
+		},
+		cli.StringFlag{
+			Name:  "release-webhook-url",
+			Usage: "POST the outcome of each release synced, deleted, tested or checked for its status to the URL as JSON, without waiting for the delivery",
+		},
+		cli.StringSliceFlag{
+			Name:  "http-header",
+			Usage: "Add the header in the form of 'Name: value' to every request fetching helmfiles by http(s), like 'Authorization: Bearer $TOKEN'. Environment variables are expanded in the value (can specify multiple)",
+		},
+		cli.DurationFlag{
+			Name:  "http-cache-ttl",
+			Usage: "Reuse helmfiles fetched by http(s) within the duration across runs, instead of fetching them on every run",
+		},
+		cli.BoolFlag{
+			Name:  "force-reload",
+			Usage: "Load helmfiles from scratch, instead of reusing the states loaded before when none of the files they were loaded from has changed",
+		},
+		cli.BoolFlag{
+			Name:  "disable-log-redaction",
+			Usage: "Log the values resolved from references to secrets via vals, like ref+vault://..., as-is instead of masking them",
+		},
+		cli.StringSliceFlag{
+			Name:  "redact-pattern",
+			Usage: "Mask the strings matching the regular expression in logs, in addition to the values resolved via vals (can specify multiple)",
+		},
+		cli.BoolFlag{
+			Name:  "deterministic",
+			Usage: "Make randomized template functions like randAlphaNum and uuidv4 return the same results for the same helmfile on every run, and fail the ones generating keys and certificates",
+		},
+		cli.StringFlag{
+			Name:   "deterministic-seed",
+			Usage:  "The secret seed of --deterministic, which makes the results differ from the ones with another seed",
+			EnvVar: app.DeterministicSeedEnvVar,
+		},
+		cli.BoolFlag{
+			Name:  "strict-templates",
+			Usage: "Fail rendering helmfiles that print <no value> for undefined or null values, like index .Values \"typo\", instead of leaking it into the result",
+		},
+		cli.StringFlag{
+			Name:  "debug-render-dir",
+			Usage: "Write every rendered part of helmfiles to the directory, named after the path of the helmfile and the index of the part, to inspect what is parsed",
+		},
+		cli.IntFlag{
+			Name:  "default-concurrency",
+			Value: 0,
+			Usage: "maximum number of concurrent helm processes to run when neither --concurrency nor the environment's concurrency is specified, 0 is unlimited",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrency",
+			Value: 0,
+			Usage: "hard limit of the number of concurrent helm processes, which takes precedence over --concurrency and the environment's concurrency, 0 is unlimited",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrency-per-namespace",
+			Value: 0,
+			Usage: "maximum number of releases processed at once per namespace, 0 is unlimited",
+		},
+		cli.IntFlag{
+			Name:  "max-dag-depth",
+			Value: 0,
+			Usage: "fail before processing any release when the releases are planned in more groups than this, due to long chains of needs. 0 is unlimited",
+		},
+		cli.BoolFlag{
+			Name:  "ordered-dispatch",
+			Usage: "start processing releases in the order of declaration, while still processing them concurrently, for reproducible logs",
+		},
+		cli.BoolFlag{
+			Name:  "sequential",
+			Usage: "process releases one at a time in the order of declaration, or in the reverse order on deletion, ignoring the ordering by needs",
+		},
 		cli.BoolFlag{
 			Name:  "no-color",
 			Usage: "Output without color",
@@ -89,11 +232,19 @@ func main() {
 		},
 		cli.StringSliceFlag{
 			Name: "selector, l",
-			Usage: `Only run using the releases that match labels. Labels can take the form of foo=bar or foo!=bar.
+			Usage: `Only run using the releases that match labels. Labels can take the form of foo=bar, foo!=bar, foo in (bar,baz) or foo notin (bar,baz).
 	A release must match all labels in a group in order to be used. Multiple groups can be specified at once.
 	--selector tier=frontend,tier!=proxy --selector tier=backend. Will match all frontend, non-proxy releases AND all backend releases.
 	The name of a release can be used as a label. --selector name=myrelease`,
 		},
+		cli.StringSliceFlag{
+			Name:  "group, g",
+			Usage: "Only run using the releases in the group defined in the groups section of helmfiles (can specify multiple). Combined with --selector, only the releases in the group matching the selector are run",
+		},
+		cli.BoolFlag{
+			Name:  "include-group-needs",
+			Usage: "Also run the releases needed by the releases in the groups given by --group, directly or indirectly",
+		},
 		cli.BoolFlag{
 			Name:  "allow-no-matching-release",
 			Usage: `Do not exit with an error code if the provided selector has no matching releases.`,
@@ -119,6 +270,14 @@ func main() {
 					Name:  "skip-repos",
 					Usage: "skip running `helm repo update` before running `helm dependency build`",
 				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "print the dependency graph of the releases defined by `needs` in the format instead of updating charts. The only supported format is `dot`, for Graphviz",
+				},
+				cli.BoolFlag{
+					Name:  "orphans",
+					Usage: "print the releases that neither need nor are needed by any release, instead of updating charts",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Deps(c)
@@ -209,6 +368,103 @@ func main() {
 				return run.Diff(c)
 			}),
 		},
+		{
+			Name:  "drift",
+			Usage: "detect releases drifted from the desired state in the cluster (helm diff). exits with 2 when any release drifted",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "args",
+					Value: "",
+					Usage: "pass args to helm exec",
+				},
+				cli.StringSliceFlag{
+					Name:  "set",
+					Usage: "additional values to be merged into the command",
+				},
+				cli.StringSliceFlag{
+					Name:  "values",
+					Usage: "additional value files to be merged into the command",
+				},
+				cli.BoolFlag{
+					Name:  "skip-deps",
+					Usage: "skip running `helm repo update` and `helm dependency build`",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 0,
+					Usage: "maximum number of concurrent helm processes to run, 0 is unlimited",
+				},
+				cli.IntFlag{
+					Name:  "context",
+					Value: 0,
+					Usage: "output NUM lines of context around changes",
+				},
+				cli.StringFlag{
+					Name:  "report-file",
+					Usage: "write the drift of each release to the file as JSON, for monitoring",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.Drift(c)
+			}),
+		},
+		{
+			Name:  "prune",
+			Usage: "list releases installed in the namespaces managed by the helmfiles but not defined in any of them, and optionally uninstall them",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "label-selector",
+					Value: "managed-by=helmfile",
+					Usage: "list only the releases with the labels, passed to `helm list --selector`. requires helm 3. set to empty to list all the releases in the namespaces",
+				},
+				cli.BoolFlag{
+					Name:  "delete",
+					Usage: "uninstall the orphaned releases found. they are only listed by default",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.Prune(c)
+			}),
+		},
+		{
+			Name:  "validate-schema",
+			Usage: "validate the rendered manifests of releases against the OpenAPI schema of the Kubernetes API, without accessing the cluster",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "args",
+					Value: "",
+					Usage: "pass args to helm exec",
+				},
+				cli.StringSliceFlag{
+					Name:  "set",
+					Usage: "additional values to be merged into the command",
+				},
+				cli.StringSliceFlag{
+					Name:  "values",
+					Usage: "additional value files to be merged into the command",
+				},
+				cli.BoolFlag{
+					Name:  "skip-deps",
+					Usage: "skip running `helm repo update` and `helm dependency build`",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: 0,
+					Usage: "maximum number of concurrent downloads of release charts",
+				},
+				cli.StringFlag{
+					Name:  "schema",
+					Usage: "path or HTTP(S) URL to the OpenAPI v2 schema of the Kubernetes API to validate against, like the output of `kubectl get --raw /openapi/v2`",
+				},
+				cli.StringFlag{
+					Name:  "report-file",
+					Usage: "write the validation of each release to the file as JSON",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.ValidateSchema(c)
+			}),
+		},
 		{
 			Name:  "template",
 			Usage: "template releases from state file against env (helm template)",
@@ -230,6 +486,10 @@ func main() {
 					Name:  "output-dir",
 					Usage: "output directory to pass to helm template (helm template --output-dir)",
 				},
+				cli.BoolFlag{
+					Name:  "validate",
+					Usage: "validate the helmfiles, including templates, environments, sub-helmfiles and needs, without running helm. prints the releases in the order they would be synced",
+				},
 				cli.IntFlag{
 					Name:  "concurrency",
 					Value: 0,
@@ -270,6 +530,10 @@ func main() {
 					Name:  "skip-deps",
 					Usage: "skip running `helm repo update` and `helm dependency build`",
 				},
+				cli.BoolFlag{
+					Name:  "warn-disconnected",
+					Usage: "warn on releases that form groups disconnected from each other via needs, which may indicate a missing need",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Lint(c)
@@ -301,6 +565,31 @@ func main() {
 					Name:  "skip-deps",
 					Usage: "skip running `helm repo update` and `helm dependency build`",
 				},
+				cli.BoolFlag{
+					Name:  "skip-needs-not-installed",
+					Usage: "skip releases that need releases with 'installed: false', instead of failing",
+				},
+				cli.IntFlag{
+					Name:  "max-failures",
+					Value: 0,
+					Usage: "keep syncing releases not needing failed releases until this number of releases failed. 0 stops at the first group of releases with a failure, like 1, and -1 never stops",
+				},
+				cli.BoolFlag{
+					Name:  "atomic-run",
+					Usage: "on the first failure, stop and roll back all the releases synced so far in this run in the reverse order of needs, deleting the ones newly installed. --max-failures is ignored",
+				},
+				cli.BoolFlag{
+					Name:  "batch",
+					Usage: "delete releases with 'installed: false' sharing the same kube context, namespace and tiller in a single helm command to reduce the number of helm processes",
+				},
+				cli.BoolFlag{
+					Name:  "incremental",
+					Usage: "process only the releases whose inputs changed since the last successful incremental run, and the releases needing them. The hashes of the inputs are recorded in <HELMFILE>.hashes",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "skip the releases succeeded by the last failed run, unless the releases changed since then. The progress of every failed run is recorded in <HELMFILE>.progress",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Sync(c)
@@ -341,6 +630,31 @@ func main() {
 					Name:  "skip-deps",
 					Usage: "skip running `helm repo update` and `helm dependency build`",
 				},
+				cli.BoolFlag{
+					Name:  "skip-needs-not-installed",
+					Usage: "skip releases that need releases with 'installed: false', instead of failing",
+				},
+				cli.IntFlag{
+					Name:  "max-failures",
+					Value: 0,
+					Usage: "keep syncing releases not needing failed releases until this number of releases failed. 0 stops at the first group of releases with a failure, like 1, and -1 never stops",
+				},
+				cli.BoolFlag{
+					Name:  "atomic-run",
+					Usage: "on the first failure, stop and roll back all the releases synced so far in this run in the reverse order of needs, deleting the ones newly installed. --max-failures is ignored",
+				},
+				cli.BoolFlag{
+					Name:  "batch",
+					Usage: "delete releases with 'installed: false' sharing the same kube context, namespace and tiller in a single helm command to reduce the number of helm processes",
+				},
+				cli.BoolFlag{
+					Name:  "incremental",
+					Usage: "process only the releases whose inputs changed since the last successful incremental run, and the releases needing them. The hashes of the inputs are recorded in <HELMFILE>.hashes",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "skip the releases succeeded by the last failed run, unless the releases changed since then. The progress of every failed run is recorded in <HELMFILE>.progress",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Apply(c)
@@ -383,6 +697,26 @@ func main() {
 					Name:  "purge",
 					Usage: "purge releases i.e. free release names and histories",
 				},
+				cli.BoolFlag{
+					Name:  "batch",
+					Usage: "delete releases sharing the same kube context, namespace and tiller in a single helm command to reduce the number of helm processes",
+				},
+				cli.IntFlag{
+					Name:  "group",
+					Usage: "delete only the releases in the Nth group of the DAG of releases, as numbered in the debug logs. Deletes all the groups by default",
+				},
+				cli.StringFlag{
+					Name:  "reverse-sort-key",
+					Usage: "sort releases to delete by the key, one of index, name, namespace and priority. index deletes releases in the reverse order of declaration",
+				},
+				cli.BoolFlag{
+					Name:  "continue-on-error",
+					Usage: "keep deleting releases not needed by failed releases, instead of stopping at the first group of releases with a failure",
+				},
+				cli.BoolFlag{
+					Name:  "strict-dependents",
+					Usage: "fail instead of warning when releases to delete are needed by releases not selected for deletion",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Delete(c)
@@ -402,6 +736,26 @@ func main() {
 					Value: "",
 					Usage: "pass args to helm exec",
 				},
+				cli.BoolFlag{
+					Name:  "batch",
+					Usage: "delete releases sharing the same kube context, namespace and tiller in a single helm command to reduce the number of helm processes",
+				},
+				cli.IntFlag{
+					Name:  "group",
+					Usage: "delete only the releases in the Nth group of the DAG of releases, as numbered in the debug logs. Deletes all the groups by default",
+				},
+				cli.StringFlag{
+					Name:  "reverse-sort-key",
+					Usage: "sort releases to delete by the key, one of index, name, namespace and priority. index deletes releases in the reverse order of declaration",
+				},
+				cli.BoolFlag{
+					Name:  "continue-on-error",
+					Usage: "keep deleting releases not needed by failed releases, instead of stopping at the first group of releases with a failure",
+				},
+				cli.BoolFlag{
+					Name:  "strict-dependents",
+					Usage: "fail instead of warning when releases to delete are needed by releases not selected for deletion",
+				},
 			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.Destroy(c)
@@ -446,11 +800,111 @@ func main() {
 		{
 			Name:  "list",
 			Usage: "list releases defined in state file",
-			Flags: []cli.Flag{},
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "ordered",
+					Usage: "list releases in the order they would be synced, with the numbers of the groups of releases processed concurrently",
+				},
+			},
 			Action: action(func(run *app.App, c configImpl) error {
 				return run.ListReleases(c)
 			}),
 		},
+		{
+			Name:  "plan",
+			Usage: "print the groups of releases in the order they would be synced, or compare them against a golden file",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "golden",
+					Value: "",
+					Usage: "fail when the plan differs from the one in the file, to catch unexpected changes in the order of releases",
+				},
+				cli.BoolFlag{
+					Name:  "update-golden",
+					Usage: "write the plan to the file given via --golden instead of comparing against it",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.Plan(c)
+			}),
+		},
+		{
+			Name:  "write-values",
+			Usage: "print the values merged for each release from its values, secrets and set entries, without running helm",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output-file-template",
+					Usage: "write the values of each release to the file rendered from the template, like `values/{{ .Release.Namespace }}/{{ .Release.Name }}.yaml`, instead of printing them",
+				},
+			},
+			Action: action(func(run *app.App, c configImpl) error {
+				return run.WriteValues(c)
+			}),
+		},
+		{
+			Name:  "env",
+			Usage: "inspect environments defined in state file",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "list names of environments defined in state file, one per line",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "with-values",
+							Usage: "print values of every environment resolved for each state file defining it, in YAML",
+						},
+					},
+					Action: action(func(run *app.App, c configImpl) error {
+						return run.ListEnvironments(c)
+					}),
+				},
+				{
+					Name:  "export",
+					Usage: "print values of the selected environment as shell export lines, like `export FOO_BAR='baz'`",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "prefix",
+							Usage: "prefix prepended to the names of the exported variables, like `HELMFILE_`",
+						},
+					},
+					Action: action(func(run *app.App, c configImpl) error {
+						return run.ExportEnvironment(c)
+					}),
+				},
+			},
+		},
+		{
+			Name:   postrender.Command,
+			Usage:  "stamp labels and annotations onto the manifests read from stdin. run by helm as the post-renderer for commonLabels and commonAnnotations",
+			Hidden: true,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "label",
+					Usage: "label to add to every resource, in the form of KEY=VALUE",
+				},
+				cli.StringSliceFlag{
+					Name:  "annotation",
+					Usage: "annotation to add to every resource, in the form of KEY=VALUE",
+				},
+				cli.StringFlag{
+					Name:  "then",
+					Usage: "post-renderer command to run on the manifests before stamping them",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				labels, err := postrender.ParsePairs(c.StringSlice("label"))
+				if err != nil {
+					return err
+				}
+
+				annotations, err := postrender.ParsePairs(c.StringSlice("annotation"))
+				if err != nil {
+					return err
+				}
+
+				return postrender.Run(os.Stdin, os.Stdout, labels, annotations, c.String("then"))
+			},
+		},
 	}
 
 	err := cliApp.Run(os.Args)
@@ -463,7 +917,9 @@ func main() {
 type configImpl struct {
 	c *cli.Context
 
-	set map[string]interface{}
+	set           map[string]interface{}
+	kubeContexts  map[string]string
+	chartRewrites map[string]string
 }
 
 func NewUrfaveCliConfigImpl(c *cli.Context) (configImpl, error) {
@@ -477,28 +933,71 @@ func NewUrfaveCliConfigImpl(c *cli.Context) (configImpl, error) {
 	}
 
 	optsSet := c.GlobalStringSlice("state-values-set")
-	if len(optsSet) > 0 {
+	optsSetString := c.GlobalStringSlice("state-values-set-string")
+	if len(optsSet) > 0 || len(optsSetString) > 0 {
 		set := map[string]interface{}{}
-		for i := range optsSet {
-			ops := strings.Split(optsSet[i], ",")
-			for j := range ops {
-				op := strings.SplitN(ops[j], "=", 2)
-				k := strings.Split(op[0], ".")
-				v := op[1]
-
-				set = maputil.Set(set, k, v)
+		parseSet := func(opts []string, parse func(string) interface{}) error {
+			for i := range opts {
+				ops := strings.Split(opts[i], ",")
+				for j := range ops {
+					op := strings.SplitN(ops[j], "=", 2)
+					if len(op) != 2 {
+						return fmt.Errorf("err: malformed state value %q: it must be in the form of key=value", ops[j])
+					}
+					v := parse(op[1])
+
+					if err := maputil.SetPath(set, op[0], v); err != nil {
+						return fmt.Errorf("err: %v", err)
+					}
+				}
 			}
+			return nil
+		}
+		if err := parseSet(optsSet, maputil.ParseValue); err != nil {
+			return configImpl{}, err
+		}
+		if err := parseSet(optsSetString, func(s string) interface{} { return s }); err != nil {
+			return configImpl{}, err
 		}
 		conf.set = set
 	}
 
+	kubeContexts, err := parseKeyValues("environment-kube-context", c.GlobalStringSlice("environment-kube-context"))
+	if err != nil {
+		return configImpl{}, err
+	}
+	conf.kubeContexts = kubeContexts
+
+	chartRewrites, err := parseKeyValues("rewrite-chart", c.GlobalStringSlice("rewrite-chart"))
+	if err != nil {
+		return configImpl{}, err
+	}
+	conf.chartRewrites = chartRewrites
+
 	return conf, nil
 }
 
+// parseKeyValues parses the values of the flag in the form of KEY=VALUE into a map
+func parseKeyValues(flag string, kvs []string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range kvs {
+		keyAndValue := strings.SplitN(kv, "=", 2)
+		if len(keyAndValue) != 2 || keyAndValue[0] == "" {
+			return nil, fmt.Errorf("err: malformed --%s %q: it must be in the form of KEY=VALUE", flag, kv)
+		}
+		m[keyAndValue[0]] = keyAndValue[1]
+	}
+	return m, nil
+}
+
 func (c configImpl) Set() []string {
 	return c.c.StringSlice("set")
 }
 
+func (c configImpl) Orphans() bool {
+	return c.c.Bool("orphans")
+}
+
 func (c configImpl) SkipRepos() bool {
 	return c.c.Bool("skip-repos")
 }
@@ -511,10 +1010,58 @@ func (c configImpl) Args() string {
 	return c.c.String("args")
 }
 
+func (c configImpl) Output() string {
+	return c.c.String("output")
+}
+
 func (c configImpl) OutputDir() string {
 	return c.c.String("output-dir")
 }
 
+func (c configImpl) Validate() bool {
+	return c.c.Bool("validate")
+}
+
+func (c configImpl) Ordered() bool {
+	return c.c.Bool("ordered")
+}
+
+func (c configImpl) WithValues() bool {
+	return c.c.Bool("with-values")
+}
+
+func (c configImpl) Prefix() string {
+	return c.c.String("prefix")
+}
+
+func (c configImpl) OutputFileTemplate() string {
+	return c.c.String("output-file-template")
+}
+
+func (c configImpl) ReportFile() string {
+	return c.c.String("report-file")
+}
+
+func (c configImpl) LabelSelector() string {
+	return c.c.String("label-selector")
+}
+
+func (c configImpl) Delete() bool {
+	return c.c.Bool("delete")
+}
+
+func (c configImpl) Schema() string {
+	return c.c.String("schema")
+}
+
+func (c configImpl) Golden() string {
+	return c.c.String("golden")
+}
+
+func (c configImpl) UpdateGolden() bool {
+	return c.c.Bool("update-golden")
+}
+
 func (c configImpl) Concurrency() int {
 	return c.c.Int("concurrency")
 }
@@ -529,6 +1076,30 @@ func (c configImpl) SkipDeps() bool {
 	return c.c.Bool("skip-deps")
 }
 
+func (c configImpl) WarnDisconnected() bool {
+	return c.c.Bool("warn-disconnected")
+}
+
+func (c configImpl) SkipNeedsNotInstalled() bool {
+	return c.c.Bool("skip-needs-not-installed")
+}
+
+func (c configImpl) MaxFailures() int {
+	return c.c.Int("max-failures")
+}
+
+func (c configImpl) AtomicRun() bool {
+	return c.c.Bool("atomic-run")
+}
+
+func (c configImpl) Incremental() bool {
+	return c.c.Bool("incremental")
+}
+
+func (c configImpl) Resume() bool {
+	return c.c.Bool("resume")
+}
+
 func (c configImpl) DetailedExitcode() bool {
 	return c.c.Bool("detailed-exitcode")
 }
@@ -543,6 +1114,26 @@ func (c configImpl) Purge() bool {
 	return c.c.Bool("purge")
 }
 
+func (c configImpl) Batch() bool {
+	return c.c.Bool("batch")
+}
+
+func (c configImpl) Group() int {
+	return c.c.Int("group")
+}
+
+func (c configImpl) ReverseSortKey() string {
+	return c.c.String("reverse-sort-key")
+}
+
+func (c configImpl) ContinueOnError() bool {
+	return c.c.Bool("continue-on-error")
+}
+
+func (c configImpl) StrictDependents() bool {
+	return c.c.Bool("strict-dependents")
+}
+
 // TestConfig
 
 func (c configImpl) Cleanup() bool {
@@ -563,6 +1154,127 @@ func (c configImpl) KubeContext() string {
 	return c.c.GlobalString("kube-context")
 }
 
+func (c configImpl) KubeContexts() map[string]string {
+	return c.kubeContexts
+}
+
+func (c configImpl) RestrictFileAccess() bool {
+	return c.c.GlobalBool("restrict-file-access")
+}
+
+func (c configImpl) AllowedDirs() []string {
+	return c.c.GlobalStringSlice("allow-dir")
+}
+
+func (c configImpl) ChartRewrites() map[string]string {
+	return c.chartRewrites
+}
+
+func (c configImpl) UseLock() bool {
+	return c.c.GlobalBool("use-lock")
+}
+
+func (c configImpl) DiscoverEnvValues() bool {
+	return c.c.GlobalBool("discover-environment-values")
+}
+
+func (c configImpl) DiscoverEnvSecrets() bool {
+	return c.c.GlobalBool("discover-environment-secrets")
+}
+
+func (c configImpl) StrictReleaseMerge() bool {
+	return c.c.GlobalBool("strict-release-merge")
+}
+
+func (c configImpl) MergeHelmfileDir() bool {
+	return c.c.GlobalBool("merge-helmfile-dir")
+}
+
+func (c configImpl) NestedBases() bool {
+	return c.c.GlobalBool("nested-bases")
+}
+
+func (c configImpl) InheritHelmDefaults() bool {
+	return c.c.GlobalBool("inherit-helm-defaults")
+}
+
+func (c configImpl) SkipBrokenSubHelmfiles() bool {
+	return c.c.GlobalBool("skip-broken-sub-helmfiles")
+}
+
+func (c configImpl) ChartCacheDir() string {
+	return c.c.GlobalString("chart-cache-dir")
+}
+
+func (c configImpl) ClearChartCache() bool {
+	return c.c.GlobalBool("clear-chart-cache")
+}
+
+func (c configImpl) DebugRenderDir() string {
+	return c.c.GlobalString("debug-render-dir")
+}
+
+func (c configImpl) Deterministic() bool {
+	return c.c.GlobalBool("deterministic")
+}
+
+func (c configImpl) DeterministicSeed() string {
+	return c.c.GlobalString("deterministic-seed")
+}
+
+func (c configImpl) StrictTemplates() bool {
+	return c.c.GlobalBool("strict-templates")
+}
+
+func (c configImpl) DefaultConcurrency() int {
+	return c.c.GlobalInt("default-concurrency")
+}
+
+func (c configImpl) MaxConcurrency() int {
+	return c.c.GlobalInt("max-concurrency")
+}
+
+func (c configImpl) MaxConcurrencyPerNamespace() int {
+	return c.c.GlobalInt("max-concurrency-per-namespace")
+}
+
+func (c configImpl) MaxDAGDepth() int {
+	return c.c.GlobalInt("max-dag-depth")
+}
+
+func (c configImpl) OrderedDispatch() bool {
+	return c.c.GlobalBool("ordered-dispatch")
+}
+
+func (c configImpl) Sequential() bool {
+	return c.c.GlobalBool("sequential")
+}
+
+func (c configImpl) ChartFetchRetries() int {
+	return c.c.GlobalInt("chart-fetch-retries")
+}
+
+func (c configImpl) ReleaseWebhookURL() string {
+	return c.c.GlobalString("release-webhook-url")
+}
+
+func (c configImpl) HTTPHeaders() []string {
+	return c.c.GlobalStringSlice("http-header")
+}
+
+func (c configImpl) HTTPCacheTTL() time.Duration {
+	return c.c.GlobalDuration("http-cache-ttl")
+}
+
+func (c configImpl) ForceReload() bool {
+	return c.c.GlobalBool("force-reload")
+}
+
+func (c configImpl) Redactor() *helmexec.Redactor {
+	r, _ := c.c.App.Metadata["redactor"].(*helmexec.Redactor)
+	return r
+}
+
 func (c configImpl) Namespace() string {
 	return c.c.GlobalString("namespace")
 }
@@ -575,6 +1287,14 @@ func (c configImpl) Selectors() []string {
 	return c.c.GlobalStringSlice("selector")
 }
 
+func (c configImpl) Groups() []string {
+	return c.c.GlobalStringSlice("group")
+}
+
+func (c configImpl) IncludeGroupNeeds() bool {
+	return c.c.GlobalBool("include-group-needs")
+}
+
 func (c configImpl) StateValuesSet() map[string]interface{} {
 	return c.set
 }
@@ -1,19 +1,28 @@
 package app
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/gosuri/uitable"
 	"github.com/roboll/helmfile/pkg/helmexec"
 	"github.com/roboll/helmfile/pkg/remote"
+	"github.com/roboll/helmfile/pkg/schema"
 	"github.com/roboll/helmfile/pkg/state"
 	"github.com/variantdev/vals"
+	"gopkg.in/yaml.v2"
 
 	"go.uber.org/zap"
 
@@ -27,17 +36,124 @@ const (
 )
 
 type App struct {
-	KubeContext string
-	Logger      *zap.SugaredLogger
-	Reverse     bool
-	Env         string
-	Namespace   string
-	Selectors   []string
+	KubeContext  string
+	KubeContexts map[string]string
+	Logger       *zap.SugaredLogger
+	Reverse      bool
+	Env          string
+	Namespace    string
+	Selectors    []string
+	// Groups is the names of the groups of releases to run. See state.HelmState.SelectedGroups
+	Groups []string
+	// IncludeGroupNeeds also runs the releases needed by the releases in Groups. See state.HelmState.IncludeGroupNeeds
+	IncludeGroupNeeds bool
+
 	HelmBinary  string
 	Args        string
 	ValuesFiles []string
 	Set         map[string]interface{}
 
+	// ReverseSortKey is the key to sort releases by in the reverse mode. See LoadOpts.ReverseSortKey
+	ReverseSortKey string
+
+	RestrictFileAccess bool
+	AllowedDirs        []string
+
+	ChartRewriter ChartRewriter
+
+	// PlanMetricsSink, when set, receives the metrics of every DAG of releases planned for processing
+	PlanMetricsSink func(state.PlanMetrics)
+	// ReleaseTimingsSink, when set, receives the durations of processing the releases. See state.HelmState.ReleaseTimingsSink
+	ReleaseTimingsSink func([]state.ReleaseTiming)
+	// LoadInputsSink, when set, receives the path to every helmfile loaded, including nested ones, along with all the files and
+	// globs accessed while loading it, including the ones read in templates, and the values and secrets files of its releases,
+	// so that tools can reload it when any of them changes. Each helmfile is reported every time it is loaded, even when the state loaded before is reused. See LoadInput
+	LoadInputsSink func(string, []LoadInput)
+
+	// BeforeRelease and AfterRelease, when set, are called around processing each release. See state.HelmState.BeforeRelease
+	BeforeRelease func(state.ReleaseSpec) error
+	AfterRelease  func(state.ReleaseSpec, error, time.Duration)
+	// ReleaseSkipped, when set, is called for each release skipped without being processed. See state.HelmState.ReleaseSkipped
+	ReleaseSkipped func(state.ReleaseSpec, state.SkipReason)
+
+	// UseLock pins releases to the charts and versions recorded in the lock file by `helmfile deps`
+	UseLock bool
+
+	// DiscoverEnvValues merges environments/<env>/*.yaml next to each helmfile into the values of the selected environment
+	DiscoverEnvValues bool
+
+	// DiscoverEnvSecrets decrypts secrets.<env>.yaml next to each helmfile via vals and merges it into the values of the selected environment
+	DiscoverEnvSecrets bool
+
+	// StrictReleaseMerge fails loading a helmfile whose parts define a release with different charts, instead of warning
+	StrictReleaseMerge bool
+
+	// MergeHelmfileDir loads all the helmfiles in the helmfile directory as one state, instead of one after another. See desiredStateLoader.LoadDir
+	MergeHelmfileDir bool
+
+	// NestedBases evaluates the bases of bases, recursively. See LoadOpts.NestedBases
+	NestedBases bool
+	// InheritHelmDefaults cascades the `helmDefaults` of helmfiles to the nested ones. See LoadOpts.InheritHelmDefaults
+	InheritHelmDefaults bool
+	// SkipBrokenSubHelmfiles skips the sub-helmfiles failed to load with warnings. See LoadOpts.SkipBrokenSubHelmfiles
+	SkipBrokenSubHelmfiles bool
+
+	// DebugRenderDir, when set, is the directory to write every rendered part of helmfiles to. See desiredStateLoader.DebugRenderDir
+	DebugRenderDir string
+	// Deterministic renders the randomized template functions in helmfiles deterministically. See desiredStateLoader.Deterministic
+	Deterministic bool
+	// DeterministicSeed is the secret seed of Deterministic. See desiredStateLoader.DeterministicSeed
+	DeterministicSeed string
+	// StrictTemplates fails rendering helmfiles printing `<no value>` for undefined values. See desiredStateLoader.StrictTemplates
+	StrictTemplates bool
+
+	// TemplateFuncs is the additional template functions available in all the rendered helmfiles. See LoadOpts.TemplateFuncs
+	TemplateFuncs template.FuncMap
+	// InlineValues is the state values given without values files when embedding helmfile. See LoadOpts.InlineValues
+	InlineValues map[string]interface{}
+	// ValuesTransform transforms the values of all the releases when embedding helmfile. See LoadOpts.ValuesTransform
+	ValuesTransform ValuesTransform
+
+	// HelmfileBinary is the path to the helmfile binary run by helm as the post-renderer stamping `commonLabels` and
+	// `commonAnnotations`. It must be set when embedding helmfile, as the running executable isn't helmfile then.
+	// See state.HelmState.HelmfileBinary
+	HelmfileBinary string
+	// ChartCacheDir is the directory to keep the downloaded charts in across runs. See state.HelmState.ChartCacheDir
+	ChartCacheDir string
+	// ClearChartCache removes all the charts in ChartCacheDir before loading the helmfiles, so that they are downloaded again
+	ClearChartCache   bool
+	chartCacheCleared bool
+
+	// releaseWebhook is the webhook posted to while running a command with ReleaseWebhookURL
+	releaseWebhook *state.ReleaseWebhook
+
+	// DefaultConcurrency caps the number of concurrent helm processes when no concurrency is specified. See state.HelmState.DefaultConcurrency
+	DefaultConcurrency int
+	// MaxConcurrency is the hard ceiling of the number of concurrent helm processes. See state.HelmState.MaxConcurrency
+	MaxConcurrency int
+	// MaxConcurrencyPerNamespace caps the number of releases processed at once per namespace. See state.HelmState.MaxConcurrencyPerNamespace
+	MaxConcurrencyPerNamespace int
+	// MaxDAGDepth fails planning releases into more groups than it. See state.HelmState.MaxDAGDepth
+	MaxDAGDepth int
+	// OrderedDispatch starts processing releases in the order of declaration. See state.HelmState.OrderedDispatch
+	OrderedDispatch bool
+	// Sequential processes releases one at a time in the order of declaration. See state.HelmState.Sequential
+	Sequential bool
+	// ChartFetchRetries retries fetching charts and updating repositories failed transiently. See state.HelmState.ChartFetchRetries
+	ChartFetchRetries int
+	// ReleaseWebhookURL, when set, is the URL to post the outcome of each operation on a release to. See state.ReleaseWebhook
+	ReleaseWebhookURL string
+	// HTTPHeaders is the headers added to every request fetching helmfiles by HTTP, in the form of `Name: value`. See remote.NewHTTP
+	HTTPHeaders []string
+	// HTTPCacheTTL is how long helmfiles fetched by HTTP are reused across runs. See remote.HTTP.CacheTTL
+	HTTPCacheTTL time.Duration
+	// ForceReload loads helmfiles from scratch, ignoring the states cached by the previous loads of the same helmfiles.
+	// See loadCache
+	ForceReload bool
+	// Redactor, when set, is given every value resolved from a reference to a secret via vals, to mask it in the logs.
+	// See helmexec.Redactor
+	Redactor *helmexec.Redactor
+
 	FileOrDir string
 
 	ErrorHandler func(error) error
@@ -48,11 +164,29 @@ type App struct {
 	abs               func(string) (string, error)
 	fileExistsAt      func(string) bool
 	directoryExistsAt func(string) bool
+	lookPath          func(string) (string, error)
+
+	getwd     func() (string, error)
+	chdir     func(string) error
+	writeFile func(string, []byte, os.FileMode) error
+	mkdirAll  func(string, os.FileMode) error
+
+	// readStdin reads the helmfile given via `--file -`. The content is read only once and cached in stdinContent,
+	// as the helmfile can be loaded more than once in a run
+	readStdin    func() ([]byte, error)
+	stdinContent []byte
 
-	getwd func() (string, error)
-	chdir func(string) error
+	// loadCache is shared with the copies of the app, like the reversed one, as the options affecting loading are part of its keys
+	loadCache *loadCache
+
+	// brokenSubHelmfiles is the sub-helmfiles skipped with SkipBrokenSubHelmfiles, shared with the copies of the app like loadCache
+	brokenSubHelmfiles *[]*SubHelmfileLoadError
+
+	// helmfilesWithoutEnv is the helmfiles skipped as they don't define the environment, shared with the copies of the app like loadCache
+	helmfilesWithoutEnv *[]string
 
 	remote *remote.Remote
+	http   *remote.HTTP
 
 	helmExecer helmexec.Interface
 
@@ -61,16 +195,60 @@ type App struct {
 
 func New(conf ConfigProvider) *App {
 	return Init(&App{
-		KubeContext: conf.KubeContext(),
-		Logger:      conf.Logger(),
-		Env:         conf.Env(),
-		Namespace:   conf.Namespace(),
-		Selectors:   conf.Selectors(),
+		KubeContext:  conf.KubeContext(),
+		KubeContexts: conf.KubeContexts(),
+		Logger:       conf.Logger(),
+		Env:          conf.Env(),
+		Namespace:    conf.Namespace(),
+		Selectors:    conf.Selectors(),
+
+		Groups:            conf.Groups(),
+		IncludeGroupNeeds: conf.IncludeGroupNeeds(),
+
 		HelmBinary:  conf.HelmBinary(),
 		Args:        conf.Args(),
 		FileOrDir:   conf.FileOrDir(),
 		ValuesFiles: conf.StateValuesFiles(),
 		Set:         conf.StateValuesSet(),
+
+		RestrictFileAccess: conf.RestrictFileAccess(),
+		AllowedDirs:        conf.AllowedDirs(),
+
+		ChartRewriter: NewPrefixChartRewriter(conf.ChartRewrites()),
+
+		UseLock: conf.UseLock(),
+
+		DiscoverEnvValues:  conf.DiscoverEnvValues(),
+		DiscoverEnvSecrets: conf.DiscoverEnvSecrets(),
+
+		StrictReleaseMerge:  conf.StrictReleaseMerge(),
+		MergeHelmfileDir:    conf.MergeHelmfileDir(),
+		NestedBases:         conf.NestedBases(),
+		InheritHelmDefaults: conf.InheritHelmDefaults(),
+
+		SkipBrokenSubHelmfiles: conf.SkipBrokenSubHelmfiles(),
+
+		DebugRenderDir:    conf.DebugRenderDir(),
+		Deterministic:     conf.Deterministic(),
+		DeterministicSeed: conf.DeterministicSeed(),
+		StrictTemplates:   conf.StrictTemplates(),
+
+		ChartCacheDir:   conf.ChartCacheDir(),
+		ClearChartCache: conf.ClearChartCache(),
+
+		DefaultConcurrency:         conf.DefaultConcurrency(),
+		MaxConcurrency:             conf.MaxConcurrency(),
+		MaxConcurrencyPerNamespace: conf.MaxConcurrencyPerNamespace(),
+		MaxDAGDepth:                conf.MaxDAGDepth(),
+		OrderedDispatch:            conf.OrderedDispatch(),
+		Sequential:                 conf.Sequential(),
+		ChartFetchRetries:          conf.ChartFetchRetries(),
+		ReleaseWebhookURL:          conf.ReleaseWebhookURL(),
+		ForceReload:                conf.ForceReload(),
+		HTTPHeaders:                conf.HTTPHeaders(),
+		HTTPCacheTTL:               conf.HTTPCacheTTL(),
+		Redactor:                   conf.Redactor(),
+
 		helmExecer: helmexec.New(conf.Logger(), conf.KubeContext(), &helmexec.ShellRunner{
 			Logger: conf.Logger(),
 		}),
@@ -79,19 +257,31 @@ func New(conf ConfigProvider) *App {
 
 func Init(app *App) *App {
 	app.readFile = ioutil.ReadFile
+	app.loadCache = &loadCache{}
+	app.brokenSubHelmfiles = &[]*SubHelmfileLoadError{}
+	app.helmfilesWithoutEnv = &[]string{}
 	app.glob = filepath.Glob
 	app.abs = filepath.Abs
 	app.getwd = os.Getwd
 	app.chdir = os.Chdir
+	app.writeFile = ioutil.WriteFile
+	app.mkdirAll = os.MkdirAll
 	app.fileExistsAt = fileExistsAt
 	app.fileExists = fileExists
 	app.directoryExistsAt = directoryExistsAt
+	app.lookPath = exec.LookPath
+	app.readStdin = func() ([]byte, error) {
+		return ioutil.ReadAll(os.Stdin)
+	}
 
 	var err error
 	app.valsRuntime, err = vals.New(valsCacheSize)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to initialize vals runtime: %v", err))
 	}
+	if app.Redactor != nil {
+		app.valsRuntime = &redactingEvaluator{Evaluator: app.valsRuntime, redactor: app.Redactor}
+	}
 
 	return app
 }
@@ -108,9 +298,10 @@ func (a *App) Repos(c ReposConfigProvider) error {
 	})
 }
 
-func (a *App) reverse() *App {
+func (a *App) reverse(sortKey string) *App {
 	new := *a
 	new.Reverse = true
+	new.ReverseSortKey = sortKey
 	return &new
 }
 
@@ -126,6 +317,131 @@ func (a *App) Diff(c DiffConfigProvider) error {
 	})
 }
 
+// Drift compares the desired manifest of each release against the live cluster state across all the helmfiles, and prints
+// the summary of the releases drifted from the desired state after their diffs. See state.DetectDrift for more details.
+//
+// The report is written as JSON to the report file when given, for monitoring. It exits with 2 when any release drifted
+// and none failed, like `helmfile diff --detailed-exitcode`.
+func (a *App) Drift(c DriftConfigProvider) error {
+	report := &state.DriftReport{}
+
+	err := a.ForEachState(func(run *Run) []error {
+		r, errs := run.Drift(c)
+		if r != nil {
+			report.Add(r.Releases...)
+		}
+		return errs
+	})
+
+	table := uitable.New()
+	table.AddRow("RELEASE", "NAMESPACE", "STATUS", "CHANGES")
+	for _, d := range report.Releases {
+		table.AddRow(d.Release, d.Namespace, string(d.Status), d.Changes)
+	}
+	fmt.Println(table.String())
+	fmt.Printf("\n%d releases drifted, %d in sync, %d failed\n", report.Drifted, report.InSync, report.Failed)
+
+	if path := c.ReportFile(); path != "" {
+		bs, jsonErr := json.MarshalIndent(report, "", "  ")
+		if jsonErr == nil {
+			jsonErr = a.writeFile(path, append(bs, '\n'), 0644)
+		}
+		if jsonErr != nil {
+			werr := appError(fmt.Sprintf("failed writing drift report to %s", path), jsonErr)
+			if a.ErrorHandler != nil {
+				return a.ErrorHandler(werr)
+			}
+			return werr
+		}
+	}
+
+	return err
+}
+
+// ValidateSchema validates the rendered manifests of each release against the OpenAPI schema of the Kubernetes API offline
+// across all the helmfiles, and prints the schema violations per release. See state.ValidateManifests for more details.
+//
+// The schema is read from the path or fetched from the HTTP(S) URL. The report is written as JSON to the report file when given.
+func (a *App) ValidateSchema(c ValidateSchemaConfigProvider) error {
+	sch, err := a.loadSchema(c.Schema())
+	if err != nil {
+		return appError(fmt.Sprintf("failed loading schema from %s", c.Schema()), err)
+	}
+
+	report := &state.ValidationReport{}
+
+	err = a.ForEachState(func(run *Run) []error {
+		r, errs := run.ValidateSchema(c, sch)
+		if r != nil {
+			report.Add(r.Releases...)
+		}
+		return errs
+	})
+
+	table := uitable.New()
+	table.AddRow("RELEASE", "NAMESPACE", "STATUS", "RESOURCES", "VIOLATIONS")
+	for _, v := range report.Releases {
+		table.AddRow(v.Release, v.Namespace, string(v.Status), v.Resources, len(v.Violations))
+	}
+	fmt.Println(table.String())
+
+	for _, v := range report.Releases {
+		for _, violation := range v.Violations {
+			fmt.Printf("%s: %s\n", v.Release, violation)
+		}
+		for _, kind := range v.Skipped {
+			a.Logger.Infof("%s: skipped validating %s not defined in the schema", v.Release, kind)
+		}
+	}
+	fmt.Printf("\n%d releases valid, %d invalid, %d failed\n", report.Valid, report.Invalid, report.Failed)
+
+	if path := c.ReportFile(); path != "" {
+		bs, jsonErr := json.MarshalIndent(report, "", "  ")
+		if jsonErr == nil {
+			jsonErr = a.writeFile(path, append(bs, '\n'), 0644)
+		}
+		if jsonErr != nil {
+			werr := appError(fmt.Sprintf("failed writing validation report to %s", path), jsonErr)
+			if a.ErrorHandler != nil {
+				return a.ErrorHandler(werr)
+			}
+			return werr
+		}
+	}
+
+	return err
+}
+
+func (a *App) loadSchema(location string) (*schema.Schema, error) {
+	if location == "" {
+		return nil, errors.New("no schema specified. set --schema to the path or the URL to the OpenAPI schema, like the output of `kubectl get --raw /openapi/v2`")
+	}
+
+	path := location
+
+	// Fetched as remote helmfiles are, so that the schema is fetched with --http-header and cached for --http-cache-ttl
+	if remote.IsHTTPURL(location) {
+		if a.http == nil {
+			if err := a.initRemote(); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		path, err = a.http.Locate(location)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bs, err := a.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return schema.Load(bs)
+}
+
 func (a *App) Template(c TemplateConfigProvider) error {
 	return a.ForEachState(func(run *Run) []error {
 		return run.Template(c)
@@ -157,17 +473,96 @@ func (a *App) Status(c StatusesConfigProvider) error {
 }
 
 func (a *App) Delete(c DeleteConfigProvider) error {
-	return a.reverse().ForEachState(func(run *Run) []error {
+	return a.reverse(c.ReverseSortKey()).ForEachState(func(run *Run) []error {
 		return run.Delete(c)
 	})
 }
 
 func (a *App) Destroy(c DestroyConfigProvider) error {
-	return a.reverse().ForEachState(func(run *Run) []error {
+	return a.reverse(c.ReverseSortKey()).ForEachState(func(run *Run) []error {
 		return run.Destroy(c)
 	})
 }
 
+// Prune lists the releases installed in the namespaces managed by the helmfiles, which match the label selector but are not defined
+// in any of the helmfiles, like the ones removed from the helmfiles since they were installed.
+// They are only listed by default, and uninstalled with Delete. See state.FindOrphanedReleases for more details.
+func (a *App) Prune(c PruneConfigProvider) error {
+	var defined, installed []state.ReleaseRef
+
+	// owners is the run that listed each installed release, to delete it with the connection flags of the helmfile
+	owners := map[state.ReleaseRef]*Run{}
+
+	// Reset to tell the helmfiles skipped in this run
+	a.helmfilesWithoutEnv = &[]string{}
+
+	err := a.ForEachState(func(run *Run) []error {
+		defined = append(defined, run.state.DefinedReleaseRefs()...)
+
+		listed, err := run.state.ListInstalledReleases(run.helm, c.LabelSelector())
+		if err != nil {
+			return []error{err}
+		}
+
+		for _, r := range listed {
+			if _, ok := owners[r]; !ok {
+				owners[r] = run
+				installed = append(installed, r)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	orphans := state.FindOrphanedReleases(defined, installed)
+
+	if len(orphans) == 0 {
+		a.Logger.Infof("No orphaned releases found in %d releases installed", len(installed))
+		return nil
+	}
+
+	table := uitable.New()
+	table.AddRow("NAME", "NAMESPACE", "KUBECONTEXT")
+	for _, o := range orphans {
+		table.AddRow(o.Name, o.Namespace, o.KubeContext)
+	}
+	fmt.Println(table.String())
+
+	if !c.Delete() {
+		a.Logger.Infof("%d orphaned releases found. run with --delete to uninstall them", len(orphans))
+		return nil
+	}
+
+	// Releases defined in the sub-helmfiles failed to load would be deleted as orphans
+	if broken := a.BrokenSubHelmfiles(); len(broken) > 0 {
+		return appError("refusing to delete orphaned releases", fmt.Errorf("%d sub-helmfiles failed to load, which may define them", len(broken)))
+	}
+
+	// So would the releases defined in the helmfiles skipped as they don't define the environment
+	if skipped := a.HelmfilesWithoutEnv(); len(skipped) > 0 {
+		return appError("refusing to delete orphaned releases", fmt.Errorf("%d helmfiles not defining the environment %q were skipped, which may define them: %s. please run it in an environment defined in all the helmfiles", len(skipped), a.Env, strings.Join(skipped, ", ")))
+	}
+
+	if c.Interactive() && !AskForConfirmation(fmt.Sprintf("Do you really want to uninstall the %d orphaned releases above?\n", len(orphans))) {
+		return nil
+	}
+
+	var errs []error
+	for _, o := range orphans {
+		run := owners[o]
+		errs = append(errs, run.state.DeleteOrphanedReleases(run.helm, []state.ReleaseRef{o})...)
+	}
+
+	if len(errs) > 0 {
+		return &Error{msg: "failed uninstalling orphaned releases", Errors: errs}
+	}
+
+	return nil
+}
+
 func (a *App) Test(c TestConfigProvider) error {
 	return a.ForEachState(func(run *Run) []error {
 		return run.Test(c)
@@ -177,7 +572,7 @@ func (a *App) Test(c TestConfigProvider) error {
 func (a *App) PrintState(c StateConfigProvider) error {
 
 	return a.ForEachState(func(run *Run) []error {
-		state, err := run.state.ToYaml()
+		state, err := run.state.Build()
 		if err != nil {
 			return []error{err}
 		}
@@ -186,19 +581,40 @@ func (a *App) PrintState(c StateConfigProvider) error {
 	})
 }
 
-func (a *App) ListReleases(c StateConfigProvider) error {
+func (a *App) ListReleases(c ListConfigProvider) error {
 	table := uitable.New()
-	table.AddRow("NAME", "NAMESPACE", "INSTALLED", "LABELS")
+	if c.Ordered() {
+		table.AddRow("NAME", "NAMESPACE", "INSTALLED", "LABELS", "GROUP")
+	} else {
+		table.AddRow("NAME", "NAMESPACE", "INSTALLED", "LABELS")
+	}
 
 	err := a.ForEachState(func(run *Run) []error {
-		//var releases m
-		for _, r := range run.state.Releases {
+		row := func(r state.ReleaseSpec) []interface{} {
 			labels := ""
 			for k, v := range r.Labels {
 				labels = fmt.Sprintf("%s,%s:%s", labels, k, v)
 			}
 			installed := r.Installed == nil || *r.Installed
-			table.AddRow(r.Name, r.Namespace, fmt.Sprintf("%t", installed), strings.Trim(labels, ","))
+			return []interface{}{r.Name, r.Namespace, fmt.Sprintf("%t", installed), strings.Trim(labels, ",")}
+		}
+
+		if !c.Ordered() {
+			for _, r := range run.state.Releases {
+				table.AddRow(row(r)...)
+			}
+			return []error{}
+		}
+
+		// Releases are listed in the order they would be synced, with the numbers of the groups of releases processed concurrently
+		groups, err := run.state.PlanReleases(nil, 0)
+		if err != nil {
+			return []error{err}
+		}
+		for i, group := range groups {
+			for _, r := range group {
+				table.AddRow(append(row(r), i+1)...)
+			}
 		}
 		return []error{}
 	})
@@ -206,6 +622,326 @@ func (a *App) ListReleases(c StateConfigProvider) error {
 	return err
 }
 
+// helmfilePlan is the groups of releases planned for a helmfile, serialized by Plan
+type helmfilePlan struct {
+	Helmfile string     `yaml:"helmfile"`
+	Groups   [][]string `yaml:"groups"`
+}
+
+// Plan prints the groups of releases in the order they would be synced for every helmfile, with the releases sorted
+// within each group, so that adding a release changes only the group it belongs to.
+//
+// When a golden file is given, it instead fails if the plan differs from the one in the golden file, so that unexpected
+// changes in the order of releases are caught in CI. The golden file is rewritten instead when requested.
+func (a *App) Plan(c PlanConfigProvider) error {
+	golden := c.Golden()
+	if c.UpdateGolden() && golden == "" {
+		return fmt.Errorf("err: --update-golden requires --golden")
+	}
+
+	wd, err := a.getwd()
+	if err != nil {
+		return err
+	}
+
+	var plans []helmfilePlan
+
+	err = a.ForEachState(func(run *Run) []error {
+		groups, err := run.state.PlanReleaseIDs()
+		if err != nil {
+			return []error{err}
+		}
+
+		helmfile, err := a.relativeHelmfilePath(wd, run.state)
+		if err != nil {
+			return []error{err}
+		}
+
+		plans = append(plans, helmfilePlan{
+			Helmfile: helmfile,
+			Groups:   groups,
+		})
+		return []error{}
+	})
+	if err != nil {
+		return err
+	}
+
+	actual, err := yaml.Marshal(plans)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case golden == "":
+		fmt.Print(string(actual))
+	case c.UpdateGolden():
+		if err := a.writeFile(golden, actual, 0644); err != nil {
+			return fmt.Errorf("failed writing plan to %s: %v", golden, err)
+		}
+		a.Logger.Infof("wrote plan to %s", golden)
+	default:
+		expected, err := a.readFile(golden)
+		if err != nil {
+			return fmt.Errorf("failed reading plan from %s: %v", golden, err)
+		}
+		if !bytes.Equal(expected, actual) {
+			return fmt.Errorf("plan differs from %s at %s. run with --update-golden to update it if the change is expected", golden, firstDifference(expected, actual))
+		}
+	}
+
+	return nil
+}
+
+// relativeHelmfilePath returns the path to the helmfile being visited, relative to the working directory wd the command was
+// run in. It is called while visiting the helmfile, as the working directory is changed to the one containing the helmfile.
+func (a *App) relativeHelmfilePath(wd string, st *state.HelmState) (string, error) {
+	dir, err := a.getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(filepath.Join(rel, filepath.Base(st.FilePath))), nil
+}
+
+// helmfileEnvironment is the values of an environment resolved for a helmfile, serialized by ListEnvironments
+type helmfileEnvironment struct {
+	Helmfile    string                 `yaml:"helmfile"`
+	Environment string                 `yaml:"environment"`
+	Values      map[string]interface{} `yaml:"values"`
+}
+
+// ListEnvironments prints the names of the environments defined in the top-level helmfiles, one per line, so that tools
+// can enumerate them without running anything. See state.HelmState.EnvironmentNames for the default environment.
+// Environments defined only in nested helmfiles are not listed, as selecting them skips the helmfiles including them.
+//
+// With values, it instead prints the values of every environment resolved for each helmfile defining it, including nested
+// ones, which requires loading the helmfiles once per environment.
+func (a *App) ListEnvironments(c EnvListConfigProvider) error {
+	env := a.Env
+	defer func() {
+		a.Env = env
+	}()
+
+	// The helmfiles are loaded with the default environment, which is always available, to read the environments defined
+	a.Env = state.DefaultEnv
+
+	if err := a.initRemote(); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	var names []string
+
+	err := a.visitStateFiles(a.FileOrDir, func(f, d string) error {
+		opts := a.loadOpts()
+		opts.CalleePath = f
+
+		st, err := a.loadDesiredStateFromYaml(f, opts)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range st.EnvironmentNames() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if a.ErrorHandler != nil {
+			return a.ErrorHandler(err)
+		}
+		return err
+	}
+
+	sort.Strings(names)
+
+	if !c.WithValues() {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	}
+
+	wd, err := a.getwd()
+	if err != nil {
+		return err
+	}
+
+	var envs []helmfileEnvironment
+
+	for _, name := range names {
+		a.Env = name
+
+		// Helmfiles not defining the environment are skipped while visiting them, which results in NoMatchingHelmfileError
+		// when the environment is defined only in some of the nested helmfiles
+		err := a.VisitDesiredStatesWithReleasesFiltered(a.FileOrDir, func(st *state.HelmState, _ helmexec.Interface) []error {
+			helmfile, err := a.relativeHelmfilePath(wd, st)
+			if err != nil {
+				return []error{err}
+			}
+
+			values := st.Env.Values
+			if values == nil {
+				values = map[string]interface{}{}
+			}
+
+			envs = append(envs, helmfileEnvironment{
+				Helmfile:    helmfile,
+				Environment: name,
+				Values:      values,
+			})
+			return []error{}
+		})
+		if _, ok := err.(*NoMatchingHelmfileError); err != nil && !ok {
+			if a.ErrorHandler != nil {
+				return a.ErrorHandler(err)
+			}
+			return err
+		}
+	}
+
+	out, err := yaml.Marshal(envs)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+
+	return nil
+}
+
+// ExportEnvironment prints the values of the selected environment as shell export lines, so that scripts can source them
+// like `eval "$(helmfile -e prod env export)"`. See shellExports for how the values are flattened.
+// When there are multiple top-level helmfiles, the values of all of them are printed in order, so that the later ones win.
+func (a *App) ExportEnvironment(c EnvExportConfigProvider) error {
+	if err := a.initRemote(); err != nil {
+		return err
+	}
+
+	var lines []string
+
+	err := a.visitStateFiles(a.FileOrDir, func(f, d string) error {
+		opts := a.loadOpts()
+		opts.CalleePath = f
+
+		st, err := a.loadDesiredStateFromYaml(f, opts)
+		if err != nil {
+			return err
+		}
+
+		exports, err := shellExports(st.Env.Values, c.Prefix())
+		if err != nil {
+			return fmt.Errorf("failed to export environment %q of %s: %v", a.Env, st.FilePath, err)
+		}
+
+		lines = append(lines, exports...)
+		return nil
+	})
+	if err != nil {
+		if a.ErrorHandler != nil {
+			return a.ErrorHandler(err)
+		}
+		return err
+	}
+
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+
+	return nil
+}
+
+// releaseValuesFileTemplateData is the data the output file template of WriteValues is rendered with
+type releaseValuesFileTemplateData struct {
+	Release     state.ReleaseSpec
+	Environment string
+}
+
+// WriteValues prints the values each selected release receives, merged from its values, secrets and `set` entries as done by
+// state.ReleaseValues, so that what a chart actually gets can be inspected without running helm against the cluster.
+//
+// When an output file template like `values/{{ .Release.Namespace }}/{{ .Release.Name }}.yaml` is given, the values of each
+// release are instead written to the file the template renders to.
+func (a *App) WriteValues(c WriteValuesConfigProvider) error {
+	var outputFile *template.Template
+	if c.OutputFileTemplate() != "" {
+		t, err := template.New("output-file-template").Parse(c.OutputFileTemplate())
+		if err != nil {
+			return fmt.Errorf("failed parsing output file template %q: %v", c.OutputFileTemplate(), err)
+		}
+		outputFile = t
+	}
+
+	return a.ForEachState(func(run *Run) []error {
+		st := run.state
+
+		for i := range st.Releases {
+			release := &st.Releases[i]
+			if !release.Desired() {
+				continue
+			}
+
+			values, err := st.ReleaseValues(run.helm, release)
+			if err != nil {
+				return []error{err}
+			}
+
+			out, err := yaml.Marshal(values)
+			if err != nil {
+				return []error{err}
+			}
+
+			if outputFile == nil {
+				fmt.Printf("---\n# Source: %s: %s\n%s", st.FilePath, release.Name, out)
+				continue
+			}
+
+			var buf bytes.Buffer
+			if err := outputFile.Execute(&buf, releaseValuesFileTemplateData{Release: *release, Environment: a.Env}); err != nil {
+				return []error{fmt.Errorf("failed rendering output file template for release %q: %v", release.Name, err)}
+			}
+			path := buf.String()
+
+			if err := a.mkdirAll(filepath.Dir(path), 0755); err != nil {
+				return []error{fmt.Errorf("failed writing values of release %q: %v", release.Name, err)}
+			}
+			if err := a.writeFile(path, out, 0644); err != nil {
+				return []error{fmt.Errorf("failed writing values of release %q: %v", release.Name, err)}
+			}
+			a.Logger.Infof("wrote values of release %q to %s", release.Name, path)
+		}
+
+		return []error{}
+	})
+}
+
+// firstDifference describes the first line differing between the expected and the actual content
+func firstDifference(expected, actual []byte) string {
+	e := strings.Split(string(expected), "\n")
+	a := strings.Split(string(actual), "\n")
+
+	for i := 0; i < len(e) || i < len(a); i++ {
+		var el, al string
+		if i < len(e) {
+			el = e[i]
+		}
+		if i < len(a) {
+			al = a[i]
+		}
+		if el != al {
+			return fmt.Sprintf("line %d: expected %q, got %q", i+1, el, al)
+		}
+	}
+
+	return "the end"
+}
+
 func (a *App) within(dir string, do func() error) error {
 	if dir == "." {
 		return do()
@@ -251,7 +987,7 @@ func (a *App) visitStateFiles(fileOrDir string, do func(string, string) error) e
 		var file string
 		var dir string
 		if a.directoryExistsAt(relPath) {
-			file = relPath
+			file = "."
 			dir = relPath
 		} else {
 			file = filepath.Base(relPath)
@@ -277,17 +1013,107 @@ func (a *App) visitStateFiles(fileOrDir string, do func(string, string) error) e
 }
 
 func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.HelmState, error) {
+	return a.loadDesiredStateFromYamlForEnv(file, a.Env, opts...)
+}
+
+// LoadAll loads the helmfile for each of the environments concurrently, at most `concurrency` at a time, or all at once when it is less than 1.
+// Each environment is loaded independently into its own state, so that CI can validate a helmfile across many environments quickly.
+//
+// It returns the states keyed by the names of the environments loaded successfully. When loading any of them failed,
+// it also returns a *LoadAllError keyed by the names of the failed ones.
+func (a *App) LoadAll(file string, envs []string, concurrency int, opts LoadOpts) (map[string]*state.HelmState, error) {
+	if file == StdinHelmfile && a.stdinContent == nil {
+		// Read stdin once up front, so that concurrent loads never race on reading it
+		content, err := a.readStdin()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading helmfile from stdin: %v", err)
+		}
+		a.stdinContent = content
+	}
+
+	if concurrency < 1 || concurrency > len(envs) {
+		concurrency = len(envs)
+	}
+
+	type result struct {
+		env string
+		st  *state.HelmState
+		err error
+	}
+
+	queue := make(chan string)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for env := range queue {
+				st, err := a.loadDesiredStateFromYamlForEnv(file, env, opts)
+				results <- result{env: env, st: st, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, env := range envs {
+			queue <- env
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	states := map[string]*state.HelmState{}
+	errs := map[string]error{}
+	for r := range results {
+		if r.err != nil {
+			errs[r.env] = r.err
+			continue
+		}
+		states[r.env] = r.st
+	}
+
+	if len(errs) > 0 {
+		return states, &LoadAllError{Errors: errs, Total: len(envs)}
+	}
+
+	return states, nil
+}
+
+func (a *App) loadDesiredStateFromYamlForEnv(file, env string, opts ...LoadOpts) (*state.HelmState, error) {
 	ld := &desiredStateLoader{
 		readFile:   a.readFile,
 		fileExists: a.fileExists,
-		env:        a.Env,
+		env:        env,
 		namespace:  a.Namespace,
 		logger:     a.Logger,
 		abs:        a.abs,
 
-		Reverse:     a.Reverse,
-		KubeContext: a.KubeContext,
+		Reverse:      a.Reverse,
+		KubeContext:  a.KubeContext,
+		KubeContexts: a.KubeContexts,
+
+		RestrictFileAccess: a.RestrictFileAccess,
+		AllowedDirs:        a.AllowedDirs,
+
+		ChartRewriter: a.ChartRewriter,
+
+		DiscoverEnvValues:  a.DiscoverEnvValues,
+		DiscoverEnvSecrets: a.DiscoverEnvSecrets,
+
+		StrictReleaseMerge: a.StrictReleaseMerge,
+
+		DebugRenderDir:    a.DebugRenderDir,
+		Deterministic:     a.Deterministic,
+		DeterministicSeed: a.DeterministicSeed,
+		StrictTemplates:   a.StrictTemplates,
+
 		glob:        a.glob,
+		writeFile:   a.writeFile,
+		mkdirAll:    a.mkdirAll,
+		lookPath:    a.lookPath,
 		helm:        a.helmExecer,
 		valsRuntime: a.valsRuntime,
 	}
@@ -297,7 +1123,107 @@ func (a *App) loadDesiredStateFromYaml(file string, opts ...LoadOpts) (*state.He
 		op = opts[0]
 	}
 
-	return ld.Load(file, op)
+	ld.TemplateFuncs = op.TemplateFuncs
+	ld.NestedBases = op.NestedBases
+	ld.SkipSubHelmfiles = op.SkipSubHelmfiles
+
+	if err := validateDocumentSeparator(op.DocumentSeparator); err != nil {
+		return nil, err
+	}
+	ld.DocumentSeparator = op.DocumentSeparator
+	ld.IsolateDocumentEnvironments = op.IsolateDocumentEnvironments
+
+	if a.http != nil {
+		// Files included by a helmfile fetched by HTTP are fetched relative to its URL
+		ld.readFile = a.http.ReadFileFunc(ld.readFile)
+		ld.fileExists = a.http.FileExistsFunc(ld.fileExists)
+		ld.glob = a.http.GlobFunc(ld.glob)
+	}
+
+	key, cacheable := a.loadCacheKey(file, env, op)
+
+	var st *state.HelmState
+	var inputs []LoadInput
+	if cacheable && !a.ForceReload {
+		st, inputs = a.loadCache.get(key, a.readFile, a.glob, a.fileExists)
+		if st != nil {
+			a.Logger.Debugf("reusing the state loaded from %s for environment %q, as none of its inputs has changed", file, env)
+		}
+	}
+
+	if st == nil {
+		var recorder *inputRecorder
+		if cacheable || a.LoadInputsSink != nil {
+			recorder = newInputRecorder(ld.readFile, ld.glob, ld.fileExists)
+			ld.readFile = recorder.readFile
+			ld.glob = recorder.glob
+			ld.fileExists = recorder.fileExists
+		}
+
+		var err error
+		if file == StdinHelmfile {
+			st, err = a.loadStdin(ld, op)
+		} else if a.directoryExistsAt != nil && a.directoryExistsAt(file) {
+			st, err = ld.LoadDir(file, op)
+		} else {
+			st, err = ld.Load(file, op)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if recorder != nil {
+			inputs = recorder.stop()
+		}
+
+		if cacheable {
+			a.loadCache.put(key, st, inputs)
+		}
+	}
+
+	if a.LoadInputsSink != nil {
+		a.LoadInputsSink(file, summarizeLoadInputs(append(append([]LoadInput{}, inputs...), releaseValuesInputs(st)...), a.abs))
+	}
+
+	st.PlanMetricsSink = a.PlanMetricsSink
+	st.ReleaseTimingsSink = a.ReleaseTimingsSink
+	st.BeforeRelease = a.BeforeRelease
+	st.AfterRelease = a.AfterRelease
+	st.ReleaseSkipped = a.ReleaseSkipped
+	st.UseLockedReleases = a.UseLock
+	st.ChartCacheDir = a.ChartCacheDir
+	st.HelmfileBinary = a.HelmfileBinary
+	if a.remote != nil {
+		st.RemoteFetcher = a.remote.Fetch
+	}
+	st.DefaultConcurrency = a.DefaultConcurrency
+	st.MaxConcurrency = a.MaxConcurrency
+	st.MaxConcurrencyPerNamespace = a.MaxConcurrencyPerNamespace
+	st.MaxDAGDepth = a.MaxDAGDepth
+	st.OrderedDispatch = a.OrderedDispatch
+	st.Sequential = a.Sequential
+	st.ChartFetchRetries = a.ChartFetchRetries
+	st.ReleaseWebhook = a.releaseWebhook
+
+	return st, nil
+}
+
+// loadStdin loads the helmfile read from stdin as if it were in the working directory.
+func (a *App) loadStdin(ld *desiredStateLoader, opts LoadOpts) (*state.HelmState, error) {
+	if a.stdinContent == nil {
+		content, err := a.readStdin()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading helmfile from stdin: %v", err)
+		}
+		a.stdinContent = content
+	}
+
+	dir, err := a.getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	return ld.LoadContent(a.stdinContent, dir, opts)
 }
 
 func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*state.HelmState, helmexec.Interface) (bool, []error)) error {
@@ -308,6 +1234,12 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 
 		if opts.CalleePath == "" {
 			opts.CalleePath = f
+
+			inherited, err := a.absOverrideValues(opts.Environment.OverrideValues)
+			if err != nil {
+				return err
+			}
+			opts.InheritedOverrideValues = inherited
 		}
 
 		st, err := a.loadDesiredStateFromYaml(f, opts)
@@ -338,23 +1270,51 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 			case *state.StateLoadError:
 				switch stateLoadErr.Cause.(type) {
 				case *state.UndefinedEnvError:
+					a.skipHelmfileWithoutEnv(filepath.Join(d, f))
 					return nil
-				default:
-					return ctx.wrapErrs(err)
 				}
-			default:
-				return ctx.wrapErrs(err)
 			}
+
+			// The top-level helmfile has no ancestors, and is never skipped
+			if opts.SkipBrokenSubHelmfiles && len(opts.AncestorPaths) > 0 {
+				a.skipBrokenSubHelmfile(&SubHelmfileLoadError{Path: filepath.Join(d, f), Parent: opts.CalleePath, Err: err})
+				return nil
+			}
+
+			return ctx.wrapErrs(err)
 		}
 		st.Selectors = opts.Selectors
 
-		if len(st.Helmfiles) > 0 {
+		visitSubHelmfiles := func() error {
+			if len(st.Helmfiles) == 0 || opts.SkipSubHelmfiles {
+				return nil
+			}
 			noMatchInSubHelmfiles := true
 			for i, m := range st.Helmfiles {
 				optsForNestedState := LoadOpts{
-					CalleePath:  filepath.Join(d, f),
-					Environment: m.Environment,
+					CalleePath:                  filepath.Join(d, f),
+					Environment:                 m.Environment,
+					Namespace:                   opts.Namespace,
+					InheritedOverrideValues:     opts.InheritedOverrideValues,
+					ReverseSortKey:              opts.ReverseSortKey,
+					TemplateFuncs:               opts.TemplateFuncs,
+					InlineValues:                opts.InlineValues,
+					NestedBases:                 opts.NestedBases,
+					InheritHelmDefaults:         opts.InheritHelmDefaults,
+					DocumentSeparator:           opts.DocumentSeparator,
+					IsolateDocumentEnvironments: opts.IsolateDocumentEnvironments,
+					ValuesTransform:             opts.ValuesTransform,
+					SkipBrokenSubHelmfiles:      opts.SkipBrokenSubHelmfiles,
+					AncestorPaths:               append(append([]string{}, opts.AncestorPaths...), filepath.Join(d, f)),
+				}
+				if m.Namespace != "" {
+					optsForNestedState.Namespace = m.Namespace
+				}
+				if opts.InheritHelmDefaults {
+					helmDefaults := st.HelmDefaults
+					optsForNestedState.ParentHelmDefaults = &helmDefaults
 				}
+				optsForNestedState.Environment.OverrideValues = append(append([]interface{}{}, m.Environment.OverrideValues...), opts.InheritedOverrideValues...)
 				//assign parent selector to sub helm selector in legacy mode or do not inherit in experimental mode
 				if (m.Selectors == nil && !isExplicitSelectorInheritanceEnabled()) || m.SelectorsInherited {
 					optsForNestedState.Selectors = opts.Selectors
@@ -374,15 +1334,32 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 				}
 			}
 			noMatchInHelmfiles = noMatchInHelmfiles && noMatchInSubHelmfiles
+			return nil
 		}
 
-		templated, tmplErr := st.ExecuteTemplates()
-		if tmplErr != nil {
-			return appError(fmt.Sprintf("failed executing release templates in \"%s\"", f), tmplErr)
+		convergeState := func() error {
+			templated, tmplErr := st.ExecuteTemplates()
+			if tmplErr != nil {
+				return appError(fmt.Sprintf("failed executing release templates in \"%s\"", f), tmplErr)
+			}
+			processed, errs := converge(templated, helm)
+			noMatchInHelmfiles = noMatchInHelmfiles && !processed
+			return context{a, templated}.clean(errs)
+		}
+
+		// Sub-helmfiles are processed before the releases in the parent helmfile.
+		// In the reverse mode like `helmfile destroy`, we do the opposite so that releases are torn down in the exact reverse order.
+		if a.Reverse {
+			if err := convergeState(); err != nil {
+				return err
+			}
+			return visitSubHelmfiles()
+		}
+
+		if err := visitSubHelmfiles(); err != nil {
+			return err
 		}
-		processed, errs := converge(templated, helm)
-		noMatchInHelmfiles = noMatchInHelmfiles && !processed
-		return context{a, templated}.clean(errs)
+		return convergeState()
 	})
 
 	if err != nil {
@@ -390,13 +1367,21 @@ func (a *App) visitStates(fileOrDir string, defOpts LoadOpts, converge func(*sta
 	}
 
 	if noMatchInHelmfiles {
-		return &NoMatchingHelmfileError{selectors: a.Selectors, env: a.Env}
+		return &NoMatchingHelmfileError{selectors: a.Selectors, groups: a.Groups, env: a.Env}
 	}
 
 	return nil
 }
 
 func (a *App) ForEachState(do func(*Run) []error) error {
+	if a.ReleaseWebhookURL != "" {
+		a.releaseWebhook = state.NewReleaseWebhook(a.ReleaseWebhookURL, a.Logger)
+		defer func() {
+			a.releaseWebhook.Close()
+			a.releaseWebhook = nil
+		}()
+	}
+
 	ctx := NewContext()
 	err := a.VisitDesiredStatesWithReleasesFiltered(a.FileOrDir, func(st *state.HelmState, helm helmexec.Interface) []error {
 		run := NewRun(st, helm, ctx)
@@ -404,6 +1389,14 @@ func (a *App) ForEachState(do func(*Run) []error) error {
 		return do(run)
 	})
 
+	if broken := a.BrokenSubHelmfiles(); len(broken) > 0 {
+		msgs := make([]string, len(broken))
+		for i, b := range broken {
+			msgs[i] = b.Error()
+		}
+		a.Logger.Warnf("skipped %d broken sub-helmfiles:\n%s", len(broken), strings.Join(msgs, "\n"))
+	}
+
 	if err != nil && a.ErrorHandler != nil {
 		return a.ErrorHandler(err)
 	}
@@ -411,27 +1404,95 @@ func (a *App) ForEachState(do func(*Run) []error) error {
 	return err
 }
 
-func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge func(*state.HelmState, helmexec.Interface) []error) error {
-	opts := LoadOpts{
-		Selectors: a.Selectors,
+// skipBrokenSubHelmfile warns and records the sub-helmfile failed to load, once even when it is visited more than once in a run
+func (a *App) skipBrokenSubHelmfile(broken *SubHelmfileLoadError) {
+	if a.brokenSubHelmfiles == nil {
+		a.brokenSubHelmfiles = &[]*SubHelmfileLoadError{}
 	}
 
-	envvals := []interface{}{}
+	for _, b := range *a.brokenSubHelmfiles {
+		if b.Path == broken.Path && b.Parent == broken.Parent {
+			return
+		}
+	}
 
-	if a.ValuesFiles != nil {
-		for i := range a.ValuesFiles {
-			envvals = append(envvals, a.ValuesFiles[i])
+	a.Logger.Warnf("skipping %s: %v", broken.Path, broken.Err)
+
+	*a.brokenSubHelmfiles = append(*a.brokenSubHelmfiles, broken)
+}
+
+// BrokenSubHelmfiles returns the sub-helmfiles skipped as they failed to load with SkipBrokenSubHelmfiles, in the order visited
+func (a *App) BrokenSubHelmfiles() []*SubHelmfileLoadError {
+	if a.brokenSubHelmfiles == nil {
+		return nil
+	}
+	return *a.brokenSubHelmfiles
+}
+
+// skipHelmfileWithoutEnv records the helmfile skipped as it doesn't define the environment, once even when it is visited more than once in a run
+func (a *App) skipHelmfileWithoutEnv(path string) {
+	if a.helmfilesWithoutEnv == nil {
+		a.helmfilesWithoutEnv = &[]string{}
+	}
+
+	for _, p := range *a.helmfilesWithoutEnv {
+		if p == path {
+			return
 		}
 	}
 
-	if a.Set != nil {
-		envvals = append(envvals, a.Set)
+	*a.helmfilesWithoutEnv = append(*a.helmfilesWithoutEnv, path)
+}
+
+// HelmfilesWithoutEnv returns the helmfiles skipped so far as they don't define the environment, in the order they were visited
+func (a *App) HelmfilesWithoutEnv() []string {
+	if a.helmfilesWithoutEnv == nil {
+		return nil
 	}
+	return *a.helmfilesWithoutEnv
+}
 
-	if len(envvals) > 0 {
-		opts.Environment.OverrideValues = envvals
+// clearChartCache removes ChartCacheDir when requested, only once even when the helmfiles are visited more than once in a run.
+func (a *App) clearChartCache() error {
+	if !a.ClearChartCache || a.chartCacheCleared {
+		return nil
+	}
+
+	if a.ChartCacheDir == "" {
+		return fmt.Errorf("err: --clear-chart-cache requires --chart-cache-dir")
+	}
+
+	a.Logger.Infof("clearing chart cache in %s", a.ChartCacheDir)
+
+	if err := os.RemoveAll(a.ChartCacheDir); err != nil {
+		return fmt.Errorf("failed clearing chart cache in %s: %v", a.ChartCacheDir, err)
+	}
+
+	a.chartCacheCleared = true
+
+	return nil
+}
+
+// absOverrideValues returns a copy of the override values whose paths to values files are made absolute,
+// so that they can be loaded from nested helmfiles in other directories.
+func (a *App) absOverrideValues(values []interface{}) ([]interface{}, error) {
+	var res []interface{}
+	for _, v := range values {
+		// References like `ref+k8s://...` are resolved by vals instead of being read from files
+		if path, ok := v.(string); ok && !strings.HasPrefix(path, state.ValsRefPrefix) {
+			abs, err := a.abs(state.ExpandPath(path))
+			if err != nil {
+				return nil, err
+			}
+			v = abs
+		}
+		res = append(res, v)
 	}
+	return res, nil
+}
 
+// initRemote prepares fetching remote helmfiles into the working directory
+func (a *App) initRemote() error {
 	dir, err := a.getwd()
 	if err != nil {
 		return err
@@ -439,7 +1500,7 @@ func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge
 
 	getter := &remote.GoGetter{Logger: a.Logger}
 
-	remote := &remote.Remote{
+	a.remote = &remote.Remote{
 		Logger:     a.Logger,
 		Home:       dir,
 		Getter:     getter,
@@ -448,10 +1509,68 @@ func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge
 		FileExists: a.fileExistsAt,
 	}
 
-	a.remote = remote
+	a.http, err = remote.NewHTTP(a.Logger, dir, a.HTTPHeaders, a.HTTPCacheTTL, a.abs)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// loadOpts returns the options to load the top-level helmfiles with
+func (a *App) loadOpts() LoadOpts {
+	opts := LoadOpts{
+		Selectors:           a.Selectors,
+		ReverseSortKey:      a.ReverseSortKey,
+		TemplateFuncs:       a.TemplateFuncs,
+		InlineValues:        a.InlineValues,
+		ValuesTransform:     a.ValuesTransform,
+		NestedBases:         a.NestedBases,
+		InheritHelmDefaults: a.InheritHelmDefaults,
+
+		SkipBrokenSubHelmfiles: a.SkipBrokenSubHelmfiles,
+	}
+
+	envvals := []interface{}{}
+
+	if a.ValuesFiles != nil {
+		for i := range a.ValuesFiles {
+			envvals = append(envvals, a.ValuesFiles[i])
+		}
+	}
+
+	if a.Set != nil {
+		envvals = append(envvals, a.Set)
+	}
+
+	if len(envvals) > 0 {
+		opts.Environment.OverrideValues = envvals
+	}
+
+	return opts
+}
+
+func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge func(*state.HelmState, helmexec.Interface) []error) error {
+	opts := a.loadOpts()
+
+	if err := a.clearChartCache(); err != nil {
+		return err
+	}
+
+	if err := a.initRemote(); err != nil {
+		return err
+	}
 
 	return a.visitStates(fileOrDir, opts, func(st *state.HelmState, helm helmexec.Interface) (bool, []error) {
-		if len(st.Selectors) > 0 {
+		st.SelectedGroups = a.Groups
+		st.IncludeGroupNeeds = a.IncludeGroupNeeds
+
+		// Needs are expanded regardless of selectors, as they are read by more than the planning, like `--incremental`
+		if err := st.ExpandLabelNeeds(); err != nil {
+			return false, []error{err}
+		}
+
+		if len(st.Selectors) > 0 || len(st.SelectedGroups) > 0 {
 			err := st.FilterReleases()
 			if err != nil {
 				return false, []error{err}
@@ -480,6 +1599,11 @@ func (a *App) VisitDesiredStatesWithReleasesFiltered(fileOrDir string, converge
 			}
 		}
 
+		// Only the selected releases are transformed, so that the values files of the others are never rendered
+		if err := transformValues(st, opts.ValuesTransform); err != nil {
+			return false, []error{err}
+		}
+
 		errs := converge(st, helm)
 
 		processed := len(st.Releases) != 0 && len(errs) == 0
@@ -505,7 +1629,17 @@ func (a *App) findStateFilesInAbsPaths(specifiedPath string) ([]string, error) {
 }
 
 func (a *App) findDesiredStateFiles(specifiedPath string) ([]string, error) {
-	path, err := a.remote.Locate(specifiedPath)
+	if specifiedPath == StdinHelmfile {
+		return []string{StdinHelmfile}, nil
+	}
+
+	var path string
+	var err error
+	if remote.IsHTTPURL(specifiedPath) {
+		path, err = a.http.Locate(specifiedPath)
+	} else {
+		path, err = a.remote.Locate(specifiedPath)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("locate: %v", err)
 	}
@@ -550,6 +1684,10 @@ func (a *App) findDesiredStateFiles(specifiedPath string) ([]string, error) {
 		}
 	}
 
+	if a.MergeHelmfileDir {
+		return []string{helmfileDir}, nil
+	}
+
 	files, err := a.glob(filepath.Join(helmfileDir, "*.y*ml"))
 	if err != nil {
 		return []string{}, err
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -12,15 +15,18 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"text/template"
 
 	"gotest.tools/assert"
 
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/remote"
 	"github.com/roboll/helmfile/pkg/state"
 	"github.com/roboll/helmfile/pkg/testhelper"
 	"github.com/variantdev/vals"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"gotest.tools/env"
 )
 
@@ -92,6 +98,79 @@ releases:
 	}
 }
 
+func TestVisitDesiredStatesWithReleasesFiltered_SkipBrokenSubHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- helmfile.d/a.yaml
+- helmfile.d/broken.yaml
+- helmfile.d/b.yaml
+releases:
+- name: zipkin
+  chart: stable/zipkin
+`,
+		"/path/to/helmfile.d/a.yaml": `
+releases:
+- name: prometheus
+  chart: stable/prometheus
+`,
+		"/path/to/helmfile.d/broken.yaml": `
+releases:
+- name: {{ .Values.undefined }}
+  chart: stable/broken
+`,
+		"/path/to/helmfile.d/b.yaml": `
+releases:
+- name: grafana
+  chart: stable/grafana
+`,
+	}
+
+	newApp := func(skip bool) *App {
+		return appWithFs(&App{
+			KubeContext:            "default",
+			Logger:                 helmexec.NewLogger(os.Stderr, "debug"),
+			Env:                    "default",
+			SkipBrokenSubHelmfiles: skip,
+		}, files)
+	}
+
+	var releases []string
+	collect := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			releases = append(releases, r.Name)
+		}
+		return []error{}
+	}
+
+	if err := newApp(false).VisitDesiredStatesWithReleasesFiltered("helmfile.yaml", collect); err == nil {
+		t.Fatalf("expected error loading the broken sub-helmfile")
+	}
+
+	releases = nil
+
+	app := newApp(true)
+	if err := app.VisitDesiredStatesWithReleasesFiltered("helmfile.yaml", collect); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"prometheus", "grafana", "zipkin"}
+	if !reflect.DeepEqual(releases, expected) {
+		t.Errorf("unexpected releases: expected=%v, actual=%v", expected, releases)
+	}
+
+	broken := app.BrokenSubHelmfiles()
+	if len(broken) != 1 {
+		t.Fatalf("unexpected broken sub-helmfiles: %v", broken)
+	}
+	if broken[0].Path != "/path/to/helmfile.d/broken.yaml" || broken[0].Parent != "/path/to/helmfile.yaml" {
+		t.Errorf("unexpected broken sub-helmfile: path=%s, parent=%s", broken[0].Path, broken[0].Parent)
+	}
+	if !strings.Contains(broken[0].Error(), "undefined") {
+		t.Errorf("unexpected error: %v", broken[0])
+	}
+}
+
 func TestVisitDesiredStatesWithReleasesFiltered_EnvValuesFileOrder(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
@@ -130,7 +209,8 @@ BAZ: 4
 		t.Errorf("unexpected error: %v", err)
 	}
 
-	expectedOrder := []string{"helmfile.yaml", "/path/to/env.1.yaml", "/path/to/env.2.yaml", "/path/to/env.1.yaml", "/path/to/env.2.yaml"}
+	// The env values files are read only once, as the helmfile contains no template action and is never rendered
+	expectedOrder := []string{"helmfile.yaml", "/path/to/env.1.yaml", "/path/to/env.2.yaml"}
 	actualOrder := fs.SuccessfulReads()
 	if !reflect.DeepEqual(actualOrder, expectedOrder) {
 		t.Errorf("unexpected order of processed state files: expected=%v, actual=%v", expectedOrder, actualOrder)
@@ -391,9 +471,9 @@ releases:
 		errMsg        string
 	}{
 		{label: "name=prometheus", expectedCount: 1, expectErr: false},
-		{label: "name=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name=. Expected label in form k=v or k!=v"},
-		{label: "name!=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name!=. Expected label in form k=v or k!=v"},
-		{label: "name", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name. Expected label in form k=v or k!=v"},
+		{label: "name=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name=. Expected label in form k=v, k!=v, k in (v1,v2) or k notin (v1,v2)"},
+		{label: "name!=", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name!=. Expected label in form k=v, k!=v, k in (v1,v2) or k notin (v1,v2)"},
+		{label: "name", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.d/a1.yaml: Malformed label: name. Expected label in form k=v, k!=v, k in (v1,v2) or k notin (v1,v2)"},
 		// See https://github.com/roboll/helmfile/issues/193
 		{label: "duplicated=yes", expectedCount: 0, expectErr: true, errMsg: "in ./helmfile.yaml: in .helmfiles[2]: in /path/to/helmfile.d/b.yaml: duplicate release \"foo\" found in \"zoo\": there were 2 releases named \"foo\" matching specified selector"},
 		{label: "duplicatedOK=yes", expectedCount: 2, expectErr: false},
@@ -850,6 +930,73 @@ releases:
 	}
 }
 
+func TestVisitDesiredStatesWithReleasesFiltered_ReverseOrder_NestedHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- helmfile.d/a*.yaml
+- helmfile.d/b*.yaml
+releases:
+- name: myapp
+  chart: charts/myapp
+`,
+		"/path/to/helmfile.d/a1.yaml": `
+helmfiles:
+- ../nested/c.yaml
+releases:
+- name: zipkin
+  chart: stable/zipkin
+`,
+		"/path/to/helmfile.d/b.yaml": `
+releases:
+- name: grafana
+  chart: stable/grafana
+- name: prometheus
+  chart: stable/prometheus
+`,
+		"/path/to/nested/c.yaml": `
+releases:
+- name: logging
+  chart: stable/fluentd
+`,
+	}
+
+	testcases := []struct {
+		reverse  bool
+		expected []string
+	}{
+		{reverse: false, expected: []string{"logging", "zipkin", "grafana", "prometheus", "myapp"}},
+		{reverse: true, expected: []string{"myapp", "prometheus", "grafana", "zipkin", "logging"}},
+	}
+	for _, testcase := range testcases {
+		actual := []string{}
+
+		collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+			for _, r := range st.Releases {
+				actual = append(actual, r.Name)
+			}
+			return []error{}
+		}
+		app := appWithFs(&App{
+			KubeContext: "default",
+			Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+			Reverse:     testcase.reverse,
+			Namespace:   "",
+			Selectors:   []string{},
+			Env:         "default",
+		}, files)
+		err := app.VisitDesiredStatesWithReleasesFiltered(
+			"helmfile.yaml", collectReleases,
+		)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(testcase.expected, actual) {
+			t.Errorf("releases did not match: expected=%v actual=%v", testcase.expected, actual)
+		}
+	}
+}
+
 func TestVisitDesiredStatesWithReleasesFiltered_EnvironmentValueOverrides(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
@@ -912,154 +1059,57 @@ bar: "bar1"
 	}
 }
 
-func TestVisitDesiredStatesWithReleasesFiltered_StateValueOverrides(t *testing.T) {
-	envTmplExpr := "{{ .Values.x.foo }}-{{ .Values.x.bar }}-{{ .Values.x.baz }}-{{ .Values.x.hoge }}-{{ .Values.x.fuga }}-{{ .Values.x.a | first | pluck \"b\" | first | first | pluck \"c\" | first }}"
-	relTmplExpr := "\"{{`{{ .Values.x.foo }}-{{ .Values.x.bar }}-{{ .Values.x.baz }}-{{ .Values.x.hoge }}-{{ .Values.x.fuga }}-{{ .Values.x.a | first | pluck \\\"b\\\" | first | first | pluck \\\"c\\\" | first }}`}}\""
-
-	testcases := []struct {
-		expr, env, expected string
-	}{
-		{
-			expr:     envTmplExpr,
-			env:      "default",
-			expected: "foo-bar_default-baz_override-hoge_set-fuga_set-C",
-		},
-		{
-			expr:     envTmplExpr,
-			env:      "production",
-			expected: "foo-bar_production-baz_override-hoge_set-fuga_set-C",
-		},
-		{
-			expr:     relTmplExpr,
-			env:      "default",
-			expected: "foo-bar_default-baz_override-hoge_set-fuga_set-C",
-		},
-		{
-			expr:     relTmplExpr,
-			env:      "production",
-			expected: "foo-bar_production-baz_override-hoge_set-fuga_set-C",
-		},
-	}
-	for i := range testcases {
-		testcase := testcases[i]
-		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
-			files := map[string]string{
-				"/path/to/helmfile.yaml": fmt.Sprintf(`
-# The top-level "values" are "base" values has inherited to state values with the lowest priority.
-# The lowest priority results in environment-specific values to override values defined in the base.
-values:
-- values.yaml
-
+func TestVisitDesiredStatesWithReleasesFiltered_StateValueOverrides_NestedHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
 environments:
   default:
     values:
-    - default.yaml
-  production:
-    values:
-    - production.yaml
----
+    - foo: parent
+      bar: parent
+helmfiles:
+- path: nested/helmfile.yaml
+  values:
+  - bar: fromparent
 releases:
-- name: %s
-  chart: %s
-  namespace: %s
-`, testcase.expr, testcase.expr, testcase.expr),
-				"/path/to/values.yaml": `
-x:
-  foo: foo
-  bar: bar
-  baz: baz
-  hoge: hoge
-  fuga: fuga
-  a: []
-`,
-				"/path/to/default.yaml": `
-x:
-  bar: "bar_default"
-  baz: "baz_default"
-  a:
-  - b: []
+- name: parent-{{ .Values.foo }}-{{ .Values.bar }}
+  chart: stable/zipkin
 `,
-				"/path/to/production.yaml": `
-x:
-  bar: "bar_production"
-  baz: "baz_production"
-  a:
-  - b: []
+		"/path/to/nested/helmfile.yaml": `
+environments:
+  default:
+    values:
+    - values.yaml
+releases:
+- name: child-{{ .Values.foo }}-{{ .Values.bar }}-{{ .Values.baz }}
+  chart: stable/grafana
 `,
-				"/path/to/overrides.yaml": `
-x:
-  baz: baz_override
-  hoge: hoge_override
-  a:
-  - b:
-    - c: C
+		"/path/to/nested/values.yaml": `
+foo: child
+bar: child
+baz: child
 `,
-			}
-
-			actual := []state.ReleaseSpec{}
-
-			collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
-				for _, r := range st.Releases {
-					actual = append(actual, r)
-				}
-				return []error{}
-			}
-			app := appWithFs(&App{
-				KubeContext: "default",
-				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
-				Reverse:     false,
-				Namespace:   "",
-				Selectors:   []string{},
-				Env:         testcase.env,
-				ValuesFiles: []string{"overrides.yaml"},
-				Set:         map[string]interface{}{"x": map[string]interface{}{"hoge": "hoge_set", "fuga": "fuga_set"}},
-			}, files)
-			err := app.VisitDesiredStatesWithReleasesFiltered(
-				"helmfile.yaml", collectReleases,
-			)
-			if err != nil {
-				t.Fatalf("unexpected error: %v", err)
-			}
-			if len(actual) != 1 {
-				t.Errorf("unexpected number of processed releases: expected=1, got=%d", len(actual))
-			}
-			if actual[0].Name != testcase.expected {
-				t.Errorf("unexpected name: expected=%s, got=%s", testcase.expected, actual[0].Name)
-			}
-			if actual[0].Chart != testcase.expected {
-				t.Errorf("unexpected chart: expected=%s, got=%s", testcase.expected, actual[0].Chart)
-			}
-			if actual[0].Namespace != testcase.expected {
-				t.Errorf("unexpected namespace: expected=%s, got=%s", testcase.expected, actual[0].Namespace)
-			}
-		})
-	}
-}
-
-func TestVisitDesiredStatesWithReleasesFiltered_ChartAtAbsPath(t *testing.T) {
-	files := map[string]string{
-		"/path/to/helmfile.yaml": `
-releases:
-- name: myapp
-  chart: /path/to/mychart
+		"/path/to/overrides.yaml": `
+baz: override
 `,
 	}
 
-	actual := []state.ReleaseSpec{}
+	actual := []string{}
 
 	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
 		for _, r := range st.Releases {
-			actual = append(actual, r)
+			actual = append(actual, r.Name)
 		}
 		return []error{}
 	}
 	app := appWithFs(&App{
 		KubeContext: "default",
 		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
-		Reverse:     false,
 		Namespace:   "",
-		Env:         "default",
 		Selectors:   []string{},
+		Env:         "default",
+		ValuesFiles: []string{"overrides.yaml"},
+		Set:         map[string]interface{}{"foo": "set"},
 	}, files)
 	err := app.VisitDesiredStatesWithReleasesFiltered(
 		"helmfile.yaml", collectReleases,
@@ -1067,48 +1117,281 @@ releases:
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if len(actual) != 1 {
-		t.Errorf("unexpected number of processed releases: expected=1, got=%d", len(actual))
-	}
-	if actual[0].Name != "myapp" {
-		t.Errorf("unexpected name: expected=%s, got=%s", "myapp", actual[0].Name)
-	}
-	if actual[0].Chart != "/path/to/mychart" {
-		t.Errorf("unexpected chart: expected=%s, got=%s", "/path/to/mychart", actual[0].Chart)
+
+	expected := []string{"child-set-fromparent-override", "parent-set-parent"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
 	}
 }
 
-func TestVisitDesiredStatesWithReleasesFiltered_RemoteTgzAsChart(t *testing.T) {
-	testcases := []struct {
-		expr, env, expected string
-	}{
-		{
-			expected: "https://github.com/arangodb/kube-arangodb/releases/download/0.3.11/kube-arangodb-crd.tgz",
-		},
+func TestVisitDesiredStatesWithReleasesFiltered_LayeredStateValueOverrides(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  default:
+    values:
+    - foo: env
+      bar: env
+      baz: env
+---
+releases:
+- name: {{ .Values.foo }}-{{ .Values.bar }}-{{ .Values.baz }}
+  chart: stable/zipkin
+`,
+		"/path/to/base.yaml": `
+foo: base
+bar: base
+baz: base
+`,
+		"/path/to/ci.yaml.gotmpl": `
+bar: ci_{{ .Values.foo }}
+baz: ci
+`,
 	}
-	for i := range testcases {
-		testcase := testcases[i]
-		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+
+	actual := []string{}
+
+	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, r.Name)
+		}
+		return []error{}
+	}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "",
+		Selectors:   []string{},
+		Env:         "default",
+		ValuesFiles: []string{"base.yaml", "ci.yaml.gotmpl"},
+		Set:         map[string]interface{}{"baz": "set"},
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectReleases,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"base-ci_base-set"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_NestedHelmfilesNamespace(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: nested/helmfile.yaml
+  namespace: ns1
+- path: nested/helmfile.yaml
+  namespace: ns2
+- path: nested/helmfile.yaml
+releases:
+- name: parent
+  chart: stable/zipkin
+`,
+		"/path/to/nested/helmfile.yaml": `
+helmfiles:
+- path: leaf/helmfile.yaml
+releases:
+- name: child
+  chart: stable/grafana
+`,
+		"/path/to/nested/leaf/helmfile.yaml": `
+releases:
+- name: leaf
+  chart: stable/grafana
+`,
+	}
+
+	actual := []string{}
+
+	collectNamespaces := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, fmt.Sprintf("%s/%s", st.Namespace, r.Name))
+		}
+		return []error{}
+	}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "default",
+		Selectors:   []string{},
+		Env:         "default",
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectNamespaces,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"ns1/leaf", "ns1/child",
+		"ns2/leaf", "ns2/child",
+		"default/leaf", "default/child",
+		"default/parent",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_ConditionalHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  default:
+  prod:
+    values:
+    - monitoring: true
+---
+helmfiles:
+- path: prod/helmfile.yaml
+  condition: {{ eq .Environment.Name "prod" }}
+- path: monitoring/helmfile.yaml
+  condition: '{{ "{{" }} .Values | get "monitoring" false {{ "}}" }}'
+- path: common/helmfile.yaml
+releases:
+- name: parent
+  chart: stable/zipkin
+`,
+		"/path/to/common/helmfile.yaml": `
+environments:
+  default:
+  prod:
+---
+releases:
+- name: common
+  chart: stable/grafana
+`,
+	}
+
+	testcases := []struct {
+		env      string
+		expected []string
+	}{
+		// The helmfiles excluded in the default environment are missing in the filesystem, so that loading them would fail
+		{env: "default", expected: []string{"common", "parent"}},
+		{env: "prod", expected: []string{"prod", "monitoring", "common", "parent"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.env, func(t *testing.T) {
+			fs := map[string]string{}
+			for k, v := range files {
+				fs[k] = v
+			}
+			if tc.env == "prod" {
+				fs["/path/to/prod/helmfile.yaml"] = "environments:\n  prod:\n---\nreleases:\n- name: prod\n  chart: stable/grafana\n"
+				fs["/path/to/monitoring/helmfile.yaml"] = "environments:\n  prod:\n---\nreleases:\n- name: monitoring\n  chart: stable/prometheus\n"
+			}
+
+			actual := []string{}
+
+			collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+				for _, r := range st.Releases {
+					actual = append(actual, r.Name)
+				}
+				return []error{}
+			}
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Namespace:   "",
+				Selectors:   []string{},
+				Env:         tc.env,
+			}, fs)
+			err := app.VisitDesiredStatesWithReleasesFiltered(
+				"helmfile.yaml", collectReleases,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("unexpected releases: expected=%v, got=%v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_ExcludedHelmfiles(t *testing.T) {
+	testcases := []struct {
+		name      string
+		helmfiles string
+		expected  []string
+	}{
+		{
+			name: "underscore-prefixed files are excluded from globs",
+			helmfiles: `
+helmfiles:
+- services/*.yaml
+`,
+			expected: []string{"a", "b", "c", "parent"},
+		},
+		{
+			name: "excludes",
+			helmfiles: `
+helmfiles:
+- path: services/*.yaml
+  excludes:
+  - services/b.yaml
+`,
+			expected: []string{"a", "c", "parent"},
+		},
+		{
+			name: "excludes with globs",
+			helmfiles: `
+helmfiles:
+- path: services/*.yaml
+  excludes:
+  - services/[bc].yaml
+`,
+			expected: []string{"a", "parent"},
+		},
+		{
+			name: "explicit path to an underscore-prefixed file",
+			helmfiles: `
+helmfiles:
+- services/a.yaml
+- services/_template.yaml
+`,
+			expected: []string{"a", "template", "parent"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
 			files := map[string]string{
-				"/path/to/helmfile.yaml": `
+				"/path/to/helmfile.yaml": tc.helmfiles + `
 releases:
-  - name: arangodb-crd
-    chart: https://github.com/arangodb/kube-arangodb/releases/download/0.3.11/kube-arangodb-crd.tgz
+- name: parent
+  chart: stable/zipkin
 `,
+				"/path/to/services/a.yaml": "releases:\n- name: a\n  chart: stable/a\n",
+				"/path/to/services/b.yaml": "releases:\n- name: b\n  chart: stable/b\n",
+				"/path/to/services/c.yaml": "releases:\n- name: c\n  chart: stable/c\n",
+				// The template fails to load unless it is explicitly included, so that it must be excluded before being loaded
+				"/path/to/services/_template.yaml": "releases:\n- name: {{ .Values.name | default \"template\" }}\n  chart: {{ required \"chart\" .Values.chart | default \"stable/template\" }}\n",
+			}
+			if strings.Contains(tc.helmfiles, "_template.yaml") {
+				files["/path/to/services/_template.yaml"] = "releases:\n- name: template\n  chart: stable/template\n"
 			}
 
-			actual := []state.ReleaseSpec{}
+			actual := []string{}
 
 			collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
 				for _, r := range st.Releases {
-					actual = append(actual, r)
+					actual = append(actual, r.Name)
 				}
 				return []error{}
 			}
 			app := appWithFs(&App{
 				KubeContext: "default",
 				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
-				Reverse:     false,
 				Namespace:   "",
 				Selectors:   []string{},
 				Env:         "default",
@@ -1119,1023 +1402,5762 @@ releases:
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
-			if len(actual) != 1 {
-				t.Errorf("unexpected number of processed releases: expected=1, got=%d", len(actual))
-			}
-			if actual[0].Chart != testcase.expected {
-				t.Errorf("unexpected chart: expected=%s, got=%s", testcase.expected, actual[0].Chart)
+
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("unexpected releases: expected=%v, got=%v", tc.expected, actual)
 			}
 		})
 	}
 }
 
-func TestLoadDesiredStateFromYaml_DuplicateReleaseName(t *testing.T) {
-	yamlFile := "example/path/to/yaml/file"
-	yamlContent := []byte(`releases:
-- name: myrelease1
-  chart: mychart1
-  labels:
-    stage: pre
-    foo: bar
-- name: myrelease1
-  chart: mychart2
-  labels:
-    stage: post
-`)
-	readFile := func(filename string) ([]byte, error) {
-		if filename != yamlFile {
-			return nil, fmt.Errorf("unexpected filename: %s", filename)
+func TestVisitDesiredStatesWithReleasesFiltered_ImportExports(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: db/helmfile.yaml
+  importExports: true
+  values:
+  - suffix: primary
+---
+releases:
+- name: app-{{ .Environment.Values.db.host }}
+  chart: stable/app
+`,
+		"/path/to/db/helmfile.yaml": `
+exports:
+  db:
+    host: db-{{ .Values.suffix }}
+releases:
+- name: db
+  chart: stable/mysql
+`,
+	}
+
+	actual := []string{}
+
+	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, r.Name)
 		}
-		return yamlContent, nil
+		return []error{}
 	}
-	app := &App{
-		readFile:    readFile,
-		glob:        filepath.Glob,
-		abs:         filepath.Abs,
+	app := appWithFs(&App{
 		KubeContext: "default",
-		Env:         "default",
 		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
-	}
-	_, err := app.loadDesiredStateFromYaml(yamlFile)
+		Namespace:   "",
+		Selectors:   []string{},
+		Env:         "default",
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectReleases,
+	)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"db", "app-db-primary"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
 	}
 }
 
-func TestLoadDesiredStateFromYaml_Bases(t *testing.T) {
-	yamlFile := "/path/to/yaml/file"
-	yamlContent := `bases:
-- ../base.yaml
-- ../base.gotmpl
+func TestVisitDesiredStatesWithReleasesFiltered_ImportExportsCycle(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: a/helmfile.yaml
+  importExports: true
+`,
+		"/path/to/a/helmfile.yaml": `
+helmfiles:
+- path: ../b/helmfile.yaml
+  importExports: true
+exports:
+  a: 1
+`,
+		"/path/to/b/helmfile.yaml": `
+helmfiles:
+- path: ../a/helmfile.yaml
+  importExports: true
+exports:
+  b: 1
+`,
+	}
 
-{{ readFile "templates.yaml" }}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "",
+		Selectors:   []string{},
+		Env:         "default",
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", func(st *state.HelmState, helm helmexec.Interface) []error { return nil },
+	)
+	if err == nil || !strings.Contains(err.Error(), "imports its own exports via helmfiles") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
 
-releases:
-- name: myrelease1
-  chart: mychart1
-  labels:
-    stage: pre
-    foo: bar
-- name: myrelease1
-  chart: mychart2
-  labels:
-    stage: post
-  <<: *default
-`
-	testFs := testhelper.NewTestFs(map[string]string{
-		yamlFile: yamlContent,
-		"/path/to/base.yaml": `environments:
+func TestVisitDesiredStatesWithReleasesFiltered_DebugRenderDir(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
   default:
     values:
-    - environments/default/1.yaml
+    - name: myapp
+---
+releases:
+- name: {{ .Environment.Values.name }}
+  chart: stable/zipkin
 `,
-		"/path/to/yaml/environments/default/1.yaml": `foo: FOO`,
-		"/path/to/base.gotmpl": `environments:
-  default:
-    values:
-    - environments/default/2.yaml
+	}
 
-helmDefaults:
-  tillerNamespace: {{ .Environment.Values.tillerNs }}
-`,
-		"/path/to/yaml/environments/default/2.yaml": `tillerNs: TILLER_NS`,
-		"/path/to/yaml/templates.yaml": `templates:
-  default: &default
-    missingFileHandler: Warn
-    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
-`,
-	})
-	app := &App{
-		readFile:     testFs.ReadFile,
-		glob:         testFs.Glob,
-		abs:          testFs.Abs,
-		fileExistsAt: testFs.FileExistsAt,
-		fileExists:   testFs.FileExists,
-		KubeContext:  "default",
-		Env:          "default",
-		Logger:       helmexec.NewLogger(os.Stderr, "debug"),
+	app := appWithFs(&App{
+		KubeContext:    "default",
+		Logger:         helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:      "",
+		Selectors:      []string{},
+		Env:            "default",
+		DebugRenderDir: "/debug",
+	}, files)
+
+	written := map[string]string{}
+	var dirs []string
+	app.writeFile = func(path string, content []byte, mode os.FileMode) error {
+		written[path] = string(content)
+		return nil
 	}
-	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	app.mkdirAll = func(path string, mode os.FileMode) error {
+		dirs = append(dirs, path)
+		return nil
+	}
+
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", func(st *state.HelmState, helm helmexec.Interface) []error { return nil },
+	)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
-		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	expected := map[string]string{
+		"/debug/path/to/helmfile.yaml.part.0": "\nenvironments:\n  default:\n    values:\n    - name: myapp",
+		"/debug/path/to/helmfile.yaml.part.1": "releases:\n- name: myapp\n  chart: stable/zipkin\n",
 	}
-
-	if *st.Releases[1].MissingFileHandler != "Warn" {
-		t.Errorf("unexpected releases[0].missingFileHandler: expected=Warn, got=%s", *st.Releases[1].MissingFileHandler)
+	if !reflect.DeepEqual(written, expected) {
+		t.Errorf("unexpected rendered parts written: expected=%v, got=%v", expected, written)
 	}
-
-	if st.Releases[1].Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
-		t.Errorf("unexpected releases[0].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", st.Releases[1].Values[0])
+	for _, d := range dirs {
+		if d != "/debug/path/to" {
+			t.Errorf("unexpected directory created: %s", d)
+		}
 	}
-
-	if st.FilePath != yamlFile {
-		t.Errorf("unexpected filePath: expected=%s, got=%s", yamlFile, st.FilePath)
+	if len(dirs) == 0 {
+		t.Error("the directory of the rendered parts must be created")
 	}
 }
 
-func TestLoadDesiredStateFromYaml_MultiPartTemplate(t *testing.T) {
-	yamlFile := "/path/to/yaml/file"
-	yamlContent := `bases:
-- ../base.yaml
----
-bases:
-- ../base.gotmpl
----
-helmDefaults:
-  kubeContext: {{ .Environment.Values.foo }}
+func TestVisitDesiredStatesWithReleasesFiltered_EnvironmentsDirective(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  default:
+  prod:
 ---
+# helmfile: environments=prod
+{{ if ne .Environment.Name "prod" }}{{ fail "must not be rendered outside prod" }}{{ end }}
 releases:
-- name: myrelease0
-  chart: mychart0
+- name: prod-only
+  chart: stable/zipkin
 ---
 
-{{ readFile "templates.yaml" }}
-
+# the directive can follow other comments
+# helmfile: environments=default, staging
 releases:
-- name: myrelease1
-  chart: mychart1
-  labels:
-    stage: pre
-    foo: bar
-- name: myrelease1
-  chart: mychart2
-  labels:
-    stage: post
-  <<: *default
-`
-	testFs := testhelper.NewTestFs(map[string]string{
-		yamlFile: yamlContent,
-		"/path/to/base.yaml": `environments:
-  default:
-    values:
-    - environments/default/1.yaml
-`,
-		"/path/to/yaml/environments/default/1.yaml": `foo: FOO`,
-		"/path/to/base.gotmpl": `environments:
-  default:
-    values:
-    - environments/default/2.yaml
-
-helmDefaults:
-  tillerNamespace: {{ .Environment.Values.tillerNs }}
-`,
-		"/path/to/yaml/environments/default/2.yaml": `tillerNs: TILLER_NS`,
-		"/path/to/yaml/templates.yaml": `templates:
-  default: &default
-    missingFileHandler: Warn
-    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+- name: non-prod
+  chart: stable/zipkin
+---
+releases:
+- name: common
+  chart: stable/zipkin
 `,
-	})
-	app := &App{
-		readFile:   testFs.ReadFile,
-		fileExists: testFs.FileExists,
-		glob:       testFs.Glob,
-		abs:        testFs.Abs,
-		Env:        "default",
-		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
-	}
-	st, err := app.loadDesiredStateFromYaml(yamlFile)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
 	}
 
-	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
-		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
-	}
-	firstRelease := st.Releases[0]
-	if firstRelease.Name != "myrelease1" {
-		t.Errorf("unexpected releases[1].name: expected=myrelease1, got=%s", firstRelease.Name)
-	}
-	secondRelease := st.Releases[1]
-	if secondRelease.Name != "myrelease1" {
-		t.Errorf("unexpected releases[2].name: expected=myrelease1, got=%s", secondRelease.Name)
-	}
-	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
-		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
-	}
-	if *secondRelease.MissingFileHandler != "Warn" {
-		t.Errorf("unexpected releases[2].missingFileHandler: expected=Warn, got=%s", *firstRelease.MissingFileHandler)
+	testcases := []struct {
+		env      string
+		expected []string
+	}{
+		{env: "default", expected: []string{"non-prod", "common"}},
+		{env: "prod", expected: []string{"prod-only", "common"}},
 	}
 
-	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
-		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
-	}
+	for _, tc := range testcases {
+		t.Run(tc.env, func(t *testing.T) {
+			actual := []string{}
 
-	if st.HelmDefaults.KubeContext != "FOO" {
-		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+			collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+				for _, r := range st.Releases {
+					actual = append(actual, r.Name)
+				}
+				return []error{}
+			}
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Namespace:   "",
+				Selectors:   []string{},
+				Env:         tc.env,
+			}, files)
+			err := app.VisitDesiredStatesWithReleasesFiltered(
+				"helmfile.yaml", collectReleases,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("unexpected releases: expected=%v, got=%v", tc.expected, actual)
+			}
+		})
 	}
 }
 
-func TestLoadDesiredStateFromYaml_EnvvalsInheritanceToBaseTemplate(t *testing.T) {
-	yamlFile := "/path/to/yaml/file"
-	yamlContent := `bases:
-- ../base.yaml
----
-bases:
-# "envvals inheritance"
-# base.gotmpl should be able to reference environment values defined in the base.yaml and default/1.yaml
-- ../base.gotmpl
----
+func TestVisitDesiredStatesWithReleasesFiltered_NestedHelmfilesReleaseBaseDir(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: apps/helmfile.yaml
 releases:
-- name: myrelease0
-  chart: mychart0
-`
-	testFs := testhelper.NewTestFs(map[string]string{
-		yamlFile: yamlContent,
-		"/path/to/base.yaml": `environments:
-  default:
-    values:
-    - environments/default/1.yaml
-`,
-		"/path/to/base.gotmpl": `helmDefaults:
-  kubeContext: {{ .Environment.Values.foo }}
-  tillerNamespace: {{ .Environment.Values.tillerNs }}
+- name: parent
+  chart: stable/zipkin
+  values:
+  - values.yaml
 `,
-		"/path/to/yaml/environments/default/1.yaml": `tillerNs: TILLER_NS
-foo: FOO
+		"/path/to/apps/helmfile.yaml": `
+bases:
+- ../common/releases.yaml
+releases:
+- name: app
+  chart: stable/grafana
+  values:
+  - values.yaml
 `,
-		"/path/to/yaml/templates.yaml": `templates:
-  default: &default
-    missingFileHandler: Warn
-    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+		"/path/to/common/releases.yaml": `
+releases:
+- name: common
+  chart: stable/prometheus
+  values:
+  - values.yaml
 `,
-	})
-	app := &App{
-		readFile:   testFs.ReadFile,
-		fileExists: testFs.FileExists,
-		glob:       testFs.Glob,
-		abs:        testFs.Abs,
-		Env:        "default",
-		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
 	}
-	st, err := app.loadDesiredStateFromYaml(yamlFile)
+
+	actual := map[string]string{}
+
+	collectValuesFiles := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			// Relative paths are resolved against the working directory, which is the directory of the helmfile being visited
+			actual[r.Name] = filepath.Join(r.BaseDir, r.Values[0].(string))
+		}
+		return []error{}
+	}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "",
+		Selectors:   []string{},
+		Env:         "default",
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectValuesFiles,
+	)
 	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
-		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	expected := map[string]string{
+		"parent": "values.yaml",
+		"app":    "values.yaml",
+		"common": "../common/values.yaml",
 	}
-
-	if st.Releases[0].Name != "myrelease0" {
-		t.Errorf("unexpected releases[0].name: expected=myrelease0, got=%s", st.Releases[0].Name)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected values files: expected=%v, got=%v", expected, actual)
 	}
+}
 
-	if st.HelmDefaults.KubeContext != "FOO" {
-		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+func TestVisitDesiredStatesWithReleasesFiltered_Stdin(t *testing.T) {
+	files := map[string]string{
+		"/path/to/nested/helmfile.yaml": `
+releases:
+- name: nested
+  chart: stable/grafana
+`,
 	}
-}
 
-func TestLoadDesiredStateFromYaml_InlineEnvVals(t *testing.T) {
-	yamlFile := "/path/to/yaml/file"
-	yamlContent := `bases:
-- ../base.yaml
----
-bases:
-# "envvals inheritance"
-# base.gotmpl should be able to reference environment values defined in the base.yaml and default/1.yaml
-- ../base.gotmpl
+	stdin := `
+environments:
+  default:
+    values:
+    - name: fromenv
 ---
+helmfiles:
+- nested/helmfile.yaml
 releases:
-- name: myrelease0
-  chart: mychart0
+- name: {{ .Values.name }}
+  chart: stable/zipkin
 `
-	testFs := testhelper.NewTestFs(map[string]string{
-		yamlFile: yamlContent,
-		"/path/to/base.yaml": `environments:
-  default:
-    values:
-    - environments/default/1.yaml
-    - tillerNs: INLINE_TILLER_NS
-`,
-		"/path/to/base.gotmpl": `helmDefaults:
-  kubeContext: {{ .Environment.Values.foo }}
-  tillerNamespace: {{ .Environment.Values.tillerNs }}
-`,
-		"/path/to/yaml/environments/default/1.yaml": `tillerNs: TILLER_NS
-foo: FOO
-`,
-		"/path/to/yaml/templates.yaml": `templates:
-  default: &default
-    missingFileHandler: Warn
-    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
-`,
-	})
-	app := &App{
-		readFile:   testFs.ReadFile,
-		fileExists: testFs.FileExists,
-		glob:       testFs.Glob,
-		abs:        testFs.Abs,
-		Env:        "default",
-		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
-	}
-	st, err := app.loadDesiredStateFromYaml(yamlFile)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+
+	actual := []string{}
+
+	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, r.Name)
+		}
+		return []error{}
 	}
+	reads := 0
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+		readStdin: func() ([]byte, error) {
+			reads++
+			return []byte(stdin), nil
+		},
+	}, files)
 
-	if st.HelmDefaults.TillerNamespace != "INLINE_TILLER_NS" {
-		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	for i := 0; i < 2; i++ {
+		err := app.VisitDesiredStatesWithReleasesFiltered(
+			"-", collectReleases,
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
 	}
 
-	if st.Releases[0].Name != "myrelease0" {
-		t.Errorf("unexpected releases[0].name: expected=myrelease0, got=%s", st.Releases[0].Name)
+	expected := []string{"nested", "fromenv", "nested", "fromenv"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
 	}
 
-	if st.HelmDefaults.KubeContext != "FOO" {
-		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+	if reads != 1 {
+		t.Errorf("unexpected number of reads from stdin: expected=1, got=%d", reads)
 	}
 }
 
-func TestLoadDesiredStateFromYaml_MultiPartTemplate_WithNonDefaultEnv(t *testing.T) {
-	yamlFile := "/path/to/yaml/file"
-	yamlContent := `bases:
-- ../base.yaml
----
-bases:
-- ../base.gotmpl
----
-helmDefaults:
-  kubeContext: {{ .Environment.Values.foo }}
----
-releases:
-- name: myrelease0
-  chart: mychart0
----
+func TestVisitDesiredStatesWithReleasesFiltered_ClearChartCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "helmfile-chart-cache-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
 
-{{ readFile "templates.yaml" }}
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "stale"), []byte{}, 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
 releases:
-- name: myrelease1
-  chart: mychart1
-  labels:
-    stage: pre
-    foo: bar
-- name: myrelease1
-  chart: mychart2
-  labels:
-    stage: post
-  <<: *default
-`
-	testFs := testhelper.NewTestFs(map[string]string{
-		yamlFile: yamlContent,
-		"/path/to/base.yaml": `environments:
-  test:
-    values:
-    - environments/default/1.yaml
+- name: zipkin
+  chart: stable/zipkin
+  version: 1.0.0
 `,
-		"/path/to/yaml/environments/default/1.yaml": `foo: FOO`,
-		"/path/to/base.gotmpl": `environments:
-  test:
-    values:
-    - environments/default/2.yaml
+	}
 
-helmDefaults:
-  tillerNamespace: {{ .Environment.Values.tillerNs }}
-`,
-		"/path/to/yaml/environments/default/2.yaml": `tillerNs: TILLER_NS`,
-		"/path/to/yaml/templates.yaml": `templates:
-  default: &default
-    missingFileHandler: Warn
-    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
-`,
+	var cacheDirs []string
+	app := appWithFs(&App{
+		KubeContext:     "default",
+		Logger:          helmexec.NewLogger(os.Stderr, "debug"),
+		Env:             "default",
+		ChartCacheDir:   cacheDir,
+		ClearChartCache: true,
+	}, files)
+	err = app.VisitDesiredStatesWithReleasesFiltered("helmfile.yaml", func(st *state.HelmState, helm helmexec.Interface) []error {
+		cacheDirs = append(cacheDirs, st.ChartCacheDir)
+		return []error{}
 	})
-	app := &App{
-		readFile:   testFs.ReadFile,
-		fileExists: testFs.FileExists,
-		glob:       testFs.Glob,
-		abs:        testFs.Abs,
-		Env:        "test",
-		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
-	}
-	st, err := app.loadDesiredStateFromYaml(yamlFile)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
-		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
-	}
-
-	firstRelease := st.Releases[0]
-	if firstRelease.Name != "myrelease1" {
-		t.Errorf("unexpected releases[1].name: expected=myrelease1, got=%s", firstRelease.Name)
-	}
-	secondRelease := st.Releases[1]
-	if secondRelease.Name != "myrelease1" {
-		t.Errorf("unexpected releases[2].name: expected=myrelease1, got=%s", secondRelease.Name)
-	}
-	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
-		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
-	}
-	if *secondRelease.MissingFileHandler != "Warn" {
-		t.Errorf("unexpected releases[2].missingFileHandler: expected=Warn, got=%s", *firstRelease.MissingFileHandler)
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("chart cache is not cleared: %v", err)
 	}
-
-	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
-		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
+	if want := []string{cacheDir}; !reflect.DeepEqual(cacheDirs, want) {
+		t.Errorf("unexpected chart cache dirs: want %v, got %v", want, cacheDirs)
 	}
 
-	if st.HelmDefaults.KubeContext != "FOO" {
-		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+	app.ChartCacheDir = ""
+	app.chartCacheCleared = false
+	err = app.VisitDesiredStatesWithReleasesFiltered("helmfile.yaml", func(st *state.HelmState, helm helmexec.Interface) []error {
+		return []error{}
+	})
+	if err == nil || !strings.Contains(err.Error(), "--clear-chart-cache requires --chart-cache-dir") {
+		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestLoadDesiredStateFromYaml_MultiPartTemplate_WithReverse(t *testing.T) {
-	yamlFile := "/path/to/yaml/file"
-	yamlContent := `
-{{ readFile "templates.yaml" }}
-
-releases:
-- name: myrelease0
-  chart: mychart0
-- name: myrelease1
-  chart: mychart1
-  <<: *default
----
-
-{{ readFile "templates.yaml" }}
-
-releases:
-- name: myrelease2
-  chart: mychart2
-- name: myrelease3
-  chart: mychart3
-  <<: *default
-`
-	testFs := testhelper.NewTestFs(map[string]string{
-		yamlFile: yamlContent,
-		"/path/to/yaml/templates.yaml": `templates:
-  default: &default
-    missingFileHandler: Warn
-    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+func TestVisitDesiredStatesWithReleasesFiltered_RecursiveHelmfiles(t *testing.T) {
+	testcases := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			name: "glob matching itself",
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+helmfiles:
+- ./*.yaml
 `,
-	})
-	app := &App{
-		readFile: testFs.ReadFile,
-		glob:     testFs.Glob,
-		abs:      testFs.Abs,
-		Env:      "default",
-		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
-		Reverse:  true,
-	}
-	st, err := app.loadDesiredStateFromYaml(yamlFile)
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+			},
+			expected: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.yaml: helmfile /path/to/helmfile.yaml includes itself via helmfiles: /path/to/helmfile.yaml -> /path/to/helmfile.yaml. please fix the paths or globs in helmfiles not to match it",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"/path/to/helmfile.yaml": `
+helmfiles:
+- nested/helmfile.yaml
+`,
+				"/path/to/nested/helmfile.yaml": `
+helmfiles:
+- ../helmfile.yaml
+`,
+			},
+			expected: "in ./helmfile.yaml: in .helmfiles[0]: in /path/to/nested/helmfile.yaml: in .helmfiles[0]: in /path/to/helmfile.yaml: helmfile /path/to/helmfile.yaml includes itself via helmfiles: /path/to/helmfile.yaml -> /path/to/nested/helmfile.yaml -> /path/to/helmfile.yaml. please fix the paths or globs in helmfiles not to match it",
+		},
 	}
 
-	if st.Releases[0].Name != "myrelease3" {
-		t.Errorf("unexpected releases[0].name: expected=myrelease3, got=%s", st.Releases[0].Name)
-	}
-	if st.Releases[1].Name != "myrelease2" {
-		t.Errorf("unexpected releases[0].name: expected=myrelease2, got=%s", st.Releases[1].Name)
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			noop := func(st *state.HelmState, helm helmexec.Interface) []error {
+				return []error{}
+			}
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Namespace:   "",
+				Selectors:   []string{},
+				Env:         "default",
+			}, tc.files)
+			err := app.VisitDesiredStatesWithReleasesFiltered("helmfile.yaml", noop)
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("unexpected error: expected=%s, got=%v", tc.expected, err)
+			}
+		})
 	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_StateValueOverrides(t *testing.T) {
+	envTmplExpr := "{{ .Values.x.foo }}-{{ .Values.x.bar }}-{{ .Values.x.baz }}-{{ .Values.x.hoge }}-{{ .Values.x.fuga }}-{{ .Values.x.a | first | pluck \"b\" | first | first | pluck \"c\" | first }}"
+	relTmplExpr := "\"{{`{{ .Values.x.foo }}-{{ .Values.x.bar }}-{{ .Values.x.baz }}-{{ .Values.x.hoge }}-{{ .Values.x.fuga }}-{{ .Values.x.a | first | pluck \\\"b\\\" | first | first | pluck \\\"c\\\" | first }}`}}\""
 
-	if len(st.Releases) != 2 {
-		t.Errorf("unexpected number of releases: expected=2, got=%d", len(st.Releases))
+	testcases := []struct {
+		expr, env, expected string
+	}{
+		{
+			expr:     envTmplExpr,
+			env:      "default",
+			expected: "foo-bar_default-baz_override-hoge_set-fuga_set-C",
+		},
+		{
+			expr:     envTmplExpr,
+			env:      "production",
+			expected: "foo-bar_production-baz_override-hoge_set-fuga_set-C",
+		},
+		{
+			expr:     relTmplExpr,
+			env:      "default",
+			expected: "foo-bar_default-baz_override-hoge_set-fuga_set-C",
+		},
+		{
+			expr:     relTmplExpr,
+			env:      "production",
+			expected: "foo-bar_production-baz_override-hoge_set-fuga_set-C",
+		},
 	}
-}
+	for i := range testcases {
+		testcase := testcases[i]
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": fmt.Sprintf(`
+# The top-level "values" are "base" values has inherited to state values with the lowest priority.
+# The lowest priority results in environment-specific values to override values defined in the base.
+values:
+- values.yaml
 
-// See https://github.com/roboll/helmfile/issues/615
-func TestLoadDesiredStateFromYaml_MultiPartTemplate_NoMergeArrayInEnvVal(t *testing.T) {
-	statePath := "/path/to/helmfile.yaml"
-	stateContent := `
-environments:
-  default:
-    values:
-    - foo: ["foo"]
----
 environments:
   default:
     values:
-    - foo: ["FOO"]
-    - 1.yaml
----
-environments:
-  default:
+    - default.yaml
+  production:
     values:
-    - 2.yaml
+    - production.yaml
 ---
 releases:
-- name: {{ .Environment.Values.foo | quote }}
-  chart: {{ .Environment.Values.bar | quote }}
-`
-	testFs := testhelper.NewTestFs(map[string]string{
-		statePath:         stateContent,
-		"/path/to/1.yaml": `bar: ["bar"]`,
-		"/path/to/2.yaml": `bar: ["BAR"]`,
-	})
-	app := &App{
-		readFile: testFs.ReadFile,
-		glob:     testFs.Glob,
-		abs:      testFs.Abs,
-		Env:      "default",
-		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
-		Reverse:  true,
+- name: %s
+  chart: %s
+  namespace: %s
+`, testcase.expr, testcase.expr, testcase.expr),
+				"/path/to/values.yaml": `
+x:
+  foo: foo
+  bar: bar
+  baz: baz
+  hoge: hoge
+  fuga: fuga
+  a: []
+`,
+				"/path/to/default.yaml": `
+x:
+  bar: "bar_default"
+  baz: "baz_default"
+  a:
+  - b: []
+`,
+				"/path/to/production.yaml": `
+x:
+  bar: "bar_production"
+  baz: "baz_production"
+  a:
+  - b: []
+`,
+				"/path/to/overrides.yaml": `
+x:
+  baz: baz_override
+  hoge: hoge_override
+  a:
+  - b:
+    - c: C
+`,
+			}
+
+			actual := []state.ReleaseSpec{}
+
+			collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+				for _, r := range st.Releases {
+					actual = append(actual, r)
+				}
+				return []error{}
+			}
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Reverse:     false,
+				Namespace:   "",
+				Selectors:   []string{},
+				Env:         testcase.env,
+				ValuesFiles: []string{"overrides.yaml"},
+				Set:         map[string]interface{}{"x": map[string]interface{}{"hoge": "hoge_set", "fuga": "fuga_set"}},
+			}, files)
+			err := app.VisitDesiredStatesWithReleasesFiltered(
+				"helmfile.yaml", collectReleases,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(actual) != 1 {
+				t.Errorf("unexpected number of processed releases: expected=1, got=%d", len(actual))
+			}
+			if actual[0].Name != testcase.expected {
+				t.Errorf("unexpected name: expected=%s, got=%s", testcase.expected, actual[0].Name)
+			}
+			if actual[0].Chart != testcase.expected {
+				t.Errorf("unexpected chart: expected=%s, got=%s", testcase.expected, actual[0].Chart)
+			}
+			if actual[0].Namespace != testcase.expected {
+				t.Errorf("unexpected namespace: expected=%s, got=%s", testcase.expected, actual[0].Namespace)
+			}
+		})
 	}
-	st, err := app.loadDesiredStateFromYaml(statePath)
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_ChartAtAbsPath(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: myapp
+  chart: /path/to/mychart
+`,
+	}
+
+	actual := []state.ReleaseSpec{}
+
+	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, r)
+		}
+		return []error{}
+	}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Reverse:     false,
+		Namespace:   "",
+		Env:         "default",
+		Selectors:   []string{},
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectReleases,
+	)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-
-	if st.Releases[0].Name != "[FOO]" {
-		t.Errorf("unexpected releases[0].name: expected=FOO, got=%s", st.Releases[0].Name)
+	if len(actual) != 1 {
+		t.Errorf("unexpected number of processed releases: expected=1, got=%d", len(actual))
 	}
-	if st.Releases[0].Chart != "[BAR]" {
-		t.Errorf("unexpected releases[0].chart: expected=BAR, got=%s", st.Releases[0].Chart)
+	if actual[0].Name != "myapp" {
+		t.Errorf("unexpected name: expected=%s, got=%s", "myapp", actual[0].Name)
+	}
+	if actual[0].Chart != "/path/to/mychart" {
+		t.Errorf("unexpected chart: expected=%s, got=%s", "/path/to/mychart", actual[0].Chart)
 	}
 }
 
-// See https://github.com/roboll/helmfile/issues/623
-func TestLoadDesiredStateFromYaml_MultiPartTemplate_MergeMapsVariousKeys(t *testing.T) {
-	type testcase struct {
-		overrideValues interface{}
-		expected       string
-	}
-	testcases := []testcase{
-		{map[interface{}]interface{}{"foo": "FOO"}, `FOO`},
-		{map[interface{}]interface{}{"foo": map[interface{}]interface{}{"foo": "FOO"}}, `map[foo:FOO]`},
-		{map[interface{}]interface{}{"foo": map[string]interface{}{"foo": "FOO"}}, `map[foo:FOO]`},
-		{map[interface{}]interface{}{"foo": []interface{}{"foo"}}, `[foo]`},
-		{map[interface{}]interface{}{"foo": "FOO"}, `FOO`},
+func TestVisitDesiredStatesWithReleasesFiltered_RemoteTgzAsChart(t *testing.T) {
+	testcases := []struct {
+		expr, env, expected string
+	}{
+		{
+			expected: "https://github.com/arangodb/kube-arangodb/releases/download/0.3.11/kube-arangodb-crd.tgz",
+		},
 	}
 	for i := range testcases {
-		tc := testcases[i]
-		statePath := "/path/to/helmfile.yaml"
-		stateContent := `
-environments:
-  default:
-    values:
-    - 1.yaml
-    - 2.yaml
----
+		testcase := testcases[i]
+		t.Run(fmt.Sprintf("case %d", i), func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": `
 releases:
-- name: {{ .Environment.Values.foo | quote }}
-  chart: {{ .Environment.Values.bar | quote }}
-`
-		testFs := testhelper.NewTestFs(map[string]string{
-			statePath:         stateContent,
-			"/path/to/1.yaml": `bar: ["bar"]`,
-			"/path/to/2.yaml": `bar: ["BAR"]`,
-		})
-		app := &App{
-			readFile: testFs.ReadFile,
-			glob:     testFs.Glob,
-			abs:      testFs.Abs,
-			Env:      "default",
-			Logger:   helmexec.NewLogger(os.Stderr, "debug"),
-			Reverse:  true,
-		}
-		opts := LoadOpts{
-			CalleePath: statePath,
-			Environment: state.SubhelmfileEnvironmentSpec{
-				OverrideValues: []interface{}{tc.overrideValues},
-			},
-		}
-		st, err := app.loadDesiredStateFromYaml(statePath, opts)
+  - name: arangodb-crd
+    chart: https://github.com/arangodb/kube-arangodb/releases/download/0.3.11/kube-arangodb-crd.tgz
+`,
+			}
 
-		if err != nil {
-			t.Fatalf("unexpected error: %v", err)
-		}
+			actual := []state.ReleaseSpec{}
 
-		if st.Releases[0].Name != tc.expected {
-			t.Errorf("unexpected releases[0].name: expected=%s, got=%s", tc.expected, st.Releases[0].Name)
-		}
-		if st.Releases[0].Chart != "[BAR]" {
-			t.Errorf("unexpected releases[0].chart: expected=BAR, got=%s", st.Releases[0].Chart)
-		}
+			collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+				for _, r := range st.Releases {
+					actual = append(actual, r)
+				}
+				return []error{}
+			}
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Reverse:     false,
+				Namespace:   "",
+				Selectors:   []string{},
+				Env:         "default",
+			}, files)
+			err := app.VisitDesiredStatesWithReleasesFiltered(
+				"helmfile.yaml", collectReleases,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(actual) != 1 {
+				t.Errorf("unexpected number of processed releases: expected=1, got=%d", len(actual))
+			}
+			if actual[0].Chart != testcase.expected {
+				t.Errorf("unexpected chart: expected=%s, got=%s", testcase.expected, actual[0].Chart)
+			}
+		})
 	}
 }
 
-func TestLoadDesiredStateFromYaml_MultiPartTemplate_SprigDictFuncs(t *testing.T) {
-	type testcase struct {
-		state    string
-		expr     string
-		expected string
-	}
-	stateInline := `
-environments:
-  default:
-    values:
-    - foo: FOO
-      bar: { "baz": "BAZ" }
+func TestLoadDesiredStateFromYaml_DuplicateReleaseName(t *testing.T) {
+	yamlFile := "example/path/to/yaml/file"
+	yamlContent := []byte(`releases:
+- name: myrelease1
+  chart: mychart1
+  labels:
+    stage: pre
+    foo: bar
+- name: myrelease1
+  chart: mychart2
+  labels:
+    stage: post
+`)
+	readFile := func(filename string) ([]byte, error) {
+		if filename != yamlFile {
+			return nil, fmt.Errorf("unexpected filename: %s", filename)
+		}
+		return yamlContent, nil
+	}
+	app := &App{
+		readFile:    readFile,
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		KubeContext: "default",
+		Env:         "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	_, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_TemplatedReleaseNameCollision(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+values:
+- prefix: web
+  name: web-api
 ---
 releases:
-- name: %s
-  chart: stable/nginx
-`
-	stateExternal := `
+- name: {{ .Values.prefix }}-api
+  namespace: apps
+  chart: mychart1
+- name: {{ .Values.name }}
+  namespace: apps
+  chart: mychart2
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	_, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err == nil {
+		t.Fatal("expected error but got none")
+	}
+
+	expected := `error during /path/to/yaml/file.part.1 parsing with env=default: release "web-api" in namespace "apps" is rendered from both releases[0] in /path/to/yaml/file and releases[1] in /path/to/yaml/file`
+	if err.Error() != expected {
+		t.Errorf("unexpected error: expected=%q, got=%q", expected, err.Error())
+	}
+}
+
+func TestLoadDesiredStateFromYaml_TemplatedReleaseNameCollision_AcrossPartsAndBases(t *testing.T) {
+	tests := []struct {
+		name     string
+		helmfile string
+		expected string
+	}{
+		{
+			name: "literal name elsewhere",
+			helmfile: `
+values:
+- prefix: web
+  name: web-api
+---
+releases:
+- name: {{ .Values.prefix }}-api
+  namespace: apps
+  chart: mychart1
+  set:
+  - name: web-api
+    value: "1"
+- name: {{ .Values.name }}
+  namespace: apps
+  chart: mychart2
+`,
+			expected: `release "web-api" in namespace "apps" is rendered from both releases[0] in /path/to/yaml/file and releases[1] in /path/to/yaml/file`,
+		},
+		{
+			name: "across parts",
+			helmfile: `
+values:
+- prefix: web
+---
+releases:
+- name: web-api
+  namespace: apps
+  chart: mychart1
+---
+releases:
+- name: {{ .Values.prefix }}-api
+  namespace: apps
+  chart: mychart2
+`,
+			expected: `release "web-api" in namespace "apps" is rendered from releases[0] with chart "mychart2", colliding with the one with chart "mychart1" in a preceding part`,
+		},
+		{
+			name: "override across parts",
+			helmfile: `
+values:
+- prefix: web
+---
+releases:
+- name: web-api
+  namespace: apps
+  chart: mychart1
+---
+releases:
+- name: {{ .Values.prefix }}-api
+  namespace: apps
+  chart: mychart1
+  version: 1.0.0
+`,
+		},
+		{
+			name: "with bases",
+			helmfile: `
+bases:
+- base.yaml
+releases:
+- name: {{ "web" }}-api
+  namespace: apps
+  chart: mychart2
+`,
+			expected: `release "web-api" in namespace "apps" is rendered from both releases[0] in /path/to/yaml/base.yaml and releases[1] in /path/to/yaml/file`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				"/path/to/yaml/file": tt.helmfile,
+				"/path/to/yaml/base.yaml": `
+releases:
+- name: web-api
+  namespace: apps
+  chart: mychart1
+`,
+			})
+			app := &App{
+				readFile:   testFs.ReadFile,
+				fileExists: testFs.FileExists,
+				glob:       testFs.Glob,
+				abs:        testFs.Abs,
+				Env:        "default",
+				Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			_, err := app.loadDesiredStateFromYaml("/path/to/yaml/file")
+			if tt.expected == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("unexpected error: expected=%q, got=%v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_Deterministic(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
 environments:
   default:
     values:
-    - 1.yaml
-    - 2.yaml
+    - env.yaml.gotmpl
 ---
 releases:
-- name: %s
-  chart: stable/nginx
-`
-	testcases := []testcase{
-		{stateInline, `{{ getOrNil "foo" .Environment.Values }}`, `FOO`},
-		{stateInline, `{{ getOrNil "baz" (getOrNil "bar" .Environment.Values) }}`, `BAZ`},
-		{stateInline, `{{ if hasKey .Environment.Values "foo" }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
-		{stateInline, `{{ if hasKey .Environment.Values "bar" }}{{ .Environment.Values.bar.baz }}{{ end }}`, `BAZ`},
-		{stateInline, `{{ if (keys .Environment.Values | has "foo") }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
-		// See https://github.com/roboll/helmfile/issues/624
-		// This fails when .Environment.Values.bar is not map[string]interface{}. At the time of #624 it was map[interface{}]interface{}, which sprig's dict funcs don't support.
-		{stateInline, `{{ if (keys .Environment.Values | has "bar") }}{{ if (keys .Environment.Values.bar | has "baz") }}{{ .Environment.Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
-		{stateExternal, `{{ getOrNil "foo" .Environment.Values }}`, `FOO`},
-		{stateExternal, `{{ getOrNil "baz" (getOrNil "bar" .Environment.Values) }}`, `BAZ`},
-		{stateExternal, `{{ if hasKey .Environment.Values "foo" }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
-		{stateExternal, `{{ if hasKey .Environment.Values "bar" }}{{ .Environment.Values.bar.baz }}{{ end }}`, `BAZ`},
-		{stateExternal, `{{ if (keys .Environment.Values | has "foo") }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
-		// See https://github.com/roboll/helmfile/issues/624
-		{stateExternal, `{{ if (keys .Environment.Values | has "bar") }}{{ if (keys .Environment.Values.bar | has "baz") }}{{ .Environment.Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
-		// See https://github.com/roboll/helmfile/issues/643
-		{stateExternal, `{{ range $service := .Environment.Values.services }}{{ $service.name }}{{ if hasKey $service "something" }}{{ $service.something }}{{ end }}{{ end }}`, `xyfalse`},
-		// Same test with .Values
-		{stateInline, `{{ getOrNil "foo" .Values }}`, `FOO`},
-		{stateInline, `{{ getOrNil "baz" (getOrNil "bar" .Values) }}`, `BAZ`},
-		{stateInline, `{{ if hasKey .Values "foo" }}{{ .Values.foo }}{{ end }}`, `FOO`},
-		{stateInline, `{{ if hasKey .Values "bar" }}{{ .Values.bar.baz }}{{ end }}`, `BAZ`},
-		{stateInline, `{{ if (keys .Values | has "foo") }}{{ .Values.foo }}{{ end }}`, `FOO`},
-		// See https://github.com/roboll/helmfile/issues/624
-		// This fails when .Values.bar is not map[string]interface{}. At the time of #624 it was map[interface{}]interface{}, which sprig's dict funcs don't support.
-		{stateInline, `{{ if (keys .Values | has "bar") }}{{ if (keys .Values.bar | has "baz") }}{{ .Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
-		{stateExternal, `{{ getOrNil "foo" .Values }}`, `FOO`},
-		{stateExternal, `{{ getOrNil "baz" (getOrNil "bar" .Values) }}`, `BAZ`},
-		{stateExternal, `{{ if hasKey .Values "foo" }}{{ .Values.foo }}{{ end }}`, `FOO`},
-		{stateExternal, `{{ if hasKey .Values "bar" }}{{ .Values.bar.baz }}{{ end }}`, `BAZ`},
-		{stateExternal, `{{ if (keys .Values | has "foo") }}{{ .Values.foo }}{{ end }}`, `FOO`},
-		// See https://github.com/roboll/helmfile/issues/624
-		{stateExternal, `{{ if (keys .Values | has "bar") }}{{ if (keys .Values.bar | has "baz") }}{{ .Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
-		// See https://github.com/roboll/helmfile/issues/643
-		{stateExternal, `{{ range $service := .Values.services }}{{ $service.name }}{{ if hasKey $service "something" }}{{ $service.something }}{{ end }}{{ end }}`, `xyfalse`},
+- name: web
+  chart: mychart
+  values:
+  - values.yaml.gotmpl
+`,
+		"/path/to/env.yaml.gotmpl":    `token: {{ randAlphaNum 16 }}`,
+		"/path/to/values.yaml.gotmpl": `password: {{ randAlphaNum 16 }}`,
 	}
-	for i := range testcases {
-		tc := testcases[i]
-		statePath := "/path/to/helmfile.yaml"
-		stateContent := fmt.Sprintf(tc.state, tc.expr)
-		testFs := testhelper.NewTestFs(map[string]string{
-			statePath:         stateContent,
-			"/path/to/1.yaml": `foo: FOO`,
-			"/path/to/2.yaml": `bar: { "baz": "BAZ" }
-services:
-  - name: "x"
-  - name: "y"
-    something: false
+
+	load := func(seed string) (map[string]interface{}, error) {
+		app := appWithFs(&App{
+			KubeContext:       "default",
+			Env:               "default",
+			Logger:            helmexec.NewLogger(os.Stderr, "debug"),
+			valsRuntime:       fakeVals{},
+			Deterministic:     true,
+			DeterministicSeed: seed,
+		}, files)
+		st, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml")
+		if err != nil {
+			return nil, err
+		}
+		values, err := st.MergedValuesEntries(&st.Releases[0])
+		if err != nil {
+			return nil, err
+		}
+		values["token"] = st.Env.Values["token"]
+		return values, nil
+	}
+
+	if _, err := load(""); err == nil || !strings.Contains(err.Error(), "requires a secret seed") {
+		t.Errorf("expected error without a seed, got %v", err)
+	}
+
+	first, err := load("secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := load("secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("unexpected difference between loads: first=%v, second=%v", first, second)
+	}
+
+	other, err := load("another")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other["password"] == first["password"] || other["token"] == first["token"] {
+		t.Errorf("unexpected identical values with another seed: %v", other)
+	}
+}
+
+type fakeGetter struct {
+	get func(wd, src, dst string) error
+}
+
+func (g *fakeGetter) Get(wd, src, dst string) error {
+	return g.get(wd, src, dst)
+}
+
+func TestLoadDesiredStateFromYaml_RemoteValues(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	files := map[string]string{
+		yamlFile: `
+releases:
+- name: api
+  chart: mychart
+  values:
+  - git::https://github.com/org/shared-values.git@common/values.yaml?ref=v1&depth=1
+  - values.yaml
+  secrets:
+  - git::https://github.com/org/shared-values.git@common/secrets.yaml?ref=v1&depth=1
+- name: worker
+  chart: mychart
+  values:
+  - git::https://github.com/org/worker-values.git@values.yaml?ref=v1
+`,
+		"/path/to/values.yaml": `image: api`,
+	}
+	testFs := testhelper.NewTestFs(files)
+
+	var fetched []string
+
+	logger := helmexec.NewLogger(os.Stderr, "debug")
+	app := &App{
+		readFile:    testFs.ReadFile,
+		fileExists:  testFs.FileExists,
+		glob:        testFs.Glob,
+		abs:         testFs.Abs,
+		Env:         "default",
+		Logger:      logger,
+		valsRuntime: fakeVals{},
+		remote: &remote.Remote{
+			Logger: logger,
+			Home:   "/path/to",
+			Getter: &fakeGetter{get: func(wd, src, dst string) error {
+				fetched = append(fetched, src)
+				files[filepath.Join(dst, "common/values.yaml")] = `replicas: 3`
+				files[filepath.Join(dst, "common/secrets.yaml")] = `password: encrypted`
+				return nil
+			}},
+			ReadFile:   testFs.ReadFile,
+			FileExists: testFs.FileExistsAt,
+			DirExists:  testFs.DirectoryExistsAt,
+		},
+	}
+
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(fetched) > 0 {
+		t.Errorf("unexpected sources fetched on loading: %v", fetched)
+	}
+
+	expected := []interface{}{"git::https://github.com/org/shared-values.git@common/values.yaml?ref=v1&depth=1", "values.yaml"}
+	if !reflect.DeepEqual(expected, st.Releases[0].Values) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, st.Releases[0].Values)
+	}
+
+	helm := &secretsDecryptingHelmExec{files: files}
+	values, err := st.ReleaseValues(helm, &st.Releases[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]interface{}{"replicas": 3, "image": "api", "password": "decrypted"}; !reflect.DeepEqual(expected, values) {
+		t.Errorf("unexpected release values: expected=%v, got=%v", expected, values)
+	}
+
+	// The values file of worker is never fetched, as only api is processed
+	for _, src := range fetched {
+		if expected := "git::https://github.com/org/shared-values.git?ref=v1&depth=1"; src != expected {
+			t.Errorf("unexpected source fetched: expected=%s, got=%s", expected, src)
+		}
+	}
+	if expected := []string{"/path/to/.helmfile/cache/https_github_com_org_shared-values_git.ref=v1_depth=1/common/secrets.yaml"}; !reflect.DeepEqual(expected, helm.decrypted) {
+		t.Errorf("unexpected secrets decrypted: expected=%v, got=%v", expected, helm.decrypted)
+	}
+}
+
+// secretsDecryptingHelmExec decrypts a secrets file into the file with the `.dec` suffix next to it
+type secretsDecryptingHelmExec struct {
+	mockHelmExec
+	files     map[string]string
+	decrypted []string
+}
+
+func (helm *secretsDecryptingHelmExec) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	helm.decrypted = append(helm.decrypted, name)
+	helm.files[name+".dec"] = `password: decrypted`
+	return name + ".dec", nil
+}
+
+func TestLoadDesiredStateFromYaml_Bases(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../base.yaml
+- ../base.gotmpl
+
+{{ readFile "templates.yaml" }}
+
+releases:
+- name: myrelease1
+  chart: mychart1
+  labels:
+    stage: pre
+    foo: bar
+- name: myrelease1
+  chart: mychart2
+  labels:
+    stage: post
+  <<: *default
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/base.yaml": `environments:
+  default:
+    values:
+    - environments/default/1.yaml
+`,
+		"/path/to/yaml/environments/default/1.yaml": `foo: FOO`,
+		"/path/to/base.gotmpl": `environments:
+  default:
+    values:
+    - environments/default/2.yaml
+
+helmDefaults:
+  tillerNamespace: {{ .Environment.Values.tillerNs }}
+`,
+		"/path/to/yaml/environments/default/2.yaml": `tillerNs: TILLER_NS`,
+		"/path/to/yaml/templates.yaml": `templates:
+  default: &default
+    missingFileHandler: Warn
+    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+`,
+	})
+	app := &App{
+		readFile:     testFs.ReadFile,
+		glob:         testFs.Glob,
+		abs:          testFs.Abs,
+		fileExistsAt: testFs.FileExistsAt,
+		fileExists:   testFs.FileExists,
+		KubeContext:  "default",
+		Env:          "default",
+		Logger:       helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
+		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	}
+
+	if *st.Releases[1].MissingFileHandler != "Warn" {
+		t.Errorf("unexpected releases[0].missingFileHandler: expected=Warn, got=%s", *st.Releases[1].MissingFileHandler)
+	}
+
+	if st.Releases[1].Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
+		t.Errorf("unexpected releases[0].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", st.Releases[1].Values[0])
+	}
+
+	if st.FilePath != yamlFile {
+		t.Errorf("unexpected filePath: expected=%s, got=%s", yamlFile, st.FilePath)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_NestedBases(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `bases:
+- ../base.yaml
+---
+releases:
+- name: {{ .Environment.Values.name }}
+  chart: {{ .Environment.Values.chart }}
+`,
+		"/path/to/base.yaml": `bases:
+- ../grandbase.yaml
+
+releases:
+- name: baserelease
+  chart: basechart
+`,
+		"/path/to/grandbase.yaml": `environments:
+  default:
+    values:
+    - name: myrelease
+      chart: mychart
+`,
+		"/path/to/yaml/cycle": `bases:
+- ../cycle.yaml
+`,
+		"/path/to/cycle.yaml": `bases:
+- ../cycle.yaml
+`,
+	})
+	newApp := func() *App {
+		return &App{
+			readFile:     testFs.ReadFile,
+			glob:         testFs.Glob,
+			abs:          testFs.Abs,
+			fileExistsAt: testFs.FileExistsAt,
+			fileExists:   testFs.FileExists,
+			KubeContext:  "default",
+			Env:          "default",
+			Logger:       helmexec.NewLogger(os.Stderr, "debug"),
+		}
+	}
+
+	_, err := newApp().loadDesiredStateFromYaml(yamlFile)
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+	if !strings.Contains(err.Error(), "run with --nested-bases") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	st, err := newApp().loadDesiredStateFromYaml(yamlFile, LoadOpts{NestedBases: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	actual := []string{}
+	for _, r := range st.Releases {
+		actual = append(actual, r.Name+" "+r.Chart)
+	}
+	expected := []string{"baserelease basechart", "myrelease mychart"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+
+	_, err = newApp().loadDesiredStateFromYaml("/path/to/yaml/cycle", LoadOpts{NestedBases: true})
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+	expectedErr := "base /path/to/cycle.yaml includes itself via bases: /path/to/cycle.yaml -> /path/to/cycle.yaml"
+	if !strings.Contains(err.Error(), expectedErr) {
+		t.Errorf("unexpected error: expected to contain %q, got %q", expectedErr, err.Error())
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_NestedBasesInHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- sub/helmfile.yaml
+`,
+		"/path/to/sub/helmfile.yaml": `bases:
+- base.yaml
+---
+releases:
+- name: {{ .Environment.Values.name }}
+  chart: stable/zipkin
+`,
+		"/path/to/sub/base.yaml": `bases:
+- grandbase.yaml
+`,
+		"/path/to/sub/grandbase.yaml": `environments:
+  default:
+    values:
+    - name: fromgrandbase
+`,
+	}
+
+	actual := []string{}
+
+	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, r.Name)
+		}
+		return []error{}
+	}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "",
+		Selectors:   []string{},
+		Env:         "default",
+		NestedBases: true,
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectReleases,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"fromgrandbase"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_InheritHelmDefaults(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmDefaults:
+  wait: true
+  timeout: 600
+  args:
+  - --parent
+helmfiles:
+- sub/helmfile.yaml
+releases:
+- name: parent
+  chart: stable/zipkin
+`,
+		"/path/to/sub/helmfile.yaml": `
+helmDefaults:
+  timeout: 300
+  atomic: true
+helmfiles:
+- grandchild/helmfile.yaml
+releases:
+- name: child
+  chart: stable/zipkin
+`,
+		"/path/to/sub/grandchild/helmfile.yaml": `
+helmDefaults:
+  args:
+  - --grandchild
+releases:
+- name: grandchild
+  chart: stable/zipkin
+`,
+	}
+
+	testcases := []struct {
+		inherit  bool
+		expected map[string]state.HelmSpec
+	}{
+		{
+			inherit: false,
+			expected: map[string]state.HelmSpec{
+				"parent":     {Wait: true, Timeout: 600, Args: []string{"--parent"}},
+				"child":      {Timeout: 300, Atomic: true},
+				"grandchild": {Args: []string{"--grandchild"}},
+			},
+		},
+		{
+			inherit: true,
+			expected: map[string]state.HelmSpec{
+				"parent":     {Wait: true, Timeout: 600, Args: []string{"--parent"}},
+				"child":      {Wait: true, Timeout: 300, Atomic: true, Args: []string{"--parent"}},
+				"grandchild": {Wait: true, Timeout: 300, Atomic: true, Args: []string{"--grandchild"}},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		actual := map[string]state.HelmSpec{}
+
+		collectHelmDefaults := func(st *state.HelmState, helm helmexec.Interface) []error {
+			for _, r := range st.Releases {
+				actual[r.Name] = st.HelmDefaults
+			}
+			return []error{}
+		}
+		app := appWithFs(&App{
+			Logger:              helmexec.NewLogger(os.Stderr, "debug"),
+			Namespace:           "",
+			Selectors:           []string{},
+			Env:                 "default",
+			InheritHelmDefaults: tc.inherit,
+		}, files)
+		err := app.VisitDesiredStatesWithReleasesFiltered(
+			"helmfile.yaml", collectHelmDefaults,
+		)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("unexpected helmDefaults with inherit=%v: expected=%v, got=%v", tc.inherit, tc.expected, actual)
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ExpandPaths(t *testing.T) {
+	defer env.PatchAll(t, map[string]string{
+		"HOME":                  "/home/user",
+		"VALUES_DIR":            "/etc/values",
+		state.ExpandPathsEnvVar: "true",
+	})()
+
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `bases:
+- ~/base.yaml
+releases:
+- name: myrelease
+  chart: mychart
+`,
+		"/home/user/base.yaml": `environments:
+  default:
+    values:
+    - ${VALUES_DIR}/1.yaml
+    - $VALUES_DIR/2.yaml
+`,
+		"/etc/values/1.yaml": `foo: FOO`,
+		"/etc/values/2.yaml": `bar: BAR`,
+	})
+	app := &App{
+		readFile:     testFs.ReadFile,
+		glob:         testFs.Glob,
+		abs:          testFs.Abs,
+		fileExistsAt: testFs.FileExistsAt,
+		fileExists:   testFs.FileExists,
+		Env:          "default",
+		Logger:       helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{"foo": "FOO", "bar": "BAR"}
+	if !reflect.DeepEqual(st.Env.Values, expected) {
+		t.Errorf("unexpected environment values: expected=%v, got=%v", expected, st.Env.Values)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../base.yaml
+---
+bases:
+- ../base.gotmpl
+---
+helmDefaults:
+  kubeContext: {{ .Environment.Values.foo }}
+---
+releases:
+- name: myrelease0
+  chart: mychart0
+---
+
+{{ readFile "templates.yaml" }}
+
+releases:
+- name: myrelease1
+  chart: mychart1
+  labels:
+    stage: pre
+    foo: bar
+- name: myrelease1
+  chart: mychart2
+  labels:
+    stage: post
+  <<: *default
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/base.yaml": `environments:
+  default:
+    values:
+    - environments/default/1.yaml
+`,
+		"/path/to/yaml/environments/default/1.yaml": `foo: FOO`,
+		"/path/to/base.gotmpl": `environments:
+  default:
+    values:
+    - environments/default/2.yaml
+
+helmDefaults:
+  tillerNamespace: {{ .Environment.Values.tillerNs }}
+`,
+		"/path/to/yaml/environments/default/2.yaml": `tillerNs: TILLER_NS`,
+		"/path/to/yaml/templates.yaml": `templates:
+  default: &default
+    missingFileHandler: Warn
+    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
+		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	}
+	if st.Releases[0].Name != "myrelease0" {
+		t.Errorf("unexpected releases[0].name: expected=myrelease0, got=%s", st.Releases[0].Name)
+	}
+	firstRelease := st.Releases[1]
+	if firstRelease.Name != "myrelease1" {
+		t.Errorf("unexpected releases[1].name: expected=myrelease1, got=%s", firstRelease.Name)
+	}
+	secondRelease := st.Releases[2]
+	if secondRelease.Name != "myrelease1" {
+		t.Errorf("unexpected releases[2].name: expected=myrelease1, got=%s", secondRelease.Name)
+	}
+	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
+		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
+	}
+	if *secondRelease.MissingFileHandler != "Warn" {
+		t.Errorf("unexpected releases[2].missingFileHandler: expected=Warn, got=%s", *firstRelease.MissingFileHandler)
+	}
+
+	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
+		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
+	}
+
+	if st.HelmDefaults.KubeContext != "FOO" {
+		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_KubeContexts(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+
+	testcases := []struct {
+		name        string
+		env         string
+		kubeContext string
+		helmDefault string
+		expected    string
+		wantErr     bool
+	}{
+		{name: "selected by env", env: "prod", expected: "prod-cluster"},
+		{name: "env not in map", env: "default", expected: ""},
+		{name: "last of multiple envs in map", env: "prod,default", expected: "prod-cluster"},
+		{name: "--kube-context overrides map", env: "prod", kubeContext: "other", expected: "other"},
+		{name: "same as helmDefaults", env: "prod", helmDefault: "prod-cluster", expected: "prod-cluster"},
+		{name: "conflicts with helmDefaults", env: "prod", helmDefault: "dev-cluster", wantErr: true},
+		{name: "helmDefaults only", env: "default", helmDefault: "dev-cluster", expected: "dev-cluster"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := `
+environments:
+  default:
+  prod:
+releases:
+- name: myrelease
+  chart: mychart
+`
+			if tc.helmDefault != "" {
+				content += "helmDefaults:\n  kubeContext: " + tc.helmDefault + "\n"
+			}
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: content,
+			})
+			app := &App{
+				readFile:    testFs.ReadFile,
+				fileExists:  testFs.FileExists,
+				glob:        testFs.Glob,
+				abs:         testFs.Abs,
+				Env:         tc.env,
+				KubeContext: tc.kubeContext,
+				KubeContexts: map[string]string{
+					"prod": "prod-cluster",
+				},
+				Logger: helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if st.HelmDefaults.KubeContext != tc.expected {
+				t.Errorf("unexpected helmDefaults.kubeContext: expected=%q, got=%q", tc.expected, st.HelmDefaults.KubeContext)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_TemplatedNamespace(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+
+	testcases := []struct {
+		name      string
+		env       string
+		namespace string
+		expected  string
+		wantErr   string
+	}{
+		{name: "rendered by env", env: "prod", expected: "prod-apps"},
+		{name: "rendered by another env", env: "staging", expected: "staging-apps"},
+		{name: "same as --namespace", env: "prod", namespace: "prod-apps", expected: "prod-apps"},
+		{
+			name:      "conflicts with --namespace",
+			env:       "staging",
+			namespace: "prod-apps",
+			wantErr:   `err: Cannot use namespace "prod-apps" given via option --namespace and set attribute namespace to "staging-apps".`,
+		},
+		{name: "rendered to nothing", env: "default", namespace: "other", expected: "other"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+environments:
+  default:
+  staging:
+  prod:
+---
+namespace: {{ if ne .Environment.Name "default" }}{{ .Environment.Name }}-apps{{ end }}
+releases:
+- name: myrelease
+  chart: mychart
+`,
+			})
+			app := &App{
+				readFile:   testFs.ReadFile,
+				fileExists: testFs.FileExists,
+				glob:       testFs.Glob,
+				abs:        testFs.Abs,
+				Env:        tc.env,
+				Namespace:  tc.namespace,
+				Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				if err.Error() != tc.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%q", tc.wantErr, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if st.Namespace != tc.expected {
+				t.Errorf("unexpected namespace: expected=%q, got=%q", tc.expected, st.Namespace)
+			}
+		})
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_ReleaseNamespacePrecedence(t *testing.T) {
+	testcases := []struct {
+		name      string
+		namespace string
+		topLevel  string
+		expected  []string
+		wantErr   string
+	}{
+		{
+			name:     "none",
+			expected: []string{"own=own", "inherited=", "nested-own=own", "nested-inherited=nested"},
+		},
+		{
+			name:     "top-level",
+			topLevel: "top",
+			expected: []string{"own=own", "inherited=top", "nested-own=own", "nested-inherited=nested"},
+		},
+		{
+			name:      "--namespace",
+			namespace: "flag",
+			expected:  []string{"own=own", "inherited=flag", "nested-own=own", "nested-inherited=nested"},
+		},
+		{
+			name:      "--namespace same as top-level",
+			namespace: "top",
+			topLevel:  "top",
+			expected:  []string{"own=own", "inherited=top", "nested-own=own", "nested-inherited=nested"},
+		},
+		{
+			name:      "--namespace conflicting with top-level",
+			namespace: "flag",
+			topLevel:  "top",
+			wantErr:   `in ./helmfile.yaml: err: Cannot use namespace "flag" given via option --namespace and set attribute namespace to "top".`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := map[string]string{
+				"/path/to/helmfile.yaml": `
+namespace: ` + tc.topLevel + `
+releases:
+- name: own
+  namespace: own
+  chart: stable/zipkin
+- name: inherited
+  chart: stable/zipkin
+`,
+				"/path/to/nested.yaml": `
+helmfiles:
+- path: nested/helmfile.yaml
+  namespace: nested
+`,
+				"/path/to/nested/helmfile.yaml": `
+releases:
+- name: nested-own
+  namespace: own
+  chart: stable/grafana
+- name: nested-inherited
+  chart: stable/grafana
+`,
+			}
+
+			actual := []string{}
+
+			collectNamespaces := func(st *state.HelmState, helm helmexec.Interface) []error {
+				for i := range st.Releases {
+					r := &st.Releases[i]
+					actual = append(actual, fmt.Sprintf("%s=%s", r.Name, st.ReleaseNamespace(r)))
+				}
+				return []error{}
+			}
+
+			var err error
+			for _, f := range []string{"helmfile.yaml", "nested.yaml"} {
+				app := appWithFs(&App{
+					KubeContext: "default",
+					Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+					Namespace:   tc.namespace,
+					Selectors:   []string{},
+					Env:         "default",
+				}, files)
+				if err = app.VisitDesiredStatesWithReleasesFiltered(f, collectNamespaces); err != nil {
+					break
+				}
+			}
+
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				if err.Error() != tc.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%q", tc.wantErr, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("unexpected namespaces: expected=%v, got=%v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_TemplatedConcurrency(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+
+	testcases := []struct {
+		env      string
+		expected int
+		wantErr  string
+	}{
+		{env: "default", expected: 4},
+		{env: "staging", expected: 10},
+		{env: "prod", expected: 2},
+		{env: "broken", wantErr: `failed to load /path/to/yaml/file: invalid concurrency "fast": it must be a non-negative integer`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.env, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+environments:
+  default:
+  staging:
+    values:
+    - deployConcurrency: 10
+  prod:
+    values:
+    - deployConcurrency: 2
+  broken:
+    values:
+    - deployConcurrency: fast
+---
+concurrency: {{ .Values | getOrNil "deployConcurrency" | default 4 }}
+releases:
+- name: myrelease
+  chart: mychart
+`,
+			})
+			app := &App{
+				readFile:   testFs.ReadFile,
+				fileExists: testFs.FileExists,
+				glob:       testFs.Glob,
+				abs:        testFs.Abs,
+				Env:        tc.env,
+				Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				if err.Error() != tc.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%q", tc.wantErr, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual := st.ResolveConcurrency(0); actual != tc.expected {
+				t.Errorf("unexpected concurrency: expected=%d, got=%d", tc.expected, actual)
+			}
+			if actual := st.ResolveConcurrency(5); actual != 5 {
+				t.Errorf("unexpected concurrency with --concurrency 5: got=%d", actual)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_InvalidReadinessProbe(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+releases:
+- name: myrelease
+  chart: mychart
+  waitFor:
+  - httpGet: auth.example.com/healthz
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	_, err := app.loadDesiredStateFromYaml(yamlFile)
+
+	expected := `failed to load /path/to/yaml/file: release "myrelease" has invalid waitFor[0]: invalid httpGet "auth.example.com/healthz": it must be an absolute http or https URL`
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected=%q, got=%v", expected, err)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_UnknownReleaseType(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+releases:
+- name: infra-ready
+  type: none
+- name: myrelease
+  chart: mychart
+  needs:
+  - infra-ready
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	_, err := app.loadDesiredStateFromYaml(yamlFile)
+
+	expected := `failed to load /path/to/yaml/file: release "infra-ready" has unknown type "none". it must be either omitted or "noop"`
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected=%q, got=%v", expected, err)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ChartVersions(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+
+	testcases := []struct {
+		name     string
+		releases string
+		expected map[string]string
+		wantErr  string
+	}{
+		{
+			name: "resolved from the versions",
+			releases: `
+- name: db
+  chart: stable/mysql
+- name: cache
+  chart: stable/redis
+  version: 9.0.0
+- name: app
+  chart: ./charts/app
+- name: old
+  chart: stable/memcached
+  installed: false
+`,
+			expected: map[string]string{"db": "1.6.2", "cache": "9.0.0", "app": "", "old": ""},
+		},
+		{
+			name: "missing in the versions",
+			releases: `
+- name: queue
+  chart: stable/rabbitmq
+`,
+			wantErr: `failed to load /path/to/yaml/file: release "queue" has no version and its chart "stable/rabbitmq" is missing in the environment value "chartVersions". please add either of them`,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+environments:
+  default:
+    values:
+    - versions.yaml
+---
+releases:` + tc.releases,
+				"/path/to/yaml/versions.yaml": `
+chartVersions:
+  stable/mysql: 1.6.2
+  stable/redis: 10.5.7
+`,
+			})
+			app := &App{
+				readFile:   testFs.ReadFile,
+				fileExists: testFs.FileExists,
+				glob:       testFs.Glob,
+				abs:        testFs.Abs,
+				Env:        "default",
+				Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if tc.wantErr != "" {
+				if err == nil {
+					t.Fatal("expected error but got none")
+				}
+				if err.Error() != tc.wantErr {
+					t.Errorf("unexpected error: expected=%q, got=%q", tc.wantErr, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			actual := map[string]string{}
+			for _, r := range st.Releases {
+				actual[r.Name] = r.Version
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("unexpected versions: expected=%v, got=%v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_SkipSubHelmfiles(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: apps/*.yaml
+- path: infra/helmfile.yaml
+  importExports: true
+releases:
+- name: top
+  chart: stable/zipkin
+`,
+		"/path/to/apps/a.yaml": `
+releases:
+- name: a
+  chart: stable/grafana
+`,
+		"/path/to/infra/helmfile.yaml": `
+releases: [
+`,
+	}
+
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+	}, files)
+
+	// infra/helmfile.yaml is broken, so that importing its exports fails unless sub-helmfiles are skipped
+	if _, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml"); err == nil {
+		t.Fatal("expected error but got none")
+	}
+
+	st, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml", LoadOpts{SkipSubHelmfiles: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var helmfiles []string
+	for _, hf := range st.Helmfiles {
+		helmfiles = append(helmfiles, hf.Path)
+	}
+	if expected := []string{"apps/*.yaml", "infra/helmfile.yaml"}; !reflect.DeepEqual(expected, helmfiles) {
+		t.Errorf("unexpected helmfiles: expected=%v, got=%v", expected, helmfiles)
+	}
+
+	if err := app.initRemote(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var visited []string
+	err = app.visitStates("helmfile.yaml", LoadOpts{SkipSubHelmfiles: true}, func(st *state.HelmState, _ helmexec.Interface) (bool, []error) {
+		for _, r := range st.Releases {
+			visited = append(visited, r.Name)
+		}
+		return len(st.Releases) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"top"}; !reflect.DeepEqual(expected, visited) {
+		t.Errorf("unexpected releases visited: expected=%v, got=%v", expected, visited)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_Dir(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/01-infra.yaml": `
+namespace: infra
+repositories:
+- name: stable
+  url: https://kubernetes-charts.storage.googleapis.com
+releases:
+- name: db
+  chart: stable/mysql
+`,
+		"/path/to/helmfile.d/02-apps.yml": `
+repositories:
+- name: stable
+  url: https://kubernetes-charts.storage.googleapis.com
+releases:
+- name: app
+  chart: stable/app
+  namespace: apps
+  needs:
+  - infra/db
+`,
+		"/path/to/helmfile.d/README.md": `not a helmfile`,
+	}
+
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+	}, files)
+
+	st, err := app.loadDesiredStateFromYaml("/path/to/helmfile.d")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var releases []string
+	for _, r := range st.Releases {
+		releases = append(releases, r.Namespace+"/"+r.Name)
+	}
+	if expected := []string{"infra/db", "apps/app"}; !reflect.DeepEqual(expected, releases) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, releases)
+	}
+
+	if len(st.Repositories) != 1 {
+		t.Errorf("unexpected repositories: %v", st.Repositories)
+	}
+
+	groups, err := st.PlanReleaseIDs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := [][]string{{"infra/db"}, {"apps/app"}}; !reflect.DeepEqual(expected, groups) {
+		t.Errorf("unexpected groups: expected=%v, got=%v", expected, groups)
+	}
+
+	files["/path/to/helmfile.d/03-dup.yaml"] = `
+releases:
+- name: db
+  chart: stable/postgresql
+  namespace: infra
+`
+	app = appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+	}, files)
+
+	_, err = app.loadDesiredStateFromYaml("/path/to/helmfile.d")
+	if err == nil || !strings.Contains(err.Error(), `release "infra/db" in /path/to/helmfile.d/03-dup.yaml conflicts with the one in /path/to/helmfile.d/01-infra.yaml`) {
+		t.Errorf("expected conflicting release error, got %v", err)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_Dir_Namespaces(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/01-infra.yaml": `
+namespace: infra
+releases:
+- name: db
+  chart: stable/mysql
+`,
+		"/path/to/helmfile.d/02-apps.yaml": `
+releases:
+- name: app
+  chart: stable/app
+  needs:
+  - infra/db
+- name: db
+  chart: stable/postgresql
+`,
+	}
+
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+	}, files)
+
+	st, err := app.loadDesiredStateFromYaml("/path/to/helmfile.d")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var namespaces []string
+	for i := range st.Releases {
+		namespaces = append(namespaces, st.ReleaseNamespace(&st.Releases[i])+"/"+st.Releases[i].Name)
+	}
+	if expected := []string{"infra/db", "/app", "/db"}; !reflect.DeepEqual(expected, namespaces) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, namespaces)
+	}
+
+	files["/path/to/helmfile.d/02-apps.yaml"] = `
+commonLabels:
+  team: apps
+releases:
+- name: app
+  chart: stable/app
+`
+	app = appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+	}, files)
+
+	_, err = app.loadDesiredStateFromYaml("/path/to/helmfile.d")
+	if err == nil || !strings.Contains(err.Error(), "commonLabels in /path/to/helmfile.d/02-apps.yaml conflicts with the ones in /path/to/helmfile.d/01-infra.yaml") {
+		t.Errorf("expected conflicting commonLabels error, got %v", err)
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_MergeHelmfileDir(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/01-infra.yaml": `
+releases:
+- name: db
+  chart: stable/mysql
+`,
+		"/path/to/helmfile.d/02-apps.yaml": `
+releases:
+- name: app
+  chart: stable/app
+  needs:
+  - db
+`,
+	}
+
+	for _, merge := range []bool{false, true} {
+		app := injectFs(&App{
+			KubeContext:      "default",
+			Logger:           helmexec.NewLogger(os.Stderr, "debug"),
+			Env:              "default",
+			MergeHelmfileDir: merge,
+		}, testhelper.NewTestFs(files))
+
+		var visited [][]string
+		err := app.VisitDesiredStatesWithReleasesFiltered("", func(st *state.HelmState, helm helmexec.Interface) []error {
+			var names []string
+			for _, r := range st.Releases {
+				names = append(names, r.Name)
+			}
+			visited = append(visited, names)
+			return nil
+		})
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		expected := [][]string{{"db"}, {"app"}}
+		if merge {
+			expected = [][]string{{"db", "app"}}
+		}
+		if !reflect.DeepEqual(expected, visited) {
+			t.Errorf("unexpected states with MergeHelmfileDir=%v: expected=%v, got=%v", merge, expected, visited)
+		}
+	}
+}
+
+func TestApp_LoadAll(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+environments:
+  dev:
+    values:
+    - replicas: 1
+  stg:
+    values:
+    - replicas: 2
+  prod:
+    values:
+    - replicas: 3
+---
+releases:
+- name: app
+  chart: stable/app
+  namespace: {{ .Environment.Name }}
+  labels:
+    replicas: "{{ .Environment.Values.replicas }}"
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+
+	states, err := app.LoadAll(yamlFile, []string{"dev", "stg", "qa", "prod"}, 2, LoadOpts{})
+
+	loadAllErr, ok := err.(*LoadAllError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(loadAllErr.Errors) != 1 || loadAllErr.Errors["qa"] == nil {
+		t.Errorf("unexpected errors: %v", loadAllErr.Errors)
+	}
+	if !strings.HasPrefix(err.Error(), "failed to load 1 of 4 environments: environment qa: ") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	actual := map[string]string{}
+	for env, st := range states {
+		if st.Env.Name != env {
+			t.Errorf("unexpected environment of the state for %s: %s", env, st.Env.Name)
+		}
+		r := st.Releases[0]
+		actual[env] = r.Namespace + "/" + r.Labels["replicas"]
+	}
+
+	expected := map[string]string{"dev": "dev/1", "stg": "stg/2", "prod": "prod/3"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected states: expected=%v, actual=%v", expected, actual)
+	}
+
+	if app.Env != "default" {
+		t.Errorf("unexpected change of the environment of the app: %s", app.Env)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_LoadSummary(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+environments:
+  default:
+  prod:
+---
+# helmfile: environments=prod
+releases:
+- name: monitoring
+  chart: stable/prometheus
+---
+helmfiles:
+- sub/helmfile.yaml
+releases:
+- name: {{ .Environment.Name }}-db
+  chart: stable/mysql
+- name: cache
+  chart: stable/redis
+`,
+		"/path/to/yaml/sub/helmfile.yaml": `
+releases:
+- name: app
+  chart: stable/app
+`,
+	})
+
+	core, logs := observer.New(zap.DebugLevel)
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     zap.New(core).Sugar(),
+	}
+	if _, err := app.loadDesiredStateFromYaml(yamlFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	summary := regexp.MustCompile(`^loaded /path/to/yaml/file in [^:]+: 2 of 3 parts, 2 releases, 1 helmfiles, 2 environments$`)
+	var found bool
+	for _, e := range logs.FilterMessageSnippet("loaded /path/to/yaml/file in").All() {
+		if summary.MatchString(e.Message) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("summary of loading not found in logs: %v", logs.FilterMessageSnippet("loaded ").All())
+	}
+
+	// The summary is never formatted unless debug logs are enabled
+	core, logs = observer.New(zap.InfoLevel)
+	app.Logger = zap.New(core).Sugar()
+	if _, err := app.loadDesiredStateFromYaml(yamlFile); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := logs.FilterMessageSnippet("loaded ").Len(); n != 0 {
+		t.Errorf("unexpected summary of loading at info level: %v", logs.All())
+	}
+}
+
+func TestLoadDesiredStateFromYaml_DiscoverEnvValues(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+
+	testcases := []struct {
+		name     string
+		env      string
+		discover bool
+		expected map[string]interface{}
+	}{
+		{
+			name:     "merged in order and overridden by the helmfile",
+			env:      "prod",
+			discover: true,
+			expected: map[string]interface{}{"a": 1, "b": 2, "c": 3},
+		},
+		{
+			name:     "missing directory",
+			env:      "default",
+			discover: true,
+			expected: map[string]interface{}{},
+		},
+		{
+			name:     "disabled",
+			env:      "prod",
+			expected: map[string]interface{}{"c": 3},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+environments:
+  default:
+  prod:
+    values:
+    - c: 3
+releases:
+- name: myrelease
+  chart: mychart
+`,
+				"/path/to/environments/prod/02.yaml": "b: 2\nc: 2\n",
+				"/path/to/environments/prod/01.yaml": "a: 1\nb: 1\n",
+			})
+			app := &App{
+				readFile:          testFs.ReadFile,
+				fileExists:        testFs.FileExists,
+				glob:              testFs.Glob,
+				abs:               testFs.Abs,
+				Env:               tc.env,
+				DiscoverEnvValues: tc.discover,
+				Logger:            helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(tc.expected, st.Env.Values) {
+				t.Errorf("unexpected environment values: expected=%v, got=%v", tc.expected, st.Env.Values)
+			}
+		})
+	}
+}
+
+// sopsVals decrypts the top-level references to sops-encrypted files to the YAML in the map, keyed by the references.
+// Any other value is left as is
+type sopsVals map[string]string
+
+func (v sopsVals) Eval(m map[string]interface{}) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	for k, value := range m {
+		res[k] = value
+		if ref, ok := value.(string); ok {
+			if yaml, ok := v[ref]; ok {
+				res[k] = yaml
+			}
+		}
+	}
+	return res, nil
+}
+
+func TestLoadDesiredStateFromYaml_DiscoverEnvSecrets(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+
+	testcases := []struct {
+		name         string
+		env          string
+		discover     bool
+		inlineValues map[string]interface{}
+		expected     string
+	}{
+		{
+			name:     "overriding the environment values",
+			env:      "prod",
+			discover: true,
+			expected: "plainhost-decrypted-1",
+		},
+		{
+			name:         "overridden by the command-line",
+			env:          "prod",
+			discover:     true,
+			inlineValues: map[string]interface{}{"db": map[string]interface{}{"password": "cli"}},
+			expected:     "plainhost-cli-1",
+		},
+		{
+			name:     "missing file",
+			env:      "staging",
+			discover: true,
+			expected: "plainhost-plain-1",
+		},
+		{
+			name:     "disabled",
+			env:      "prod",
+			expected: "plainhost-plain-1",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+environments:
+  prod:
+    values:
+    - db:
+        host: plainhost
+        password: plain
+      replicas: 1
+  staging:
+    values:
+    - db:
+        host: plainhost
+        password: plain
+      replicas: 1
+---
+releases:
+- name: {{ .Values.db.host }}-{{ .Values.db.password }}-{{ .Values.replicas }}
+  chart: mychart
+`,
+				"/path/to/secrets.prod.yaml": "ENC[...]",
+			})
+			app := &App{
+				readFile:           testFs.ReadFile,
+				fileExists:         testFs.FileExists,
+				glob:               testFs.Glob,
+				abs:                testFs.Abs,
+				Env:                tc.env,
+				DiscoverEnvSecrets: tc.discover,
+				Logger:             helmexec.NewLogger(os.Stderr, "debug"),
+				valsRuntime: sopsVals{
+					"ref+sops://secrets.prod.yaml?format=yaml": "db:\n  password: decrypted\n",
+				},
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile, LoadOpts{
+				CalleePath:   yamlFile,
+				InlineValues: tc.inlineValues,
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if st.Releases[0].Name != tc.expected {
+				t.Errorf("unexpected release name: expected=%s, got=%s", tc.expected, st.Releases[0].Name)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_Cache(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	files := map[string]string{
+		yamlFile: `
+environments:
+  prod:
+    values:
+    - values.yaml
+---
+releases:
+- name: {{ .Values.db.password }}-{{ .Values.suffix }}
+  chart: mychart
+`,
+		"/path/to/values.yaml":       "suffix: a\n",
+		"/path/to/secrets.prod.yaml": "ENC[...]",
+	}
+	testFs := testhelper.NewTestFs(files)
+
+	secrets := sopsVals{
+		"ref+sops://secrets.prod.yaml?format=yaml": "db:\n  password: decrypted\n",
+	}
+
+	app := &App{
+		readFile:           testFs.ReadFile,
+		fileExists:         testFs.FileExists,
+		glob:               testFs.Glob,
+		abs:                testFs.Abs,
+		Env:                "prod",
+		DiscoverEnvSecrets: true,
+		Logger:             helmexec.NewLogger(os.Stderr, "debug"),
+		valsRuntime:        secrets,
+		loadCache:          &loadCache{},
+	}
+
+	load := func(expected string, inlineValues map[string]interface{}) {
+		t.Helper()
+
+		st, err := app.loadDesiredStateFromYaml(yamlFile, LoadOpts{
+			CalleePath:   yamlFile,
+			InlineValues: inlineValues,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(st.Releases) != 1 || st.Releases[0].Name != expected {
+			t.Fatalf("unexpected releases: expected=%s, got=%v", expected, st.Releases)
+		}
+
+		// Running a state filters its releases in place, which must not affect the cached one
+		st.Releases = nil
+	}
+
+	load("decrypted-a", nil)
+
+	// Secrets referenced via vals are not tracked
+	secrets["ref+sops://secrets.prod.yaml?format=yaml"] = "db:\n  password: rotated\n"
+	load("decrypted-a", nil)
+
+	app.ForceReload = true
+	load("rotated-a", nil)
+	app.ForceReload = false
+
+	files["/path/to/values.yaml"] = "suffix: b\n"
+	load("rotated-b", nil)
+
+	load("cli-b", map[string]interface{}{"db": map[string]interface{}{"password": "cli"}})
+}
+
+func TestLoadDesiredStateFromYaml_LoadInputsSink(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+environments:
+  default:
+    values:
+    - values.yaml
+---
+bases:
+- base.yaml
+---
+releases:
+- name: app-{{ .Values.suffix }}
+  chart: {{ readFile "chart.txt" }}
+  values:
+  - app.yaml.gotmpl
+  - overrides/*.yaml
+  - git::https://github.com/org/shared-values.git@values.yaml?ref=v1
+  secrets:
+  - secrets.yaml
+  - ref+vault://secret/app
+`,
+		"/path/to/base.yaml":   "helmDefaults:\n  wait: true\n",
+		"/path/to/values.yaml": "suffix: a\n",
+		"/path/to/chart.txt":   "mychart",
+	})
+
+	var reported [][]LoadInput
+
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+		loadCache:  &loadCache{},
+		LoadInputsSink: func(file string, inputs []LoadInput) {
+			if file != yamlFile {
+				t.Errorf("unexpected helmfile reported: %s", file)
+			}
+			reported = append(reported, inputs)
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		st, err := app.loadDesiredStateFromYaml(yamlFile, LoadOpts{CalleePath: yamlFile})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if st.Releases[0].Name != "app-a" || st.Releases[0].Chart != "mychart" {
+			t.Fatalf("unexpected releases: %v", st.Releases)
+		}
+	}
+
+	// The second load reuses the state cached by the first one, and still reports its inputs
+	expected := []LoadInput{
+		{Kind: LoadInputFile, Path: "/path/to/helmfile.yaml"},
+		{Kind: LoadInputGlob, Path: "/path/to/values.yaml"},
+		{Kind: LoadInputFile, Path: "/path/to/values.yaml"},
+		{Kind: LoadInputFile, Path: "/path/to/base.yaml"},
+		{Kind: LoadInputFile, Path: "/path/to/chart.txt"},
+		{Kind: LoadInputFile, Path: "/path/to/app.yaml.gotmpl"},
+		{Kind: LoadInputGlob, Path: "/path/to/overrides/*.yaml"},
+		{Kind: LoadInputFile, Path: "/path/to/secrets.yaml"},
+	}
+	if !reflect.DeepEqual([][]LoadInput{expected, expected}, reported) {
+		t.Errorf("unexpected inputs reported: expected=%v, got=%v", expected, reported)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_SourceFile(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `bases:
+- ../base.yaml
+releases:
+- name: myrelease
+  chart: mychart
+`,
+		"/path/to/base.yaml": `releases:
+- name: baserelease
+  chart: mychart
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	templated, err := st.ExecuteTemplates()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual []string
+	for _, r := range templated.Releases {
+		actual = append(actual, r.Name+" "+r.SourceFile)
+	}
+
+	expected := []string{"baserelease /path/to/base.yaml", "myrelease /path/to/yaml/file"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected source files: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_TemplateFuncs(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `releases:
+- name: {{ shout "myrelease" }}
+  chart: mychart
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+	}
+
+	st, err := app.loadDesiredStateFromYaml(yamlFile, LoadOpts{
+		TemplateFuncs: template.FuncMap{"shout": strings.ToUpper},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st.Releases[0].Name != "MYRELEASE" {
+		t.Errorf("unexpected release name: expected=MYRELEASE, got=%s", st.Releases[0].Name)
+	}
+
+	_, err = app.loadDesiredStateFromYaml(yamlFile, LoadOpts{
+		TemplateFuncs: template.FuncMap{"shout": strings.ToUpper, "toYaml": strings.ToUpper},
+	})
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+	expected := `template function "toYaml" conflicts with the built-in one. please rename it`
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("unexpected error: expected to contain %q, got %q", expected, err.Error())
+	}
+}
+
+func TestLoadDesiredStateFromYaml_InlineValues(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `environments:
+  default:
+    values:
+    - image: base
+      replicas: 1
+---
+releases:
+- name: {{ .Environment.Values.image }}-{{ .Environment.Values.replicas }}-{{ .Environment.Values.tag }}
+  chart: mychart
+`,
+		"/path/to/yaml/override.yaml": `image: override
+tag: v1
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+	}
+
+	st, err := app.loadDesiredStateFromYaml(yamlFile, LoadOpts{
+		CalleePath: yamlFile,
+		Environment: state.SubhelmfileEnvironmentSpec{
+			OverrideValues: []interface{}{"override.yaml"},
+		},
+		InlineValues: map[string]interface{}{"replicas": 3, "tag": "v2"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st.Releases[0].Name != "override-3-v2" {
+		t.Errorf("unexpected release name: expected=override-3-v2, got=%s", st.Releases[0].Name)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_HelmBinary(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `releases:
+- name: myrelease1
+  chart: mychart
+- name: myrelease2
+  chart: mychart
+  helmBinary: helm3
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+	}
+
+	app.lookPath = func(file string) (string, error) {
+		if file == "helm3" {
+			return "/usr/local/bin/helm3", nil
+		}
+		return "", fmt.Errorf("executable file not found in $PATH")
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if st.Releases[1].HelmBinary != "helm3" {
+		t.Errorf("unexpected helm binary: expected=helm3, got=%s", st.Releases[1].HelmBinary)
+	}
+
+	app.lookPath = func(file string) (string, error) {
+		return "", fmt.Errorf("executable file not found in $PATH")
+	}
+	_, err = app.loadDesiredStateFromYaml(yamlFile)
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+	expected := `helm binary "helm3" of release "myrelease2" not found: executable file not found in $PATH`
+	if err.Error() != expected {
+		t.Errorf("unexpected error: expected=%q, got=%q", expected, err.Error())
+	}
+}
+
+func TestLoadDesiredStateFromYaml_TemplateErrorMentionsEnv(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `environments:
+  prod:
+---
+releases:
+- name: {{ .Environment.Values.missing }}
+  chart: mychart
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "prod",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+	}
+
+	_, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+
+	expected := "error during /path/to/yaml/file.part.1 parsing with env=prod: "
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("unexpected error: expected to contain %q, got %q", expected, err.Error())
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ConditionalNeeds(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `environments:
+  dev:
+  prod:
+---
+releases:
+- name: app
+  chart: mychart
+  needs:
+  - {{ if ne .Environment.Name "dev" }}db{{ end }}
+- name: db
+  chart: mychart
+  installed: {{ ne .Environment.Name "dev" }}
+`,
+	})
+
+	testcases := []struct {
+		env      string
+		expected [][]string
+	}{
+		{env: "dev", expected: [][]string{{"app", "db"}}},
+		{env: "prod", expected: [][]string{{"db"}, {"app"}}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.env, func(t *testing.T) {
+			app := &App{
+				readFile: testFs.ReadFile,
+				glob:     testFs.Glob,
+				abs:      testFs.Abs,
+				Env:      tc.env,
+				Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+			}
+
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			groups, err := st.PlanReleases(nil, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var actual [][]string
+			for _, g := range groups {
+				var names []string
+				for _, r := range g {
+					names = append(names, r.Name)
+				}
+				actual = append(actual, names)
+			}
+
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("unexpected plan: expected=%v, got=%v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_EnvLabels(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `environments:
+  default:
+  prod:
+    labels:
+      env: prod
+      team: platform
+releases:
+- name: myrelease1
+  chart: mychart
+- name: myrelease2
+  chart: mychart
+  labels:
+    team: app
+`,
+	})
+
+	testcases := []struct {
+		env      string
+		expected []map[string]string
+	}{
+		{
+			env:      "default",
+			expected: []map[string]string{nil, {"team": "app"}},
+		},
+		{
+			env: "prod",
+			expected: []map[string]string{
+				{"env": "prod", "team": "platform"},
+				{"env": "prod", "team": "app"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		app := &App{
+			readFile: testFs.ReadFile,
+			glob:     testFs.Glob,
+			abs:      testFs.Abs,
+			Env:      tc.env,
+			Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+		}
+		st, err := app.loadDesiredStateFromYaml(yamlFile)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		for i, expected := range tc.expected {
+			if !reflect.DeepEqual(st.Releases[i].Labels, expected) {
+				t.Errorf("unexpected labels of releases[%d] in %s: expected=%v, got=%v", i, tc.env, expected, st.Releases[i].Labels)
+			}
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultipleEnvironments(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `environments:
+  base:
+    values:
+    - replicas: 1
+    labels:
+      team: platform
+      tier: base
+  prod:
+    values:
+    - replicas: 3
+    labels:
+      tier: prod
+---
+releases:
+- name: app
+  chart: mychart
+  values:
+  - replicas: {{ .Values.replicas }}
+    prod: {{ has "prod" .Environment.Names }}
+    env: {{ .Environment.Name }}
+---
+# helmfile: environments=prod
+releases:
+- name: prod-only
+  chart: mychart
+---
+# helmfile: environments=staging
+releases:
+- name: staging-only
+  chart: mychart
+`,
+		"/path/to/environments/base/values.yaml": "zone: a\nregion: us\n",
+		"/path/to/environments/prod/values.yaml": "zone: b\n",
+	})
+
+	app := &App{
+		readFile:          testFs.ReadFile,
+		fileExists:        testFs.FileExists,
+		glob:              testFs.Glob,
+		abs:               testFs.Abs,
+		Env:               "base,prod",
+		DiscoverEnvValues: true,
+		Logger:            helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var names []string
+	for _, r := range st.Releases {
+		names = append(names, r.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"app", "prod-only"}) {
+		t.Fatalf("unexpected releases: %v", names)
+	}
+
+	expectedValues := map[interface{}]interface{}{"replicas": 3, "prod": true, "env": "base,prod"}
+	if !reflect.DeepEqual(st.Releases[0].Values[0], expectedValues) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expectedValues, st.Releases[0].Values[0])
+	}
+
+	expectedLabels := map[string]string{"team": "platform", "tier": "prod"}
+	if !reflect.DeepEqual(st.Releases[0].Labels, expectedLabels) {
+		t.Errorf("unexpected labels: expected=%v, got=%v", expectedLabels, st.Releases[0].Labels)
+	}
+
+	if st.Env.Values["zone"] != "b" || st.Env.Values["region"] != "us" {
+		t.Errorf("unexpected discovered environment values: %v", st.Env.Values)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_InterpolatedEnvValues(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `environments:
+  default:
+    interpolateValues: true
+    values:
+    - values.yaml
+  raw:
+    values:
+    - values.yaml
+---
+releases:
+- name: app
+  chart: mychart
+  values:
+  - apiUrl: {{ .Values.apiUrl | quote }}
+`,
+		"/path/to/values.yaml": `baseUrl: "https://{{ .Values.domain }}"
+apiUrl: "{{ .Values.baseUrl }}/api"
+domain: example.com
+`,
+	})
+
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedValues := map[interface{}]interface{}{"apiUrl": "https://example.com/api"}
+	if !reflect.DeepEqual(st.Releases[0].Values[0], expectedValues) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expectedValues, st.Releases[0].Values[0])
+	}
+
+	if st.Env.Values["apiUrl"] != "https://example.com/api" {
+		t.Errorf("unexpected environment values: %v", st.Env.Values)
+	}
+
+	// Values are interpolated only when opted in
+	app.Env = "raw"
+	st, err = app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.Env.Values["apiUrl"] != "{{ .Values.baseUrl }}/api" {
+		t.Errorf("unexpected environment values: %v", st.Env.Values)
+	}
+}
+
+// fakeVals resolves `ref+echo://VALUE` to VALUE, and `ref+echo://map` to a map, anywhere in nested maps and lists
+type fakeVals struct{}
+
+func (fakeVals) Eval(m map[string]interface{}) (map[string]interface{}, error) {
+	var resolve func(interface{}) interface{}
+	resolve = func(v interface{}) interface{} {
+		switch typed := v.(type) {
+		case string:
+			if typed == "ref+echo://map" {
+				return map[string]interface{}{"token": "resolved"}
+			}
+			return strings.TrimPrefix(typed, "ref+echo://")
+		case map[string]interface{}:
+			res := map[string]interface{}{}
+			for k, v := range typed {
+				res[k] = resolve(v)
+			}
+			return res
+		case map[interface{}]interface{}:
+			res := map[interface{}]interface{}{}
+			for k, v := range typed {
+				res[k] = resolve(v)
+			}
+			return res
+		case []interface{}:
+			res := []interface{}{}
+			for _, v := range typed {
+				res = append(res, resolve(v))
+			}
+			return res
+		case []string:
+			res := []interface{}{}
+			for _, v := range typed {
+				res = append(res, resolve(v))
+			}
+			return res
+		default:
+			return v
+		}
+	}
+	return resolve(m).(map[string]interface{}), nil
+}
+
+// recordingVals is fakeVals recording the references it resolved
+type recordingVals struct {
+	refs []string
+}
+
+func (v *recordingVals) Eval(m map[string]interface{}) (map[string]interface{}, error) {
+	var record func(interface{})
+	record = func(e interface{}) {
+		switch typed := e.(type) {
+		case string:
+			if strings.HasPrefix(typed, "ref+") {
+				v.refs = append(v.refs, typed)
+			}
+		case map[string]interface{}:
+			for _, e := range typed {
+				record(e)
+			}
+		case map[interface{}]interface{}:
+			for _, e := range typed {
+				record(e)
+			}
+		case []interface{}:
+			for _, e := range typed {
+				record(e)
+			}
+		}
+	}
+	record(m)
+	return fakeVals{}.Eval(m)
+}
+
+func TestLoadDesiredStateFromYaml_ValsRefs(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+releases:
+- name: myrelease
+  chart: mychart
+  values:
+  - db:
+      password: ref+echo://pass
+  secrets:
+  - ref+echo://map
+`,
+	})
+	vals := &recordingVals{}
+	app := &App{
+		readFile:    testFs.ReadFile,
+		glob:        testFs.Glob,
+		abs:         testFs.Abs,
+		Env:         "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		valsRuntime: vals,
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// References are kept as written, so that `helmfile build` never shows the secrets
+	expectedValues := []interface{}{
+		map[interface{}]interface{}{"db": map[interface{}]interface{}{"password": "ref+echo://pass"}},
+	}
+	if !reflect.DeepEqual(expectedValues, st.Releases[0].Values) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expectedValues, st.Releases[0].Values)
+	}
+	if expected := []string{"ref+echo://map"}; !reflect.DeepEqual(expected, st.Releases[0].Secrets) {
+		t.Errorf("unexpected secrets: expected=%v, got=%v", expected, st.Releases[0].Secrets)
+	}
+	if len(vals.refs) > 0 {
+		t.Errorf("unexpected references resolved on loading: %v", vals.refs)
+	}
+}
+
+func TestTemplate_ValsRefs(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: myrelease
+  chart: mychart
+  values:
+  - db:
+      password: ref+echo://pass
+      hosts:
+      - ref+echo://host1
+      - host2
+  secrets:
+  - ref+echo://map
+- name: unselected
+  chart: mychart
+  values:
+  - password: ref+echo://other
+`,
+	}
+
+	helm := &valuesRecordingHelmExec{mockHelmExec: &mockHelmExec{}, values: map[string][]string{}}
+	vals := &recordingVals{}
+
+	app := appWithFs(&App{
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		Env:         "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		helmExecer:  helm,
+		valsRuntime: vals,
+		Selectors:   []string{"name=myrelease"},
+	}, files)
+
+	if err := app.Template(configImpl{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string][]string{
+		"myrelease": {
+			"db:\n  hosts:\n  - host1\n  - host2\n  password: pass\n",
+			"token: resolved\n",
+		},
+	}
+	if !reflect.DeepEqual(helm.values, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, helm.values)
+	}
+
+	for _, ref := range vals.refs {
+		if ref == "ref+echo://other" {
+			t.Errorf("unexpected reference of the unselected release resolved: %v", vals.refs)
+		}
+	}
+}
+
+func TestVisitDesiredStatesWithReleasesFiltered_EnvValsRefs(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  default:
+    values:
+    - ref+echo://map
+    - db:
+        host: ref+echo://dbhost
+    - env.yaml
+---
+releases:
+- name: {{ .Environment.Values.token }}-{{ .Environment.Values.db.host }}-{{ .Environment.Values.region }}-{{ .Environment.Values.cluster }}
+  chart: stable/zipkin
+`,
+		"/path/to/env.yaml": `
+region: ref+echo://region1
+`,
+		"/path/to/overrides.yaml": `
+cluster: ref+echo://cluster1
+`,
+	}
+
+	actual := []string{}
+
+	collectReleases := func(st *state.HelmState, helm helmexec.Interface) []error {
+		for _, r := range st.Releases {
+			actual = append(actual, r.Name)
+		}
+		return []error{}
+	}
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Namespace:   "",
+		Selectors:   []string{},
+		Env:         "default",
+		ValuesFiles: []string{"ref+echo://map", "overrides.yaml"},
+		valsRuntime: fakeVals{},
+	}, files)
+	err := app.VisitDesiredStatesWithReleasesFiltered(
+		"helmfile.yaml", collectReleases,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"resolved-dbhost-region1-cluster1"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_RestrictFileAccess(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml.gotmpl"
+
+	testcases := []struct {
+		name        string
+		path        string
+		allowedDirs []string
+		wantErr     bool
+	}{
+		{name: "file in the helmfile dir", path: "values.yaml"},
+		{name: "traversal to the parent dir", path: "../etc/passwd", wantErr: true},
+		{name: "absolute path", path: "/etc/passwd", wantErr: true},
+		{name: "absolute path in an allowed dir", path: "/etc/passwd", allowedDirs: []string{"/etc"}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+releases:
+- name: {{ readFile "` + tc.path + `" | trim }}
+  chart: mychart
+`,
+				"/path/to/values.yaml": "myrelease",
+				"/path/etc/passwd":     "myrelease",
+				"/etc/passwd":          "myrelease",
+			})
+			app := &App{
+				readFile:           testFs.ReadFile,
+				fileExists:         testFs.FileExists,
+				glob:               testFs.Glob,
+				abs:                testFs.Abs,
+				Env:                "default",
+				RestrictFileAccess: true,
+				AllowedDirs:        tc.allowedDirs,
+				Logger:             helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "is outside of the allowed directories") {
+					t.Fatalf("expected access to be denied, but got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if st.Releases[0].Name != "myrelease" {
+				t.Errorf("unexpected release name: expected=myrelease, got=%s", st.Releases[0].Name)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_RestrictFileAccess_Symlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, d := range []string{"helmfile", "outside"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "outside", "secret"), []byte("myrelease"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "helmfile", "link")); err != nil {
+		t.Fatal(err)
+	}
+	// The helmfile itself is loaded via a symlinked directory, which must still be the base directory
+	if err := os.Symlink(filepath.Join(dir, "helmfile"), filepath.Join(dir, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "symlink pointing outside", path: "link/secret", wantErr: true},
+		{name: "file via the symlinked helmfile dir", path: "values.yaml"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			yamlFile := filepath.Join(dir, "helmfile", "helmfile.yaml.gotmpl")
+			content := "releases:\n- name: {{ readFile \"" + tc.path + "\" | trim }}\n  chart: mychart\n"
+			if err := ioutil.WriteFile(yamlFile, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "helmfile", "values.yaml"), []byte("myrelease"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			app := &App{
+				readFile:           ioutil.ReadFile,
+				fileExists:         func(path string) (bool, error) { _, err := os.Stat(path); return err == nil, nil },
+				glob:               filepath.Glob,
+				abs:                filepath.Abs,
+				Env:                "default",
+				RestrictFileAccess: true,
+				Logger:             helmexec.NewLogger(os.Stderr, "debug"),
+			}
+			st, err := app.loadDesiredStateFromYaml(filepath.Join(dir, "linked", "helmfile.yaml.gotmpl"))
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "is outside of the allowed directories") {
+					t.Fatalf("expected access to be denied, but got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if st.Releases[0].Name != "myrelease" {
+				t.Errorf("unexpected release name: expected=myrelease, got=%s", st.Releases[0].Name)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_JSON(t *testing.T) {
+	jsonFile := "/path/to/helmfile.json"
+	testFs := testhelper.NewTestFs(map[string]string{
+		jsonFile: `{
+  "environments": {
+    "default": {
+      "values": [{"tier": "backend"}]
+    }
+  },
+  "releases": [
+    {
+      "name": "myrelease",
+      "chart": "mychart",
+      "labels": {"tier": "backend"},
+      "values": [{"template": "{{ .Values.tier }}"}]
+    },
+    {
+      "name": "myrelease2",
+      "chart": "mychart"
+    }
+  ]
+}
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(jsonFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(st.Releases) != 2 || st.Releases[0].Name != "myrelease" || st.Releases[1].Name != "myrelease2" {
+		t.Fatalf("unexpected releases: %v", st.Releases)
+	}
+
+	if st.Env.Values["tier"] != "backend" {
+		t.Errorf("unexpected environment values: %v", st.Env.Values)
+	}
+
+	values, ok := st.Releases[0].Values[0].(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("unexpected type of releases[0].values[0]: %T", st.Releases[0].Values[0])
+	}
+	if values["template"] != "{{ .Values.tier }}" {
+		t.Errorf("json helmfile must not be rendered: got %q", values["template"])
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ChartRewriter(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+releases:
+- name: foo
+  chart: stable/foo
+- name: bar
+  chart: stable/bar
+- name: baz
+  chart: ./charts/baz
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+		ChartRewriter: NewPrefixChartRewriter(map[string]string{
+			"stable/":    "mirror/",
+			"stable/foo": "internal/foo",
+		}),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"internal/foo", "mirror/bar", "./charts/baz"}
+	for i, r := range st.Releases {
+		if r.Chart != expected[i] {
+			t.Errorf("unexpected chart of release %s: expected=%s, got=%s", r.Name, expected[i], r.Chart)
+		}
+	}
+
+	app.ChartRewriter = func(release state.ReleaseSpec) (string, error) {
+		return "", fmt.Errorf("no mirror for %s", release.Chart)
+	}
+	_, err = app.loadDesiredStateFromYaml(yamlFile)
+	if err == nil || err.Error() != `failed rewriting chart of release "foo": no mirror for stable/foo` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_EmptyAfterRendering(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+{{ if eq .Environment.Name "production" }}
+releases:
+- name: myrelease
+  chart: mychart
+{{ end }}
+
+---
+
+{{ if eq .Environment.Name "production" }}
+helmfiles:
+- path: sub.yaml
+{{ end }}
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st == nil {
+		t.Fatal("expected an empty state, but got nil")
+	}
+
+	if len(st.Releases) != 0 || len(st.Helmfiles) != 0 {
+		t.Errorf("unexpected releases or helmfiles: releases=%v, helmfiles=%v", st.Releases, st.Helmfiles)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_SingleDocumentDirective(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	body := `releases:
+- name: myrelease
+  chart: mychart
+  values:
+  - manifests: |
+{{ ` + "`" + `kind: ConfigMap
+---
+kind: Secret` + "`" + ` | indent 6 }}
+`
+
+	testcases := []struct {
+		content string
+		wantErr bool
+	}{
+		{content: body, wantErr: true},
+		{content: SingleDocumentDirective + "\n" + body, wantErr: false},
+	}
+
+	for i, tc := range testcases {
+		testFs := testhelper.NewTestFs(map[string]string{
+			yamlFile: tc.content,
+		})
+		app := &App{
+			readFile:   testFs.ReadFile,
+			fileExists: testFs.FileExists,
+			glob:       testFs.Glob,
+			abs:        testFs.Abs,
+			Env:        "default",
+			Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+		}
+		st, err := app.loadDesiredStateFromYaml(yamlFile)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("case %d: expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		values, ok := st.Releases[0].Values[0].(map[interface{}]interface{})
+		if !ok {
+			t.Fatalf("case %d: unexpected type of releases[0].values[0]: %T", i, st.Releases[0].Values[0])
+		}
+		if expected := "kind: ConfigMap\n---\nkind: Secret\n"; values["manifests"] != expected {
+			t.Errorf("case %d: unexpected manifests: expected=%q, got=%q", i, expected, values["manifests"])
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_DocumentSeparator(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `environments:
+  default:
+    values:
+    - name: myrelease
+#### part ####
+helmfiles:
+- path: sub/helmfile.yaml
+releases:
+- name: {{ .Values.name }}
+  chart: mychart
+  values:
+  - manifests: |
+{{ ` + "`" + `kind: ConfigMap
+---
+kind: Secret` + "`" + ` | indent 6 }}
+`,
+		"/path/to/sub/helmfile.yaml": `environments:
+  default:
+    values:
+    - name: subrelease
+#### part ####
+releases:
+- name: {{ .Values.name }}
+  chart: mychart
+`,
+	}
+
+	app := appWithFs(&App{
+		KubeContext: "default",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		Env:         "default",
+	}, files)
+
+	// `---` in the manifests would split the helmfile in the middle of the values by default
+	if _, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml"); err == nil {
+		t.Fatal("expected error but got none")
+	}
+
+	opts := LoadOpts{DocumentSeparator: "#### part ####"}
+
+	st, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml", opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(st.Releases) != 1 || st.Releases[0].Name != "myrelease" {
+		t.Fatalf("unexpected releases: %v", st.Releases)
+	}
+	values, ok := st.Releases[0].Values[0].(map[interface{}]interface{})
+	if !ok {
+		t.Fatalf("unexpected type of releases[0].values[0]: %T", st.Releases[0].Values[0])
+	}
+	if expected := "kind: ConfigMap\n---\nkind: Secret\n"; values["manifests"] != expected {
+		t.Errorf("unexpected manifests: expected=%q, got=%q", expected, values["manifests"])
+	}
+
+	if err := app.initRemote(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var visited []string
+	err = app.visitStates("helmfile.yaml", opts, func(st *state.HelmState, _ helmexec.Interface) (bool, []error) {
+		for _, r := range st.Releases {
+			visited = append(visited, r.Name)
+		}
+		return len(st.Releases) > 0, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"subrelease", "myrelease"}; !reflect.DeepEqual(expected, visited) {
+		t.Errorf("unexpected releases visited: expected=%v, got=%v", expected, visited)
+	}
+
+	for _, sep := range []string{" ", "a\nb"} {
+		if _, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml", LoadOpts{DocumentSeparator: sep}); err == nil || !strings.Contains(err.Error(), "invalid document separator") {
+			t.Errorf("separator %q: expected invalid document separator error, got %v", sep, err)
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_IsolateDocumentEnvironments(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `environments:
+  default:
+    values:
+    - name: cascaded
+---
+releases:
+- name: {{ .Values | get "name" "isolated" }}
+  chart: mychart
+`,
+	}
+
+	testcases := []struct {
+		isolate  bool
+		expected string
+	}{
+		{isolate: false, expected: "cascaded"},
+		{isolate: true, expected: "isolated"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(fmt.Sprintf("isolate=%v", tc.isolate), func(t *testing.T) {
+			app := appWithFs(&App{
+				KubeContext: "default",
+				Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+				Env:         "default",
+			}, files)
+
+			st, err := app.loadDesiredStateFromYaml("/path/to/helmfile.yaml", LoadOpts{IsolateDocumentEnvironments: tc.isolate})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(st.Releases) != 1 || st.Releases[0].Name != tc.expected {
+				t.Errorf("unexpected releases: expected=%s, got=%v", tc.expected, st.Releases)
+			}
+
+			// The environments defined in the parts are merged regardless of the isolation
+			if st.Env.Values["name"] != "cascaded" {
+				t.Errorf("unexpected environment values: %v", st.Env.Values)
+			}
+		})
+	}
+}
+
+func TestLoadDesiredStateFromYaml_EnvvalsInheritanceToBaseTemplate(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../base.yaml
+---
+bases:
+# "envvals inheritance"
+# base.gotmpl should be able to reference environment values defined in the base.yaml and default/1.yaml
+- ../base.gotmpl
+---
+releases:
+- name: myrelease0
+  chart: mychart0
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/base.yaml": `environments:
+  default:
+    values:
+    - environments/default/1.yaml
+`,
+		"/path/to/base.gotmpl": `helmDefaults:
+  kubeContext: {{ .Environment.Values.foo }}
+  tillerNamespace: {{ .Environment.Values.tillerNs }}
+`,
+		"/path/to/yaml/environments/default/1.yaml": `tillerNs: TILLER_NS
+foo: FOO
+`,
+		"/path/to/yaml/templates.yaml": `templates:
+  default: &default
+    missingFileHandler: Warn
+    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
+		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	}
+
+	if st.Releases[0].Name != "myrelease0" {
+		t.Errorf("unexpected releases[0].name: expected=myrelease0, got=%s", st.Releases[0].Name)
+	}
+
+	if st.HelmDefaults.KubeContext != "FOO" {
+		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_InlineEnvVals(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../base.yaml
+---
+bases:
+# "envvals inheritance"
+# base.gotmpl should be able to reference environment values defined in the base.yaml and default/1.yaml
+- ../base.gotmpl
+---
+releases:
+- name: myrelease0
+  chart: mychart0
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/base.yaml": `environments:
+  default:
+    values:
+    - environments/default/1.yaml
+    - tillerNs: INLINE_TILLER_NS
+`,
+		"/path/to/base.gotmpl": `helmDefaults:
+  kubeContext: {{ .Environment.Values.foo }}
+  tillerNamespace: {{ .Environment.Values.tillerNs }}
+`,
+		"/path/to/yaml/environments/default/1.yaml": `tillerNs: TILLER_NS
+foo: FOO
+`,
+		"/path/to/yaml/templates.yaml": `templates:
+  default: &default
+    missingFileHandler: Warn
+    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "default",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if st.HelmDefaults.TillerNamespace != "INLINE_TILLER_NS" {
+		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	}
+
+	if st.Releases[0].Name != "myrelease0" {
+		t.Errorf("unexpected releases[0].name: expected=myrelease0, got=%s", st.Releases[0].Name)
+	}
+
+	if st.HelmDefaults.KubeContext != "FOO" {
+		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_WithNonDefaultEnv(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `bases:
+- ../base.yaml
+---
+bases:
+- ../base.gotmpl
+---
+helmDefaults:
+  kubeContext: {{ .Environment.Values.foo }}
+---
+releases:
+- name: myrelease0
+  chart: mychart0
+---
+
+{{ readFile "templates.yaml" }}
+
+releases:
+- name: myrelease1
+  chart: mychart1
+  labels:
+    stage: pre
+    foo: bar
+- name: myrelease1
+  chart: mychart2
+  labels:
+    stage: post
+  <<: *default
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/base.yaml": `environments:
+  test:
+    values:
+    - environments/default/1.yaml
+`,
+		"/path/to/yaml/environments/default/1.yaml": `foo: FOO`,
+		"/path/to/base.gotmpl": `environments:
+  test:
+    values:
+    - environments/default/2.yaml
+
+helmDefaults:
+  tillerNamespace: {{ .Environment.Values.tillerNs }}
+`,
+		"/path/to/yaml/environments/default/2.yaml": `tillerNs: TILLER_NS`,
+		"/path/to/yaml/templates.yaml": `templates:
+  default: &default
+    missingFileHandler: Warn
+    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+`,
+	})
+	app := &App{
+		readFile:   testFs.ReadFile,
+		fileExists: testFs.FileExists,
+		glob:       testFs.Glob,
+		abs:        testFs.Abs,
+		Env:        "test",
+		Logger:     helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.HelmDefaults.TillerNamespace != "TILLER_NS" {
+		t.Errorf("unexpected helmDefaults.tillerNamespace: expected=TILLER_NS, got=%s", st.HelmDefaults.TillerNamespace)
+	}
+
+	if st.Releases[0].Name != "myrelease0" {
+		t.Errorf("unexpected releases[0].name: expected=myrelease0, got=%s", st.Releases[0].Name)
+	}
+	firstRelease := st.Releases[1]
+	if firstRelease.Name != "myrelease1" {
+		t.Errorf("unexpected releases[1].name: expected=myrelease1, got=%s", firstRelease.Name)
+	}
+	secondRelease := st.Releases[2]
+	if secondRelease.Name != "myrelease1" {
+		t.Errorf("unexpected releases[2].name: expected=myrelease1, got=%s", secondRelease.Name)
+	}
+	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
+		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
+	}
+	if *secondRelease.MissingFileHandler != "Warn" {
+		t.Errorf("unexpected releases[2].missingFileHandler: expected=Warn, got=%s", *firstRelease.MissingFileHandler)
+	}
+
+	if secondRelease.Values[0] != "{{`{{.Release.Name}}`}}/values.yaml" {
+		t.Errorf("unexpected releases[2].missingFileHandler: expected={{`{{.Release.Name}}`}}/values.yaml, got=%s", firstRelease.Values[0])
+	}
+
+	if st.HelmDefaults.KubeContext != "FOO" {
+		t.Errorf("unexpected helmDefaults.kubeContext: expected=FOO, got=%s", st.HelmDefaults.KubeContext)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_WithReverse(t *testing.T) {
+	yamlFile := "/path/to/yaml/file"
+	yamlContent := `
+{{ readFile "templates.yaml" }}
+
+releases:
+- name: myrelease0
+  chart: mychart0
+- name: myrelease1
+  chart: mychart1
+  <<: *default
+---
+
+{{ readFile "templates.yaml" }}
+
+releases:
+- name: myrelease2
+  chart: mychart2
+- name: myrelease3
+  chart: mychart3
+  <<: *default
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: yamlContent,
+		"/path/to/yaml/templates.yaml": `templates:
+  default: &default
+    missingFileHandler: Warn
+    values: ["` + "{{`" + `{{.Release.Name}}` + "`}}" + `/values.yaml"]
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+		Reverse:  true,
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.Releases[0].Name != "myrelease3" {
+		t.Errorf("unexpected releases[0].name: expected=myrelease3, got=%s", st.Releases[0].Name)
+	}
+	if st.Releases[1].Name != "myrelease2" {
+		t.Errorf("unexpected releases[0].name: expected=myrelease2, got=%s", st.Releases[1].Name)
+	}
+	if st.Releases[3].Name != "myrelease0" {
+		t.Errorf("unexpected releases[3].name: expected=myrelease0, got=%s", st.Releases[3].Name)
+	}
+
+	if len(st.Releases) != 4 {
+		t.Errorf("unexpected number of releases: expected=4, got=%d", len(st.Releases))
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_MergeReleasesByKey(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+releases:
+- name: myapp
+  namespace: ns1
+  chart: mychart
+  labels:
+    tier: frontend
+- name: mydb
+  chart: mydbchart
+---
+releases:
+- name: myapp
+  namespace: ns1
+  version: 1.2.3
+- name: myapp
+  namespace: ns2
+  chart: mychart
+`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual []string
+	for _, r := range st.Releases {
+		actual = append(actual, fmt.Sprintf("%s/%s %s %s %v", r.Namespace, r.Name, r.Chart, r.Version, r.Labels))
+	}
+
+	expected := []string{
+		"ns1/myapp mychart 1.2.3 map[tier:frontend]",
+		"/mydb mydbchart  map[]",
+		"ns2/myapp mychart  map[]",
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_ConflictingReleases(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+releases:
+- name: myapp
+  chart: mychart
+---
+releases:
+- name: myapp
+  chart: otherchart
+`,
+	})
+
+	var buffer bytes.Buffer
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(&buffer, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.Releases[0].Chart != "otherchart" {
+		t.Errorf("unexpected chart: expected=otherchart, got=%s", st.Releases[0].Chart)
+	}
+
+	conflict := `release "myapp" in namespace "" is defined with chart "mychart" in a preceding part, but overridden with chart "otherchart" in this part`
+	if !strings.Contains(buffer.String(), conflict) {
+		t.Errorf("expected warning not found in logs: %s", buffer.String())
+	}
+
+	app.StrictReleaseMerge = true
+	_, err = app.loadDesiredStateFromYaml(yamlFile)
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+	if expected := "error during /path/to/helmfile.yaml.part.1 merging releases: " + conflict; err.Error() != expected {
+		t.Errorf("unexpected error: expected=%q, got=%q", expected, err.Error())
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_SkipRenderingPlainParts(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+	testFs := testhelper.NewTestFs(map[string]string{
+		yamlFile: `
+environments:
+  default:
+    values:
+    - name: myapp
+---
+releases:
+- name: {{ .Values.name }}
+  chart: mychart
+---
+releases:
+- name: mydb
+  chart: mydbchart
+`,
+	})
+
+	var buffer bytes.Buffer
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(&buffer, "debug"),
+	}
+	st, err := app.loadDesiredStateFromYaml(yamlFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual []string
+	for _, r := range st.Releases {
+		actual = append(actual, r.Name)
+	}
+	if expected := []string{"myapp", "mydb"}; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected releases: expected=%v, got=%v", expected, actual)
+	}
+
+	for i, skipped := range []bool{true, false, true} {
+		msg := fmt.Sprintf("skipping rendering %s.part.%d as it contains no template action", yamlFile, i)
+		if strings.Contains(buffer.String(), msg) != skipped {
+			t.Errorf("unexpected rendering of part %d: skipped=%v, logs:\n%s", i, !skipped, buffer.String())
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_ReverseSortKey(t *testing.T) {
+	yamlFile := "/path/to/helmfile.yaml"
+
+	testcases := []struct {
+		key      string
+		expected []string
+		wantErr  string
+	}{
+		{key: "", expected: []string{"b", "c", "a"}},
+		{key: "index", expected: []string{"b", "c", "a"}},
+		{key: "name", expected: []string{"c", "b", "a"}},
+		{key: "namespace", expected: []string{"a", "b", "c"}},
+		{key: "priority", expected: []string{"c", "b", "a"}},
+		{key: "foo", wantErr: `invalid reverse sort key "foo": it must be one of index, name, namespace, priority`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.key, func(t *testing.T) {
+			testFs := testhelper.NewTestFs(map[string]string{
+				yamlFile: `
+releases:
+- name: a
+  namespace: ns2
+  chart: mychart
+  priority: 1
+- name: c
+  namespace: ns1
+  chart: mychart
+- name: b
+  namespace: ns1
+  chart: mychart
+  priority: 1
+`,
+			})
+			app := &App{
+				readFile: testFs.ReadFile,
+				glob:     testFs.Glob,
+				abs:      testFs.Abs,
+				Env:      "default",
+				Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+				Reverse:  true,
+			}
+			st, err := app.loadDesiredStateFromYaml(yamlFile, LoadOpts{ReverseSortKey: tc.key})
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var actual []string
+			for _, r := range st.Releases {
+				actual = append(actual, r.Name)
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("unexpected order of releases: expected=%v, got=%v", tc.expected, actual)
+			}
+
+			keepOrder := tc.key != "" && tc.key != "index"
+			if st.KeepReleaseOrder != keepOrder {
+				t.Errorf("unexpected KeepReleaseOrder: expected=%t, got=%t", keepOrder, st.KeepReleaseOrder)
+			}
+		})
+	}
+}
+
+func TestReverseReleases_StableOnTies(t *testing.T) {
+	var releases []state.ReleaseSpec
+	var expected []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("r%02d", i)
+		releases = append(releases, state.ReleaseSpec{Name: name, Namespace: "ns", Priority: i % 2})
+	}
+	for i := 18; i >= 0; i -= 2 {
+		expected = append(expected, fmt.Sprintf("r%02d", i))
+	}
+	for i := 19; i >= 0; i -= 2 {
+		expected = append(expected, fmt.Sprintf("r%02d", i))
+	}
+
+	if err := reverseReleases(releases, ReverseSortKeyPriority); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual []string
+	for _, r := range releases {
+		actual = append(actual, r.Name)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected order of releases: expected=%v, got=%v", expected, actual)
+	}
+}
+
+// See https://github.com/roboll/helmfile/issues/615
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_NoMergeArrayInEnvVal(t *testing.T) {
+	statePath := "/path/to/helmfile.yaml"
+	stateContent := `
+environments:
+  default:
+    values:
+    - foo: ["foo"]
+---
+environments:
+  default:
+    values:
+    - foo: ["FOO"]
+    - 1.yaml
+---
+environments:
+  default:
+    values:
+    - 2.yaml
+---
+releases:
+- name: {{ .Environment.Values.foo | quote }}
+  chart: {{ .Environment.Values.bar | quote }}
+`
+	testFs := testhelper.NewTestFs(map[string]string{
+		statePath:         stateContent,
+		"/path/to/1.yaml": `bar: ["bar"]`,
+		"/path/to/2.yaml": `bar: ["BAR"]`,
+	})
+	app := &App{
+		readFile: testFs.ReadFile,
+		glob:     testFs.Glob,
+		abs:      testFs.Abs,
+		Env:      "default",
+		Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+		Reverse:  true,
+	}
+	st, err := app.loadDesiredStateFromYaml(statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.Releases[0].Name != "[FOO]" {
+		t.Errorf("unexpected releases[0].name: expected=FOO, got=%s", st.Releases[0].Name)
+	}
+	if st.Releases[0].Chart != "[BAR]" {
+		t.Errorf("unexpected releases[0].chart: expected=BAR, got=%s", st.Releases[0].Chart)
+	}
+}
+
+// See https://github.com/roboll/helmfile/issues/623
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_MergeMapsVariousKeys(t *testing.T) {
+	type testcase struct {
+		overrideValues interface{}
+		expected       string
+	}
+	testcases := []testcase{
+		{map[interface{}]interface{}{"foo": "FOO"}, `FOO`},
+		{map[interface{}]interface{}{"foo": map[interface{}]interface{}{"foo": "FOO"}}, `map[foo:FOO]`},
+		{map[interface{}]interface{}{"foo": map[string]interface{}{"foo": "FOO"}}, `map[foo:FOO]`},
+		{map[interface{}]interface{}{"foo": []interface{}{"foo"}}, `[foo]`},
+		{map[interface{}]interface{}{"foo": "FOO"}, `FOO`},
+	}
+	for i := range testcases {
+		tc := testcases[i]
+		statePath := "/path/to/helmfile.yaml"
+		stateContent := `
+environments:
+  default:
+    values:
+    - 1.yaml
+    - 2.yaml
+---
+releases:
+- name: {{ .Environment.Values.foo | quote }}
+  chart: {{ .Environment.Values.bar | quote }}
+`
+		testFs := testhelper.NewTestFs(map[string]string{
+			statePath:         stateContent,
+			"/path/to/1.yaml": `bar: ["bar"]`,
+			"/path/to/2.yaml": `bar: ["BAR"]`,
+		})
+		app := &App{
+			readFile: testFs.ReadFile,
+			glob:     testFs.Glob,
+			abs:      testFs.Abs,
+			Env:      "default",
+			Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+			Reverse:  true,
+		}
+		opts := LoadOpts{
+			CalleePath: statePath,
+			Environment: state.SubhelmfileEnvironmentSpec{
+				OverrideValues: []interface{}{tc.overrideValues},
+			},
+		}
+		st, err := app.loadDesiredStateFromYaml(statePath, opts)
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if st.Releases[0].Name != tc.expected {
+			t.Errorf("unexpected releases[0].name: expected=%s, got=%s", tc.expected, st.Releases[0].Name)
+		}
+		if st.Releases[0].Chart != "[BAR]" {
+			t.Errorf("unexpected releases[0].chart: expected=BAR, got=%s", st.Releases[0].Chart)
+		}
+	}
+}
+
+func TestLoadDesiredStateFromYaml_MultiPartTemplate_SprigDictFuncs(t *testing.T) {
+	type testcase struct {
+		state    string
+		expr     string
+		expected string
+	}
+	stateInline := `
+environments:
+  default:
+    values:
+    - foo: FOO
+      bar: { "baz": "BAZ" }
+---
+releases:
+- name: %s
+  chart: stable/nginx
+`
+	stateExternal := `
+environments:
+  default:
+    values:
+    - 1.yaml
+    - 2.yaml
+---
+releases:
+- name: %s
+  chart: stable/nginx
+`
+	testcases := []testcase{
+		{stateInline, `{{ getOrNil "foo" .Environment.Values }}`, `FOO`},
+		{stateInline, `{{ getOrNil "baz" (getOrNil "bar" .Environment.Values) }}`, `BAZ`},
+		{stateInline, `{{ if hasKey .Environment.Values "foo" }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
+		{stateInline, `{{ if hasKey .Environment.Values "bar" }}{{ .Environment.Values.bar.baz }}{{ end }}`, `BAZ`},
+		{stateInline, `{{ if (keys .Environment.Values | has "foo") }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
+		// See https://github.com/roboll/helmfile/issues/624
+		// This fails when .Environment.Values.bar is not map[string]interface{}. At the time of #624 it was map[interface{}]interface{}, which sprig's dict funcs don't support.
+		{stateInline, `{{ if (keys .Environment.Values | has "bar") }}{{ if (keys .Environment.Values.bar | has "baz") }}{{ .Environment.Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
+		{stateExternal, `{{ getOrNil "foo" .Environment.Values }}`, `FOO`},
+		{stateExternal, `{{ getOrNil "baz" (getOrNil "bar" .Environment.Values) }}`, `BAZ`},
+		{stateExternal, `{{ if hasKey .Environment.Values "foo" }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
+		{stateExternal, `{{ if hasKey .Environment.Values "bar" }}{{ .Environment.Values.bar.baz }}{{ end }}`, `BAZ`},
+		{stateExternal, `{{ if (keys .Environment.Values | has "foo") }}{{ .Environment.Values.foo }}{{ end }}`, `FOO`},
+		// See https://github.com/roboll/helmfile/issues/624
+		{stateExternal, `{{ if (keys .Environment.Values | has "bar") }}{{ if (keys .Environment.Values.bar | has "baz") }}{{ .Environment.Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
+		// See https://github.com/roboll/helmfile/issues/643
+		{stateExternal, `{{ range $service := .Environment.Values.services }}{{ $service.name }}{{ if hasKey $service "something" }}{{ $service.something }}{{ end }}{{ end }}`, `xyfalse`},
+		// Same test with .Values
+		{stateInline, `{{ getOrNil "foo" .Values }}`, `FOO`},
+		{stateInline, `{{ getOrNil "baz" (getOrNil "bar" .Values) }}`, `BAZ`},
+		{stateInline, `{{ if hasKey .Values "foo" }}{{ .Values.foo }}{{ end }}`, `FOO`},
+		{stateInline, `{{ if hasKey .Values "bar" }}{{ .Values.bar.baz }}{{ end }}`, `BAZ`},
+		{stateInline, `{{ if (keys .Values | has "foo") }}{{ .Values.foo }}{{ end }}`, `FOO`},
+		// See https://github.com/roboll/helmfile/issues/624
+		// This fails when .Values.bar is not map[string]interface{}. At the time of #624 it was map[interface{}]interface{}, which sprig's dict funcs don't support.
+		{stateInline, `{{ if (keys .Values | has "bar") }}{{ if (keys .Values.bar | has "baz") }}{{ .Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
+		{stateExternal, `{{ getOrNil "foo" .Values }}`, `FOO`},
+		{stateExternal, `{{ getOrNil "baz" (getOrNil "bar" .Values) }}`, `BAZ`},
+		{stateExternal, `{{ if hasKey .Values "foo" }}{{ .Values.foo }}{{ end }}`, `FOO`},
+		{stateExternal, `{{ if hasKey .Values "bar" }}{{ .Values.bar.baz }}{{ end }}`, `BAZ`},
+		{stateExternal, `{{ if (keys .Values | has "foo") }}{{ .Values.foo }}{{ end }}`, `FOO`},
+		// See https://github.com/roboll/helmfile/issues/624
+		{stateExternal, `{{ if (keys .Values | has "bar") }}{{ if (keys .Values.bar | has "baz") }}{{ .Values.bar.baz }}{{ end }}{{ end }}`, `BAZ`},
+		// See https://github.com/roboll/helmfile/issues/643
+		{stateExternal, `{{ range $service := .Values.services }}{{ $service.name }}{{ if hasKey $service "something" }}{{ $service.something }}{{ end }}{{ end }}`, `xyfalse`},
+	}
+	for i := range testcases {
+		tc := testcases[i]
+		statePath := "/path/to/helmfile.yaml"
+		stateContent := fmt.Sprintf(tc.state, tc.expr)
+		testFs := testhelper.NewTestFs(map[string]string{
+			statePath:         stateContent,
+			"/path/to/1.yaml": `foo: FOO`,
+			"/path/to/2.yaml": `bar: { "baz": "BAZ" }
+services:
+  - name: "x"
+  - name: "y"
+    something: false
+`,
+		})
+		app := &App{
+			readFile: testFs.ReadFile,
+			glob:     testFs.Glob,
+			abs:      testFs.Abs,
+			Env:      "default",
+			Logger:   helmexec.NewLogger(os.Stderr, "debug"),
+			Reverse:  true,
+		}
+		st, err := app.loadDesiredStateFromYaml(statePath)
+
+		if err != nil {
+			t.Fatalf("unexpected error at %d: %v", i, err)
+		}
+
+		if st.Releases[0].Name != tc.expected {
+			t.Errorf("unexpected releases[0].name at %d: expected=%s, got=%s", i, tc.expected, st.Releases[0].Name)
+		}
+	}
+}
+
+type configImpl struct {
+	set      []string
+	validate bool
+	ordered  bool
+	logger   *zap.SugaredLogger
+
+	golden       string
+	updateGolden bool
+
+	withValues bool
+	prefix     string
+
+	outputFileTemplate string
+}
+
+func (c configImpl) Set() []string {
+	return c.set
+}
+
+func (c configImpl) Values() []string {
+	return []string{}
+}
+
+func (c configImpl) Args() string {
+	return "some args"
+}
+
+func (c configImpl) SkipDeps() bool {
+	return true
+}
+
+func (c configImpl) OutputDir() string {
+	return "output/subdir"
+}
+
+func (c configImpl) Validate() bool {
+	return c.validate
+}
+
+func (c configImpl) Ordered() bool {
+	return c.ordered
+}
+
+func (c configImpl) Golden() string {
+	return c.golden
+}
+
+func (c configImpl) UpdateGolden() bool {
+	return c.updateGolden
+}
+
+func (c configImpl) WithValues() bool {
+	return c.withValues
+}
+
+func (c configImpl) Prefix() string {
+	return c.prefix
+}
+
+func (c configImpl) OutputFileTemplate() string {
+	return c.outputFileTemplate
+}
+
+func (c configImpl) Logger() *zap.SugaredLogger {
+	return c.logger
+}
+
+func (c configImpl) Concurrency() int {
+	return 1
+}
+
+// Mocking the command-line runner
+
+type mockRunner struct {
+	output []byte
+	err    error
+}
+
+func (mock *mockRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func MockExecer(logger *zap.SugaredLogger, kubeContext string) helmexec.Interface {
+	execer := helmexec.New(logger, kubeContext, &mockRunner{})
+	return execer
+}
+
+// mocking helmexec.Interface
+
+type listKey struct {
+	filter string
+	flags  string
+}
+
+type mockHelmExec struct {
+	templated []mockTemplates
+
+	updateDepsCallbacks map[string]func(string) error
+}
+
+type mockTemplates struct {
+	name, chart string
+	flags       []string
+}
+
+func (helm *mockHelmExec) TemplateRelease(name, chart string, flags ...string) error {
+	helm.templated = append(helm.templated, mockTemplates{name: name, chart: chart, flags: flags})
+	return nil
+}
+
+func (helm *mockHelmExec) UpdateDeps(chart string) error {
+	return nil
+}
+
+func (helm *mockHelmExec) BuildDeps(name, chart string) error {
+	return nil
+}
+
+func (helm *mockHelmExec) SetExtraArgs(args ...string) {
+	return
+}
+func (helm *mockHelmExec) SetHelmBinary(bin string) {
+	return
+}
+func (helm *mockHelmExec) WithHelmBinary(bin string) helmexec.Interface {
+	return helm
+}
+func (helm *mockHelmExec) AddRepo(name, repository, cafile, certfile, keyfile, username, password string) error {
+	return nil
+}
+func (helm *mockHelmExec) UpdateRepo() error {
+	return nil
+}
+func (helm *mockHelmExec) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) DiffRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) ReleaseStatus(context helmexec.HelmContext, release string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) DeleteRelease(context helmexec.HelmContext, name string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) DeleteReleases(context helmexec.HelmContext, names []string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) RollbackRelease(context helmexec.HelmContext, name string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) List(context helmexec.HelmContext, filter string, flags ...string) (string, error) {
+	return "", nil
+}
+func (helm *mockHelmExec) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
+	return "", nil
+}
+func (helm *mockHelmExec) TestRelease(context helmexec.HelmContext, name string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) Fetch(chart string, flags ...string) error {
+	return nil
+}
+func (helm *mockHelmExec) Lint(name, chart string, flags ...string) error {
+	return nil
+}
+
+func TestTemplate_SingleStateFile(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+- name: myrelease2
+  chart: mychart2
+`,
+	}
+
+	var helm = &mockHelmExec{}
+	var wantReleases = []mockTemplates{
+		{name: "myrelease1", chart: "mychart1", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease1"}},
+		{name: "myrelease2", chart: "mychart2", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease2"}},
+	}
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	valsRuntime, err := vals.New(32)
+	if err != nil {
+		t.Errorf("unexpected error creating vals runtime: %v", err)
+	}
+
+	app := appWithFs(&App{
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		KubeContext: "default",
+		Env:         "default",
+		Logger:      logger,
+		helmExecer:  helm,
+		Namespace:   "testNamespace",
+		valsRuntime: valsRuntime,
+	}, files)
+	app.Template(configImpl{set: []string{"foo=a", "bar=b"}})
+
+	for i := range wantReleases {
+		if wantReleases[i].name != helm.templated[i].name {
+			t.Errorf("name = [%v], want %v", helm.templated[i].name, wantReleases[i].name)
+		}
+		if !strings.Contains(helm.templated[i].chart, wantReleases[i].chart) {
+			t.Errorf("chart = [%v], want %v", helm.templated[i].chart, wantReleases[i].chart)
+		}
+		for j := range wantReleases[i].flags {
+			if j == 7 {
+				matched, _ := regexp.Match(wantReleases[i].flags[j], []byte(helm.templated[i].flags[j]))
+				if !matched {
+					t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
+				}
+			} else if wantReleases[i].flags[j] != helm.templated[i].flags[j] {
+				t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
+			}
+		}
+
+	}
+}
+
+// valuesRecordingHelmExec records the content of the values files given to each `helm template`,
+// which are removed once the release is templated
+type valuesRecordingHelmExec struct {
+	*mockHelmExec
+	values map[string][]string
+}
+
+func (helm *valuesRecordingHelmExec) TemplateRelease(name, chart string, flags ...string) error {
+	for i := 0; i < len(flags)-1; i++ {
+		if flags[i] != "--values" {
+			continue
+		}
+		bs, err := ioutil.ReadFile(flags[i+1])
+		if err != nil {
+			return err
+		}
+		helm.values[name] = append(helm.values[name], string(bs))
+	}
+	return helm.mockHelmExec.TemplateRelease(name, chart, flags...)
+}
+
+func TestTemplate_ValuesTransform(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+  values:
+  - values.yaml
+  - replicas: 2
+- name: myrelease2
+  chart: mychart2
+`,
+		"/path/to/values.yaml": `
+image: foo
+replicas: 1
+`,
+	}
+
+	transform := func(release state.ReleaseSpec, values map[string]interface{}) (map[string]interface{}, error) {
+		if release.Name == "broken" {
+			return nil, fmt.Errorf("unexpected release")
+		}
+		values["commonLabels"] = map[string]interface{}{"team": "platform"}
+		if replicas, ok := values["replicas"].(int); ok {
+			values["replicas"] = replicas * 10
+		}
+		return values, nil
+	}
+
+	helm := &valuesRecordingHelmExec{mockHelmExec: &mockHelmExec{}, values: map[string][]string{}}
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	app := appWithFs(&App{
+		glob:            filepath.Glob,
+		abs:             filepath.Abs,
+		Env:             "default",
+		Logger:          logger,
+		helmExecer:      helm,
+		valsRuntime:     fakeVals{},
+		ValuesTransform: transform,
+	}, files)
+
+	if err := app.Template(configImpl{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The values files and inline values are merged before the transform, and given to helm as a single values file
+	expected := map[string][]string{
+		"myrelease1": {"commonLabels:\n  team: platform\nimage: foo\nreplicas: 20\n"},
+		"myrelease2": {"commonLabels:\n  team: platform\n"},
+	}
+	if !reflect.DeepEqual(helm.values, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, helm.values)
+	}
+
+	// Releases filtered out are never transformed, so that their values files aren't rendered
+	files["/path/to/helmfile.yaml"] = `
+releases:
+- name: myrelease1
+  chart: mychart1
+- name: broken
+  chart: mychart
+  values:
+  - missing.yaml
+`
+
+	helm.values = map[string][]string{}
+
+	app = appWithFs(&App{
+		glob:            filepath.Glob,
+		abs:             filepath.Abs,
+		Env:             "default",
+		Logger:          logger,
+		helmExecer:      helm,
+		valsRuntime:     fakeVals{},
+		Selectors:       []string{"name=myrelease1"},
+		ValuesTransform: transform,
+	}, files)
+
+	if err := app.Template(configImpl{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = map[string][]string{
+		"myrelease1": {"commonLabels:\n  team: platform\n"},
+	}
+	if !reflect.DeepEqual(helm.values, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, helm.values)
+	}
+
+	files["/path/to/helmfile.yaml"] = `
+releases:
+- name: broken
+  chart: mychart
+`
+
+	app = appWithFs(&App{
+		glob:            filepath.Glob,
+		abs:             filepath.Abs,
+		Env:             "default",
+		Logger:          logger,
+		helmExecer:      helm,
+		valsRuntime:     fakeVals{},
+		ValuesTransform: transform,
+	}, files)
+
+	err := app.Template(configImpl{})
+	if err == nil || !strings.Contains(err.Error(), `failed transforming values of release "broken": unexpected release`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTemplate_Validate(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- sub/helmfile.yaml
+releases:
+- name: app
+  chart: mychart
+  needs:
+  - db
+- name: db
+  chart: mychart
+`,
+		"/path/to/sub/helmfile.yaml": `
+releases:
+- name: {{ .Environment.Name }}-sub
+  chart: mychart
+`,
+	}
+
+	var helm = &mockHelmExec{}
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "info")
+
+	app := appWithFs(&App{
+		glob:       filepath.Glob,
+		abs:        filepath.Abs,
+		Env:        "default",
+		Logger:     logger,
+		helmExecer: helm,
+	}, files)
+	if err := app.Template(configImpl{validate: true, logger: logger}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(helm.templated) > 0 {
+		t.Errorf("unexpected releases templated: %v", helm.templated)
+	}
+
+	for _, expected := range []string{
+		"2 release(s) in helmfile.yaml are valid, and would be synced in this order:\n  1. db\n  2. app\n",
+		"1 release(s) in helmfile.yaml are valid, and would be synced in this order:\n  1. default-sub\n",
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, buffer.String())
+		}
+	}
+
+	files["/path/to/helmfile.yaml"] = `
+releases:
+- name: app
+  chart: mychart
+  needs:
+  - cache
+`
+	app = appWithFs(&App{
+		glob:       filepath.Glob,
+		abs:        filepath.Abs,
+		Env:        "default",
+		Logger:     logger,
+		helmExecer: helm,
+	}, files)
+	err := app.Template(configImpl{validate: true, logger: logger})
+	if err == nil {
+		t.Fatal("expected error did not occur")
+	}
+	if expected := `"app" needs "cache", but it must be one of app`; !strings.Contains(err.Error(), expected) {
+		t.Errorf("unexpected error: expected to contain %q, got %q", expected, err.Error())
+	}
+}
+
+func captureStdout(f func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	stdout := os.Stdout
+	defer func() {
+		os.Stdout = stdout
+		log.SetOutput(os.Stderr)
+	}()
+	os.Stdout = writer
+	log.SetOutput(writer)
+	out := make(chan string)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		var buf bytes.Buffer
+		wg.Done()
+		io.Copy(&buf, reader)
+		out <- buf.String()
+	}()
+	wg.Wait()
+	f()
+	writer.Close()
+	return <-out
+}
+
+func TestPrint_SingleStateFile(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+- name: myrelease2
+  chart: mychart1
+`,
+	}
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	app := appWithFs(&App{
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		KubeContext: "default",
+		Env:         "default",
+		Logger:      logger,
+		Namespace:   "testNamespace",
+	}, files)
+	out := captureStdout(func() {
+		err := app.PrintState(configImpl{})
+		assert.NilError(t, err)
+	})
+	assert.Assert(t, strings.Count(out, "---") == 1,
+		"state should contain '---' yaml doc separator:\n%s\n", out)
+	assert.Assert(t, strings.Contains(out, "helmfile.yaml"),
+		"state should contain source helmfile name:\n%s\n", out)
+	assert.Assert(t, strings.Contains(out, "name: myrelease1"),
+		"state should contain releases:\n%s\n", out)
+}
+
+func TestPrint_MultiStateFile(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/first.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+- name: myrelease2
+  chart: mychart1
+`,
+		"/path/to/helmfile.d/second.yaml": `
+releases:
+- name: myrelease3
+  chart: mychart1
+- name: myrelease4
+  chart: mychart1
+`,
+	}
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	app := appWithFs(&App{
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		KubeContext: "default",
+		Env:         "default",
+		Logger:      logger,
+		Namespace:   "testNamespace",
+	}, files)
+	out := captureStdout(func() {
+		err := app.PrintState(configImpl{})
+		assert.NilError(t, err)
+	})
+	assert.Assert(t, strings.Count(out, "---") == 2,
+		"state should contain '---' yaml doc separators:\n%s\n", out)
+	assert.Assert(t, strings.Contains(out, "second.yaml"),
+		"state should contain source helmfile name:\n%s\n", out)
+	assert.Assert(t, strings.Contains(out, "second.yaml"),
+		"state should contain source helmfile name:\n%s\n", out)
+}
+
+func TestList(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.d/first.yaml": `
+releases:
+- name: myrelease1
+  chart: mychart1
+  installed: no
+  labels:
+    id: myrelease1
+- name: myrelease2
+  chart: mychart1
+`,
+		"/path/to/helmfile.d/second.yaml": `
+releases:
+- name: myrelease3
+  chart: mychart1
+  installed: yes
+- name: myrelease4
+  chart: mychart1
+  labels:
+    id: myrelease1
+`,
+	}
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	app := appWithFs(&App{
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		KubeContext: "default",
+		Env:         "default",
+		Logger:      logger,
+		Namespace:   "testNamespace",
+	}, files)
+	out := captureStdout(func() {
+		err := app.ListReleases(configImpl{})
+		assert.NilError(t, err)
+	})
+
+	expected := `NAME      	NAMESPACE	INSTALLED	LABELS       
+myrelease1	         	false    	id:myrelease1
+myrelease2	         	true     	             
+myrelease3	         	true     	             
+myrelease4	         	true     	id:myrelease1
+`
+	assert.Equal(t, expected, out)
+}
+
+func TestList_Ordered(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+releases:
+- name: app
+  chart: mychart1
+  needs:
+  - db
+  - cache
+- name: db
+  chart: mychart1
+  labels:
+    tier: backend
+- name: cache
+  chart: mychart1
+  needs:
+  - db
+- name: old
+  chart: mychart1
+  installed: false
+`,
+	}
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+
+	var buffer bytes.Buffer
+	logger := helmexec.NewLogger(&buffer, "debug")
+
+	app := appWithFs(&App{
+		glob:        filepath.Glob,
+		abs:         filepath.Abs,
+		KubeContext: "default",
+		Env:         "default",
+		Logger:      logger,
+	}, files)
+	out := captureStdout(func() {
+		err := app.ListReleases(configImpl{ordered: true})
+		assert.NilError(t, err)
+	})
+
+	expected := `NAME 	NAMESPACE	INSTALLED	LABELS      	GROUP
+db   	         	true     	tier:backend	1    
+old  	         	false    	            	1    
+cache	         	true     	            	2    
+app  	         	true     	            	3    
+`
+	assert.Equal(t, expected, out)
+}
+
+func TestPlan(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+helmfiles:
+- path: apps/helmfile.yaml
+releases:
+- name: db
+  chart: mychart1
+- name: cache
+  chart: mychart1
+- name: app
+  namespace: web
+  chart: mychart1
+  needs:
+  - db
+  - cache
 `,
+		"/path/to/apps/helmfile.yaml": `
+releases:
+- name: frontend
+  chart: mychart1
+`,
+	}
+
+	expected := `- helmfile: apps/helmfile.yaml
+  groups:
+  - - frontend
+- helmfile: helmfile.yaml
+  groups:
+  - - cache
+    - db
+  - - web/app
+`
+
+	newApp := func(files map[string]string) *App {
+		return appWithFs(&App{
+			KubeContext: "default",
+			Env:         "default",
+			Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		}, files)
+	}
+
+	t.Run("print", func(t *testing.T) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
+
+		out := captureStdout(func() {
+			err := newApp(files).Plan(configImpl{})
+			assert.NilError(t, err)
 		})
-		app := &App{
-			readFile: testFs.ReadFile,
-			glob:     testFs.Glob,
-			abs:      testFs.Abs,
-			Env:      "default",
-			Logger:   helmexec.NewLogger(os.Stderr, "debug"),
-			Reverse:  true,
-		}
-		st, err := app.loadDesiredStateFromYaml(statePath)
 
-		if err != nil {
-			t.Fatalf("unexpected error at %d: %v", i, err)
+		assert.Equal(t, expected, out)
+	})
+
+	t.Run("golden", func(t *testing.T) {
+		fs := map[string]string{"/path/to/helmfile.plan.yaml": expected}
+		for k, v := range files {
+			fs[k] = v
 		}
 
-		if st.Releases[0].Name != tc.expected {
-			t.Errorf("unexpected releases[0].name at %d: expected=%s, got=%s", i, tc.expected, st.Releases[0].Name)
+		err := newApp(fs).Plan(configImpl{golden: "helmfile.plan.yaml"})
+		assert.NilError(t, err)
+	})
+
+	t.Run("golden differs", func(t *testing.T) {
+		fs := map[string]string{"/path/to/helmfile.plan.yaml": strings.Replace(expected, "    - db\n", "", 1)}
+		for k, v := range files {
+			fs[k] = v
 		}
-	}
-}
 
-type configImpl struct {
-	set []string
-}
+		err := newApp(fs).Plan(configImpl{golden: "helmfile.plan.yaml"})
+		assert.Error(t, err, `plan differs from helmfile.plan.yaml at line 7: expected "  - - web/app", got "    - db". run with --update-golden to update it if the change is expected`)
+	})
 
-func (c configImpl) Set() []string {
-	return c.set
-}
+	t.Run("update golden", func(t *testing.T) {
+		written := map[string]string{}
 
-func (c configImpl) Values() []string {
-	return []string{}
-}
+		app := newApp(files)
+		app.writeFile = func(path string, content []byte, mode os.FileMode) error {
+			written[path] = string(content)
+			return nil
+		}
 
-func (c configImpl) Args() string {
-	return "some args"
-}
+		err := app.Plan(configImpl{golden: "helmfile.plan.yaml", updateGolden: true})
+		assert.NilError(t, err)
 
-func (c configImpl) SkipDeps() bool {
-	return true
+		assert.Equal(t, expected, written["helmfile.plan.yaml"])
+	})
 }
 
-func (c configImpl) OutputDir() string {
-	return "output/subdir"
-}
+func TestFormatApplyPreview(t *testing.T) {
+	preview := &state.ApplyPreview{
+		Installed: []state.ReleaseDiff{
+			{ReleaseSpec: &state.ReleaseSpec{Name: "grault", Chart: "stable/grault"}, Changes: 2},
+		},
+		Upgraded: []state.ReleaseDiff{
+			{ReleaseSpec: &state.ReleaseSpec{Name: "foo", Chart: "stable/foo"}, Changes: 3},
+			{ReleaseSpec: &state.ReleaseSpec{Name: "bar", Chart: "stable/bar"}, Changes: 1},
+			{ReleaseSpec: &state.ReleaseSpec{Name: "baz", Chart: "stable/baz"}},
+		},
+		Uninstalled: []*state.ReleaseSpec{
+			{Name: "corge", Chart: "stable/corge"},
+		},
+		Unchanged: []*state.ReleaseSpec{
+			{Name: "qux", Chart: "stable/qux"},
+			{Name: "quux", Chart: "stable/quux"},
+		},
+	}
 
-func (c configImpl) Concurrency() int {
-	return 1
-}
+	expected := `Affected releases are:
+  grault (stable/grault) INSTALLED, 2 resources changed
+  foo (stable/foo) UPDATED, 3 resources changed
+  bar (stable/bar) UPDATED, 1 resource changed
+  baz (stable/baz) UPDATED
+  corge (stable/corge) DELETED
 
-// Mocking the command-line runner
+1 release(s) to be installed, 3 release(s) to be updated, 1 release(s) to be deleted, 2 release(s) unchanged`
 
-type mockRunner struct {
-	output []byte
-	err    error
+	assert.Equal(t, expected, formatApplyPreview(preview))
 }
 
-func (mock *mockRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
-	return []byte{}, nil
-}
+func TestListEnvironments(t *testing.T) {
+	files := map[string]string{
+		"/path/to/helmfile.yaml": `
+environments:
+  staging:
+    values:
+    - domain: staging.example.com
+  production:
+    values:
+    - domain: example.com
+---
+helmfiles:
+- path: apps/helmfile.yaml
+releases:
+- name: db
+  chart: mychart1
+`,
+		"/path/to/apps/helmfile.yaml": `
+environments:
+  production:
+    values:
+    - replicas: 3
+  canary:
+---
+releases:
+- name: frontend
+  chart: mychart1
+`,
+		"/path/to/single.yaml": `
+releases:
+- name: frontend
+  chart: mychart1
+`,
+	}
 
-func MockExecer(logger *zap.SugaredLogger, kubeContext string) helmexec.Interface {
-	execer := helmexec.New(logger, kubeContext, &mockRunner{})
-	return execer
-}
+	newApp := func(fileOrDir string) *App {
+		return appWithFs(&App{
+			KubeContext: "default",
+			Env:         "production",
+			FileOrDir:   fileOrDir,
+			Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		}, files)
+	}
 
-// mocking helmexec.Interface
+	t.Run("names", func(t *testing.T) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
 
-type listKey struct {
-	filter string
-	flags  string
-}
+		out := captureStdout(func() {
+			err := newApp("helmfile.yaml").ListEnvironments(configImpl{})
+			assert.NilError(t, err)
+		})
 
-type mockHelmExec struct {
-	templated []mockTemplates
+		// canary is defined only in the nested helmfile, which is skipped along with the parent when canary is selected
+		assert.Equal(t, "production\nstaging\n", out)
+	})
 
-	updateDepsCallbacks map[string]func(string) error
-}
+	t.Run("default only", func(t *testing.T) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
 
-type mockTemplates struct {
-	name, chart string
-	flags       []string
-}
+		out := captureStdout(func() {
+			err := newApp("single.yaml").ListEnvironments(configImpl{})
+			assert.NilError(t, err)
+		})
 
-func (helm *mockHelmExec) TemplateRelease(name, chart string, flags ...string) error {
-	helm.templated = append(helm.templated, mockTemplates{name: name, chart: chart, flags: flags})
-	return nil
-}
+		assert.Equal(t, "default\n", out)
+	})
 
-func (helm *mockHelmExec) UpdateDeps(chart string) error {
-	return nil
-}
+	t.Run("with values", func(t *testing.T) {
+		stdout := os.Stdout
+		defer func() { os.Stdout = stdout }()
 
-func (helm *mockHelmExec) BuildDeps(name, chart string) error {
-	return nil
-}
+		app := newApp("helmfile.yaml")
 
-func (helm *mockHelmExec) SetExtraArgs(args ...string) {
-	return
-}
-func (helm *mockHelmExec) SetHelmBinary(bin string) {
-	return
-}
-func (helm *mockHelmExec) AddRepo(name, repository, cafile, certfile, keyfile, username, password string) error {
-	return nil
-}
-func (helm *mockHelmExec) UpdateRepo() error {
-	return nil
-}
-func (helm *mockHelmExec) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
-	return nil
-}
-func (helm *mockHelmExec) DiffRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
-	return nil
-}
-func (helm *mockHelmExec) ReleaseStatus(context helmexec.HelmContext, release string, flags ...string) error {
-	return nil
-}
-func (helm *mockHelmExec) DeleteRelease(context helmexec.HelmContext, name string, flags ...string) error {
-	return nil
-}
-func (helm *mockHelmExec) List(context helmexec.HelmContext, filter string, flags ...string) (string, error) {
-	return "", nil
-}
-func (helm *mockHelmExec) DecryptSecret(context helmexec.HelmContext, name string, flags ...string) (string, error) {
-	return "", nil
-}
-func (helm *mockHelmExec) TestRelease(context helmexec.HelmContext, name string, flags ...string) error {
-	return nil
-}
-func (helm *mockHelmExec) Fetch(chart string, flags ...string) error {
-	return nil
-}
-func (helm *mockHelmExec) Lint(name, chart string, flags ...string) error {
-	return nil
+		out := captureStdout(func() {
+			err := app.ListEnvironments(configImpl{withValues: true})
+			assert.NilError(t, err)
+		})
+
+		expected := `- helmfile: apps/helmfile.yaml
+  environment: production
+  values:
+    replicas: 3
+- helmfile: helmfile.yaml
+  environment: production
+  values:
+    domain: example.com
+- helmfile: helmfile.yaml
+  environment: staging
+  values:
+    domain: staging.example.com
+`
+		assert.Equal(t, expected, out)
+		assert.Equal(t, "production", app.Env)
+	})
 }
 
-func TestTemplate_SingleStateFile(t *testing.T) {
+func TestExportEnvironment(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
+environments:
+  production:
+    values:
+    - domain: example.com
+      db:
+        host: db.example.com
+        port: 5432
+        replicas: [db-0, db-1]
+      tls: true
+      greeting: "it's $HOME"
+      empty: ""
+      nothing: {}
+---
 releases:
-- name: myrelease1
+- name: db
+  chart: mychart1
+`,
+		"/path/to/conflict.yaml": `
+environments:
+  production:
+    values:
+    - db-host: a
+      db_host: b
+---
+releases:
+- name: db
+  chart: mychart1
+`,
+		"/path/to/digit.yaml": `
+environments:
+  production:
+    values:
+    - 1st: a
+---
+releases:
+- name: db
   chart: mychart1
-- name: myrelease2
-  chart: mychart2
 `,
 	}
 
-	var helm = &mockHelmExec{}
-	var wantReleases = []mockTemplates{
-		{name: "myrelease1", chart: "mychart1", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease1"}},
-		{name: "myrelease2", chart: "mychart2", flags: []string{"--namespace", "testNamespace", "--set", "foo=a", "--set", "bar=b", "--output-dir", "output/subdir/helmfile-[a-z0-9]{8}-myrelease2"}},
+	newApp := func(fileOrDir string) *App {
+		return appWithFs(&App{
+			KubeContext: "default",
+			Env:         "production",
+			FileOrDir:   fileOrDir,
+			Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		}, files)
 	}
 
-	var buffer bytes.Buffer
-	logger := helmexec.NewLogger(&buffer, "debug")
-
-	valsRuntime, err := vals.New(32)
-	if err != nil {
-		t.Errorf("unexpected error creating vals runtime: %v", err)
+	testcases := []struct {
+		name     string
+		file     string
+		prefix   string
+		expected string
+		wantErr  string
+	}{
+		{
+			name: "flattened",
+			file: "helmfile.yaml",
+			expected: `export DB_HOST='db.example.com'
+export DB_PORT='5432'
+export DB_REPLICAS_0='db-0'
+export DB_REPLICAS_1='db-1'
+export DOMAIN='example.com'
+export EMPTY=''
+export GREETING='it'\''s $HOME'
+export TLS='true'
+`,
+		},
+		{
+			name:   "prefixed",
+			file:   "helmfile.yaml",
+			prefix: "app_",
+			expected: `export APP_DB_HOST='db.example.com'
+export APP_DB_PORT='5432'
+export APP_DB_REPLICAS_0='db-0'
+export APP_DB_REPLICAS_1='db-1'
+export APP_DOMAIN='example.com'
+export APP_EMPTY=''
+export APP_GREETING='it'\''s $HOME'
+export APP_TLS='true'
+`,
+		},
+		{
+			name:    "conflicting names",
+			file:    "conflict.yaml",
+			wantErr: `in ./conflict.yaml: failed to export environment "production" of conflict.yaml: values "db-host" and "db_host" are both exported as DB_HOST. please rename either of them`,
+		},
+		{
+			name:    "invalid name",
+			file:    "digit.yaml",
+			wantErr: `in ./digit.yaml: failed to export environment "production" of digit.yaml: value "1st" cannot be exported as "1ST", which is not a valid shell variable name. please set a prefix`,
+		},
+		{
+			name:     "invalid name with prefix",
+			file:     "digit.yaml",
+			prefix:   "X_",
+			expected: "export X_1ST='a'\n",
+		},
 	}
 
-	app := appWithFs(&App{
-		glob:        filepath.Glob,
-		abs:         filepath.Abs,
-		KubeContext: "default",
-		Env:         "default",
-		Logger:      logger,
-		helmExecer:  helm,
-		Namespace:   "testNamespace",
-		valsRuntime: valsRuntime,
-	}, files)
-	app.Template(configImpl{set: []string{"foo=a", "bar=b"}})
-
-	for i := range wantReleases {
-		if wantReleases[i].name != helm.templated[i].name {
-			t.Errorf("name = [%v], want %v", helm.templated[i].name, wantReleases[i].name)
-		}
-		if !strings.Contains(helm.templated[i].chart, wantReleases[i].chart) {
-			t.Errorf("chart = [%v], want %v", helm.templated[i].chart, wantReleases[i].chart)
-		}
-		for j := range wantReleases[i].flags {
-			if j == 7 {
-				matched, _ := regexp.Match(wantReleases[i].flags[j], []byte(helm.templated[i].flags[j]))
-				if !matched {
-					t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
-				}
-			} else if wantReleases[i].flags[j] != helm.templated[i].flags[j] {
-				t.Errorf("HelmState.TemplateReleases() = [%v], want %v", helm.templated[i].flags[j], wantReleases[i].flags[j])
-			}
-		}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout := os.Stdout
+			defer func() { os.Stdout = stdout }()
 
-	}
-}
+			var err error
+			out := captureStdout(func() {
+				err = newApp(tc.file).ExportEnvironment(configImpl{prefix: tc.prefix})
+			})
 
-func captureStdout(f func()) string {
-	reader, writer, err := os.Pipe()
-	if err != nil {
-		panic(err)
+			if tc.wantErr != "" {
+				assert.Error(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, tc.expected, out)
+		})
 	}
-	stdout := os.Stdout
-	defer func() {
-		os.Stdout = stdout
-		log.SetOutput(os.Stderr)
-	}()
-	os.Stdout = writer
-	log.SetOutput(writer)
-	out := make(chan string)
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		var buf bytes.Buffer
-		wg.Done()
-		io.Copy(&buf, reader)
-		out <- buf.String()
-	}()
-	wg.Wait()
-	f()
-	writer.Close()
-	return <-out
 }
 
-func TestPrint_SingleStateFile(t *testing.T) {
+func TestWriteValues(t *testing.T) {
 	files := map[string]string{
 		"/path/to/helmfile.yaml": `
+environments:
+  default:
+    values:
+    - domain: example.com
+---
 releases:
-- name: myrelease1
-  chart: mychart1
-- name: myrelease2
+- name: web
   chart: mychart1
+  namespace: apps
+  values:
+  - values.yaml.gotmpl
+  - db:
+      password: ref+echo://secret
+      port: 5432
+  secrets:
+  - ref+echo://map
+  set:
+  - name: db.user
+    value: ref+echo://admin
+  - name: replicas
+    value: "3"
+  - name: debug
+    value: "true"
+  - name: hosts
+    values:
+    - ref+echo://host1
+    - host2
+- name: uninstalled
+  chart: mychart2
+  installed: false
+  values:
+  - password: ref+echo://pass
+`,
+		"/path/to/values.yaml.gotmpl": `
+host: web.{{ .Values.domain }}
+db:
+  port: 3306
+  name: web
 `,
 	}
+
 	stdout := os.Stdout
 	defer func() { os.Stdout = stdout }()
 
-	var buffer bytes.Buffer
-	logger := helmexec.NewLogger(&buffer, "debug")
+	var err error
+	out := captureStdout(func() {
+		err = appWithFs(&App{
+			KubeContext: "default",
+			Env:         "default",
+			Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+			valsRuntime: fakeVals{},
+		}, files).WriteValues(configImpl{})
+	})
+	assert.NilError(t, err)
+
+	expected := `---
+# Source: helmfile.yaml: web
+db:
+  name: web
+  password: secret
+  port: 5432
+  user: admin
+debug: true
+host: web.example.com
+hosts:
+- host1
+- host2
+replicas: 3
+token: resolved
+`
+	assert.Equal(t, expected, out)
 
+	written := map[string]string{}
+	var dirs []string
 	app := appWithFs(&App{
-		glob:        filepath.Glob,
-		abs:         filepath.Abs,
 		KubeContext: "default",
 		Env:         "default",
-		Logger:      logger,
-		Namespace:   "testNamespace",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		valsRuntime: fakeVals{},
 	}, files)
-	out := captureStdout(func() {
-		err := app.PrintState(configImpl{})
-		assert.NilError(t, err)
-	})
-	assert.Assert(t, strings.Count(out, "---") == 1,
-		"state should contain '---' yaml doc separator:\n%s\n", out)
-	assert.Assert(t, strings.Contains(out, "helmfile.yaml"),
-		"state should contain source helmfile name:\n%s\n", out)
-	assert.Assert(t, strings.Contains(out, "name: myrelease1"),
-		"state should contain releases:\n%s\n", out)
+	app.mkdirAll = func(dir string, _ os.FileMode) error {
+		dirs = append(dirs, dir)
+		return nil
+	}
+	app.writeFile = func(path string, content []byte, _ os.FileMode) error {
+		written[path] = string(content)
+		return nil
+	}
+	err = app.WriteValues(configImpl{outputFileTemplate: "values/{{ .Release.Namespace }}/{{ .Release.Name }}.yaml"})
+	assert.NilError(t, err)
+
+	assert.DeepEqual(t, []string{"values/apps"}, dirs)
+	assert.Equal(t, expected[len("---\n# Source: helmfile.yaml: web\n"):], written["values/apps/web.yaml"])
 }
 
-func TestPrint_MultiStateFile(t *testing.T) {
+func TestLoadSchema_HTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/openapi/v2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"definitions": {"io.k8s.api.core.v1.ConfigMap": {"type": "object", "x-kubernetes-group-version-kind": [{"group": "", "version": "v1", "kind": "ConfigMap"}]}}}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "helmfile-schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The schema is fetched with the headers given for fetching helmfiles
+	app := &App{
+		readFile:    ioutil.ReadFile,
+		abs:         filepath.Abs,
+		getwd:       func() (string, error) { return dir, nil },
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		HTTPHeaders: []string{"Authorization: Bearer secret"},
+	}
+
+	if _, err := app.loadSchema(server.URL + "/openapi/v2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := app.loadSchema(server.URL + "/missing"); err == nil || err.Error() != server.URL+"/missing is not found" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type pruneConfig struct {
+	delete bool
+}
+
+func (c pruneConfig) LabelSelector() string {
+	return ""
+}
+
+func (c pruneConfig) Delete() bool {
+	return c.delete
+}
+
+func (c pruneConfig) Interactive() bool {
+	return false
+}
+
+// pruningHelmExec lists the releases installed in each namespace, and records the releases deleted
+type pruningHelmExec struct {
+	*mockHelmExec
+	installed map[string]string
+	deleted   []string
+}
+
+func (helm *pruningHelmExec) List(context helmexec.HelmContext, filter string, flags ...string) (string, error) {
+	for i := 0; i < len(flags)-1; i++ {
+		if flags[i] == "--namespace" {
+			return helm.installed[flags[i+1]], nil
+		}
+	}
+	return "", nil
+}
+
+func (helm *pruningHelmExec) DeleteRelease(context helmexec.HelmContext, name string, flags ...string) error {
+	helm.deleted = append(helm.deleted, name)
+	return nil
+}
+
+func TestPrune_HelmfilesWithoutEnv(t *testing.T) {
 	files := map[string]string{
-		"/path/to/helmfile.d/first.yaml": `
+		"/path/to/helmfile.yaml": `
+environments:
+  prod:
+---
+helmfiles:
+- helmfiles/a.yaml
+- helmfiles/b.yaml
+`,
+		"/path/to/helmfiles/a.yaml": `
+environments:
+  prod:
+---
 releases:
-- name: myrelease1
-  chart: mychart1
-- name: myrelease2
-  chart: mychart1
+- name: app
+  namespace: apps
+  chart: stable/app
 `,
-		"/path/to/helmfile.d/second.yaml": `
+		// Skipped in the prod environment, although its release is installed in the same namespace
+		"/path/to/helmfiles/b.yaml": `
+environments:
+  staging:
+---
 releases:
-- name: myrelease3
-  chart: mychart1
-- name: myrelease4
-  chart: mychart1
+- name: worker
+  namespace: apps
+  chart: stable/worker
 `,
 	}
-	stdout := os.Stdout
-	defer func() { os.Stdout = stdout }()
 
-	var buffer bytes.Buffer
-	logger := helmexec.NewLogger(&buffer, "debug")
+	helm := &pruningHelmExec{
+		mockHelmExec: &mockHelmExec{},
+		installed:    map[string]string{"apps": `[{"name":"app"},{"name":"worker"},{"name":"old"}]`},
+	}
 
 	app := appWithFs(&App{
 		glob:        filepath.Glob,
 		abs:         filepath.Abs,
-		KubeContext: "default",
-		Env:         "default",
-		Logger:      logger,
-		Namespace:   "testNamespace",
+		Env:         "prod",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		helmExecer:  helm,
+		valsRuntime: fakeVals{},
 	}, files)
-	out := captureStdout(func() {
-		err := app.PrintState(configImpl{})
-		assert.NilError(t, err)
-	})
-	assert.Assert(t, strings.Count(out, "---") == 2,
-		"state should contain '---' yaml doc separators:\n%s\n", out)
-	assert.Assert(t, strings.Contains(out, "second.yaml"),
-		"state should contain source helmfile name:\n%s\n", out)
-	assert.Assert(t, strings.Contains(out, "second.yaml"),
-		"state should contain source helmfile name:\n%s\n", out)
-}
 
-func TestList(t *testing.T) {
-	files := map[string]string{
-		"/path/to/helmfile.d/first.yaml": `
-releases:
-- name: myrelease1
-  chart: mychart1
-  installed: no
-  labels:
-    id: myrelease1
-- name: myrelease2
-  chart: mychart1
-`,
-		"/path/to/helmfile.d/second.yaml": `
-releases:
-- name: myrelease3
-  chart: mychart1
-  installed: yes
-- name: myrelease4
-  chart: mychart1
-  labels:
-    id: myrelease1
-`,
+	// Listing the orphans is harmless
+	if err := app.Prune(pruneConfig{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	stdout := os.Stdout
-	defer func() { os.Stdout = stdout }()
 
-	var buffer bytes.Buffer
-	logger := helmexec.NewLogger(&buffer, "debug")
+	err := app.Prune(pruneConfig{delete: true})
+	if err == nil || !strings.Contains(err.Error(), `1 helmfiles not defining the environment "prod" were skipped, which may define them: /path/to/helmfiles/b.yaml`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(helm.deleted) > 0 {
+		t.Errorf("unexpected releases deleted: %v", helm.deleted)
+	}
 
-	app := appWithFs(&App{
+	// Every helmfile defines the environment
+	files["/path/to/helmfiles/b.yaml"] = strings.Replace(files["/path/to/helmfiles/b.yaml"], "staging:", "prod:", 1)
+
+	app = appWithFs(&App{
 		glob:        filepath.Glob,
 		abs:         filepath.Abs,
-		KubeContext: "default",
-		Env:         "default",
-		Logger:      logger,
-		Namespace:   "testNamespace",
+		Env:         "prod",
+		Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+		helmExecer:  helm,
+		valsRuntime: fakeVals{},
 	}, files)
-	out := captureStdout(func() {
-		err := app.ListReleases(configImpl{})
-		assert.NilError(t, err)
-	})
 
-	expected := `NAME      	NAMESPACE	INSTALLED	LABELS       
-myrelease1	         	false    	id:myrelease1
-myrelease2	         	true     	             
-myrelease3	         	true     	             
-myrelease4	         	true     	id:myrelease1
+	if err := app.Prune(pruneConfig{delete: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(helm.deleted, []string{"old"}) {
+		t.Errorf("unexpected releases deleted: %v", helm.deleted)
+	}
+}
+
+type syncConfig struct {
+	resume bool
+}
+
+func (c syncConfig) Args() string {
+	return ""
+}
+
+func (c syncConfig) Values() []string {
+	return []string{}
+}
+
+func (c syncConfig) Set() []string {
+	return []string{}
+}
+
+func (c syncConfig) SkipDeps() bool {
+	return true
+}
+
+func (c syncConfig) SkipNeedsNotInstalled() bool {
+	return false
+}
+
+func (c syncConfig) Incremental() bool {
+	return false
+}
+
+func (c syncConfig) Resume() bool {
+	return c.resume
+}
+
+func (c syncConfig) MaxFailures() int {
+	return 0
+}
+
+func (c syncConfig) AtomicRun() bool {
+	return false
+}
+
+func (c syncConfig) Batch() bool {
+	return false
+}
+
+func (c syncConfig) Concurrency() int {
+	return 1
+}
+
+func (c syncConfig) Logger() *zap.SugaredLogger {
+	return helmexec.NewLogger(os.Stderr, "debug")
+}
+
+// failingHelmExec fails syncing the releases in fail, and records the releases synced
+type failingHelmExec struct {
+	*mockHelmExec
+	fail   map[string]bool
+	synced []string
+}
+
+func (helm *failingHelmExec) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	if helm.fail[name] {
+		return fmt.Errorf("failed syncing %s", name)
+	}
+	helm.synced = append(helm.synced, name)
+	return nil
+}
+
+func TestSync_Resume(t *testing.T) {
+	// The progress is recorded next to the helmfile, which is written into a temporary directory
+	dir, err := ioutil.TempDir("", "helmfile-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	helmfile := filepath.Join(dir, "helmfile.yaml")
+	progressFile := filepath.Join(dir, "helmfile.progress")
+
+	content := `
+releases:
+- name: db
+  chart: stable/db
+- name: app
+  chart: stable/app
+  needs:
+  - db
+- name: web
+  chart: stable/web
+  needs:
+  - app
 `
-	assert.Equal(t, expected, out)
+	if err := ioutil.WriteFile(helmfile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sync := func(helm *failingHelmExec, c syncConfig) error {
+		app := Init(&App{
+			FileOrDir:   helmfile,
+			Env:         "default",
+			Logger:      helmexec.NewLogger(os.Stderr, "debug"),
+			helmExecer:  helm,
+			valsRuntime: fakeVals{},
+		})
+		return app.Sync(c)
+	}
+
+	// The progress of a failed run is recorded without --resume
+	helm := &failingHelmExec{mockHelmExec: &mockHelmExec{}, fail: map[string]bool{"app": true}}
+	if err := sync(helm, syncConfig{}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !reflect.DeepEqual(helm.synced, []string{"db"}) {
+		t.Errorf("unexpected releases synced: %v", helm.synced)
+	}
+	if _, err := os.Stat(progressFile); err != nil {
+		t.Fatalf("expected the progress to be recorded: %v", err)
+	}
+
+	// The resumed run skips the release succeeded by the failed run
+	helm = &failingHelmExec{mockHelmExec: &mockHelmExec{}}
+	if err := sync(helm, syncConfig{resume: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(helm.synced, []string{"app", "web"}) {
+		t.Errorf("unexpected releases synced: %v", helm.synced)
+	}
+	if _, err := os.Stat(progressFile); !os.IsNotExist(err) {
+		t.Errorf("expected the progress to be removed: %v", err)
+	}
 }
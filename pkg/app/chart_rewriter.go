@@ -0,0 +1,34 @@
+package app
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/state"
+)
+
+// ChartRewriter returns the chart reference to be used for the release instead of `release.Chart`.
+// It is applied to every release after the helmfile is loaded, so that e.g. charts in public repositories can be
+// redirected to internal mirrors without editing each release.
+type ChartRewriter func(release state.ReleaseSpec) (string, error)
+
+// NewPrefixChartRewriter returns a ChartRewriter that replaces the longest matching prefix of the chart reference
+// according to the rewrites, whose keys are the prefixes to be replaced with the values.
+func NewPrefixChartRewriter(rewrites map[string]string) ChartRewriter {
+	var prefixes []string
+	for p := range rewrites {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	return func(release state.ReleaseSpec) (string, error) {
+		for _, p := range prefixes {
+			if strings.HasPrefix(release.Chart, p) {
+				return rewrites[p] + strings.TrimPrefix(release.Chart, p), nil
+			}
+		}
+		return release.Chart, nil
+	}
+}
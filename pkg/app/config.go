@@ -1,6 +1,11 @@
 package app
 
-import "go.uber.org/zap"
+import (
+	"time"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"go.uber.org/zap"
+)
 
 type ConfigProvider interface {
 	Args() string
@@ -8,8 +13,40 @@ type ConfigProvider interface {
 
 	FileOrDir() string
 	KubeContext() string
+	KubeContexts() map[string]string
+	RestrictFileAccess() bool
+	AllowedDirs() []string
+	ChartRewrites() map[string]string
+	UseLock() bool
+	DiscoverEnvValues() bool
+	DiscoverEnvSecrets() bool
+	StrictReleaseMerge() bool
+	MergeHelmfileDir() bool
+	NestedBases() bool
+	InheritHelmDefaults() bool
+	SkipBrokenSubHelmfiles() bool
+	ChartCacheDir() string
+	ClearChartCache() bool
+	DebugRenderDir() string
+	Deterministic() bool
+	DeterministicSeed() string
+	StrictTemplates() bool
+	DefaultConcurrency() int
+	MaxConcurrency() int
+	MaxConcurrencyPerNamespace() int
+	MaxDAGDepth() int
+	OrderedDispatch() bool
+	Sequential() bool
+	ChartFetchRetries() int
+	ReleaseWebhookURL() string
+	ForceReload() bool
+	HTTPHeaders() []string
+	HTTPCacheTTL() time.Duration
+	Redactor() *helmexec.Redactor
 	Namespace() string
 	Selectors() []string
+	Groups() []string
+	IncludeGroupNeeds() bool
 	StateValuesSet() map[string]interface{}
 	StateValuesFiles() []string
 	Env() string
@@ -27,6 +64,8 @@ type DeprecatedChartsConfigProvider interface {
 type DepsConfigProvider interface {
 	Args() string
 	SkipRepos() bool
+	Output() string
+	Orphans() bool
 }
 
 type ReposConfigProvider interface {
@@ -39,6 +78,12 @@ type ApplyConfigProvider interface {
 	Values() []string
 	Set() []string
 	SkipDeps() bool
+	SkipNeedsNotInstalled() bool
+	Incremental() bool
+	Resume() bool
+	MaxFailures() int
+	AtomicRun() bool
+	Batch() bool
 
 	SuppressSecrets() bool
 
@@ -56,6 +101,12 @@ type SyncConfigProvider interface {
 	Values() []string
 	Set() []string
 	SkipDeps() bool
+	SkipNeedsNotInstalled() bool
+	Incremental() bool
+	Resume() bool
+	MaxFailures() int
+	AtomicRun() bool
+	Batch() bool
 
 	concurrencyConfig
 	loggingConfig
@@ -77,10 +128,41 @@ type DiffConfigProvider interface {
 	concurrencyConfig
 }
 
+type DriftConfigProvider interface {
+	Args() string
+
+	Values() []string
+	Set() []string
+	SkipDeps() bool
+
+	Context() int
+	ReportFile() string
+
+	concurrencyConfig
+}
+
+type ValidateSchemaConfigProvider interface {
+	Args() string
+
+	Values() []string
+	Set() []string
+	SkipDeps() bool
+
+	Schema() string
+	ReportFile() string
+
+	concurrencyConfig
+}
+
 type DeleteConfigProvider interface {
 	Args() string
 
 	Purge() bool
+	Batch() bool
+	Group() int
+	ReverseSortKey() string
+	ContinueOnError() bool
+	StrictDependents() bool
 
 	interactive
 	loggingConfig
@@ -90,6 +172,12 @@ type DeleteConfigProvider interface {
 type DestroyConfigProvider interface {
 	Args() string
 
+	Batch() bool
+	Group() int
+	ReverseSortKey() string
+	ContinueOnError() bool
+	StrictDependents() bool
+
 	interactive
 	loggingConfig
 	concurrencyConfig
@@ -110,6 +198,7 @@ type LintConfigProvider interface {
 	Values() []string
 	Set() []string
 	SkipDeps() bool
+	WarnDisconnected() bool
 
 	concurrencyConfig
 }
@@ -121,8 +210,10 @@ type TemplateConfigProvider interface {
 	Set() []string
 	SkipDeps() bool
 	OutputDir() string
+	Validate() bool
 
 	concurrencyConfig
+	loggingConfig
 }
 
 type StatusesConfigProvider interface {
@@ -134,6 +225,34 @@ type StatusesConfigProvider interface {
 type StateConfigProvider interface {
 }
 
+type PruneConfigProvider interface {
+	LabelSelector() string
+	Delete() bool
+
+	interactive
+}
+
+type ListConfigProvider interface {
+	Ordered() bool
+}
+
+type EnvListConfigProvider interface {
+	WithValues() bool
+}
+
+type EnvExportConfigProvider interface {
+	Prefix() string
+}
+
+type WriteValuesConfigProvider interface {
+	OutputFileTemplate() string
+}
+
+type PlanConfigProvider interface {
+	Golden() string
+	UpdateGolden() bool
+}
+
 type concurrencyConfig interface {
 	Concurrency() int
 }
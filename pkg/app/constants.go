@@ -9,8 +9,11 @@ const (
 	DefaultHelmfile              = "helmfile.yaml"
 	DeprecatedHelmfile           = "charts.yaml"
 	DefaultHelmfileDirectory     = "helmfile.d"
+	StdinHelmfile                = "-"                             // value of --file to read the helmfile from stdin, with relative paths in it resolved against the working directory
 	ExperimentalEnvVar           = "HELMFILE_EXPERIMENTAL"         // environment variable for experimental features, expecting "true" lower case
 	ExperimentalSelectorExplicit = "explicit-selector-inheritance" // value to remove default selector inheritance to sub-helmfiles and use the explicit one
+	SingleDocumentDirective      = "# helmfile: single-document"   // first line of a helmfile to render it as a whole, without splitting it into parts at `---`
+	EnvironmentsDirective        = "# helmfile: environments="     // leading comment of a part of a helmfile to render and load it only in the listed environments, like `# helmfile: environments=prod,staging`
 )
 
 func experimentalModeEnabled() bool {
@@ -2,22 +2,80 @@ package app
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"text/template"
+	"time"
 
 	"github.com/imdario/mergo"
 	"github.com/roboll/helmfile/pkg/environment"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
 	"github.com/roboll/helmfile/pkg/state"
 	"github.com/variantdev/vals"
 	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
 )
 
 type desiredStateLoader struct {
 	KubeContext string
-	Reverse     bool
+	// KubeContexts maps environment names to kube contexts. KubeContext takes precedence over it
+	KubeContexts map[string]string
+	Reverse      bool
+
+	// RestrictFileAccess confines all the file accesses made while loading the helmfile to the directory containing it and AllowedDirs
+	RestrictFileAccess bool
+	AllowedDirs        []string
+
+	ChartRewriter ChartRewriter
+
+	// DiscoverEnvValues merges environments/<env>/*.yaml next to the helmfile into the values of the selected environment
+	DiscoverEnvValues bool
+
+	// DiscoverEnvSecrets decrypts secrets.<env>.yaml next to the helmfile via vals and merges it into the values of the selected environment
+	DiscoverEnvSecrets bool
+
+	// StrictReleaseMerge fails loading a helmfile whose parts define a release with different charts, instead of warning
+	StrictReleaseMerge bool
+
+	// TemplateFuncs is the additional template functions available in the helmfile. See LoadOpts.TemplateFuncs
+	TemplateFuncs template.FuncMap
+
+	// DebugRenderDir, when set, is the directory to write every rendered part of helmfiles to before parsing it, for debugging
+	// templates. Each part is written to `<DebugRenderDir>/<absolute path of the helmfile>.part.<index>`, overwritten every run.
+	DebugRenderDir string
+
+	// NestedBases evaluates the bases of bases, recursively. See LoadOpts.NestedBases
+	NestedBases bool
+
+	// SkipSubHelmfiles leaves `helmfiles` unexpanded and doesn't import their exports. See LoadOpts.SkipSubHelmfiles
+	SkipSubHelmfiles bool
+
+	// DocumentSeparator is the line separating the parts of helmfiles in place of `---`. See LoadOpts.DocumentSeparator
+	DocumentSeparator string
+
+	// IsolateDocumentEnvironments renders every part against the same environment. See LoadOpts.IsolateDocumentEnvironments
+	IsolateDocumentEnvironments bool
+
+	// Deterministic makes the randomized template functions return the same results for the same part of a helmfile,
+	// so that loading it repeatedly renders identical output. See tmpl.FileRenderer.WithDeterministic
+	Deterministic bool
+
+	// DeterministicSeed is the secret the randomized template functions are seeded by along with the environment, when Deterministic.
+	// Loading fails without it, as the results would otherwise be predictable from the helmfile alone
+	DeterministicSeed string
+
+	// StrictTemplates fails rendering a part of a helmfile that prints `<no value>`. See tmpl.FileRenderer.WithStrict
+	StrictTemplates bool
+
+	// importingExports is the helmfiles being loaded for their exports, to detect ones importing their own exports
+	importingExports []string
+
+	// loadingBases is the bases being loaded with NestedBases, to detect ones including themselves
+	loadingBases []string
 
 	env       string
 	namespace string
@@ -26,6 +84,9 @@ type desiredStateLoader struct {
 	fileExists func(string) (bool, error)
 	abs        func(string) (string, error)
 	glob       func(string) ([]string, error)
+	lookPath   func(string) (string, error)
+	writeFile  func(string, []byte, os.FileMode) error
+	mkdirAll   func(string, os.FileMode) error
 
 	logger      *zap.SugaredLogger
 	helm        helmexec.Interface
@@ -33,51 +94,163 @@ type desiredStateLoader struct {
 }
 
 func (ld *desiredStateLoader) Load(f string, opts LoadOpts) (*state.HelmState, error) {
-	var overrodeEnv *environment.Environment
+	if ld.Deterministic && ld.DeterministicSeed == "" {
+		return nil, fmt.Errorf("rendering %s deterministically requires a secret seed. please specify it with --deterministic-seed or %s", f, DeterministicSeedEnvVar)
+	}
+
+	var inheritedEnv, overrodeEnv *environment.Environment
+
+	if len(opts.AncestorPaths) > 0 {
+		abs, err := ld.abs(f)
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range opts.AncestorPaths {
+			if p == abs {
+				cycle := append(append([]string{}, opts.AncestorPaths[i:]...), abs)
+				return nil, fmt.Errorf("helmfile %s includes itself via helmfiles: %s. please fix the paths or globs in helmfiles not to match it", abs, strings.Join(cycle, " -> "))
+			}
+		}
+	}
+
+	if ld.RestrictFileAccess {
+		if err := ld.restrictFileAccess(filepath.Dir(f)); err != nil {
+			return nil, err
+		}
+	}
+
+	if ld.DiscoverEnvValues {
+		var err error
+		inheritedEnv, err = ld.discoverEnvValues(filepath.Dir(f))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ld.DiscoverEnvSecrets {
+		var err error
+		overrodeEnv, err = ld.discoverEnvSecrets(filepath.Dir(f))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	args := opts.Environment.OverrideValues
 
+	if len(args) > 0 && opts.CalleePath == "" {
+		return nil, fmt.Errorf("bug: opts.CalleePath was nil: f=%s, opts=%v", f, opts)
+	}
+
+	if len(opts.InlineValues) > 0 {
+		args = append(append([]interface{}{}, args...), opts.InlineValues)
+	}
+
 	if len(args) > 0 {
-		if opts.CalleePath == "" {
-			return nil, fmt.Errorf("bug: opts.CalleePath was nil: f=%s, opts=%v", f, opts)
-		}
 		storage := state.NewStorage(opts.CalleePath, ld.logger, ld.glob)
-		envld := state.NewEnvironmentValuesLoader(storage, ld.readFile, ld.logger)
+		envld := state.NewEnvironmentValuesLoader(storage, ld.readFile, ld.logger, ld.valsRuntime)
 		handler := state.MissingFileHandlerError
 		vals, err := envld.LoadEnvironmentValues(&handler, args)
 		if err != nil {
 			return nil, err
 		}
 
-		overrodeEnv = &environment.Environment{
+		// Values given on the command-line take precedence over the discovered secrets
+		overrodeEnv, err = overrodeEnv.Merge(&environment.Environment{
 			Name:   ld.env,
 			Values: vals,
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	st, err := ld.loadFileWithOverrides(nil, overrodeEnv, filepath.Dir(f), filepath.Base(f), true)
+	st, err := ld.loadFileWithOverrides(inheritedEnv, overrodeEnv, filepath.Dir(f), filepath.Base(f), true)
 	if err != nil {
 		return nil, err
 	}
 
+	applyEnvLabels(st, ld.env)
+
+	if err := st.ValidateConcurrency(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", f, err)
+	}
+
+	if err := st.ValidateReleaseTypes(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", f, err)
+	}
+
+	if err := st.ValidateReadinessProbes(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", f, err)
+	}
+
+	// The child's own defaults take precedence. As booleans can't tell `false` from unset, the ones turned on by the parent
+	// can't be turned off by the child.
+	if opts.ParentHelmDefaults != nil {
+		if err := mergo.Merge(&st.HelmDefaults, *opts.ParentHelmDefaults); err != nil {
+			return nil, fmt.Errorf("failed inheriting helmDefaults of the parent helmfile: %v", err)
+		}
+	}
+
 	if ld.Reverse {
-		rev := func(i, j int) bool {
-			return j < i
+		if err := reverseReleases(st.Releases, opts.ReverseSortKey); err != nil {
+			return nil, err
 		}
-		sort.Slice(st.Releases, rev)
-		sort.Slice(st.Helmfiles, rev)
+		// Priorities would otherwise reorder the releases sorted by the key within each group of the DAG
+		st.KeepReleaseOrder = opts.ReverseSortKey != "" && opts.ReverseSortKey != ReverseSortKeyIndex
+		for i, j := 0, len(st.Helmfiles)-1; i < j; i, j = i+1, j-1 {
+			st.Helmfiles[i], st.Helmfiles[j] = st.Helmfiles[j], st.Helmfiles[i]
+		}
+	}
+
+	// Versions are looked up by the charts as written in the helmfile, before they are rewritten
+	if err := st.ApplyChartVersions(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", f, err)
 	}
 
-	if ld.KubeContext != "" {
-		if st.HelmDefaults.KubeContext != "" {
-			return nil, errors.New("err: Cannot use option --kube-context and set attribute helmDefaults.kubeContext.")
+	if ld.ChartRewriter != nil {
+		for i := range st.Releases {
+			chart, err := ld.ChartRewriter(st.Releases[i])
+			if err != nil {
+				return nil, fmt.Errorf("failed rewriting chart of release %q: %v", st.Releases[i].Name, err)
+			}
+			if chart != st.Releases[i].Chart {
+				ld.logger.Debugf("rewrote chart of release %q from %q to %q", st.Releases[i].Name, st.Releases[i].Chart, chart)
+			}
+			st.Releases[i].Chart = chart
 		}
-		st.HelmDefaults.KubeContext = ld.KubeContext
 	}
 
-	if ld.namespace != "" {
-		if st.Namespace != "" {
-			return nil, errors.New("err: Cannot use option --namespace and set attribute namespace.")
+	if err := ld.checkHelmBinaries(st); err != nil {
+		return nil, err
+	}
+
+	kubeContext := ld.KubeContext
+	if kubeContext == "" {
+		// The context of the last environment having one wins, as values of later environments do
+		for _, name := range environment.SplitNames(ld.env) {
+			if c, ok := ld.KubeContexts[name]; ok {
+				kubeContext = c
+			}
+		}
+	}
+
+	if kubeContext != "" {
+		if st.HelmDefaults.KubeContext != "" && st.HelmDefaults.KubeContext != kubeContext {
+			return nil, fmt.Errorf("err: Cannot use kube context %q selected by option --kube-context or --environment-kube-context and set attribute helmDefaults.kubeContext to %q.", kubeContext, st.HelmDefaults.KubeContext)
+		}
+		st.HelmDefaults.KubeContext = kubeContext
+	}
+
+	if opts.Namespace != "" {
+		if st.Namespace != "" && st.Namespace != opts.Namespace {
+			return nil, fmt.Errorf("err: Cannot use namespace %q given via helmfiles[].namespace and set attribute namespace to %q.", opts.Namespace, st.Namespace)
+		}
+		st.Namespace = opts.Namespace
+	} else if ld.namespace != "" {
+		// The attribute is compared after being rendered, so that e.g. `namespace: {{ .Environment.Name }}-apps` conflicts
+		// only in the environments rendering it to another namespace
+		if st.Namespace != "" && st.Namespace != ld.namespace {
+			return nil, fmt.Errorf("err: Cannot use namespace %q given via option --namespace and set attribute namespace to %q.", ld.namespace, st.Namespace)
 		}
 		st.Namespace = ld.namespace
 	}
@@ -85,11 +258,102 @@ func (ld *desiredStateLoader) Load(f string, opts LoadOpts) (*state.HelmState, e
 	return st, nil
 }
 
+// LoadDir loads all the helmfiles matching `*.y*ml` in the directory, like the ones in `helmfile.d`, and merges them into one state
+// in the order of their names, so that the releases in them are processed together, e.g. ordered by `needs` across the helmfiles.
+// In the reverse mode, the helmfiles are merged in the reverse order, so that the releases are in the exact reverse order.
+//
+// Each helmfile is loaded as Load does. See state.HelmState.MergeReleasesFrom for how they are merged.
+func (ld *desiredStateLoader) LoadDir(dir string, opts LoadOpts) (*state.HelmState, error) {
+	files, err := ld.glob(filepath.Join(dir, "*.y*ml"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no helmfile found in directory %s. it must contain at least one *.yaml or *.yml file", dir)
+	}
+
+	sort.Strings(files)
+
+	if ld.Reverse {
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	}
+
+	var merged *state.HelmState
+
+	for _, f := range files {
+		st, err := ld.Load(f, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if merged == nil {
+			merged = st
+		} else if err := merged.MergeReleasesFrom(st); err != nil {
+			return nil, fmt.Errorf("failed merging helmfiles in directory %s: %v", dir, err)
+		}
+	}
+
+	return merged, nil
+}
+
+// LoadContent loads the helmfile content as if it were read from a file named `-` in baseDir, so that relative paths in it
+// are resolved against baseDir. It is split into parts and rendered exactly as Load does for the file.
+func (ld *desiredStateLoader) LoadContent(content []byte, baseDir string, opts LoadOpts) (*state.HelmState, error) {
+	f := filepath.Join(baseDir, StdinHelmfile)
+
+	readFile := ld.readFile
+	ld.readFile = func(path string) ([]byte, error) {
+		if path == f {
+			return content, nil
+		}
+		return readFile(path)
+	}
+	defer func() {
+		ld.readFile = readFile
+	}()
+
+	return ld.Load(f, opts)
+}
+
+// loadFile loads a base of a helmfile, which is called back by state.StateCreator with evaluateBases=false so that a base
+// having its own bases is an error. With NestedBases, the bases of the base are evaluated instead, recursively.
 func (ld *desiredStateLoader) loadFile(inheritedEnv *environment.Environment, baseDir, file string, evaluateBases bool) (*state.HelmState, error) {
-	return ld.loadFileWithOverrides(inheritedEnv, nil, baseDir, file, evaluateBases)
+	if !ld.NestedBases {
+		return ld.loadFileWithOverrides(inheritedEnv, nil, baseDir, file, evaluateBases)
+	}
+
+	f := state.ExpandPath(file)
+	if !filepath.IsAbs(f) {
+		f = filepath.Join(baseDir, f)
+	}
+	abs, err := ld.abs(f)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, p := range ld.loadingBases {
+		if p == abs {
+			cycle := append(append([]string{}, ld.loadingBases[i:]...), abs)
+			return nil, fmt.Errorf("base %s includes itself via bases: %s", abs, strings.Join(cycle, " -> "))
+		}
+	}
+
+	ld.loadingBases = append(ld.loadingBases, abs)
+	defer func() {
+		ld.loadingBases = ld.loadingBases[:len(ld.loadingBases)-1]
+	}()
+
+	return ld.loadFileWithOverrides(inheritedEnv, nil, baseDir, file, true)
 }
 
+// loadFileWithOverrides loads the helmfile. evaluateBases is true for the helmfile being loaded, and false for its bases
+// unless NestedBases is enabled. See loadFile.
 func (ld *desiredStateLoader) loadFileWithOverrides(inheritedEnv, overrodeEnv *environment.Environment, baseDir, file string, evaluateBases bool) (*state.HelmState, error) {
+	file = state.ExpandPath(file)
+
 	var f string
 	if filepath.IsAbs(file) {
 		f = file
@@ -106,7 +370,17 @@ func (ld *desiredStateLoader) loadFileWithOverrides(inheritedEnv, overrodeEnv *e
 
 	var self *state.HelmState
 
-	if !experimentalModeEnabled() || ext == ".gotmpl" {
+	// JSON helmfiles are usually generated by other tools, so they are loaded as-is without being rendered nor split into parts
+	if ext == ".json" {
+		self, err = ld.load(
+			fileBytes,
+			baseDir,
+			file,
+			evaluateBases,
+			inheritedEnv,
+			overrodeEnv,
+		)
+	} else if !experimentalModeEnabled() || ext == ".gotmpl" {
 		self, err = ld.renderAndLoad(
 			inheritedEnv,
 			overrodeEnv,
@@ -132,6 +406,7 @@ func (ld *desiredStateLoader) loadFileWithOverrides(inheritedEnv, overrodeEnv *e
 func (a *desiredStateLoader) underlying() *state.StateCreator {
 	c := state.NewCreator(a.logger, a.readFile, a.fileExists, a.abs, a.glob, a.helm, a.valsRuntime)
 	c.LoadFile = a.loadFile
+	c.DeterministicSeed = a.deterministicSeed()
 	return c
 }
 
@@ -146,6 +421,17 @@ func (a *desiredStateLoader) load(yaml []byte, baseDir, file string, evaluateBas
 		return nil, err
 	}
 
+	if interpolatesEnvValues(st, a.env) {
+		st.Env.Values, err = interpolateEnvValues(st.Env.Values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+	}
+
+	if a.SkipSubHelmfiles {
+		return st, nil
+	}
+
 	helmfiles, err := st.ExpandedHelmfiles()
 	if err != nil {
 		return nil, err
@@ -156,28 +442,55 @@ func (a *desiredStateLoader) load(yaml []byte, baseDir, file string, evaluateBas
 }
 
 func (ld *desiredStateLoader) renderAndLoad(env, overrodeEnv *environment.Environment, baseDir, filename string, content []byte, evaluateBases bool) (*state.HelmState, error) {
-	parts := bytes.Split(content, []byte("\n---\n"))
+	start := time.Now()
+
+	parts := splitIntoParts(content, ld.DocumentSeparator)
 
 	var finalState *state.HelmState
 
+	// loaded is the number of parts loaded, excluding the ones skipped for other environments or rendered to nothing
+	var loaded int
+
 	for i, part := range parts {
 		var yamlBuf *bytes.Buffer
 		var err error
 
 		id := fmt.Sprintf("%s.part.%d", filename, i)
 
-		if env == nil && overrodeEnv == nil {
+		if envs, ok := partEnvironments(part); ok && !containsAnyString(envs, environment.SplitNames(ld.env)) {
+			ld.logger.Debugf("skipping %s as it is only for environments %s", id, strings.Join(envs, ", "))
+			continue
+		}
+
+		if !bytes.Contains(part, templateActionDelim) {
+			// Rendering a part without any template action results in the part itself, so it is loaded as-is
+			ld.logger.Debugf("skipping rendering %s as it contains no template action", id)
+			yamlBuf = bytes.NewBuffer(part)
+		} else if env == nil && overrodeEnv == nil {
 			yamlBuf, err = ld.renderTemplatesToYaml(baseDir, id, part)
 			if err != nil {
-				return nil, fmt.Errorf("error during %s parsing: %v", id, err)
+				return nil, fmt.Errorf("error during %s parsing with env=%s: %v", id, ld.env, err)
 			}
 		} else {
 			yamlBuf, err = ld.renderTemplatesToYamlWithEnv(baseDir, id, part, env, overrodeEnv)
 			if err != nil {
-				return nil, fmt.Errorf("error during %s parsing: %v", id, err)
+				return nil, fmt.Errorf("error during %s parsing with env=%s: %v", id, ld.env, err)
+			}
+		}
+
+		if ld.DebugRenderDir != "" {
+			if err := ld.writeRenderedPart(id, yamlBuf.Bytes()); err != nil {
+				return nil, err
 			}
 		}
 
+		if len(bytes.TrimSpace(yamlBuf.Bytes())) == 0 {
+			ld.logger.Debugf("skipping %s as it rendered to nothing", id)
+			continue
+		}
+
+		loaded++
+
 		currentState, err := ld.load(
 			yamlBuf.Bytes(),
 			baseDir,
@@ -190,18 +503,716 @@ func (ld *desiredStateLoader) renderAndLoad(env, overrodeEnv *environment.Enviro
 			return nil, err
 		}
 
+		var preceding []state.ReleaseSpec
+		if finalState != nil {
+			preceding = finalState.Releases
+		}
+		if err := checkReleaseCollisions(currentState, preceding, part); err != nil {
+			return nil, fmt.Errorf("error during %s parsing with env=%s: %v", id, ld.env, err)
+		}
+
 		if finalState == nil {
 			finalState = currentState
 		} else {
+			releases, conflicts, err := mergeReleases(finalState.Releases, currentState.Releases)
+			if err != nil {
+				return nil, fmt.Errorf("error during %s merging releases: %v", id, err)
+			}
+
+			for _, c := range conflicts {
+				if ld.StrictReleaseMerge {
+					return nil, fmt.Errorf("error during %s merging releases: %s", id, c)
+				}
+				ld.logger.Warnf("%s: %s. run with --strict-release-merge to make it an error", id, c)
+			}
+
 			if err := mergo.Merge(finalState, currentState, mergo.WithOverride); err != nil {
 				return nil, err
 			}
+
+			finalState.Releases = releases
 		}
 
-		env = &finalState.Env
+		if !ld.SkipSubHelmfiles {
+			if err := ld.importExports(finalState, currentState.Helmfiles, filename, overrodeEnv); err != nil {
+				return nil, fmt.Errorf("error during %s importing exports: %v", id, err)
+			}
+		}
+
+		// Otherwise the following parts are rendered against the environment given to the helmfile
+		if !ld.IsolateDocumentEnvironments {
+			env = &finalState.Env
 
-		ld.logger.Debugf("merged environment: %v", env)
+			ld.logger.Debugf("merged environment: %v", env)
+		}
 	}
 
+	// Every part rendered to nothing, e.g. all the content was excluded by conditionals.
+	// Load an empty state so that the caller never gets nil.
+	if finalState == nil {
+		var err error
+		finalState, err = ld.load(nil, baseDir, filename, evaluateBases, env, overrodeEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ld.logger.Debugf("loaded %s in %s: %d of %d parts, %d releases, %d helmfiles, %d environments",
+		filename, time.Since(start), loaded, len(parts), len(finalState.Releases), len(finalState.Helmfiles), len(finalState.Environments))
+
 	return finalState, nil
 }
+
+// importExports loads the sub-helmfiles marked with `importExports: true` and merges their `exports` into the environment
+// values of the state, so that the parts of the helmfile following the one including them can refer to the exported values.
+//
+// The sub-helmfiles are loaded with their own `values` overrode by the ones given to the parent, and skipped when they
+// don't define the environment, as they are when visited. They are loaded again when visited later.
+func (ld *desiredStateLoader) importExports(st *state.HelmState, helmfiles []state.SubHelmfileSpec, filename string, overrodeEnv *environment.Environment) error {
+	for _, hf := range helmfiles {
+		if !hf.ImportExports {
+			continue
+		}
+
+		exports, err := ld.loadExports(hf, filename, overrodeEnv)
+		if err != nil {
+			return fmt.Errorf("failed loading exports of %s: %v", hf.Path, err)
+		}
+
+		if len(exports) == 0 {
+			continue
+		}
+
+		merged, err := st.Env.Merge(&environment.Environment{Values: exports})
+		if err != nil {
+			return err
+		}
+		st.Env = *merged
+
+		ld.logger.Debugf("imported exports of %s: %v", hf.Path, exports)
+	}
+
+	return nil
+}
+
+func (ld *desiredStateLoader) loadExports(hf state.SubHelmfileSpec, filename string, overrodeEnv *environment.Environment) (map[string]interface{}, error) {
+	var childEnv *environment.Environment
+
+	if len(hf.Environment.OverrideValues) > 0 {
+		storage := state.NewStorage(filename, ld.logger, ld.glob)
+		envld := state.NewEnvironmentValuesLoader(storage, ld.readFile, ld.logger, ld.valsRuntime)
+		handler := state.MissingFileHandlerError
+		vals, err := envld.LoadEnvironmentValues(&handler, hf.Environment.OverrideValues)
+		if err != nil {
+			return nil, err
+		}
+
+		childEnv = &environment.Environment{
+			Name:   ld.env,
+			Values: vals,
+		}
+	}
+
+	childEnv, err := childEnv.Merge(overrodeEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	f := state.ExpandPath(hf.Path)
+	if !filepath.IsAbs(f) {
+		f = filepath.Join(filepath.Dir(filename), f)
+	}
+
+	for _, p := range ld.importingExports {
+		if p == f {
+			return nil, fmt.Errorf("helmfile %s imports its own exports via helmfiles", f)
+		}
+	}
+	ld.importingExports = append(ld.importingExports, f)
+	defer func() {
+		ld.importingExports = ld.importingExports[:len(ld.importingExports)-1]
+	}()
+
+	child, err := ld.loadFileWithOverrides(nil, childEnv, filepath.Dir(f), filepath.Base(f), true)
+	if err != nil {
+		if loadErr, ok := err.(*state.StateLoadError); ok {
+			if _, ok := loadErr.Cause.(*state.UndefinedEnvError); ok {
+				return nil, nil
+			}
+		}
+		return nil, err
+	}
+
+	return child.Exports, nil
+}
+
+// writeRenderedPart writes the rendered part to DebugRenderDir, so that it can be inspected when it fails to be parsed
+func (ld *desiredStateLoader) writeRenderedPart(id string, content []byte) error {
+	abs, err := ld.abs(id)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ld.DebugRenderDir, abs)
+
+	if err := ld.mkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed writing rendered %s: %v", id, err)
+	}
+
+	if err := ld.writeFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed writing rendered %s: %v", id, err)
+	}
+
+	ld.logger.Debugf("wrote rendered %s to %s", id, path)
+
+	return nil
+}
+
+// reverseReleases sorts the releases by the key, falling back to the reverse order of declaration on ties, so that
+// releases with the same key are deterministically ordered.
+func reverseReleases(releases []state.ReleaseSpec, key string) error {
+	var less func(a, b state.ReleaseSpec) bool
+
+	switch key {
+	case "", ReverseSortKeyIndex:
+	case ReverseSortKeyName:
+		less = func(a, b state.ReleaseSpec) bool { return a.Name > b.Name }
+	case ReverseSortKeyNamespace:
+		less = func(a, b state.ReleaseSpec) bool { return a.Namespace > b.Namespace }
+	case ReverseSortKeyPriority:
+		less = func(a, b state.ReleaseSpec) bool { return a.Priority < b.Priority }
+	default:
+		keys := []string{ReverseSortKeyIndex, ReverseSortKeyName, ReverseSortKeyNamespace, ReverseSortKeyPriority}
+		return fmt.Errorf("invalid reverse sort key %q: it must be one of %s", key, strings.Join(keys, ", "))
+	}
+
+	type indexed struct {
+		index   int
+		release state.ReleaseSpec
+	}
+
+	sorted := make([]indexed, len(releases))
+	for i, r := range releases {
+		sorted[i] = indexed{index: i, release: r}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if less != nil {
+			if less(a.release, b.release) {
+				return true
+			}
+			if less(b.release, a.release) {
+				return false
+			}
+		}
+		return a.index > b.index
+	})
+
+	for i := range sorted {
+		releases[i] = sorted[i].release
+	}
+
+	return nil
+}
+
+// DeterministicSeedEnvVar is the environment variable to specify the seed of `--deterministic` with, like `--deterministic-seed`
+const DeterministicSeedEnvVar = "HELMFILE_DETERMINISTIC_SEED"
+
+// deterministicSeed returns the seed of the randomized template functions when rendering deterministically, which mixes the
+// environment into DeterministicSeed so that each environment gets different results. It is empty otherwise.
+func (ld *desiredStateLoader) deterministicSeed() string {
+	if !ld.Deterministic {
+		return ""
+	}
+	return ld.DeterministicSeed + "\x00" + ld.env
+}
+
+// checkReleaseCollisions returns an error when a release rendered from a template in a part of a helmfile collides with another release,
+// having the same name and namespace, like the templated names `{{ .Values.prefix }}-api` and `{{ .Values.name }}` rendered to the same one.
+// Otherwise the latter silently replaces the former wherever releases are looked up by their IDs, like in the DAG built from `needs`.
+//
+// The releases of the part are compared with each other and with the ones of its bases. A templated release with the same name and
+// namespace as one in the preceding parts collides when the charts differ, as it would otherwise override the release as mergeReleases does.
+// Releases whose name and namespace are written literally in the part are duplicates rather than collisions, and are left to be reported
+// when they are selected, as they've ever been. So are all the releases of a part whose releases can't be told before rendering.
+// See templatedReleases.
+func checkReleaseCollisions(st *state.HelmState, preceding []state.ReleaseSpec, part []byte) error {
+	var own []int
+	for i := range st.Releases {
+		if st.Releases[i].SourceFile == st.FilePath {
+			own = append(own, i)
+		}
+	}
+
+	templated := make([]bool, len(st.Releases))
+	if t, ok := templatedReleases(part, len(own)); ok {
+		for k, i := range own {
+			templated[i] = t[k]
+		}
+	}
+
+	type key struct {
+		tillerNamespace, namespace, name string
+	}
+
+	indices := map[key]int{}
+
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		k := key{r.TillerNamespace, st.ReleaseNamespace(r), r.Name}
+		if j, ok := indices[k]; ok && (templated[i] || templated[j]) {
+			return fmt.Errorf("release %q in namespace %q is rendered from both releases[%d] in %s and releases[%d] in %s",
+				k.name, k.namespace, j, st.Releases[j].SourceFile, i, r.SourceFile)
+		}
+		indices[k] = i
+	}
+
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		if !templated[i] {
+			continue
+		}
+		for _, p := range preceding {
+			if p.Name == r.Name && p.Namespace == r.Namespace && p.Chart != "" && r.Chart != "" && p.Chart != r.Chart {
+				return fmt.Errorf("release %q in namespace %q is rendered from releases[%d] with chart %q, colliding with the one with chart %q in a preceding part",
+					r.Name, r.Namespace, i, r.Chart, p.Chart)
+			}
+		}
+	}
+
+	return nil
+}
+
+// templateActionPlaceholder replaces the template actions in a part of a helmfile for templatedReleases
+const templateActionPlaceholder = "__helmfile_template_action__"
+
+// templatedReleases tells whether the name or the namespace of each of the n releases written in the part of a helmfile is rendered
+// from a template, by parsing the part with its template actions masked. It returns false when the releases can't be told before
+// rendering, like when they are generated by `range`, or the part isn't valid YAML until rendered.
+func templatedReleases(part []byte, n int) ([]bool, bool) {
+	var masked strings.Builder
+	rest := string(part)
+	for {
+		i := strings.Index(rest, "{{")
+		if i < 0 {
+			masked.WriteString(rest)
+			break
+		}
+		j := strings.Index(rest[i:], "}}")
+		if j < 0 {
+			return nil, false
+		}
+		masked.WriteString(rest[:i])
+		masked.WriteString(templateActionPlaceholder)
+		rest = rest[i+j+2:]
+	}
+
+	var raw struct {
+		Releases []struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"releases"`
+	}
+	if err := yaml.Unmarshal([]byte(masked.String()), &raw); err != nil || len(raw.Releases) != n {
+		return nil, false
+	}
+
+	templated := make([]bool, n)
+	for i, r := range raw.Releases {
+		templated[i] = strings.Contains(r.Name, templateActionPlaceholder) || strings.Contains(r.Namespace, templateActionPlaceholder)
+	}
+
+	return templated, true
+}
+
+// mergeReleases merges releases defined in a part of a helmfile into the ones defined in the preceding parts.
+// A release with the same name and namespace as a preceding one updates it in place, so that a release can be defined
+// across parts, like a base and its overrides. Other releases are appended in their order.
+//
+// It also returns the descriptions of the conflicts, where an override replaces the chart of a preceding release with another one.
+// They are likely to be two different releases accidentally sharing the name and the namespace, rather than an override.
+func mergeReleases(releases, overrides []state.ReleaseSpec) ([]state.ReleaseSpec, []string, error) {
+	merged := append([]state.ReleaseSpec{}, releases...)
+
+	var conflicts []string
+
+	for _, o := range overrides {
+		// Only releases in the preceding parts are updated, so that duplicates in the same part are kept as-is and reported by checkReleaseCollisions or when selected
+		i := 0
+		for ; i < len(releases); i++ {
+			if merged[i].Name == o.Name && merged[i].Namespace == o.Namespace {
+				break
+			}
+		}
+
+		if i == len(releases) {
+			merged = append(merged, o)
+			continue
+		}
+
+		if merged[i].Chart != "" && o.Chart != "" && merged[i].Chart != o.Chart {
+			conflicts = append(conflicts, fmt.Sprintf("release %q in namespace %q is defined with chart %q in a preceding part, but overridden with chart %q in this part", o.Name, o.Namespace, merged[i].Chart, o.Chart))
+		}
+
+		if err := mergo.Merge(&merged[i], o, mergo.WithOverride); err != nil {
+			return nil, nil, fmt.Errorf("release %q: %v", o.Name, err)
+		}
+	}
+
+	return merged, conflicts, nil
+}
+
+// templateActionDelim is the left delimiter of go template actions. A part of a helmfile without it has nothing to render.
+var templateActionDelim = []byte("{{")
+
+// partEnvironments returns the environments listed by the EnvironmentsDirective in the leading comments of the part, or false
+// when there's no such directive. Only the comments and blank lines before the content are scanned, so that a part can be
+// skipped without rendering it nor scanning it as a whole.
+func partEnvironments(part []byte) ([]string, bool) {
+	rest := part
+	for len(rest) > 0 {
+		line := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = nil
+		}
+
+		trimmed := strings.TrimSpace(string(line))
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(trimmed, "#") {
+			break
+		}
+		if !strings.HasPrefix(trimmed, EnvironmentsDirective) {
+			continue
+		}
+
+		var envs []string
+		for _, e := range strings.Split(strings.TrimPrefix(trimmed, EnvironmentsDirective), ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				envs = append(envs, e)
+			}
+		}
+		return envs, true
+	}
+
+	return nil, false
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAnyString(ss []string, candidates []string) bool {
+	for _, c := range candidates {
+		if containsString(ss, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitIntoParts splits the helmfile content into parts at each line consisting of the separator, or `---` when empty,
+// so that each part can be rendered with the environment defined in the preceding parts.
+// A helmfile whose first line is the SingleDocumentDirective is never split, so that `---` in it can be used for other purposes,
+// like embedding Kubernetes manifests.
+func splitIntoParts(content []byte, separator string) [][]byte {
+	if separator == "" {
+		separator = DefaultDocumentSeparator
+	}
+
+	firstLine := content
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		firstLine = content[:i]
+	}
+
+	if string(bytes.TrimSpace(firstLine)) == SingleDocumentDirective {
+		return [][]byte{content}
+	}
+
+	return bytes.Split(content, []byte("\n"+separator+"\n"))
+}
+
+// applyEnvLabels merges the labels of the environment into the labels of each release.
+// A label of the release takes precedence over the one of the environment with the same key.
+// When multiple environments are selected, their labels are merged in the order, so that a later environment takes precedence.
+func applyEnvLabels(st *state.HelmState, env string) {
+	labels := map[string]string{}
+	for _, name := range environment.SplitNames(env) {
+		for k, v := range st.Environments[name].Labels {
+			labels[k] = v
+		}
+	}
+	if len(labels) == 0 {
+		return
+	}
+
+	for i := range st.Releases {
+		merged := map[string]string{}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		for k, v := range st.Releases[i].Labels {
+			merged[k] = v
+		}
+		st.Releases[i].Labels = merged
+	}
+}
+
+// transformValues replaces the values entries of each release with the values returned by the transform for the merged ones.
+// Releases not going to be installed and noop releases have no values to pass to helm, and are left as they are.
+func transformValues(st *state.HelmState, transform ValuesTransform) error {
+	if transform == nil {
+		return nil
+	}
+
+	for i := range st.Releases {
+		r := &st.Releases[i]
+
+		if !r.Desired() || r.Noop() {
+			continue
+		}
+
+		values, err := st.MergedValuesEntries(r)
+		if err != nil {
+			return fmt.Errorf("failed transforming values of release %q: %v", r.Name, err)
+		}
+
+		transformed, err := transform(*r, values)
+		if err != nil {
+			return fmt.Errorf("failed transforming values of release %q: %v", r.Name, err)
+		}
+
+		r.Values = []interface{}{transformed}
+	}
+
+	return nil
+}
+
+// checkHelmBinaries ensures that the helm binaries specified for releases exist, so that a typo in one of them fails
+// the whole run before anything is installed
+func (ld *desiredStateLoader) checkHelmBinaries(st *state.HelmState) error {
+	for _, r := range st.Releases {
+		if r.HelmBinary == "" {
+			continue
+		}
+		if _, err := ld.lookPath(r.HelmBinary); err != nil {
+			return fmt.Errorf("helm binary %q of release %q not found: %v", r.HelmBinary, r.Name, err)
+		}
+	}
+	return nil
+}
+
+// discoverEnvValues loads environments/<env>/*.yaml in baseDir in the lexical order of their names.
+// The values are inherited by the helmfile, so that ones defined in the helmfile and given on the command-line take precedence over them.
+// It returns nil when there are no such files, so that a missing directory is a no-op.
+func (ld *desiredStateLoader) discoverEnvValues(baseDir string) (*environment.Environment, error) {
+	// The files of multiple environments are loaded in the order of the environments, so that later ones take precedence
+	var files []string
+	for _, name := range environment.SplitNames(ld.env) {
+		matches, err := ld.glob(filepath.Join(baseDir, "environments", name, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(matches)
+
+		files = append(files, matches...)
+	}
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	entries := make([]interface{}, len(files))
+	for i, f := range files {
+		entries[i] = f
+	}
+
+	storage := state.NewStorage(filepath.Join(baseDir, "helmfile.yaml"), ld.logger, ld.glob)
+	envld := state.NewEnvironmentValuesLoader(storage, ld.readFile, ld.logger, ld.valsRuntime)
+	vals, err := envld.LoadEnvironmentValues(nil, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	ld.logger.Debugf("discovered environment values files for %q: %v", ld.env, files)
+
+	return &environment.Environment{
+		Name:   ld.env,
+		Values: vals,
+	}, nil
+}
+
+// discoverEnvSecrets decrypts secrets.<env>.yaml in baseDir via vals, as `ref+sops://secrets.<env>.yaml?format=yaml`.
+// The secrets override the values of the environment defined in the helmfile, like the `secrets` of environments do,
+// while the values given on the command-line take precedence over them.
+// It returns nil when there's no such file, so that a missing file is a no-op.
+// When multiple environments are selected, the secrets of each environment are merged in the order.
+func (ld *desiredStateLoader) discoverEnvSecrets(baseDir string) (*environment.Environment, error) {
+	var merged *environment.Environment
+
+	for _, name := range environment.SplitNames(ld.env) {
+		vals, err := ld.discoverEnvSecretsOf(baseDir, name)
+		if err != nil {
+			return nil, err
+		}
+		if vals == nil {
+			continue
+		}
+
+		merged, err = merged.Merge(&environment.Environment{
+			Name:   ld.env,
+			Values: vals,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return merged, nil
+}
+
+// discoverEnvSecretsOf decrypts secrets.<env>.yaml of the single environment, returning nil when there's no such file.
+func (ld *desiredStateLoader) discoverEnvSecretsOf(baseDir, name string) (map[string]interface{}, error) {
+	files, err := ld.glob(filepath.Join(baseDir, fmt.Sprintf("secrets.%s.yaml", name)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	file := files[0]
+
+	if ld.valsRuntime == nil {
+		return nil, fmt.Errorf("failed decrypting environment secrets file %q: vals is not available", file)
+	}
+
+	// vals reads the file relative to the working directory, even when the path in the reference starts with `/`
+	if filepath.IsAbs(file) {
+		wd, err := ld.abs(".")
+		if err != nil {
+			return nil, err
+		}
+		if file, err = filepath.Rel(wd, file); err != nil {
+			return nil, err
+		}
+	}
+
+	ref := fmt.Sprintf("%ssops://%s?format=yaml", state.ValsRefPrefix, filepath.ToSlash(file))
+	resolved, err := ld.valsRuntime.Eval(map[string]interface{}{"secrets": ref})
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting environment secrets file %q: %v", file, err)
+	}
+
+	var m interface{}
+	switch v := resolved["secrets"].(type) {
+	case string:
+		// The whole content of the file is decrypted into a string, which is the YAML of the values
+		if err := yaml.Unmarshal([]byte(v), &m); err != nil {
+			return nil, fmt.Errorf("failed decrypting environment secrets file %q: %v", file, err)
+		}
+	default:
+		m = v
+	}
+
+	if m == nil {
+		return nil, nil
+	}
+
+	vals, err := maputil.CastKeysToStrings(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting environment secrets file %q: it must be decrypted to a map of values: %v", file, err)
+	}
+
+	ld.logger.Debugf("discovered environment secrets file for %q: %s", name, file)
+
+	return vals, nil
+}
+
+// restrictFileAccess replaces readFile, fileExists and glob with ones that deny access to any path outside of baseDir and AllowedDirs.
+// Paths are made absolute, cleaned and resolved of symlinks before being checked, so that neither `..`, absolute paths nor symlinks
+// can be used to escape them.
+func (ld *desiredStateLoader) restrictFileAccess(baseDir string) error {
+	var roots []string
+	for _, d := range append([]string{baseDir}, ld.AllowedDirs...) {
+		abs, err := ld.abs(d)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, evalSymlinks(abs))
+	}
+
+	check := func(path string) error {
+		abs, err := ld.abs(path)
+		if err != nil {
+			return err
+		}
+		abs = evalSymlinks(abs)
+		for _, root := range roots {
+			rel, err := filepath.Rel(root, abs)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("access to %q is denied: it is outside of the allowed directories %s. use --allow-dir to allow it", path, strings.Join(roots, ", "))
+	}
+
+	readFile, fileExists, glob := ld.readFile, ld.fileExists, ld.glob
+
+	ld.readFile = func(path string) ([]byte, error) {
+		if err := check(path); err != nil {
+			return nil, err
+		}
+		return readFile(path)
+	}
+	ld.fileExists = func(path string) (bool, error) {
+		if err := check(path); err != nil {
+			return false, err
+		}
+		return fileExists(path)
+	}
+	ld.glob = func(pattern string) ([]string, error) {
+		if err := check(pattern); err != nil {
+			return nil, err
+		}
+		matches, err := glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		// A pattern within the allowed directories can still match symlinks pointing outside of them
+		for _, m := range matches {
+			if err := check(m); err != nil {
+				return nil, err
+			}
+		}
+		return matches, nil
+	}
+
+	return nil
+}
+
+// evalSymlinks resolves the symlinks in the absolute path. The part of the path that doesn't exist, like a file to be checked for
+// existence or a glob pattern, is kept as is after the resolved part
+func evalSymlinks(path string) string {
+	var rest []string
+	for p := path; ; p = filepath.Dir(p) {
+		if resolved, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...)
+		}
+		if filepath.Dir(p) == p {
+			return path
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+	}
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// shellExports flattens the environment values into `export NAME='value'` lines sorted by the names, for sourcing into a shell.
+//
+// The keys of nested maps are joined with `_`, and the items of lists are keyed by their indexes, so that
+// `{db: {hosts: [a, b]}}` is exported as `DB_HOSTS_0` and `DB_HOSTS_1`. Names are upper-cased, prefixed with the prefix,
+// and any character not allowed in shell variable names is replaced with `_`.
+// Values are single-quoted so that the shell never expands them. Empty maps and lists export nothing.
+//
+// It fails when two keys are exported as the same name, like `db-host` and `db_host`, or when a name is not a valid
+// shell variable name, like one starting with a digit.
+func shellExports(values map[string]interface{}, prefix string) ([]string, error) {
+	vars := map[string]string{}
+	keys := map[string]string{}
+
+	var flatten func(path []string, v interface{}) error
+	flatten = func(path []string, v interface{}) error {
+		switch typed := v.(type) {
+		case map[string]interface{}:
+			for k, vv := range typed {
+				if err := flatten(append(path[:len(path):len(path)], k), vv); err != nil {
+					return err
+				}
+			}
+		case map[interface{}]interface{}:
+			for k, vv := range typed {
+				if err := flatten(append(path[:len(path):len(path)], fmt.Sprintf("%v", k)), vv); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, vv := range typed {
+				if err := flatten(append(path[:len(path):len(path)], fmt.Sprintf("%d", i)), vv); err != nil {
+					return err
+				}
+			}
+		default:
+			key := strings.Join(path, ".")
+			name := shellVarName(prefix + strings.Join(path, "_"))
+
+			if name == "" || name[0] >= '0' && name[0] <= '9' {
+				return fmt.Errorf("value %q cannot be exported as %q, which is not a valid shell variable name. please set a prefix", key, name)
+			}
+
+			if other, ok := keys[name]; ok {
+				a, b := other, key
+				if a > b {
+					a, b = b, a
+				}
+				return fmt.Errorf("values %q and %q are both exported as %s. please rename either of them", a, b, name)
+			}
+			keys[name] = key
+
+			if v == nil {
+				vars[name] = ""
+			} else {
+				vars[name] = fmt.Sprintf("%v", v)
+			}
+		}
+		return nil
+	}
+
+	if err := flatten(nil, values); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, name := range names {
+		lines[i] = fmt.Sprintf("export %s=%s", name, shellQuote(vars[name]))
+	}
+
+	return lines, nil
+}
+
+// shellVarName upper-cases the name and replaces every character other than ASCII letters, digits and `_` with `_`.
+func shellVarName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// shellQuote single-quotes the value, so that it is never expanded by the shell.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/state"
+	"github.com/roboll/helmfile/pkg/tmpl"
+)
+
+var (
+	// templateActionPattern matches the template actions in a string, like `{{ .Values.baseUrl }}`
+	templateActionPattern = regexp.MustCompile(`(?s){{(.*?)}}`)
+
+	// rootFieldPattern matches the fields of the template data referred to in a template action, like `Values` in `.Values.baseUrl`
+	rootFieldPattern = regexp.MustCompile(`(?:^|[^\w.)\]$])\$?\.([A-Za-z_]\w*)`)
+
+	// valuesRefPattern matches the references to the values in a template action, capturing the path like `.app.domain`
+	// in `.Values.app.domain`. The path is empty for the values as a whole, like in `index .Values "app"`
+	valuesRefPattern = regexp.MustCompile(`(?:^|[^\w.)\]$])\$?\.Values((?:\.[A-Za-z_]\w*)*)`)
+)
+
+// interpolatesEnvValues reports whether the environment values are to be interpolated, as opted in with `interpolateValues`
+// of the environment in the helmfile. The state may be nil when the helmfile failed to be parsed.
+func interpolatesEnvValues(st *state.HelmState, env string) bool {
+	return st != nil && st.Environments[env].InterpolateValues
+}
+
+// interpolateEnvValues resolves the references to the other values of the environment in its string values,
+// like `apiUrl: "{{ .Values.baseUrl }}/api"`, so that the environment values can be written DRY.
+//
+// Only the strings whose template actions refer to `.Values` and nothing else from the template data are interpolated,
+// so that templates meant for charts rendering them via `tpl`, like `{{ .Release.Name }}`, are kept as they are.
+// Each of them is rendered exactly once, after all the values it refers to are rendered, so that a template escaped
+// like `{{ "{{ .Values.domain }}" }}` is rendered into the literal text rather than interpolated again.
+// It is an error when values refer to each other in a cycle, or to a value that is not defined.
+// The given values are never modified.
+func interpolateEnvValues(values map[string]interface{}) (map[string]interface{}, error) {
+	// pending is the paths to the values to be interpolated, like `app.hosts[0]`, and the paths to the values they refer to
+	pending := map[string][]string{}
+	collectInterpolatedValues(values, "", pending)
+
+	current := values
+
+	for len(pending) > 0 {
+		ready := map[string]bool{}
+		for path, refs := range pending {
+			if !refersToPending(refs, pending) {
+				ready[path] = true
+			}
+		}
+
+		if len(ready) == 0 {
+			var paths []string
+			for path := range pending {
+				paths = append(paths, path)
+			}
+			sort.Strings(paths)
+			return nil, fmt.Errorf("environment values refer to each other in a cycle: %s", strings.Join(paths, ", "))
+		}
+
+		in := &envValuesInterpolator{
+			render: tmpl.NewTextRenderer(ioutil.ReadFile, "", map[string]interface{}{"Values": current}),
+			ready:  ready,
+		}
+
+		next, err := in.interpolate(current, "")
+		if err != nil {
+			return nil, err
+		}
+
+		for path := range ready {
+			delete(pending, path)
+		}
+
+		current = next.(map[string]interface{})
+	}
+
+	return current, nil
+}
+
+// collectInterpolatedValues adds the path to each string value to be interpolated to pending, along with the paths to the values
+// it refers to
+func collectInterpolatedValues(v interface{}, path string, pending map[string][]string) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			collectInterpolatedValues(e, p, pending)
+		}
+	case []interface{}:
+		for i, e := range t {
+			collectInterpolatedValues(e, fmt.Sprintf("%s[%d]", path, i), pending)
+		}
+	case string:
+		if !refersToValuesOnly(t) {
+			return
+		}
+
+		refs := []string{}
+		for _, action := range templateActionPattern.FindAllStringSubmatch(t, -1) {
+			for _, ref := range valuesRefPattern.FindAllStringSubmatch(action[1], -1) {
+				refs = append(refs, strings.TrimPrefix(ref[1], "."))
+			}
+		}
+		pending[path] = refs
+	}
+}
+
+// refersToPending returns true when any of the paths refers to a value yet to be interpolated, or a map or a list containing one.
+// An empty path refers to the values as a whole.
+func refersToPending(refs []string, pending map[string][]string) bool {
+	for _, ref := range refs {
+		for path := range pending {
+			if ref == "" || ref == path || strings.HasPrefix(path, ref+".") || strings.HasPrefix(path, ref+"[") || strings.HasPrefix(ref, path+".") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type envValuesInterpolator struct {
+	render tmpl.TextRenderer
+
+	// ready is the paths to the values to be interpolated in the pass, whose references are all resolved
+	ready map[string]bool
+}
+
+func (in *envValuesInterpolator) interpolate(v interface{}, path string) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+
+			r, err := in.interpolate(e, p)
+			if err != nil {
+				return nil, err
+			}
+
+			m[k] = r
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			r, err := in.interpolate(e, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+
+			s[i] = r
+		}
+		return s, nil
+	case string:
+		if !in.ready[path] {
+			return t, nil
+		}
+
+		r, err := in.render.RenderTemplateText(t)
+		if err != nil {
+			return nil, fmt.Errorf("failed interpolating environment value %s: %v", path, err)
+		}
+
+		return r, nil
+	default:
+		return v, nil
+	}
+}
+
+// refersToValuesOnly returns true when the string contains template actions referring to `.Values`, and nothing else
+// from the template data
+func refersToValuesOnly(s string) bool {
+	if !strings.Contains(s, "{{") {
+		return false
+	}
+
+	refersToValues := false
+
+	for _, action := range templateActionPattern.FindAllStringSubmatch(s, -1) {
+		for _, field := range rootFieldPattern.FindAllStringSubmatch(action[1], -1) {
+			if field[1] != "Values" {
+				return false
+			}
+			refersToValues = true
+		}
+	}
+
+	return refersToValues
+}
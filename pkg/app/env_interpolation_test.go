@@ -0,0 +1,95 @@
+package app
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateEnvValues(t *testing.T) {
+	values := map[string]interface{}{
+		"scheme":  "https",
+		"domain":  "example.com",
+		"baseUrl": "{{ .Values.scheme }}://{{ .Values.domain }}",
+		"apiUrl":  "{{ .Values.baseUrl }}/api",
+		"app": map[string]interface{}{
+			"hosts":    []interface{}{"{{ .Values.domain }}", "www.{{ .Values.domain }}"},
+			"callback": "{{ .Values.apiUrl }}/callback",
+			"replicas": 2,
+		},
+		// Templates meant for charts are kept as they are
+		"fullname": "{{ .Release.Name }}-{{ .Values.domain }}",
+		"literal":  "no template",
+		// Escaped templates are rendered once, even when rendered into a reference to another value
+		"escaped": `{{ "{{ .Values.domain }}" }}`,
+	}
+
+	actual, err := interpolateEnvValues(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"scheme":  "https",
+		"domain":  "example.com",
+		"baseUrl": "https://example.com",
+		"apiUrl":  "https://example.com/api",
+		"app": map[string]interface{}{
+			"hosts":    []interface{}{"example.com", "www.example.com"},
+			"callback": "https://example.com/api/callback",
+			"replicas": 2,
+		},
+		"fullname": "{{ .Release.Name }}-{{ .Values.domain }}",
+		"literal":  "no template",
+		"escaped":  "{{ .Values.domain }}",
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected values:\nexpected=%v\nactual=%v", expected, actual)
+	}
+
+	if values["apiUrl"] != "{{ .Values.baseUrl }}/api" {
+		t.Errorf("given values must not be modified: %v", values)
+	}
+}
+
+func TestInterpolateEnvValues_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]interface{}
+		err    string
+	}{
+		{
+			name:   "self reference",
+			values: map[string]interface{}{"url": "{{ .Values.url }}/api"},
+			err:    "environment values refer to each other in a cycle: url",
+		},
+		{
+			name: "cycle",
+			values: map[string]interface{}{
+				"a":       "{{ .Values.b.c }}",
+				"b":       map[string]interface{}{"c": "{{ .Values.a }}"},
+				"plain":   "{{ .Values.literal }}",
+				"literal": "x",
+			},
+			err: "environment values refer to each other in a cycle: a, b.c",
+		},
+		{
+			name:   "undefined",
+			values: map[string]interface{}{"url": "{{ .Values.undefined }}/api"},
+			err:    "failed interpolating environment value url: ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := interpolateEnvValues(tt.values)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("unexpected error: expected=%s, actual=%v", tt.err, err)
+			}
+		})
+	}
+}
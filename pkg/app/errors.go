@@ -2,18 +2,64 @@ package app
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
 type NoMatchingHelmfileError struct {
 	selectors []string
+	groups    []string
 	env       string
 }
 
 func (e *NoMatchingHelmfileError) Error() string {
+	if len(e.groups) > 0 {
+		return fmt.Sprintf(
+			"err: no releases found that matches specified selector(%s), group(%s) and environment(%s), in any helmfile",
+			strings.Join(e.selectors, ", "),
+			strings.Join(e.groups, ", "),
+			e.env,
+		)
+	}
 	return fmt.Sprintf(
 		"err: no releases found that matches specified selector(%s) and environment(%s), in any helmfile",
 		strings.Join(e.selectors, ", "),
 		e.env,
 	)
 }
+
+// SubHelmfileLoadError is a sub-helmfile failed to load, which is skipped with LoadOpts.SkipBrokenSubHelmfiles.
+type SubHelmfileLoadError struct {
+	// Path is the absolute path to the sub-helmfile
+	Path string
+	// Parent is the absolute path to the helmfile including the sub-helmfile via `helmfiles`
+	Parent string
+	Err    error
+}
+
+func (e *SubHelmfileLoadError) Error() string {
+	return fmt.Sprintf("failed to load %s included by %s: %v", e.Path, e.Parent, e.Err)
+}
+
+// LoadAllError is returned by App.LoadAll when loading the helmfile failed for any of the environments.
+type LoadAllError struct {
+	// Errors is the errors keyed by the names of the environments failed to load
+	Errors map[string]error
+	// Total is the number of the environments requested to load
+	Total int
+}
+
+func (e *LoadAllError) Error() string {
+	envs := make([]string, 0, len(e.Errors))
+	for env := range e.Errors {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	msgs := make([]string, len(envs))
+	for i, env := range envs {
+		msgs[i] = fmt.Sprintf("environment %s: %v", env, e.Errors[env])
+	}
+
+	return fmt.Sprintf("failed to load %d of %d environments: %s", len(envs), e.Total, strings.Join(msgs, "; "))
+}
@@ -0,0 +1,256 @@
+package app
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/roboll/helmfile/pkg/state"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// LoadInputFile is for a file read while loading a helmfile, like the helmfile itself, its bases, environment values files
+	// and the files read via `readFile` in templates, or a values or secrets file of a release
+	LoadInputFile = "file"
+	// LoadInputGlob is for a glob pattern expanded while loading a helmfile, like the paths of sub-helmfiles, or the one of
+	// values or secrets files of a release
+	LoadInputGlob = "glob"
+	// LoadInputExists is for a file checked for its existence while loading a helmfile, like an optional values file
+	LoadInputExists = "exists"
+)
+
+// LoadInput is a file or a glob accessed while loading a helmfile, reported to App.LoadInputsSink
+type LoadInput struct {
+	// Kind is one of LoadInputFile, LoadInputGlob and LoadInputExists
+	Kind string
+	// Path is the absolute path to the file, or the glob pattern
+	Path string
+
+	// digest is the digest of what was read, to tell whether the input has changed since
+	digest string
+}
+
+// inputRecorder wraps the functions the loader accesses files with, recording every access as a LoadInput,
+// so that a cached state can be told stale when any of the files it was loaded from has changed
+type inputRecorder struct {
+	mu     sync.Mutex
+	inputs []LoadInput
+	done   bool
+
+	readFileFunc   func(string) ([]byte, error)
+	globFunc       func(string) ([]string, error)
+	fileExistsFunc func(string) (bool, error)
+}
+
+func newInputRecorder(readFile func(string) ([]byte, error), glob func(string) ([]string, error), fileExists func(string) (bool, error)) *inputRecorder {
+	return &inputRecorder{
+		readFileFunc:   readFile,
+		globFunc:       glob,
+		fileExistsFunc: fileExists,
+	}
+}
+
+func (r *inputRecorder) record(kind, path, digest string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The state keeps reading files via the recorder while running, like values files, which are read on every run anyway
+	if !r.done {
+		r.inputs = append(r.inputs, LoadInput{Kind: kind, Path: path, digest: digest})
+	}
+}
+
+func (r *inputRecorder) readFile(path string) ([]byte, error) {
+	bytes, err := r.readFileFunc(path)
+	r.record(LoadInputFile, path, fileDigest(bytes, err))
+	return bytes, err
+}
+
+func (r *inputRecorder) glob(pattern string) ([]string, error) {
+	matches, err := r.globFunc(pattern)
+	r.record(LoadInputGlob, pattern, globDigest(matches, err))
+	return matches, err
+}
+
+func (r *inputRecorder) fileExists(path string) (bool, error) {
+	exists, err := r.fileExistsFunc(path)
+	r.record(LoadInputExists, path, existsDigest(exists, err))
+	return exists, err
+}
+
+// stop stops recording and returns the inputs recorded so far
+func (r *inputRecorder) stop() []LoadInput {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.done = true
+	return r.inputs
+}
+
+// releaseValuesInputs returns the values and secrets files of all the releases of the state as inputs, as they are read when
+// running commands rather than loading. A path with a glob pattern is reported as LoadInputGlob. See state.HelmState.ReleaseValuesFiles
+func releaseValuesInputs(st *state.HelmState) []LoadInput {
+	var inputs []LoadInput
+	for i := range st.Releases {
+		for _, f := range st.ReleaseValuesFiles(&st.Releases[i]) {
+			kind := LoadInputFile
+			if strings.ContainsAny(f, "*?[") {
+				kind = LoadInputGlob
+			}
+			inputs = append(inputs, LoadInput{Kind: kind, Path: f})
+		}
+	}
+	return inputs
+}
+
+// summarizeLoadInputs returns the inputs with their paths made absolute, excluding the duplicates of the preceding ones
+func summarizeLoadInputs(inputs []LoadInput, abs func(string) (string, error)) []LoadInput {
+	type key struct{ kind, path string }
+
+	seen := map[key]bool{}
+
+	var summary []LoadInput
+
+	for _, in := range inputs {
+		path := in.Path
+		if p, err := abs(path); err == nil {
+			path = p
+		}
+
+		k := key{in.Kind, path}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+
+		summary = append(summary, LoadInput{Kind: in.Kind, Path: path})
+	}
+
+	return summary
+}
+
+func fileDigest(bytes []byte, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(bytes))
+}
+
+func globDigest(matches []string, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return strings.Join(matches, "\n")
+}
+
+func existsDigest(exists bool, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	return fmt.Sprintf("%v", exists)
+}
+
+type loadCacheEntry struct {
+	st     *state.HelmState
+	inputs []LoadInput
+}
+
+// loadCache caches the states loaded by an App, for embedding helmfile into interactive and watch workflows that load
+// the same helmfile repeatedly. An entry is keyed by everything given to the loader, including the environment, the state
+// values and the environment variables, and is valid as long as every file and glob read while loading it is unchanged.
+//
+// Files are compared by their digests rather than their modification times, so that touching a file doesn't invalidate
+// the cache. Anything else the helmfile depends on, like the output of `exec` and the secrets referenced via vals,
+// is not tracked. Use App.ForceReload to ignore the cache in that case.
+type loadCache struct {
+	mu      sync.Mutex
+	entries map[string]*loadCacheEntry
+}
+
+// get returns a copy of the state cached for the key along with its inputs, or nil when there is none or any of its inputs
+// has changed. A nil cache caches nothing.
+func (c *loadCache) get(key string, readFile func(string) ([]byte, error), glob func(string) ([]string, error), fileExists func(string) (bool, error)) (*state.HelmState, []LoadInput) {
+	if c == nil {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, nil
+	}
+
+	for _, in := range entry.inputs {
+		var digest string
+		switch in.Kind {
+		case LoadInputFile:
+			digest = fileDigest(readFile(in.Path))
+		case LoadInputGlob:
+			digest = globDigest(glob(in.Path))
+		case LoadInputExists:
+			digest = existsDigest(fileExists(in.Path))
+		}
+		if digest != in.digest {
+			return nil, nil
+		}
+	}
+
+	return entry.st.Copy(), entry.inputs
+}
+
+func (c *loadCache) put(key string, st *state.HelmState, inputs []LoadInput) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]*loadCacheEntry{}
+	}
+	c.entries[key] = &loadCacheEntry{st: st.Copy(), inputs: inputs}
+}
+
+// loadCacheKey returns the key to cache the state loaded from the file for the environment with the options.
+// It returns false when the state can't be cached, like one loaded from stdin or with additional template functions,
+// whose results can't be told unchanged.
+func (a *App) loadCacheKey(file, env string, opts LoadOpts) (string, bool) {
+	if a.loadCache == nil || file == StdinHelmfile || len(opts.TemplateFuncs) > 0 {
+		return "", false
+	}
+
+	environ := os.Environ()
+	sort.Strings(environ)
+
+	bytes, err := yaml.Marshal(struct {
+		File         string
+		Env          string
+		Opts         LoadOpts
+		InlineValues map[string]interface{}
+		Namespace    string
+		KubeContext  string
+		Reverse      bool
+		Environ      []string
+	}{
+		File:         file,
+		Env:          env,
+		Opts:         opts,
+		InlineValues: opts.InlineValues,
+		Namespace:    a.Namespace,
+		KubeContext:  a.KubeContext,
+		Reverse:      a.Reverse,
+		Environ:      environ,
+	})
+	if err != nil {
+		return "", false
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(bytes)), true
+}
@@ -1,6 +1,10 @@
 package app
 
 import (
+	"fmt"
+	"strings"
+	"text/template"
+
 	"github.com/roboll/helmfile/pkg/state"
 	"gopkg.in/yaml.v2"
 )
@@ -9,8 +13,106 @@ type LoadOpts struct {
 	Selectors   []string
 	Environment state.SubhelmfileEnvironmentSpec
 
+	// Namespace is the namespace given via `helmfiles[].namespace` of the parent helmfile, or inherited from its ancestor.
+	// It takes precedence over `--namespace` and is applied to all the releases in the helmfile being loaded.
+	Namespace string
+
+	// InheritedOverrideValues is the state values given on the command-line, with paths to values files made absolute.
+	// They are passed down to nested helmfiles, and take precedence over values given via `helmfiles[].values`.
+	InheritedOverrideValues []interface{}
+
 	// CalleePath is the absolute path to the file being loaded
 	CalleePath string
+
+	// AncestorPaths is the absolute paths of the helmfiles including the file being loaded via `helmfiles`, from the top-level one.
+	// It is used to detect a helmfile including itself, directly or indirectly, which would otherwise recurse infinitely.
+	AncestorPaths []string
+
+	// ReverseSortKey is the key to sort releases by in the reverse mode, like `helmfile destroy`.
+	// It must be one of the ReverseSortKey* constants. Releases are sorted in the reverse order of declaration by default.
+	ReverseSortKey string
+
+	// TemplateFuncs is the additional template functions available in all the rendered helmfiles, including nested ones.
+	// Loading fails when any of them has the same name as a built-in function, so that it never silently replaces one.
+	TemplateFuncs template.FuncMap `yaml:"-"`
+
+	// InlineValues is the state values given programmatically when embedding helmfile as a library, without writing them to
+	// a values file. They are merged on top of Environment.OverrideValues, so that they take precedence over the values files
+	// and `--state-values-set`, and are passed down to nested helmfiles like InheritedOverrideValues.
+	InlineValues map[string]interface{} `yaml:"-"`
+
+	// NestedBases evaluates the bases of bases, recursively, in the helmfile being loaded and all the nested ones.
+	// By default, the bases of each helmfile are evaluated, but a base having its own bases is an error.
+	NestedBases bool
+
+	// InheritHelmDefaults passes down the `helmDefaults` of each helmfile to the nested ones via ParentHelmDefaults.
+	InheritHelmDefaults bool
+
+	// ParentHelmDefaults is the `helmDefaults` of the parent helmfile, merged with the ones inherited from its ancestors.
+	// The fields unset in the `helmDefaults` of the helmfile being loaded are set to the ones of the parent.
+	ParentHelmDefaults *state.HelmSpec
+
+	// SkipSubHelmfiles loads only the helmfile itself, for tools inspecting just the top level quickly.
+	// `helmfiles` are left as declared, without expanding globs or evaluating conditions, and neither loaded nor visited.
+	// Values exported by them via `importExports` are not imported either.
+	SkipSubHelmfiles bool
+
+	// DocumentSeparator is the line separating the parts of helmfiles in place of `---`, for generated helmfiles embedding
+	// content that contains `---` itself. It applies to the helmfile being loaded and all the nested ones.
+	// It must be a single non-blank line, and matches only a whole line. Parts are separated by `---` when empty.
+	DocumentSeparator string
+
+	// IsolateDocumentEnvironments renders every part of helmfiles against the environment given to the helmfile, like the
+	// environment values of the parent helmfile and the state values, instead of the one merged from the preceding parts.
+	// By default, a part sees the environments defined and the exports imported by the preceding parts. It applies to the
+	// helmfile being loaded, its bases, and all the nested helmfiles.
+	IsolateDocumentEnvironments bool
+
+	// ValuesTransform, when set, transforms the values of every release processed in the helmfile and all the nested ones,
+	// e.g. to inject common labels or to enforce resource limits when embedding helmfile as a library. See ValuesTransform
+	ValuesTransform ValuesTransform `yaml:"-"`
+
+	// SkipBrokenSubHelmfiles skips the nested helmfiles failed to load while visiting helmfiles, with warnings, instead of
+	// failing, so that the remaining ones are still processed. Each error is collected for reporting. See App.BrokenSubHelmfiles
+	SkipBrokenSubHelmfiles bool
+}
+
+// ValuesTransform is given the values of the release merged from all its values entries, with values files rendered and
+// references to secrets resolved via vals, and returns the values to pass to helm instead. The release is a copy for reference.
+//
+// It is applied to the releases selected to be processed, after they are filtered and before any command runs helm for them,
+// so that the values files of the releases filtered out are never rendered. Secrets files and `set` entries are left as they are, and still take precedence.
+type ValuesTransform func(release state.ReleaseSpec, values map[string]interface{}) (map[string]interface{}, error)
+
+const (
+	// ReverseSortKeyIndex sorts releases in the reverse order of declaration
+	ReverseSortKeyIndex = "index"
+	// ReverseSortKeyName sorts releases by their names in the descending order
+	ReverseSortKeyName = "name"
+	// ReverseSortKeyNamespace sorts releases by their namespaces in the descending order
+	ReverseSortKeyNamespace = "namespace"
+	// ReverseSortKeyPriority sorts releases by their priorities in the ascending order, which is the opposite of the order of syncing them
+	ReverseSortKeyPriority = "priority"
+)
+
+// DefaultDocumentSeparator is the line separating the parts of helmfiles by default. See LoadOpts.DocumentSeparator
+const DefaultDocumentSeparator = "---"
+
+// validateDocumentSeparator fails when the separator given via LoadOpts.DocumentSeparator can never be on its own line.
+func validateDocumentSeparator(sep string) error {
+	if sep == "" {
+		return nil
+	}
+
+	if strings.TrimSpace(sep) == "" {
+		return fmt.Errorf("invalid document separator %q: it must not be blank", sep)
+	}
+
+	if strings.ContainsAny(sep, "\r\n") {
+		return fmt.Errorf("invalid document separator %q: it must be a single line", sep)
+	}
+
+	return nil
 }
 
 func (o LoadOpts) DeepCopy() LoadOpts {
@@ -24,5 +126,9 @@ func (o LoadOpts) DeepCopy() LoadOpts {
 		panic(err)
 	}
 
+	new.TemplateFuncs = o.TemplateFuncs
+	new.InlineValues = o.InlineValues
+	new.ValuesTransform = o.ValuesTransform
+
 	return new
 }
@@ -2,11 +2,15 @@ package app
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/roboll/helmfile/pkg/argparser"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/schema"
 	"github.com/roboll/helmfile/pkg/state"
+	"go.uber.org/zap"
 )
 
 type Run struct {
@@ -21,6 +25,10 @@ func NewRun(st *state.HelmState, helm helmexec.Interface, ctx Context) *Run {
 	return &Run{state: st, helm: helm, ctx: ctx}
 }
 
+func (r *Run) concurrency(c concurrencyConfig) int {
+	return r.state.ResolveConcurrency(c.Concurrency())
+}
+
 func (r *Run) askForConfirmation(msg string) bool {
 	if r.Ask != nil {
 		return r.Ask(msg)
@@ -29,6 +37,32 @@ func (r *Run) askForConfirmation(msg string) bool {
 }
 
 func (r *Run) Deps(c DepsConfigProvider) []error {
+	if c.Orphans() {
+		degrees, err := r.state.Degrees()
+		if err != nil {
+			return []error{err}
+		}
+		for _, d := range degrees {
+			if d.Orphan() {
+				fmt.Println(d.Release)
+			}
+		}
+		return nil
+	}
+
+	switch c.Output() {
+	case "":
+	case "dot":
+		graph, err := r.state.DOT()
+		if err != nil {
+			return []error{err}
+		}
+		fmt.Print(graph)
+		return nil
+	default:
+		return []error{fmt.Errorf("unsupported output format %q: it must be one of: dot", c.Output())}
+	}
+
 	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
 	if !c.SkipRepos() {
@@ -51,13 +85,13 @@ func (r *Run) DeprecatedSyncCharts(c DeprecatedChartsConfigProvider) []error {
 	helm := r.helm
 
 	affectedReleases := state.AffectedReleases{}
-	errs := st.SyncReleases(&affectedReleases, helm, c.Values(), c.Concurrency())
+	errs := st.SyncReleases(&affectedReleases, helm, c.Values(), r.concurrency(c))
 	affectedReleases.DisplayAffectedReleases(c.Logger())
 	return errs
 }
 
 func (r *Run) Status(c StatusesConfigProvider) []error {
-	workers := c.Concurrency()
+	workers := r.concurrency(c)
 
 	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
@@ -86,7 +120,7 @@ Do you really want to delete?
 	if !interactive || interactive && r.askForConfirmation(msg) {
 		r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
-		errs = r.state.DeleteReleases(&affectedReleases, r.helm, c.Concurrency(), purge)
+		errs = r.state.DeleteReleases(&affectedReleases, r.helm, r.concurrency(c), purge, &state.DeleteOpts{Batch: c.Batch(), Group: c.Group(), ContinueOnError: c.ContinueOnError(), StrictDependents: c.StrictDependents()})
 	}
 	affectedReleases.DisplayAffectedReleases(c.Logger())
 	return errs
@@ -112,7 +146,7 @@ Do you really want to delete?
 	if !interactive || interactive && r.askForConfirmation(msg) {
 		r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
-		errs = r.state.DeleteReleases(&affectedReleases, r.helm, c.Concurrency(), true)
+		errs = r.state.DeleteReleases(&affectedReleases, r.helm, r.concurrency(c), true, &state.DeleteOpts{Batch: c.Batch(), Group: c.Group(), ContinueOnError: c.ContinueOnError(), StrictDependents: c.StrictDependents()})
 	}
 	affectedReleases.DisplayAffectedReleases(c.Logger())
 	return errs
@@ -128,14 +162,34 @@ func (r *Run) Apply(c ApplyConfigProvider) []error {
 		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
 			return errs
 		}
-		if errs := st.BuildDeps(helm); errs != nil && len(errs) > 0 {
-			return errs
-		}
 	}
+
+	record, err := r.selectChangedReleases(c.Incremental(), c.Values(), c.Set(), c.Logger())
+	if err != nil {
+		return []error{err}
+	}
+	if c.Incremental() && len(st.Releases) == 0 {
+		return nil
+	}
+
+	progress, err := r.resumeReleases(c.Resume(), c.AtomicRun(), "apply", c.Values(), c.Set(), c.Logger())
+	if err != nil {
+		return []error{err}
+	}
+	if c.Resume() && len(st.Releases) == 0 {
+		return record(progress(&affectedReleases, nil))
+	}
+
 	if errs := st.PrepareReleases(helm, "apply"); errs != nil && len(errs) > 0 {
 		return errs
 	}
 
+	cleanup, errs := r.prepareCharts(c, c.SkipDeps())
+	defer cleanup()
+	if len(errs) > 0 {
+		return errs
+	}
+
 	// helm must be 2.11+ and helm-diff should be provided `--detailed-exitcode` in order for `helmfile apply` to work properly
 	detailedExitCode := true
 
@@ -145,9 +199,9 @@ func (r *Run) Apply(c ApplyConfigProvider) []error {
 		Set:     c.Set(),
 	}
 
-	releases, errs := st.DiffReleases(helm, c.Values(), c.Concurrency(), detailedExitCode, c.SuppressSecrets(), false, diffOpts)
+	summary, errs := st.DiffReleasesWithSummary(helm, c.Values(), r.concurrency(c), detailedExitCode, c.SuppressSecrets(), false, diffOpts)
 
-	releasesToBeDeleted, err := st.DetectReleasesToBeDeleted(helm)
+	preview, err := st.PreviewApply(helm, summary, r.concurrency(c))
 	if err != nil {
 		errs = append(errs, err)
 	}
@@ -170,44 +224,38 @@ func (r *Run) Apply(c ApplyConfigProvider) []error {
 
 	// sync only when there are changes
 	if noError {
-		if len(releases) == 0 && len(releasesToBeDeleted) == 0 {
+		if len(preview.Installed) == 0 && len(preview.Upgraded) == 0 && len(preview.Uninstalled) == 0 {
 			// TODO better way to get the logger
 			logger := c.Logger()
 			logger.Infof("")
 			logger.Infof("No affected releases")
-		} else {
-			names := []string{}
-			for _, r := range releases {
-				names = append(names, fmt.Sprintf("  %s (%s) UPDATED", r.Name, r.Chart))
-			}
-			for _, r := range releasesToBeDeleted {
-				names = append(names, fmt.Sprintf("  %s (%s) DELETED", r.Name, r.Chart))
-			}
 
-			msg := fmt.Sprintf(`Affected releases are:
-%s
+			if errs := record(progress(&affectedReleases, nil)); len(errs) > 0 {
+				return errs
+			}
+		} else {
+			msg := fmt.Sprintf(`%s
 
 Do you really want to apply?
   Helmfile will apply all your changes, as shown above.
 
-`, strings.Join(names, "\n"))
+`, formatApplyPreview(preview))
 			interactive := c.Interactive()
+			if !interactive {
+				c.Logger().Info(formatApplyPreview(preview))
+			}
 			if !interactive || interactive && r.askForConfirmation(msg) {
-				rs := []state.ReleaseSpec{}
-				for _, r := range releases {
-					rs = append(rs, *r)
-				}
-				for _, r := range releasesToBeDeleted {
-					rs = append(rs, *r)
-				}
-
 				r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
-				st.Releases = rs
+				st.SelectAffectedReleases(preview)
 				syncOpts := &state.SyncOpts{
-					Set: c.Set(),
+					Set:                   c.Set(),
+					SkipNeedsNotInstalled: c.SkipNeedsNotInstalled(),
+					MaxFailures:           c.MaxFailures(),
+					AtomicRun:             c.AtomicRun(),
+					Batch:                 c.Batch(),
 				}
-				return st.SyncReleases(&affectedReleases, helm, c.Values(), c.Concurrency(), syncOpts)
+				return record(progress(&affectedReleases, st.SyncReleases(&affectedReleases, helm, c.Values(), r.concurrency(c), syncOpts)))
 			}
 		}
 	}
@@ -216,6 +264,37 @@ Do you really want to apply?
 	return fatalErrs
 }
 
+// formatApplyPreview describes the releases to be installed and updated along with the number of the resources changed in each,
+// the releases to be deleted, and the number of the releases with and without changes across the whole helmfile
+func formatApplyPreview(preview *state.ApplyPreview) string {
+	names := []string{}
+	describe := func(r state.ReleaseDiff, action string) string {
+		switch r.Changes {
+		case 0:
+			return fmt.Sprintf("  %s (%s) %s", r.Name, r.Chart, action)
+		case 1:
+			return fmt.Sprintf("  %s (%s) %s, 1 resource changed", r.Name, r.Chart, action)
+		default:
+			return fmt.Sprintf("  %s (%s) %s, %d resources changed", r.Name, r.Chart, action, r.Changes)
+		}
+	}
+	for _, r := range preview.Installed {
+		names = append(names, describe(r, "INSTALLED"))
+	}
+	for _, r := range preview.Upgraded {
+		names = append(names, describe(r, "UPDATED"))
+	}
+	for _, r := range preview.Uninstalled {
+		names = append(names, fmt.Sprintf("  %s (%s) DELETED", r.Name, r.Chart))
+	}
+
+	return fmt.Sprintf(`Affected releases are:
+%s
+
+%d release(s) to be installed, %d release(s) to be updated, %d release(s) to be deleted, %d release(s) unchanged`,
+		strings.Join(names, "\n"), len(preview.Installed), len(preview.Upgraded), len(preview.Uninstalled), len(preview.Unchanged))
+}
+
 func (r *Run) Diff(c DiffConfigProvider) []error {
 	st := r.state
 	helm := r.helm
@@ -225,14 +304,17 @@ func (r *Run) Diff(c DiffConfigProvider) []error {
 		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
 			return errs
 		}
-		if errs := st.BuildDeps(helm); errs != nil && len(errs) > 0 {
-			return errs
-		}
 	}
 	if errs := st.PrepareReleases(helm, "diff"); errs != nil && len(errs) > 0 {
 		return errs
 	}
 
+	cleanup, errs := r.prepareCharts(c, c.SkipDeps())
+	defer cleanup()
+	if len(errs) > 0 {
+		return errs
+	}
+
 	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
 	opts := &state.DiffOpts{
@@ -240,43 +322,229 @@ func (r *Run) Diff(c DiffConfigProvider) []error {
 		NoColor: c.NoColor(),
 		Set:     c.Set(),
 	}
-	_, errs := st.DiffReleases(helm, c.Values(), c.Concurrency(), c.DetailedExitcode(), c.SuppressSecrets(), true, opts)
+	_, errs = st.DiffReleases(helm, c.Values(), r.concurrency(c), c.DetailedExitcode(), c.SuppressSecrets(), true, opts)
 	return errs
 }
 
-func (r *Run) Sync(c SyncConfigProvider) []error {
+// Drift detects the releases drifted from the desired state, preparing the releases and the charts as Diff does
+func (r *Run) Drift(c DriftConfigProvider) (*state.DriftReport, []error) {
 	st := r.state
 	helm := r.helm
 	ctx := r.ctx
 
-	affectedReleases := state.AffectedReleases{}
 	if !c.SkipDeps() {
 		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
-			return errs
+			return nil, errs
+		}
+	}
+	if errs := st.PrepareReleases(helm, "drift"); errs != nil && len(errs) > 0 {
+		return nil, errs
+	}
+
+	cleanup, errs := r.prepareCharts(c, c.SkipDeps())
+	defer cleanup()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
+
+	opts := &state.DiffOpts{
+		Context: c.Context(),
+		NoColor: true,
+		Set:     c.Set(),
+	}
+	return st.DetectDrift(helm, c.Values(), r.concurrency(c), opts)
+}
+
+func (r *Run) ValidateSchema(c ValidateSchemaConfigProvider, sch *schema.Schema) (*state.ValidationReport, []error) {
+	st := r.state
+	helm := r.helm
+	ctx := r.ctx
+
+	if !c.SkipDeps() {
+		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
+			return nil, errs
 		}
 		if errs := st.BuildDeps(helm); errs != nil && len(errs) > 0 {
+			return nil, errs
+		}
+	}
+	if errs := st.PrepareReleases(helm, "validate-schema"); errs != nil && len(errs) > 0 {
+		return nil, errs
+	}
+
+	args := argparser.GetArgs(c.Args(), st)
+	opts := &state.TemplateOpts{
+		Set: c.Set(),
+	}
+	return st.ValidateManifests(helm, sch, c.Values(), args, r.concurrency(c), opts)
+}
+
+func (r *Run) Sync(c SyncConfigProvider) []error {
+	st := r.state
+	helm := r.helm
+	ctx := r.ctx
+
+	affectedReleases := state.AffectedReleases{}
+	if !c.SkipDeps() {
+		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
 			return errs
 		}
 	}
+
+	record, err := r.selectChangedReleases(c.Incremental(), c.Values(), c.Set(), c.Logger())
+	if err != nil {
+		return []error{err}
+	}
+	if c.Incremental() && len(st.Releases) == 0 {
+		return nil
+	}
+
+	progress, err := r.resumeReleases(c.Resume(), c.AtomicRun(), "sync", c.Values(), c.Set(), c.Logger())
+	if err != nil {
+		return []error{err}
+	}
+	if c.Resume() && len(st.Releases) == 0 {
+		return record(progress(&affectedReleases, nil))
+	}
+
 	if errs := st.PrepareReleases(helm, "sync"); errs != nil && len(errs) > 0 {
 		return errs
 	}
 
+	cleanup, errs := r.prepareCharts(c, c.SkipDeps())
+	defer cleanup()
+	if len(errs) > 0 {
+		return errs
+	}
+
 	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
 	opts := &state.SyncOpts{
-		Set: c.Set(),
+		Set:                   c.Set(),
+		SkipNeedsNotInstalled: c.SkipNeedsNotInstalled(),
+		MaxFailures:           c.MaxFailures(),
+		AtomicRun:             c.AtomicRun(),
+		Batch:                 c.Batch(),
 	}
-	errs := st.SyncReleases(&affectedReleases, helm, c.Values(), c.Concurrency(), opts)
+	errs = record(progress(&affectedReleases, st.SyncReleases(&affectedReleases, helm, c.Values(), r.concurrency(c), opts)))
 	affectedReleases.DisplayAffectedReleases(c.Logger())
 	return errs
 }
 
+// selectChangedReleases narrows the releases down to the ones changed since the last successful run, along with the releases
+// needing them, when run incrementally. See state.HelmState.SelectChangedReleases for more details.
+// It returns the function to be called with the errors of processing the releases, which records the hashes of the releases
+// for the next run only when there's no error.
+func (r *Run) selectChangedReleases(incremental bool, values, set []string, logger *zap.SugaredLogger) (func([]error) []error, error) {
+	noop := func(errs []error) []error { return errs }
+
+	if !incremental {
+		return noop, nil
+	}
+
+	st := r.state
+
+	previous, err := st.LoadReleaseHashes()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes, err := st.SelectChangedReleases(previous, values, set)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(st.Releases) == 0 {
+		logger.Infof("No releases changed since the last incremental run in %s", st.FilePath)
+		return noop, nil
+	}
+
+	return func(errs []error) []error {
+		if len(errs) > 0 {
+			return errs
+		}
+
+		for id, h := range hashes {
+			previous[id] = h
+		}
+
+		if err := st.SaveReleaseHashes(previous); err != nil {
+			return []error{err}
+		}
+
+		return nil
+	}, nil
+}
+
+// resumeReleases skips the releases succeeded by the last failed run of the command, when resumed.
+// See state.HelmState.SelectUnfinishedReleases for more details.
+// It returns the function to be called with the releases affected and the errors of processing the releases, which records the
+// progress of the run for the next run to resume from when there's an error, and removes the record otherwise.
+// The progress is recorded whether resumed or not, so that any failed run can be resumed, except for atomic runs.
+func (r *Run) resumeReleases(resume, atomicRun bool, command string, values, set []string, logger *zap.SugaredLogger) (func(*state.AffectedReleases, []error) []error, error) {
+	noop := func(_ *state.AffectedReleases, errs []error) []error { return errs }
+
+	if atomicRun {
+		if resume {
+			return nil, fmt.Errorf("--resume can't be used with --atomic-run, as the releases synced by a failed atomic run are rolled back")
+		}
+		// A failed atomic run leaves nothing to resume from, as the releases synced in the run are rolled back
+		return noop, nil
+	}
+
+	st := r.state
+
+	var previous *state.RunProgress
+	if resume {
+		var err error
+		previous, err = st.LoadRunProgress()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	progress, err := st.SelectUnfinishedReleases(previous, command, values, set)
+	if err != nil {
+		if !resume {
+			logger.Warnf("the progress of the run is not going to be recorded for --resume: %v", err)
+			return noop, nil
+		}
+		return nil, err
+	}
+
+	if resume && len(st.Releases) == 0 {
+		logger.Infof("No releases left to resume in %s", st.FilePath)
+	}
+
+	return func(affected *state.AffectedReleases, errs []error) []error {
+		if len(errs) == 0 {
+			if err := st.RemoveRunProgress(); err != nil {
+				return []error{err}
+			}
+			return nil
+		}
+
+		progress.Record(affected)
+
+		if err := st.SaveRunProgress(progress); err != nil {
+			return append(errs, err)
+		}
+
+		return errs
+	}, nil
+}
+
 func (r *Run) Template(c TemplateConfigProvider) []error {
 	st := r.state
 	helm := r.helm
 	ctx := r.ctx
 
+	if c.Validate() {
+		return r.validate(c.Logger())
+	}
+
 	if !c.SkipDeps() {
 		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
 			return errs
@@ -293,13 +561,46 @@ func (r *Run) Template(c TemplateConfigProvider) []error {
 	opts := &state.TemplateOpts{
 		Set: c.Set(),
 	}
-	return st.TemplateReleases(helm, c.OutputDir(), c.Values(), args, c.Concurrency(), opts)
+	return st.TemplateReleases(helm, c.OutputDir(), c.Values(), args, r.concurrency(c), opts)
+}
+
+// prepareCharts builds the dependencies of the local charts and downloads the remote charts into a temporary directory concurrently,
+// before the releases are processed in the order of the DAG. The returned function removes the directory.
+func (r *Run) prepareCharts(c concurrencyConfig, skipDeps bool) (func(), []error) {
+	dir, err := ioutil.TempDir("", "helmfile-charts-")
+	if err != nil {
+		return func() {}, []error{err}
+	}
+
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+
+	// Unlike the concurrency of processing releases, the one of preparing charts is never limited by the environment,
+	// as downloading charts has nothing to do with the cluster. It is still capped by --max-concurrency, via the workers of the state
+	return cleanup, r.state.PrepareCharts(r.helm, dir, c.Concurrency(), skipDeps)
+}
+
+// validate reports the releases in the order they would be synced, after validating them without running helm
+func (r *Run) validate(logger *zap.SugaredLogger) []error {
+	groups, err := r.state.Validate()
+	if err != nil {
+		return []error{err}
+	}
+
+	logger.Infof("")
+	logger.Infof("%d release(s) in %s are valid, and would be synced in this order:", len(r.state.Releases), r.state.FilePath)
+	for i, ids := range groups {
+		logger.Infof("  %d. %s", i+1, strings.Join(ids, ", "))
+	}
+
+	return nil
 }
 
 func (r *Run) Test(c TestConfigProvider) []error {
 	cleanup := c.Cleanup()
 	timeout := c.Timeout()
-	concurrency := c.Concurrency()
+	concurrency := r.concurrency(c)
 
 	r.helm.SetExtraArgs(argparser.GetArgs(c.Args(), r.state)...)
 
@@ -313,7 +614,10 @@ func (r *Run) Lint(c LintConfigProvider) []error {
 
 	values := c.Values()
 	args := argparser.GetArgs(c.Args(), st)
-	workers := c.Concurrency()
+	workers := r.concurrency(c)
+	if errs := st.ValidateDAG(c.WarnDisconnected()); len(errs) > 0 {
+		return errs
+	}
 	if !c.SkipDeps() {
 		if errs := ctx.SyncReposOnce(st, helm); errs != nil && len(errs) > 0 {
 			return errs
@@ -25,7 +25,7 @@ func (r *desiredStateLoader) renderPrestate(firstPassEnv *environment.Environmen
 		Namespace:   r.namespace,
 		Values:      map[string]interface{}{},
 	}
-	firstPassRenderer := tmpl.NewFirstPassRenderer(baseDir, tmplData)
+	firstPassRenderer := tmpl.NewFirstPassRenderer(baseDir, tmplData).WithFuncs(r.TemplateFuncs).WithDeterministic(r.deterministicSeed())
 
 	// parse as much as we can, tolerate errors, this is a preparse
 	yamlBuf, err := firstPassRenderer.RenderTemplateContentToBuffer(content)
@@ -109,6 +109,14 @@ func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *en
 		return nil, err
 	}
 
+	// Interpolated before the second pass, so that the templates in the helmfile see the resolved values
+	if interpolatesEnvValues(prestate, r.env) {
+		finalEnv.Values, err = interpolateEnvValues(finalEnv.Values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if r.logger != nil {
 		r.logger.Debugf("first-pass rendering result of \"%s\": %v", filename, *finalEnv)
 	}
@@ -130,7 +138,7 @@ func (r *desiredStateLoader) twoPassRenderTemplateToYaml(inherited, overrode *en
 		Namespace:   r.namespace,
 		Values:      vals,
 	}
-	secondPassRenderer := tmpl.NewFileRenderer(r.readFile, baseDir, tmplData)
+	secondPassRenderer := tmpl.NewFileRenderer(r.readFile, baseDir, tmplData).WithFuncs(r.TemplateFuncs).WithDeterministic(r.deterministicSeed()).WithStrict(r.StrictTemplates)
 	yamlBuf, err := secondPassRenderer.RenderTemplateContentToBuffer(content)
 	if err != nil {
 		if r.logger != nil {
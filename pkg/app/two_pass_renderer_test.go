@@ -232,3 +232,87 @@ releases:
 		t.Fatalf("wanted error, none returned")
 	}
 }
+
+func TestReadFromYaml_RenderTemplateDeterministically(t *testing.T) {
+	yamlContent := []byte(`releases:
+- name: myrelease
+  chart: mychart
+  values:
+  - password: {{ randAlphaNum 16 }}
+    id: {{ uuidv4 }}
+`)
+
+	render := func(env, seed string) string {
+		r, _ := makeLoader(map[string]string{}, env)
+		r.Deterministic = seed != ""
+		r.DeterministicSeed = seed
+		yamlBuf, err := r.renderTemplatesToYaml("", "", yamlContent)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return yamlBuf.String()
+	}
+
+	first, second := render("default", "secret"), render("default", "secret")
+	if first != second {
+		t.Errorf("unexpected difference between renders:\nfirst=%s\nsecond=%s", first, second)
+	}
+
+	if random := render("default", ""); random == first {
+		t.Errorf("unexpected deterministic render without Deterministic: %s", random)
+	}
+	if other := render("default", "another"); other == first {
+		t.Errorf("unexpected identical render with another seed: %s", other)
+	}
+	if other := render("prod", "secret"); other == first {
+		t.Errorf("unexpected identical render for another environment: %s", other)
+	}
+
+	r, _ := makeLoader(map[string]string{}, "default")
+	r.Deterministic = true
+	r.DeterministicSeed = "secret"
+	if _, err := r.renderTemplatesToYaml("", "", []byte(`key: {{ genPrivateKey "rsa" | quote }}`)); err == nil || !strings.Contains(err.Error(), "genPrivateKey is disabled") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReadFromYaml_RenderTemplateStrictly(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		strict   bool
+		expected string
+		wantErr  string
+	}{
+		{name: "defined", content: `name: {{ index (dict "foo" "app") "foo" }}-{{ .Environment.Name }}`, strict: true, expected: `name: app-default`},
+		{name: "undefined", content: `name: {{ index .Values "typo" }}`, expected: `name: <no value>`},
+		{
+			name:    "undefined with strict",
+			content: "releases:\n- name: {{ index .Values \"typo\" }}",
+			strict:  true,
+			wantErr: `rendered "<no value>" for an undefined or null value at line 2 of the result: - name: <no value>. use ` + "`default` or `hasKey`" + ` for an optional one`,
+		},
+		{name: "defaulted with strict", content: `name: {{ index .Values "typo" | default "app" }}`, strict: true, expected: `name: app`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := makeLoader(map[string]string{}, "default")
+			r.StrictTemplates = tt.strict
+
+			yamlBuf, err := r.renderTemplatesToYaml("", "", []byte(tt.content))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if yamlBuf.String() != tt.expected {
+				t.Errorf("unexpected result: expected=%q, got=%q", tt.expected, yamlBuf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/variantdev/vals"
+)
+
+// redactingEvaluator adds every value resolved from a reference to a secret via vals, like `ref+vault://...`,
+// to the redactor, so that the logs emitted after the value is resolved never contain it
+type redactingEvaluator struct {
+	vals.Evaluator
+	redactor *helmexec.Redactor
+}
+
+func (e *redactingEvaluator) Eval(template map[string]interface{}) (map[string]interface{}, error) {
+	resolved, err := e.Evaluator.Eval(template)
+	if err != nil {
+		return nil, err
+	}
+
+	e.addResolved(template, resolved)
+
+	return resolved, nil
+}
+
+// addResolved walks the template and the resolved values in parallel, adding the values resolved from the references
+func (e *redactingEvaluator) addResolved(template, resolved interface{}) {
+	switch t := template.(type) {
+	case string:
+		if strings.Contains(t, "ref+") {
+			e.addAll(resolved)
+		}
+	case map[string]interface{}:
+		if r, ok := resolved.(map[string]interface{}); ok {
+			for k, v := range t {
+				e.addResolved(v, r[k])
+			}
+		}
+	case map[interface{}]interface{}:
+		switch r := resolved.(type) {
+		case map[interface{}]interface{}:
+			for k, v := range t {
+				e.addResolved(v, r[k])
+			}
+		case map[string]interface{}:
+			for k, v := range t {
+				if ks, ok := k.(string); ok {
+					e.addResolved(v, r[ks])
+				}
+			}
+		}
+	case []interface{}:
+		if r, ok := resolved.([]interface{}); ok && len(r) == len(t) {
+			for i := range t {
+				e.addResolved(t[i], r[i])
+			}
+		}
+	case []string:
+		switch r := resolved.(type) {
+		case []interface{}:
+			if len(r) == len(t) {
+				for i := range t {
+					e.addResolved(t[i], r[i])
+				}
+			}
+		case []string:
+			if len(r) == len(t) {
+				for i := range t {
+					e.addResolved(t[i], r[i])
+				}
+			}
+		}
+	}
+}
+
+// addAll adds all the strings in the value resolved from a reference, which is a map when the reference has no fragment
+func (e *redactingEvaluator) addAll(resolved interface{}) {
+	switch r := resolved.(type) {
+	case string:
+		e.redactor.Add(r)
+	case map[string]interface{}:
+		for _, v := range r {
+			e.addAll(v)
+		}
+	case map[interface{}]interface{}:
+		for _, v := range r {
+			e.addAll(v)
+		}
+	case []interface{}:
+		for _, v := range r {
+			e.addAll(v)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+type fakeEvaluator struct {
+	values map[string]interface{}
+}
+
+func (e *fakeEvaluator) Eval(template map[string]interface{}) (map[string]interface{}, error) {
+	return e.resolve(template).(map[string]interface{}), nil
+}
+
+func (e *fakeEvaluator) resolve(template interface{}) interface{} {
+	switch t := template.(type) {
+	case string:
+		if v, ok := e.values[t]; ok {
+			return v
+		}
+		return t
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, v := range t {
+			m[k] = e.resolve(v)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, v := range t {
+			s[i] = e.resolve(v)
+		}
+		return s
+	case []string:
+		s := make([]interface{}, len(t))
+		for i, v := range t {
+			s[i] = e.resolve(v)
+		}
+		return s
+	}
+	return template
+}
+
+func TestRedactingEvaluator(t *testing.T) {
+	redactor, err := helmexec.NewRedactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &redactingEvaluator{
+		Evaluator: &fakeEvaluator{values: map[string]interface{}{
+			"ref+vault://myapp/db#/password": "dbpassword",
+			"ref+vault://myapp/secrets":      map[string]interface{}{"token": "apitoken"},
+			"ref+echo://plain":               "plainvalue",
+		}},
+		redactor: redactor,
+	}
+
+	if _, err := e.Eval(map[string]interface{}{
+		"values": []interface{}{
+			map[string]interface{}{"db": map[string]interface{}{"password": "ref+vault://myapp/db#/password", "user": "dbuser"}},
+			"ref+vault://myapp/secrets",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(map[string]interface{}{"values": []string{"ref+echo://plain"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	actual := redactor.Redact("dbuser:dbpassword apitoken plainvalue")
+	expected := "dbuser:*** *** ***"
+	if actual != expected {
+		t.Errorf("unexpected redaction: expected=%q, got=%q", expected, actual)
+	}
+}
@@ -1,6 +1,9 @@
 package environment
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/imdario/mergo"
 	"github.com/roboll/helmfile/pkg/maputil"
 	"gopkg.in/yaml.v2"
@@ -14,6 +17,27 @@ type Environment struct {
 
 var EmptyEnvironment Environment
 
+// NameSeparator separates the names of the environments selected at once, like `base,prod`.
+// The environments are merged in the order, so that values in a later environment take precedence.
+const NameSeparator = ","
+
+// SplitNames returns the names of the environments selected by the name, which is a single name or the names joined by NameSeparator.
+func SplitNames(name string) []string {
+	var names []string
+	for _, n := range strings.Split(name, NameSeparator) {
+		if n = strings.TrimSpace(n); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// Names returns the names of the environments merged into the environment in the order, like `["base", "prod"]` for `base,prod`.
+// It is handy for checking an environment in templates regardless of the others selected with it, like `has "prod" .Environment.Names`.
+func (e Environment) Names() []string {
+	return SplitNames(e.Name)
+}
+
 func (e Environment) DeepCopy() Environment {
 	valuesBytes, err := yaml.Marshal(e.Values)
 	if err != nil {
@@ -48,19 +72,68 @@ func (e Environment) DeepCopy() Environment {
 	}
 }
 
+// Merge returns a copy of the environment with the other environment merged into it. Neither of them is modified.
+//
+// Values in the other environment take precedence, and are merged according to their types:
+//
+//   - maps are merged recursively, key by key
+//   - lists are replaced as a whole, even when they contain maps, as helm does for values. Items are never appended nor merged by index
+//   - scalars are replaced, including zero values like `false`, `0` and `""`
+//   - null deletes the key, so that a value inherited from the environment can be unset, e.g. for `hasKey` to return false
+//
+// The result is deterministic, regardless of the order of keys in the maps.
 func (e *Environment) Merge(other *Environment) (*Environment, error) {
 	if e == nil {
 		if other != nil {
 			copy := other.DeepCopy()
+			deleteNulls(copy.Values, other.Values)
+			deleteNulls(copy.Defaults, other.Defaults)
 			return &copy, nil
 		}
 		return nil, nil
 	}
 	copy := e.DeepCopy()
 	if other != nil {
-		if err := mergo.Merge(&copy, other, mergo.WithOverride); err != nil {
+		// The other environment is copied as well, as mergo shares its nested maps with the result, from which nulls are deleted
+		overrides := other.DeepCopy()
+		if err := mergo.Merge(&copy, &overrides, mergo.WithOverride); err != nil {
 			return nil, err
 		}
+		deleteNulls(copy.Values, overrides.Values)
+		deleteNulls(copy.Defaults, overrides.Defaults)
 	}
 	return &copy, nil
 }
+
+// deleteNulls deletes the keys set to null in the overrides from the merged values, recursively in nested maps.
+// Both of them may be keyed by strings or by anything, as values unmarshalled from YAML are.
+func deleteNulls(merged, overrides interface{}) {
+	switch o := overrides.(type) {
+	case map[string]interface{}:
+		for k, v := range o {
+			deleteNull(merged, k, v)
+		}
+	case map[interface{}]interface{}:
+		for k, v := range o {
+			deleteNull(merged, k, v)
+		}
+	}
+}
+
+func deleteNull(merged interface{}, k, v interface{}) {
+	switch m := merged.(type) {
+	case map[string]interface{}:
+		key := fmt.Sprintf("%v", k)
+		if v == nil {
+			delete(m, key)
+		} else {
+			deleteNulls(m[key], v)
+		}
+	case map[interface{}]interface{}:
+		if v == nil {
+			delete(m, k)
+		} else {
+			deleteNulls(m[k], v)
+		}
+	}
+}
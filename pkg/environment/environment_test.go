@@ -0,0 +1,194 @@
+package environment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvironment_Merge(t *testing.T) {
+	inherited := &Environment{
+		Name: "default",
+		Values: map[string]interface{}{
+			"app": map[string]interface{}{
+				"replicas": 1,
+				"enabled":  true,
+				"image":    "app:v1",
+				"hosts":    []interface{}{"a.example.com", "b.example.com"},
+				"sidecars": []interface{}{
+					map[string]interface{}{"name": "proxy", "image": "proxy:v1"},
+				},
+			},
+			"keep": "kept",
+		},
+	}
+
+	override := &Environment{
+		Name: "default",
+		Values: map[string]interface{}{
+			"app": map[string]interface{}{
+				"replicas": 3,
+				"enabled":  false,
+				"image":    nil,
+				"hosts":    []interface{}{"c.example.com"},
+				"sidecars": []interface{}{
+					map[string]interface{}{"name": "logger"},
+				},
+			},
+			"new": []interface{}{},
+		},
+	}
+
+	merged, err := inherited.Merge(override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app": map[string]interface{}{
+			"replicas": 3,
+			"enabled":  false,
+			"hosts":    []interface{}{"c.example.com"},
+			"sidecars": []interface{}{
+				map[string]interface{}{"name": "logger"},
+			},
+		},
+		"keep": "kept",
+		"new":  []interface{}{},
+	}
+
+	if !reflect.DeepEqual(merged.Values, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, merged.Values)
+	}
+
+	if !reflect.DeepEqual(inherited.Values["app"].(map[string]interface{})["hosts"], []interface{}{"a.example.com", "b.example.com"}) {
+		t.Errorf("inherited environment must not be modified: %v", inherited.Values)
+	}
+}
+
+func TestEnvironment_Merge_EmptyListReplaces(t *testing.T) {
+	inherited := &Environment{Values: map[string]interface{}{"hosts": []interface{}{"a.example.com"}}}
+	override := &Environment{Values: map[string]interface{}{"hosts": []interface{}{}}}
+
+	merged, err := inherited.Merge(override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{"hosts": []interface{}{}}
+	if !reflect.DeepEqual(merged.Values, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, merged.Values)
+	}
+}
+
+func TestEnvironment_Merge_Nil(t *testing.T) {
+	env := &Environment{Name: "default", Values: map[string]interface{}{"foo": "bar"}}
+
+	var nilEnv *Environment
+
+	merged, err := nilEnv.Merge(env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(merged.Values, env.Values) {
+		t.Errorf("unexpected values: expected=%v, got=%v", env.Values, merged.Values)
+	}
+
+	merged, err = env.Merge(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(merged.Values, env.Values) {
+		t.Errorf("unexpected values: expected=%v, got=%v", env.Values, merged.Values)
+	}
+}
+
+func TestEnvironment_Merge_NullDeletes(t *testing.T) {
+	inherited := &Environment{
+		Values: map[string]interface{}{
+			"ingress": map[string]interface{}{"host": "example.com"},
+			"app": map[string]interface{}{
+				"image": "app:v1",
+				"tls":   map[string]interface{}{"secret": "app-tls", "enabled": true},
+			},
+			"keep": "kept",
+		},
+	}
+
+	override := &Environment{
+		Values: map[string]interface{}{
+			"ingress": nil,
+			"app": map[string]interface{}{
+				"tls":     map[string]interface{}{"secret": nil},
+				"missing": nil,
+			},
+		},
+	}
+
+	merged, err := inherited.Merge(override)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app": map[string]interface{}{
+			"image": "app:v1",
+			"tls":   map[string]interface{}{"enabled": true},
+		},
+		"keep": "kept",
+	}
+
+	if !reflect.DeepEqual(merged.Values, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, merged.Values)
+	}
+
+	if _, ok := inherited.Values["ingress"]; !ok {
+		t.Errorf("inherited environment must not be modified: %v", inherited.Values)
+	}
+}
+
+func TestEnvironment_Merge_KeepsOther(t *testing.T) {
+	inherited := &Environment{
+		Values: map[string]interface{}{"keep": "kept"},
+	}
+
+	override := &Environment{
+		Values: map[string]interface{}{
+			"app": map[string]interface{}{"image": "app:v2", "tls": nil},
+		},
+	}
+
+	if _, err := inherited.Merge(override); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app": map[string]interface{}{"image": "app:v2", "tls": nil},
+	}
+
+	if !reflect.DeepEqual(override.Values, expected) {
+		t.Errorf("other environment must not be modified: expected=%v, got=%v", expected, override.Values)
+	}
+}
+
+func TestDeleteNulls_NonStringKeys(t *testing.T) {
+	merged := map[string]interface{}{
+		"ports": map[interface{}]interface{}{80: "http", 443: "https"},
+		"app":   map[string]interface{}{"image": "app:v1", "tls": true},
+	}
+
+	overrides := map[interface{}]interface{}{
+		"ports": map[interface{}]interface{}{443: nil},
+		"app":   map[interface{}]interface{}{"tls": nil},
+	}
+
+	deleteNulls(merged, overrides)
+
+	expected := map[string]interface{}{
+		"ports": map[interface{}]interface{}{80: "http"},
+		"app":   map[string]interface{}{"image": "app:v1"},
+	}
+
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("unexpected values: expected=%v, got=%v", expected, merged)
+	}
+}
@@ -0,0 +1,19 @@
+package helmexec
+
+import (
+	"regexp"
+)
+
+var (
+	// ansiEscapePattern matches the color codes helm-diff prints unless `--no-color` is given
+	ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+	// diffHeaderPattern matches the header helm-diff prints for each resource with changes, like
+	// `default, web, Deployment (apps) has changed:`
+	diffHeaderPattern = regexp.MustCompile(`(?m)^\S.*, .* has (changed|been added|been removed):\s*$`)
+)
+
+// countDiffChanges returns the number of the resources added, removed or changed in the helm-diff output
+func countDiffChanges(out []byte) int {
+	return len(diffHeaderPattern.FindAll(ansiEscapePattern.ReplaceAll(out, nil), -1))
+}
@@ -68,6 +68,17 @@ func (helm *execer) SetHelmBinary(bin string) {
 	helm.helmBinary = bin
 }
 
+func (helm *execer) WithHelmBinary(bin string) Interface {
+	return &execer{
+		helmBinary:       bin,
+		runner:           helm.runner,
+		logger:           helm.logger,
+		kubeContext:      helm.kubeContext,
+		extra:            helm.extra,
+		decryptedSecrets: make(map[string]*decryptedSecret),
+	}
+}
+
 func (helm *execer) AddRepo(name, repository, cafile, certfile, keyfile, username, password string) error {
 	var args []string
 	args = append(args, "repo", "add", name, repository)
@@ -242,7 +253,7 @@ func (helm *execer) DiffRelease(context HelmContext, name, chart string, flags .
 		case ExitError:
 			if e.ExitStatus() == 2 {
 				helm.write(out)
-				return err
+				return DiffError{ExitError: e, Changes: countDiffChanges(out)}
 			}
 		}
 	} else {
@@ -274,6 +285,26 @@ func (helm *execer) DeleteRelease(context HelmContext, name string, flags ...str
 	return err
 }
 
+func (helm *execer) DeleteReleases(context HelmContext, names []string, flags ...string) error {
+	helm.logger.Infof("Deleting %v", strings.Join(names, ", "))
+	preArgs := context.GetTillerlessArgs(helm.helmBinary)
+	env := context.getTillerlessEnv()
+	out, err := helm.exec(append(append(append(preArgs, "delete"), names...), flags...), env)
+	helm.write(out)
+	return err
+}
+
+// RollbackRelease rolls back the release to its previous revision
+func (helm *execer) RollbackRelease(context HelmContext, name string, flags ...string) error {
+	helm.logger.Infof("Rolling back %v", name)
+	preArgs := context.GetTillerlessArgs(helm.helmBinary)
+	env := context.getTillerlessEnv()
+	// Revision 0 is the previous revision
+	out, err := helm.exec(append(append(preArgs, "rollback", name, "0"), flags...), env)
+	helm.write(out)
+	return err
+}
+
 func (helm *execer) TestRelease(context HelmContext, name string, flags ...string) error {
 	helm.logger.Infof("Testing %v", name)
 	preArgs := context.GetTillerlessArgs(helm.helmBinary)
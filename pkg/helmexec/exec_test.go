@@ -20,7 +20,7 @@ type mockRunner struct {
 }
 
 func (mock *mockRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
-	return []byte{}, nil
+	return mock.output, mock.err
 }
 
 func MockExecer(logger *zap.SugaredLogger, kubeContext string) *execer {
@@ -277,6 +277,37 @@ exec: helm diff upgrade --reset-values --allow-unreleased release chart --kube-c
 	}
 }
 
+func Test_DiffRelease_Changes(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	output := "\x1b[33mdefault, web, Deployment (apps) has changed:\x1b[0m\n" +
+		"-   replicas: 1\n" +
+		"+   replicas: 2\n" +
+		"default, web, Service (v1) has been added:\n" +
+		"+ kind: Service\n" +
+		"default, web-config, ConfigMap (v1) has been removed:\n" +
+		"- kind: ConfigMap\n"
+	helm := New(logger, "dev", &mockRunner{output: []byte(output), err: newExitError("helm", 2, "")})
+
+	err := helm.DiffRelease(HelmContext{}, "release", "chart", "--detailed-exitcode")
+	diffErr, ok := err.(DiffError)
+	if !ok {
+		t.Fatalf("unexpected error: expected DiffError, got %T: %v", err, err)
+	}
+	if diffErr.ExitStatus() != 2 {
+		t.Errorf("unexpected exit status: expected 2, got %d", diffErr.ExitStatus())
+	}
+	if diffErr.Changes != 3 {
+		t.Errorf("unexpected number of changes: expected 3, got %d", diffErr.Changes)
+	}
+
+	helm = New(logger, "dev", &mockRunner{err: newExitError("helm", 1, "failed")})
+	err = helm.DiffRelease(HelmContext{}, "release", "chart", "--detailed-exitcode")
+	if _, ok := err.(ExitError); !ok {
+		t.Errorf("unexpected error: expected ExitError, got %T: %v", err, err)
+	}
+}
+
 func Test_DiffReleaseTillerless(t *testing.T) {
 	var buffer bytes.Buffer
 	logger := NewLogger(&buffer, "debug")
@@ -317,6 +348,32 @@ exec: helm delete release --purge --kube-context dev:
 		t.Errorf("helmexec.DeleteRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
 	}
 }
+func Test_RollbackRelease(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	helm.RollbackRelease(HelmContext{}, "release", "--namespace", "ns")
+	expected := `Rolling back release
+exec: helm rollback release 0 --namespace ns --kube-context dev
+exec: helm rollback release 0 --namespace ns --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.RollbackRelease()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
+func Test_DeleteReleases(t *testing.T) {
+	var buffer bytes.Buffer
+	logger := NewLogger(&buffer, "debug")
+	helm := MockExecer(logger, "dev")
+	helm.DeleteReleases(HelmContext{}, []string{"release1", "release2"}, "--purge")
+	expected := `Deleting release1, release2
+exec: helm delete release1 release2 --purge --kube-context dev
+exec: helm delete release1 release2 --purge --kube-context dev: 
+`
+	if buffer.String() != expected {
+		t.Errorf("helmexec.DeleteReleases()\nactual = %v\nexpect = %v", buffer.String(), expected)
+	}
+}
 
 func Test_TestRelease(t *testing.T) {
 	var buffer bytes.Buffer
@@ -34,3 +34,12 @@ func (e ExitError) Error() string {
 func (e ExitError) ExitStatus() int {
 	return e.exitStatus
 }
+
+// DiffError is returned by DiffRelease when helm-diff run with `--detailed-exitcode` found changes, which is an ExitError
+// with the exit status 2 along with the number of the resources changed
+type DiffError struct {
+	ExitError
+
+	// Changes is the number of the resources added, removed or changed. It is zero when the diff output was not recognized
+	Changes int
+}
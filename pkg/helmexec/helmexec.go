@@ -4,6 +4,8 @@ package helmexec
 type Interface interface {
 	SetExtraArgs(args ...string)
 	SetHelmBinary(bin string)
+	// WithHelmBinary returns an Interface that runs the helm binary instead, with the same settings as this one
+	WithHelmBinary(bin string) Interface
 
 	AddRepo(name, repository, cafile, certfile, keyfile, username, password string) error
 	UpdateRepo() error
@@ -16,6 +18,8 @@ type Interface interface {
 	Lint(name, chart string, flags ...string) error
 	ReleaseStatus(context HelmContext, name string, flags ...string) error
 	DeleteRelease(context HelmContext, name string, flags ...string) error
+	DeleteReleases(context HelmContext, names []string, flags ...string) error
+	RollbackRelease(context HelmContext, name string, flags ...string) error
 	TestRelease(context HelmContext, name string, flags ...string) error
 	List(context HelmContext, filter string, flags ...string) (string, error)
 	DecryptSecret(context HelmContext, name string, flags ...string) (string, error)
@@ -0,0 +1,150 @@
+package helmexec
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// RedactedMask replaces the secrets in the redacted logs
+const RedactedMask = "***"
+
+// minRedactedLength is the minimum length of the secrets to be redacted.
+// Shorter ones, like `1` and `true`, would mask unrelated parts of every log rather than the secrets.
+const minRedactedLength = 4
+
+// Redactor masks known secrets, like the values resolved via vals, and the strings matching its patterns in logs.
+// Secrets are added while running, so that a log emitted after a secret is resolved never contains the secret.
+type Redactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]struct{}
+	patterns []*regexp.Regexp
+	replacer *strings.Replacer
+}
+
+// NewRedactor returns a Redactor masking the strings matching any of the regular expressions, in addition to the secrets added later
+func NewRedactor(patterns ...string) (*Redactor, error) {
+	r := &Redactor{secrets: map[string]struct{}{}}
+
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+// Add adds the secrets to be masked
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range secrets {
+		if len(s) < minRedactedLength {
+			continue
+		}
+		if _, ok := r.secrets[s]; ok {
+			continue
+		}
+		r.secrets[s] = struct{}{}
+		r.replacer = nil
+	}
+}
+
+// Redact returns the string with the secrets and the strings matching the patterns masked
+func (r *Redactor) Redact(s string) string {
+	if r == nil {
+		return s
+	}
+
+	r.mu.RLock()
+	replacer := r.replacer
+	r.mu.RUnlock()
+
+	if replacer == nil {
+		replacer = r.buildReplacer()
+	}
+
+	s = replacer.Replace(s)
+
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, RedactedMask)
+	}
+
+	return s
+}
+
+func (r *Redactor) buildReplacer() *strings.Replacer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.replacer != nil {
+		return r.replacer
+	}
+
+	// Longer secrets go first, so that a secret containing another one is masked as a whole
+	secrets := make([]string, 0, len(r.secrets))
+	for s := range r.secrets {
+		secrets = append(secrets, s)
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		if len(secrets[i]) != len(secrets[j]) {
+			return len(secrets[i]) > len(secrets[j])
+		}
+		return secrets[i] < secrets[j]
+	})
+
+	oldnew := make([]string, 0, len(secrets)*2)
+	for _, s := range secrets {
+		oldnew = append(oldnew, s, RedactedMask)
+	}
+	r.replacer = strings.NewReplacer(oldnew...)
+
+	return r.replacer
+}
+
+// WrapLogger returns the logger redacting the messages and the string fields of every log
+func (r *Redactor) WrapLogger(logger *zap.SugaredLogger) *zap.SugaredLogger {
+	return logger.Desugar().WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: core, redactor: r}
+	})).Sugar()
+}
+
+type redactingCore struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.redactFields(fields)), redactor: c.redactor}
+}
+
+func (c *redactingCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactingCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.redactor.Redact(ent.Message)
+	return c.Core.Write(ent, c.redactFields(fields))
+}
+
+func (c *redactingCore) redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		if f.Type == zapcore.StringType {
+			f.String = c.redactor.Redact(f.String)
+		}
+		redacted[i] = f
+	}
+	return redacted
+}
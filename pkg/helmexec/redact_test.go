@@ -0,0 +1,39 @@
+package helmexec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(`token-[0-9a-f]+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buffer bytes.Buffer
+	logger := r.WrapLogger(NewLogger(&buffer, "debug"))
+
+	r.Add("s3cr3t", "s3cr3t-suffixed", "yes")
+
+	logger.Debugf("merged environment: password=%s, extended=%s, flag=%s, auth=%s", "s3cr3t", "s3cr3t-suffixed", "yes", "token-abc123")
+
+	expected := "merged environment: password=***, extended=***, flag=yes, auth=***\n"
+	if buffer.String() != expected {
+		t.Errorf("unexpected log: expected=%q, got=%q", expected, buffer.String())
+	}
+
+	buffer.Reset()
+	logger.Infow("resolved", "value", "s3cr3t")
+
+	expected = "resolved\t{\"value\": \"***\"}\n"
+	if buffer.String() != expected {
+		t.Errorf("unexpected log: expected=%q, got=%q", expected, buffer.String())
+	}
+}
+
+func TestNewRedactor_InvalidPattern(t *testing.T) {
+	if _, err := NewRedactor(`(`); err == nil {
+		t.Error("expected error but got none")
+	}
+}
@@ -1,6 +1,10 @@
 package maputil
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func CastKeysToStrings(s interface{}) (map[string]interface{}, error) {
 	new := map[string]interface{}{}
@@ -60,7 +64,7 @@ func recursivelyStringifyMapKey(v interface{}) (interface{}, error) {
 	return casted_v, nil
 }
 
-func Set(m map[string]interface{}, key []string, value string) map[string]interface{} {
+func Set(m map[string]interface{}, key []string, value interface{}) map[string]interface{} {
 	if len(key) == 0 {
 		panic(fmt.Errorf("bug: unexpected length of key: %d", len(key)))
 	}
@@ -89,3 +93,141 @@ func Set(m map[string]interface{}, key []string, value string) map[string]interf
 
 	return m
 }
+
+// SetPath sets the value at the path in the map, creating the intermediate maps and lists as needed.
+//
+// The path is a dotted key that can contain indices of lists, like `hosts[1].name`. An index must be less than or equal to
+// the length of the list, so that items are either updated or appended without leaving gaps.
+// It fails when the path traverses a value of another type, like a map via an index or a list via a key.
+func SetPath(m map[string]interface{}, path string, value interface{}) error {
+	elems, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = setPath(m, elems, value, "")
+	if err != nil {
+		return fmt.Errorf("failed setting %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// parsePath splits the path into the keys of maps and the indices of lists, like "a", 1 and "b" for `a[1].b`
+func parsePath(path string) ([]interface{}, error) {
+	var elems []interface{}
+
+	for _, k := range strings.Split(path, ".") {
+		key := k
+		var indices []interface{}
+		if i := strings.Index(k, "["); i >= 0 {
+			key = k[:i]
+			rest := k[i:]
+			for rest != "" {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("malformed path %s: expected an index like [0] after %q", path, key)
+				}
+				idx, err := strconv.Atoi(rest[1:end])
+				if err != nil || idx < 0 {
+					return nil, fmt.Errorf("malformed path %s: index %q must be a non-negative integer", path, rest[1:end])
+				}
+				indices = append(indices, idx)
+				rest = rest[end+1:]
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("malformed path %s: empty key", path)
+		}
+		elems = append(elems, key)
+		elems = append(elems, indices...)
+	}
+
+	return elems, nil
+}
+
+func setPath(current interface{}, path []interface{}, value interface{}, at string) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	switch p := path[0].(type) {
+	case string:
+		var m map[string]interface{}
+		switch c := current.(type) {
+		case nil:
+			m = map[string]interface{}{}
+		case map[string]interface{}:
+			m = c
+		default:
+			return nil, fmt.Errorf("%s is %T, not a map to set the key %q in", describePath(at), c, p)
+		}
+		v, err := setPath(m[p], path[1:], value, joinPath(at, p))
+		if err != nil {
+			return nil, err
+		}
+		m[p] = v
+		return m, nil
+	case int:
+		var l []interface{}
+		switch c := current.(type) {
+		case nil:
+		case []interface{}:
+			l = c
+		default:
+			return nil, fmt.Errorf("%s is %T, not a list to set the index %d in", describePath(at), c, p)
+		}
+		if p > len(l) {
+			return nil, fmt.Errorf("index %d of %s is out of range: it must be %d or less as the list has %d item(s)", p, describePath(at), len(l), len(l))
+		}
+		if p == len(l) {
+			l = append(l, nil)
+		}
+		v, err := setPath(l[p], path[1:], value, fmt.Sprintf("%s[%d]", at, p))
+		if err != nil {
+			return nil, err
+		}
+		l[p] = v
+		return l, nil
+	}
+
+	panic(fmt.Errorf("bug: unexpected path element: %v(%T)", path[0], path[0]))
+}
+
+func joinPath(at, key string) string {
+	if at == "" {
+		return key
+	}
+	return at + "." + key
+}
+
+func describePath(at string) string {
+	if at == "" {
+		return "the root"
+	}
+	return at
+}
+
+// ParseValue converts the string value given on the command-line to a boolean, an integer or nil when it looks like one,
+// in the same way as helm's `--set` does. Otherwise it returns the string as is.
+// Integers with leading zeros are kept as strings, so that values like `007` are not mangled.
+func ParseValue(s string) interface{} {
+	switch {
+	case strings.EqualFold(s, "true"):
+		return true
+	case strings.EqualFold(s, "false"):
+		return false
+	case strings.EqualFold(s, "null"):
+		return nil
+	case s == "0":
+		return int64(0)
+	case len(s) > 1 && s[0] == '0':
+		return s
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+
+	return s
+}
@@ -1,6 +1,9 @@
 package maputil
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestMapUtil_StrKeys(t *testing.T) {
 	m := map[string]interface{}{
@@ -59,3 +62,137 @@ func TestMapUtil_IFKeys(t *testing.T) {
 		t.Errorf("unexpected c: expected=C, got=%s", c)
 	}
 }
+
+func TestMapUtil_ParseValue(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected interface{}
+	}{
+		{in: "123", expected: int64(123)},
+		{in: "-1", expected: int64(-1)},
+		{in: "0", expected: int64(0)},
+		{in: "007", expected: "007"},
+		{in: "1.5", expected: "1.5"},
+		{in: "true", expected: true},
+		{in: "FALSE", expected: false},
+		{in: "null", expected: nil},
+		{in: "", expected: ""},
+		{in: "foo", expected: "foo"},
+	}
+
+	for _, tt := range tests {
+		if actual := ParseValue(tt.in); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("unexpected value for %q: expected=%v(%T), got=%v(%T)", tt.in, tt.expected, tt.expected, actual, actual)
+		}
+	}
+}
+
+func TestMapUtil_SetTypedValue(t *testing.T) {
+	m := Set(map[string]interface{}{}, []string{"a", "b"}, ParseValue("1"))
+	m = Set(m, []string{"a", "c"}, "1")
+
+	expected := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": int64(1),
+			"c": "1",
+		},
+	}
+
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("unexpected map: expected=%v, got=%v", expected, m)
+	}
+}
+
+func TestMapUtil_SetPath(t *testing.T) {
+	m := map[string]interface{}{}
+	sets := []struct {
+		path  string
+		value interface{}
+	}{
+		{"app.hosts[0].name", "a.example.com"},
+		{"app.hosts[0].tls", true},
+		{"app.hosts[1].name", "b.example.com"},
+		{"app.ports[0]", int64(80)},
+		{"app.ports[1]", int64(443)},
+		{"app.ports[0]", int64(8080)},
+		{"matrix[0][0]", "x"},
+		{"matrix[0][1]", "y"},
+		{"environments.prod.values.replicas", int64(5)},
+	}
+	for _, s := range sets {
+		if err := SetPath(m, s.path, s.value); err != nil {
+			t.Fatalf("unexpected error setting %s: %v", s.path, err)
+		}
+	}
+
+	expected := map[string]interface{}{
+		"app": map[string]interface{}{
+			"hosts": []interface{}{
+				map[string]interface{}{"name": "a.example.com", "tls": true},
+				map[string]interface{}{"name": "b.example.com"},
+			},
+			"ports": []interface{}{int64(8080), int64(443)},
+		},
+		"matrix": []interface{}{[]interface{}{"x", "y"}},
+		"environments": map[string]interface{}{
+			"prod": map[string]interface{}{
+				"values": map[string]interface{}{"replicas": int64(5)},
+			},
+		},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("unexpected map: expected=%v, got=%v", expected, m)
+	}
+}
+
+func TestMapUtil_SetPath_Errors(t *testing.T) {
+	tests := []struct {
+		existing map[string]interface{}
+		path     string
+		expected string
+	}{
+		{
+			existing: map[string]interface{}{"hosts": []interface{}{"a"}},
+			path:     "hosts[2]",
+			expected: "failed setting hosts[2]: index 2 of hosts is out of range: it must be 1 or less as the list has 1 item(s)",
+		},
+		{
+			existing: map[string]interface{}{"app": map[string]interface{}{"name": "a"}},
+			path:     "app[0]",
+			expected: "failed setting app[0]: app is map[string]interface {}, not a list to set the index 0 in",
+		},
+		{
+			existing: map[string]interface{}{"hosts": []interface{}{"a"}},
+			path:     "hosts.name",
+			expected: `failed setting hosts.name: hosts is []interface {}, not a map to set the key "name" in`,
+		},
+		{
+			existing: map[string]interface{}{"hosts": []interface{}{"a"}},
+			path:     "hosts[0].name",
+			expected: `failed setting hosts[0].name: hosts[0] is string, not a map to set the key "name" in`,
+		},
+		{
+			existing: map[string]interface{}{},
+			path:     "hosts[-1]",
+			expected: `malformed path hosts[-1]: index "-1" must be a non-negative integer`,
+		},
+		{
+			existing: map[string]interface{}{},
+			path:     "hosts[0",
+			expected: `malformed path hosts[0: expected an index like [0] after "hosts"`,
+		},
+		{
+			existing: map[string]interface{}{},
+			path:     "app..name",
+			expected: "malformed path app..name: empty key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			err := SetPath(tt.existing, tt.path, "v")
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("unexpected error: expected=%s, got=%v", tt.expected, err)
+			}
+		})
+	}
+}
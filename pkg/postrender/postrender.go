@@ -0,0 +1,238 @@
+// Package postrender is the post-renderer built into helmfile, which helm runs as `helmfile post-render` via `--post-renderer`
+// to stamp the labels and annotations common to all the releases onto every resource rendered from the charts.
+package postrender
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Command is the helmfile sub-command running the built-in post-renderer
+const Command = "post-render"
+
+// Args returns the arguments to the helmfile sub-command, which stamps the labels and annotations onto the output of
+// the post-renderer command `then` when given, or onto the manifests rendered by helm otherwise
+func Args(labels, annotations map[string]string, then string) []string {
+	args := []string{Command}
+
+	for _, k := range sortedKeys(labels) {
+		args = append(args, fmt.Sprintf("--label=%s=%s", k, labels[k]))
+	}
+
+	for _, k := range sortedKeys(annotations) {
+		args = append(args, fmt.Sprintf("--annotation=%s=%s", k, annotations[k]))
+	}
+
+	if then != "" {
+		args = append(args, "--then="+then)
+	}
+
+	return args
+}
+
+// ParsePairs parses the `KEY=VALUE` pairs given to the sub-command via `--label` or `--annotation`
+func ParsePairs(pairs []string) (map[string]string, error) {
+	m := map[string]string{}
+
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid pair %q: it must be in the form of KEY=VALUE", p)
+		}
+		m[kv[0]] = kv[1]
+	}
+
+	return m, nil
+}
+
+// Run reads the manifests rendered by helm from in, runs the post-renderer command `then` on them when given,
+// and writes them stamped with the labels and annotations to out
+func Run(in io.Reader, out io.Writer, labels, annotations map[string]string, then string) error {
+	manifests, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	if then != "" {
+		var stdout bytes.Buffer
+
+		cmd := exec.Command(then)
+		cmd.Stdin = bytes.NewReader(manifests)
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed running post-renderer %s: %v", then, err)
+		}
+
+		manifests = stdout.Bytes()
+	}
+
+	stamped, err := Stamp(manifests, labels, annotations)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(stamped)
+
+	return err
+}
+
+// Stamp adds the labels and annotations to the metadata of every resource in the manifests. A label or an annotation
+// already set on a resource is kept as is, so that the ones set by charts and users are never clobbered.
+//
+// The comments preceding each resource, like `# Source: mychart/templates/deployment.yaml`, are kept, whereas the comments
+// within resources are dropped, as the resources are re-serialized.
+func Stamp(manifests []byte, labels, annotations map[string]string) ([]byte, error) {
+	if len(labels) == 0 && len(annotations) == 0 {
+		return manifests, nil
+	}
+
+	var out bytes.Buffer
+
+	for i, doc := range splitDocuments(string(manifests)) {
+		if i > 0 {
+			out.WriteString("---\n")
+		}
+
+		stamped, err := stampDocument(doc, labels, annotations)
+		if err != nil {
+			return nil, fmt.Errorf("failed stamping resource %d: %v", i, err)
+		}
+
+		out.WriteString(stamped)
+	}
+
+	return out.Bytes(), nil
+}
+
+// splitDocuments splits the YAML stream by the `---` lines
+func splitDocuments(s string) []string {
+	var docs []string
+	var doc strings.Builder
+
+	for _, line := range strings.SplitAfter(s, "\n") {
+		if strings.TrimRight(line, " \t\r\n") == "---" {
+			docs = append(docs, doc.String())
+			doc.Reset()
+			continue
+		}
+		doc.WriteString(line)
+	}
+
+	return append(docs, doc.String())
+}
+
+func stampDocument(doc string, labels, annotations map[string]string) (string, error) {
+	// The leading comments and blank lines are kept as they are
+	var header strings.Builder
+	body := doc
+	for body != "" {
+		end := strings.Index(body, "\n") + 1
+		if end == 0 {
+			end = len(body)
+		}
+		line := strings.TrimSpace(body[:end])
+		if line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		header.WriteString(body[:end])
+		body = body[end:]
+	}
+
+	if body == "" {
+		return doc, nil
+	}
+
+	var resource yaml.MapSlice
+	if err := yaml.Unmarshal([]byte(body), &resource); err != nil {
+		return "", err
+	}
+
+	i := indexOf(resource, "metadata")
+	if i < 0 || indexOf(resource, "kind") < 0 {
+		return doc, nil
+	}
+
+	metadata, ok := resource[i].Value.(yaml.MapSlice)
+	if !ok {
+		return doc, nil
+	}
+
+	metadata, err := stampField(metadata, "labels", labels)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err = stampField(metadata, "annotations", annotations)
+	if err != nil {
+		return "", err
+	}
+
+	resource[i].Value = metadata
+
+	bs, err := yaml.Marshal(resource)
+	if err != nil {
+		return "", err
+	}
+
+	return header.String() + string(bs), nil
+}
+
+// stampField adds the key-value pairs missing in the field of the metadata, like `labels`
+func stampField(metadata yaml.MapSlice, field string, pairs map[string]string) (yaml.MapSlice, error) {
+	if len(pairs) == 0 {
+		return metadata, nil
+	}
+
+	var current yaml.MapSlice
+
+	i := indexOf(metadata, field)
+	if i >= 0 && metadata[i].Value != nil {
+		m, ok := metadata[i].Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("unexpected type of metadata.%s: %T", field, metadata[i].Value)
+		}
+		current = m
+	}
+
+	for _, k := range sortedKeys(pairs) {
+		if indexOf(current, k) < 0 {
+			current = append(current, yaml.MapItem{Key: k, Value: pairs[k]})
+		}
+	}
+
+	if i < 0 {
+		return append(metadata, yaml.MapItem{Key: field, Value: current}), nil
+	}
+
+	metadata[i].Value = current
+
+	return metadata, nil
+}
+
+func indexOf(m yaml.MapSlice, key string) int {
+	for i, item := range m {
+		if k, ok := item.Key.(string); ok && k == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,141 @@
+package postrender
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStamp(t *testing.T) {
+	manifests := `---
+# Source: mychart/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  enabled: "true"
+---
+# Source: mychart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: myapp
+    team: payments
+  annotations:
+---
+# Source: mychart/templates/empty.yaml
+`
+
+	expected := `---
+# Source: mychart/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  labels:
+    managed-by: helmfile
+    team: platform
+  annotations:
+    deploy-id: "123"
+data:
+  enabled: "true"
+---
+# Source: mychart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: myapp
+    team: payments
+    managed-by: helmfile
+  annotations:
+    deploy-id: "123"
+---
+# Source: mychart/templates/empty.yaml
+`
+
+	labels := map[string]string{"managed-by": "helmfile", "team": "platform"}
+	annotations := map[string]string{"deploy-id": "123"}
+
+	actual, err := Stamp([]byte(manifests), labels, annotations)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if string(actual) != expected {
+		t.Errorf("unexpected manifests:\nexpected:\n%s\nactual:\n%s", expected, actual)
+	}
+
+	unchanged, err := Stamp([]byte(manifests), nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(unchanged) != manifests {
+		t.Errorf("manifests must be unchanged without labels and annotations:\n%s", unchanged)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	labels := map[string]string{"team": "platform", "managed-by": "helmfile"}
+	annotations := map[string]string{"deploy-id": "a=b"}
+
+	args := Args(labels, annotations, "./kustomize.sh")
+
+	expected := []string{Command, "--label=managed-by=helmfile", "--label=team=platform", "--annotation=deploy-id=a=b", "--then=./kustomize.sh"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Fatalf("unexpected args: expected=%v, actual=%v", expected, args)
+	}
+
+	parsed, err := ParsePairs([]string{"managed-by=helmfile", "team=platform"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, labels) {
+		t.Errorf("unexpected labels: expected=%v, actual=%v", labels, parsed)
+	}
+
+	parsed, err = ParsePairs([]string{"deploy-id=a=b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, annotations) {
+		t.Errorf("unexpected annotations: expected=%v, actual=%v", annotations, parsed)
+	}
+
+	if _, err := ParsePairs([]string{"=value"}); err == nil {
+		t.Errorf("expected error for a pair without key")
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmfile-postrender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	then := filepath.Join(dir, "rename.sh")
+	if err := ioutil.WriteFile(then, []byte("#!/bin/sh\nsed 's/name: app/name: renamed/'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	in := strings.NewReader("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n")
+
+	var out bytes.Buffer
+	if err := Run(in, &out, map[string]string{"managed-by": "helmfile"}, nil, then); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: renamed\n  labels:\n    managed-by: helmfile\n"
+	if out.String() != expected {
+		t.Errorf("unexpected output:\nexpected:\n%s\nactual:\n%s", expected, out.String())
+	}
+}
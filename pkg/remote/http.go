@@ -0,0 +1,241 @@
+package remote
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IsHTTPURL reports whether the path to a helmfile is a plain HTTP(S) URL to be fetched by HTTP,
+// rather than a go-getter URL like `git::https://github.com/org/repo@path/to/helmfile.yaml`
+func IsHTTPURL(path string) bool {
+	return (strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")) && !IsRemote(path)
+}
+
+// HTTP fetches helmfiles hosted on HTTP(S) servers, along with the files they include relatively, like bases and values files.
+//
+// Each file is fetched into its mirror under Dir, at `<Dir>/<scheme>/<host>/<path>`, so that the loader resolves relative paths
+// in a fetched helmfile against the mirror exactly like for a local helmfile. The functions wrapped by ReadFileFunc, FileExistsFunc
+// and GlobFunc fetch a file under Dir from its URL on the first access in the run, before accessing the mirror.
+// As HTTP has no way to list files, a glob under Dir fails unless it matches a single file literally.
+type HTTP struct {
+	Logger *zap.SugaredLogger
+
+	// Dir is the absolute path to the directory to mirror the fetched files into
+	Dir string
+
+	// Header is added to every request, like `Authorization` for private servers
+	Header http.Header
+
+	// CacheTTL is how long a fetched file is reused across runs without being fetched again.
+	// When 0, every file is fetched once per run
+	CacheTTL time.Duration
+
+	Client *http.Client
+
+	// abs makes paths absolute to tell whether they are under Dir
+	abs func(string) (string, error)
+	now func() time.Time
+
+	mu sync.Mutex
+	// fetched is whether each file under Dir has been found on its server in this run, or the error fetching it
+	fetched map[string]fetchResult
+}
+
+type fetchResult struct {
+	found bool
+	err   error
+}
+
+// NewHTTP returns HTTP mirroring the fetched files into `<home>/.helmfile/cache/http`.
+// Each header is in the form of `Name: value`, where environment variables like `$TOKEN` are expanded in the value,
+// so that credentials are not given on the command-line.
+func NewHTTP(logger *zap.SugaredLogger, home string, headers []string, cacheTTL time.Duration, abs func(string) (string, error)) (*HTTP, error) {
+	header := http.Header{}
+	for _, h := range headers {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid http header %q: it must be in the form of `Name: value`", h)
+		}
+		header.Add(strings.TrimSpace(kv[0]), os.ExpandEnv(strings.TrimSpace(kv[1])))
+	}
+
+	dir, err := abs(filepath.Join(home, DefaultCacheDir, "http"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &HTTP{
+		Logger:   logger,
+		Dir:      dir,
+		Header:   header,
+		CacheTTL: cacheTTL,
+		Client:   &http.Client{Timeout: 30 * time.Second},
+		abs:      abs,
+		now:      time.Now,
+		fetched:  map[string]fetchResult{},
+	}, nil
+}
+
+// Locate fetches the file at the URL, like a helmfile, and returns the path to its mirror
+func (h *HTTP) Locate(url string) (string, error) {
+	if strings.Contains(url, "?") || strings.Contains(url, "#") {
+		return "", fmt.Errorf("unsupported url %s: files fetched by http can't have queries or fragments", url)
+	}
+
+	scheme := strings.SplitN(url, "://", 2)
+	path := filepath.Join(h.Dir, scheme[0], filepath.FromSlash(scheme[1]))
+
+	found, err := h.fetch(path)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("%s is not found", url)
+	}
+
+	return path, nil
+}
+
+// ReadFileFunc returns readFile fetching the file before reading it when it is under Dir
+func (h *HTTP) ReadFileFunc(readFile func(string) ([]byte, error)) func(string) ([]byte, error) {
+	return func(path string) ([]byte, error) {
+		if _, err := h.fetch(path); err != nil {
+			return nil, err
+		}
+		return readFile(path)
+	}
+}
+
+// FileExistsFunc returns fileExists fetching the file before checking it when it is under Dir
+func (h *HTTP) FileExistsFunc(fileExists func(string) (bool, error)) func(string) (bool, error) {
+	return func(path string) (bool, error) {
+		if _, err := h.fetch(path); err != nil {
+			return false, err
+		}
+		return fileExists(path)
+	}
+}
+
+// GlobFunc returns glob fetching the file before matching it when the pattern is under Dir.
+// It fails when such a pattern contains any of the meta characters, as files on HTTP servers can't be listed.
+func (h *HTTP) GlobFunc(glob func(string) ([]string, error)) func(string) ([]string, error) {
+	return func(pattern string) ([]string, error) {
+		if _, ok := h.url(pattern); ok && strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("glob %s is not supported in helmfiles fetched by http, as files on http servers can't be listed. please list the files one by one", pattern)
+		}
+		if _, err := h.fetch(pattern); err != nil {
+			return nil, err
+		}
+		return glob(pattern)
+	}
+}
+
+// url returns the URL of the file mirrored at the path, or false when the path is not under Dir
+func (h *HTTP) url(path string) (string, bool) {
+	abs, err := h.abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(h.Dir, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+
+	return parts[0] + "://" + parts[1], true
+}
+
+// fetch fetches the file mirrored at the path from its URL, unless it was fetched in this run or within CacheTTL.
+// It reports whether the file was found on the server, and does nothing for paths not under Dir.
+func (h *HTTP) fetch(path string) (bool, error) {
+	url, ok := h.url(path)
+	if !ok {
+		return false, nil
+	}
+
+	abs, _ := h.abs(path)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r, ok := h.fetched[abs]; ok {
+		return r.found, r.err
+	}
+
+	found, err := h.get(url, abs)
+	h.fetched[abs] = fetchResult{found: found, err: err}
+
+	return found, err
+}
+
+func (h *HTTP) get(url, dst string) (bool, error) {
+	// A directory in the mirror is created by fetching a file in it, and has nothing to fetch
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		return true, nil
+	}
+
+	if h.CacheTTL > 0 {
+		if info, err := os.Stat(dst); err == nil && h.now().Sub(info.ModTime()) < h.CacheTTL {
+			h.Logger.Debugf("reusing %s fetched from %s at %s", dst, url, info.ModTime())
+			return true, nil
+		}
+	}
+
+	h.Logger.Debugf("fetching %s to %s", url, dst)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	for k, vs := range h.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed fetching %s: %v", url, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		// Otherwise a file removed from the server would be read from the stale mirror
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return false, fmt.Errorf("failed fetching %s: %s", url, res.Status)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, fmt.Errorf("failed fetching %s: %v", url, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+
+	if err := ioutil.WriteFile(dst, body, 0644); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,130 @@
+package remote
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+func TestHTTP(t *testing.T) {
+	files := map[string]string{
+		"/helmfiles/helmfile.yaml": "bases:\n- base.yaml\n",
+		"/helmfiles/base.yaml":     "releases: []\n",
+	}
+
+	requests := map[string]int{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	home, err := ioutil.TempDir("", "helmfile-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	os.Setenv("HELMFILE_TEST_TOKEN", "secret")
+	defer os.Unsetenv("HELMFILE_TEST_TOKEN")
+
+	logger := helmexec.NewLogger(os.Stderr, "debug")
+
+	h, err := NewHTTP(logger, home, []string{"Authorization: Bearer $HELMFILE_TEST_TOKEN"}, 0, filepath.Abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := h.Locate(server.URL + "/helmfiles/helmfile.yaml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(path, filepath.Join(home, DefaultCacheDir, "http", "http")) {
+		t.Errorf("unexpected path: %s", path)
+	}
+
+	readFile := h.ReadFileFunc(ioutil.ReadFile)
+
+	// The base included relatively is fetched relative to the URL of the helmfile
+	for i := 0; i < 2; i++ {
+		bytes, err := readFile(filepath.Join(filepath.Dir(path), "base.yaml"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(bytes) != files["/helmfiles/base.yaml"] {
+			t.Errorf("unexpected content: %s", string(bytes))
+		}
+	}
+
+	fileExists := h.FileExistsFunc(func(path string) (bool, error) {
+		_, err := os.Stat(path)
+		return err == nil, nil
+	})
+	if exists, err := fileExists(filepath.Join(filepath.Dir(path), "missing.yaml")); err != nil || exists {
+		t.Errorf("unexpected result for missing file: exists=%v, err=%v", exists, err)
+	}
+
+	glob := h.GlobFunc(filepath.Glob)
+	if _, err := glob(filepath.Join(filepath.Dir(path), "*.yaml")); err == nil {
+		t.Errorf("expected glob to fail")
+	}
+
+	// Files outside the mirror are never fetched
+	local := filepath.Join(home, "local.yaml")
+	if err := ioutil.WriteFile(local, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, err := readFile(local); err != nil || string(bytes) != "local" {
+		t.Errorf("unexpected result for local file: content=%s, err=%v", string(bytes), err)
+	}
+
+	// Each file is fetched once per run
+	expected := map[string]int{
+		"/helmfiles/helmfile.yaml": 1,
+		"/helmfiles/base.yaml":     1,
+		"/helmfiles/missing.yaml":  1,
+	}
+	for p, n := range expected {
+		if requests[p] != n {
+			t.Errorf("unexpected number of requests for %s: expected=%d, got=%d", p, n, requests[p])
+		}
+	}
+
+	// Within the TTL, files fetched by the previous run are reused
+	cached, err := NewHTTP(logger, home, nil, time.Hour, filepath.Abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cached.Locate(server.URL + "/helmfiles/helmfile.yaml"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requests["/helmfiles/helmfile.yaml"] != 1 {
+		t.Errorf("unexpected number of requests: %d", requests["/helmfiles/helmfile.yaml"])
+	}
+
+	// Without the header, the server denies the request
+	uncached, err := NewHTTP(logger, home, nil, 0, filepath.Abs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uncached.Locate(server.URL + "/helmfiles/helmfile.yaml"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 const DefaultCacheDir = ".helmfile/cache"
@@ -31,6 +32,10 @@ type Remote struct {
 	ReadFile   func(string) ([]byte, error)
 	DirExists  func(string) bool
 	FileExists func(string) bool
+
+	// mu makes Fetch fetch one directory at a time, so that a directory is never fetched into the cache concurrently,
+	// like when the values files of releases processed concurrently refer to the same one
+	mu sync.Mutex
 }
 
 func (r *Remote) Unmarshal(src string, dst interface{}) error {
@@ -150,6 +155,9 @@ func Parse(goGetterSrc string) (*Source, error) {
 }
 
 func (r *Remote) Fetch(goGetterSrc string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	u, err := Parse(goGetterSrc)
 	if err != nil {
 		return "", err
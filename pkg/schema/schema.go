@@ -0,0 +1,335 @@
+// Package schema validates Kubernetes manifests offline against the OpenAPI v2 schema of the Kubernetes API, like the one
+// served by `kubectl get --raw /openapi/v2` or published as `api/openapi-spec/swagger.json` in the Kubernetes repository.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const refPrefix = "#/definitions/"
+
+// Schema is the definitions of the Kubernetes resources and their fields
+type Schema struct {
+	definitions map[string]*definition
+
+	// kinds maps the `GROUP/VERSION/KIND` of each resource, like `apps/v1/Deployment` or `/v1/ConfigMap`, to its definition
+	kinds map[string]*definition
+}
+
+type definition struct {
+	Type       string                 `json:"type"`
+	Format     string                 `json:"format"`
+	Ref        string                 `json:"$ref"`
+	Properties map[string]*definition `json:"properties"`
+	Required   []string               `json:"required"`
+	Items      *definition            `json:"items"`
+
+	// AdditionalProperties is either a boolean or the definition of the values of a map
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+
+	GroupVersionKinds []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+
+	additional    *definition
+	anyAdditional bool
+}
+
+// Violation is a field of a resource violating the schema
+type Violation struct {
+	// Resource is the KIND/NAME of the resource, like `Deployment/app`
+	Resource string `json:"resource"`
+	// Path is the path to the field, like `spec.template.spec.containers[0].image`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s: %s", v.Resource, v.Path, v.Message)
+}
+
+// Result is the outcome of validating manifests
+type Result struct {
+	// Resources is the number of the resources validated
+	Resources int
+
+	// Skipped is the `GROUP/VERSION/KIND` of the resources without definitions in the schema, like custom resources,
+	// which are never validated
+	Skipped []string
+
+	Violations []Violation
+}
+
+// Load reads the schema from the OpenAPI v2 document in JSON
+func Load(bs []byte) (*Schema, error) {
+	var doc struct {
+		Definitions map[string]*definition `json:"definitions"`
+	}
+
+	if err := json.Unmarshal(bs, &doc); err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI schema: %v", err)
+	}
+
+	if len(doc.Definitions) == 0 {
+		return nil, fmt.Errorf("failed to read OpenAPI schema: no definitions found")
+	}
+
+	s := &Schema{definitions: doc.Definitions, kinds: map[string]*definition{}}
+
+	var names []string
+	for name := range doc.Definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		d := doc.Definitions[name]
+
+		// Quantities like `cpu: 1` are written as numbers as well as strings
+		if strings.HasSuffix(name, "resource.Quantity") {
+			d.Format = "quantity"
+		}
+
+		for _, gvk := range d.GroupVersionKinds {
+			key := gvk.Group + "/" + gvk.Version + "/" + gvk.Kind
+			if _, ok := s.kinds[key]; !ok {
+				s.kinds[key] = d
+			}
+		}
+	}
+
+	for _, d := range doc.Definitions {
+		if err := d.init(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (d *definition) init() error {
+	if d == nil {
+		return nil
+	}
+
+	switch raw := bytes.TrimSpace(d.AdditionalProperties); {
+	case len(raw) == 0, string(raw) == "false":
+	case string(raw) == "true":
+		d.anyAdditional = true
+	default:
+		d.additional = &definition{}
+		if err := json.Unmarshal(raw, d.additional); err != nil {
+			return fmt.Errorf("failed to read OpenAPI schema: %v", err)
+		}
+	}
+
+	for _, p := range d.Properties {
+		if err := p.init(); err != nil {
+			return err
+		}
+	}
+
+	if err := d.Items.init(); err != nil {
+		return err
+	}
+
+	return d.additional.init()
+}
+
+// Validate validates every resource in the YAML stream of manifests, like the output of `helm template`
+func (s *Schema) Validate(manifests []byte) (*Result, error) {
+	result := &Result{}
+
+	skipped := map[string]bool{}
+
+	dec := yaml.NewDecoder(bytes.NewReader(manifests))
+	for {
+		var doc interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse manifests: %v", err)
+		}
+
+		resource, ok := doc.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+
+		apiVersion, _ := resource["apiVersion"].(string)
+		kind, _ := resource["kind"].(string)
+		if apiVersion == "" || kind == "" {
+			result.Violations = append(result.Violations, Violation{Resource: resourceName(resource), Path: ".", Message: "apiVersion and kind are required"})
+			continue
+		}
+
+		group, version := "", apiVersion
+		if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+			group, version = apiVersion[:i], apiVersion[i+1:]
+		}
+
+		key := group + "/" + version + "/" + kind
+
+		d, ok := s.kinds[key]
+		if !ok {
+			if !skipped[key] {
+				skipped[key] = true
+				result.Skipped = append(result.Skipped, key)
+			}
+			continue
+		}
+
+		result.Resources++
+
+		name := resourceName(resource)
+		s.validate(d, resource, "", func(path, msg string) {
+			result.Violations = append(result.Violations, Violation{Resource: name, Path: path, Message: msg})
+		})
+	}
+
+	return result, nil
+}
+
+func (s *Schema) resolve(d *definition) *definition {
+	for d != nil && d.Ref != "" {
+		d = s.definitions[strings.TrimPrefix(d.Ref, refPrefix)]
+	}
+	return d
+}
+
+func (s *Schema) validate(d *definition, v interface{}, path string, report func(path, msg string)) {
+	d = s.resolve(d)
+	if d == nil || v == nil {
+		// A field without its definition, or set to null, is never validated. The latter is treated as unset by the API server
+		return
+	}
+
+	typ := d.Type
+	if typ == "" && len(d.Properties) > 0 {
+		typ = "object"
+	}
+
+	switch typ {
+	case "object":
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			report(pathOrRoot(path), fmt.Sprintf("expected object, got %s", typeName(v)))
+			return
+		}
+
+		for _, r := range d.Required {
+			if _, ok := m[r]; !ok {
+				report(joinPath(path, r), "required field is missing")
+			}
+		}
+
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, fmt.Sprint(k))
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			e := m[k]
+			if p, ok := d.Properties[k]; ok {
+				s.validate(p, e, joinPath(path, k), report)
+			} else if d.additional != nil {
+				s.validate(d.additional, e, joinPath(path, k), report)
+			} else if len(d.Properties) > 0 && !d.anyAdditional {
+				report(joinPath(path, k), "unknown field")
+			}
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			report(pathOrRoot(path), fmt.Sprintf("expected array, got %s", typeName(v)))
+			return
+		}
+
+		for i, e := range items {
+			s.validate(d.Items, e, fmt.Sprintf("%s[%d]", path, i), report)
+		}
+	case "string":
+		switch v.(type) {
+		case string:
+		case int, int64, uint64, float64:
+			if d.Format != "int-or-string" && d.Format != "quantity" {
+				report(pathOrRoot(path), fmt.Sprintf("expected string, got %s", typeName(v)))
+			}
+		default:
+			report(pathOrRoot(path), fmt.Sprintf("expected string, got %s", typeName(v)))
+		}
+	case "integer":
+		switch v.(type) {
+		case int, int64, uint64:
+		default:
+			report(pathOrRoot(path), fmt.Sprintf("expected integer, got %s", typeName(v)))
+		}
+	case "number":
+		switch v.(type) {
+		case int, int64, uint64, float64:
+		default:
+			report(pathOrRoot(path), fmt.Sprintf("expected number, got %s", typeName(v)))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			report(pathOrRoot(path), fmt.Sprintf("expected boolean, got %s", typeName(v)))
+		}
+	}
+}
+
+func resourceName(resource map[interface{}]interface{}) string {
+	kind, _ := resource["kind"].(string)
+	if kind == "" {
+		kind = "unknown"
+	}
+
+	name := ""
+	if metadata, ok := resource["metadata"].(map[interface{}]interface{}); ok {
+		name, _ = metadata["name"].(string)
+	}
+
+	return kind + "/" + name
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func pathOrRoot(path string) string {
+	if path == "" {
+		return "."
+	}
+	return path
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case map[interface{}]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
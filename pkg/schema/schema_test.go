@@ -0,0 +1,148 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+  "definitions": {
+    "io.k8s.api.apps.v1.Deployment": {
+      "type": "object",
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"},
+        "spec": {"$ref": "#/definitions/io.k8s.api.apps.v1.DeploymentSpec"}
+      },
+      "x-kubernetes-group-version-kind": [{"group": "apps", "version": "v1", "kind": "Deployment"}]
+    },
+    "io.k8s.api.apps.v1.DeploymentSpec": {
+      "type": "object",
+      "required": ["template"],
+      "properties": {
+        "replicas": {"type": "integer", "format": "int32"},
+        "paused": {"type": "boolean"},
+        "template": {
+          "type": "object",
+          "properties": {
+            "spec": {
+              "type": "object",
+              "properties": {
+                "containers": {"type": "array", "items": {"$ref": "#/definitions/io.k8s.api.core.v1.Container"}}
+              }
+            }
+          }
+        }
+      }
+    },
+    "io.k8s.api.core.v1.Container": {
+      "type": "object",
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string"},
+        "image": {"type": "string"},
+        "port": {"$ref": "#/definitions/io.k8s.apimachinery.pkg.util.intstr.IntOrString"},
+        "resources": {
+          "type": "object",
+          "properties": {
+            "limits": {"type": "object", "additionalProperties": {"$ref": "#/definitions/io.k8s.apimachinery.pkg.api.resource.Quantity"}}
+          }
+        }
+      }
+    },
+    "io.k8s.api.core.v1.ConfigMap": {
+      "type": "object",
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"$ref": "#/definitions/io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta"},
+        "data": {"type": "object", "additionalProperties": {"type": "string"}}
+      },
+      "x-kubernetes-group-version-kind": [{"group": "", "version": "v1", "kind": "ConfigMap"}]
+    },
+    "io.k8s.apimachinery.pkg.apis.meta.v1.ObjectMeta": {
+      "type": "object",
+      "properties": {
+        "name": {"type": "string"},
+        "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+        "annotations": {"type": "object", "additionalProperties": true}
+      }
+    },
+    "io.k8s.apimachinery.pkg.util.intstr.IntOrString": {"type": "string", "format": "int-or-string"},
+    "io.k8s.apimachinery.pkg.api.resource.Quantity": {"type": "string"}
+  }
+}`
+
+func TestValidate(t *testing.T) {
+	s, err := Load([]byte(testSchema))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	manifests := `---
+# Source: mychart/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: myapp
+spec:
+  replicas: "3"
+  paused: null
+  template:
+    spec:
+      containers:
+      - image: myapp:1.0
+        port: 8080
+        resources:
+          limits:
+            cpu: 1
+            memory: 1Gi
+        imagePullPolicy: Always
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  enabled: true
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+---
+`
+
+	result, err := s.Validate([]byte(manifests))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := &Result{
+		Resources: 2,
+		Skipped:   []string{"example.com/v1/Widget"},
+		Violations: []Violation{
+			{Resource: "Deployment/app", Path: "spec.replicas", Message: "expected integer, got string"},
+			{Resource: "Deployment/app", Path: "spec.template.spec.containers[0].name", Message: "required field is missing"},
+			{Resource: "Deployment/app", Path: "spec.template.spec.containers[0].imagePullPolicy", Message: "unknown field"},
+			{Resource: "ConfigMap/config", Path: "data.enabled", Message: "expected string, got boolean"},
+		},
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("unexpected result:\nexpected=%+v\nactual=%+v", expected, result)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	if _, err := Load([]byte(`{"swagger": "2.0"}`)); err == nil {
+		t.Error("expected error for a schema without definitions")
+	}
+
+	if _, err := Load([]byte(`not json`)); err == nil {
+		t.Error("expected error for a malformed schema")
+	}
+}
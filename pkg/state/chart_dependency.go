@@ -53,6 +53,14 @@ type ChartLockedRequirements struct {
 	ResolvedDependencies []ResolvedChartDependency `yaml:"dependencies"`
 	Digest               string                    `yaml:"digest"`
 	Generated            string                    `yaml:"generated"`
+	// Releases is the resolved charts and versions of the releases keyed by [TILLER_NS/][NS/]NAME.
+	// Releases are pinned to them only when `--use-lock` is specified.
+	Releases map[string]LockedRelease `yaml:"releases,omitempty"`
+}
+
+type LockedRelease struct {
+	Chart   string `yaml:"chart"`
+	Version string `yaml:"version"`
 }
 
 func (d *UnresolvedDependencies) Add(chart, url, versionConstraint string) error {
@@ -91,7 +99,8 @@ func (d *UnresolvedDependencies) ToChartRequirements() *ChartRequirements {
 }
 
 type ResolvedDependencies struct {
-	deps map[string][]ResolvedChartDependency
+	deps     map[string][]ResolvedChartDependency
+	releases map[string]LockedRelease
 }
 
 func (d *ResolvedDependencies) add(dep ResolvedChartDependency) error {
@@ -145,15 +154,21 @@ func (st *HelmState) mergeLockedDependencies() (*HelmState, error) {
 		depMan.readFile = st.readFile
 	}
 
-	return resolveDependencies(st, depMan, unresolved)
+	return resolveDependencies(st, depMan, unresolved, st.UseLockedReleases)
 }
 
-func resolveDependencies(st *HelmState, depMan *chartDependencyManager, unresolved *UnresolvedDependencies) (*HelmState, error) {
+// resolveDependencies fills in the chart versions of the releases from the lock file.
+// When useLockedReleases is true, every release whose chart is managed by the lock file must be pinned in the lock file,
+// so that exactly the same charts and versions are deployed on every run.
+func resolveDependencies(st *HelmState, depMan *chartDependencyManager, unresolved *UnresolvedDependencies, useLockedReleases bool) (*HelmState, error) {
 	resolved, lockfileExists, err := depMan.Resolve(unresolved)
 	if err != nil {
 		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
 	}
 	if !lockfileExists {
+		if useLockedReleases {
+			return nil, fmt.Errorf("lock file %s not found. run `helmfile deps` to create it", depMan.lockFileName())
+		}
 		return st, nil
 	}
 
@@ -177,6 +192,16 @@ func resolveDependencies(st *HelmState, depMan *chartDependencyManager, unresolv
 			continue
 		}
 
+		if useLockedReleases {
+			id := releaseToID(&r)
+			locked, ok := resolved.releases[id]
+			if !ok || locked.Chart != r.Chart {
+				return nil, fmt.Errorf("release %q with chart %q is not locked in %s. run `helmfile deps` to update it", id, r.Chart, depMan.lockFileName())
+			}
+			updated.Releases[i].Version = locked.Version
+			continue
+		}
+
 		ver, err := resolved.Get(chart, r.Version)
 		if err != nil {
 			return nil, err
@@ -254,7 +279,16 @@ func updateDependencies(st *HelmState, shell helmexec.DependencyUpdater, unresol
 		return nil, fmt.Errorf("unable to resolve %d deps: %v", len(unresolved.deps), err)
 	}
 
-	return resolveDependencies(st, depMan, unresolved)
+	updated, err := resolveDependencies(st, depMan, unresolved, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := depMan.lockReleases(updated); err != nil {
+		return nil, err
+	}
+
+	return updated, nil
 }
 
 type chartDependencyManager struct {
@@ -404,7 +438,7 @@ func (m *chartDependencyManager) Resolve(unresolved *UnresolvedDependencies) (*R
 		return nil, false, err
 	}
 
-	resolved := &ResolvedDependencies{deps: map[string][]ResolvedChartDependency{}}
+	resolved := &ResolvedDependencies{deps: map[string][]ResolvedChartDependency{}, releases: lockedReqs.Releases}
 	for _, d := range lockedReqs.ResolvedDependencies {
 		if err := resolved.add(d); err != nil {
 			return nil, false, err
@@ -414,6 +448,49 @@ func (m *chartDependencyManager) Resolve(unresolved *UnresolvedDependencies) (*R
 	return resolved, true, nil
 }
 
+// lockReleases records the resolved charts and versions of the releases into the lock file, so that the releases can be
+// pinned to them with `--use-lock`. Only releases whose charts are managed by the lock file are recorded.
+func (m *chartDependencyManager) lockReleases(st *HelmState) error {
+	content, err := m.readBytes(m.lockFileName())
+	if err != nil {
+		return err
+	}
+
+	lockedReqs := &ChartLockedRequirements{}
+	if err := yaml.Unmarshal(content, lockedReqs); err != nil {
+		return err
+	}
+
+	repoToURL := map[string]string{}
+
+	for _, r := range st.Repositories {
+		repoToURL[r.Name] = r.URL
+	}
+
+	lockedReqs.Releases = map[string]LockedRelease{}
+
+	for _, r := range st.Releases {
+		repo, _, ok := resolveRemoteChart(r.Chart)
+		if !ok {
+			continue
+		}
+
+		if _, ok := repoToURL[repo]; !ok {
+			continue
+		}
+
+		lockedReqs.Releases[releaseToID(&r)] = LockedRelease{Chart: r.Chart, Version: r.Version}
+	}
+
+	// yaml.Marshal sorts the releases by their IDs, so that the lock file is deterministic
+	updatedContent, err := yaml.Marshal(lockedReqs)
+	if err != nil {
+		return err
+	}
+
+	return m.writeBytes(m.lockFileName(), updatedContent)
+}
+
 func (m *chartDependencyManager) readBytes(filename string) ([]byte, error) {
 	bytes, err := m.readFile(filename)
 	if err != nil {
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/imdario/mergo"
 	"github.com/roboll/helmfile/pkg/environment"
@@ -44,6 +45,9 @@ type StateCreator struct {
 
 	Strict bool
 
+	// DeterministicSeed is given to the states created, so that their values files are rendered deterministically. See HelmState.DeterministicSeed
+	DeterministicSeed string
+
 	LoadFile func(inheritedEnv *environment.Environment, baseDir, file string, evaluateBases bool) (*HelmState, error)
 }
 
@@ -100,11 +104,17 @@ func (c *StateCreator) Parse(content []byte, baseDir, file string) (*HelmState,
 		state.DeprecatedReleases = []ReleaseSpec{}
 	}
 
+	for i := range state.Releases {
+		state.Releases[i].SourceFile = file
+		state.Releases[i].BaseDir = baseDir
+	}
+
 	if state.DeprecatedContext != "" && state.HelmDefaults.KubeContext == "" {
 		state.HelmDefaults.KubeContext = state.DeprecatedContext
 	}
 
 	state.logger = c.logger
+	state.DeterministicSeed = c.DeterministicSeed
 
 	state.readFile = c.readFile
 	state.removeFile = os.Remove
@@ -143,7 +153,7 @@ func (c *StateCreator) ParseAndLoad(content []byte, baseDir, file string, envNam
 
 	if !evaluateBases {
 		if len(state.Bases) > 0 {
-			return nil, errors.New("nested `base` helmfile is unsupported. please submit a feature request if you need this!")
+			return nil, errors.New("nested `base` helmfile is unsupported. run with --nested-bases to evaluate bases of bases")
 		}
 	}
 
@@ -169,6 +179,14 @@ func (c *StateCreator) loadBases(envValues *environment.Environment, st *HelmSta
 		if err != nil {
 			return nil, err
 		}
+		// Releases defined in a base resolve their files relative to the base, not to the helmfile including it
+		baseFileDir := filepath.Dir(ExpandPath(b))
+		if !filepath.IsAbs(baseFileDir) {
+			baseFileDir = filepath.Join(baseDir, baseFileDir)
+		}
+		for i := range base.Releases {
+			base.Releases[i].BaseDir = baseFileDir
+		}
 		layers = append(layers, base)
 	}
 	layers = append(layers, st)
@@ -182,12 +200,44 @@ func (c *StateCreator) loadBases(envValues *environment.Environment, st *HelmSta
 	return layers[0], nil
 }
 
+// loadEnvValues loads the values of the environments selected by the name, merged in the order when the name consists of
+// multiple names like `base,prod`. Values in a later environment take precedence, and its values files with the `.gotmpl`
+// extension are rendered with the values of the preceding environments available as `.Values`.
 func (st *HelmState) loadEnvValues(name string, ctxEnv *environment.Environment, readFile func(string) ([]byte, error), glob func(string) ([]string, error)) (*environment.Environment, error) {
 	envVals := map[string]interface{}{}
+	for _, n := range environment.SplitNames(name) {
+		var err error
+		envVals, err = st.loadEnvValuesOnto(envVals, n, ctxEnv, readFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	newEnv := &environment.Environment{Name: name, Values: envVals}
+
+	if ctxEnv != nil {
+		intEnv, err := ctxEnv.Merge(newEnv)
+		if err != nil {
+			return nil, fmt.Errorf("error while merging environment values for \"%s\": %v", name, err)
+		}
+
+		newEnv = intEnv
+	}
+
+	return newEnv, nil
+}
+
+// loadEnvValuesOnto loads the values of the single environment merged onto the values of the preceding environments.
+func (st *HelmState) loadEnvValuesOnto(envVals map[string]interface{}, name string, ctxEnv *environment.Environment, readFile func(string) ([]byte, error)) (map[string]interface{}, error) {
 	envSpec, ok := st.Environments[name]
 	if ok {
+		entries := envSpec.Values
+		if len(envVals) > 0 {
+			entries = append([]interface{}{envVals}, entries...)
+		}
+
 		var err error
-		envVals, err = st.loadValuesEntries(envSpec.MissingFileHandler, envSpec.Values)
+		envVals, err = st.loadValuesEntries(envSpec.MissingFileHandler, entries)
 		if err != nil {
 			return nil, err
 		}
@@ -214,19 +264,7 @@ func (st *HelmState) loadEnvValues(name string, ctxEnv *environment.Environment,
 		return nil, &UndefinedEnvError{msg: fmt.Sprintf("environment \"%s\" is not defined", name)}
 	}
 
-	newEnv := &environment.Environment{Name: name, Values: envVals}
-
-	if ctxEnv != nil {
-		intEnv := *ctxEnv
-
-		if err := mergo.Merge(&intEnv, newEnv, mergo.WithOverride); err != nil {
-			return nil, fmt.Errorf("error while merging environment values for \"%s\": %v", name, err)
-		}
-
-		newEnv = &intEnv
-	}
-
-	return newEnv, nil
+	return envVals, nil
 }
 
 func (st *HelmState) scatterGatherEnvSecretFiles(envSecretFiles []string, envVals map[string]interface{}, readFile func(string) ([]byte, error)) error {
@@ -310,7 +348,8 @@ func (st *HelmState) loadValuesEntries(missingFileHandler *string, entries []int
 	envVals := map[string]interface{}{}
 
 	valuesEntries := append([]interface{}{}, entries...)
-	ld := NewEnvironmentValuesLoader(st.storage(), st.readFile, st.logger)
+	ld := NewEnvironmentValuesLoader(st.storage(), st.readFile, st.logger, st.valsRuntime)
+	ld.deterministicSeed = st.DeterministicSeed
 	var err error
 	envVals, err = ld.LoadEnvironmentValues(missingFileHandler, valuesEntries)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/roboll/helmfile/pkg/testhelper"
@@ -129,6 +130,138 @@ bar: {{ readFile "bar.txt" }}
 	}
 }
 
+func TestReadFromYaml_GotmplEnvValuesReferringToPrecedingValues(t *testing.T) {
+	yamlFile := "/example/path/to/helmfile.yaml"
+	yamlContent := []byte(`environments:
+  production:
+    values:
+    - base.yaml
+    - computed.yaml.gotmpl
+    - override.yaml
+
+releases:
+- name: myrelease
+  chart: mychart
+`)
+
+	testFs := testhelper.NewTestFs(map[string]string{
+		"/example/path/to/base.yaml": `domain: example.com
+replicas: 2
+`,
+		"/example/path/to/computed.yaml.gotmpl": `api: api.{{ .Values.domain }}
+maxReplicas: {{ mul .Values.replicas 3 }}
+later: {{ .Values | getOrNil "late" | default "unavailable" }}
+`,
+		"/example/path/to/override.yaml": `domain: example.org
+late: value
+`,
+	})
+	testFs.Cwd = "/example/path/to"
+
+	state, err := NewCreator(logger, testFs.ReadFile, testFs.FileExists, testFs.Abs, testFs.Glob, nil, nil).ParseAndLoad(yamlContent, filepath.Dir(yamlFile), yamlFile, "production", false, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"domain":      "example.org",
+		"replicas":    2,
+		"api":         "api.example.com",
+		"maxReplicas": 6,
+		// Values of the following files are not available yet
+		"later": "unavailable",
+		"late":  "value",
+	}
+	if !reflect.DeepEqual(state.Env.Values, expected) {
+		t.Errorf("unexpected environment values: expected=%v, actual=%v", expected, state.Env.Values)
+	}
+}
+
+func TestReadFromYaml_MultipleEnvironments(t *testing.T) {
+	yamlFile := "/example/path/to/helmfile.yaml"
+	yamlContent := []byte(`environments:
+  base:
+    values:
+    - domain: example.com
+      replicas: 1
+      tier: base
+  prod:
+    values:
+    - replicas: 3
+    - prod.yaml.gotmpl
+  eu:
+    values:
+    - region: eu
+      tier: eu
+
+releases:
+- name: myrelease
+  chart: mychart
+`)
+
+	testFs := testhelper.NewTestFs(map[string]string{
+		"/example/path/to/prod.yaml.gotmpl": `api: api.{{ .Values | getOrNil "domain" | default "unknown" }}
+`,
+	})
+	testFs.Cwd = "/example/path/to"
+
+	tests := []struct {
+		env      string
+		expected map[string]interface{}
+	}{
+		{
+			env: "base,prod",
+			expected: map[string]interface{}{
+				"domain":   "example.com",
+				"replicas": 3,
+				"tier":     "base",
+				"api":      "api.example.com",
+			},
+		},
+		{
+			env: "base,prod,eu",
+			expected: map[string]interface{}{
+				"domain":   "example.com",
+				"replicas": 3,
+				"tier":     "eu",
+				"api":      "api.example.com",
+				"region":   "eu",
+			},
+		},
+		{
+			env: "prod,base",
+			expected: map[string]interface{}{
+				"domain":   "example.com",
+				"replicas": 1,
+				"tier":     "base",
+				// The values of base are not available yet when prod is loaded
+				"api": "api.unknown",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			state, err := NewCreator(logger, testFs.ReadFile, testFs.FileExists, testFs.Abs, testFs.Glob, nil, nil).ParseAndLoad(yamlContent, filepath.Dir(yamlFile), yamlFile, tt.env, false, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(state.Env.Values, tt.expected) {
+				t.Errorf("unexpected environment values: expected=%v, actual=%v", tt.expected, state.Env.Values)
+			}
+			if state.Env.Name != tt.env {
+				t.Errorf("unexpected environment name: expected=%s, actual=%s", tt.env, state.Env.Name)
+			}
+		})
+	}
+
+	_, err := NewCreator(logger, testFs.ReadFile, testFs.FileExists, testFs.Abs, testFs.Glob, nil, nil).ParseAndLoad(yamlContent, filepath.Dir(yamlFile), yamlFile, "base,staging", false, nil)
+	if err == nil || !strings.Contains(err.Error(), `environment "staging" is not defined`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func TestReadFromYaml_StrictUnmarshalling(t *testing.T) {
 	yamlFile := "example/path/to/yaml/file"
 	yamlContent := []byte(`releases:
@@ -219,6 +352,54 @@ func TestReadFromYaml_FilterReleasesOnLabels(t *testing.T) {
 	}
 }
 
+func TestReadFromYaml_Needs(t *testing.T) {
+	yamlFile := "example/path/to/yaml/file"
+	yamlContent := []byte(`releases:
+- name: myrelease
+  chart: mychart
+  needs:
+  - ns1/hard
+  - ?ns1/soft
+  - release: ns2/hard
+  - release: ns2/soft
+    ignoreFailure: true
+  - release: ns2/explicitlyhard
+    ignoreFailure: false
+  - ""
+  - "  "
+  -
+  - " ns3/padded "
+`)
+	state, err := createFromYaml(yamlContent, yamlFile, DefaultEnv, logger)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := Needs{"ns1/hard", "?ns1/soft", "ns2/hard", "?ns2/soft", "ns2/explicitlyhard", "ns3/padded"}
+	if !reflect.DeepEqual(state.Releases[0].Needs, expected) {
+		t.Errorf("unexpected needs: expected=%v, got=%v", expected, state.Releases[0].Needs)
+	}
+
+	invalid := []string{
+		`releases:
+- name: myrelease
+  needs:
+  - ignoreFailure: true
+`,
+		`releases:
+- name: myrelease
+  needs:
+  - release: ns/name
+    waitForReady: true
+`,
+	}
+	for i, c := range invalid {
+		if _, err := createFromYaml([]byte(c), yamlFile, DefaultEnv, logger); err == nil {
+			t.Errorf("[%d] expected error did not occur", i)
+		}
+	}
+}
+
 func TestReadFromYaml_FilterNegatives(t *testing.T) {
 	yamlFile := "example/path/to/yaml/file"
 	yamlContent := []byte(`releases:
@@ -244,6 +425,12 @@ func TestReadFromYaml_FilterNegatives(t *testing.T) {
 			[]bool{false, true, false}},
 		{LabelFilter{negativeLabels: [][]string{[]string{"stage", "pre"}, []string{"stage", "post"}}},
 			[]bool{false, false, true}},
+		{LabelFilter{negativeLabels: [][]string{[]string{"foo", "bar"}, []string{"stage", "post"}}},
+			[]bool{false, false, true}},
+		{LabelFilter{inLabels: []labelSet{{key: "stage", values: []string{"pre", "post"}}}},
+			[]bool{true, true, false}},
+		{LabelFilter{notInLabels: []labelSet{{key: "stage", values: []string{"pre"}}}},
+			[]bool{false, true, true}},
 	}
 	state, err := createFromYaml(yamlContent, yamlFile, DefaultEnv, logger)
 	if err != nil {
@@ -277,12 +464,18 @@ func TestReadFromYaml_Helmfiles_Selectors(t *testing.T) {
   selectors: []
 - path: path/prefix/inherits/selector.yaml
   selectorsInherited: true
+- path: path/prefix/namespaced.yaml
+  namespace: ns1
+- path: path/prefix/conditional.yaml
+  condition: "false"
 `),
 			wantErr: false,
 			helmfiles: []SubHelmfileSpec{{Path: "simple/helmfile.yaml", Selectors: nil, SelectorsInherited: false},
 				{Path: "path/prefix/selector.yaml", Selectors: []string{"name=zorba", "foo=bar"}, SelectorsInherited: false},
 				{Path: "path/prefix/empty/selector.yaml", Selectors: []string{}, SelectorsInherited: false},
 				{Path: "path/prefix/inherits/selector.yaml", Selectors: nil, SelectorsInherited: true},
+				{Path: "path/prefix/namespaced.yaml", Namespace: "ns1"},
+				{Path: "path/prefix/conditional.yaml", Condition: "false"},
 			},
 		},
 		{
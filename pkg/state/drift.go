@@ -0,0 +1,121 @@
+package state
+
+import (
+	"fmt"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// DriftStatus is the outcome of comparing the desired manifest of a release against the live cluster state
+type DriftStatus string
+
+const (
+	// DriftStatusInSync is for a release whose live state matches the desired manifest
+	DriftStatusInSync DriftStatus = "in-sync"
+	// DriftStatusDrifted is for a release whose live state differs from the desired manifest
+	DriftStatusDrifted DriftStatus = "drifted"
+	// DriftStatusFailed is for a release failed to be compared, like due to an error rendering its chart
+	DriftStatusFailed DriftStatus = "failed"
+)
+
+// ReleaseDrift is the drift of a release detected by DetectDrift
+type ReleaseDrift struct {
+	Release   string      `json:"release"`
+	Namespace string      `json:"namespace,omitempty"`
+	Status    DriftStatus `json:"status"`
+	// Changes is the number of the resources added, removed or changed in the cluster, or zero when it is unknown
+	Changes int `json:"changes"`
+	// Error is the error comparing the release, only when Status is DriftStatusFailed
+	Error string `json:"error,omitempty"`
+}
+
+// DriftReport aggregates the drifts of releases in the order of the releases, along with the number of releases per status,
+// so that monitoring can alert on Drifted without parsing the diffs
+type DriftReport struct {
+	Releases []ReleaseDrift `json:"releases"`
+	InSync   int            `json:"inSync"`
+	Drifted  int            `json:"drifted"`
+	Failed   int            `json:"failed"`
+}
+
+// Add appends the drift of a release to the report, counting it by its status
+func (r *DriftReport) Add(drifts ...ReleaseDrift) {
+	for _, d := range drifts {
+		r.Releases = append(r.Releases, d)
+		switch d.Status {
+		case DriftStatusInSync:
+			r.InSync++
+		case DriftStatusDrifted:
+			r.Drifted++
+		case DriftStatusFailed:
+			r.Failed++
+		}
+	}
+}
+
+// DetectDrift compares the desired manifest of each release against the live cluster state via helm-diff, reusing the preparation
+// of DiffReleases, and reports the releases drifted from the desired state. Secrets are always suppressed in the diffs.
+//
+// Unlike DiffReleases, which previews the changes to apply, it is meant for monitoring. Each drifted release is returned as
+// a ReleaseError with the code 2 in addition to the report, so that detecting any drift exits non-zero, while the failures take
+// precedence as usual.
+func (st *HelmState) DetectDrift(helm helmexec.Interface, additionalValues []string, workerLimit int, opt ...DiffOpt) (*DriftReport, []error) {
+	opts := &DiffOpts{}
+	for _, o := range opt {
+		o.Apply(opts)
+	}
+
+	report := &DriftReport{}
+
+	preps, prepErrs := st.prepareDiffReleases(helm, additionalValues, workerLimit, true, true, opts)
+	if len(prepErrs) > 0 {
+		return report, prepErrs
+	}
+
+	// Each release is compared by exactly one worker, which writes only to the index of the release.
+	// A release failed before being compared, like by its readiness probes, stays failed
+	drifts := make([]ReleaseDrift, len(preps))
+
+	releases := make([]ReleaseSpec, len(preps))
+	idToIndex := map[string]int{}
+	for i, p := range preps {
+		releases[i] = *p.release
+		idToIndex[releaseToID(p.release)] = i
+		drifts[i] = ReleaseDrift{Release: p.release.Name, Namespace: p.release.Namespace, Status: DriftStatusFailed, Error: "not compared"}
+	}
+
+	errs := st.iterateOnReleases(helm, workerLimit, releases, func(release ReleaseSpec, workerIndex int) error {
+		i := idToIndex[releaseToID(&release)]
+		prep := preps[i]
+
+		drift := ReleaseDrift{Release: release.Name, Namespace: release.Namespace, Status: DriftStatusInSync}
+
+		err := releaseHelm(helm, prep.release).DiffRelease(st.createHelmContext(prep.release, workerIndex), release.Name, st.chartFor(prep.release), prep.flags...)
+		if diffErr, ok := err.(helmexec.DiffError); ok {
+			drift.Status = DriftStatusDrifted
+			drift.Changes = diffErr.Changes
+			err = nil
+		} else if err != nil {
+			drift.Status = DriftStatusFailed
+			drift.Error = err.Error()
+		}
+
+		drifts[i] = drift
+
+		if _, err := st.triggerCleanupEvent(prep.release, "drift"); err != nil {
+			st.workerLogger(workerIndex).Warnf("warn: %v\n", err)
+		}
+
+		return err
+	})
+
+	report.Add(drifts...)
+
+	for i, d := range drifts {
+		if d.Status == DriftStatusDrifted {
+			errs = append(errs, &ReleaseError{preps[i].release, fmt.Errorf("drifted from the desired state: %d resources differ", d.Changes), 2})
+		}
+	}
+
+	return report, errs
+}
@@ -1,5 +1,7 @@
 package state
 
+import "sort"
+
 type EnvironmentSpec struct {
 	Values  []interface{} `yaml:"values,omitempty"`
 	Secrets []string      `yaml:"secrets,omitempty"`
@@ -12,4 +14,33 @@ type EnvironmentSpec struct {
 	// Use "Warn", "Info", or "Debug" if you want helmfile to not fail when a values file is missing, while just leaving
 	// a message about the missing file at the log-level.
 	MissingFileHandler *string `yaml:"missingFileHandler,omitempty"`
+
+	// Concurrency is the default maximum number of concurrent helm processes for the environment.
+	// It is used only when `--concurrency` is not specified or 0. The default is 0, which means unlimited.
+	Concurrency int `yaml:"concurrency,omitempty"`
+
+	// Labels is the default labels of all the releases in the environment, like `env: prod`.
+	// A label of a release takes precedence over the one of the environment with the same key.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// InterpolateValues, when set to true, resolves the references to the other values of the environment in its string values,
+	// like `apiUrl: "{{ .Values.baseUrl }}/api"`. It is opt-in, as the strings are otherwise passed to charts as they are
+	InterpolateValues bool `yaml:"interpolateValues,omitempty"`
+}
+
+// EnvironmentNames returns the names of the environments defined in the helmfile, sorted.
+// The default environment is listed only when it is defined, or when no environment is defined at all, as it is always
+// available to the helmfile without being defined.
+func (st *HelmState) EnvironmentNames() []string {
+	if len(st.Environments) == 0 {
+		return []string{DefaultEnv}
+	}
+
+	names := make([]string, 0, len(st.Environments))
+	for name := range st.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
 }
@@ -6,27 +6,44 @@ import (
 	"github.com/roboll/helmfile/pkg/environment"
 	"github.com/roboll/helmfile/pkg/maputil"
 	"github.com/roboll/helmfile/pkg/tmpl"
+	"github.com/variantdev/vals"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 	"path/filepath"
+	"strings"
 )
 
+// ValsRefPrefix is the prefix of references to values resolved by vals, like `ref+vault://path/to/secret#/key`
+const ValsRefPrefix = "ref+"
+
 type EnvironmentValuesLoader struct {
 	storage *Storage
 
 	readFile func(string) ([]byte, error)
 
 	logger *zap.SugaredLogger
+
+	// deterministicSeed renders the values files deterministically when set. See HelmState.DeterministicSeed
+	deterministicSeed string
+
+	// valsRuntime, when set, resolves references like `ref+k8s://v1/ConfigMap/NS/NAME` in the values entries.
+	// A values entry that is a reference must be resolved to a map of values, whereas a reference in values is resolved to a single value.
+	valsRuntime vals.Evaluator
 }
 
-func NewEnvironmentValuesLoader(storage *Storage, readFile func(string) ([]byte, error), logger *zap.SugaredLogger) *EnvironmentValuesLoader {
+func NewEnvironmentValuesLoader(storage *Storage, readFile func(string) ([]byte, error), logger *zap.SugaredLogger, valsRuntime vals.Evaluator) *EnvironmentValuesLoader {
 	return &EnvironmentValuesLoader{
-		storage:  storage,
-		readFile: readFile,
-		logger:   logger,
+		storage:     storage,
+		readFile:    readFile,
+		logger:      logger,
+		valsRuntime: valsRuntime,
 	}
 }
 
+// LoadEnvironmentValues loads the values entries merged in the order. Values in a later entry take precedence over the ones in the earlier entries.
+//
+// Each values file with the `.gotmpl` extension is rendered with the values merged from the preceding entries available as `.Values`,
+// so that it can compute values from the ones before it. The values of the entries following it are never available.
 func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *string, valuesEntries []interface{}) (map[string]interface{}, error) {
 	result := map[string]interface{}{}
 
@@ -35,6 +52,15 @@ func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *str
 
 		switch strOrMap := entry.(type) {
 		case string:
+			if ld.valsRuntime != nil && strings.HasPrefix(strOrMap, ValsRefPrefix) {
+				m, err := ld.resolveValsRef(strOrMap)
+				if err != nil {
+					return nil, err
+				}
+				maps = append(maps, m)
+				break
+			}
+
 			urlOrPath := strOrMap
 			files, skipped, err := ld.storage.resolveFile(missingFileHandler, "environment values", urlOrPath)
 			if err != nil {
@@ -45,8 +71,8 @@ func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *str
 			}
 
 			for _, f := range files {
-				tmplData := EnvironmentTemplateData{environment.EmptyEnvironment, "", map[string]interface{}{}}
-				r := tmpl.NewFileRenderer(ld.readFile, filepath.Dir(f), tmplData)
+				tmplData := EnvironmentTemplateData{environment.EmptyEnvironment, "", result}
+				r := tmpl.NewFileRenderer(ld.readFile, filepath.Dir(f), tmplData).WithDeterministic(ld.deterministicSeed)
 				bytes, err := r.RenderToBytes(f)
 				if err != nil {
 					return nil, fmt.Errorf("failed to load environment values file \"%s\": %v", f, err)
@@ -60,7 +86,7 @@ func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *str
 					ld.logger.Debugf("envvals_loader: loaded %s:%v", strOrMap, m)
 				}
 			}
-		case map[interface{}]interface{}:
+		case map[interface{}]interface{}, map[string]interface{}:
 			maps = append(maps, strOrMap)
 		default:
 			return nil, fmt.Errorf("unexpected type of value: value=%v, type=%T", strOrMap, strOrMap)
@@ -73,6 +99,14 @@ func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *str
 			if err != nil {
 				return nil, err
 			}
+			// References are resolved before merging, so that the values rendered into helmfile templates, and into the values files
+			// of the subsequent layers, never contain references
+			if ld.valsRuntime != nil {
+				vals, err = ld.valsRuntime.Eval(vals)
+				if err != nil {
+					return nil, fmt.Errorf("failed to resolve references in environment values: %v", err)
+				}
+			}
 			if err := mergo.Merge(&result, &vals, mergo.WithOverride); err != nil {
 				return nil, fmt.Errorf("failed to merge %v: %v", m, err)
 			}
@@ -81,3 +115,20 @@ func (ld *EnvironmentValuesLoader) LoadEnvironmentValues(missingFileHandler *str
 
 	return result, nil
 }
+
+// resolveValsRef resolves the values entry that is a reference to a map of values, like a ConfigMap in the cluster.
+func (ld *EnvironmentValuesLoader) resolveValsRef(ref string) (map[string]interface{}, error) {
+	resolved, err := ld.valsRuntime.Eval(map[string]interface{}{"values": ref})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load environment values %q: %v", ref, err)
+	}
+
+	switch m := resolved["values"].(type) {
+	case map[string]interface{}:
+		return m, nil
+	case map[interface{}]interface{}:
+		return maputil.CastKeysToStrings(m)
+	default:
+		return nil, fmt.Errorf("failed to load environment values %q: it must be resolved to a map of values, but got %T", ref, m)
+	}
+}
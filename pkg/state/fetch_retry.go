@@ -0,0 +1,74 @@
+package state
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// chartFetchRetryInterval is the base interval before the first retry of a chart fetch, doubled on every retry
+	chartFetchRetryInterval = time.Second
+	// maxChartFetchRetryInterval caps the interval between retries of a chart fetch
+	maxChartFetchRetryInterval = 30 * time.Second
+)
+
+// httpStatusPattern matches an HTTP status like `503 Service Unavailable` in the output of helm
+var httpStatusPattern = regexp.MustCompile(`\b([1-5][0-9]{2}) [A-Z][A-Za-z]`)
+
+// transientFetchErrors is the lower-cased parts of the messages of network errors worth retrying
+var transientFetchErrors = []string{
+	"timeout",
+	"timed out",
+	"connection reset",
+	"unexpected eof",
+}
+
+// isTransientFetchError reports whether the error of fetching a chart or a repository index is worth retrying.
+// A 5xx response or a timeout is likely to succeed on retry, whereas a 4xx response, like for a chart missing in the
+// repository or wrong credentials, or any other error is not.
+func isTransientFetchError(err error) bool {
+	msg := err.Error()
+
+	if m := httpStatusPattern.FindStringSubmatch(msg); m != nil {
+		return m[1][0] == '5'
+	}
+
+	lower := strings.ToLower(msg)
+	for _, s := range transientFetchErrors {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryChartFetch calls fetch, retrying up to ChartFetchRetries times while it fails transiently as told by isTransientFetchError.
+// The interval between retries starts from chartFetchRetryInterval and doubles on every retry up to maxChartFetchRetryInterval,
+// with a random jitter of up to its half, so that concurrent workers fetching from the same flaky repository don't retry in lockstep.
+func (st *HelmState) retryChartFetch(desc string, fetch func() error) error {
+	sleep := st.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	interval := chartFetchRetryInterval
+
+	for retry := 1; ; retry++ {
+		err := fetch()
+		if err == nil || retry > st.ChartFetchRetries || !isTransientFetchError(err) {
+			return err
+		}
+
+		delay := interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+		st.logger.Warnf("retrying %s in %s (%d/%d) as it failed transiently: %v", desc, delay, retry, st.ChartFetchRetries, err)
+		sleep(delay)
+
+		interval *= 2
+		if interval > maxChartFetchRetryInterval {
+			interval = maxChartFetchRetryInterval
+		}
+	}
+}
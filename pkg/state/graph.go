@@ -0,0 +1,300 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DOT renders the dependency graph of the releases defined by `needs` in the Graphviz DOT format, without running helm.
+//
+// Each node is a release labeled with its [TILLER_NS/][NS/]NAME, and each edge goes from the dependent release to the release it needs.
+// Releases are grouped into a cluster per namespace. Soft needs are drawn as dashed edges, and releases with `installed: false` in gray.
+// `needs` are validated as done by SyncReleases, so that the graph never contains a dependency that helmfile would reject.
+func (st *HelmState) DOT() (string, error) {
+	releases, _ := st.releasesByID()
+
+	if _, err := st.planReleases(releases, true, ignoreNotInstalledNeeds); err != nil {
+		return "", err
+	}
+
+	ids := map[string]bool{}
+	var namespaces []string
+	nsToReleases := map[string][]*ReleaseSpec{}
+	for _, r := range releases {
+		ids[releaseToID(r)] = true
+		if _, ok := nsToReleases[r.Namespace]; !ok {
+			namespaces = append(namespaces, r.Namespace)
+		}
+		nsToReleases[r.Namespace] = append(nsToReleases[r.Namespace], r)
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "digraph %q {\n", st.FilePath)
+
+	for i, ns := range namespaces {
+		indent := "  "
+		if ns != "" {
+			fmt.Fprintf(&buf, "  subgraph \"cluster_%d\" {\n", i)
+			fmt.Fprintf(&buf, "    label=%q;\n", ns)
+			indent = "    "
+		}
+		for _, r := range nsToReleases[ns] {
+			if r.Desired() {
+				fmt.Fprintf(&buf, "%s%q;\n", indent, releaseToID(r))
+			} else {
+				fmt.Fprintf(&buf, "%s%q [color=gray, fontcolor=gray];\n", indent, releaseToID(r))
+			}
+		}
+		if ns != "" {
+			buf.WriteString("  }\n")
+		}
+	}
+
+	for _, r := range releases {
+		id := releaseToID(r)
+		for _, n := range r.Needs {
+			need, soft := parseNeed(n)
+			// Releases filtered out by selectors are not drawn
+			if !ids[need] {
+				continue
+			}
+			if soft {
+				fmt.Fprintf(&buf, "  %q -> %q [style=dashed];\n", id, need)
+			} else {
+				fmt.Fprintf(&buf, "  %q -> %q;\n", id, need)
+			}
+		}
+	}
+
+	buf.WriteString("}\n")
+
+	return buf.String(), nil
+}
+
+// ReleaseDegree is the number of the edges of a release in the dependency graph of the releases defined by `needs`
+type ReleaseDegree struct {
+	// Release is the [TILLER_NS/][NS/]NAME of the release
+	Release string
+	// InDegree is the number of the releases that need the release
+	InDegree int
+	// OutDegree is the number of the releases the release needs
+	OutDegree int
+}
+
+// Orphan reports whether the release neither needs nor is needed by any release.
+func (d ReleaseDegree) Orphan() bool {
+	return d.InDegree == 0 && d.OutDegree == 0
+}
+
+// Degrees returns the in-degree and out-degree of each release in the dependency graph of the releases, in the order of the releases.
+// The graph is the same as the one rendered by DOT, so that soft needs are counted and releases filtered out by selectors are not.
+func (st *HelmState) Degrees() ([]ReleaseDegree, error) {
+	releases, _ := st.releasesByID()
+
+	if _, err := st.planReleases(releases, true, ignoreNotInstalledNeeds); err != nil {
+		return nil, err
+	}
+
+	index := map[string]int{}
+	degrees := make([]ReleaseDegree, len(releases))
+	for i, r := range releases {
+		id := releaseToID(r)
+		index[id] = i
+		degrees[i].Release = id
+	}
+
+	for i, r := range releases {
+		for _, n := range r.Needs {
+			need, _ := parseNeed(n)
+			j, ok := index[need]
+			if !ok {
+				continue
+			}
+			degrees[i].OutDegree++
+			degrees[j].InDegree++
+		}
+	}
+
+	return degrees, nil
+}
+
+// ValidateDAG checks the dependency graph of the releases defined by `needs`, `after` and `before`, without running helm.
+// Unlike planning releases, it doesn't stop at the first problem but returns all of them at once, so that `helmfile lint` can report them together.
+//
+// The problems are releases sharing the same ID, releases depending on themselves, `needs` that don't refer to exactly one of the releases,
+// and cycles of any length. When warnDisconnected is true, it also warns on releases that form groups disconnected from each other,
+// as it may indicate a forgotten dependency.
+// Releases filtered out by selectors are validated too, as they are still planned along with the others.
+func (st *HelmState) ValidateDAG(warnDisconnected bool) []error {
+	releases := st.allReleases()
+
+	// The problems are the same as the ones checked on planning releases, which are reported all at once instead of one by one
+	ids, edges, errs := resolveNeeds(releases)
+	for id, preceding := range orderingNeeds(releases, nil) {
+		edges[id] = append(edges[id], preceding...)
+	}
+
+	for _, cycle := range stronglyConnectedComponents(ids, edges) {
+		if len(cycle) > 1 {
+			errs = append(errs, fmt.Errorf("releases %s form a cycle of dependencies. please remove one of the needs among them", strings.Join(cycle, ", ")))
+		}
+	}
+
+	if warnDisconnected {
+		if groups := st.DisconnectedGroups(); len(groups) > 1 {
+			var descs []string
+			for _, g := range groups {
+				descs = append(descs, "["+strings.Join(g, ", ")+"]")
+			}
+			st.logger.Warnf("releases form %d groups disconnected from each other: %s. please make sure that no need is missing", len(groups), strings.Join(descs, ", "))
+		}
+	}
+
+	return errs
+}
+
+// DisconnectedGroups returns the groups of the IDs of the releases that are connected to each other via `needs`, `after` or `before`,
+// regardless of the direction. More than one group means that some releases are disconnected from the others.
+// Dangling needs are ignored, and the groups and the IDs in each group are in the order of the releases.
+func (st *HelmState) DisconnectedGroups() [][]string {
+	releases := st.allReleases()
+
+	var ids []string
+	known := map[string]bool{}
+	for _, r := range releases {
+		if id := releaseToID(r); !known[id] {
+			known[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	edges := map[string][]string{}
+	for _, r := range releases {
+		id := releaseToID(r)
+		for _, n := range r.Needs {
+			if need, _ := parseNeed(n); known[need] {
+				edges[id] = append(edges[id], need)
+			}
+		}
+	}
+	for id, preceding := range orderingNeeds(releases, nil) {
+		edges[id] = append(edges[id], preceding...)
+	}
+
+	return connectedComponents(ids, edges)
+}
+
+// allReleases returns the releases along with the ones filtered out by selectors.
+func (st *HelmState) allReleases() []*ReleaseSpec {
+	var releases []*ReleaseSpec
+	for i := range st.Releases {
+		releases = append(releases, &st.Releases[i])
+	}
+	for i := range st.filteredOutReleases {
+		releases = append(releases, &st.filteredOutReleases[i])
+	}
+	return releases
+}
+
+// connectedComponents returns the groups of the nodes connected by the edges regardless of their directions,
+// in the order of the nodes.
+func connectedComponents(nodes []string, edges map[string][]string) [][]string {
+	neighbors := map[string][]string{}
+	for from, tos := range edges {
+		for _, to := range tos {
+			neighbors[from] = append(neighbors[from], to)
+			neighbors[to] = append(neighbors[to], from)
+		}
+	}
+
+	group := map[string]int{}
+	var groups [][]string
+	for _, n := range nodes {
+		if _, ok := group[n]; ok {
+			continue
+		}
+		g := len(groups)
+		group[n] = g
+		queue := []string{n}
+		for len(queue) > 0 {
+			for _, m := range neighbors[queue[0]] {
+				if _, ok := group[m]; !ok {
+					group[m] = g
+					queue = append(queue, m)
+				}
+			}
+			queue = queue[1:]
+		}
+		groups = append(groups, nil)
+	}
+
+	for _, n := range nodes {
+		groups[group[n]] = append(groups[group[n]], n)
+	}
+
+	return groups
+}
+
+// stronglyConnectedComponents returns the groups of the nodes reachable from each other via the edges, using Tarjan's algorithm.
+// A group of two or more nodes is a cycle. The nodes in each group are in the order of the nodes.
+func stronglyConnectedComponents(nodes []string, edges map[string][]string) [][]string {
+	order := map[string]int{}
+	for i, n := range nodes {
+		order[n] = i
+	}
+
+	index := map[string]int{}
+	lowlink := map[string]int{}
+	onStack := map[string]bool{}
+	var stack []string
+	var groups [][]string
+
+	var visit func(string)
+	visit = func(n string) {
+		index[n] = len(index)
+		lowlink[n] = index[n]
+		stack = append(stack, n)
+		onStack[n] = true
+
+		for _, m := range edges[n] {
+			if _, ok := index[m]; !ok {
+				visit(m)
+				if lowlink[m] < lowlink[n] {
+					lowlink[n] = lowlink[m]
+				}
+			} else if onStack[m] && index[m] < lowlink[n] {
+				lowlink[n] = index[m]
+			}
+		}
+
+		if lowlink[n] != index[n] {
+			return
+		}
+
+		var group []string
+		for {
+			m := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[m] = false
+			group = append(group, m)
+			if m == n {
+				break
+			}
+		}
+		sort.Slice(group, func(i, j int) bool { return order[group[i]] < order[group[j]] })
+		groups = append(groups, group)
+	}
+
+	for _, n := range nodes {
+		if _, ok := index[n]; !ok {
+			visit(n)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return order[groups[i][0]] < order[groups[j][0]] })
+
+	return groups
+}
@@ -1,5 +1,7 @@
 package state
 
+import "fmt"
+
 type Dependency struct {
 	Chart   string `yaml:"chart"`
 	Version string `yaml:"version"`
@@ -51,5 +53,23 @@ func (st *HelmState) appendHelmXFlags(flags []string, release *ReleaseSpec) ([]s
 		release.generatedValues = append(release.generatedValues, generatedFiles...)
 	}
 
+	for _, t := range release.Transformers {
+		switch typedTransformer := t.(type) {
+		case string:
+			flags = append(flags, "--transformer", st.releaseStorage(release).normalizePath(typedTransformer))
+		case map[interface{}]interface{}, map[string]interface{}:
+			generatedFiles, err := st.generateTemporaryValuesFiles([]interface{}{typedTransformer}, release.MissingFileHandler)
+			if err != nil {
+				return nil, err
+			}
+
+			flags = append(flags, "--transformer", generatedFiles[0])
+
+			release.generatedValues = append(release.generatedValues, generatedFiles...)
+		default:
+			return nil, fmt.Errorf("unexpected type of transformer: transformer=%v, type=%T", typedTransformer, typedTransformer)
+		}
+	}
+
 	return flags, nil
 }
@@ -0,0 +1,307 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/remote"
+	"gopkg.in/yaml.v2"
+)
+
+// ReleaseHashes is the hashes of the inputs of releases keyed by their [TILLER_NS/][NS/]NAME,
+// recorded by the last successful incremental run. See SelectChangedReleases for more details.
+type ReleaseHashes map[string]string
+
+// releaseHashesFileName returns the file to record the release hashes in, which is `<NAME>.hashes` next to `<NAME>.yaml`
+// like the lock file written by `helmfile deps`.
+func (st *HelmState) releaseHashesFileName() string {
+	return st.siblingFileName("hashes")
+}
+
+// siblingFileName returns `<NAME>.<EXT>` next to the helmfile `<NAME>.yaml`
+func (st *HelmState) siblingFileName(ext string) string {
+	filename := filepath.Base(st.FilePath)
+	filename = strings.TrimSuffix(filename, ".gotmpl")
+	filename = strings.TrimSuffix(filename, ".yaml")
+	filename = strings.TrimSuffix(filename, ".yml")
+
+	return filepath.Join(st.basePath, fmt.Sprintf("%s.%s", filename, ext))
+}
+
+// LoadReleaseHashes reads the release hashes recorded by the last successful incremental run.
+// It returns no hashes when there's no record yet, so that all the releases are considered changed.
+func (st *HelmState) LoadReleaseHashes() (ReleaseHashes, error) {
+	hashes := ReleaseHashes{}
+
+	file := st.releaseHashesFileName()
+
+	exists, err := st.fileExists(file)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return hashes, nil
+	}
+
+	bs, err := st.readFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(bs, &hashes); err != nil {
+		return nil, fmt.Errorf("failed to read release hashes from %s: %v", file, err)
+	}
+
+	return hashes, nil
+}
+
+// SaveReleaseHashes records the release hashes for the next incremental run.
+func (st *HelmState) SaveReleaseHashes(hashes ReleaseHashes) error {
+	bs, err := yaml.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+
+	file := st.releaseHashesFileName()
+
+	if err := ioutil.WriteFile(file, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write release hashes to %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// ReleaseInputsHash returns the hash of everything helmfile passes to helm for the release, so that the rendered manifests
+// of the release are unchanged as long as the hash is unchanged, given the same remote chart versions.
+//
+// It covers the release spec including its inline values, the values files rendered with the environment, the contents of
+// its secrets files, the files in its chart when the chart is a local directory, and the additional values and `--set` flags
+// given on the command line.
+// Values are hashed in their canonical serialization with sorted keys, so that the hash is stable across runs and
+// reformatting a values file never changes it.
+func (st *HelmState) ReleaseInputsHash(release *ReleaseSpec, additionalValues []string, set []string) (string, error) {
+	h := sha256.New()
+
+	spec, err := yaml.Marshal(release)
+	if err != nil {
+		return "", err
+	}
+	h.Write(spec)
+
+	// Remote files are hashed as fetched, as their content may change without changing their URLs, like on a branch
+	remoteOrPrefixed := func(tpe, path string) (string, error) {
+		if remote.IsRemote(path) {
+			return st.fetchRemoteFile(release, tpe, path)
+		}
+		return release.ValuesPathPrefix + path, nil
+	}
+
+	var valuesFiles []string
+	for _, v := range release.Values {
+		if path, ok := v.(string); ok {
+			f, err := remoteOrPrefixed("values", path)
+			if err != nil {
+				return "", err
+			}
+			valuesFiles = append(valuesFiles, f)
+		}
+	}
+
+	var secretsFiles []string
+	for _, s := range release.Secrets {
+		// References to secrets are hashed as written in the spec, as resolving them is deferred until the release is processed
+		if strings.HasPrefix(s, ValsRefPrefix) {
+			continue
+		}
+		f, err := remoteOrPrefixed("secrets", s)
+		if err != nil {
+			return "", err
+		}
+		secretsFiles = append(secretsFiles, f)
+	}
+
+	// Missing files are hashed as missing instead of failing, as they may be generated later by `prepare` hooks
+	missingFileHandler := MissingFileHandlerDebug
+	storage := st.releaseStorage(release)
+	hashFiles := func(files []string, hash func(io.Writer, string) error) error {
+		for _, f := range files {
+			paths, _, err := storage.resolveFile(&missingFileHandler, "values", f)
+			if err != nil {
+				return err
+			}
+			if len(paths) == 0 {
+				fmt.Fprintf(h, "missing:%s\n", f)
+			}
+			for _, p := range paths {
+				if err := hash(h, p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := hashFiles(valuesFiles, st.hashValuesFile); err != nil {
+		return "", err
+	}
+
+	// Secrets files are encrypted, so they are hashed as is
+	if err := hashFiles(secretsFiles, st.hashFile); err != nil {
+		return "", err
+	}
+
+	for _, f := range additionalValues {
+		if err := st.hashFile(h, f); err != nil {
+			return "", err
+		}
+	}
+
+	for _, s := range set {
+		fmt.Fprintf(h, "set:%s\n", s)
+	}
+
+	if chart := normalizeChart(st.basePath, release.Chart); isLocalChart(release.Chart) && pathExists(chart) {
+		if err := st.hashChartDir(h, chart); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (st *HelmState) hashFile(h io.Writer, path string) error {
+	bs, err := st.readFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "file:%s:%d\n", path, len(bs))
+	h.Write(bs)
+	return nil
+}
+
+// hashValuesFile hashes the values file rendered as helm receives it, in the canonical serialization when it is valid YAML.
+func (st *HelmState) hashValuesFile(h io.Writer, path string) error {
+	bs, err := st.RenderValuesFileToBytes(path)
+	if err != nil {
+		return err
+	}
+
+	var values interface{}
+	if err := yaml.Unmarshal(bs, &values); err == nil {
+		if canonical, err := yaml.Marshal(values); err == nil {
+			bs = canonical
+		}
+	}
+
+	fmt.Fprintf(h, "values:%s:%d\n", path, len(bs))
+	h.Write(bs)
+	return nil
+}
+
+func (st *HelmState) hashChartDir(h io.Writer, dir string) error {
+	var files []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to hash chart %s: %v", dir, err)
+	}
+
+	sort.Strings(files)
+
+	for _, f := range files {
+		bs, err := ioutil.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("failed to hash chart %s: %v", dir, err)
+		}
+		fmt.Fprintf(h, "chart:%s:%d\n", f, len(bs))
+		h.Write(bs)
+	}
+
+	return nil
+}
+
+// ReleaseInputsHashes returns the hashes of the inputs of all the releases keyed by their [TILLER_NS/][NS/]NAME.
+// See ReleaseInputsHash for what the inputs are.
+func (st *HelmState) ReleaseInputsHashes(additionalValues []string, set []string) (ReleaseHashes, error) {
+	hashes := ReleaseHashes{}
+
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		id := releaseToID(r)
+
+		hash, err := st.ReleaseInputsHash(r, additionalValues, set)
+		if err != nil {
+			return nil, fmt.Errorf("failed hashing inputs of release %q: %v", id, err)
+		}
+
+		hashes[id] = hash
+	}
+
+	return hashes, nil
+}
+
+// SelectChangedReleases narrows the releases down to the ones whose inputs changed since the hashes recorded by the last
+// successful incremental run, along with the releases transitively needing them, so that unchanged releases are skipped
+// entirely. See ReleaseInputsHash for what the inputs are.
+//
+// The releases left out are treated like ones filtered out by selectors, so that they are still taken into account in
+// ordering the selected releases.
+// It returns the hashes of the selected releases, to be recorded via SaveReleaseHashes after processing them successfully.
+func (st *HelmState) SelectChangedReleases(previous ReleaseHashes, additionalValues []string, set []string) (ReleaseHashes, error) {
+	current, err := st.ReleaseInputsHashes(additionalValues, set)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for i := range st.Releases {
+		id := releaseToID(&st.Releases[i])
+		if previous[id] != current[id] {
+			st.logger.Debugf("release %q changed since the last incremental run", id)
+			selected[id] = true
+		}
+	}
+
+	for id := range current {
+		if !selected[id] {
+			continue
+		}
+		for _, d := range st.TransitiveDependents(id) {
+			if !selected[d] {
+				st.logger.Debugf("release %q is selected as it needs the changed release %q", d, id)
+				selected[d] = true
+			}
+		}
+	}
+
+	var releases, unchanged []ReleaseSpec
+	for _, r := range st.Releases {
+		id := releaseToID(&r)
+		if selected[id] {
+			releases = append(releases, r)
+		} else {
+			unchanged = append(unchanged, r)
+			delete(current, id)
+		}
+	}
+
+	st.Releases = releases
+	st.filteredOutReleases = append(st.filteredOutReleases, unchanged...)
+
+	return current, nil
+}
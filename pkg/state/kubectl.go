@@ -0,0 +1,121 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"go.uber.org/zap"
+)
+
+const (
+	// KubectlHookPresync is the event of a kubectl hook run before the release is synced, after its presync hooks
+	KubectlHookPresync = "presync"
+	// KubectlHookPostsync is the event of a kubectl hook run after the release is synced successfully
+	KubectlHookPostsync = "postsync"
+)
+
+// KubectlHook is a kubectl command run before or after helm syncs the release, like applying the raw manifests of CRDs and
+// namespaces that the chart relies on. Unlike chart hooks, it is run by helmfile, against the kube context and the namespace
+// of the release.
+// Either Apply or Args must be specified.
+type KubectlHook struct {
+	// Name is shown in logs and errors. It defaults to the kubectl command
+	Name string `yaml:"name,omitempty"`
+
+	// Events is the events to run the hook on, which are either `presync` or `postsync`
+	Events []string `yaml:"events"`
+
+	// Apply is the paths or URLs to the manifests applied via `kubectl apply -f`.
+	// A relative path is resolved against the directory of the helmfile defining the release
+	Apply []string `yaml:"apply,omitempty"`
+
+	// Args is the arguments to an arbitrary kubectl command, like `[rollout, status, deployment/myapp]`
+	Args []string `yaml:"args,omitempty"`
+}
+
+// kubectlArgs returns the arguments to kubectl, followed by the kube context and the namespace of the release
+func (st *HelmState) kubectlArgs(h KubectlHook, release ReleaseSpec) ([]string, error) {
+	var args []string
+
+	switch {
+	case len(h.Apply) > 0 && len(h.Args) > 0:
+		return nil, errors.New("either apply or args must be specified, but not both")
+	case len(h.Apply) > 0:
+		storage := st.releaseStorage(&release)
+		args = append(args, "apply")
+		for _, f := range h.Apply {
+			args = append(args, "-f", storage.normalizePath(f))
+		}
+	case len(h.Args) > 0:
+		args = append(args, h.Args...)
+	default:
+		return nil, errors.New("either apply or args must be specified")
+	}
+
+	if release.KubeContext != "" {
+		args = append(args, "--context", release.KubeContext)
+	} else if st.HelmDefaults.KubeContext != "" {
+		args = append(args, "--context", st.HelmDefaults.KubeContext)
+	}
+
+	if ns := st.ReleaseNamespace(&release); ns != "" {
+		args = append(args, "--namespace", ns)
+	}
+
+	return args, nil
+}
+
+func (h KubectlHook) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if len(h.Apply) > 0 {
+		return "apply"
+	}
+	if len(h.Args) > 0 {
+		return h.Args[0]
+	}
+	return ""
+}
+
+// runKubectlHooks runs the kubectl hooks of the release on the event in order, stopping at the first failure.
+// Releases with `installed: false` never run them, as they are going to be uninstalled.
+func (st *HelmState) runKubectlHooks(release ReleaseSpec, evt string, logger *zap.SugaredLogger) error {
+	if !release.Desired() {
+		return nil
+	}
+
+	runner := st.runner
+	if runner == nil {
+		runner = helmexec.ShellRunner{Dir: st.basePath}
+	}
+
+	for _, h := range release.KubectlHooks {
+		contained := false
+		for _, e := range h.Events {
+			if e != KubectlHookPresync && e != KubectlHookPostsync {
+				return fmt.Errorf("kubectl hook %q: unknown event %q: it must be either %s or %s", h.name(), e, KubectlHookPresync, KubectlHookPostsync)
+			}
+			contained = contained || e == evt
+		}
+		if !contained {
+			continue
+		}
+
+		args, err := st.kubectlArgs(h, release)
+		if err != nil {
+			return fmt.Errorf("kubectl hook %q: %v", h.name(), err)
+		}
+
+		logger.Debugf("kubectl hook[%s]: triggered by event %q", h.name(), evt)
+
+		out, err := runner.Execute("kubectl", args, map[string]string{})
+		logger.Debugf("kubectl hook[%s]: %s", h.name(), string(out))
+		if err != nil {
+			return fmt.Errorf("kubectl hook %q failed: %v", h.name(), err)
+		}
+	}
+
+	return nil
+}
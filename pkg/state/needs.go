@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Needs is the releases that a release depends on, each in the [TILLER_NS/][NS/]NAME form prefixed with SoftNeedPrefix when it is soft.
+//
+// In YAML, each of them can also be written as an object carrying the semantics of the dependency along with it, like:
+//
+//	needs:
+//	- ns/name
+//	- release: ns/other
+//	  ignoreFailure: true
+//
+// which is normalized to `["ns/name", "?ns/other"]`. Entries without ignoreFailure are hard dependencies, as plain strings are.
+//
+// An entry prefixed with LabelNeedPrefix, like `label:tier=data`, refers to all the releases matching the label selector.
+//
+// Empty and whitespace-only entries are dropped, so that an entry can be conditionally rendered like
+// `- {{ if ne .Environment.Name "dev" }}db{{ end }}` without making the release depend on a nonexistent one.
+type Needs []string
+
+// needSpec is the object form of an entry of Needs
+type needSpec struct {
+	// Release is the [TILLER_NS/][NS/]NAME of the release needed
+	Release string `yaml:"release"`
+	// IgnoreFailure makes the need soft, so that the release is processed even when the release needed failed
+	IgnoreFailure bool `yaml:"ignoreFailure,omitempty"`
+}
+
+// UnmarshalYAML accepts both the string and the object forms of the entries
+func (n *Needs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var entries []needEntry
+	if err := unmarshal(&entries); err != nil {
+		return err
+	}
+
+	needs := make(Needs, 0, len(entries))
+	for _, e := range entries {
+		if e == "" {
+			continue
+		}
+		needs = append(needs, string(e))
+	}
+
+	*n = needs
+
+	return nil
+}
+
+// needEntry is an entry of Needs normalized to the string form
+type needEntry string
+
+func (e *needEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*e = needEntry(strings.TrimSpace(s))
+		return nil
+	}
+
+	var spec needSpec
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+
+	if spec.Release == "" {
+		return fmt.Errorf("missing release in needs entry %+v: it must be in the form of [TILLER_NS/][NS/]NAME", spec)
+	}
+
+	if spec.IgnoreFailure {
+		*e = needEntry(SoftNeedPrefix + spec.Release)
+	} else {
+		*e = needEntry(spec.Release)
+	}
+
+	return nil
+}
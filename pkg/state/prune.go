@@ -0,0 +1,177 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+)
+
+// ReleaseRef is where a release is installed, which tells the releases defined in helmfiles and the ones installed in clusters
+// apart from each other. An empty KubeContext is the current kube context
+type ReleaseRef struct {
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace,omitempty"`
+	KubeContext string `json:"kubeContext,omitempty"`
+}
+
+func (r ReleaseRef) key() string {
+	return r.KubeContext + "/" + r.Namespace + "/" + r.Name
+}
+
+// DefinedReleaseRefs returns where the releases defined in the helmfile are installed, including the ones filtered out by selectors
+// and the ones with `installed: false`, as they are all managed by the helmfile
+func (st *HelmState) DefinedReleaseRefs() []ReleaseRef {
+	var refs []ReleaseRef
+
+	for _, releases := range [][]ReleaseSpec{st.Releases, st.filteredOutReleases} {
+		for i := range releases {
+			r := &releases[i]
+			if r.Noop() {
+				continue
+			}
+			refs = append(refs, ReleaseRef{Name: r.Name, Namespace: st.ReleaseNamespace(r), KubeContext: st.releaseKubeContext(r)})
+		}
+	}
+
+	return refs
+}
+
+func (st *HelmState) releaseKubeContext(r *ReleaseSpec) string {
+	if r.KubeContext != "" {
+		return r.KubeContext
+	}
+	return st.HelmDefaults.KubeContext
+}
+
+// ListInstalledReleases lists the releases installed in the namespaces the releases of the helmfile are installed into, which
+// match the label selector like `managed-by=helmfile` when given. Selecting releases by labels requires helm 3.
+//
+// The namespace of the current kube context is never listed, as the releases installed there can't be told apart from the ones
+// installed into the namespace by its name.
+func (st *HelmState) ListInstalledReleases(helm helmexec.Interface, selector string) ([]ReleaseRef, error) {
+	if selector != "" && !isHelm3() {
+		return nil, errors.New("selecting releases by labels requires helm 3. run with an empty label selector to list all the releases in the namespaces")
+	}
+
+	var scopes []ReleaseRef
+	listed := map[string]bool{}
+	for _, r := range st.DefinedReleaseRefs() {
+		scope := ReleaseRef{Namespace: r.Namespace, KubeContext: r.KubeContext}
+		if scope.Namespace == "" || listed[scope.key()] {
+			continue
+		}
+		listed[scope.key()] = true
+		scopes = append(scopes, scope)
+	}
+
+	var installed []ReleaseRef
+
+	for _, scope := range scopes {
+		release := &ReleaseSpec{Namespace: scope.Namespace, KubeContext: scope.KubeContext}
+
+		// All the releases are listed regardless of their statuses, like failed ones, and without the default limit on the number of them,
+		// not to miss any orphan
+		flags := append(st.connectionFlags(release), "--namespace", scope.Namespace, "--all", "--max", "0", "--output", "json")
+		if selector != "" {
+			flags = append(flags, "--selector", selector)
+		}
+
+		out, err := helm.List(st.createHelmContext(release, 0), "", flags...)
+		if err != nil {
+			return nil, err
+		}
+
+		names, err := parseReleaseList(out)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list releases in %s: %v", scope.Namespace, err)
+		}
+
+		for _, name := range names {
+			installed = append(installed, ReleaseRef{Name: name, Namespace: scope.Namespace, KubeContext: scope.KubeContext})
+		}
+	}
+
+	return installed, nil
+}
+
+// parseReleaseList reads the names of the releases from the output of `helm list --output json`, which is an array for helm 3,
+// or an object with `Releases` for helm 2, or nothing for helm 2 when no release is found
+func parseReleaseList(out string) ([]string, error) {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return nil, nil
+	}
+
+	type listed struct {
+		Name string `json:"name"`
+	}
+
+	var releases []listed
+	if strings.HasPrefix(out, "[") {
+		if err := json.Unmarshal([]byte(out), &releases); err != nil {
+			return nil, err
+		}
+	} else {
+		var list struct {
+			Releases []listed `json:"releases"`
+		}
+		if err := json.Unmarshal([]byte(out), &list); err != nil {
+			return nil, err
+		}
+		releases = list.Releases
+	}
+
+	names := make([]string, len(releases))
+	for i, r := range releases {
+		names[i] = r.Name
+	}
+
+	return names, nil
+}
+
+// FindOrphanedReleases returns the installed releases that are not defined in any of the helmfiles, sorted by their kube contexts,
+// namespaces and names.
+//
+// A release installed with the same name as a release defined without namespace in the same kube context is never orphaned,
+// as it can't be told whether the defined one is installed into the namespace.
+func FindOrphanedReleases(defined, installed []ReleaseRef) []ReleaseRef {
+	definedKeys := map[string]bool{}
+	for _, d := range defined {
+		definedKeys[d.key()] = true
+	}
+
+	var orphans []ReleaseRef
+	found := map[string]bool{}
+	for _, r := range installed {
+		if definedKeys[r.key()] || definedKeys[ReleaseRef{Name: r.Name, KubeContext: r.KubeContext}.key()] || found[r.key()] {
+			continue
+		}
+		found[r.key()] = true
+		orphans = append(orphans, r)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].key() < orphans[j].key()
+	})
+
+	return orphans
+}
+
+// DeleteOrphanedReleases uninstalls the releases, which are purged with helm 2
+func (st *HelmState) DeleteOrphanedReleases(helm helmexec.Interface, orphans []ReleaseRef) []error {
+	var errs []error
+
+	for _, o := range orphans {
+		release := &ReleaseSpec{Name: o.Name, Namespace: o.Namespace, KubeContext: o.KubeContext}
+
+		if err := helm.DeleteRelease(st.createHelmContext(release, 0), o.Name, st.deletionFlags(release, true)...); err != nil {
+			errs = append(errs, newReleaseError(release, err))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,112 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHelmState_ListInstalledReleases(t *testing.T) {
+	state := &HelmState{
+		HelmDefaults: HelmSpec{KubeContext: "default"},
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "web"},
+			{Name: "api", Namespace: "web"},
+			{Name: "db", Namespace: "data", KubeContext: "other"},
+			{Name: "nonamespace"},
+		},
+		logger: logger,
+	}
+
+	helm := &mockHelmExec{
+		lists: map[listKey]string{
+			{flags: "--kube-contextdefault--namespaceweb--all--max0--outputjson"}: `{"Releases":[{"Name":"app"},{"Name":"old"}]}`,
+			{flags: "--kube-contextother--namespacedata--all--max0--outputjson"}:  "",
+		},
+	}
+
+	installed, err := state.ListInstalledReleases(helm, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ReleaseRef{
+		{Name: "app", Namespace: "web", KubeContext: "default"},
+		{Name: "old", Namespace: "web", KubeContext: "default"},
+	}
+	if !reflect.DeepEqual(installed, expected) {
+		t.Errorf("unexpected installed releases:\nexpected=%v\nactual=%v", expected, installed)
+	}
+
+	if _, err := state.ListInstalledReleases(helm, "managed-by=helmfile"); err == nil {
+		t.Error("expected error selecting releases by labels with helm 2")
+	}
+}
+
+func TestParseReleaseList(t *testing.T) {
+	tests := []struct {
+		out      string
+		expected []string
+	}{
+		{out: `[{"name":"app","namespace":"web"},{"name":"old","namespace":"web"}]`, expected: []string{"app", "old"}},
+		{out: `{"Next":"","Releases":[{"Name":"app"}]}`, expected: []string{"app"}},
+		{out: "\n", expected: nil},
+	}
+
+	for _, tt := range tests {
+		actual, err := parseReleaseList(tt.out)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("unexpected names for %q: expected=%v, actual=%v", tt.out, tt.expected, actual)
+		}
+	}
+}
+
+func TestFindOrphanedReleases(t *testing.T) {
+	defined := []ReleaseRef{
+		{Name: "app", Namespace: "web"},
+		{Name: "db", Namespace: "data", KubeContext: "other"},
+		{Name: "nonamespace"},
+	}
+
+	installed := []ReleaseRef{
+		{Name: "app", Namespace: "web"},
+		{Name: "old", Namespace: "web"},
+		{Name: "db", Namespace: "data"},
+		{Name: "db", Namespace: "data", KubeContext: "other"},
+		{Name: "nonamespace", Namespace: "web"},
+		{Name: "nonamespace", Namespace: "web", KubeContext: "other"},
+		{Name: "old", Namespace: "web"},
+	}
+
+	expected := []ReleaseRef{
+		{Name: "db", Namespace: "data"},
+		{Name: "old", Namespace: "web"},
+		{Name: "nonamespace", Namespace: "web", KubeContext: "other"},
+	}
+
+	actual := FindOrphanedReleases(defined, installed)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected orphans:\nexpected=%v\nactual=%v", expected, actual)
+	}
+}
+
+func TestHelmState_DeleteOrphanedReleases(t *testing.T) {
+	state := &HelmState{logger: logger}
+	helm := &mockHelmExec{}
+
+	errs := state.DeleteOrphanedReleases(helm, []ReleaseRef{
+		{Name: "old", Namespace: "web"},
+		{Name: "error", Namespace: "web"},
+	})
+
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := []mockRelease{{name: "old", flags: []string{"--purge"}}}
+	if !reflect.DeepEqual(helm.deleted, expected) {
+		t.Errorf("unexpected deletions:\nexpected=%v\nactual=%v", expected, helm.deleted)
+	}
+}
@@ -0,0 +1,162 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultReadinessProbeTimeout is the number of seconds to wait for a readiness probe to pass when its timeout is unspecified
+	DefaultReadinessProbeTimeout = 300
+	// DefaultReadinessProbeInterval is the number of seconds between attempts of a readiness probe when its interval is unspecified
+	DefaultReadinessProbeInterval = 5
+)
+
+// ReadinessProbe is a precondition of a release that is not managed by helmfile, like an external database.
+// It is attempted before the release is processed, repeatedly until it passes or times out.
+// Either Command or HTTPGet must be specified.
+type ReadinessProbe struct {
+	// Name is shown in logs and errors. It defaults to the command or the URL
+	Name string `yaml:"name,omitempty"`
+
+	// Command is run with Args in the directory of the helmfile. The probe passes when it exits with the status 0
+	Command string   `yaml:"command,omitempty"`
+	Args    []string `yaml:"args,omitempty"`
+
+	// HTTPGet is the URL to send GET requests to. The probe passes when the response has a 2xx status.
+	// Each request times out after the interval.
+	HTTPGet string `yaml:"httpGet,omitempty"`
+
+	// Timeout is the number of seconds to wait for the probe to pass since the first attempt. See DefaultReadinessProbeTimeout
+	Timeout int `yaml:"timeout,omitempty"`
+
+	// Interval is the number of seconds between attempts. See DefaultReadinessProbeInterval
+	Interval int `yaml:"interval,omitempty"`
+}
+
+func (p ReadinessProbe) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	if p.Command != "" {
+		return p.Command
+	}
+	return p.HTTPGet
+}
+
+// validate checks that the probe can be attempted, so that a misconfigured probe fails immediately instead of being
+// attempted until it times out
+func (p ReadinessProbe) validate() error {
+	switch {
+	case p.Command != "" && p.HTTPGet != "":
+		return errors.New("either command or httpGet must be specified, but not both")
+	case p.Command == "" && p.HTTPGet == "":
+		return errors.New("either command or httpGet must be specified")
+	case p.HTTPGet != "":
+		u, err := url.Parse(p.HTTPGet)
+		if err != nil {
+			return fmt.Errorf("invalid httpGet %q: %v", p.HTTPGet, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid httpGet %q: it must be an absolute http or https URL", p.HTTPGet)
+		}
+	}
+	return nil
+}
+
+// ValidateReadinessProbes checks the `waitFor` of all the releases, so that a misconfigured probe fails the helmfile
+// when it is loaded, before any release is processed.
+func (st *HelmState) ValidateReadinessProbes() error {
+	for _, r := range st.Releases {
+		for i, p := range r.WaitFor {
+			if err := p.validate(); err != nil {
+				return fmt.Errorf("release %q has invalid waitFor[%d]: %v", r.Name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// waitForReadiness attempts the readiness probes of the release in order, each until it passes or times out.
+// It returns the error of the first probe timed out, so that the release is not processed.
+// Releases with `installed: false` are never blocked by their preconditions, as they are going to be uninstalled.
+func (st *HelmState) waitForReadiness(release ReleaseSpec, logger *zap.SugaredLogger) error {
+	if !release.Desired() {
+		return nil
+	}
+
+	for _, p := range release.WaitFor {
+		if err := st.waitForProbe(p, logger); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *HelmState) waitForProbe(p ReadinessProbe, logger *zap.SugaredLogger) error {
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("readiness probe %q is invalid: %v", p.name(), err)
+	}
+
+	timeout := time.Duration(p.Timeout) * time.Second
+	if p.Timeout <= 0 {
+		timeout = DefaultReadinessProbeTimeout * time.Second
+	}
+	interval := time.Duration(p.Interval) * time.Second
+	if p.Interval <= 0 {
+		interval = DefaultReadinessProbeInterval * time.Second
+	}
+
+	sleep := st.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+
+	deadline := st.clock().Now().Add(timeout)
+
+	for attempt := 1; ; attempt++ {
+		err := st.attemptProbe(p, interval)
+		if err == nil {
+			logger.Debugf("readiness probe %q passed at attempt %d", p.name(), attempt)
+			return nil
+		}
+
+		if st.clock().Now().Add(interval).After(deadline) {
+			return fmt.Errorf("readiness probe %q did not pass within %s: %v", p.name(), timeout, err)
+		}
+
+		logger.Infof("waiting for readiness probe %q to pass: attempt %d failed: %v", p.name(), attempt, err)
+
+		sleep(interval)
+	}
+}
+
+func (st *HelmState) attemptProbe(p ReadinessProbe, interval time.Duration) error {
+	if p.Command != "" {
+		runner := st.runner
+		if runner == nil {
+			runner = helmexec.ShellRunner{Dir: st.basePath}
+		}
+		if _, err := runner.Execute(p.Command, p.Args, map[string]string{}); err != nil {
+			return fmt.Errorf("command `%s` failed: %v", p.Command, err)
+		}
+		return nil
+	}
+
+	client := &http.Client{Timeout: interval}
+	res, err := client.Get(p.HTTPGet)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("GET %s returned %s", p.HTTPGet, res.Status)
+	}
+	return nil
+}
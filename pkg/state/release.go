@@ -196,9 +196,36 @@ func (r ReleaseSpec) Clone() (*ReleaseSpec, error) {
 		return nil, fmt.Errorf("failed cloning release \"%s\": %v", r.Name, err)
 	}
 
+	deserialized.SourceFile = r.SourceFile
+	deserialized.BaseDir = r.BaseDir
+
 	return &deserialized, nil
 }
 
 func (r ReleaseSpec) Desired() bool {
 	return r.Installed == nil || *r.Installed
 }
+
+// DryRun reports whether the release is synced in the dry-run mode, so that helm only renders what would be changed.
+func (r ReleaseSpec) DryRun() bool {
+	return r.DryRunMode != nil && *r.DryRunMode
+}
+
+// ReleaseTypeNoop is the type of a release that deploys nothing but orders the releases needing it. See ReleaseSpec.Type
+const ReleaseTypeNoop = "noop"
+
+// Noop reports whether the release deploys nothing, so that helm is never run for it.
+func (r ReleaseSpec) Noop() bool {
+	return r.Type == ReleaseTypeNoop
+}
+
+// ValidateReleaseTypes checks that the type of every release is either omitted or ReleaseTypeNoop, so that a release of
+// an unknown type fails the helmfile when it is loaded, instead of being deployed as a usual release.
+func (st *HelmState) ValidateReleaseTypes() error {
+	for _, r := range st.Releases {
+		if r.Type != "" && !r.Noop() {
+			return fmt.Errorf("release %q has unknown type %q. it must be either omitted or %q", r.Name, r.Type, ReleaseTypeNoop)
+		}
+	}
+	return nil
+}
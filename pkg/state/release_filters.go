@@ -4,8 +4,14 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/Masterminds/semver"
 )
 
+// chartVersionLabel is the pseudo label to select releases by the versions of their charts.
+// Its value in a selector is a semver constraint like `1.2.3`, `1.2.x`, `~1.2.0` or `>=1.2.0`.
+const chartVersionLabel = "chartVersion"
+
 // ReleaseFilter is used to determine if a given release should be used during helmfile execution
 type ReleaseFilter interface {
 	// Match returns true if the ReleaseSpec matches the Filter
@@ -17,6 +23,62 @@ type ReleaseFilter interface {
 type LabelFilter struct {
 	positiveLabels [][]string
 	negativeLabels [][]string
+
+	// inLabels matches a release whose label has one of the values, for cases such as tier in (frontend,backend)
+	inLabels []labelSet
+	// notInLabels matches a release whose label is missing or has none of the values, for cases such as tier notin (frontend,backend)
+	notInLabels []labelSet
+}
+
+type labelSet struct {
+	key    string
+	values []string
+}
+
+func (s labelSet) contains(r ReleaseSpec, rVal string) bool {
+	for _, value := range s.values {
+		if labelValueMatches(r, s.key, rVal, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// labelValue returns the value of the label of the release, and whether the release has the label.
+// The value of chartVersionLabel is the version of the chart, which is missing when the version is not specified.
+func labelValue(r ReleaseSpec, k string) (string, bool) {
+	if k == chartVersionLabel {
+		return r.Version, r.Version != ""
+	}
+	v, ok := r.Labels[k]
+	return v, ok
+}
+
+// labelValueMatches reports whether the value of the label of the release matches the value in the selector.
+//
+// Besides the exact match, the `chart` label matches the full chart reference like `stable/nginx` as well as the chart name,
+// and chartVersionLabel matches the version satisfying the semver constraint.
+func labelValueMatches(r ReleaseSpec, k, rVal, v string) bool {
+	if rVal == v {
+		return true
+	}
+
+	switch k {
+	case "chart":
+		return r.Chart == v
+	case chartVersionLabel:
+		c, err := semver.NewConstraint(v)
+		if err != nil {
+			return false
+		}
+		ver, err := semver.NewVersion(rVal)
+		if err != nil {
+			return false
+		}
+		return c.Check(ver)
+	}
+
+	return false
 }
 
 // Match will match a release that has the same labels as the filter
@@ -25,9 +87,9 @@ func (l LabelFilter) Match(r ReleaseSpec) bool {
 		for _, element := range l.positiveLabels {
 			k := element[0]
 			v := element[1]
-			if rVal, ok := r.Labels[k]; !ok {
+			if rVal, ok := labelValue(r, k); !ok {
 				return false
-			} else if rVal != v {
+			} else if !labelValueMatches(r, k, rVal, v) {
 				return false
 			}
 		}
@@ -37,33 +99,99 @@ func (l LabelFilter) Match(r ReleaseSpec) bool {
 		for _, element := range l.negativeLabels {
 			k := element[0]
 			v := element[1]
-			if rVal, ok := r.Labels[k]; !ok {
-				return true
-			} else if rVal == v {
+			if rVal, ok := labelValue(r, k); !ok {
+				continue
+			} else if labelValueMatches(r, k, rVal, v) {
 				return false
 			}
 		}
 	}
+
+	for _, s := range l.inLabels {
+		if rVal, ok := labelValue(r, s.key); !ok || !s.contains(r, rVal) {
+			return false
+		}
+	}
+
+	for _, s := range l.notInLabels {
+		if rVal, ok := labelValue(r, s.key); ok && s.contains(r, rVal) {
+			return false
+		}
+	}
+
 	return true
 }
 
-// ParseLabels takes a label in the form foo=bar,baz!=bat and returns a LabelFilter that will match the labels
+// labelValuePattern matches a label value, which can be a chart reference like `stable/nginx` or a semver constraint like `~1.2.0` or `>=1.2.0`
+const labelValuePattern = `(?:[<>]=?|[~^])?[a-zA-Z0-9_./*+-]+`
+
+var (
+	negativeLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+!=` + labelValuePattern + `$`)
+	positiveLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+=` + labelValuePattern + `$`)
+	labelSetRegexp      = regexp.MustCompile(`^([a-zA-Z0-9_-]+)\s+(in|notin)\s+\(([a-zA-Z0-9_,\s./*+~^<>=-]*)\)$`)
+)
+
+// ParseLabels takes a label in the form foo=bar,baz!=bat,qux in (a,b),quux notin (c,d) and returns a LabelFilter that will match the labels
 func ParseLabels(l string) (LabelFilter, error) {
 	lf := LabelFilter{}
 	lf.positiveLabels = [][]string{}
 	lf.negativeLabels = [][]string{}
 	var err error
-	labels := strings.Split(l, ",")
+	labels := splitLabels(l)
 	for _, label := range labels {
-		if match, _ := regexp.MatchString("^[a-zA-Z0-9_-]+!=[a-zA-Z0-9_-]+$", label); match == true { // k!=v case
-			kv := strings.Split(label, "!=")
+		if negativeLabelRegexp.MatchString(label) { // k!=v case
+			kv := strings.SplitN(label, "!=", 2)
 			lf.negativeLabels = append(lf.negativeLabels, kv)
-		} else if match, _ := regexp.MatchString("^[a-zA-Z0-9_-]+=[a-zA-Z0-9_-]+$", label); match == true { // k=v case
-			kv := strings.Split(label, "=")
+		} else if positiveLabelRegexp.MatchString(label) { // k=v case
+			kv := strings.SplitN(label, "=", 2)
 			lf.positiveLabels = append(lf.positiveLabels, kv)
+		} else if s, op, ok := parseLabelSet(label); ok { // k in (v1,v2) and k notin (v1,v2) cases
+			if op == "in" {
+				lf.inLabels = append(lf.inLabels, s)
+			} else {
+				lf.notInLabels = append(lf.notInLabels, s)
+			}
 		} else { // malformed case
-			return lf, fmt.Errorf("Malformed label: %s. Expected label in form k=v or k!=v", label)
+			return lf, fmt.Errorf("Malformed label: %s. Expected label in form k=v, k!=v, k in (v1,v2) or k notin (v1,v2)", label)
 		}
 	}
 	return lf, err
 }
+
+// splitLabels splits the labels by commas, except the ones separating values of a set like (v1,v2)
+func splitLabels(l string) []string {
+	var labels []string
+	var depth, start int
+	for i, c := range l {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				labels = append(labels, strings.TrimSpace(l[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(labels, strings.TrimSpace(l[start:]))
+}
+
+func parseLabelSet(label string) (labelSet, string, bool) {
+	m := labelSetRegexp.FindStringSubmatch(label)
+	if m == nil {
+		return labelSet{}, "", false
+	}
+
+	s := labelSet{key: m[1]}
+	for _, v := range strings.Split(m[3], ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			return labelSet{}, "", false
+		}
+		s.values = append(s.values, v)
+	}
+
+	return s, m[2], true
+}
@@ -0,0 +1,207 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/imdario/mergo"
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
+	"github.com/roboll/helmfile/pkg/remote"
+	"gopkg.in/yaml.v2"
+)
+
+// ReleaseValues returns the values the release receives from helmfile, merged in the order helm merges them: the values entries,
+// then the decrypted secrets files, then the `set` entries, so that later ones win.
+//
+// Values files are rendered with the environment values of the state and the references to secrets are resolved via vals,
+// exactly like for `helm upgrade`, so that the result is what the chart actually gets without running helm against the cluster.
+// Secrets files are still decrypted via helm-secrets, and the decrypted files are removed by Clean.
+func (st *HelmState) ReleaseValues(helm helmexec.Interface, release *ReleaseSpec) (map[string]interface{}, error) {
+	result, err := st.MergedValuesEntries(release)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, value := range release.Secrets {
+		if strings.HasPrefix(value, ValsRefPrefix) {
+			vals, err := st.resolveValsSecret(release, value)
+			if err != nil {
+				return nil, err
+			}
+			if err := mergeValues(result, release, fmt.Sprintf("secret %q", value), vals); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		path, skip, err := st.decryptSecret(helm, release, 0, value)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			continue
+		}
+
+		bytes, err := st.readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeValuesFile(result, release, value, bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, set := range release.SetValues {
+		switch {
+		case set.Value != "":
+			rendered, err := renderValsSecrets(st.valsRuntime, set.Value)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to render set value entry in %s for release %s: %v", st.FilePath, release.Name, err)
+			}
+			setValue(result, set.Name, parseSetValue(rendered[0]))
+		case set.File != "":
+			bytes, err := st.readFile(st.releaseStorage(release).normalizePath(set.File))
+			if err != nil {
+				return nil, err
+			}
+			setValue(result, set.Name, string(bytes))
+		case len(set.Values) > 0:
+			rendered, err := renderValsSecrets(st.valsRuntime, set.Values...)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to render set values entry in %s for release %s: %v", st.FilePath, release.Name, err)
+			}
+			items := make([]interface{}, len(rendered))
+			for i, v := range rendered {
+				items[i] = parseSetValue(v)
+			}
+			setValue(result, set.Name, items)
+		}
+	}
+
+	return result, nil
+}
+
+// MergedValuesEntries returns the values entries of the release merged in the order, without the secrets files and the `set` entries.
+// Values files are rendered and the references to secrets are resolved as ReleaseValues does.
+func (st *HelmState) MergedValuesEntries(release *ReleaseSpec) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	entries, err := st.releaseValuesEntries(release)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		switch typedValue := entry.(type) {
+		case string:
+			path, bytes, skip, err := st.renderValuesFile(release.MissingFileHandler, typedValue)
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				continue
+			}
+			if err := mergeValuesFile(result, release, path, bytes); err != nil {
+				return nil, err
+			}
+		case map[interface{}]interface{}, map[string]interface{}:
+			if err := mergeValues(result, release, "inline values", typedValue); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected type of value: value=%v, type=%T", typedValue, typedValue)
+		}
+	}
+
+	return result, nil
+}
+
+// ReleaseValuesFiles returns the paths to the local values and secrets files of the release, resolved against the directory of
+// the helmfile defining the release like when the release is processed, without reading them. Glob patterns are returned as-is.
+// Remote files and references to secrets like `ref+vault://...` are excluded, as they aren't local files.
+func (st *HelmState) ReleaseValuesFiles(release *ReleaseSpec) []string {
+	var files []string
+
+	add := func(f string) {
+		if remote.IsRemote(f) || strings.HasPrefix(f, ValsRefPrefix) {
+			return
+		}
+		files = append(files, st.releaseStorage(release).normalizePath(release.ValuesPathPrefix+f))
+	}
+
+	for _, v := range release.Values {
+		if f, ok := v.(string); ok {
+			add(f)
+		}
+	}
+	for _, f := range release.Secrets {
+		add(f)
+	}
+
+	return files
+}
+
+func mergeValues(result map[string]interface{}, release *ReleaseSpec, desc string, values interface{}) error {
+	m, err := maputil.CastKeysToStrings(values)
+	if err != nil {
+		return fmt.Errorf("failed to merge %s of release %q: %v", desc, release.Name, err)
+	}
+	if err := mergo.Merge(&result, &m, mergo.WithOverride); err != nil {
+		return fmt.Errorf("failed to merge %s of release %q: %v", desc, release.Name, err)
+	}
+	return nil
+}
+
+func mergeValuesFile(result map[string]interface{}, release *ReleaseSpec, path string, bytes []byte) error {
+	m := map[interface{}]interface{}{}
+	if err := yaml.Unmarshal(bytes, &m); err != nil {
+		return fmt.Errorf("failed to load values file \"%s\" of release %q: %v", path, release.Name, err)
+	}
+	return mergeValues(result, release, path, m)
+}
+
+// parseSetValue parses the value of a `set` entry as YAML, so that numbers, booleans and null keep their types like with `helm --set`.
+// Anything else, including what YAML would read as a map or a list, is kept as the string.
+func parseSetValue(value string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil {
+		return value
+	}
+	switch v.(type) {
+	case int, int64, uint64, float64, bool, nil:
+		return v
+	}
+	return value
+}
+
+// setValue sets the value at the path given as the name of a `set` entry, like `a.b.c`, creating the intermediate maps.
+// A dot escaped like `a\.b` is part of the key, consistently with `helm --set`.
+func setValue(values map[string]interface{}, name string, value interface{}) {
+	var keys []string
+	var key strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name) && name[i+1] == '.':
+			key.WriteByte('.')
+			i++
+		case name[i] == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(name[i])
+		}
+	}
+	keys = append(keys, key.String())
+
+	m := values
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := m[k].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			m[k] = next
+		}
+		m = next
+	}
+	m[keys[len(keys)-1]] = value
+}
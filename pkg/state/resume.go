@@ -0,0 +1,166 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RunProgress is the outcomes of the releases processed by a failed run, recorded so that the next run can resume from
+// the failed releases instead of processing all the releases again. See SelectUnfinishedReleases for more details.
+type RunProgress struct {
+	// Command is the helmfile command of the run, like `sync`
+	Command string `yaml:"command"`
+
+	// Hashes is the hashes of the inputs of the releases processed by the run, to tell whether the helmfile changed since then
+	Hashes ReleaseHashes `yaml:"hashes"`
+
+	// Succeeded is the [TILLER_NS/][NS/]NAME of the releases synced or deleted successfully by the run
+	Succeeded []string `yaml:"succeeded"`
+}
+
+// Record adds the releases synced or deleted successfully to the succeeded ones
+func (p *RunProgress) Record(affected *AffectedReleases) {
+	succeeded := map[string]bool{}
+	for _, id := range p.Succeeded {
+		succeeded[id] = true
+	}
+
+	for _, releases := range [][]*ReleaseSpec{affected.Upgraded, affected.Deleted} {
+		for _, r := range releases {
+			id := releaseToID(r)
+			if !succeeded[id] {
+				succeeded[id] = true
+				p.Succeeded = append(p.Succeeded, id)
+			}
+		}
+	}
+
+	sort.Strings(p.Succeeded)
+}
+
+// runProgressFileName returns the file to record the progress of a failed run in, which is `<NAME>.progress` next to `<NAME>.yaml`
+func (st *HelmState) runProgressFileName() string {
+	return st.siblingFileName("progress")
+}
+
+// LoadRunProgress reads the progress recorded by the last failed run. It returns nil when there's no record.
+func (st *HelmState) LoadRunProgress() (*RunProgress, error) {
+	file := st.runProgressFileName()
+
+	exists, err := st.fileExists(file)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	bs, err := st.readFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var progress RunProgress
+	if err := yaml.Unmarshal(bs, &progress); err != nil {
+		return nil, fmt.Errorf("failed to read run progress from %s: %v", file, err)
+	}
+
+	return &progress, nil
+}
+
+// SaveRunProgress records the progress of the failed run for the next run to resume from.
+func (st *HelmState) SaveRunProgress(progress *RunProgress) error {
+	bs, err := yaml.Marshal(progress)
+	if err != nil {
+		return err
+	}
+
+	file := st.runProgressFileName()
+
+	if err := ioutil.WriteFile(file, bs, 0644); err != nil {
+		return fmt.Errorf("failed to write run progress to %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// RemoveRunProgress removes the progress recorded by the last failed run, once a run succeeds.
+func (st *HelmState) RemoveRunProgress() error {
+	file := st.runProgressFileName()
+
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove run progress %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// SelectUnfinishedReleases narrows the releases down to the ones not succeeded by the last failed run of the command,
+// so that the run resumes from the group of releases that failed. The releases left out are treated like ones filtered out
+// by selectors, so that they are still taken into account in ordering the remaining releases.
+//
+// The previous progress is ignored, processing all the releases, when it's nil or recorded by another command, or when the
+// inputs of any release changed since the failed run, as the releases succeeded by the run may be outdated.
+// See ReleaseInputsHash for what the inputs are.
+// It returns the progress of this run, carrying over the releases succeeded by the failed run, to be recorded via
+// SaveRunProgress when this run fails too.
+func (st *HelmState) SelectUnfinishedReleases(previous *RunProgress, command string, additionalValues []string, set []string) (*RunProgress, error) {
+	current, err := st.ReleaseInputsHashes(additionalValues, set)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &RunProgress{Command: command, Hashes: current}
+
+	switch {
+	case previous == nil:
+		st.logger.Debugf("no failed run to resume in %s", st.FilePath)
+		return progress, nil
+	case previous.Command != command:
+		st.logger.Warnf("not resuming the failed %s run in %s by %s. processing all the releases", previous.Command, st.FilePath, command)
+		return progress, nil
+	case !previous.Hashes.equal(current):
+		st.logger.Warnf("not resuming the failed run in %s, as the releases changed since the run. processing all the releases", st.FilePath)
+		return progress, nil
+	}
+
+	succeeded := map[string]bool{}
+	for _, id := range previous.Succeeded {
+		succeeded[id] = true
+	}
+
+	var releases, finished []ReleaseSpec
+	for _, r := range st.Releases {
+		id := releaseToID(&r)
+		if succeeded[id] {
+			st.logger.Infof("skipping %q succeeded by the failed run", id)
+			finished = append(finished, r)
+			progress.Succeeded = append(progress.Succeeded, id)
+		} else {
+			releases = append(releases, r)
+		}
+	}
+
+	sort.Strings(progress.Succeeded)
+
+	st.Releases = releases
+	st.filteredOutReleases = append(st.filteredOutReleases, finished...)
+
+	return progress, nil
+}
+
+func (h ReleaseHashes) equal(other ReleaseHashes) bool {
+	if len(h) != len(other) {
+		return false
+	}
+	for id, hash := range h {
+		if other[id] != hash {
+			return false
+		}
+	}
+	return true
+}
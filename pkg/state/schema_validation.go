@@ -0,0 +1,201 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/schema"
+)
+
+// ValidationStatus is the outcome of validating the rendered manifests of a release against the schema
+type ValidationStatus string
+
+const (
+	// ValidationStatusValid is for a release whose manifests conform to the schema
+	ValidationStatusValid ValidationStatus = "valid"
+	// ValidationStatusInvalid is for a release whose manifests violate the schema
+	ValidationStatusInvalid ValidationStatus = "invalid"
+	// ValidationStatusFailed is for a release failed to be validated, like due to an error rendering its chart
+	ValidationStatusFailed ValidationStatus = "failed"
+)
+
+// ReleaseValidation is the outcome of validating the rendered manifests of a release by ValidateManifests
+type ReleaseValidation struct {
+	Release   string           `json:"release"`
+	Namespace string           `json:"namespace,omitempty"`
+	Status    ValidationStatus `json:"status"`
+	// Resources is the number of the resources validated
+	Resources int `json:"resources"`
+	// Skipped is the GROUP/VERSION/KIND of the resources not defined in the schema, like custom resources, which are never validated
+	Skipped    []string           `json:"skipped,omitempty"`
+	Violations []schema.Violation `json:"violations,omitempty"`
+	// Error is the error validating the release, only when Status is ValidationStatusFailed
+	Error string `json:"error,omitempty"`
+}
+
+// ValidationReport aggregates the validations of releases in the order of the releases, along with the number of releases per status
+type ValidationReport struct {
+	Releases []ReleaseValidation `json:"releases"`
+	Valid    int                 `json:"valid"`
+	Invalid  int                 `json:"invalid"`
+	Failed   int                 `json:"failed"`
+}
+
+// Add appends the validation of a release to the report, counting it by its status
+func (r *ValidationReport) Add(validations ...ReleaseValidation) {
+	for _, v := range validations {
+		r.Releases = append(r.Releases, v)
+		switch v.Status {
+		case ValidationStatusValid:
+			r.Valid++
+		case ValidationStatusInvalid:
+			r.Invalid++
+		case ValidationStatusFailed:
+			r.Failed++
+		}
+	}
+}
+
+// ValidateManifests renders the manifests of each release via `helm template`, like TemplateReleases, and validates them against
+// the schema of the Kubernetes API without accessing the cluster, so that invalid manifests are caught before applying them,
+// like in CI without a live cluster.
+//
+// Each release violating the schema is returned as a ReleaseError in addition to the report.
+func (st *HelmState) ValidateManifests(helm helmexec.Interface, sch *schema.Schema, additionalValues []string, args []string, workerLimit int, opt ...TemplateOpt) (*ValidationReport, []error) {
+	opts := &TemplateOpts{}
+	for _, o := range opt {
+		o.Apply(opts)
+	}
+
+	report := &ValidationReport{}
+
+	// Reset the extra args if already set, not to break `helm fetch` by adding the args intended for `template`
+	helm.SetExtraArgs()
+
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		return report, []error{err}
+	}
+	defer os.RemoveAll(dir)
+
+	temp, errs := st.downloadCharts(helm, dir, workerLimit, "validate-schema")
+	if errs != nil {
+		return report, errs
+	}
+
+	if len(args) > 0 {
+		helm.SetExtraArgs(args...)
+	}
+
+	for i := range st.Releases {
+		release := st.Releases[i]
+
+		if !release.Desired() {
+			st.releaseSkipped(release, SkipReasonNotInstalled)
+			continue
+		}
+
+		if release.Noop() {
+			continue
+		}
+
+		st.applyDefaultsTo(&release)
+
+		validation := ReleaseValidation{Release: release.Name, Namespace: release.Namespace}
+
+		outputDir := filepath.Join(dir, "manifests", strconv.Itoa(i))
+
+		result, err := st.validateReleaseManifests(helm, sch, &release, temp[release.Name], outputDir, additionalValues, opts)
+		switch {
+		case err != nil:
+			validation.Status = ValidationStatusFailed
+			validation.Error = err.Error()
+			errs = append(errs, newReleaseError(&release, err))
+		case len(result.Violations) > 0:
+			validation.Status = ValidationStatusInvalid
+			errs = append(errs, newReleaseError(&release, fmt.Errorf("%d schema violations in the rendered manifests", len(result.Violations))))
+		default:
+			validation.Status = ValidationStatusValid
+		}
+
+		if result != nil {
+			validation.Resources = result.Resources
+			validation.Skipped = result.Skipped
+			validation.Violations = result.Violations
+		}
+
+		report.Add(validation)
+
+		if _, err := st.triggerCleanupEvent(&release, "validate-schema"); err != nil {
+			st.logger.Warnf("warn: %v\n", err)
+		}
+	}
+
+	return report, errs
+}
+
+func (st *HelmState) validateReleaseManifests(helm helmexec.Interface, sch *schema.Schema, release *ReleaseSpec, chart, outputDir string, additionalValues []string, opts *TemplateOpts) (*schema.Result, error) {
+	flags, err := st.flagsForTemplate(helm, release, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	flags, errs := appendTemplateValuesFlags(flags, additionalValues, opts.Set)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+
+	flags = append(flags, "--output-dir", outputDir)
+
+	if err := releaseHelm(helm, release).TemplateRelease(release.Name, chart, flags...); err != nil {
+		return nil, err
+	}
+
+	manifests, err := readManifests(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return sch.Validate(manifests)
+}
+
+// readManifests concatenates the manifests written by `helm template --output-dir` into the directory into a YAML stream
+func readManifests(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		buf.WriteString("---\n")
+		buf.Write(bs)
+		buf.WriteString("\n")
+
+		return nil
+	})
+
+	return buf.Bytes(), err
+}
@@ -7,23 +7,28 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/roboll/helmfile/pkg/environment"
 	"github.com/roboll/helmfile/pkg/event"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/maputil"
+	"github.com/roboll/helmfile/pkg/postrender"
 	"github.com/roboll/helmfile/pkg/remote"
 	"github.com/roboll/helmfile/pkg/tmpl"
-	"github.com/variantdev/dag/pkg/dag"
 
 	"regexp"
 
+	"github.com/Masterminds/semver"
 	"github.com/tatsushid/go-prettytable"
 	"github.com/variantdev/vals"
 	"go.uber.org/zap"
@@ -50,12 +55,123 @@ type HelmState struct {
 	Releases           []ReleaseSpec     `yaml:"releases,omitempty"`
 	Selectors          []string          `yaml:"-"`
 
+	// Groups is the named sets of releases to run by `--group`, keyed by the names of the groups, like `frontend: [web, api]`.
+	// Each release is referred to by its name, or by its ID like `NS/NAME` to tell releases of the same name apart
+	Groups map[string][]string `yaml:"groups,omitempty"`
+
+	// CommonLabels and CommonAnnotations are stamped onto every resource of all the releases by the post-renderer built into
+	// helmfile, e.g. to tell the resources managed by helmfile for auditing and cleanup. The labels and annotations already set
+	// by charts are never overwritten. See appendPostRendererFlags
+	CommonLabels      map[string]string `yaml:"commonLabels,omitempty"`
+	CommonAnnotations map[string]string `yaml:"commonAnnotations,omitempty"`
+
+	// HelmfileBinary is the path to the helmfile binary run by helm as the built-in post-renderer. Defaults to the running executable,
+	// which is the helmfile binary unless helmfile is embedded into another program. See app.App.HelmfileBinary
+	HelmfileBinary string `yaml:"-"`
+
+	// SelectedGroups is the names of the groups of releases to run, given via `--group`. See FilterReleases
+	SelectedGroups []string `yaml:"-"`
+
+	// IncludeGroupNeeds also runs the releases needed by the releases in SelectedGroups, directly or indirectly
+	IncludeGroupNeeds bool `yaml:"-"`
+
+	// Concurrency is the default maximum number of concurrent helm processes for the helmfile, used when neither `--concurrency`
+	// nor the environment's concurrency is specified. It is a string so that it can be rendered from the environment values,
+	// like `concurrency: {{ .Values.deployConcurrency }}`, and is validated to be a non-negative integer on loading.
+	Concurrency string `yaml:"concurrency,omitempty"`
+
+	// PlanMetricsSink, when set, receives the metrics of every DAG of releases planned for processing
+	PlanMetricsSink func(PlanMetrics) `yaml:"-"`
+
+	// ReleaseTimingsSink, when set, receives the durations of processing the releases, slowest first, every time a set of
+	// releases is processed concurrently. That is once per group of releases when processed in the order of `needs`.
+	ReleaseTimingsSink func([]ReleaseTiming) `yaml:"-"`
+
+	// BeforeRelease, when set, is called in the worker right before processing each release, e.g. to acquire a lock or to
+	// send a notification. An error fails the release without processing it.
+	BeforeRelease func(ReleaseSpec) error `yaml:"-"`
+
+	// AfterRelease, when set, is called in the worker right after processing each release, with the error and the duration of
+	// processing it. It is called even when the release failed, including by BeforeRelease.
+	AfterRelease func(ReleaseSpec, error, time.Duration) `yaml:"-"`
+
+	// ReleaseSkipped, when set, is called for each release skipped without being processed, with the reason, so that releases
+	// never silently vanish from the releases processed. It may be called concurrently from workers.
+	ReleaseSkipped func(ReleaseSpec, SkipReason) `yaml:"-"`
+
+	// UseLockedReleases pins releases to the charts and versions recorded in the lock file by `helmfile deps`
+	UseLockedReleases bool `yaml:"-"`
+
+	// ChartCacheDir, when set, is the directory to keep the downloaded charts in across runs, so that a chart of an exact version
+	// is downloaded only once. See chartCachePath for more details.
+	ChartCacheDir string `yaml:"-"`
+
+	// DefaultConcurrency, when greater than 0, caps the number of concurrent helm processes when no concurrency is specified
+	// by `--concurrency` nor the environment. It is 0 by default, which processes all the items at once.
+	DefaultConcurrency int `yaml:"-"`
+
+	// MaxConcurrency, when greater than 0, is the hard ceiling of the number of concurrent helm processes, regardless of
+	// the concurrency specified and the number of releases processed at once, so that a wide group of releases
+	// doesn't exhaust file descriptors by spawning a helm process per release.
+	MaxConcurrency int `yaml:"-"`
+
+	// MaxConcurrencyPerNamespace, when greater than 0, caps the number of releases processed at once per namespace,
+	// independently of the overall concurrency, e.g. to not exceed a namespace's resource quota or to not overwhelm
+	// an admission webhook watching the namespace. It is 0 by default, which is unlimited.
+	MaxConcurrencyPerNamespace int `yaml:"-"`
+
+	// MaxDAGDepth, when greater than 0, fails planning releases into more groups than it, before processing any release.
+	// It guards against deep chains of `needs` that serialize the run, which are often a modeling mistake.
+	MaxDAGDepth int `yaml:"-"`
+
+	// OrderedDispatch, when set to true, hands releases to workers one by one in the order of declaration, each after the
+	// previous one started being processed, so that releases start in a reproducible order even when processed concurrently.
+	OrderedDispatch bool `yaml:"-"`
+
+	// Sequential, when set to true, processes releases one at a time in the order of declaration, or in the reverse order on deletion,
+	// regardless of the groups planned from `needs`, `after`, `before`, `wave` and `priority`.
+	// `needs` are still validated, so that a missing release or a cycle is an error as usual.
+	Sequential bool `yaml:"-"`
+
+	// KeepReleaseOrder, when set to true, processes releases in the same group of the DAG in the order of Releases rather than
+	// by their priorities, so that the order the releases were sorted in by a reverse sort key is kept on deletion.
+	KeepReleaseOrder bool `yaml:"-"`
+
+	// ReleaseWebhook, when set, is notified of the outcome of each release synced, deleted, tested or checked for its status.
+	// See ReleaseWebhook for more details.
+	ReleaseWebhook *ReleaseWebhook `yaml:"-"`
+
+	// ChartFetchRetries is the number of times to retry fetching a chart or updating repository indexes when it failed transiently,
+	// like by a 5xx response or a timeout, so that a flaky repository doesn't fail the whole run. See retryChartFetch for the backoff.
+	ChartFetchRetries int `yaml:"-"`
+
+	// Clock, when set, tells the time used in measuring durations instead of the real time, so that they can be tested without sleeping
+	Clock Clock `yaml:"-"`
+
 	Templates map[string]TemplateSpec `yaml:"templates"`
 
+	// Exports is the values exported to the parent helmfile including this helmfile via `helmfiles` with `importExports: true`.
+	// See SubHelmfileSpec.ImportExports for more details.
+	Exports map[string]interface{} `yaml:"exports,omitempty"`
+
 	Env environment.Environment `yaml:"-"`
 
+	// RemoteFetcher fetches the values and secrets files of the releases referred to by go-getter URLs, returning the paths
+	// to the fetched files. See fetchRemoteFile
+	RemoteFetcher func(string) (string, error) `yaml:"-"`
+
+	// DeterministicSeed, when set, makes the randomized template functions in the values files of the releases return the same
+	// results on every run, like in the helmfile rendered with `--deterministic`. See tmpl.FileRenderer.WithDeterministic
+	DeterministicSeed string `yaml:"-"`
+
 	logger *zap.SugaredLogger
 
+	// filteredOutReleases is the releases not matching the selectors, which are used only for ordering the selected releases
+	filteredOutReleases []ReleaseSpec
+
+	// preparedCharts maps IDs of releases to the paths to their charts downloaded by PrepareCharts
+	preparedCharts map[string]string
+
 	readFile func(string) ([]byte, error)
 
 	removeFile func(string) error
@@ -66,6 +182,9 @@ type HelmState struct {
 	runner      helmexec.Runner
 	helm        helmexec.Interface
 	valsRuntime vals.Evaluator
+
+	// sleep waits between attempts of readiness probes and chart fetches. It defaults to time.Sleep
+	sleep func(time.Duration)
 }
 
 // SubHelmfileSpec defines the subhelmfile path and options
@@ -76,6 +195,14 @@ type SubHelmfileSpec struct {
 	Selectors []string `yaml:"selectors,omitempty"`
 	//do the sub helmfiles inherits from parent selectors
 	SelectorsInherited bool `yaml:"selectorsInherited,omitempty"`
+	//namespace to install all the releases in the sub helmfiles into
+	Namespace string `yaml:"namespace,omitempty"`
+	//condition to include the sub helmfiles, evaluated as a template against the environment. the sub helmfiles are not loaded at all when false
+	Condition string `yaml:"condition,omitempty"`
+	//merge the exports of the sub helmfiles into the environment values, so that the following parts of the parent helmfile can refer to them
+	ImportExports bool `yaml:"importExports,omitempty"`
+	//paths or glob patterns for the files matched by path but not to be loaded as sub helmfiles
+	Excludes []string `yaml:"excludes,omitempty"`
 
 	Environment SubhelmfileEnvironmentSpec
 }
@@ -91,6 +218,12 @@ type HelmSpec struct {
 	Tillerless      bool     `yaml:"tillerless"`
 	Args            []string `yaml:"args,omitempty"`
 	Verify          bool     `yaml:"verify"`
+	// Keyring is the path to the keyring containing the public keys to verify charts with, relative to the helmfile.
+	// It is passed via `--keyring` when verify is enabled. Helm's default keyring is used when omitted
+	Keyring string `yaml:"keyring,omitempty"`
+	// TillerlessAllowConcurrency, when set to true, processes tillerless releases at the requested concurrency.
+	// By default, releases are processed one by one when any of them is tillerless.
+	TillerlessAllowConcurrency bool `yaml:"tillerlessAllowConcurrency"`
 	// Devel, when set to true, use development versions, too. Equivalent to version '>0.0.0-0'
 	Devel bool `yaml:"devel"`
 	// Wait, if set to true, will wait until all Pods, PVCs, Services, and minimum number of Pods of a Deployment are in a ready state before marking the release as successful
@@ -103,6 +236,12 @@ type HelmSpec struct {
 	Force bool `yaml:"force"`
 	// Atomic, when set to true, restore previous state in case of a failed install/upgrade attempt
 	Atomic bool `yaml:"atomic"`
+	// CreateNamespace, when set to true, creates the namespace of the release if it doesn't exist. Requires helm 3.2 or greater
+	CreateNamespace bool `yaml:"createNamespace"`
+	// HistoryMax is the maximum number of revisions helm keeps for each release. 0 keeps them all. Helm's default applies when unset
+	HistoryMax *int `yaml:"historyMax,omitempty"`
+	// SkipDeps, when set to true, never runs `helm dependency build` for the local charts of the releases, like `--skip-deps` does
+	SkipDeps bool `yaml:"skipDeps"`
 
 	TLS       bool   `yaml:"tls"`
 	TLSCACert string `yaml:"tlsCACert,omitempty"`
@@ -127,6 +266,9 @@ type ReleaseSpec struct {
 	Chart   string `yaml:"chart,omitempty"`
 	Version string `yaml:"version,omitempty"`
 	Verify  *bool  `yaml:"verify,omitempty"`
+	// Keyring is the path to the keyring to verify the chart with, relative to the helmfile defining the release.
+	// It defaults to helmDefaults.keyring
+	Keyring string `yaml:"keyring,omitempty"`
 	// Devel, when set to true, use development versions, too. Equivalent to version '>0.0.0-0'
 	Devel *bool `yaml:"devel,omitempty"`
 	// Wait, if set to true, will wait until all Pods, PVCs, Services, and minimum number of Pods of a Deployment are in a ready state before marking the release as successful
@@ -141,16 +283,67 @@ type ReleaseSpec struct {
 	Installed *bool `yaml:"installed,omitempty"`
 	// Atomic, when set to true, restore previous state in case of a failed install/upgrade attempt
 	Atomic *bool `yaml:"atomic,omitempty"`
+	// CreateNamespace, when set to true, passes `--create-namespace` to `helm upgrade --install` to create the namespace of the release
+	// if it doesn't exist. It defaults to helmDefaults.createNamespace when unset. Requires helm 3.2 or greater
+	CreateNamespace *bool `yaml:"createNamespace,omitempty"`
+	// HistoryMax, when set, passes `--history-max` to `helm upgrade --install` to limit the number of revisions kept for the release.
+	// 0 keeps them all. It defaults to helmDefaults.historyMax when unset
+	HistoryMax *int `yaml:"historyMax,omitempty"`
+	// SkipDeps, when set to true, never runs `helm dependency build` for the local chart of the release, e.g. when its dependencies
+	// are already vendored for air-gapped runs. It defaults to helmDefaults.skipDeps when unset
+	SkipDeps *bool `yaml:"skipDeps,omitempty"`
+	// DisableValidation, when set to true, passes `--disable-validation` to `helm diff`, so that the release can be diffed
+	// before the CRDs its manifests rely on are installed, like by another release in the same apply
+	DisableValidation *bool `yaml:"disableValidation,omitempty"`
+	// DisableOpenAPIValidation, when set to true, passes `--disable-openapi-validation` to `helm upgrade` and `helm diff`, so that
+	// manifests are not validated against the Kubernetes OpenAPI schema. Requires helm 3
+	DisableOpenAPIValidation *bool `yaml:"disableOpenAPIValidation,omitempty"`
+	// DryRunMode, when set to true, passes `--dry-run` to `helm upgrade --install` and `helm delete` on syncing the release, so that
+	// it can be inspected without being applied while the other releases are applied normally. Its hooks and readiness probes are
+	// never run, and the releases hard-needing it are skipped, as what they need isn't really applied. See DryRun
+	DryRunMode *bool `yaml:"dryRun,omitempty"`
+	// PostRenderer is the command to transform the manifests rendered by helm, passed via `--post-renderer`.
+	// A relative path like `./kustomize.sh` is resolved against the directory containing the helmfile, whereas a bare command name is looked up in PATH.
+	PostRenderer string `yaml:"postRenderer,omitempty"`
+	// ExtraArgs is the additional flags passed as-is to `helm upgrade --install`, like `--cleanup-on-fail`.
+	// They are appended after the flags generated by helmfile, so that they take precedence when helm accepts the last one of a flag given twice.
+	// Flags managed by helmfile that identify or configure the release, like `--namespace` and `--values`, are rejected. See managedFlags.
+	ExtraArgs []string `yaml:"extraArgs,omitempty"`
 
 	// MissingFileHandler is set to either "Error" or "Warn". "Error" instructs helmfile to fail when unable to find a values or secrets file. When "Warn", it prints the file and continues.
 	// The default value for MissingFileHandler is "Error".
 	MissingFileHandler *string `yaml:"missingFileHandler,omitempty"`
 	// Needs is the [TILLER_NS/][NS/]NAME representations of releases that this release depends on.
-	Needs []string `yaml:"needs,omitempty"`
+	// Prefix one with SoftNeedPrefix, or write it as an object with `ignoreFailure: true`, to keep processing this release even when
+	// the needed release failed.
+	Needs Needs `yaml:"needs,omitempty"`
+	// After and Before are the [TILLER_NS/][NS/]NAME representations of releases to process this release after and before, respectively.
+	// Unlike Needs, they only order the releases. A failure of one never affects the other, and a release that is not defined,
+	// not going to be installed, or filtered out by selectors is just ignored. See orderingNeeds for more details.
+	After  []string `yaml:"after,omitempty"`
+	Before []string `yaml:"before,omitempty"`
+	// Wave is the deploy wave of the release for coarse ordering. All the releases in a wave are processed after all the releases
+	// in the lower waves, like they had `after` on them, while `needs`, `after` and `before` are still honored within and across waves.
+	// Releases without it are in the wave 0.
+	Wave int `yaml:"wave,omitempty"`
+	// Priority is used to order releases that are processed in the same group of the DAG. Releases with higher priorities are processed first.
+	// Releases with the same priority are processed in the declared order. It does not affect the DAG itself.
+	Priority int `yaml:"priority,omitempty"`
 
 	// Hooks is a list of extension points paired with operations, that are executed in specific points of the lifecycle of releases defined in helmfile
 	Hooks []event.Hook `yaml:"hooks,omitempty"`
 
+	// KubectlHooks is the kubectl commands run against the kube context and the namespace of the release before and after
+	// syncing it, like applying raw manifests of CRDs. See KubectlHook
+	KubectlHooks []KubectlHook `yaml:"kubectlHooks,omitempty"`
+
+	// WaitFor is the readiness probes of the preconditions not managed by helmfile, which must pass before the release is processed
+	WaitFor []ReadinessProbe `yaml:"waitFor,omitempty"`
+
+	// Type is the type of the release. `noop` makes it a node in the DAG that deploys nothing, like a barrier between phases
+	// that many releases can `needs`. It needs no chart, and only its hooks and readiness probes are run. Empty for a usual release
+	Type string `yaml:"type,omitempty"`
+
 	// Name is the name of this release
 	Name      string            `yaml:"name,omitempty"`
 	Namespace string            `yaml:"namespace,omitempty"`
@@ -172,6 +365,10 @@ type ReleaseSpec struct {
 
 	KubeContext string `yaml:"kubeContext,omitempty"`
 
+	// HelmBinary is the path to or the name of the helm binary to run for this release, instead of the one given via --helm-binary.
+	// It is useful for migrating releases from helm 2 to helm 3 one by one.
+	HelmBinary string `yaml:"helmBinary,omitempty"`
+
 	TLS       *bool  `yaml:"tls,omitempty"`
 	TLSCACert string `yaml:"tlsCACert,omitempty"`
 	TLSKey    string `yaml:"tlsKey,omitempty"`
@@ -188,6 +385,19 @@ type ReleaseSpec struct {
 	JSONPatches           []interface{} `yaml:"jsonPatches,omitempty"`
 	StrategicMergePatches []interface{} `yaml:"strategicMergePatches,omitempty"`
 	Adopt                 []string      `yaml:"adopt,omitempty"`
+	// Transformers is the kustomize transformer configs applied to the manifests rendered from the chart, passed via `--transformer`.
+	// Each of them is either a path to a transformer config, resolved against the directory containing the helmfile defining the release,
+	// or an inline transformer config.
+	Transformers []interface{} `yaml:"transformers,omitempty"`
+
+	// SourceFile is the path to the helmfile that the release is defined in, as in HelmState.FilePath.
+	// It is set on loading, so that errors can tell where the release came from when there are many helmfiles.
+	SourceFile string `yaml:"-"`
+
+	// BaseDir is the directory containing the helmfile that the release is defined in, which differs from the directory of
+	// the loaded helmfile when the release is defined in one of its `bases`.
+	// Relative paths to values, secrets and `set` files of the release are resolved against it.
+	BaseDir string `yaml:"-"`
 
 	// generatedValues are values that need cleaned up on exit
 	generatedValues []string
@@ -208,6 +418,8 @@ type AffectedReleases struct {
 	Upgraded []*ReleaseSpec
 	Deleted  []*ReleaseSpec
 	Failed   []*ReleaseSpec
+	// DryRun is the releases synced in the dry-run mode, which are neither upgraded nor deleted. See ReleaseSpec.DryRunMode
+	DryRun []*ReleaseSpec
 }
 
 const DefaultEnv = "default"
@@ -217,10 +429,127 @@ const MissingFileHandlerInfo = "Info"
 const MissingFileHandlerWarn = "Warn"
 const MissingFileHandlerDebug = "Debug"
 
+// applyDefaultsTo sets the namespace of the helmfile to the release without its own namespace. See ReleaseNamespace for more details.
 func (st *HelmState) applyDefaultsTo(spec *ReleaseSpec) {
-	if st.Namespace != "" {
-		spec.Namespace = st.Namespace
+	spec.Namespace = st.ReleaseNamespace(spec)
+}
+
+// MergeReleasesFrom merges the releases, repositories, groups and sub-helmfiles of the other state loaded from another helmfile into the state,
+// like the helmfiles in a directory loaded as one state.
+//
+// The namespaces of both states are set to their releases without their own namespace, as applyDefaultsTo does, before the releases are
+// compared, so that the releases keep their namespaces in the state and are referred to by them in `needs` across the helmfiles.
+// The namespace of the state is cleared when the other state has another one, so that it never applies to the releases of the other state.
+// It fails when a release of the other state has the same [TILLER_NS/][NS/]NAME as one already in the state, when a repository or a group
+// of the same name has a different definition, or when the settings the state can have only one of, like `helmDefaults`, `concurrency`,
+// `commonLabels`, `commonAnnotations` and the environment values, differ.
+func (st *HelmState) MergeReleasesFrom(other *HelmState) error {
+	if !reflect.DeepEqual(st.HelmDefaults, other.HelmDefaults) {
+		return fmt.Errorf("helmDefaults in %s conflicts with the ones in %s. please define them identically, e.g. in a base shared by both", other.FilePath, st.FilePath)
 	}
+
+	settings := []struct {
+		name        string
+		mine, other interface{}
+	}{
+		{"concurrency", st.Concurrency, other.Concurrency},
+		{"commonLabels", st.CommonLabels, other.CommonLabels},
+		{"commonAnnotations", st.CommonAnnotations, other.CommonAnnotations},
+		{"the environment values", st.Env.Values, other.Env.Values},
+		{"the environment defaults", st.Env.Defaults, other.Env.Defaults},
+	}
+	for _, s := range settings {
+		if !sameSetting(s.mine, s.other) {
+			return fmt.Errorf("%s in %s conflicts with the ones in %s. please define them identically, e.g. in a base shared by both", s.name, other.FilePath, st.FilePath)
+		}
+	}
+
+	ids := map[string]string{}
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		st.applyDefaultsTo(r)
+		if r.SourceFile != "" {
+			ids[releaseToID(r)] = r.SourceFile
+		} else {
+			ids[releaseToID(r)] = st.FilePath
+		}
+	}
+	if st.Namespace != other.Namespace {
+		st.Namespace = ""
+	}
+
+	for _, r := range other.Releases {
+		other.applyDefaultsTo(&r)
+		id := releaseToID(&r)
+		if file, ok := ids[id]; ok {
+			return fmt.Errorf("release %q in %s conflicts with the one in %s. please rename either of them or give them different namespaces", id, other.FilePath, file)
+		}
+		ids[id] = other.FilePath
+		st.Releases = append(st.Releases, r)
+	}
+
+	repos := map[string]RepositorySpec{}
+	for _, r := range st.Repositories {
+		repos[r.Name] = r
+	}
+	for _, r := range other.Repositories {
+		if existing, ok := repos[r.Name]; ok {
+			if !reflect.DeepEqual(existing, r) {
+				return fmt.Errorf("repository %q in %s conflicts with the one of the same name in %s. please define it identically or rename either of them", r.Name, other.FilePath, st.FilePath)
+			}
+			continue
+		}
+		repos[r.Name] = r
+		st.Repositories = append(st.Repositories, r)
+	}
+
+	for name, members := range other.Groups {
+		if existing, ok := st.Groups[name]; ok {
+			if !reflect.DeepEqual(existing, members) {
+				return fmt.Errorf("group %q in %s conflicts with the one of the same name in %s. please define it identically or rename either of them", name, other.FilePath, st.FilePath)
+			}
+			continue
+		}
+		if st.Groups == nil {
+			st.Groups = map[string][]string{}
+		}
+		st.Groups[name] = members
+	}
+
+	st.Helmfiles = append(st.Helmfiles, other.Helmfiles...)
+
+	return nil
+}
+
+// sameSetting reports whether both settings are the same, treating empty maps and strings as unset.
+func sameSetting(a, b interface{}) bool {
+	empty := func(v interface{}) bool {
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Invalid:
+			return true
+		case reflect.Map, reflect.String, reflect.Slice:
+			return rv.Len() == 0
+		}
+		return false
+	}
+	if empty(a) && empty(b) {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Copy returns a copy of the state that can be run independently of the original, like one cached after loading.
+// The releases, helmfiles and selectors are copied, as running a state filters them in place, and the state of the run,
+// like the prepared charts, is reset. The specs of the releases are shared, as they are never modified by running.
+func (st *HelmState) Copy() *HelmState {
+	c := *st
+	c.Releases = append([]ReleaseSpec(nil), st.Releases...)
+	c.Helmfiles = append([]SubHelmfileSpec(nil), st.Helmfiles...)
+	c.Selectors = append([]string(nil), st.Selectors...)
+	c.filteredOutReleases = nil
+	c.preparedCharts = nil
+	return &c
 }
 
 type RepoUpdater interface {
@@ -233,7 +562,10 @@ func (st *HelmState) SyncRepos(helm RepoUpdater) []error {
 	errs := []error{}
 
 	for _, repo := range st.Repositories {
-		if err := helm.AddRepo(repo.Name, repo.URL, repo.CaFile, repo.CertFile, repo.KeyFile, repo.Username, repo.Password); err != nil {
+		err := st.retryChartFetch(fmt.Sprintf("adding repository %s", repo.Name), func() error {
+			return helm.AddRepo(repo.Name, repo.URL, repo.CaFile, repo.CertFile, repo.KeyFile, repo.Username, repo.Password)
+		})
+		if err != nil {
 			errs = append(errs, err)
 		}
 	}
@@ -242,7 +574,7 @@ func (st *HelmState) SyncRepos(helm RepoUpdater) []error {
 		return errs
 	}
 
-	if err := helm.UpdateRepo(); err != nil {
+	if err := st.retryChartFetch("updating repositories", helm.UpdateRepo); err != nil {
 		return []error{err}
 	}
 	return nil
@@ -298,7 +630,8 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 				// This logic addresses:
 				// - https://github.com/roboll/helmfile/issues/519
 				// - https://github.com/roboll/helmfile/issues/616
-				if !release.Desired() {
+				// Noop releases have nothing to sync, too.
+				if !release.Desired() || release.Noop() {
 					results <- syncPrepareResult{release: release, flags: []string{}, errors: []*ReleaseError{}}
 					continue
 				}
@@ -357,6 +690,20 @@ func (st *HelmState) prepareSyncReleases(helm helmexec.Interface, additionalValu
 		},
 	)
 
+	// Results are gathered in the order the workers completed them. They are sorted back into the order of declaration,
+	// so that the plan and its tie-breaks don't depend on the concurrency.
+	releaseToIndex := map[*ReleaseSpec]int{}
+	for i, r := range releases {
+		releaseToIndex[r] = i
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].release == nil || res[j].release == nil {
+			return res[j].release == nil && res[i].release != nil
+		}
+		return releaseToIndex[res[i].release] < releaseToIndex[res[j].release]
+	})
+
 	return res, errs
 }
 
@@ -370,12 +717,63 @@ func (st *HelmState) isReleaseInstalled(context helmexec.HelmContext, helm helme
 	return false, nil
 }
 
+// releasesInstalled tells whether each of the releases is installed, keyed by its ID. `helm list` is run for the releases
+// concurrently, with as many workers as the releases are processed with. See workers.
+// It returns the error of the first release failed to be listed, in the order of the releases.
+func (st *HelmState) releasesInstalled(helm helmexec.Interface, releases []*ReleaseSpec, concurrency int) (map[string]bool, error) {
+	type result struct {
+		index     int
+		installed bool
+		err       error
+	}
+
+	jobs := make(chan int, len(releases))
+	results := make(chan result, len(releases))
+	errs := make([]error, len(releases))
+	installed := map[string]bool{}
+
+	st.scatterGather(
+		concurrency,
+		len(releases),
+		func() {
+			for i := range releases {
+				jobs <- i
+			}
+			close(jobs)
+		},
+		func(workerIndex int) {
+			for i := range jobs {
+				ok, err := st.isReleaseInstalled(st.createHelmContext(releases[i], workerIndex), helm, *releases[i])
+				results <- result{index: i, installed: ok, err: err}
+			}
+		},
+		func() {
+			for range releases {
+				r := <-results
+				if r.err != nil {
+					errs[r.index] = newReleaseError(releases[r.index], r.err)
+					continue
+				}
+				installed[releaseToID(releases[r.index])] = r.installed
+			}
+		},
+	)
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return installed, nil
+}
+
 func (st *HelmState) DetectReleasesToBeDeleted(helm helmexec.Interface) ([]*ReleaseSpec, error) {
 	detected := []*ReleaseSpec{}
 	for i := range st.Releases {
 		release := st.Releases[i]
 
-		if !release.Desired() {
+		if !release.Desired() && !release.Noop() {
 			installed, err := st.isReleaseInstalled(st.createHelmContext(&release, 0), helm, release)
 			if err != nil {
 				return nil, err
@@ -389,8 +787,131 @@ func (st *HelmState) DetectReleasesToBeDeleted(helm helmexec.Interface) ([]*Rele
 	return detected, nil
 }
 
+// ApplyPreview is what `helmfile apply` is going to do to each release, computed before applying anything,
+// so that the releases to be uninstalled are told apart from the ones to be installed or upgraded.
+type ApplyPreview struct {
+	// Installed is the releases with changes that are not installed yet
+	Installed []ReleaseDiff
+	// Upgraded is the releases with changes that are already installed
+	Upgraded []ReleaseDiff
+	// Uninstalled is the releases with `installed: false` that are still installed
+	Uninstalled []*ReleaseSpec
+	// Unchanged is the releases without changes, which are left as they are
+	Unchanged []*ReleaseSpec
+}
+
+// Affected returns the releases to be installed, upgraded or uninstalled, in the order of the given releases
+// rather than grouped by what is done to them, so that they are synced in the declared order within each group of the DAG.
+func (p *ApplyPreview) Affected(releases []ReleaseSpec) []ReleaseSpec {
+	affected := map[string]bool{}
+	for _, r := range p.Installed {
+		affected[releaseToID(r.ReleaseSpec)] = true
+	}
+	for _, r := range p.Upgraded {
+		affected[releaseToID(r.ReleaseSpec)] = true
+	}
+	for _, r := range p.Uninstalled {
+		affected[releaseToID(r)] = true
+	}
+
+	var rs []ReleaseSpec
+	for i := range releases {
+		if affected[releaseToID(&releases[i])] {
+			rs = append(rs, releases[i])
+		}
+	}
+
+	return rs
+}
+
+// SelectAffectedReleases narrows the releases down to the ones to be installed, upgraded or uninstalled according to the preview,
+// so that the releases without changes are skipped entirely in the apply phase following the diff phase.
+// The releases left out are treated like ones filtered out by selectors, so that the affected releases are still ordered by
+// `needs` via the unchanged ones, like an app needing a database via an unchanged cache.
+func (st *HelmState) SelectAffectedReleases(preview *ApplyPreview) {
+	affected := preview.Affected(st.Releases)
+
+	ids := map[string]bool{}
+	for i := range affected {
+		ids[releaseToID(&affected[i])] = true
+	}
+
+	var unaffected []ReleaseSpec
+	for _, r := range st.Releases {
+		if !ids[releaseToID(&r)] {
+			st.logger.Debugf("skipping %q without changes", releaseToID(&r))
+			unaffected = append(unaffected, r)
+		}
+	}
+
+	st.Releases = affected
+	st.filteredOutReleases = append(st.filteredOutReleases, unaffected...)
+}
+
+// PreviewApply tells the releases with changes in the summary computed by DiffReleasesWithSummary apart by whether they
+// are already installed, and detects the releases to be uninstalled as DetectReleasesToBeDeleted does.
+// Whether the releases are installed is checked concurrently, with as many workers as the releases are processed with.
+func (st *HelmState) PreviewApply(helm helmexec.Interface, summary *DiffSummary, concurrency int) (*ApplyPreview, error) {
+	preview := &ApplyPreview{Unchanged: summary.Unchanged}
+
+	var releases []*ReleaseSpec
+	for _, r := range summary.Changed {
+		releases = append(releases, r.ReleaseSpec)
+	}
+
+	var undesired []*ReleaseSpec
+	for i := range st.Releases {
+		if r := st.Releases[i]; !r.Desired() && !r.Noop() {
+			// Copied as DetectReleasesToBeDeleted does, not to be messed up(https://github.com/roboll/helmfile/issues/554)
+			undesired = append(undesired, &r)
+		}
+	}
+
+	installed, err := st.releasesInstalled(helm, append(releases, undesired...), concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range summary.Changed {
+		if installed[releaseToID(r.ReleaseSpec)] {
+			preview.Upgraded = append(preview.Upgraded, r)
+		} else {
+			preview.Installed = append(preview.Installed, r)
+		}
+	}
+
+	for _, r := range undesired {
+		if installed[releaseToID(r)] {
+			preview.Uninstalled = append(preview.Uninstalled, r)
+		}
+	}
+
+	return preview, nil
+}
+
 type SyncOpts struct {
 	Set []string
+
+	// SkipNeedsNotInstalled skips releases needing releases with `installed: false`, instead of failing
+	SkipNeedsNotInstalled bool
+
+	// MaxFailures is the number of failed releases that aborts syncing the remaining groups of releases.
+	// Until then, the releases not hard-needing failed releases, directly or indirectly, are still synced.
+	// 0 aborts on the first failure, like 1, and a negative number never aborts
+	MaxFailures int
+
+	// AtomicRun makes syncing all-or-nothing. On the first failure, it aborts regardless of MaxFailures and rolls back
+	// all the releases synced successfully so far in the run, in the reverse order of the groups. See rollbackReleases
+	AtomicRun bool
+
+	// Batch deletes the releases with `installed: false` sharing the same helm context and flags within each group of the DAG
+	// in a single helm command. The other releases are still synced one by one, as `helm upgrade` takes one release at a time
+	Batch bool
+}
+
+// aborts reports whether syncing the remaining groups of releases is to be aborted after the number of failed releases
+func (o *SyncOpts) aborts(failures int) bool {
+	return o.MaxFailures >= 0 && failures >= o.MaxFailures
 }
 
 type SyncOpt interface{ Apply(*SyncOpts) }
@@ -411,23 +932,24 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 		return prepErrs
 	}
 
-	availableIds := make([]string, len(preps))
+	releases := make([]*ReleaseSpec, len(preps))
 	idToPrep := map[string]syncPrepareResult{}
 
-	d := dag.New()
 	for i, p := range preps {
 		r := p.release
 
-		id := releaseToID(r)
-
-		idToPrep[id] = p
+		idToPrep[releaseToID(r)] = p
 
-		availableIds[i] = id
+		releases[i] = r
+	}
 
-		d.Add(id, dag.Dependencies(r.Needs))
+	policy := rejectNotInstalledNeeds
+	if opts.SkipNeedsNotInstalled {
+		policy = skipNotInstalledNeeds
 	}
 
-	plan, err := d.Plan()
+	// Releases with `installed: false` are kept in the plan so that they are uninstalled
+	plan, err := st.planReleases(releases, true, policy)
 	if err != nil {
 		return []error{err}
 	}
@@ -436,13 +958,21 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 
 	st.logger.Debugf("syncing %d groups of releases in this order: %s", groupsTotal, plan)
 
-	for id, prep := range idToPrep {
-		for _, need := range prep.release.Needs {
-			if _, ok := idToPrep[need]; !ok {
-				return []error{fmt.Errorf("%q needs %q, but it must be one of %s", id, need, strings.Join(availableIds, ", "))}
-			}
-		}
-	}
+	var softErrs []error
+
+	// failed is the IDs of the failed and skipped releases, so that the releases hard-needing them are skipped
+	failed := map[string]bool{}
+	// failures is the number of failed releases so far, excluding the skipped ones, counted against opts.MaxFailures
+	failures := 0
+	// dryRun is the IDs of the releases synced in the dry-run mode and the ones skipped for them, so that the releases
+	// hard-needing them are skipped, as what they need isn't really applied
+	dryRun := map[string]bool{}
+	needs := st.hardNeeds()
+
+	// synced is the releases synced successfully so far per group, and installed tells whether each of them had been
+	// installed before the run, so that they are rolled back on a failure with opts.AtomicRun
+	var synced [][]*ReleaseSpec
+	installed := map[string]bool{}
 
 	for groupIndex, dagNodesInGroup := range plan {
 		var idsInGroup []string
@@ -453,16 +983,198 @@ func (st *HelmState) SyncReleases(affectedReleases *AffectedReleases, helm helme
 			if !ok {
 				panic(fmt.Sprintf("[bug] no release found for dag node id %q", node.Id))
 			}
+			if need, ok := failedNeed(prepareResult.release, needs, failed); ok {
+				st.logger.Warnf("skipping %q as %q it needs failed or was skipped", node.Id, need)
+				st.releaseSkipped(*prepareResult.release, SkipReasonNeedsFailed)
+				softErrs = append(softErrs, fmt.Errorf("release \"%s\" skipped: %q it needs failed or was skipped", prepareResult.release.Name, need))
+				failed[node.Id] = true
+				continue
+			}
+			if need, ok := failedNeed(prepareResult.release, needs, dryRun); ok {
+				st.logger.Infof("skipping %q as %q it needs is synced in the dry-run mode or skipped", node.Id, need)
+				st.releaseSkipped(*prepareResult.release, SkipReasonNeedsDryRun)
+				dryRun[node.Id] = true
+				continue
+			}
+			if prepareResult.release.DryRun() {
+				dryRun[node.Id] = true
+			}
 			prepsInGroup = append(prepsInGroup, prepareResult)
 			idsInGroup = append(idsInGroup, node.Id)
 		}
 
+		if len(prepsInGroup) == 0 {
+			continue
+		}
+
+		if opts.AtomicRun {
+			var toSync []*ReleaseSpec
+			for _, p := range prepsInGroup {
+				if p.release.Desired() && !p.release.Noop() {
+					toSync = append(toSync, p.release)
+				}
+			}
+			installedInGroup, err := st.releasesInstalled(helm, toSync, workerLimit)
+			if err != nil {
+				return append(softErrs, st.rollbackReleases(helm, synced, installed, err)...)
+			}
+			for id, ok := range installedInGroup {
+				installed[id] = ok
+			}
+		}
+
 		st.logger.Debugf("syncing releases in group %d/%d: %s", groupIndex+1, groupsTotal, strings.Join(idsInGroup, ", "))
 
-		errs := st.syncReleaseGroup(affectedReleases, helm, workerLimit, prepsInGroup)
+		var errs []error
+		if opts.Batch {
+			errs = st.syncReleaseGroupInBatches(affectedReleases, helm, workerLimit, prepsInGroup)
+		} else {
+			errs = st.syncReleaseGroup(affectedReleases, helm, workerLimit, prepsInGroup)
+		}
+
+		if opts.AtomicRun {
+			failedInGroup := map[string]bool{}
+			for _, err := range errs {
+				if relErr, ok := err.(*ReleaseError); ok {
+					failedInGroup[releaseToID(relErr.ReleaseSpec)] = true
+				}
+			}
+
+			var syncedInGroup []*ReleaseSpec
+			for _, p := range prepsInGroup {
+				if p.release.Desired() && !p.release.Noop() && !p.release.DryRun() && !failedInGroup[releaseToID(p.release)] {
+					syncedInGroup = append(syncedInGroup, p.release)
+				}
+			}
+			synced = append(synced, syncedInGroup)
+
+			if len(errs) > 0 {
+				return append(softErrs, st.rollbackReleases(helm, synced, installed, errs...)...)
+			}
+		}
+
 		if len(errs) > 0 {
-			return errs
+			var failedIDs []string
+			for _, err := range errs {
+				if relErr, ok := err.(*ReleaseError); ok {
+					failedIDs = append(failedIDs, releaseToID(relErr.ReleaseSpec))
+				} else {
+					failedIDs = nil
+					break
+				}
+			}
+
+			failures += len(failedIDs)
+
+			if allSoftFailures(releases, failedIDs, false) {
+				st.logger.Warnf("continuing as the failed releases are only softly needed: %s", strings.Join(failedIDs, ", "))
+			} else if len(failedIDs) == 0 || opts.aborts(failures) {
+				return append(softErrs, errs...)
+			} else {
+				st.logger.Warnf("continuing with the releases not needing the failed ones, as %d failed releases are below the maximum of %d: %s", failures, opts.MaxFailures, strings.Join(failedIDs, ", "))
+			}
+
+			for _, id := range failedIDs {
+				failed[id] = true
+			}
+
+			softErrs = append(softErrs, errs...)
+		}
+	}
+
+	if len(softErrs) > 0 {
+		return softErrs
+	}
+
+	return nil
+}
+
+// ResolveConcurrency returns the concurrency when it is specified, typically by `--concurrency`.
+// Otherwise it returns the concurrency of the selected environment, so that e.g. the production environment can be
+// synced one release at a time by default, and then the top-level `concurrency` of the helmfile.
+// When multiple environments are selected, the concurrency of the last one specifying it is used.
+func (st *HelmState) ResolveConcurrency(concurrency int) int {
+	if concurrency != 0 {
+		return concurrency
+	}
+
+	names := st.Env.Names()
+	for i := len(names) - 1; i >= 0; i-- {
+		if c := st.Environments[names[i]].Concurrency; c != 0 {
+			return c
+		}
+	}
+
+	// Already validated on loading
+	c, _ := parseConcurrency(st.Concurrency)
+
+	return c
+}
+
+// ValidateConcurrency checks that the top-level `concurrency` of the fully rendered helmfile is a non-negative integer.
+func (st *HelmState) ValidateConcurrency() error {
+	_, err := parseConcurrency(st.Concurrency)
+	return err
+}
+
+// parseConcurrency parses the top-level `concurrency` of a helmfile, which is 0 when empty.
+func parseConcurrency(s string) (int, error) {
+	if strings.TrimSpace(s) == "" {
+		return 0, nil
+	}
+
+	c, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || c < 0 {
+		return 0, fmt.Errorf("invalid concurrency %q: it must be a non-negative integer", s)
+	}
+
+	return c, nil
+}
+
+// ChartVersionsValuesKey is the key of the environment values holding the versions of charts keyed by the charts, like
+// `stable/mysql: 1.6.2`, so that the versions of all the releases are managed in one place.
+const ChartVersionsValuesKey = "chartVersions"
+
+// ApplyChartVersions sets the version of each release without `version` to the version of its chart in the environment values
+// under ChartVersionsValuesKey. An explicit `version` of a release takes precedence. It does nothing without such environment values.
+//
+// A release of a remote chart missing in the versions fails, so that it is never installed with the latest version by accident.
+// Releases of local charts and releases with `installed: false` don't need versions.
+func (st *HelmState) ApplyChartVersions() error {
+	v, ok := st.Env.Values[ChartVersionsValuesKey]
+	if !ok || v == nil {
+		return nil
+	}
+
+	var versions map[string]interface{}
+	switch m := v.(type) {
+	case map[string]interface{}:
+		versions = m
+	case map[interface{}]interface{}:
+		var err error
+		versions, err = maputil.CastKeysToStrings(m)
+		if err != nil {
+			return err
 		}
+	default:
+		return fmt.Errorf("environment value %q must be a map of charts to versions, but got %T", ChartVersionsValuesKey, v)
+	}
+
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		if r.Version != "" || r.Noop() {
+			continue
+		}
+
+		version, ok := versions[r.Chart]
+		if !ok || version == nil {
+			if isLocalChart(r.Chart) || !r.Desired() {
+				continue
+			}
+			return fmt.Errorf("release %q has no version and its chart %q is missing in the environment value %q. please add either of them", r.Name, r.Chart, ChartVersionsValuesKey)
+		}
+
+		r.Version = fmt.Sprintf("%v", version)
 	}
 
 	return nil
@@ -481,9 +1193,164 @@ func releaseToID(r *ReleaseSpec) string {
 		id += ns + "/"
 	}
 
-	id += r.Name
+	id += r.Name
+
+	return id
+}
+
+// syncReleaseGroupInBatches is the batched variant of syncReleaseGroup.
+// The releases with `installed: false` sharing the same helm context and flags are deleted with a single helm command per batch,
+// and then the other releases are synced by syncReleaseGroup.
+// When a batch fails, its releases are deleted one by one, so that the failure is attributed to the releases that caused it.
+func (st *HelmState) syncReleaseGroupInBatches(affectedReleases *AffectedReleases, helm helmexec.Interface, concurrency int, preps []syncPrepareResult) []error {
+	var toDelete []ReleaseSpec
+	var toSync []syncPrepareResult
+
+	for _, p := range preps {
+		if !p.release.Desired() && !p.release.Noop() {
+			toDelete = append(toDelete, *p.release)
+		} else {
+			toSync = append(toSync, p)
+		}
+	}
+
+	m := new(sync.Mutex)
+
+	key := func(release ReleaseSpec) string {
+		return st.releaseBatchKey(&release, st.syncDeletionFlags(&release))
+	}
+
+	errs, _ := st.iterateOnReleaseBatches(concurrency, batchReleases(toDelete, key), func(batch []ReleaseSpec, workerIndex int) ([]error, []string) {
+		return st.deleteUndesiredReleaseBatch(affectedReleases, helm, m, batch, workerIndex), nil
+	})
+
+	if len(toSync) > 0 {
+		errs = append(errs, st.syncReleaseGroup(affectedReleases, helm, concurrency, toSync)...)
+	}
+
+	return errs
+}
+
+// deleteUndesiredReleaseBatch deletes the installed releases in the batch of releases with `installed: false` with a single helm command.
+// The hooks of each release are run and the release webhook is notified of each release as syncReleaseGroup does.
+func (st *HelmState) deleteUndesiredReleaseBatch(affectedReleases *AffectedReleases, helm helmexec.Interface, m *sync.Mutex, batch []ReleaseSpec, workerIndex int) []error {
+	logger := st.workerLogger(workerIndex)
+	flags := st.syncDeletionFlags(&batch[0])
+	context := st.createHelmContext(&batch[0], workerIndex)
+
+	relErrs := make([]*ReleaseError, len(batch))
+	installed := make([]bool, len(batch))
+
+	var names []string
+
+	for i := range batch {
+		release := &batch[i]
+
+		if !release.DryRun() {
+			if _, err := st.triggerPresyncEvent(release, "sync"); err != nil {
+				relErrs[i] = newReleaseError(release, err)
+			} else if err := st.runKubectlHooks(*release, KubectlHookPresync, logger); err != nil {
+				relErrs[i] = newReleaseError(release, err)
+			} else if err := st.waitForReadiness(*release, logger); err != nil {
+				relErrs[i] = newReleaseError(release, err)
+			}
+		}
+
+		if relErrs[i] != nil {
+			continue
+		}
+
+		ok, err := st.isReleaseInstalled(context, helm, *release)
+		if err != nil {
+			relErrs[i] = newReleaseError(release, err)
+		} else if !ok {
+			st.releaseSkipped(*release, SkipReasonNotInstalled)
+		} else {
+			installed[i] = true
+			names = append(names, release.Name)
+		}
+	}
+
+	start := st.clock().Now()
+
+	if len(names) > 0 {
+		if err := releaseHelm(helm, &batch[0]).DeleteReleases(context, names, flags...); err != nil {
+			logger.Debugf("failed to delete releases %s in a batch: %v. deleting them one by one", strings.Join(names, ", "), err)
+
+			for i := range batch {
+				if installed[i] {
+					if err := releaseHelm(helm, &batch[i]).DeleteRelease(context, batch[i].Name, flags...); err != nil {
+						relErrs[i] = newReleaseError(&batch[i], err)
+					}
+				}
+			}
+		}
+	}
+
+	duration := st.clock().Now().Sub(start)
+
+	var errs []error
+
+	for i := range batch {
+		release := &batch[i]
+
+		if installed[i] {
+			m.Lock()
+			if relErrs[i] != nil {
+				affectedReleases.Failed = append(affectedReleases.Failed, release)
+			} else if release.DryRun() {
+				affectedReleases.DryRun = append(affectedReleases.DryRun, release)
+			} else {
+				affectedReleases.Deleted = append(affectedReleases.Deleted, release)
+			}
+			m.Unlock()
+		}
+
+		// A failed postsync kubectl hook fails the release even though helm deleted it, as in syncReleaseGroup
+		if relErrs[i] == nil && !release.DryRun() {
+			if err := st.runKubectlHooks(*release, KubectlHookPostsync, logger); err != nil {
+				relErrs[i] = newReleaseError(release, err)
+			}
+		}
+
+		if (installed[i] || relErrs[i] != nil) && !release.DryRun() {
+			var err error
+			if relErrs[i] != nil {
+				err = relErrs[i]
+			}
+			st.notifyReleaseWebhook("sync", *release, err, duration)
+		}
+
+		if relErrs[i] != nil {
+			errs = append(errs, relErrs[i])
+		}
+
+		if !release.DryRun() {
+			if _, err := st.triggerPostsyncEvent(release, relErrs[i], "sync"); err != nil {
+				logger.Warnf("warn: %v\n", err)
+			}
+
+			if _, err := st.triggerCleanupEvent(release, "sync"); err != nil {
+				logger.Warnf("warn: %v\n", err)
+			}
+		}
+	}
+
+	return errs
+}
 
-	return id
+// syncDeletionFlags returns the flags to delete the release with `installed: false` on sync
+func (st *HelmState) syncDeletionFlags(release *ReleaseSpec) []string {
+	var args []string
+	if isHelm3() {
+		args = []string{}
+	} else {
+		args = []string{"--purge"}
+	}
+	if release.DryRun() {
+		args = append(args, "--dry-run")
+	}
+	return st.appendConnectionFlags(args, release)
 }
 
 func (st *HelmState) syncReleaseGroup(affectedReleases *AffectedReleases, helm helmexec.Interface, concurrency int, preps []syncPrepareResult) []error {
@@ -495,76 +1362,125 @@ func (st *HelmState) syncReleaseGroup(affectedReleases *AffectedReleases, helm h
 	}
 
 	m := new(sync.Mutex)
+	slots := st.newNamespaceSlots()
+	order := st.newDispatchOrder()
 
 	st.scatterGather(
 		concurrency,
 		len(preps),
 		func() {
-			for i := 0; i < len(preps); i++ {
+			slots.dispatch(len(preps), func(i int) string {
+				return st.ReleaseNamespace(preps[i].release)
+			}, func(i int) {
 				jobQueue <- &preps[i]
-			}
+				order.wait()
+			})
 			close(jobQueue)
 		},
 		func(workerIndex int) {
+			logger := st.workerLogger(workerIndex)
 			for prep := range jobQueue {
 				release := prep.release
 				flags := prep.flags
-				chart := normalizeChart(st.basePath, release.Chart)
 				var relErr *ReleaseError
 				context := st.createHelmContext(release, workerIndex)
 
-				if _, err := st.triggerPresyncEvent(release, "sync"); err != nil {
-					relErr = newReleaseError(release, err)
+				// Hooks are never run for the releases in the dry-run mode, as they may change the cluster, nor are they waited for
+				// to be ready, as they are never applied
+				if !release.DryRun() {
+					if _, err := st.triggerPresyncEvent(release, "sync"); err != nil {
+						relErr = newReleaseError(release, err)
+					} else if err := st.runKubectlHooks(*release, KubectlHookPresync, logger); err != nil {
+						relErr = newReleaseError(release, err)
+					} else if err := st.waitForReadiness(*release, logger); err != nil {
+						relErr = newReleaseError(release, err)
+					}
+				}
+
+				order.start()
+
+				start := st.clock().Now()
+				// notify is whether to notify the release webhook of the outcome, which is false when there was nothing to sync
+				// or it was a dry run
+				notify := !release.DryRun()
+
+				if relErr != nil {
+					// Failed before syncing. The error is reported below
+				} else if release.Noop() {
+					logger.Debugf("reached noop release %q", release.Name)
+					notify = false
 				} else if !release.Desired() {
 					installed, err := st.isReleaseInstalled(context, helm, *release)
 					if err != nil {
 						relErr = newReleaseError(release, err)
-					} else if installed {
-						var args []string
-						if isHelm3() {
-							args = []string{}
-						} else {
-							args = []string{"--purge"}
-						}
-						deletionFlags := st.appendConnectionFlags(args, release)
+					} else if !installed {
+						st.releaseSkipped(*release, SkipReasonNotInstalled)
+						notify = false
+					} else {
+						deletionFlags := st.syncDeletionFlags(release)
 						m.Lock()
-						if err := helm.DeleteRelease(context, release.Name, deletionFlags...); err != nil {
+						if err := releaseHelm(helm, release).DeleteRelease(context, release.Name, deletionFlags...); err != nil {
 							affectedReleases.Failed = append(affectedReleases.Failed, release)
 							relErr = newReleaseError(release, err)
+						} else if release.DryRun() {
+							affectedReleases.DryRun = append(affectedReleases.DryRun, release)
 						} else {
 							affectedReleases.Deleted = append(affectedReleases.Deleted, release)
 						}
 						m.Unlock()
 					}
-				} else if err := helm.SyncRelease(context, release.Name, chart, flags...); err != nil {
+				} else if err := releaseHelm(helm, release).SyncRelease(context, release.Name, st.chartFor(release), flags...); err != nil {
 					m.Lock()
 					affectedReleases.Failed = append(affectedReleases.Failed, release)
 					m.Unlock()
 					relErr = newReleaseError(release, err)
+				} else if release.DryRun() {
+					m.Lock()
+					affectedReleases.DryRun = append(affectedReleases.DryRun, release)
+					m.Unlock()
 				} else {
 					m.Lock()
 					affectedReleases.Upgraded = append(affectedReleases.Upgraded, release)
 					m.Unlock()
 					installedVersion, err := st.getDeployedVersion(context, helm, release)
 					if err != nil { //err is not really impacting so just log it
-						st.logger.Debugf("getting deployed release version failed:%v", err)
+						logger.Debugf("getting deployed release version failed:%v", err)
 					} else {
 						release.installedVersion = installedVersion
 					}
 				}
 
+				// A failed postsync kubectl hook fails the release even though helm synced it, as the release is incomplete without it
+				if relErr == nil && !release.DryRun() {
+					if err := st.runKubectlHooks(*release, KubectlHookPostsync, logger); err != nil {
+						relErr = newReleaseError(release, err)
+					}
+				}
+
+				slots.free(st.ReleaseNamespace(release))
+
+				if notify {
+					var err error
+					if relErr != nil {
+						err = relErr
+					}
+					st.notifyReleaseWebhook("sync", *release, err, st.clock().Now().Sub(start))
+				}
+
 				if relErr == nil {
 					results <- syncResult{}
 				} else {
 					results <- syncResult{errors: []*ReleaseError{relErr}}
 				}
 
-				if _, err := st.triggerPostsyncEvent(release, relErr, "sync"); err != nil {
-					st.logger.Warnf("warn: %v\n", err)
-				}
+				if !release.DryRun() {
+					if _, err := st.triggerPostsyncEvent(release, relErr, "sync"); err != nil {
+						logger.Warnf("warn: %v\n", err)
+					}
 
-				if _, err := st.triggerCleanupEvent(release, "sync"); err != nil {
-					st.logger.Warnf("warn: %v\n", err)
+					if _, err := st.triggerCleanupEvent(release, "sync"); err != nil {
+						logger.Warnf("warn: %v\n", err)
+					}
 				}
 			}
 		},
@@ -593,7 +1509,7 @@ func (st *HelmState) listReleases(context helmexec.HelmContext, helm helmexec.In
 	if isHelm3() && release.Namespace != "" {
 		flags = append(flags, "--namespace", release.Namespace)
 	}
-	return helm.List(context, "^"+release.Name+"$", flags...)
+	return releaseHelm(helm, release).List(context, "^"+release.Name+"$", flags...)
 }
 
 func (st *HelmState) getDeployedVersion(context helmexec.HelmContext, helm helmexec.Interface, release *ReleaseSpec) (string, error) {
@@ -637,34 +1553,13 @@ func (st *HelmState) downloadCharts(helm helmexec.Interface, dir string, concurr
 		},
 		func(_ int) {
 			for release := range jobQueue {
-				chartPath := ""
-				if pathExists(normalizeChart(st.basePath, release.Chart)) {
-					chartPath = normalizeChart(st.basePath, release.Chart)
-				} else {
-					fetchFlags := []string{}
-					if release.Version != "" {
-						chartPath = path.Join(dir, release.Name, release.Version, release.Chart)
-						fetchFlags = append(fetchFlags, "--version", release.Version)
-					} else {
-						chartPath = path.Join(dir, release.Name, "latest", release.Chart)
-					}
-
-					if st.isDevelopment(release) {
-						fetchFlags = append(fetchFlags, "--devel")
-					}
-
-					// only fetch chart if it is not already fetched
-					if _, err := os.Stat(chartPath); os.IsNotExist(err) {
-						fetchFlags = append(fetchFlags, "--untar", "--untardir", chartPath)
-						if err := helm.Fetch(release.Chart, fetchFlags...); err != nil {
-							errs = append(errs, err)
-						}
-					}
-					// Set chartPath to be the path containing Chart.yaml, if found
-					fullChartPath, err := findChartDirectory(chartPath)
-					if err == nil {
-						chartPath = filepath.Dir(fullChartPath)
-					}
+				if release.Noop() {
+					results <- &downloadResults{release.Name, ""}
+					continue
+				}
+				chartPath, err := st.downloadChart(helm, release, dir)
+				if err != nil {
+					errs = append(errs, err)
 				}
 				results <- &downloadResults{release.Name, chartPath}
 			}
@@ -683,6 +1578,276 @@ func (st *HelmState) downloadCharts(helm helmexec.Interface, dir string, concurr
 	return temp, nil
 }
 
+// downloadChart downloads and untars the chart of the release into dir unless it is a local chart, and returns the path to the chart
+func (st *HelmState) downloadChart(helm helmexec.Interface, release *ReleaseSpec, dir string) (string, error) {
+	if pathExists(normalizeChart(st.basePath, release.Chart)) {
+		return normalizeChart(st.basePath, release.Chart), nil
+	}
+
+	var chartPath string
+	fetchFlags := []string{}
+	if release.Version != "" {
+		chartPath = path.Join(dir, release.Name, release.Version, release.Chart)
+		fetchFlags = append(fetchFlags, "--version", release.Version)
+	} else {
+		chartPath = path.Join(dir, release.Name, "latest", release.Chart)
+	}
+
+	if st.isDevelopment(release) {
+		fetchFlags = append(fetchFlags, "--devel")
+	}
+
+	if cachePath, ok := st.chartCachePath(release); ok {
+		return st.downloadChartToCache(helm, release, cachePath, fetchFlags)
+	}
+
+	var fetchErr error
+	// only fetch chart if it is not already fetched
+	if _, err := os.Stat(chartPath); os.IsNotExist(err) {
+		fetchFlags = append(fetchFlags, "--untar", "--untardir", chartPath)
+		fetchErr = st.retryChartFetch(fmt.Sprintf("fetching chart %s", release.Chart), func() error {
+			return releaseHelm(helm, release).Fetch(release.Chart, fetchFlags...)
+		})
+	}
+	// Set chartPath to be the path containing Chart.yaml, if found
+	fullChartPath, err := findChartDirectory(chartPath)
+	if err == nil {
+		chartPath = filepath.Dir(fullChartPath)
+	}
+	return chartPath, fetchErr
+}
+
+// chartCachePath returns the directory to cache the chart of the release in, keyed by the URL of the repository, the chart and the version.
+// It returns false when ChartCacheDir is not set, or the chart is not to be cached as the version is missing or a range
+// that may resolve to a newer version later.
+// The name of the repository is used instead of the URL when the repository is not defined in the helmfile.
+func (st *HelmState) chartCachePath(release *ReleaseSpec) (string, bool) {
+	if st.ChartCacheDir == "" || release.Version == "" {
+		return "", false
+	}
+
+	if _, err := semver.NewVersion(release.Version); err != nil {
+		return "", false
+	}
+
+	repoAndChart := strings.SplitN(release.Chart, "/", 2)
+	if len(repoAndChart) != 2 {
+		return "", false
+	}
+
+	repo := repoAndChart[0]
+	for _, r := range st.Repositories {
+		if r.Name == repo {
+			repo = r.URL
+			break
+		}
+	}
+
+	return filepath.Join(st.ChartCacheDir, url.PathEscape(repo), repoAndChart[1], release.Version), true
+}
+
+// downloadChartToCache downloads and untars the chart of the release into cachePath unless it is already there, and returns the path to the chart.
+// The chart is downloaded into a temporary directory next to cachePath and then moved to it, so that a failed download never
+// leaves a broken chart in the cache, and concurrent downloads of the same chart never conflict.
+func (st *HelmState) downloadChartToCache(helm helmexec.Interface, release *ReleaseSpec, cachePath string, fetchFlags []string) (string, error) {
+	if _, err := os.Stat(cachePath); err == nil {
+		st.logger.Debugf("using chart %s of version %s cached in %s", release.Chart, release.Version, cachePath)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+			return "", err
+		}
+
+		tmp, err := ioutil.TempDir(filepath.Dir(cachePath), ".fetching-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmp)
+
+		fetchFlags = append(fetchFlags, "--untar", "--untardir", tmp)
+		err = st.retryChartFetch(fmt.Sprintf("fetching chart %s", release.Chart), func() error {
+			return releaseHelm(helm, release).Fetch(release.Chart, fetchFlags...)
+		})
+		if err != nil {
+			return "", err
+		}
+
+		// The same chart may have been cached by another worker meanwhile, which is as good as the one just downloaded
+		if err := os.Rename(tmp, cachePath); err != nil && !pathExists(cachePath) {
+			return "", err
+		}
+	}
+
+	chartPath := cachePath
+	// Set chartPath to be the path containing Chart.yaml, if found
+	if fullChartPath, err := findChartDirectory(cachePath); err == nil {
+		chartPath = filepath.Dir(fullChartPath)
+	}
+
+	return chartPath, nil
+}
+
+// PrepareCharts builds the dependencies of the local charts and downloads the remote charts into dir, concurrently for all the releases.
+// SyncReleases and DiffReleases then use the downloaded charts, so that they don't spend time on downloading charts one release
+// at a time while processing the releases in the order of the DAG.
+// The charts are prepared with as many workers as the releases are processed with, capped by DefaultConcurrency and MaxConcurrency.
+//
+// Unlike the other operations, it is never limited to one at a time for tillerless releases, as it doesn't talk to tiller.
+// When skipDeps is true, nothing is prepared, as is for releases with `skipDeps: true`, so that the local charts are used as they are
+// and the remote charts are installed from the repositories by helm, as without PrepareCharts. The charts of releases to be
+// verified are downloaded as archives along with their provenance files, as `helm upgrade --verify` can't verify an untarred chart.
+func (st *HelmState) PrepareCharts(helm helmexec.Interface, dir string, concurrency int, skipDeps bool) []error {
+	// Reset the extra args if already set, not to break `helm fetch` by adding the args intended for other commands
+	helm.SetExtraArgs()
+
+	if skipDeps {
+		return nil
+	}
+
+	type job struct {
+		local    bool
+		verify   bool
+		chart    string
+		releases []*ReleaseSpec
+	}
+
+	// Releases sharing a chart are prepared at once, so that no two workers write to the same directory
+	var jobs []*job
+	keyToJob := map[string]*job{}
+
+	for i := range st.Releases {
+		release := &st.Releases[i]
+		if !release.Desired() || release.Noop() {
+			continue
+		}
+
+		if st.skipDeps(release) {
+			continue
+		}
+
+		local := isLocalChart(release.Chart)
+
+		key := normalizeChart(st.basePath, release.Chart)
+		if !local {
+			key = path.Join(release.Name, release.Version, release.Chart)
+		}
+
+		if j, ok := keyToJob[key]; ok {
+			j.releases = append(j.releases, release)
+			continue
+		}
+
+		j := &job{local: local, verify: st.verify(release), chart: normalizeChart(st.basePath, release.Chart), releases: []*ReleaseSpec{release}}
+		keyToJob[key] = j
+		jobs = append(jobs, j)
+	}
+
+	concurrency = st.cappedConcurrency(concurrency, len(jobs))
+
+	charts := map[string]string{}
+	var errs []error
+	var mu sync.Mutex
+
+	queue := make(chan *job, len(jobs))
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				release := j.releases[0]
+
+				if j.local {
+					if err := releaseHelm(helm, release).BuildDeps(release.Name, j.chart); err != nil {
+						mu.Lock()
+						errs = append(errs, newReleaseError(release, err))
+						mu.Unlock()
+					}
+					continue
+				}
+
+				var chartPath string
+				var err error
+				if j.verify {
+					chartPath, err = st.downloadChartArchive(helm, release, dir)
+				} else {
+					chartPath, err = st.downloadChart(helm, release, dir)
+				}
+
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, newReleaseError(release, err))
+				} else {
+					for _, r := range j.releases {
+						charts[releaseToID(r)] = chartPath
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	st.preparedCharts = charts
+
+	return nil
+}
+
+// downloadChartArchive downloads the packaged chart of the release along with its provenance file into dir, returning the path to
+// the archive, so that `helm upgrade --verify` verifies it as it would verify the chart in the repository
+func (st *HelmState) downloadChartArchive(helm helmexec.Interface, release *ReleaseSpec, dir string) (string, error) {
+	version := release.Version
+	if version == "" {
+		version = "latest"
+	}
+	destination := path.Join(dir, release.Name, version, "archive")
+
+	fetchFlags := []string{"--prov", "--destination", destination}
+	if release.Version != "" {
+		fetchFlags = append(fetchFlags, "--version", release.Version)
+	}
+	if st.isDevelopment(release) {
+		fetchFlags = append(fetchFlags, "--devel")
+	}
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return "", err
+	}
+
+	err := st.retryChartFetch(fmt.Sprintf("fetching chart %s", release.Chart), func() error {
+		return releaseHelm(helm, release).Fetch(release.Chart, fetchFlags...)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	archives, err := filepath.Glob(filepath.Join(destination, "*.tgz"))
+	if err != nil {
+		return "", err
+	}
+	if len(archives) != 1 {
+		return "", fmt.Errorf("failed to find the archive of chart %s fetched into %s", release.Chart, destination)
+	}
+
+	return archives[0], nil
+}
+
+// chartFor returns the chart to install or diff for the release, which is the one downloaded by PrepareCharts if any
+func (st *HelmState) chartFor(release *ReleaseSpec) string {
+	if chart, ok := st.preparedCharts[releaseToID(release)]; ok {
+		return chart
+	}
+	return normalizeChart(st.basePath, release.Chart)
+}
+
 type TemplateOpts struct {
 	Set []string
 }
@@ -694,6 +1859,30 @@ func (o *TemplateOpts) Apply(opts *TemplateOpts) {
 }
 
 // TemplateReleases wrapper for executing helm template on the releases
+// appendTemplateValuesFlags appends `--values` for each of the additional values files and `--set` for each of the values set
+// via the command-line to the flags for `helm template`. It returns the errors for the values files not found along with the flags.
+func appendTemplateValuesFlags(flags []string, additionalValues []string, set []string) ([]string, []error) {
+	var errs []error
+
+	for _, value := range additionalValues {
+		valfile, err := filepath.Abs(value)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if _, err := os.Stat(valfile); os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		flags = append(flags, "--values", valfile)
+	}
+
+	for _, s := range set {
+		flags = append(flags, "--set", s)
+	}
+
+	return flags, errs
+}
+
 func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string, additionalValues []string, args []string, workerLimit int, opt ...TemplateOpt) []error {
 	opts := &TemplateOpts{}
 	for _, o := range opt {
@@ -727,6 +1916,11 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 		release := st.Releases[i]
 
 		if !release.Desired() {
+			st.releaseSkipped(release, SkipReasonNotInstalled)
+			continue
+		}
+
+		if release.Noop() {
 			continue
 		}
 
@@ -737,23 +1931,8 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 			errs = append(errs, err)
 		}
 
-		for _, value := range additionalValues {
-			valfile, err := filepath.Abs(value)
-			if err != nil {
-				errs = append(errs, err)
-			}
-
-			if _, err := os.Stat(valfile); os.IsNotExist(err) {
-				errs = append(errs, err)
-			}
-			flags = append(flags, "--values", valfile)
-		}
-
-		if opts.Set != nil {
-			for _, s := range opts.Set {
-				flags = append(flags, "--set", s)
-			}
-		}
+		flags, valuesErrs := appendTemplateValuesFlags(flags, additionalValues, opts.Set)
+		errs = append(errs, valuesErrs...)
 
 		if len(outputDir) > 0 {
 			releaseOutputDir, err := st.GenerateOutputDir(outputDir, release)
@@ -767,7 +1946,7 @@ func (st *HelmState) TemplateReleases(helm helmexec.Interface, outputDir string,
 		}
 
 		if len(errs) == 0 {
-			if err := helm.TemplateRelease(release.Name, temp[release.Name], flags...); err != nil {
+			if err := releaseHelm(helm, &release).TemplateRelease(release.Name, temp[release.Name], flags...); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -827,6 +2006,11 @@ func (st *HelmState) LintReleases(helm helmexec.Interface, additionalValues []st
 		release := st.Releases[i]
 
 		if !release.Desired() {
+			st.releaseSkipped(release, SkipReasonNotInstalled)
+			continue
+		}
+
+		if release.Noop() {
 			continue
 		}
 
@@ -853,7 +2037,7 @@ func (st *HelmState) LintReleases(helm helmexec.Interface, additionalValues []st
 		}
 
 		if len(errs) == 0 {
-			if err := helm.Lint(release.Name, temp[release.Name], flags...); err != nil {
+			if err := releaseHelm(helm, &release).Lint(release.Name, temp[release.Name], flags...); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -871,7 +2055,27 @@ func (st *HelmState) LintReleases(helm helmexec.Interface, additionalValues []st
 }
 
 type diffResult struct {
-	err *ReleaseError
+	index   int
+	err     *ReleaseError
+	changes int
+}
+
+// ReleaseDiff is the diff of a release with changes, computed by DiffReleases
+type ReleaseDiff struct {
+	*ReleaseSpec
+
+	// Changes is the number of the resources added, removed or changed, or zero when it is unknown
+	Changes int
+}
+
+// DiffSummary aggregates the diffs across all the releases computed by DiffReleases, in the order of the releases.
+// Releases failed to be diffed are in neither of the lists.
+//
+// Releases with changes are told apart from unchanged ones only with `--detailed-exitcode`. Otherwise all the releases
+// diffed successfully are unchanged.
+type DiffSummary struct {
+	Changed   []ReleaseDiff
+	Unchanged []*ReleaseSpec
 }
 
 type diffPrepareResult struct {
@@ -889,6 +2093,10 @@ func (st *HelmState) prepareDiffReleases(helm helmexec.Interface, additionalValu
 	releases := []*ReleaseSpec{}
 	for i, _ := range st.Releases {
 		if !st.Releases[i].Desired() {
+			st.releaseSkipped(st.Releases[i], SkipReasonToBeDeleted)
+			continue
+		}
+		if st.Releases[i].Noop() {
 			continue
 		}
 		releases = append(releases, &st.Releases[i])
@@ -1006,6 +2214,14 @@ func (st *HelmState) createHelmContext(spec *ReleaseSpec, workerIndex int) helme
 	}
 }
 
+// releaseHelm returns the helm to run for the release, which runs the release-specific helm binary when it is specified
+func releaseHelm(helm helmexec.Interface, release *ReleaseSpec) helmexec.Interface {
+	if release.HelmBinary == "" {
+		return helm
+	}
+	return helm.WithHelmBinary(release.HelmBinary)
+}
+
 type DiffOpts struct {
 	Context int
 	NoColor bool
@@ -1021,20 +2237,34 @@ type DiffOpt interface{ Apply(*DiffOpts) }
 // DiffReleases wrapper for executing helm diff on the releases
 // It returns releases that had any changes
 func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []string, workerLimit int, detailedExitCode, suppressSecrets bool, triggerCleanupEvents bool, opt ...DiffOpt) ([]*ReleaseSpec, []error) {
+	summary, errs := st.DiffReleasesWithSummary(helm, additionalValues, workerLimit, detailedExitCode, suppressSecrets, triggerCleanupEvents, opt...)
+
+	rs := []*ReleaseSpec{}
+	for _, d := range summary.Changed {
+		rs = append(rs, d.ReleaseSpec)
+	}
+
+	return rs, errs
+}
+
+// DiffReleasesWithSummary is DiffReleases that returns the summary of the diffs across all the releases, instead of
+// the releases with changes only. The releases are diffed in parallel regardless of the DAG, as diffs change nothing.
+func (st *HelmState) DiffReleasesWithSummary(helm helmexec.Interface, additionalValues []string, workerLimit int, detailedExitCode, suppressSecrets bool, triggerCleanupEvents bool, opt ...DiffOpt) (*DiffSummary, []error) {
 	opts := &DiffOpts{}
 	for _, o := range opt {
 		o.Apply(opts)
 	}
 
+	summary := &DiffSummary{}
+
 	preps, prepErrs := st.prepareDiffReleases(helm, additionalValues, workerLimit, detailedExitCode, suppressSecrets, opts)
 	if len(prepErrs) > 0 {
-		return []*ReleaseSpec{}, prepErrs
+		return summary, prepErrs
 	}
 
-	jobQueue := make(chan *diffPrepareResult, len(preps))
+	jobQueue := make(chan int, len(preps))
 	results := make(chan diffResult, len(preps))
 
-	rs := []*ReleaseSpec{}
 	errs := []error{}
 
 	st.scatterGather(
@@ -1042,25 +2272,28 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 		len(preps),
 		func() {
 			for i := 0; i < len(preps); i++ {
-				jobQueue <- &preps[i]
+				jobQueue <- i
 			}
 			close(jobQueue)
 		},
 		func(workerIndex int) {
-			for prep := range jobQueue {
+			for i := range jobQueue {
+				prep := &preps[i]
 				flags := prep.flags
 				release := prep.release
-				if err := helm.DiffRelease(st.createHelmContext(release, workerIndex), release.Name, normalizeChart(st.basePath, release.Chart), flags...); err != nil {
+				if err := releaseHelm(helm, release).DiffRelease(st.createHelmContext(release, workerIndex), release.Name, st.chartFor(release), flags...); err != nil {
 					switch e := err.(type) {
+					case helmexec.DiffError:
+						results <- diffResult{i, &ReleaseError{release, err, e.ExitStatus()}, e.Changes}
 					case helmexec.ExitError:
 						// Propagate any non-zero exit status from the external command like `helm` that is failed under the hood
-						results <- diffResult{&ReleaseError{release, err, e.ExitStatus()}}
+						results <- diffResult{i, &ReleaseError{release, err, e.ExitStatus()}, 0}
 					default:
-						results <- diffResult{&ReleaseError{release, err, 0}}
+						results <- diffResult{i, &ReleaseError{release, err, 0}, 0}
 					}
 				} else {
 					// diff succeeded, found no changes
-					results <- diffResult{}
+					results <- diffResult{index: i}
 				}
 
 				if triggerCleanupEvents {
@@ -1071,50 +2304,96 @@ func (st *HelmState) DiffReleases(helm helmexec.Interface, additionalValues []st
 			}
 		},
 		func() {
+			ordered := make([]diffResult, len(preps))
 			for i := 0; i < len(preps); i++ {
 				res := <-results
-				if res.err != nil {
-					errs = append(errs, res.err)
-					if res.err.Code == 2 {
-						rs = append(rs, res.err.ReleaseSpec)
-					}
+				ordered[res.index] = res
+			}
+
+			for i, res := range ordered {
+				if res.err == nil {
+					summary.Unchanged = append(summary.Unchanged, preps[i].release)
+					continue
+				}
+				errs = append(errs, res.err)
+				if res.err.Code == 2 {
+					summary.Changed = append(summary.Changed, ReleaseDiff{ReleaseSpec: res.err.ReleaseSpec, Changes: res.changes})
 				}
 			}
 		},
 	)
 
-	return rs, errs
+	return summary, errs
 }
 
 func (st *HelmState) ReleaseStatuses(helm helmexec.Interface, workerLimit int) []error {
 	return st.scatterGatherReleases(helm, workerLimit, func(release ReleaseSpec, workerIndex int) error {
 		if !release.Desired() {
+			st.releaseSkipped(release, SkipReasonNotInstalled)
+			return nil
+		}
+
+		if release.Noop() {
 			return nil
 		}
 
 		flags := []string{}
 		flags = st.appendConnectionFlags(flags, &release)
 
-		return helm.ReleaseStatus(st.createHelmContext(&release, workerIndex), release.Name, flags...)
+		return st.withReleaseWebhook("status", release, func() error {
+			return releaseHelm(helm, &release).ReleaseStatus(st.createHelmContext(&release, workerIndex), release.Name, flags...)
+		})
 	})
 }
 
+type DeleteOpts struct {
+	// Batch deletes releases sharing the same helm context and flags within each group of the DAG in a single helm command
+	Batch bool
+
+	// Group, when greater than zero, restricts the deletion to the releases in the group of the DAG numbered so in the logs,
+	// so that a failing group can be isolated without re-running the other groups
+	Group int
+
+	// ContinueOnError keeps deleting the releases whose dependents were deleted successfully, instead of stopping at the
+	// first group with a failure. Releases needed by failed or skipped releases are skipped. All the errors are returned at the end
+	ContinueOnError bool
+
+	// StrictDependents fails before deleting any release when a release to be deleted is needed by releases filtered out by
+	// selectors, which are left running without the release they need. It is warned by default. See remainingDependents
+	StrictDependents bool
+}
+
+type DeleteOpt interface{ Apply(*DeleteOpts) }
+
+func (o *DeleteOpts) Apply(opts *DeleteOpts) {
+	*opts = *o
+}
+
 // DeleteReleases wrapper for executing helm delete on the releases
 // This function traverses the DAG of the releases in the reverse order, so that the releases that are NOT depended by any others are deleted first.
-func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm helmexec.Interface, concurrency int, purge bool) []error {
-	return st.dagAwareReverseIterateOnReleases(helm, concurrency, func(release ReleaseSpec, workerIndex int) error {
-		if !release.Desired() {
-			return nil
-		}
+func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm helmexec.Interface, concurrency int, purge bool, opt ...DeleteOpt) []error {
+	opts := &DeleteOpts{}
+	for _, o := range opt {
+		o.Apply(opts)
+	}
 
-		flags := []string{}
-		if purge && !isHelm3() {
-			flags = append(flags, "--purge")
+	// Releases with `installed: false` are never planned for deletion, as they have nothing to be deleted
+	for i := range st.Releases {
+		if !st.Releases[i].Desired() {
+			st.releaseSkipped(st.Releases[i], SkipReasonNotInstalled)
 		}
-		flags = st.appendConnectionFlags(flags, &release)
-		if isHelm3() && release.Namespace != "" {
-			flags = append(flags, "--namespace", release.Namespace)
+	}
+
+	if opts.Batch {
+		return st.deleteReleasesInBatches(affectedReleases, helm, concurrency, purge, opts)
+	}
+
+	return st.dagAwareReverseIterateOnReleases(helm, concurrency, opts, func(release ReleaseSpec, workerIndex int) error {
+		if !release.Desired() || release.Noop() {
+			return nil
 		}
+
+		flags := st.deletionFlags(&release, purge)
 		context := st.createHelmContext(&release, workerIndex)
 
 		installed, err := st.isReleaseInstalled(context, helm, release)
@@ -1122,7 +2401,9 @@ func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm hel
 			return err
 		}
 		if installed {
-			if err := helm.DeleteRelease(context, release.Name, flags...); err != nil {
+			if err := st.withReleaseWebhook("delete", release, func() error {
+				return releaseHelm(helm, &release).DeleteRelease(context, release.Name, flags...)
+			}); err != nil {
 				affectedReleases.Failed = append(affectedReleases.Failed, &release)
 				return err
 			} else {
@@ -1134,10 +2415,99 @@ func (st *HelmState) DeleteReleases(affectedReleases *AffectedReleases, helm hel
 	})
 }
 
+// deleteReleasesInBatches deletes the installed releases in each batch with a single helm command.
+// When the batch fails, it falls back to deleting the releases one by one, so that the failure is attributed to the releases that caused it.
+func (st *HelmState) deleteReleasesInBatches(affectedReleases *AffectedReleases, helm helmexec.Interface, concurrency int, purge bool, opts *DeleteOpts) []error {
+	key := func(release ReleaseSpec) string {
+		return st.releaseBatchKey(&release, st.deletionFlags(&release, purge))
+	}
+
+	return st.dagAwareReverseIterateOnReleaseBatches(concurrency, opts, key, func(batch []ReleaseSpec, workerIndex int) ([]error, []string) {
+		var errs []error
+		var failedIDs []string
+
+		flags := st.deletionFlags(&batch[0], purge)
+		context := st.createHelmContext(&batch[0], workerIndex)
+
+		var installed []ReleaseSpec
+		var names []string
+
+		for _, release := range batch {
+			if !release.Desired() || release.Noop() {
+				continue
+			}
+
+			ok, err := st.isReleaseInstalled(context, helm, release)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("release \"%s\" failed: %v", release.Name, err))
+				failedIDs = append(failedIDs, releaseToID(&release))
+			} else if ok {
+				installed = append(installed, release)
+				names = append(names, release.Name)
+			}
+		}
+
+		if len(installed) == 0 {
+			return errs, failedIDs
+		}
+
+		start := st.clock().Now()
+		if err := releaseHelm(helm, &batch[0]).DeleteReleases(context, names, flags...); err == nil {
+			duration := st.clock().Now().Sub(start)
+			for i := range installed {
+				affectedReleases.Deleted = append(affectedReleases.Deleted, &installed[i])
+				st.notifyReleaseWebhook("delete", installed[i], nil, duration)
+			}
+			return errs, failedIDs
+		} else {
+			st.workerLogger(workerIndex).Debugf("failed to delete releases %s in a batch: %v. deleting them one by one", strings.Join(names, ", "), err)
+		}
+
+		for i := range installed {
+			release := &installed[i]
+			if err := st.withReleaseWebhook("delete", *release, func() error {
+				return releaseHelm(helm, release).DeleteRelease(context, release.Name, flags...)
+			}); err != nil {
+				affectedReleases.Failed = append(affectedReleases.Failed, release)
+				errs = append(errs, fmt.Errorf("release \"%s\" failed: %v", release.Name, err))
+				failedIDs = append(failedIDs, releaseToID(release))
+			} else {
+				affectedReleases.Deleted = append(affectedReleases.Deleted, release)
+			}
+		}
+
+		return errs, failedIDs
+	})
+}
+
+// releaseBatchKey returns the key of the batch the release belongs to. Releases with the same key are run with the same helm binary,
+// tiller and flags, so that they can be processed with a single helm command.
+func (st *HelmState) releaseBatchKey(release *ReleaseSpec, flags []string) string {
+	context := st.createHelmContext(release, 0)
+	return fmt.Sprintf("%t/%s/%s/%s", context.Tillerless, context.TillerNamespace, release.HelmBinary, strings.Join(flags, " "))
+}
+
+func (st *HelmState) deletionFlags(release *ReleaseSpec, purge bool) []string {
+	flags := []string{}
+	if purge && !isHelm3() {
+		flags = append(flags, "--purge")
+	}
+	flags = st.appendConnectionFlags(flags, release)
+	if isHelm3() && release.Namespace != "" {
+		flags = append(flags, "--namespace", release.Namespace)
+	}
+	return flags
+}
+
 // TestReleases wrapper for executing helm test on the releases
 func (st *HelmState) TestReleases(helm helmexec.Interface, cleanup bool, timeout int, concurrency int) []error {
 	return st.scatterGatherReleases(helm, concurrency, func(release ReleaseSpec, workerIndex int) error {
 		if !release.Desired() {
+			st.releaseSkipped(release, SkipReasonNotInstalled)
+			return nil
+		}
+
+		if release.Noop() {
 			return nil
 		}
 
@@ -1152,7 +2522,9 @@ func (st *HelmState) TestReleases(helm helmexec.Interface, cleanup bool, timeout
 		flags = append(flags, "--timeout", duration)
 		flags = st.appendConnectionFlags(flags, &release)
 
-		return helm.TestRelease(st.createHelmContext(&release, workerIndex), release.Name, flags...)
+		return st.withReleaseWebhook("test", release, func() error {
+			return releaseHelm(helm, &release).TestRelease(st.createHelmContext(&release, workerIndex), release.Name, flags...)
+		})
 	})
 }
 
@@ -1181,8 +2553,17 @@ func (st *HelmState) Clean() []error {
 }
 
 // FilterReleases allows for the execution of helm commands against a subset of the releases in the helmfile.
+// A release is selected when it matches any of the selectors and is in any of SelectedGroups, either of which may be empty.
+//
+// Releases not selected are never processed, but still planned along with the selected ones,
+// so that the selected releases are ordered correctly even when they depend on each other only via the filtered-out ones.
+// Needs referring to releases by labels are expanded beforehand, against all the releases. See ExpandLabelNeeds.
 func (st *HelmState) FilterReleases() error {
-	var filteredReleases []ReleaseSpec
+	if err := st.ExpandLabelNeeds(); err != nil {
+		return err
+	}
+
+	var filteredReleases, filteredOutReleases []ReleaseSpec
 	releaseSet := map[string][]ReleaseSpec{}
 	filters := []ReleaseFilter{}
 	for _, label := range st.Selectors {
@@ -1192,6 +2573,10 @@ func (st *HelmState) FilterReleases() error {
 		}
 		filters = append(filters, f)
 	}
+	grouped, err := st.groupedReleases()
+	if err != nil {
+		return err
+	}
 	for _, r := range st.Releases {
 		if r.Labels == nil {
 			r.Labels = map[string]string{}
@@ -1202,25 +2587,74 @@ func (st *HelmState) FilterReleases() error {
 		// Strip off just the last portion for the name stable/newrelic would give newrelic
 		chartSplit := strings.Split(r.Chart, "/")
 		r.Labels["chart"] = chartSplit[len(chartSplit)-1]
+		if grouped != nil && !grouped[releaseToID(&r)] {
+			filteredOutReleases = append(filteredOutReleases, r)
+			st.releaseSkipped(r, SkipReasonFilteredByGroup)
+			continue
+		}
+		// Without selectors, all the releases in the groups are selected
+		matched := len(filters) == 0
 		for _, f := range filters {
 			if r.Labels == nil {
 				r.Labels = map[string]string{}
 			}
 			if f.Match(r) {
-				releaseSet[r.Name] = append(releaseSet[r.Name], r)
-				continue
+				matched = true
+				break
 			}
 		}
+		if matched {
+			releaseSet[r.Name] = append(releaseSet[r.Name], r)
+		} else {
+			filteredOutReleases = append(filteredOutReleases, r)
+			st.releaseSkipped(r, SkipReasonFilteredBySelector)
+		}
 	}
 	for _, r := range releaseSet {
 		filteredReleases = append(filteredReleases, r...)
 	}
 	st.Releases = filteredReleases
+	st.filteredOutReleases = filteredOutReleases
 	numFound := len(filteredReleases)
-	st.logger.Debugf("%d release(s) matching %s found in %s\n", numFound, strings.Join(st.Selectors, ","), st.FilePath)
+	st.logger.Debugf("%d release(s) matching %s found in %s\n", numFound, strings.Join(append(append([]string{}, st.Selectors...), st.SelectedGroups...), ","), st.FilePath)
 	return nil
 }
 
+// groupedReleases returns the IDs of the releases in SelectedGroups, along with the releases they need when IncludeGroupNeeds,
+// or nil when no group is selected. A group not defined in the helmfile selects no release, so that a group can be defined
+// in some of the nested helmfiles only. A release in a group that is not defined in the helmfile is an error, to catch typos.
+func (st *HelmState) groupedReleases() (map[string]bool, error) {
+	if len(st.SelectedGroups) == 0 {
+		return nil, nil
+	}
+
+	ids := map[string]bool{}
+	for _, group := range st.SelectedGroups {
+		for _, member := range st.Groups[group] {
+			found := false
+			for i := range st.Releases {
+				r := &st.Releases[i]
+				id := releaseToID(r)
+				if r.Name != member && id != member {
+					continue
+				}
+				found = true
+				ids[id] = true
+				if st.IncludeGroupNeeds {
+					for _, need := range st.TransitiveNeeds(id) {
+						ids[need] = true
+					}
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("group %q in %s has release %q, which is not defined. please fix the name of the release or remove it from the group", group, st.FilePath, member)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
 func (st *HelmState) PrepareReleases(helm helmexec.Interface, helmfileCommand string) []error {
 	errs := []error{}
 
@@ -1289,8 +2723,8 @@ func (st *HelmState) UpdateDeps(helm helmexec.Interface) []error {
 	var errs []error
 
 	for _, release := range st.Releases {
-		if isLocalChart(release.Chart) {
-			if err := helm.UpdateDeps(normalizeChart(st.basePath, release.Chart)); err != nil {
+		if isLocalChart(release.Chart) && !release.Noop() {
+			if err := releaseHelm(helm, &release).UpdateDeps(normalizeChart(st.basePath, release.Chart)); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -1318,8 +2752,12 @@ func (st *HelmState) BuildDeps(helm helmexec.Interface) []error {
 	errs := []error{}
 
 	for _, release := range st.Releases {
-		if isLocalChart(release.Chart) {
-			if err := helm.BuildDeps(release.Name, normalizeChart(st.basePath, release.Chart)); err != nil {
+		if st.skipDeps(&release) {
+			st.logger.Debugf("skipping building dependencies of release %q as skipDeps is set", release.Name)
+			continue
+		}
+		if isLocalChart(release.Chart) && !release.Noop() {
+			if err := releaseHelm(helm, &release).BuildDeps(release.Name, normalizeChart(st.basePath, release.Chart)); err != nil {
 				errs = append(errs, err)
 			}
 		}
@@ -1330,6 +2768,19 @@ func (st *HelmState) BuildDeps(helm helmexec.Interface) []error {
 	return nil
 }
 
+// skipDeps reports whether building the dependencies of the local chart of the release is skipped by `skipDeps` of the release,
+// or of helmDefaults when the release doesn't set it.
+func (st *HelmState) verify(release *ReleaseSpec) bool {
+	return release.Verify != nil && *release.Verify || release.Verify == nil && st.HelmDefaults.Verify
+}
+
+func (st *HelmState) skipDeps(release *ReleaseSpec) bool {
+	if release.SkipDeps != nil {
+		return *release.SkipDeps
+	}
+	return st.HelmDefaults.SkipDeps
+}
+
 func pathExists(chart string) bool {
 	_, err := os.Stat(chart)
 	return err == nil
@@ -1419,6 +2870,31 @@ func (st *HelmState) connectionFlags(release *ReleaseSpec) []string {
 	return flags
 }
 
+// verifyFlags returns the flags to verify the chart of the release against its provenance file, along with the keyring if any.
+// A local chart is checked up front, as helm fails with an unclear error for a chart directory, which can't be signed,
+// or for a packaged chart missing its `.prov` file next to it.
+func (st *HelmState) verifyFlags(release *ReleaseSpec) ([]string, error) {
+	if isLocalChart(release.Chart) {
+		chart := normalizeChart(st.basePath, release.Chart)
+		if !strings.HasSuffix(chart, ".tgz") {
+			return nil, fmt.Errorf("release %q cannot be verified as its chart %q is a directory, which has no signature. please use a packaged and signed chart, or disable verify", release.Name, release.Chart)
+		}
+		if !pathExists(chart + ".prov") {
+			return nil, fmt.Errorf("release %q cannot be verified as its chart %q has no signature: %s.prov is missing. please sign the chart, or disable verify", release.Name, release.Chart, chart)
+		}
+	}
+
+	flags := []string{"--verify"}
+
+	if release.Keyring != "" {
+		flags = append(flags, "--keyring", st.releaseStorage(release).normalizePath(release.Keyring))
+	} else if st.HelmDefaults.Keyring != "" {
+		flags = append(flags, "--keyring", st.storage().normalizePath(st.HelmDefaults.Keyring))
+	}
+
+	return flags, nil
+}
+
 func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, error) {
 	flags := []string{}
 	if release.Version != "" {
@@ -1429,8 +2905,12 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--devel")
 	}
 
-	if release.Verify != nil && *release.Verify || release.Verify == nil && st.HelmDefaults.Verify {
-		flags = append(flags, "--verify")
+	if st.verify(release) {
+		verifyFlags, err := st.verifyFlags(release)
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, verifyFlags...)
 	}
 
 	if release.Wait != nil && *release.Wait || release.Wait == nil && st.HelmDefaults.Wait {
@@ -1461,7 +2941,28 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 		flags = append(flags, "--atomic")
 	}
 
+	if release.CreateNamespace != nil && *release.CreateNamespace || release.CreateNamespace == nil && st.HelmDefaults.CreateNamespace {
+		flags = append(flags, "--create-namespace")
+	}
+
+	historyMax := release.HistoryMax
+	if historyMax == nil {
+		historyMax = st.HelmDefaults.HistoryMax
+	}
+	if historyMax != nil {
+		flags = append(flags, "--history-max", strconv.Itoa(*historyMax))
+	}
+
+	if release.DisableOpenAPIValidation != nil && *release.DisableOpenAPIValidation {
+		flags = append(flags, "--disable-openapi-validation")
+	}
+
+	if release.DryRun() {
+		flags = append(flags, "--dry-run")
+	}
+
 	flags = st.appendConnectionFlags(flags, release)
+	flags = st.appendPostRendererFlags(flags, release)
 
 	var err error
 	flags, err = st.appendHelmXFlags(flags, release)
@@ -1473,11 +2974,42 @@ func (st *HelmState) flagsForUpgrade(helm helmexec.Interface, release *ReleaseSp
 	if err != nil {
 		return nil, err
 	}
-	return append(flags, common...), nil
+	flags = append(flags, common...)
+
+	return appendExtraArgs(flags, release)
+}
+
+// managedFlags is the helm flags that must not be given via extraArgs, as helmfile generates them from the release
+// and giving them twice would make the release diverge from what the helmfile says.
+var managedFlags = map[string]bool{
+	"--namespace":        true,
+	"-n":                 true,
+	"--kube-context":     true,
+	"--tiller-namespace": true,
+	"--version":          true,
+	"--values":           true,
+	"-f":                 true,
+	"--set":              true,
+	"--set-string":       true,
+	"--set-file":         true,
+	"--post-renderer":    true,
+}
+
+// appendExtraArgs adds extraArgs of the release after the flags generated by helmfile.
+func appendExtraArgs(flags []string, release *ReleaseSpec) ([]string, error) {
+	for _, arg := range release.ExtraArgs {
+		name := strings.SplitN(arg, "=", 2)[0]
+		if managedFlags[name] {
+			return nil, fmt.Errorf("release %q: %s in extraArgs conflicts with the flag managed by helmfile. please use the corresponding field of the release instead", release.Name, name)
+		}
+	}
+
+	return append(flags, release.ExtraArgs...), nil
 }
 
 func (st *HelmState) flagsForTemplate(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, error) {
 	flags := []string{}
+	flags = st.appendPostRendererFlags(flags, release)
 
 	var err error
 	flags, err = st.appendHelmXFlags(flags, release)
@@ -1502,7 +3034,16 @@ func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec,
 		flags = append(flags, "--devel")
 	}
 
+	if release.DisableValidation != nil && *release.DisableValidation {
+		flags = append(flags, "--disable-validation")
+	}
+
+	if release.DisableOpenAPIValidation != nil && *release.DisableOpenAPIValidation {
+		flags = append(flags, "--disable-openapi-validation")
+	}
+
 	flags = st.appendConnectionFlags(flags, release)
+	flags = st.appendPostRendererFlags(flags, release)
 
 	var err error
 	flags, err = st.appendHelmXFlags(flags, release)
@@ -1517,6 +3058,52 @@ func (st *HelmState) flagsForDiff(helm helmexec.Interface, release *ReleaseSpec,
 	return append(flags, common...), nil
 }
 
+// appendPostRendererFlags adds `--post-renderer` for the release, resolving a relative path to the command against basePath.
+// A bare command name is passed as-is so that helm looks it up in PATH.
+//
+// When CommonLabels or CommonAnnotations are set, helm runs the post-renderer built into helmfile instead, via
+// `--post-renderer-args` available since helm 3.10. It stamps them onto the output of `postRenderer` of the release, if any.
+func (st *HelmState) appendPostRendererFlags(flags []string, release *ReleaseSpec) []string {
+	cmd := release.PostRenderer
+
+	if cmd != "" && !filepath.IsAbs(cmd) && strings.ContainsRune(cmd, '/') {
+		cmd = filepath.Join(st.basePath, cmd)
+		// Keep it a path even when basePath is `.`, so that helm doesn't look it up in PATH
+		if !strings.ContainsRune(cmd, '/') {
+			cmd = "./" + cmd
+		}
+	}
+
+	if len(st.CommonLabels) > 0 || len(st.CommonAnnotations) > 0 {
+		flags = append(flags, "--post-renderer", st.helmfileBinary())
+		// Each argument is given with `=`, as helm would take an argument starting with `--` for a flag
+		for _, arg := range postrender.Args(st.CommonLabels, st.CommonAnnotations, cmd) {
+			flags = append(flags, "--post-renderer-args="+arg)
+		}
+		return flags
+	}
+
+	if cmd == "" {
+		return flags
+	}
+
+	return append(flags, "--post-renderer", cmd)
+}
+
+// helmfileBinary returns HelmfileBinary, or the path to the running executable when unset
+func (st *HelmState) helmfileBinary() string {
+	if st.HelmfileBinary != "" {
+		return st.HelmfileBinary
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return "helmfile"
+	}
+
+	return exe
+}
+
 func (st *HelmState) isDevelopment(release *ReleaseSpec) bool {
 	result := st.HelmDefaults.Devel
 	if release.Devel != nil {
@@ -1541,7 +3128,7 @@ func (st *HelmState) flagsForLint(helm helmexec.Interface, release *ReleaseSpec,
 }
 
 func (st *HelmState) RenderValuesFileToBytes(path string) ([]byte, error) {
-	r := tmpl.NewFileRenderer(st.readFile, filepath.Dir(path), st.valuesFileTemplateData())
+	r := tmpl.NewFileRenderer(st.readFile, filepath.Dir(path), st.valuesFileTemplateData()).WithDeterministic(st.DeterministicSeed)
 	return r.RenderToBytes(path)
 }
 
@@ -1554,10 +3141,28 @@ func (st *HelmState) storage() *Storage {
 	}
 }
 
+// releaseStorage returns the storage to resolve the files of the release against the directory of the helmfile defining it.
+func (st *HelmState) releaseStorage(release *ReleaseSpec) *Storage {
+	s := st.storage()
+	if release.BaseDir != "" {
+		s.basePath = release.BaseDir
+	}
+	return s
+}
+
 func (st *HelmState) ExpandedHelmfiles() ([]SubHelmfileSpec, error) {
 	helmfiles := []SubHelmfileSpec{}
 	for _, hf := range st.Helmfiles {
-		if remote.IsRemote(hf.Path) {
+		enabled, err := st.subHelmfileEnabled(hf)
+		if err != nil {
+			return nil, err
+		}
+		if !enabled {
+			st.logger.Debugf("skipping helmfile %q as its condition %q is false", hf.Path, hf.Condition)
+			continue
+		}
+
+		if remote.IsRemote(hf.Path) || remote.IsHTTPURL(hf.Path) {
 			helmfiles = append(helmfiles, hf)
 			continue
 		}
@@ -1569,7 +3174,20 @@ func (st *HelmState) ExpandedHelmfiles() ([]SubHelmfileSpec, error) {
 		if len(matches) == 0 {
 			continue
 		}
+		excluded, err := st.excludedHelmfiles(hf)
+		if err != nil {
+			return nil, err
+		}
+		isGlob := strings.ContainsAny(hf.Path, "*?[")
 		for _, match := range matches {
+			if excluded[match] {
+				st.logger.Debugf("skipping helmfile %q as it is excluded", match)
+				continue
+			}
+			if isGlob && strings.HasPrefix(filepath.Base(match), "_") {
+				st.logger.Debugf("skipping helmfile %q matched by %q as its name starts with an underscore", match, hf.Path)
+				continue
+			}
 			newHelmfile := hf
 			newHelmfile.Path = match
 			helmfiles = append(helmfiles, newHelmfile)
@@ -1579,13 +3197,50 @@ func (st *HelmState) ExpandedHelmfiles() ([]SubHelmfileSpec, error) {
 	return helmfiles, nil
 }
 
+// excludedHelmfiles returns the set of the files matched by the excludes of the sub helmfile, which are resolved like the path
+func (st *HelmState) excludedHelmfiles(hf SubHelmfileSpec) (map[string]bool, error) {
+	excluded := map[string]bool{}
+	for _, pattern := range hf.Excludes {
+		matches, err := st.storage().ExpandPaths(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			excluded[m] = true
+		}
+	}
+	return excluded, nil
+}
+
+// subHelmfileEnabled evaluates the condition of the sub helmfile against the environment of the state.
+// A condition like `condition: {{ eq .Environment.Name "prod" }}` is already rendered along with the helmfile, and rendering it
+// once more here is a no-op. It still allows a template expression escaped in the helmfile to be evaluated with the merged environment.
+func (st *HelmState) subHelmfileEnabled(hf SubHelmfileSpec) (bool, error) {
+	if hf.Condition == "" {
+		return true, nil
+	}
+
+	r := tmpl.NewFileRenderer(st.readFile, st.basePath, st.valuesFileTemplateData())
+	cond, err := r.RenderTemplateContentToString([]byte(hf.Condition))
+	if err != nil {
+		return false, fmt.Errorf("failed evaluating condition of helmfile %q: %v", hf.Path, err)
+	}
+
+	enabled, err := getBoolRefFromStringTemplate(strings.TrimSpace(cond))
+	if err != nil {
+		return false, fmt.Errorf("failed evaluating condition of helmfile %q: %v", hf.Path, err)
+	}
+
+	return *enabled, nil
+}
+
 func (st *HelmState) generateTemporaryValuesFiles(values []interface{}, missingFileHandler *string) ([]string, error) {
 	generatedFiles := []string{}
 
 	for _, value := range values {
 		switch typedValue := value.(type) {
 		case string:
-			paths, skip, err := st.storage().resolveFile(missingFileHandler, "values", typedValue)
+			path, yamlBytes, skip, err := st.renderValuesFile(missingFileHandler, typedValue)
 			if err != nil {
 				return nil, err
 			}
@@ -1593,16 +3248,6 @@ func (st *HelmState) generateTemporaryValuesFiles(values []interface{}, missingF
 				continue
 			}
 
-			if len(paths) > 1 {
-				return nil, fmt.Errorf("glob patterns in release values and secrets is not supported yet. please submit a feature request if necessary")
-			}
-			path := paths[0]
-
-			yamlBytes, err := st.RenderValuesFileToBytes(path)
-			if err != nil {
-				return nil, fmt.Errorf("failed to render values files \"%s\": %v", typedValue, err)
-			}
-
 			valfile, err := ioutil.TempFile("", "values")
 			if err != nil {
 				return nil, err
@@ -1633,17 +3278,125 @@ func (st *HelmState) generateTemporaryValuesFiles(values []interface{}, missingF
 	return generatedFiles, nil
 }
 
-func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, error) {
-	flags := []string{}
-	if release.Namespace != "" {
-		flags = append(flags, "--namespace", release.Namespace)
+// renderValuesFile renders the values file at the path, returning the path resolved against the directory of the helmfile.
+// It returns true instead when the file is missing and skipped as told by the missingFileHandler.
+func (st *HelmState) renderValuesFile(missingFileHandler *string, value string) (string, []byte, bool, error) {
+	paths, skip, err := st.storage().resolveFile(missingFileHandler, "values", value)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if skip {
+		return "", nil, true, nil
+	}
+
+	if len(paths) > 1 {
+		return "", nil, false, fmt.Errorf("glob patterns in release values and secrets is not supported yet. please submit a feature request if necessary")
+	}
+	path := paths[0]
+
+	yamlBytes, err := st.RenderValuesFileToBytes(path)
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to render values files \"%s\": %v", value, err)
+	}
+
+	return path, yamlBytes, false, nil
+}
+
+// decryptSecret decrypts the secrets file of the release via helm-secrets, returning the path to the decrypted file, which is
+// removed along with the other generated values files of the release. It returns true instead when the file is missing and
+// skipped as told by the missingFileHandler of the release.
+func (st *HelmState) decryptSecret(helm helmexec.Interface, release *ReleaseSpec, workerIndex int, value string) (string, bool, error) {
+	file := release.ValuesPathPrefix + value
+	if remote.IsRemote(value) {
+		var err error
+		if file, err = st.fetchRemoteFile(release, "secrets", value); err != nil {
+			return "", false, err
+		}
+	}
+
+	paths, skip, err := st.releaseStorage(release).resolveFile(release.MissingFileHandler, "secrets", file)
+	if err != nil {
+		return "", false, err
+	}
+	if skip {
+		return "", true, nil
+	}
+
+	if len(paths) > 1 {
+		return "", false, fmt.Errorf("glob patterns in release secret file is not supported yet. please submit a feature request if necessary")
+	}
+	path := paths[0]
+
+	decryptFlags := st.appendConnectionFlags([]string{}, release)
+	valfile, err := releaseHelm(helm, release).DecryptSecret(st.createHelmContext(release, workerIndex), path, decryptFlags...)
+	if err != nil {
+		return "", false, err
+	}
+
+	release.generatedValues = append(release.generatedValues, valfile)
+
+	return valfile, false, nil
+}
+
+// fetchRemoteFile fetches the values or secrets file of the release referred to by a go-getter URL, like
+// `git::https://github.com/org/shared-values.git@path/to/values.yaml?ref=v1.0.0`, returning the path to the fetched file,
+// so that it is read exactly like a local file, including rendering a `.gotmpl` values file or decrypting a secrets file.
+//
+// It is fetched only when the release is processed, so that neither unselected releases nor `helmfile build` fetch it, and the spec
+// of the release keeps the URL. The remote directory is cached by its URL and query like `ref`, like remote helmfiles.
+// go-getter handles the authentication, like credentials in the URL and `sshkey`, and shallow clones via `depth`.
+func (st *HelmState) fetchRemoteFile(release *ReleaseSpec, tpe, src string) (string, error) {
+	if st.RemoteFetcher == nil {
+		return "", fmt.Errorf("failed fetching %s file %q of release %q: remote files can't be fetched in this helmfile", tpe, src, release.Name)
+	}
+
+	path, err := st.RemoteFetcher(src)
+	if err != nil {
+		return "", fmt.Errorf("failed fetching %s file %q of release %q: %v", tpe, src, release.Name, err)
+	}
+
+	st.logger.Debugf("fetched %s file %q of release %q to %q", tpe, src, release.Name, path)
+
+	return path, nil
+}
+
+// resolveValsSecret resolves the secrets entry of the release that is a reference like `ref+vault://path/to/secrets` via vals.
+// It must be resolved to a map of values, as there's no file to be decrypted by helm-secrets.
+// It is resolved only when the release is processed, so that neither unselected releases nor `helmfile build` resolve it.
+func (st *HelmState) resolveValsSecret(release *ReleaseSpec, ref string) (interface{}, error) {
+	if st.valsRuntime == nil {
+		return nil, fmt.Errorf("failed resolving secret %q of release %q: vals is not available", ref, release.Name)
+	}
+
+	resolved, err := st.valsRuntime.Eval(map[string]interface{}{"secret": ref})
+	if err != nil {
+		return nil, fmt.Errorf("failed resolving secret %q of release %q: %v", ref, release.Name, err)
+	}
+
+	switch v := resolved["secret"].(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("failed resolving secret %q of release %q: it must be resolved to a map of values, but got %T", ref, release.Name, v)
 	}
+}
 
+// releaseValuesEntries returns the values entries of the release, with the paths to values files resolved against the directory
+// of the helmfile defining the release, and the references to secrets like `ref+vault://...` resolved via vals.
+func (st *HelmState) releaseValuesEntries(release *ReleaseSpec) ([]interface{}, error) {
 	values := []interface{}{}
 	for _, v := range release.Values {
 		switch typedValue := v.(type) {
 		case string:
-			path := st.storage().normalizePath(release.ValuesPathPrefix + typedValue)
+			if remote.IsRemote(typedValue) {
+				path, err := st.fetchRemoteFile(release, "values", typedValue)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, path)
+				continue
+			}
+			path := st.releaseStorage(release).normalizePath(release.ValuesPathPrefix + typedValue)
 			values = append(values, path)
 		default:
 			values = append(values, v)
@@ -1660,6 +3413,20 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 		return nil, fmt.Errorf("Failed to render values in %s for release %s: type %T isn't supported", st.FilePath, release.Name, valuesMapSecretsRendered["values"])
 	}
 
+	return valuesSecretsRendered, nil
+}
+
+func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *ReleaseSpec, workerIndex int) ([]string, error) {
+	flags := []string{}
+	if release.Namespace != "" {
+		flags = append(flags, "--namespace", release.Namespace)
+	}
+
+	valuesSecretsRendered, err := st.releaseValuesEntries(release)
+	if err != nil {
+		return nil, err
+	}
+
 	generatedFiles, err := st.generateTemporaryValuesFiles(valuesSecretsRendered, release.MissingFileHandler)
 	if err != nil {
 		return nil, err
@@ -1672,26 +3439,31 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 	release.generatedValues = append(release.generatedValues, generatedFiles...)
 
 	for _, value := range release.Secrets {
-		paths, skip, err := st.storage().resolveFile(release.MissingFileHandler, "secrets", release.ValuesPathPrefix+value)
-		if err != nil {
-			return nil, err
-		}
-		if skip {
-			continue
-		}
+		if strings.HasPrefix(value, ValsRefPrefix) {
+			vals, err := st.resolveValsSecret(release, value)
+			if err != nil {
+				return nil, err
+			}
+
+			generatedFiles, err := st.generateTemporaryValuesFiles([]interface{}{vals}, release.MissingFileHandler)
+			if err != nil {
+				return nil, err
+			}
+
+			flags = append(flags, "--values", generatedFiles[0])
+			release.generatedValues = append(release.generatedValues, generatedFiles...)
 
-		if len(paths) > 1 {
-			return nil, fmt.Errorf("glob patterns in release secret file is not supported yet. please submit a feature request if necessary")
+			continue
 		}
-		path := paths[0]
 
-		decryptFlags := st.appendConnectionFlags([]string{}, release)
-		valfile, err := helm.DecryptSecret(st.createHelmContext(release, workerIndex), path, decryptFlags...)
+		valfile, skip, err := st.decryptSecret(helm, release, workerIndex, value)
 		if err != nil {
 			return nil, err
 		}
+		if skip {
+			continue
+		}
 
-		release.generatedValues = append(release.generatedValues, valfile)
 		flags = append(flags, "--values", valfile)
 	}
 	if len(release.SetValues) > 0 {
@@ -1703,7 +3475,7 @@ func (st *HelmState) namespaceAndValuesFlags(helm helmexec.Interface, release *R
 				}
 				flags = append(flags, "--set", fmt.Sprintf("%s=%s", escape(set.Name), escape(renderedValue[0])))
 			} else if set.File != "" {
-				flags = append(flags, "--set-file", fmt.Sprintf("%s=%s", escape(set.Name), st.storage().normalizePath(set.File)))
+				flags = append(flags, "--set-file", fmt.Sprintf("%s=%s", escape(set.Name), st.releaseStorage(release).normalizePath(set.File)))
 			} else if len(set.Values) > 0 {
 				renderedValues, err := renderValsSecrets(st.valsRuntime, set.Values...)
 				if err != nil {
@@ -1791,6 +3563,13 @@ func (ar *AffectedReleases) DisplayAffectedReleases(logger *zap.SugaredLogger) {
 			logger.Info(release.Name)
 		}
 	}
+	if ar.DryRun != nil {
+		logger.Info("\nList of releases dry-run :")
+		logger.Info("RELEASE")
+		for _, release := range ar.DryRun {
+			logger.Info(release.Name)
+		}
+	}
 	if ar.Failed != nil {
 		logger.Info("\nList of releases in error :")
 		logger.Info("RELEASE")
@@ -1823,6 +3602,10 @@ func (hf *SubHelmfileSpec) UnmarshalYAML(unmarshal func(interface{}) error) erro
 			Path               string   `yaml:"path"`
 			Selectors          []string `yaml:"selectors"`
 			SelectorsInherited bool     `yaml:"selectorsInherited"`
+			Namespace          string   `yaml:"namespace"`
+			Condition          string   `yaml:"condition"`
+			ImportExports      bool     `yaml:"importExports"`
+			Excludes           []string `yaml:"excludes"`
 
 			Environment SubhelmfileEnvironmentSpec `yaml:",inline"`
 		}
@@ -1832,6 +3615,10 @@ func (hf *SubHelmfileSpec) UnmarshalYAML(unmarshal func(interface{}) error) erro
 		hf.Path = subHelmfileSpecTmp.Path
 		hf.Selectors = subHelmfileSpecTmp.Selectors
 		hf.SelectorsInherited = subHelmfileSpecTmp.SelectorsInherited
+		hf.Namespace = subHelmfileSpecTmp.Namespace
+		hf.Condition = subHelmfileSpecTmp.Condition
+		hf.ImportExports = subHelmfileSpecTmp.ImportExports
+		hf.Excludes = subHelmfileSpecTmp.Excludes
 		hf.Environment = subHelmfileSpecTmp.Environment
 	}
 	//since we cannot make sur the "console" string can be red after the "path" we must check we don't have
@@ -1871,7 +3658,31 @@ func (st *HelmState) GenerateOutputDir(outputDir string, release ReleaseSpec) (s
 	return path.Join(outputDir, sb.String()), nil
 }
 
-func (st *HelmState) ToYaml() (string, error) {
+// MarshalYAML implements yaml.Marshaler.
+// The state values are serialized as a single `values` entry that contains the default values merged with the environment values,
+// so that the result reflects the values actually used to render releases.
+func (st HelmState) MarshalYAML() (interface{}, error) {
+	// helmState is an alias to HelmState without methods, that is required to not recursively call MarshalYAML
+	type helmState HelmState
+
+	vals, err := st.Values()
+	if err != nil {
+		return nil, err
+	}
+
+	s := helmState(st)
+	if len(vals) > 0 {
+		s.DefaultValues = []interface{}{vals}
+	} else {
+		s.DefaultValues = nil
+	}
+
+	return s, nil
+}
+
+// Build returns the YAML representation of the state, after all the templates are rendered and the environment values are merged.
+// Map keys are sorted and releases are kept in the declared order, so that the output can be diffed across runs.
+func (st *HelmState) Build() (string, error) {
 	if result, err := yaml.Marshal(st); err != nil {
 		return "", err
 	} else {
@@ -1,35 +1,52 @@
 package state
 
 import (
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/roboll/helmfile/pkg/helmexec"
 	"github.com/variantdev/dag/pkg/dag"
+	"go.uber.org/zap"
 )
 
 type result struct {
-	release ReleaseSpec
-	err     error
+	release  ReleaseSpec
+	err      error
+	duration time.Duration
 }
 
-func (st *HelmState) scatterGather(concurrency int, items int, produceInputs func(), receiveInputsAndProduceIntermediates func(int), aggregateIntermediates func()) {
+// Clock tells the current time. See HelmState.Clock
+type Clock interface {
+	Now() time.Time
+}
 
-	if concurrency < 1 || concurrency > items {
-		concurrency = items
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (st *HelmState) clock() Clock {
+	if st.Clock != nil {
+		return st.Clock
 	}
+	return realClock{}
+}
 
-	for _, r := range st.Releases {
-		if r.Tillerless != nil {
-			if *r.Tillerless {
-				concurrency = 1
-			}
-		} else if st.HelmDefaults.Tillerless {
-			concurrency = 1
-		}
+func (st *HelmState) scatterGather(concurrency int, items int, produceInputs func(), receiveInputsAndProduceIntermediates func(int), aggregateIntermediates func()) {
+	// There's nothing to produce nor aggregate. Return early without starting any goroutine, so that no one waits on
+	// channels that are never sent to nor received from.
+	if items < 1 {
+		return
 	}
 
+	concurrency = st.workers(concurrency, items)
+
 	// WaitGroup is required to wait until goroutine per job in job queue cleanly stops.
 	var waitGroup sync.WaitGroup
 	waitGroup.Add(concurrency)
@@ -51,6 +68,44 @@ func (st *HelmState) scatterGather(concurrency int, items int, produceInputs fun
 	waitGroup.Wait()
 }
 
+// workers returns the number of workers started by scatterGather to process the items with the concurrency.
+func (st *HelmState) workers(concurrency int, items int) int {
+	concurrency = st.cappedConcurrency(concurrency, items)
+
+	// Tillerless releases are processed one by one unless explicitly allowed, as concurrent `helm tiller run`s may conflict
+	if !st.HelmDefaults.TillerlessAllowConcurrency {
+		for _, r := range st.Releases {
+			if r.Tillerless != nil {
+				if *r.Tillerless {
+					concurrency = 1
+				}
+			} else if st.HelmDefaults.Tillerless {
+				concurrency = 1
+			}
+		}
+	}
+
+	return concurrency
+}
+
+// cappedConcurrency returns the concurrency to process the items with, defaulted to DefaultConcurrency and capped by MaxConcurrency.
+// Unlike workers, it never limits the concurrency to one for tillerless releases.
+func (st *HelmState) cappedConcurrency(concurrency int, items int) int {
+	if concurrency < 1 {
+		concurrency = st.DefaultConcurrency
+	}
+
+	if concurrency < 1 || concurrency > items {
+		concurrency = items
+	}
+
+	if st.MaxConcurrency > 0 && concurrency > st.MaxConcurrency {
+		concurrency = st.MaxConcurrency
+	}
+
+	return concurrency
+}
+
 func (st *HelmState) scatterGatherReleases(helm helmexec.Interface, concurrency int,
 	do func(ReleaseSpec, int) error) []error {
 
@@ -59,44 +114,94 @@ func (st *HelmState) scatterGatherReleases(helm helmexec.Interface, concurrency
 
 func (st *HelmState) iterateOnReleases(helm helmexec.Interface, concurrency int, inputs []ReleaseSpec,
 	do func(ReleaseSpec, int) error) []error {
+	return st.iterateOnReleasesUntil(helm, concurrency, inputs, do, nil)
+}
+
+// iterateOnReleasesUntil is iterateOnReleases that stops dispatching releases to workers as soon as abort returns true for
+// the errors occurred so far. abort is never called when nil.
+//
+// On abort, the releases already dispatched are still waited for and their results are received, so that no worker is
+// left blocked on sending its result. The releases never dispatched are neither processed nor reported as errors.
+func (st *HelmState) iterateOnReleasesUntil(helm helmexec.Interface, concurrency int, inputs []ReleaseSpec,
+	do func(ReleaseSpec, int) error, abort func([]error) bool) []error {
 	var errs []error
+	var timings []ReleaseTiming
 
 	inputsSize := len(inputs)
 
 	releases := make(chan ReleaseSpec)
-	results := make(chan result)
+	// Buffered so that workers never wait for the aggregation to receive their results before processing the next releases.
+	// The aggregation still receives exactly one result per dispatched release.
+	results := make(chan result, inputsSize)
+	// done is closed on abort, to stop dispatching releases
+	done := make(chan struct{})
+	// dispatched receives the number of releases dispatched to workers, once all of them are dispatched or on abort.
+	// Buffered so that the producer never waits for the aggregation, which stops receiving it once all the results are received.
+	dispatched := make(chan int, 1)
+	slots := st.newNamespaceSlots()
+	order := st.newDispatchOrder()
 
 	st.scatterGather(
 		concurrency,
 		inputsSize,
 		func() {
-			for _, release := range inputs {
-				releases <- release
-			}
+			n := 0
+			slots.dispatch(inputsSize, func(i int) string {
+				return st.ReleaseNamespace(&inputs[i])
+			}, func(i int) {
+				select {
+				case releases <- inputs[i]:
+					n++
+					order.wait()
+				case <-done:
+					// The slot taken for the release is freed as no worker is going to process it
+					slots.free(st.ReleaseNamespace(&inputs[i]))
+				}
+			})
 			close(releases)
+			dispatched <- n
 		},
 		func(id int) {
+			logger := st.workerLogger(id)
 			for release := range releases {
-				err := do(release, id)
-				st.logger.Debugf("sending result for release: %s\n", release.Name)
-				results <- result{release: release, err: err}
-				st.logger.Debugf("sent result for release: %s\n", release.Name)
+				r := st.processRelease(release, id, slots, order, do)
+				logger.Debugf("sending result for release: %s\n", release.Name)
+				results <- r
+				logger.Debugf("sent result for release: %s\n", release.Name)
 			}
 		},
 		func() {
-			for i := range inputs {
-				st.logger.Debugf("receiving result %d", i)
-				r := <-results
+			aborted := false
+			total := inputsSize
+			for i := 0; i < total; {
+				var r result
+				select {
+				case n := <-dispatched:
+					total = n
+					continue
+				case r = <-results:
+				}
+				st.logger.Debugf("received result %d", i)
+				i++
+				st.logger.Debugf("release \"%s\" finished in %s", r.release.Name, r.duration)
+				timings = append(timings, ReleaseTiming{Release: releaseToID(&r.release), Duration: r.duration, Err: r.err})
 				if r.err != nil {
-					errs = append(errs, fmt.Errorf("release \"%s\" failed: %v", r.release.Name, r.err))
+					errs = append(errs, r.failure())
 				} else {
 					st.logger.Debugf("received result for release \"%s\"", r.release.Name)
 				}
 				st.logger.Debugf("received result for %d", i)
+				if !aborted && abort != nil && abort(errs) {
+					st.logger.Debugf("aborting after %d results", i)
+					aborted = true
+					close(done)
+				}
 			}
 		},
 	)
 
+	st.sinkReleaseTimings(timings)
+
 	if len(errs) != 0 {
 		return errs
 	}
@@ -104,51 +209,1508 @@ func (st *HelmState) iterateOnReleases(helm helmexec.Interface, concurrency int,
 	return nil
 }
 
-func (st *HelmState) dagAwareReverseIterateOnReleases(helm helmexec.Interface, concurrency int,
-	do func(ReleaseSpec, int) error) []error {
+// processRelease processes the release in the worker between BeforeRelease and AfterRelease, after its readiness probes pass,
+// and frees the slot of its namespace taken on dispatch. See namespaceSlots and dispatchOrder for more details.
+func (st *HelmState) processRelease(release ReleaseSpec, workerIndex int, slots *namespaceSlots, order *dispatchOrder,
+	do func(ReleaseSpec, int) error) result {
+	var err error
+	if st.BeforeRelease != nil {
+		err = st.BeforeRelease(release)
+	}
+	if err == nil {
+		err = st.waitForReadiness(release, st.workerLogger(workerIndex))
+	}
+	order.start()
+	start := st.clock().Now()
+	if err == nil {
+		err = st.doRecoverably(do, release, workerIndex)
+	}
+	duration := st.clock().Now().Sub(start)
+	slots.free(st.ReleaseNamespace(&release))
+	if st.AfterRelease != nil {
+		st.AfterRelease(release, err, duration)
+	}
+	return result{release: release, err: err, duration: duration}
+}
 
-	idToRelease := map[string]ReleaseSpec{}
+// failure returns the error of the failed release, annotated with the release name and the file the release is defined in.
+func (r result) failure() error {
+	if r.release.SourceFile != "" {
+		return fmt.Errorf("release \"%s\" (from %s) failed: %v", r.release.Name, r.release.SourceFile, r.err)
+	}
+	return fmt.Errorf("release \"%s\" failed: %v", r.release.Name, r.err)
+}
 
-	preps := st.Releases
+// sinkReleaseTimings sends the timings to ReleaseTimingsSink, slowest first, when set.
+func (st *HelmState) sinkReleaseTimings(timings []ReleaseTiming) {
+	if st.ReleaseTimingsSink == nil || len(timings) == 0 {
+		return
+	}
 
-	d := dag.New()
-	for _, r := range preps {
+	sort.SliceStable(timings, func(i, j int) bool {
+		return timings[i].Duration > timings[j].Duration
+	})
+	st.ReleaseTimingsSink(timings)
+}
+
+// ReleaseTiming is the wall-clock duration of processing a release, like running `helm upgrade --install` for it.
+type ReleaseTiming struct {
+	// Release is the [TILLER_NS/][NS/]NAME of the release
+	Release string
+	// Duration is the time taken to process the release, excluding the time spent waiting for a worker
+	Duration time.Duration
+	// Err is the error occurred while processing the release, if any
+	Err error
+}
 
-		id := releaseToID(&r)
+// SkipReason is the reason why a release is skipped without being processed. See HelmState.ReleaseSkipped
+type SkipReason string
 
-		idToRelease[id] = r
+const (
+	// SkipReasonNotInstalled is for a release with `installed: false` that has nothing to be processed,
+	// like on templating, or on syncing it while it is already uninstalled
+	SkipReasonNotInstalled SkipReason = "not-installed"
+	// SkipReasonToBeDeleted is for a release with `installed: false` on diffing, which is not diffed as it is going to be
+	// uninstalled on sync, unless it is already uninstalled
+	SkipReasonToBeDeleted SkipReason = "to-be-deleted"
+	// SkipReasonFilteredBySelector is for a release not matching any of the selectors given by `--selector`
+	SkipReasonFilteredBySelector SkipReason = "filtered-by-selector"
+	// SkipReasonFilteredByGroup is for a release not in any of the groups given by `--group`
+	SkipReasonFilteredByGroup SkipReason = "filtered-by-group"
+	// SkipReasonNeedsNotInstalled is for a release pruned from the DAG by `--skip-needs-not-installed`, as it needs
+	// a release that is not going to be installed, directly or indirectly
+	SkipReasonNeedsNotInstalled SkipReason = "needs-not-installed"
+	// SkipReasonNeedsFailed is for a release hard-needing a release that failed or was skipped, while syncing goes on
+	// as the failures are below SyncOpts.MaxFailures
+	SkipReasonNeedsFailed SkipReason = "needs-failed"
+	// SkipReasonNeedsDryRun is for a release hard-needing a release synced in the dry-run mode, directly or indirectly, as what
+	// it needs isn't really applied. See ReleaseSpec.DryRunMode
+	SkipReasonNeedsDryRun SkipReason = "needs-dry-run"
+)
 
-		d.Add(id, dag.Dependencies(r.Needs))
+// releaseSkipped calls ReleaseSkipped for the release when set.
+func (st *HelmState) releaseSkipped(release ReleaseSpec, reason SkipReason) {
+	if st.ReleaseSkipped != nil {
+		st.ReleaseSkipped(release, reason)
 	}
+}
 
-	plan, err := d.Plan()
-	if err != nil {
-		return []error{err}
+// workerLogger returns the logger that tags every log entry with the worker index.
+// `do` functions given to iterateOnReleases should log with it, so that interleaved logs of releases processed concurrently
+// can be correlated to workers.
+func (st *HelmState) workerLogger(workerIndex int) *zap.SugaredLogger {
+	return st.logger.With("worker", workerIndex)
+}
+
+// doRecoverably calls `do` for the release while recovering from a panic in it.
+// A panic is turned into an error for the release, so that a bug or a nil dereference in processing a release doesn't crash
+// the whole process nor leave other workers waiting forever.
+func (st *HelmState) doRecoverably(do func(ReleaseSpec, int) error, release ReleaseSpec, workerIndex int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			st.workerLogger(workerIndex).Debugf("recovered from panic while processing release \"%s\": %v\n%s", release.Name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return do(release, workerIndex)
+}
+
+// dagAwareReverseIterateOnReleases calls `do` for each release in the reverse order of the DAG.
+//
+// Each release is processed as soon as all the releases needing it are done, rather than after the whole group preceding it,
+// so that a release needed only by releases done early never waits for unrelated ones. See reverseIterateOnReleasesEagerly.
+// When opts.Group is greater than zero, only the releases in the group are processed, as dagAwareReverseIterateOnReleaseGroups does.
+func (st *HelmState) dagAwareReverseIterateOnReleases(helm helmexec.Interface, concurrency int, opts *DeleteOpts,
+	do func(ReleaseSpec, int) error) []error {
+
+	if opts.Group == 0 {
+		releases, idToRelease, plan, errs := st.planDeletion(opts)
+		if len(errs) > 0 {
+			return errs
+		}
+
+		return st.reverseIterateOnReleasesEagerly(concurrency, releases, idToRelease, plan, opts, do)
+	}
+
+	var m sync.Mutex
+
+	return st.dagAwareReverseIterateOnReleaseGroups(opts, func(releasesInGroup []ReleaseSpec) ([]error, []string) {
+		var failedIDs []string
+
+		errs := st.iterateOnReleases(helm, concurrency, releasesInGroup, func(release ReleaseSpec, workerIndex int) error {
+			err := do(release, workerIndex)
+			if err != nil {
+				m.Lock()
+				failedIDs = append(failedIDs, releaseToID(&release))
+				m.Unlock()
+			}
+			return err
+		})
+
+		return errs, failedIDs
+	})
+}
+
+// dagAwareReverseIterateOnReleaseBatches is the batched variant of dagAwareReverseIterateOnReleases.
+// Releases in each group of the DAG are split into batches of releases sharing the same key, and `do` is called once per batch
+// so that the batch can be processed with a single helm command.
+// `do` is responsible for attributing errors to the releases in the batch, by returning the IDs of the failed releases along with
+// the errors, so that failures of softly needed releases don't abort the remaining groups as dagAwareReverseIterateOnReleases does.
+func (st *HelmState) dagAwareReverseIterateOnReleaseBatches(concurrency int, opts *DeleteOpts, key func(ReleaseSpec) string,
+	do func([]ReleaseSpec, int) ([]error, []string)) []error {
+
+	return st.dagAwareReverseIterateOnReleaseGroups(opts, func(releasesInGroup []ReleaseSpec) ([]error, []string) {
+		return st.iterateOnReleaseBatches(concurrency, batchReleases(releasesInGroup, key), do)
+	})
+}
+
+// dagAwareReverseIterateOnReleaseGroups calls `do` for each group of releases in the DAG, in the reverse order.
+// `do` returns errors along with the IDs of the failed releases, so that the remaining groups are still processed
+// when all the failures are soft. See isSoftFailure for more details.
+//
+// When opts.Group is greater than zero, only the group numbered so in the logs is processed.
+// When opts.ContinueOnError is true, failures never abort the remaining groups. Instead, each release is skipped when any release
+// hard-needing it failed or was skipped, as it may still be in use. See skippedByFailedDependents for more details.
+func (st *HelmState) dagAwareReverseIterateOnReleaseGroups(opts *DeleteOpts, do func([]ReleaseSpec) ([]error, []string)) []error {
+	releases, idToRelease, plan, errs := st.planDeletion(opts)
+	if len(errs) > 0 {
+		return errs
 	}
 
 	groupsTotal := len(plan)
 
+	group := opts.Group
+
 	st.logger.Debugf("processing %d groups of releases in this order: %s", groupsTotal, plan)
 
+	var softErrs []error
+
+	// failed is the IDs of the failed and skipped releases, used only when opts.ContinueOnError is true
+	failed := map[string]bool{}
+
 	for groupIndex := len(plan) - 1; groupIndex >= 0; groupIndex-- {
 		dagNodesInGroup := plan[groupIndex]
 
+		if group > 0 && groupIndex+1 != group {
+			continue
+		}
+
 		var idsInGroup []string
 		var releasesInGroup []ReleaseSpec
 
 		for _, node := range dagNodesInGroup {
+			if opts.ContinueOnError {
+				if dependent, ok := skippedByFailedDependents(releases, failed, node.Id); ok {
+					st.logger.Warnf("skipping %q as %q needing it failed or was skipped", node.Id, dependent)
+					softErrs = append(softErrs, fmt.Errorf("release \"%s\" skipped: %q needing it failed or was skipped", idToRelease[node.Id].Name, dependent))
+					failed[node.Id] = true
+					continue
+				}
+			}
+
 			releasesInGroup = append(releasesInGroup, idToRelease[node.Id])
 			idsInGroup = append(idsInGroup, node.Id)
 		}
 
+		if len(releasesInGroup) == 0 {
+			continue
+		}
+
 		st.logger.Debugf("processing releases in group %d/%d: %s", groupIndex+1, groupsTotal, strings.Join(idsInGroup, ", "))
 
-		errs := st.iterateOnReleases(helm, concurrency, releasesInGroup, do)
+		errs, failedIDs := do(releasesInGroup)
+
+		if len(errs) > 0 && opts.ContinueOnError {
+			// Failures not attributed to releases are attributed to the whole group to be safe
+			if len(failedIDs) == 0 {
+				failedIDs = idsInGroup
+			}
+			for _, id := range failedIDs {
+				failed[id] = true
+			}
+
+			softErrs = append(softErrs, errs...)
+
+			continue
+		}
 
 		if len(errs) > 0 {
-			return errs
+			if !allSoftFailures(releases, failedIDs, true) {
+				return append(softErrs, errs...)
+			}
+
+			st.logger.Warnf("continuing as the failed releases are only softly needed: %s", strings.Join(failedIDs, ", "))
+
+			softErrs = append(softErrs, errs...)
 		}
 	}
 
+	if len(softErrs) > 0 {
+		return softErrs
+	}
+
 	return nil
 }
+
+// planDeletion plans the releases to be deleted, returning them along with the releases keyed by their IDs.
+// It fails when a release to be deleted is needed by releases not going to be deleted and opts.StrictDependents is true,
+// or when opts.Group is out of the range of the groups planned.
+func (st *HelmState) planDeletion(opts *DeleteOpts) ([]*ReleaseSpec, map[string]ReleaseSpec, dag.Topology, []error) {
+	releases, idToRelease := st.releasesByID()
+
+	plan, err := st.planReleasesToDelete(releases)
+	if err != nil {
+		return nil, nil, nil, []error{err}
+	}
+
+	var dependentErrs []error
+	for _, d := range st.remainingDependents() {
+		msg := fmt.Sprintf("deleting %q breaks %s needing it, which are not going to be deleted", d.Release, strings.Join(d.Dependents, ", "))
+		if opts.StrictDependents {
+			dependentErrs = append(dependentErrs, errors.New(msg))
+		} else {
+			st.logger.Warnf("%s. run with --strict-dependents to make it an error", msg)
+		}
+	}
+	if len(dependentErrs) > 0 {
+		return nil, nil, nil, dependentErrs
+	}
+
+	if groupsTotal := len(plan); opts.Group < 0 || opts.Group > groupsTotal {
+		return nil, nil, nil, []error{fmt.Errorf("group %d is out of range: it must be between 1 and %d", opts.Group, groupsTotal)}
+	}
+
+	return releases, idToRelease, plan, nil
+}
+
+// remainingDependent is a release to be deleted along with the releases that hard-need it but are not going to be deleted.
+type remainingDependent struct {
+	Release    string
+	Dependents []string
+}
+
+// remainingDependents looks "upward" in the DAG for releases filtered out by selectors that hard-need the releases to be deleted.
+// Such releases are left running without the releases they need, like an app left without its database.
+// Soft needs and releases with `installed: false` are ignored, as deleting the releases they need never breaks them.
+func (st *HelmState) remainingDependents() []remainingDependent {
+	deleted := map[string]bool{}
+	for i := range st.Releases {
+		if st.Releases[i].Desired() {
+			deleted[releaseToID(&st.Releases[i])] = true
+		}
+	}
+
+	var ids []string
+	dependents := map[string][]string{}
+	for i := range st.filteredOutReleases {
+		r := &st.filteredOutReleases[i]
+		if !r.Desired() {
+			continue
+		}
+		for _, n := range r.Needs {
+			need, soft := parseNeed(n)
+			if soft || !deleted[need] {
+				continue
+			}
+			if _, ok := dependents[need]; !ok {
+				ids = append(ids, need)
+			}
+			dependents[need] = append(dependents[need], fmt.Sprintf("%q", releaseToID(r)))
+		}
+	}
+
+	sort.Strings(ids)
+
+	var result []remainingDependent
+	for _, id := range ids {
+		result = append(result, remainingDependent{Release: id, Dependents: dependents[id]})
+	}
+
+	return result
+}
+
+// releasesByID returns pointers to the releases along with the releases keyed by their [TILLER_NS/][NS/]NAME.
+func (st *HelmState) releasesByID() ([]*ReleaseSpec, map[string]ReleaseSpec) {
+	idToRelease := map[string]ReleaseSpec{}
+
+	releases := make([]*ReleaseSpec, len(st.Releases))
+
+	for i := range st.Releases {
+		r := &st.Releases[i]
+
+		idToRelease[releaseToID(r)] = *r
+
+		releases[i] = r
+	}
+
+	return releases, idToRelease
+}
+
+// planReleasesToDelete plans the releases in the order of `needs`, to be processed in the reverse order by deletions.
+func (st *HelmState) planReleasesToDelete(releases []*ReleaseSpec) (dag.Topology, error) {
+	// Releases with `installed: false` have nothing to be deleted
+	return st.planReleases(releases, false, ignoreNotInstalledNeeds)
+}
+
+type PlanOpts struct {
+	// Reverse plans the releases as DeleteReleases does, in the reverse order, instead of as SyncReleases does
+	Reverse bool
+}
+
+type PlanOpt interface{ Apply(*PlanOpts) }
+
+func (o *PlanOpts) Apply(opts *PlanOpts) {
+	*opts = *o
+}
+
+// PlanReleases returns the groups of releases in the exact order they would be processed, without running helm.
+// Releases in a group are processed concurrently, after all the releases in the preceding groups.
+//
+// Releases are planned as SyncReleases does, so that releases with `installed: false` are included to be uninstalled,
+// or as DeleteReleases does with PlanOpts.Reverse.
+// Releases not matching the selectors, if any, or filtered out beforehand are never included, although they are still
+// taken into account in ordering the releases. The state is left as it is.
+//
+// When concurrency is greater than zero, each group is split into groups of as many releases as processed at once with
+// the concurrency, capped as done by the commands. Otherwise a group holds all the releases that can be processed concurrently.
+func (st *HelmState) PlanReleases(selectors []string, concurrency int, opt ...PlanOpt) ([][]ReleaseSpec, error) {
+	opts := &PlanOpts{}
+	for _, o := range opt {
+		o.Apply(opts)
+	}
+
+	selected, err := st.selectReleases(selectors)
+	if err != nil {
+		return nil, err
+	}
+
+	releases, idToRelease := selected.releasesByID()
+
+	var plan dag.Topology
+	if opts.Reverse {
+		plan, err = selected.planReleasesToDelete(releases)
+	} else {
+		plan, err = selected.planReleases(releases, true, rejectNotInstalledNeeds)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([][]ReleaseSpec, 0, len(plan))
+	for i := range plan {
+		group := plan[i]
+		if opts.Reverse {
+			group = plan[len(plan)-1-i]
+		}
+
+		var rs []ReleaseSpec
+		for _, node := range group {
+			rs = append(rs, idToRelease[node.Id])
+		}
+
+		if concurrency < 1 {
+			groups = append(groups, rs)
+			continue
+		}
+
+		n := selected.workers(concurrency, len(rs))
+		for len(rs) > n {
+			groups = append(groups, rs[:n])
+			rs = rs[n:]
+		}
+		groups = append(groups, rs)
+	}
+
+	return groups, nil
+}
+
+// selectReleases returns a copy of the state with the releases matching the selectors, for planning them without
+// filtering the releases of the state. The state itself is returned when there are no selectors.
+func (st *HelmState) selectReleases(selectors []string) (*HelmState, error) {
+	if len(selectors) == 0 {
+		return st, nil
+	}
+
+	selected := *st
+	selected.Selectors = selectors
+	selected.SelectedGroups = nil
+	selected.ReleaseSkipped = nil
+	selected.Releases = make([]ReleaseSpec, len(st.Releases))
+	for i, r := range st.Releases {
+		// FilterReleases adds the name, namespace and chart labels to the releases
+		labels := make(map[string]string, len(r.Labels))
+		for k, v := range r.Labels {
+			labels[k] = v
+		}
+		r.Labels = labels
+		selected.Releases[i] = r
+	}
+
+	if err := selected.FilterReleases(); err != nil {
+		return nil, err
+	}
+
+	selected.filteredOutReleases = append(append([]ReleaseSpec{}, st.filteredOutReleases...), selected.filteredOutReleases...)
+
+	return &selected, nil
+}
+
+// PlanReleaseIDs returns the IDs of the releases in the groups planned by PlanReleases for syncing, sorted within each group.
+// The result is deterministic, so that it only changes when the order of processing the releases changes.
+func (st *HelmState) PlanReleaseIDs() ([][]string, error) {
+	groups, err := st.PlanReleases(nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		var g []string
+		for i := range group {
+			g = append(g, releaseToID(&group[i]))
+		}
+		sort.Strings(g)
+		ids = append(ids, g)
+	}
+
+	return ids, nil
+}
+
+// skippedByFailedDependents reports whether the release is to be skipped in the reverse order, with the ID of a failed release
+// that hard-needs it. A release softly needed by a failed release is not skipped, consistently with isSoftFailure.
+func skippedByFailedDependents(releases []*ReleaseSpec, failed map[string]bool, id string) (string, bool) {
+	for _, r := range releases {
+		dependent := releaseToID(r)
+		if !failed[dependent] {
+			continue
+		}
+
+		for _, n := range r.Needs {
+			if need, soft := parseNeed(n); need == id && !soft {
+				return dependent, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// hardNeeds returns the IDs of the releases hard-needed by each release of the state keyed by its ID, including the releases
+// filtered out by the selectors, so that failedNeed follows the needs through the releases not being processed.
+func (st *HelmState) hardNeeds() map[string][]string {
+	needs := map[string][]string{}
+	for _, releases := range [][]ReleaseSpec{st.Releases, st.filteredOutReleases} {
+		for i := range releases {
+			id := releaseToID(&releases[i])
+			for _, n := range releases[i].Needs {
+				if need, soft := parseNeed(n); !soft {
+					needs[id] = append(needs[id], need)
+				}
+			}
+		}
+	}
+	return needs
+}
+
+// failedNeed returns the ID of a release hard-needed by the release, directly or transitively via the hard needs, that failed
+// or was skipped, if any. A release softly needed by a failed release is not skipped, consistently with isSoftFailure.
+func failedNeed(release *ReleaseSpec, needs map[string][]string, failed map[string]bool) (string, bool) {
+	visited := map[string]bool{}
+
+	var walk func([]string) (string, bool)
+	walk = func(ids []string) (string, bool) {
+		for _, id := range ids {
+			if failed[id] {
+				return id, true
+			}
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+			if need, ok := walk(needs[id]); ok {
+				return need, true
+			}
+		}
+		return "", false
+	}
+
+	var direct []string
+	for _, n := range release.Needs {
+		if need, soft := parseNeed(n); !soft {
+			direct = append(direct, need)
+		}
+	}
+
+	return walk(direct)
+}
+
+// rollbackReleases rolls back the releases synced successfully in the run with SyncOpts.AtomicRun after the errors occurred,
+// and returns the errors followed by the ones of rolling back.
+//
+// The groups of releases are rolled back in the reverse order, like releases are deleted, so that no release is rolled back
+// before the releases needing it. Releases are rolled back one at a time, in the reverse order within each group, too.
+// A release installed before the run is rolled back to its previous revision, whereas a release newly installed in the run
+// is deleted, as it has no revision to roll back to. Releases uninstalled in the run, with `installed: false`, are never restored.
+func (st *HelmState) rollbackReleases(helm helmexec.Interface, synced [][]*ReleaseSpec, installed map[string]bool, errs ...error) []error {
+	total := 0
+	for _, g := range synced {
+		total += len(g)
+	}
+
+	if total == 0 {
+		return errs
+	}
+
+	st.logger.Warnf("rolling back %d releases synced in this run, as syncing failed", total)
+
+	for i := len(synced) - 1; i >= 0; i-- {
+		for j := len(synced[i]) - 1; j >= 0; j-- {
+			release := synced[i][j]
+			context := st.createHelmContext(release, 0)
+
+			var err error
+			if installed[releaseToID(release)] {
+				// Rolling back takes the same connection flags as deleting
+				err = releaseHelm(helm, release).RollbackRelease(context, release.Name, st.deletionFlags(release, false)...)
+			} else {
+				err = releaseHelm(helm, release).DeleteRelease(context, release.Name, st.deletionFlags(release, true)...)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed rolling back release %q: %v", release.Name, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// batchReleases splits the releases into batches of releases sharing the same key, preserving the order of the releases.
+func batchReleases(releases []ReleaseSpec, key func(ReleaseSpec) string) [][]ReleaseSpec {
+	var keys []string
+	batches := map[string][]ReleaseSpec{}
+
+	for _, r := range releases {
+		k := key(r)
+		if _, ok := batches[k]; !ok {
+			keys = append(keys, k)
+		}
+		batches[k] = append(batches[k], r)
+	}
+
+	res := make([][]ReleaseSpec, len(keys))
+	for i, k := range keys {
+		res[i] = batches[k]
+	}
+
+	return res
+}
+
+func (st *HelmState) iterateOnReleaseBatches(concurrency int, inputs [][]ReleaseSpec, do func([]ReleaseSpec, int) ([]error, []string)) ([]error, []string) {
+	var errs []error
+	var failedIDs []string
+
+	type batchResult struct {
+		errs      []error
+		failedIDs []string
+	}
+
+	batches := make(chan []ReleaseSpec)
+	results := make(chan batchResult)
+
+	st.scatterGather(
+		concurrency,
+		len(inputs),
+		func() {
+			for _, batch := range inputs {
+				batches <- batch
+			}
+			close(batches)
+		},
+		func(id int) {
+			for batch := range batches {
+				errs, failedIDs := st.doBatchRecoverably(do, batch, id)
+				results <- batchResult{errs: errs, failedIDs: failedIDs}
+			}
+		},
+		func() {
+			for range inputs {
+				r := <-results
+				errs = append(errs, r.errs...)
+				failedIDs = append(failedIDs, r.failedIDs...)
+			}
+		},
+	)
+
+	return errs, failedIDs
+}
+
+// doBatchRecoverably is the batched variant of doRecoverably.
+// A panic is turned into an error for every release in the batch, as it can't be told which release caused it.
+func (st *HelmState) doBatchRecoverably(do func([]ReleaseSpec, int) ([]error, []string), batch []ReleaseSpec, workerIndex int) (errs []error, failedIDs []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			st.logger.Debugf("recovered from panic in worker %d while processing a batch of %d releases: %v\n%s", workerIndex, len(batch), r, debug.Stack())
+			errs, failedIDs = nil, nil
+			for i := range batch {
+				errs = append(errs, fmt.Errorf("release \"%s\" failed: panic: %v", batch[i].Name, r))
+				failedIDs = append(failedIDs, releaseToID(&batch[i]))
+			}
+		}
+	}()
+
+	return do(batch, workerIndex)
+}
+
+// notInstalledNeedsPolicy determines how planReleases treats a release that hard-needs a release with `installed: false`.
+// Soft needs referring to such releases are always ignored.
+type notInstalledNeedsPolicy int
+
+const (
+	// ignoreNotInstalledNeeds ignores the needs, which is fine for deletions as there's nothing to wait for
+	ignoreNotInstalledNeeds notInstalledNeedsPolicy = iota
+	// rejectNotInstalledNeeds fails planning, as the release is likely to fail without the release it needs
+	rejectNotInstalledNeeds
+	// skipNotInstalledNeeds excludes the release from the plan, along with the releases that need it transitively
+	skipNotInstalledNeeds
+)
+
+// planReleases validates `needs` of the releases and sorts them topologically into groups of release IDs.
+// Releases in a group depend only on releases in the preceding groups, so that they can be processed concurrently.
+//
+// Releases with `installed: false` neither depend on nor are depended on by any other release, as they are only to be uninstalled.
+// Otherwise `needs` referring to them would make their dependents wait for releases that are never installed.
+// They are excluded from the plan at all unless includeUndesired is true.
+// Releases needing them are handled according to the policy.
+//
+// Releases filtered out by selectors are planned along with the given releases and then removed from the plan,
+// so that a release still waits for the releases it needs transitively via the filtered-out ones.
+//
+// `after`, `before` and `wave` of the releases add edges to the DAG just for ordering. See orderingNeeds for more details.
+//
+// Releases in each group are sorted by their priorities in the descending order, and then by the declared order.
+func (st *HelmState) planReleases(releases []*ReleaseSpec, includeUndesired bool, policy notInstalledNeedsPolicy) (dag.Topology, error) {
+	if err := st.ExpandLabelNeeds(); err != nil {
+		return nil, err
+	}
+
+	filteredOut := map[string]bool{}
+	if len(st.filteredOutReleases) > 0 {
+		releases = append([]*ReleaseSpec{}, releases...)
+		for i := range st.filteredOutReleases {
+			r := &st.filteredOutReleases[i]
+			filteredOut[releaseToID(r)] = true
+			releases = append(releases, r)
+		}
+	}
+
+	if err := checkNeeds(releases); err != nil {
+		return nil, err
+	}
+
+	desired := map[string]bool{}
+	idToIndex := map[string]int{}
+	for i, r := range releases {
+		id := releaseToID(r)
+		desired[id] = r.Desired()
+		idToIndex[id] = i
+	}
+
+	skipped, err := st.checkNotInstalledNeeds(releases, desired, filteredOut, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range releases {
+		if skipped[releaseToID(r)] {
+			st.releaseSkipped(*r, SkipReasonNeedsNotInstalled)
+		}
+	}
+
+	// Releases not going to be installed are ignored too, so that waves are ordered relative to the nearest lower wave actually processed
+	ignored := map[string]bool{}
+	for id := range desired {
+		if filteredOut[id] || !desired[id] || skipped[id] {
+			ignored[id] = true
+		}
+	}
+
+	ordering := orderingNeeds(releases, ignored)
+
+	var edges int
+
+	d := dag.New()
+	for _, r := range releases {
+		id := releaseToID(r)
+
+		if !r.Desired() {
+			if includeUndesired && !filteredOut[id] {
+				d.Add(id)
+			}
+			continue
+		}
+
+		if skipped[id] {
+			continue
+		}
+
+		var needs []string
+		added := map[string]bool{}
+		for _, n := range r.Needs {
+			need, _ := parseNeed(n)
+			if !desired[need] {
+				st.logger.Debugf("ignoring %q in needs of %q because it is not going to be installed", need, id)
+				continue
+			}
+			needs = append(needs, need)
+			added[need] = true
+		}
+		for _, o := range ordering[id] {
+			if !desired[o] || skipped[o] || added[o] {
+				continue
+			}
+			needs = append(needs, o)
+			added[o] = true
+		}
+
+		edges += len(needs)
+
+		d.Add(id, dag.Dependencies(needs))
+	}
+
+	plan, err := d.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(filteredOut) > 0 {
+		plan = removeFromPlan(plan, filteredOut)
+	}
+
+	if st.MaxDAGDepth > 0 && len(plan) > st.MaxDAGDepth {
+		return nil, fmt.Errorf("releases are planned in %d groups processed one after another, which exceeds the max DAG depth of %d. please remove unnecessary needs to shorten the chains of dependencies", len(plan), st.MaxDAGDepth)
+	}
+
+	for _, group := range plan {
+		sort.SliceStable(group, func(i, j int) bool {
+			ri, rj := releases[idToIndex[group[i].Id]], releases[idToIndex[group[j].Id]]
+			if ri.Priority != rj.Priority && !st.KeepReleaseOrder {
+				return ri.Priority > rj.Priority
+			}
+			return idToIndex[group[i].Id] < idToIndex[group[j].Id]
+		})
+	}
+
+	if st.Sequential {
+		plan, err = sequentialPlan(plan, idToIndex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if st.PlanMetricsSink != nil {
+		metrics := PlanMetrics{Groups: len(plan), Needs: edges}
+		for _, group := range plan {
+			metrics.Releases += len(group)
+			if len(group) > metrics.MaxGroupWidth {
+				metrics.MaxGroupWidth = len(group)
+			}
+		}
+		st.PlanMetricsSink(metrics)
+	}
+
+	return plan, nil
+}
+
+// sequentialPlan replans the releases in the plan into groups of one release each, in the order of declaration.
+// Each release depends on the one declared before it, so that releases are never processed concurrently, even eagerly
+// by reverseIterateOnReleasesEagerly.
+func sequentialPlan(plan dag.Topology, idToIndex map[string]int) (dag.Topology, error) {
+	var ids []string
+	for _, group := range plan {
+		for _, node := range group {
+			ids = append(ids, node.Id)
+		}
+	}
+
+	sort.SliceStable(ids, func(i, j int) bool {
+		return idToIndex[ids[i]] < idToIndex[ids[j]]
+	})
+
+	d := dag.New()
+	for i, id := range ids {
+		if i == 0 {
+			d.Add(id)
+			continue
+		}
+		d.Add(id, dag.Dependencies([]string{ids[i-1]}))
+	}
+
+	return d.Plan()
+}
+
+// Validate checks that every release has a name, a known type and a chart unless it is a noop release, that their readiness
+// probes can be attempted, and that their `needs` can be planned by PlanReleases, without running helm.
+// It returns the groups of release IDs in the order they would be synced.
+func (st *HelmState) Validate() ([][]string, error) {
+	for i := range st.Releases {
+		if st.Releases[i].Name == "" {
+			return nil, fmt.Errorf("releases[%d] has no name", i)
+		}
+	}
+
+	if err := st.ValidateReleaseTypes(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range st.Releases {
+		if r.Chart == "" && !r.Noop() {
+			return nil, fmt.Errorf("release %q has no chart", r.Name)
+		}
+	}
+
+	if err := st.ValidateReadinessProbes(); err != nil {
+		return nil, err
+	}
+
+	plan, err := st.PlanReleases(nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([][]string, len(plan))
+	for i, group := range plan {
+		for j := range group {
+			groups[i] = append(groups[i], releaseToID(&group[j]))
+		}
+	}
+
+	return groups, nil
+}
+
+// removeFromPlan removes the releases with the IDs from the plan, along with the groups that become empty.
+//
+// The parents and children of the remaining releases are rewired to bypass the removed ones, so that a release still
+// depends on the releases it depended on transitively via the removed ones.
+func removeFromPlan(plan dag.Topology, ids map[string]bool) dag.Topology {
+	nodes := map[string]*dag.NodeInfo{}
+	for _, group := range plan {
+		for _, node := range group {
+			nodes[node.Id] = node
+		}
+	}
+
+	var bypass func(adjacent []string, next func(*dag.NodeInfo) []string, seen map[string]bool) []string
+	bypass = func(adjacent []string, next func(*dag.NodeInfo) []string, seen map[string]bool) []string {
+		var result []string
+		for _, id := range adjacent {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if !ids[id] {
+				result = append(result, id)
+			} else if n, ok := nodes[id]; ok {
+				result = append(result, bypass(next(n), next, seen)...)
+			}
+		}
+		return result
+	}
+
+	parents := func(n *dag.NodeInfo) []string { return n.ParentIds }
+	children := func(n *dag.NodeInfo) []string { return n.ChildIds }
+
+	// Computed before updating any node, as the removed nodes are traversed via their original parents and children
+	rewiredParents, rewiredChildren := map[string][]string{}, map[string][]string{}
+	for id, node := range nodes {
+		if !ids[id] {
+			rewiredParents[id] = bypass(node.ParentIds, parents, map[string]bool{})
+			rewiredChildren[id] = bypass(node.ChildIds, children, map[string]bool{})
+		}
+	}
+	for id := range rewiredParents {
+		nodes[id].ParentIds, nodes[id].ChildIds = rewiredParents[id], rewiredChildren[id]
+	}
+
+	var result dag.Topology
+
+	for _, group := range plan {
+		var nodes []*dag.NodeInfo
+		for _, node := range group {
+			if !ids[node.Id] {
+				nodes = append(nodes, node)
+			}
+		}
+		if len(nodes) > 0 {
+			result = append(result, nodes)
+		}
+	}
+
+	return result
+}
+
+// checkNotInstalledNeeds finds the desired releases that hard-need releases with `installed: false`, and returns the IDs of
+// the releases to be skipped according to the policy.
+// A release needing a skipped release is skipped too, so that no release is installed without the releases it needs.
+// Releases filtered out by selectors are never checked, as they are not processed anyway.
+func (st *HelmState) checkNotInstalledNeeds(releases []*ReleaseSpec, desired, filteredOut map[string]bool, policy notInstalledNeedsPolicy) (map[string]bool, error) {
+	skipped := map[string]bool{}
+
+	if policy == ignoreNotInstalledNeeds {
+		return skipped, nil
+	}
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, r := range releases {
+			id := releaseToID(r)
+
+			if !r.Desired() || skipped[id] || filteredOut[id] {
+				continue
+			}
+
+			for _, n := range r.Needs {
+				need, soft := parseNeed(n)
+				if soft || desired[need] && !skipped[need] {
+					continue
+				}
+
+				if policy == rejectNotInstalledNeeds {
+					return nil, fmt.Errorf("%q needs %q, but it is not going to be installed. please remove it from the needs, install it, or run with --skip-needs-not-installed to skip %q", id, need, id)
+				}
+
+				if skipped[need] {
+					st.logger.Warnf("skipping %q as it needs %q that is skipped", id, need)
+				} else {
+					st.logger.Warnf("skipping %q as it needs %q that is not going to be installed", id, need)
+				}
+
+				skipped[id] = true
+				changed = true
+
+				break
+			}
+		}
+	}
+
+	return skipped, nil
+}
+
+// TransitiveNeeds returns the IDs of all the releases that the release identified by the [TILLER_NS/][NS/]NAME depends on,
+// directly or indirectly via `needs`, in the order of discovery.
+// Each release appears only once even when `needs` form a cycle, and the release itself is never included.
+func (st *HelmState) TransitiveNeeds(id string) []string {
+	idToRelease := map[string]*ReleaseSpec{}
+	for i := range st.Releases {
+		idToRelease[releaseToID(&st.Releases[i])] = &st.Releases[i]
+	}
+
+	var result []string
+
+	visited := map[string]bool{id: true}
+	queue := []string{id}
+
+	for len(queue) > 0 {
+		r, ok := idToRelease[queue[0]]
+		queue = queue[1:]
+		if !ok {
+			continue
+		}
+
+		for _, n := range r.Needs {
+			need, _ := parseNeed(n)
+			if visited[need] {
+				continue
+			}
+			visited[need] = true
+			result = append(result, need)
+			queue = append(queue, need)
+		}
+	}
+
+	return result
+}
+
+// TransitiveDependents returns the IDs of all the releases that depend on the release identified by the [TILLER_NS/][NS/]NAME,
+// directly or indirectly via `needs`, in the order of discovery. It is the reverse of TransitiveNeeds.
+// Each release appears only once even when `needs` form a cycle, and the release itself is never included.
+func (st *HelmState) TransitiveDependents(id string) []string {
+	dependents := map[string][]string{}
+	for i := range st.Releases {
+		r := &st.Releases[i]
+		for _, n := range r.Needs {
+			need, _ := parseNeed(n)
+			dependents[need] = append(dependents[need], releaseToID(r))
+		}
+	}
+
+	var result []string
+
+	visited := map[string]bool{id: true}
+	queue := []string{id}
+
+	for len(queue) > 0 {
+		ds := dependents[queue[0]]
+		queue = queue[1:]
+
+		for _, d := range ds {
+			if visited[d] {
+				continue
+			}
+			visited[d] = true
+			result = append(result, d)
+			queue = append(queue, d)
+		}
+	}
+
+	return result
+}
+
+// UnresolvedNeed is an entry of `needs` that doesn't refer to exactly one of the releases.
+type UnresolvedNeed struct {
+	// Release is the [TILLER_NS/][NS/]NAME of the release having the need
+	Release string
+	// Need is the entry of `needs` as written, including the soft need prefix if any
+	Need string
+}
+
+// VisitUnresolvedNeeds calls `visit` for each entry of `needs` that doesn't refer to exactly one of the releases,
+// in the order of the releases and their `needs`.
+// Unlike planning releases, it never fails on them, so that tools like linters can report all of them at once without running helm.
+// Releases filtered out by selectors can still be referred to.
+func (st *HelmState) VisitUnresolvedNeeds(visit func(UnresolvedNeed)) {
+	releases := append(append([]ReleaseSpec{}, st.Releases...), st.filteredOutReleases...)
+
+	ids := map[string]bool{}
+	for i := range releases {
+		ids[releaseToID(&releases[i])] = true
+	}
+
+	for i := range releases {
+		id := releaseToID(&releases[i])
+		for _, n := range releases[i].Needs {
+			if need, _ := parseNeed(n); !ids[need] {
+				visit(UnresolvedNeed{Release: id, Need: n})
+			}
+		}
+	}
+}
+
+// UnresolvedNeeds returns all the entries of `needs` that don't refer to exactly one of the releases.
+// See VisitUnresolvedNeeds for more details.
+func (st *HelmState) UnresolvedNeeds() []UnresolvedNeed {
+	var result []UnresolvedNeed
+
+	st.VisitUnresolvedNeeds(func(n UnresolvedNeed) {
+		result = append(result, n)
+	})
+
+	return result
+}
+
+// PlanMetrics describes the shape of the DAG of releases planned for processing.
+// Many groups with small widths mean that the releases are processed mostly serially.
+type PlanMetrics struct {
+	// Groups is the number of groups of releases, which are processed one after another
+	Groups int
+	// MaxGroupWidth is the number of releases in the largest group, which can be processed concurrently
+	MaxGroupWidth int
+	// Releases is the number of releases in the plan
+	Releases int
+	// Needs is the number of `needs` edges between the releases in the plan
+	Needs int
+}
+
+// checkNeeds ensures that every release is uniquely identified by its [TILLER_NS/][NS/]NAME and
+// that each of `needs` refers to exactly one of the releases.
+//
+// A need that is a bare release name is accepted only when it equals the ID of a release.
+// When it instead matches the names of two or more releases in different namespaces, it is reported as ambiguous
+// so that the user can fix it by specifying the namespace, like `needs: ["NS/NAME"]`.
+//
+// It also reports a release depending on itself, and two releases depending on each other, with clearer messages than
+// the one for a cycle of any length reported by the DAG.
+func checkNeeds(releases []*ReleaseSpec) error {
+	ids, edges, errs := resolveNeeds(releases)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	for _, id := range ids {
+		for _, need := range edges[id] {
+			for _, n := range edges[need] {
+				if n == id {
+					return fmt.Errorf("releases %q and %q cannot depend on each other. please remove one of them from the needs of the other", id, need)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveNeeds resolves the `needs` of the releases to the IDs of the needed releases. It returns the IDs of the releases
+// in order and the IDs of the releases needed by each release, along with all the problems found in the order of the releases:
+// releases sharing the same ID, releases depending on themselves, and `needs` that don't refer to exactly one of the releases.
+// Needs with problems are dropped from the result. Cycles are left to the callers.
+func resolveNeeds(releases []*ReleaseSpec) ([]string, map[string][]string, []error) {
+	var errs []error
+
+	ids := make([]string, 0, len(releases))
+	idToRelease := map[string]*ReleaseSpec{}
+	nameToIDs := map[string][]string{}
+
+	for _, r := range releases {
+		id := releaseToID(r)
+
+		if _, ok := idToRelease[id]; ok {
+			errs = append(errs, fmt.Errorf("found multiple releases with the same id %q. each release must have a unique combination of tiller namespace, namespace and name", id))
+			continue
+		}
+
+		idToRelease[id] = r
+		ids = append(ids, id)
+		nameToIDs[r.Name] = append(nameToIDs[r.Name], id)
+	}
+
+	edges := map[string][]string{}
+	for _, id := range ids {
+		for _, n := range idToRelease[id].Needs {
+			need, _ := parseNeed(n)
+			switch {
+			case need == id:
+				errs = append(errs, fmt.Errorf("release %q cannot depend on itself. please remove it from its needs", id))
+			case idToRelease[need] != nil:
+				edges[id] = append(edges[id], need)
+			case len(nameToIDs[need]) > 1:
+				candidates := nameToIDs[need]
+				errs = append(errs, fmt.Errorf("%q needs %q, but it is ambiguous as it matches %d releases: %s. please specify one of them in the form of [TILLER_NS/][NS/]NAME", id, need, len(candidates), strings.Join(candidates, ", ")))
+			default:
+				errs = append(errs, fmt.Errorf("%q needs %q, but it must be one of %s", id, need, strings.Join(ids, ", ")))
+			}
+		}
+	}
+
+	return ids, edges, errs
+}
+
+// orderingNeeds returns the IDs of the releases to be processed before each release according to `after`, `before` and `wave`,
+// keyed by the ID of the release to be processed after them.
+//
+// Each release in a wave is ordered after all the releases in the nearest lower wave among the releases, which transitively
+// orders it after all the lower waves. Waves add no edges when all the releases are in the same wave.
+//
+// References to releases that are not among the releases, or are ignored like the ones filtered out by selectors, are dropped,
+// so that `after` and `before` never fail planning. They are treated as soft needs on failures, so that a failure of a release
+// never prevents the releases ordered relative to it from being processed.
+func orderingNeeds(releases []*ReleaseSpec, ignored map[string]bool) map[string][]string {
+	ids := map[string]bool{}
+	for _, r := range releases {
+		if id := releaseToID(r); !ignored[id] {
+			ids[id] = true
+		}
+	}
+
+	waves := map[int][]string{}
+	for _, r := range releases {
+		if id := releaseToID(r); ids[id] {
+			waves[r.Wave] = append(waves[r.Wave], id)
+		}
+	}
+
+	var sortedWaves []int
+	for w := range waves {
+		sortedWaves = append(sortedWaves, w)
+	}
+	sort.Ints(sortedWaves)
+
+	previousWave := map[int]int{}
+	for i := 1; i < len(sortedWaves); i++ {
+		previousWave[sortedWaves[i]] = sortedWaves[i-1]
+	}
+
+	result := map[string][]string{}
+	for _, r := range releases {
+		id := releaseToID(r)
+		if !ids[id] {
+			continue
+		}
+		if prev, ok := previousWave[r.Wave]; ok {
+			result[id] = append(result[id], waves[prev]...)
+		}
+		for _, a := range r.After {
+			if ids[a] && a != id {
+				result[id] = append(result[id], a)
+			}
+		}
+		for _, b := range r.Before {
+			if ids[b] && b != id {
+				result[b] = append(result[b], id)
+			}
+		}
+	}
+
+	return result
+}
+
+// SoftNeedPrefix is prepended to a need to make it soft, like `needs: ["?NS/NAME"]`.
+// A soft need orders releases in the DAG as usual, but a failure of the needed release doesn't prevent the release from being processed.
+const SoftNeedPrefix = "?"
+
+// parseNeed returns the ID of the release needed and whether the need is soft.
+func parseNeed(need string) (string, bool) {
+	if strings.HasPrefix(need, SoftNeedPrefix) {
+		return strings.TrimPrefix(need, SoftNeedPrefix), true
+	}
+	return need, false
+}
+
+// LabelNeedPrefix makes a need refer to all the releases matching the label selector following it, like `needs: ["label:tier=data"]`,
+// instead of a release by its name, so that dependencies survive renaming releases. It can be combined with SoftNeedPrefix,
+// like `?label:tier=data`. See ExpandLabelNeeds
+const LabelNeedPrefix = "label:"
+
+// ExpandLabelNeeds replaces each need prefixed with LabelNeedPrefix with the IDs of all the other releases matching the selector,
+// keeping them soft when the need is soft, so that the rest deals with the IDs only.
+// It fails when the selector matches no release, as the release would otherwise silently depend on nothing.
+//
+// A selector matches the releases filtered out by selectors too. Expanded needs are left as they are, so that it can be called
+// any number of times, as done by FilterReleases and the planning of the releases.
+func (st *HelmState) ExpandLabelNeeds() error {
+	all := st.allReleases()
+
+	for _, r := range all {
+
+		var expanded Needs
+		changed := false
+
+		// A release matched by a selector and also needed explicitly or via another selector is needed once
+		added := map[string]bool{}
+		add := func(n string) {
+			if !added[n] {
+				added[n] = true
+				expanded = append(expanded, n)
+			}
+		}
+
+		for _, n := range r.Needs {
+			need, soft := parseNeed(n)
+			if !strings.HasPrefix(need, LabelNeedPrefix) {
+				add(n)
+				continue
+			}
+
+			changed = true
+
+			selector := strings.TrimPrefix(need, LabelNeedPrefix)
+			f, err := ParseLabels(selector)
+			if err != nil {
+				return fmt.Errorf("release %q needs %q: %v", releaseToID(r), n, err)
+			}
+
+			matches := 0
+			for _, m := range all {
+				if m == r || !f.Match(*m) {
+					continue
+				}
+				matches++
+
+				id := releaseToID(m)
+				if soft {
+					id = SoftNeedPrefix + id
+				}
+				add(id)
+			}
+
+			if matches == 0 {
+				return fmt.Errorf("release %q needs %q, but no other release matches the selector %q. please fix the selector or the labels of the releases", releaseToID(r), n, selector)
+			}
+		}
+
+		if changed {
+			st.logger.Debugf("expanded needs of %q from %v to %v", releaseToID(r), r.Needs, expanded)
+			r.Needs = expanded
+		}
+	}
+
+	return nil
+}
+
+// allSoftFailures reports whether all the failed releases are soft failures.
+// It returns false when there's no failed release known, so that unattributed errors abort the remaining groups as usual.
+func allSoftFailures(releases []*ReleaseSpec, failedIDs []string, reverse bool) bool {
+	if len(failedIDs) == 0 {
+		return false
+	}
+
+	for _, id := range failedIDs {
+		if !isSoftFailure(releases, id, reverse) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isSoftFailure reports whether the failure of the release doesn't need to abort the remaining groups of releases.
+//
+// Releases are processed in the order of `needs` unless reverse is true. In that case, the failed release is a soft failure
+// when it is needed by at least one release, and only softly, so that its dependents are still processed.
+// When reverse is true, as in deletions, the failed release is a soft failure when it needs at least one release,
+// and only softly, so that its dependencies are still processed.
+// Releases ordered relative to each other by `after` and `before` count as softly needed.
+func isSoftFailure(releases []*ReleaseSpec, failedID string, reverse bool) bool {
+	var edges int
+
+	for _, r := range releases {
+		id := releaseToID(r)
+
+		if reverse && id != failedID {
+			continue
+		}
+
+		for _, n := range r.Needs {
+			need, soft := parseNeed(n)
+			if !reverse && need != failedID {
+				continue
+			}
+			if !soft {
+				return false
+			}
+			edges++
+		}
+	}
+
+	for id, ordered := range orderingNeeds(releases, nil) {
+		for _, o := range ordered {
+			if reverse && id == failedID || !reverse && o == failedID {
+				edges++
+			}
+		}
+	}
+
+	return edges > 0
+}
+
+// namespaceSlots caps the number of releases processed at once per namespace. See HelmState.MaxConcurrencyPerNamespace
+//
+// A slot is taken before a release is dispatched to a worker and freed by the worker, so that workers never wait for slots
+// while releases in other namespaces could be processed.
+type namespaceSlots struct {
+	max  int
+	mu   sync.Mutex
+	cond *sync.Cond
+	used map[string]int
+}
+
+func (st *HelmState) newNamespaceSlots() *namespaceSlots {
+	s := &namespaceSlots{max: st.MaxConcurrencyPerNamespace, used: map[string]int{}}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// dispatch calls send with the indices of the n items in order, each after taking a slot of the namespace of the item.
+// An item whose namespace has no free slot is passed over by the following items in the other namespaces, and sent once
+// a slot of its namespace is freed.
+func (s *namespaceSlots) dispatch(n int, namespace func(int) string, send func(int)) {
+	pending := make([]int, n)
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for len(pending) > 0 {
+		namespaces := make([]string, len(pending))
+		for j, i := range pending {
+			namespaces[j] = namespace(i)
+		}
+
+		j := s.next(namespaces, true)
+		i := pending[j]
+		pending = append(pending[:j], pending[j+1:]...)
+
+		send(i)
+	}
+}
+
+// next takes a slot of the first namespace with a free slot, and returns its index. When none of them has a free slot,
+// it blocks until one is freed if wait is true, or returns -1 otherwise.
+func (s *namespaceSlots) next(namespaces []string, wait bool) int {
+	if len(namespaces) == 0 {
+		return -1
+	}
+
+	if s.max < 1 {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for i, ns := range namespaces {
+			if s.used[ns] < s.max {
+				s.used[ns]++
+				return i
+			}
+		}
+
+		if !wait {
+			return -1
+		}
+
+		s.cond.Wait()
+	}
+}
+
+// free frees the slot of the namespace taken by next
+func (s *namespaceSlots) free(namespace string) {
+	if s.max < 1 {
+		return
+	}
+
+	s.mu.Lock()
+	s.used[namespace]--
+	s.mu.Unlock()
+
+	s.cond.Broadcast()
+}
+
+// ReleaseNamespace returns the namespace the release is installed into.
+// The namespace of the release always wins over the one of the helmfile, which is set via `namespace`, `--namespace` or `helmfiles[].namespace`.
+// An empty string means the namespace of the current kube context.
+func (st *HelmState) ReleaseNamespace(release *ReleaseSpec) string {
+	if release.Namespace != "" {
+		return release.Namespace
+	}
+	return st.Namespace
+}
+
+// dispatchOrder makes the producer of releases wait for each release handed to a worker to be started, before handing the next one.
+// It is nil unless HelmState.OrderedDispatch is set to true, which makes both wait and start no-op.
+type dispatchOrder struct {
+	started chan struct{}
+}
+
+func (st *HelmState) newDispatchOrder() *dispatchOrder {
+	if !st.OrderedDispatch {
+		return nil
+	}
+	return &dispatchOrder{started: make(chan struct{})}
+}
+
+// wait is called by the producer right after handing a release to a worker, and blocks until the worker calls start.
+func (o *dispatchOrder) wait() {
+	if o == nil {
+		return
+	}
+	<-o.started
+}
+
+// start is called by the worker exactly once per release, right before processing it, even when it is not going to be processed due to an error.
+func (o *dispatchOrder) start() {
+	if o == nil {
+		return
+	}
+	o.started <- struct{}{}
+}
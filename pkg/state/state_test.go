@@ -2,18 +2,30 @@ package state
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/roboll/helmfile/pkg/environment"
+	"github.com/roboll/helmfile/pkg/event"
 	"github.com/roboll/helmfile/pkg/helmexec"
+	"github.com/roboll/helmfile/pkg/schema"
 	"github.com/roboll/helmfile/pkg/testhelper"
 	"github.com/variantdev/vals"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"errors"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"encoding/json"
 	"fmt"
 )
 
@@ -39,6 +51,14 @@ func TestLabelParsing(t *testing.T) {
 		{"foo", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
 		{"foo!=bar=baz", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
 		{"=bar", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"tier in (frontend,backend)", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}, inLabels: []labelSet{{key: "tier", values: []string{"frontend", "backend"}}}}, false},
+		{"tier notin (frontend, backend),foo=bar", LabelFilter{positiveLabels: [][]string{[]string{"foo", "bar"}}, negativeLabels: [][]string{}, notInLabels: []labelSet{{key: "tier", values: []string{"frontend", "backend"}}}}, false},
+		{"tier in ()", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"tier in (frontend", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"tier within (frontend)", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
+		{"chart=stable/nginx,chartVersion=>=1.2.0", LabelFilter{positiveLabels: [][]string{[]string{"chart", "stable/nginx"}, []string{"chartVersion", ">=1.2.0"}}, negativeLabels: [][]string{}}, false},
+		{"chartVersion!=~1.2.0", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{[]string{"chartVersion", "~1.2.0"}}}, false},
+		{"chartVersion=1.2.0=1.3.0", LabelFilter{positiveLabels: [][]string{}, negativeLabels: [][]string{}}, true},
 	}
 	for idx, c := range cases {
 		filter, err := ParseLabels(c.labelString)
@@ -123,8 +143,24 @@ func TestHelmState_applyDefaultsTo(t *testing.T) {
 			args: args{
 				spec: specWithNamespace,
 			},
+			want: specWithNamespace,
+		},
+		{
+			name:   "Has a namespace only from flags",
+			fields: fieldsWithNamespace,
+			args: args{
+				spec: specWithoutNamespace,
+			},
 			want: specWithNamespaceFromFields,
 		},
+		{
+			name:   "Has no namespace",
+			fields: fieldsWithoutNamespace,
+			args: args{
+				spec: specWithoutNamespace,
+			},
+			want: specWithoutNamespace,
+		},
 	}
 	for i := range tests {
 		tt := tests[i]
@@ -355,6 +391,72 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--namespace", "test-namespace",
 			},
 		},
+		{
+			name: "post-renderer",
+			release: &ReleaseSpec{
+				Chart:        "test/chart",
+				Version:      "0.1",
+				PostRenderer: "./kustomize.sh",
+				Name:         "test-charts",
+				Namespace:    "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--post-renderer", "./kustomize.sh",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "post-renderer-in-path",
+			release: &ReleaseSpec{
+				Chart:        "test/chart",
+				Version:      "0.1",
+				PostRenderer: "kustomize-wrapper",
+				Name:         "test-charts",
+				Namespace:    "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--post-renderer", "kustomize-wrapper",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "extra-args",
+			defaults: HelmSpec{
+				Timeout: 300,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+				ExtraArgs: []string{"--cleanup-on-fail", "--timeout=600"},
+			},
+			want: []string{
+				"--version", "0.1",
+				"--timeout", "300",
+				"--namespace", "test-namespace",
+				"--cleanup-on-fail", "--timeout=600",
+			},
+		},
+		{
+			name: "wait-unset-from-default",
+			defaults: HelmSpec{
+				Wait: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--wait",
+				"--namespace", "test-namespace",
+			},
+		},
 		{
 			name: "timeout",
 			defaults: HelmSpec{
@@ -443,6 +545,107 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--namespace", "test-namespace",
 			},
 		},
+		{
+			name:     "create-namespace",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:           "test/chart",
+				Version:         "0.1",
+				Name:            "test-charts",
+				Namespace:       "test-namespace",
+				CreateNamespace: boolValue(true),
+			},
+			want: []string{
+				"--version", "0.1",
+				"--create-namespace",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "create-namespace-override-default",
+			defaults: HelmSpec{
+				CreateNamespace: true,
+			},
+			release: &ReleaseSpec{
+				Chart:           "test/chart",
+				Version:         "0.1",
+				Name:            "test-charts",
+				Namespace:       "test-namespace",
+				CreateNamespace: boolValue(false),
+			},
+			want: []string{
+				"--version", "0.1",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "create-namespace-from-default",
+			defaults: HelmSpec{
+				CreateNamespace: true,
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--create-namespace",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name:     "history-max",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:      "test/chart",
+				Version:    "0.1",
+				Name:       "test-charts",
+				Namespace:  "test-namespace",
+				HistoryMax: some(5),
+			},
+			want: []string{
+				"--version", "0.1",
+				"--history-max", "5",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "history-max-from-default",
+			defaults: HelmSpec{
+				HistoryMax: some(10),
+			},
+			release: &ReleaseSpec{
+				Chart:     "test/chart",
+				Version:   "0.1",
+				Name:      "test-charts",
+				Namespace: "test-namespace",
+			},
+			want: []string{
+				"--version", "0.1",
+				"--history-max", "10",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name: "history-max-override-default",
+			defaults: HelmSpec{
+				HistoryMax: some(10),
+			},
+			release: &ReleaseSpec{
+				Chart:      "test/chart",
+				Version:    "0.1",
+				Name:       "test-charts",
+				Namespace:  "test-namespace",
+				HistoryMax: some(0),
+			},
+			want: []string{
+				"--version", "0.1",
+				"--history-max", "0",
+				"--namespace", "test-namespace",
+			},
+		},
 		{
 			name:     "tiller",
 			defaults: HelmSpec{},
@@ -493,6 +696,38 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 				"--tls-ca-cert", "ca.pem",
 			},
 		},
+		{
+			name:     "disable-openapi-validation",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:                    "test/chart",
+				Version:                  "0.1",
+				Name:                     "test-charts",
+				Namespace:                "test-namespace",
+				DisableValidation:        &enable,
+				DisableOpenAPIValidation: &enable,
+			},
+			want: []string{
+				"--version", "0.1",
+				"--disable-openapi-validation",
+				"--namespace", "test-namespace",
+			},
+		},
+		{
+			name:     "disable-openapi-validation-false",
+			defaults: HelmSpec{},
+			release: &ReleaseSpec{
+				Chart:                    "test/chart",
+				Version:                  "0.1",
+				Name:                     "test-charts",
+				Namespace:                "test-namespace",
+				DisableOpenAPIValidation: &disable,
+			},
+			want: []string{
+				"--version", "0.1",
+				"--namespace", "test-namespace",
+			},
+		},
 		{
 			name: "tiller-from-defaults",
 			defaults: HelmSpec{
@@ -541,105 +776,442 @@ func TestHelmState_flagsForUpgrade(t *testing.T) {
 	}
 }
 
-func Test_isLocalChart(t *testing.T) {
-	type args struct {
-		chart string
+func TestHelmState_flagsForUpgrade_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmfile-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"signed-1.0.0.tgz", "signed-1.0.0.tgz.prov", "unsigned-1.0.0.tgz"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
 	}
+
 	tests := []struct {
-		name string
-		args args
-		want bool
+		name     string
+		defaults HelmSpec
+		release  ReleaseSpec
+		want     []string
+		wantErr  string
 	}{
 		{
-			name: "local chart",
-			args: args{
-				chart: "./",
-			},
-			want: true,
+			name:    "keyring",
+			release: ReleaseSpec{Chart: "test/chart", Verify: boolValue(true), Keyring: "keys/pubring.gpg"},
+			want:    []string{"--verify", "--keyring", filepath.Join(dir, "keys/pubring.gpg")},
 		},
 		{
-			name: "repo chart",
-			args: args{
-				chart: "stable/genius",
-			},
-			want: false,
+			name:     "keyring-from-default",
+			defaults: HelmSpec{Verify: true, Keyring: "default.gpg"},
+			release:  ReleaseSpec{Chart: "test/chart"},
+			want:     []string{"--verify", "--keyring", filepath.Join(dir, "default.gpg")},
 		},
 		{
-			name: "empty",
-			args: args{
-				chart: "",
-			},
-			want: true,
+			name:     "keyring-override-default",
+			defaults: HelmSpec{Verify: true, Keyring: "default.gpg"},
+			release:  ReleaseSpec{Chart: "test/chart", Keyring: "/etc/keys/pubring.gpg"},
+			want:     []string{"--verify", "--keyring", "/etc/keys/pubring.gpg"},
 		},
 		{
-			name: "parent local path",
-			args: args{
-				chart: "../examples",
-			},
-			want: true,
+			name:     "keyring-without-verify",
+			defaults: HelmSpec{Keyring: "default.gpg"},
+			release:  ReleaseSpec{Chart: "test/chart", Keyring: "keys/pubring.gpg"},
+			want:     []string{},
 		},
 		{
-			name: "parent-parent local path",
-			args: args{
-				chart: "../../",
-			},
-			want: true,
+			name:    "signed-local-chart",
+			release: ReleaseSpec{Chart: "./signed-1.0.0.tgz", Verify: boolValue(true)},
+			want:    []string{"--verify"},
 		},
 		{
-			name: "absolute path",
-			args: args{
-				chart: "/foo/bar/baz",
-			},
-			want: true,
+			name:    "unsigned-local-chart",
+			release: ReleaseSpec{Chart: "./unsigned-1.0.0.tgz", Verify: boolValue(true)},
+			wantErr: fmt.Sprintf(`release "test-charts" cannot be verified as its chart "./unsigned-1.0.0.tgz" has no signature: %s.prov is missing. please sign the chart, or disable verify`, filepath.Join(dir, "unsigned-1.0.0.tgz")),
 		},
 		{
-			name: "local chart in 3-level deep dir",
-			args: args{
-				chart: "foo/bar/baz",
-			},
-			want: true,
+			name:    "chart-directory",
+			release: ReleaseSpec{Chart: "./charts/app", Verify: boolValue(true)},
+			wantErr: `release "test-charts" cannot be verified as its chart "./charts/app" is a directory, which has no signature. please use a packaged and signed chart, or disable verify`,
 		},
 	}
 	for i := range tests {
 		tt := tests[i]
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isLocalChart(tt.args.chart); got != tt.want {
-				t.Errorf("%s(\"%s\") isLocalChart(): got %v, want %v", tt.name, tt.args.chart, got, tt.want)
+			release := tt.release
+			release.Name = "test-charts"
+			state := &HelmState{
+				basePath:     dir,
+				FilePath:     filepath.Join(dir, "helmfile.yaml"),
+				Releases:     []ReleaseSpec{release},
+				HelmDefaults: tt.defaults,
+				valsRuntime:  valsRuntime,
+				logger:       logger,
+			}
+			helm := helmexec.New(logger, "default", &helmexec.ShellRunner{
+				Logger: logger,
+			})
+			args, err := state.flagsForUpgrade(helm, &release, 0)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: want %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d := cmp.Diff(tt.want, args); d != "" {
+				t.Errorf("unexpected flags:\n%s", d)
 			}
 		})
 	}
 }
 
-func Test_normalizeChart(t *testing.T) {
-	type args struct {
-		basePath string
-		chart    string
+func TestHelmState_flagsForUpgrade_ExtraArgsConflict(t *testing.T) {
+	for _, arg := range []string{"--namespace", "-n", "--values=foo.yaml", "--set"} {
+		t.Run(arg, func(t *testing.T) {
+			state := &HelmState{
+				basePath:    "./",
+				valsRuntime: valsRuntime,
+			}
+			release := &ReleaseSpec{
+				Chart:     "test/chart",
+				Name:      "test-charts",
+				ExtraArgs: []string{"--atomic", arg, "bar"},
+			}
+			helm := helmexec.New(logger, "default", &helmexec.ShellRunner{
+				Logger: logger,
+			})
+			_, err := state.flagsForUpgrade(helm, release, 0)
+			if err == nil {
+				t.Fatal("expected error did not occur")
+			}
+			if !strings.Contains(err.Error(), "conflicts with the flag managed by helmfile") {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
 	}
+}
+
+func TestHelmState_flagsForDiff_DisableValidation(t *testing.T) {
+	enable := true
+	disable := false
+
 	tests := []struct {
-		name string
-		args args
-		want string
+		name    string
+		release *ReleaseSpec
+		want    []string
 	}{
 		{
-			name: "construct local chart path",
-			args: args{
-				basePath: "/Users/jane/code/deploy/charts",
-				chart:    "./app",
-			},
-			want: "/Users/jane/code/deploy/charts/app",
+			name:    "unset",
+			release: &ReleaseSpec{Chart: "test/chart", Name: "test-charts", Namespace: "test-namespace"},
+			want:    []string{"--namespace", "test-namespace"},
 		},
 		{
-			name: "repo path",
-			args: args{
-				basePath: "/Users/jane/code/deploy/charts",
-				chart:    "remote/app",
-			},
-			want: "remote/app",
+			name:    "disabled",
+			release: &ReleaseSpec{Chart: "test/chart", Name: "test-charts", Namespace: "test-namespace", DisableValidation: &disable, DisableOpenAPIValidation: &disable},
+			want:    []string{"--namespace", "test-namespace"},
 		},
 		{
-			name: "construct local chart path, parent dir",
-			args: args{
-				basePath: "/Users/jane/code/deploy/charts",
+			name:    "disable-validation",
+			release: &ReleaseSpec{Chart: "test/chart", Name: "test-charts", Namespace: "test-namespace", DisableValidation: &enable},
+			want:    []string{"--disable-validation", "--namespace", "test-namespace"},
+		},
+		{
+			name:    "disable-both",
+			release: &ReleaseSpec{Chart: "test/chart", Name: "test-charts", Namespace: "test-namespace", DisableValidation: &enable, DisableOpenAPIValidation: &enable},
+			want:    []string{"--disable-validation", "--disable-openapi-validation", "--namespace", "test-namespace"},
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath:    "./",
+				Releases:    []ReleaseSpec{*tt.release},
+				valsRuntime: valsRuntime,
+			}
+			helm := helmexec.New(logger, "default", &helmexec.ShellRunner{
+				Logger: logger,
+			})
+			args, err := state.flagsForDiff(helm, tt.release, 0)
+			if err != nil {
+				t.Errorf("unexpected error flagsForDiff: %v", err)
+			}
+			if !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("flagsForDiff returned = %v, want %v", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestHelmState_appendPostRendererFlags(t *testing.T) {
+	tests := []struct {
+		basePath     string
+		postRenderer string
+		want         []string
+	}{
+		{basePath: "/path/to", postRenderer: "./kustomize.sh", want: []string{"--post-renderer", "/path/to/kustomize.sh"}},
+		{basePath: "/path/to", postRenderer: "../bin/kustomize.sh", want: []string{"--post-renderer", "/path/bin/kustomize.sh"}},
+		{basePath: "/path/to", postRenderer: "/usr/local/bin/kustomize.sh", want: []string{"--post-renderer", "/usr/local/bin/kustomize.sh"}},
+		{basePath: "/path/to", postRenderer: "kustomize-wrapper", want: []string{"--post-renderer", "kustomize-wrapper"}},
+		{basePath: "sub", postRenderer: "./kustomize.sh", want: []string{"--post-renderer", "sub/kustomize.sh"}},
+		{basePath: "/path/to", postRenderer: "", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.postRenderer, func(t *testing.T) {
+			state := &HelmState{basePath: tt.basePath}
+			flags := state.appendPostRendererFlags([]string{}, &ReleaseSpec{PostRenderer: tt.postRenderer})
+			if !reflect.DeepEqual(flags, tt.want) {
+				t.Errorf("unexpected flags: expected=%v, got=%v", tt.want, flags)
+			}
+		})
+	}
+}
+
+func TestHelmState_appendPostRendererFlags_CommonLabels(t *testing.T) {
+	state := &HelmState{
+		basePath:          "/path/to",
+		CommonLabels:      map[string]string{"team": "platform", "managed-by": "helmfile"},
+		CommonAnnotations: map[string]string{"deploy-id": "123"},
+		HelmfileBinary:    "/usr/local/bin/helmfile",
+	}
+
+	tests := []struct {
+		postRenderer string
+		want         []string
+	}{
+		{
+			postRenderer: "./kustomize.sh",
+			want: []string{
+				"--post-renderer", "/usr/local/bin/helmfile",
+				"--post-renderer-args=post-render",
+				"--post-renderer-args=--label=managed-by=helmfile",
+				"--post-renderer-args=--label=team=platform",
+				"--post-renderer-args=--annotation=deploy-id=123",
+				"--post-renderer-args=--then=/path/to/kustomize.sh",
+			},
+		},
+		{
+			postRenderer: "",
+			want: []string{
+				"--post-renderer", "/usr/local/bin/helmfile",
+				"--post-renderer-args=post-render",
+				"--post-renderer-args=--label=managed-by=helmfile",
+				"--post-renderer-args=--label=team=platform",
+				"--post-renderer-args=--annotation=deploy-id=123",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.postRenderer, func(t *testing.T) {
+			flags := state.appendPostRendererFlags([]string{}, &ReleaseSpec{PostRenderer: tt.postRenderer})
+			if !reflect.DeepEqual(flags, tt.want) {
+				t.Errorf("unexpected flags: expected=%v, got=%v", tt.want, flags)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncAndDiffReleases_CommonLabels(t *testing.T) {
+	state := &HelmState{
+		basePath: "/path/to",
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "foo/db"},
+			{Name: "cache", Chart: "foo/cache", PostRenderer: "./kustomize.sh"},
+			{Name: "app", Chart: "foo/app", Needs: []string{"db"}},
+		},
+		CommonLabels:   map[string]string{"managed-by": "helmfile"},
+		HelmfileBinary: "/usr/local/bin/helmfile",
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if _, errs := state.DiffReleases(helm, []string{}, 1, false, false, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for cmd, releases := range map[string][]mockRelease{"sync": helm.releases, "diff": helm.diffed} {
+		labeled := map[string]bool{}
+		for _, r := range releases {
+			flags := strings.Join(r.flags, " ")
+			labeled[r.name] = strings.Contains(flags, "--post-renderer /usr/local/bin/helmfile") &&
+				strings.Contains(flags, "--post-renderer-args=--label=managed-by=helmfile")
+		}
+		if want := map[string]bool{"db": true, "cache": true, "app": true}; !reflect.DeepEqual(labeled, want) {
+			t.Errorf("unexpected releases labeled on %s: want %v, got %v", cmd, want, labeled)
+		}
+	}
+}
+
+func TestHelmState_appendHelmXFlags_Transformers(t *testing.T) {
+	state := &HelmState{
+		basePath: "/path/to",
+		logger:   logger,
+	}
+	release := &ReleaseSpec{
+		Name:    "myrelease",
+		BaseDir: "/path/to/sub",
+		Transformers: []interface{}{
+			"transformers/labels.yaml",
+			"/etc/transformers/annotations.yaml",
+			map[interface{}]interface{}{
+				"apiVersion": "builtin",
+				"kind":       "LabelTransformer",
+				"metadata":   map[interface{}]interface{}{"name": "team"},
+				"labels":     map[interface{}]interface{}{"team": "payments"},
+			},
+		},
+	}
+
+	flags, err := state.appendHelmXFlags([]string{}, release)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() {
+		for _, f := range release.generatedValues {
+			os.Remove(f)
+		}
+	}()
+
+	if len(flags) != 6 || len(release.generatedValues) != 1 {
+		t.Fatalf("unexpected flags: %v", flags)
+	}
+
+	expected := []string{
+		"--transformer", "/path/to/sub/transformers/labels.yaml",
+		"--transformer", "/etc/transformers/annotations.yaml",
+		"--transformer", release.generatedValues[0],
+	}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Errorf("unexpected flags: expected=%v, got=%v", expected, flags)
+	}
+
+	generated, err := ioutil.ReadFile(release.generatedValues[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedTransformer := `apiVersion: builtin
+kind: LabelTransformer
+labels:
+  team: payments
+metadata:
+  name: team
+`
+	if d := cmp.Diff(expectedTransformer, string(generated)); d != "" {
+		t.Errorf("unexpected transformer:\n%s", d)
+	}
+
+	release.Transformers = []interface{}{1}
+	if _, err := state.appendHelmXFlags([]string{}, release); err == nil {
+		t.Error("expected error did not occur")
+	}
+}
+
+func Test_isLocalChart(t *testing.T) {
+	type args struct {
+		chart string
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{
+			name: "local chart",
+			args: args{
+				chart: "./",
+			},
+			want: true,
+		},
+		{
+			name: "repo chart",
+			args: args{
+				chart: "stable/genius",
+			},
+			want: false,
+		},
+		{
+			name: "empty",
+			args: args{
+				chart: "",
+			},
+			want: true,
+		},
+		{
+			name: "parent local path",
+			args: args{
+				chart: "../examples",
+			},
+			want: true,
+		},
+		{
+			name: "parent-parent local path",
+			args: args{
+				chart: "../../",
+			},
+			want: true,
+		},
+		{
+			name: "absolute path",
+			args: args{
+				chart: "/foo/bar/baz",
+			},
+			want: true,
+		},
+		{
+			name: "local chart in 3-level deep dir",
+			args: args{
+				chart: "foo/bar/baz",
+			},
+			want: true,
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLocalChart(tt.args.chart); got != tt.want {
+				t.Errorf("%s(\"%s\") isLocalChart(): got %v, want %v", tt.name, tt.args.chart, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_normalizeChart(t *testing.T) {
+	type args struct {
+		basePath string
+		chart    string
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "construct local chart path",
+			args: args{
+				basePath: "/Users/jane/code/deploy/charts",
+				chart:    "./app",
+			},
+			want: "/Users/jane/code/deploy/charts/app",
+		},
+		{
+			name: "repo path",
+			args: args{
+				basePath: "/Users/jane/code/deploy/charts",
+				chart:    "remote/app",
+			},
+			want: "remote/app",
+		},
+		{
+			name: "construct local chart path, parent dir",
+			args: args{
+				basePath: "/Users/jane/code/deploy/charts",
 				chart:    "../app",
 			},
 			want: "/Users/jane/code/deploy/app",
@@ -677,6 +1249,11 @@ type mockHelmExec struct {
 	deleted  []mockRelease
 	lists    map[listKey]string
 	diffed   []mockRelease
+	diffs    map[string]error
+	binaries []string
+	fetched  []string
+
+	rolledBack []mockRelease
 
 	updateDepsCallbacks map[string]func(string) error
 }
@@ -723,6 +1300,10 @@ func (helm *mockHelmExec) SetExtraArgs(args ...string) {
 func (helm *mockHelmExec) SetHelmBinary(bin string) {
 	return
 }
+func (helm *mockHelmExec) WithHelmBinary(bin string) helmexec.Interface {
+	helm.binaries = append(helm.binaries, bin)
+	return helm
+}
 func (helm *mockHelmExec) AddRepo(name, repository, cafile, certfile, keyfile, username, password string) error {
 	helm.repo = []string{name, repository, cafile, certfile, keyfile, username, password}
 	return nil
@@ -740,7 +1321,7 @@ func (helm *mockHelmExec) SyncRelease(context helmexec.HelmContext, name, chart
 }
 func (helm *mockHelmExec) DiffRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
 	helm.diffed = append(helm.diffed, mockRelease{name: name, flags: flags})
-	return nil
+	return helm.diffs[name]
 }
 func (helm *mockHelmExec) ReleaseStatus(context helmexec.HelmContext, release string, flags ...string) error {
 	if strings.Contains(release, "error") {
@@ -756,6 +1337,22 @@ func (helm *mockHelmExec) DeleteRelease(context helmexec.HelmContext, name strin
 	helm.deleted = append(helm.deleted, mockRelease{name: name, flags: flags})
 	return nil
 }
+func (helm *mockHelmExec) DeleteReleases(context helmexec.HelmContext, names []string, flags ...string) error {
+	for _, name := range names {
+		if strings.Contains(name, "error") {
+			return errors.New("error")
+		}
+	}
+	helm.deleted = append(helm.deleted, mockRelease{name: strings.Join(names, ","), flags: flags})
+	return nil
+}
+func (helm *mockHelmExec) RollbackRelease(context helmexec.HelmContext, name string, flags ...string) error {
+	if strings.Contains(name, "error") {
+		return errors.New("error")
+	}
+	helm.rolledBack = append(helm.rolledBack, mockRelease{name: name, flags: flags})
+	return nil
+}
 func (helm *mockHelmExec) List(context helmexec.HelmContext, filter string, flags ...string) (string, error) {
 	return helm.lists[listKey{filter: filter, flags: strings.Join(flags, "")}], nil
 }
@@ -770,6 +1367,7 @@ func (helm *mockHelmExec) TestRelease(context helmexec.HelmContext, name string,
 	return nil
 }
 func (helm *mockHelmExec) Fetch(chart string, flags ...string) error {
+	helm.fetched = append(helm.fetched, chart)
 	return nil
 }
 func (helm *mockHelmExec) Lint(name, chart string, flags ...string) error {
@@ -865,11 +1463,135 @@ func TestHelmState_SyncRepos(t *testing.T) {
 	}
 }
 
+// flakyRepoUpdater fails updating repositories with the errors in order, and succeeds afterwards
+type flakyRepoUpdater struct {
+	errs    []error
+	updates int
+}
+
+func (u *flakyRepoUpdater) AddRepo(name, repository, cafile, certfile, keyfile, username, password string) error {
+	return nil
+}
+
+func (u *flakyRepoUpdater) UpdateRepo() error {
+	u.updates++
+	if u.updates <= len(u.errs) {
+		return u.errs[u.updates-1]
+	}
+	return nil
+}
+
+// flakyFetchHelmExec fails fetching charts with the errors in order, and succeeds afterwards
+type flakyFetchHelmExec struct {
+	*mockHelmExec
+	errs    []error
+	fetches int
+}
+
+func (helm *flakyFetchHelmExec) Fetch(chart string, flags ...string) error {
+	helm.fetches++
+	if helm.fetches <= len(helm.errs) {
+		return helm.errs[helm.fetches-1]
+	}
+	return nil
+}
+
+func TestHelmState_retryChartFetch(t *testing.T) {
+	unavailable := errors.New("helm exited with status 1:\n  Error: looks like \"https://charts.example.com\" is not a valid chart repository or cannot be reached: failed to fetch https://charts.example.com/index.yaml : 503 Service Unavailable")
+	timeout := errors.New("helm exited with status 1:\n  Error: Get https://charts.example.com/index.yaml: net/http: TLS handshake timeout")
+	notFound := errors.New("helm exited with status 1:\n  Error: failed to fetch https://charts.example.com/app-1.0.0.tgz : 404 Not Found")
+
+	testcases := []struct {
+		name    string
+		retries int
+		errs    []error
+		calls   int
+		wantErr error
+	}{
+		{name: "succeeds after 5xx and timeout", retries: 3, errs: []error{unavailable, timeout}, calls: 3},
+		{name: "gives up after retries", retries: 2, errs: []error{unavailable, unavailable, unavailable}, calls: 3, wantErr: unavailable},
+		{name: "never retries 4xx", retries: 3, errs: []error{notFound}, calls: 1, wantErr: notFound},
+		{name: "never retries by default", errs: []error{unavailable}, calls: 1, wantErr: unavailable},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Run("repositories", func(t *testing.T) {
+				var delays []time.Duration
+				state := &HelmState{
+					Repositories:      []RepositorySpec{{Name: "stable", URL: "https://charts.example.com"}},
+					ChartFetchRetries: tc.retries,
+					logger:            logger,
+					sleep:             func(d time.Duration) { delays = append(delays, d) },
+				}
+				helm := &flakyRepoUpdater{errs: tc.errs}
+
+				errs := state.SyncRepos(helm)
+
+				if tc.wantErr == nil && len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				if tc.wantErr != nil && (len(errs) != 1 || errs[0] != tc.wantErr) {
+					t.Fatalf("unexpected errors: expected=%v, got=%v", tc.wantErr, errs)
+				}
+				if helm.updates != tc.calls {
+					t.Errorf("unexpected number of updates: expected=%d, got=%d", tc.calls, helm.updates)
+				}
+				assertChartFetchRetryDelays(t, delays, tc.calls-1)
+			})
+
+			t.Run("charts", func(t *testing.T) {
+				dir, err := ioutil.TempDir("", "helmfile-test-")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+
+				var delays []time.Duration
+				state := &HelmState{
+					ChartFetchRetries: tc.retries,
+					logger:            logger,
+					sleep:             func(d time.Duration) { delays = append(delays, d) },
+				}
+				helm := &flakyFetchHelmExec{mockHelmExec: &mockHelmExec{}, errs: tc.errs}
+
+				_, err = state.downloadChart(helm, &ReleaseSpec{Name: "app", Chart: "stable/app", Version: "1.0.0"}, dir)
+
+				if err != tc.wantErr {
+					t.Fatalf("unexpected error: expected=%v, got=%v", tc.wantErr, err)
+				}
+				if helm.fetches != tc.calls {
+					t.Errorf("unexpected number of fetches: expected=%d, got=%d", tc.calls, helm.fetches)
+				}
+				assertChartFetchRetryDelays(t, delays, tc.calls-1)
+			})
+		})
+	}
+}
+
+// assertChartFetchRetryDelays checks that the delays double from chartFetchRetryInterval with jitters of up to their halves
+func assertChartFetchRetryDelays(t *testing.T, delays []time.Duration, retries int) {
+	t.Helper()
+
+	if len(delays) != retries {
+		t.Fatalf("unexpected number of retries: expected=%d, got=%d", retries, len(delays))
+	}
+
+	interval := chartFetchRetryInterval
+	for i, d := range delays {
+		if d < interval/2 || d > interval {
+			t.Errorf("unexpected delay of retry %d: expected between %s and %s, got %s", i+1, interval/2, interval, d)
+		}
+		interval *= 2
+	}
+}
+
 func TestHelmState_SyncReleases(t *testing.T) {
 	tests := []struct {
 		name          string
 		releases      []ReleaseSpec
 		helm          *mockHelmExec
+		syncOpts      *SyncOpts
 		wantReleases  []mockRelease
 		wantErrorMsgs []string
 	}{
@@ -1062,20 +1784,279 @@ func TestHelmState_SyncReleases(t *testing.T) {
 			helm:          &mockHelmExec{},
 			wantErrorMsgs: []string{`"tillerns1/ns1/foo" needs "bar", but it must be one of tillerns1/ns1/foo, tillerns2/ns2/bar`},
 		},
-	}
-	for i := range tests {
-		tt := tests[i]
-		t.Run(tt.name, func(t *testing.T) {
-			state := &HelmState{
-				Releases:    tt.releases,
-				logger:      logger,
-				valsRuntime: valsRuntime,
-			}
-			if errs := state.SyncReleases(&AffectedReleases{}, tt.helm, []string{}, 1); errs != nil && len(errs) > 0 {
-				if len(errs) != len(tt.wantErrorMsgs) {
-					t.Fatalf("Unexpected errors: %v\nExpected: %v", errs, tt.wantErrorMsgs)
-				}
-				var mismatch int
+		{
+			name: "c/app needs a/redis while b/redis exists",
+			releases: []ReleaseSpec{
+				{
+					Name:      "app",
+					Namespace: "c",
+					Chart:     "charts/app",
+					Needs: []string{
+						"a/redis",
+					},
+				},
+				{
+					Name:      "redis",
+					Namespace: "a",
+					Chart:     "charts/redis",
+				},
+				{
+					Name:      "redis",
+					Namespace: "b",
+					Chart:     "charts/redis",
+				},
+			},
+			helm: &mockHelmExec{},
+			wantReleases: []mockRelease{
+				{"redis", []string{"--namespace", "a"}},
+				{"redis", []string{"--namespace", "b"}},
+				{"app", []string{"--namespace", "c"}},
+			},
+		},
+		{
+			name: "c/app needs redis that is ambiguous between a/redis and b/redis",
+			releases: []ReleaseSpec{
+				{
+					Name:      "app",
+					Namespace: "c",
+					Chart:     "charts/app",
+					Needs: []string{
+						"redis",
+					},
+				},
+				{
+					Name:      "redis",
+					Namespace: "a",
+					Chart:     "charts/redis",
+				},
+				{
+					Name:      "redis",
+					Namespace: "b",
+					Chart:     "charts/redis",
+				},
+			},
+			helm:          &mockHelmExec{},
+			wantErrorMsgs: []string{`"c/app" needs "redis", but it is ambiguous as it matches 2 releases: a/redis, b/redis. please specify one of them in the form of [TILLER_NS/][NS/]NAME`},
+		},
+		{
+			name: "releases in a group are ordered by priority",
+			releases: []ReleaseSpec{
+				{
+					Name:  "operator",
+					Chart: "charts/operator",
+				},
+				{
+					Name:     "crds",
+					Chart:    "charts/crds",
+					Priority: 10,
+				},
+				{
+					Name:  "app",
+					Chart: "charts/app",
+					Needs: []string{
+						"operator",
+					},
+				},
+				{
+					Name:     "monitoring",
+					Chart:    "charts/monitoring",
+					Priority: -1,
+				},
+				{
+					Name:  "logging",
+					Chart: "charts/logging",
+				},
+			},
+			helm: &mockHelmExec{},
+			wantReleases: []mockRelease{
+				{"crds", []string{}},
+				{"operator", []string{}},
+				{"logging", []string{}},
+				{"monitoring", []string{}},
+				{"app", []string{}},
+			},
+		},
+		{
+			name: "foo needs bar that is not going to be installed",
+			releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "charts/foo",
+					Needs: []string{
+						"bar",
+					},
+				},
+				{
+					Name:      "bar",
+					Chart:     "charts/bar",
+					Installed: boolValue(false),
+				},
+				{
+					Name:  "baz",
+					Chart: "charts/baz",
+				},
+			},
+			helm:          &mockHelmExec{},
+			wantErrorMsgs: []string{`"foo" needs "bar", but it is not going to be installed. please remove it from the needs, install it, or run with --skip-needs-not-installed to skip "foo"`},
+		},
+		{
+			name: "foo softly needs bar that is not going to be installed",
+			releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "charts/foo",
+					Needs: []string{
+						"?bar",
+					},
+				},
+				{
+					Name:      "bar",
+					Chart:     "charts/bar",
+					Installed: boolValue(false),
+				},
+				{
+					Name:  "baz",
+					Chart: "charts/baz",
+				},
+			},
+			helm: &mockHelmExec{},
+			// foo no longer waits for bar, so that it is synced in the first group along with baz
+			wantReleases: []mockRelease{{"foo", []string{}}, {"baz", []string{}}},
+		},
+		{
+			name: "foo needs bar that is not going to be installed, skipped with qux needing foo",
+			releases: []ReleaseSpec{
+				{
+					Name:  "qux",
+					Chart: "charts/qux",
+					Needs: []string{
+						"foo",
+					},
+				},
+				{
+					Name:  "foo",
+					Chart: "charts/foo",
+					Needs: []string{
+						"bar",
+					},
+				},
+				{
+					Name:      "bar",
+					Chart:     "charts/bar",
+					Installed: boolValue(false),
+				},
+				{
+					Name:  "baz",
+					Chart: "charts/baz",
+				},
+			},
+			helm:         &mockHelmExec{},
+			syncOpts:     &SyncOpts{SkipNeedsNotInstalled: true},
+			wantReleases: []mockRelease{{"baz", []string{}}},
+		},
+		{
+			name: "foo needs itself",
+			releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "charts/foo",
+					Needs: []string{"bar", "foo"},
+				},
+				{
+					Name:  "bar",
+					Chart: "charts/bar",
+				},
+			},
+			helm:          &mockHelmExec{},
+			wantErrorMsgs: []string{`release "foo" cannot depend on itself. please remove it from its needs`},
+		},
+		{
+			name: "foo and bar need each other",
+			releases: []ReleaseSpec{
+				{
+					Name:  "foo",
+					Chart: "charts/foo",
+					Needs: []string{"bar"},
+				},
+				{
+					Name:  "bar",
+					Chart: "charts/bar",
+					Needs: []string{"?foo"},
+				},
+			},
+			helm:          &mockHelmExec{},
+			wantErrorMsgs: []string{`releases "foo" and "bar" cannot depend on each other. please remove one of them from the needs of the other`},
+		},
+		{
+			name: "app softly needs logging that failed",
+			releases: []ReleaseSpec{
+				{
+					Name:  "logging-error",
+					Chart: "charts/logging",
+				},
+				{
+					Name:  "app",
+					Chart: "charts/app",
+					Needs: []string{
+						"?logging-error",
+					},
+				},
+				{
+					Name:  "frontend",
+					Chart: "charts/frontend",
+					Needs: []string{
+						"app",
+					},
+				},
+			},
+			helm:          &mockHelmExec{},
+			wantReleases:  []mockRelease{{"app", []string{}}, {"frontend", []string{}}},
+			wantErrorMsgs: []string{"failed processing release logging-error: error"},
+		},
+		{
+			name: "app needs logging that failed",
+			releases: []ReleaseSpec{
+				{
+					Name:  "logging-error",
+					Chart: "charts/logging",
+				},
+				{
+					Name:  "app",
+					Chart: "charts/app",
+					Needs: []string{
+						"logging-error",
+					},
+				},
+				{
+					Name:  "frontend",
+					Chart: "charts/frontend",
+					Needs: []string{
+						"?logging-error",
+					},
+				},
+			},
+			helm:          &mockHelmExec{},
+			wantReleases:  nil,
+			wantErrorMsgs: []string{"failed processing release logging-error: error"},
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases:    tt.releases,
+				logger:      logger,
+				valsRuntime: valsRuntime,
+			}
+			var opts []SyncOpt
+			if tt.syncOpts != nil {
+				opts = append(opts, tt.syncOpts)
+			}
+			if errs := state.SyncReleases(&AffectedReleases{}, tt.helm, []string{}, 1, opts...); errs != nil && len(errs) > 0 {
+				if len(errs) != len(tt.wantErrorMsgs) {
+					t.Fatalf("Unexpected errors: %v\nExpected: %v", errs, tt.wantErrorMsgs)
+				}
+				var mismatch int
 				for i := range tt.wantErrorMsgs {
 					expected := tt.wantErrorMsgs[i]
 					actual := errs[i].Error()
@@ -1607,6 +2588,55 @@ func TestHelmState_SyncReleasesCleanup(t *testing.T) {
 	}
 }
 
+func TestHelmState_SyncReleases_ValuesRelativeToBaseDir(t *testing.T) {
+	tests := []struct {
+		baseDir       string
+		expectedError string
+	}{
+		{
+			baseDir: "/path/to/common",
+		},
+		{
+			baseDir:       "",
+			expectedError: `failed processing release foo: values file matching "values.yaml" does not exist in "."`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("baseDir=%q", tt.baseDir), func(t *testing.T) {
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{
+						Name:    "foo",
+						Chart:   "foo",
+						Values:  []interface{}{"values.yaml"},
+						Secrets: []string{"secrets.yaml"},
+						BaseDir: tt.baseDir,
+					},
+				},
+				basePath:    ".",
+				logger:      logger,
+				valsRuntime: valsRuntime,
+				removeFile:  func(f string) error { return nil },
+			}
+			testfs := testhelper.NewTestFs(map[string]string{
+				"/path/to/common/values.yaml":  `foo: FOO`,
+				"/path/to/common/secrets.yaml": `bar: BAR`,
+			})
+			state = injectFs(state, testfs)
+
+			var actual string
+			errs := state.SyncReleases(&AffectedReleases{}, &mockHelmExec{}, []string{}, 1)
+			if len(errs) > 0 {
+				actual = errs[0].Error()
+			}
+			if actual != tt.expectedError {
+				t.Errorf("unexpected error: expected=%q, got=%q", tt.expectedError, actual)
+			}
+		})
+	}
+}
+
 func TestHelmState_DiffReleasesCleanup(t *testing.T) {
 	tests := []struct {
 		name                    string
@@ -1692,42 +2722,206 @@ func TestHelmState_DiffReleasesCleanup(t *testing.T) {
 	}
 }
 
-func TestHelmState_UpdateDeps(t *testing.T) {
+func TestHelmState_DetectDrift(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "web", Chart: "foo/web", Namespace: "apps"},
+			{Name: "db", Chart: "foo/db", Namespace: "apps"},
+			{Name: "cache", Chart: "foo/cache"},
+			{Name: "legacy", Chart: "foo/legacy", Installed: boolValue(false)},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+
 	helm := &mockHelmExec{
-		updateDepsCallbacks: map[string]func(string) error{},
+		diffs: map[string]error{
+			"web":   helmexec.DiffError{Changes: 2},
+			"cache": errors.New("chart not found"),
+		},
 	}
 
-	var generatedDir string
-	tempDir := func(dir, prefix string) (string, error) {
-		var err error
-		generatedDir, err = ioutil.TempDir(dir, prefix)
-		if err != nil {
-			return "", err
+	report, errs := state.DetectDrift(helm, []string{}, 1)
+
+	expected := &DriftReport{
+		Releases: []ReleaseDrift{
+			{Release: "web", Namespace: "apps", Status: DriftStatusDrifted, Changes: 2},
+			{Release: "db", Namespace: "apps", Status: DriftStatusInSync},
+			{Release: "cache", Status: DriftStatusFailed, Error: "chart not found"},
+		},
+		InSync:  1,
+		Drifted: 1,
+		Failed:  1,
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("unexpected report: expected=%+v, got=%+v", expected, report)
+	}
+
+	if len(errs) != 2 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if strings.Contains(errs[0].Error(), "cache") == false {
+		t.Errorf("unexpected error for the failed release: %v", errs[0])
+	}
+	if relErr, ok := errs[1].(*ReleaseError); !ok || relErr.Name != "web" || relErr.Code != 2 {
+		t.Errorf("unexpected error for the drifted release: %v", errs[1])
+	}
+
+	for _, d := range helm.diffed {
+		flags := strings.Join(d.flags, " ")
+		if !strings.Contains(flags, "--detailed-exitcode") || !strings.Contains(flags, "--suppress-secrets") {
+			t.Errorf("unexpected flags for diffing %s: %s", d.name, flags)
 		}
-		helm.updateDepsCallbacks[generatedDir] = func(chart string) error {
-			content := []byte(`dependencies:
-- name: envoy
-  repository: https://kubernetes-charts.storage.googleapis.com
-  version: 1.5.0
-- name: envoy
-  repository: https://kubernetes-charts.storage.googleapis.com
-  version: 1.4.0
-digest: sha256:8194b597c85bb3d1fee8476d4a486e952681d5c65f185ad5809f2118bc4079b5
-generated: 2019-05-16T15:42:45.50486+09:00
-`)
-			filename := filepath.Join(generatedDir, "requirements.lock")
-			logger.Debugf("test: writing %s: %s", filename, content)
-			return ioutil.WriteFile(filename, content, 0644)
+	}
+}
+
+// manifestWritingHelmExec writes the manifests of each release to the directory given via `--output-dir`, like `helm template`
+type manifestWritingHelmExec struct {
+	*mockHelmExec
+	manifests map[string]string
+}
+
+func (helm *manifestWritingHelmExec) TemplateRelease(name, chart string, flags ...string) error {
+	manifests, ok := helm.manifests[name]
+	if !ok {
+		return errors.New("chart not found")
+	}
+	for i, f := range flags {
+		if f == "--output-dir" {
+			dir := filepath.Join(flags[i+1], "mychart", "templates")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dir, "all.yaml"), []byte(manifests), 0644)
 		}
-		return generatedDir, nil
+	}
+	return errors.New("missing --output-dir")
+}
+
+func TestHelmState_ValidateManifests(t *testing.T) {
+	sch, err := schema.Load([]byte(`{
+  "definitions": {
+    "io.k8s.api.core.v1.ConfigMap": {
+      "type": "object",
+      "properties": {
+        "apiVersion": {"type": "string"},
+        "kind": {"type": "string"},
+        "metadata": {"type": "object", "properties": {"name": {"type": "string"}}},
+        "data": {"type": "object", "additionalProperties": {"type": "string"}}
+      },
+      "x-kubernetes-group-version-kind": [{"group": "", "version": "v1", "kind": "ConfigMap"}]
+    }
+  }
+}`))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	logger := helmexec.NewLogger(os.Stderr, "debug")
 	state := &HelmState{
-		basePath: "/src",
-		FilePath: "/src/helmfile.yaml",
 		Releases: []ReleaseSpec{
-			{
+			{Name: "web", Chart: "foo/web", Namespace: "apps"},
+			{Name: "db", Chart: "foo/db", Namespace: "apps"},
+			{Name: "cache", Chart: "foo/cache"},
+			{Name: "legacy", Chart: "foo/legacy", Installed: boolValue(false)},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+
+	helm := &manifestWritingHelmExec{
+		mockHelmExec: &mockHelmExec{},
+		manifests: map[string]string{
+			"web": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\ndata:\n  port: 8080\n  host: web\n",
+			"db":  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: db\n---\napiVersion: example.com/v1\nkind: Backup\nmetadata:\n  name: db\n",
+		},
+	}
+
+	report, errs := state.ValidateManifests(helm, sch, []string{}, nil, 1)
+
+	expected := &ValidationReport{
+		Releases: []ReleaseValidation{
+			{
+				Release:   "web",
+				Namespace: "apps",
+				Status:    ValidationStatusInvalid,
+				Resources: 1,
+				Violations: []schema.Violation{
+					{Resource: "ConfigMap/web", Path: "data.port", Message: "expected string, got integer"},
+				},
+			},
+			{Release: "db", Namespace: "apps", Status: ValidationStatusValid, Resources: 1, Skipped: []string{"example.com/v1/Backup"}},
+			{Release: "cache", Status: ValidationStatusFailed, Error: "chart not found"},
+		},
+		Valid:   1,
+		Invalid: 1,
+		Failed:  1,
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("unexpected report: expected=%+v, got=%+v", expected, report)
+	}
+
+	if len(errs) != 2 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if relErr, ok := errs[0].(*ReleaseError); !ok || relErr.Name != "web" {
+		t.Errorf("unexpected error for the invalid release: %v", errs[0])
+	}
+	if relErr, ok := errs[1].(*ReleaseError); !ok || relErr.Name != "cache" {
+		t.Errorf("unexpected error for the failed release: %v", errs[1])
+	}
+}
+
+func TestHelmState_UpdateDeps(t *testing.T) {
+	// The lock file is written into the working directory, which is changed to a temporary one so that the test leaves nothing behind
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockDir, err := ioutil.TempDir("", "helmfile-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(lockDir)
+	if err := os.Chdir(lockDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	helm := &mockHelmExec{
+		updateDepsCallbacks: map[string]func(string) error{},
+	}
+
+	var generatedDir string
+	tempDir := func(dir, prefix string) (string, error) {
+		var err error
+		generatedDir, err = ioutil.TempDir(dir, prefix)
+		if err != nil {
+			return "", err
+		}
+		helm.updateDepsCallbacks[generatedDir] = func(chart string) error {
+			content := []byte(`dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.4.0
+digest: sha256:8194b597c85bb3d1fee8476d4a486e952681d5c65f185ad5809f2118bc4079b5
+generated: 2019-05-16T15:42:45.50486+09:00
+`)
+			filename := filepath.Join(generatedDir, "requirements.lock")
+			logger.Debugf("test: writing %s: %s", filename, content)
+			return ioutil.WriteFile(filename, content, 0644)
+		}
+		return generatedDir, nil
+	}
+
+	logger := helmexec.NewLogger(os.Stderr, "debug")
+	state := &HelmState{
+		basePath: "/src",
+		FilePath: "/src/helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{
 				Chart: "./..",
 			},
 			{
@@ -1829,6 +3023,130 @@ func TestHelmState_ResolveDeps_NoLockFile(t *testing.T) {
 	}
 }
 
+func TestHelmState_ResolveDeps_UseLockedReleases(t *testing.T) {
+	lockFile := `dependencies:
+- name: envoy
+  repository: https://kubernetes-charts.storage.googleapis.com
+  version: 1.5.0
+digest: sha256:8194b597c85bb3d1fee8476d4a486e952681d5c65f185ad5809f2118bc4079b5
+generated: "2019-05-16T15:42:45.50486+09:00"
+releases:
+  default/envoy:
+    chart: stable/envoy
+    version: 1.4.0
+`
+
+	tests := []struct {
+		name              string
+		useLockedReleases bool
+		releases          []ReleaseSpec
+		expected          string
+		wantErr           string
+	}{
+		{
+			name:     "without --use-lock",
+			releases: []ReleaseSpec{{Name: "envoy", Namespace: "default", Chart: "stable/envoy"}},
+			expected: "1.5.0",
+		},
+		{
+			name:              "with --use-lock",
+			useLockedReleases: true,
+			releases:          []ReleaseSpec{{Name: "envoy", Namespace: "default", Chart: "stable/envoy"}},
+			expected:          "1.4.0",
+		},
+		{
+			name:              "release missing in the lock file",
+			useLockedReleases: true,
+			releases:          []ReleaseSpec{{Name: "envoy2", Namespace: "default", Chart: "stable/envoy"}},
+			wantErr:           "release \"default/envoy2\" with chart \"stable/envoy\" is not locked in helmfile.lock. run `helmfile deps` to update it",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				basePath: "/src",
+				FilePath: "/src/helmfile.yaml",
+				Releases: tt.releases,
+				Repositories: []RepositorySpec{
+					{
+						Name: "stable",
+						URL:  "https://kubernetes-charts.storage.googleapis.com",
+					},
+				},
+				UseLockedReleases: tt.useLockedReleases,
+				logger:            logger,
+				readFile: func(f string) ([]byte, error) {
+					if f != "helmfile.lock" {
+						return nil, fmt.Errorf("stub: unexpected file: %s", f)
+					}
+					return []byte(lockFile), nil
+				},
+			}
+
+			resolved, err := state.ResolveDeps()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resolved.Releases[0].Version != tt.expected {
+				t.Errorf("unexpected version number: expected=%s, got=%s", tt.expected, resolved.Releases[0].Version)
+			}
+		})
+	}
+}
+
+func TestChartDependencyManager_lockReleases(t *testing.T) {
+	written := map[string]string{}
+
+	m := NewChartDependencyManager("helmfile", logger)
+	m.readFile = func(f string) ([]byte, error) {
+		return []byte("dependencies: []\ndigest: sha256:abc\ngenerated: \"2019-05-16T15:42:45.50486+09:00\"\n"), nil
+	}
+	m.writeFile = func(f string, data []byte, _ os.FileMode) error {
+		written[f] = string(data)
+		return nil
+	}
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "zipkin", Namespace: "tracing", Chart: "stable/zipkin", Version: "1.0.0"},
+			{Name: "envoy", Namespace: "default", Chart: "stable/envoy", Version: "1.4.0"},
+			{Name: "myapp", Namespace: "default", Chart: "./charts/myapp"},
+		},
+		Repositories: []RepositorySpec{
+			{
+				Name: "stable",
+				URL:  "https://kubernetes-charts.storage.googleapis.com",
+			},
+		},
+	}
+
+	if err := m.lockReleases(state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `dependencies: []
+digest: sha256:abc
+generated: "2019-05-16T15:42:45.50486+09:00"
+releases:
+  default/envoy:
+    chart: stable/envoy
+    version: 1.4.0
+  tracing/zipkin:
+    chart: stable/zipkin
+    version: 1.0.0
+`
+	if d := cmp.Diff(expected, written["helmfile.lock"]); d != "" {
+		t.Errorf("unexpected lock file:\n%s", d)
+	}
+}
+
 func TestHelmState_ReleaseStatuses(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -2050,182 +3368,4152 @@ func TestHelmState_NoReleaseMatched(t *testing.T) {
 	}
 }
 
-func TestHelmState_Delete(t *testing.T) {
+func TestHelmState_FilterReleases_SelectorGroups(t *testing.T) {
+	releases := []ReleaseSpec{
+		{Name: "a", Labels: map[string]string{"tier": "frontend"}},
+		{Name: "b", Labels: map[string]string{"tier": "frontend", "role": "proxy"}},
+		{Name: "c", Labels: map[string]string{"tier": "backend"}},
+		{Name: "d", Labels: map[string]string{"tier": "db"}},
+		{Name: "e"},
+	}
 	tests := []struct {
-		name            string
-		deleted         []mockRelease
-		wantErr         bool
-		desired         *bool
-		installed       bool
-		purge           bool
-		flags           string
-		tillerNamespace string
-		kubeContext     string
-		defKubeContext  string
+		selectors []string
+		want      []string
 	}{
-		{
-			name:      "desired and installed (purge=false)",
-			wantErr:   false,
-			desired:   boolValue(true),
-			installed: true,
-			purge:     false,
-			deleted:   []mockRelease{{"releaseA", []string{}}},
-		},
-		{
-			name:      "desired(default) and installed (purge=false)",
-			wantErr:   false,
-			desired:   nil,
-			installed: true,
-			purge:     false,
-			deleted:   []mockRelease{{"releaseA", []string{}}},
-		},
-		{
-			name:      "desired(default) and installed (purge=false) but error",
-			wantErr:   true,
-			desired:   nil,
-			installed: true,
-			purge:     false,
-			deleted:   []mockRelease{{"releaseA", []string{}}},
-		},
-		{
-			name:      "desired and installed (purge=true)",
-			wantErr:   false,
-			desired:   boolValue(true),
-			installed: true,
-			purge:     true,
-			deleted:   []mockRelease{{"releaseA", []string{"--purge"}}},
+		{selectors: []string{"tier!=frontend"}, want: []string{"c", "d", "e"}},
+		{selectors: []string{"tier=frontend,role!=proxy"}, want: []string{"a"}},
+		{selectors: []string{"tier=frontend,role!=proxy", "tier=backend"}, want: []string{"a", "c"}},
+		{selectors: []string{"tier in (frontend,db)"}, want: []string{"a", "b", "d"}},
+		{selectors: []string{"tier notin (frontend,db)"}, want: []string{"c", "e"}},
+		{selectors: []string{"tier=frontend", "name in (a,c)"}, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.selectors, " "), func(t *testing.T) {
+			rs := make([]ReleaseSpec, len(releases))
+			copy(rs, releases)
+			state := &HelmState{
+				Releases:  rs,
+				Selectors: tt.selectors,
+				logger:    logger,
+			}
+			if err := state.FilterReleases(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, r := range state.Releases {
+				got = append(got, r.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected releases: want %v, got %v", tt.want, got)
+			}
+			if len(state.filteredOutReleases)+len(got) != len(releases) {
+				t.Errorf("unexpected number of filtered-out releases: %d", len(state.filteredOutReleases))
+			}
+		})
+	}
+}
+
+func TestHelmState_FilterReleases_Groups(t *testing.T) {
+	releases := []ReleaseSpec{
+		{Name: "db", Namespace: "data", Labels: map[string]string{"tier": "backend"}},
+		{Name: "cache", Labels: map[string]string{"tier": "backend"}},
+		{Name: "api", Needs: []string{"data/db", "cache"}, Labels: map[string]string{"tier": "frontend"}},
+		{Name: "web", Needs: []string{"api"}, Labels: map[string]string{"tier": "frontend"}},
+		{Name: "batch", Needs: []string{"data/db"}},
+	}
+	groups := map[string][]string{
+		"frontend": {"web", "api"},
+		"backend":  {"data/db", "cache"},
+		"typo":     {"wbe"},
+	}
+	tests := []struct {
+		name        string
+		groups      []string
+		needs       bool
+		selectors   []string
+		want        []string
+		wantErr     string
+		wantSkipped int
+	}{
+		{name: "group", groups: []string{"frontend"}, want: []string{"api", "web"}},
+		{name: "groups", groups: []string{"frontend", "backend"}, want: []string{"api", "cache", "db", "web"}},
+		{name: "needs", groups: []string{"frontend"}, needs: true, want: []string{"api", "cache", "db", "web"}},
+		{name: "selector", groups: []string{"frontend"}, needs: true, selectors: []string{"tier=backend"}, want: []string{"cache", "db"}},
+		{name: "undefined group", groups: []string{"ops"}, want: nil},
+		{name: "undefined release", groups: []string{"typo"}, wantErr: `group "typo" in helmfile.yaml has release "wbe", which is not defined`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := make([]ReleaseSpec, len(releases))
+			copy(rs, releases)
+			var skipped []SkipReason
+			state := &HelmState{
+				FilePath:          "helmfile.yaml",
+				Releases:          rs,
+				Groups:            groups,
+				SelectedGroups:    tt.groups,
+				IncludeGroupNeeds: tt.needs,
+				Selectors:         tt.selectors,
+				logger:            logger,
+				ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+					skipped = append(skipped, reason)
+				},
+			}
+			err := state.FilterReleases()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: want %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, r := range state.Releases {
+				got = append(got, r.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected releases: want %v, got %v", tt.want, got)
+			}
+			if len(state.filteredOutReleases)+len(got) != len(releases) {
+				t.Errorf("unexpected number of filtered-out releases: %d", len(state.filteredOutReleases))
+			}
+			if len(skipped) != len(state.filteredOutReleases) {
+				t.Errorf("unexpected releases skipped: %v", skipped)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_Groups(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "web", Chart: "foo/web", Needs: []string{"api"}},
+			{Name: "api", Chart: "foo/api", Needs: []string{"db"}},
+			{Name: "db", Chart: "foo/db"},
+			{Name: "batch", Chart: "foo/batch", Needs: []string{"db"}},
 		},
-		{
-			name:      "desired but not installed (purge=false)",
-			wantErr:   false,
-			desired:   boolValue(true),
-			installed: false,
-			purge:     false,
-			deleted:   []mockRelease{},
+		Groups: map[string][]string{
+			"frontend": {"web", "api"},
 		},
+		SelectedGroups:    []string{"frontend"},
+		IncludeGroupNeeds: true,
+		logger:            logger,
+		valsRuntime:       valsRuntime,
+	}
+
+	if err := state.FilterReleases(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// The releases in the group are synced after the release they need, which is not in the group
+	var got []string
+	for _, r := range helm.releases {
+		got = append(got, r.name)
+	}
+	if want := []string{"db", "api", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected releases synced: want %v, got %v", want, got)
+	}
+}
+
+func TestHelmState_FilterReleases_LabelNeeds(t *testing.T) {
+	releases := func() []ReleaseSpec {
+		return []ReleaseSpec{
+			{Name: "db", Namespace: "data", Chart: "foo/db", Labels: map[string]string{"tier": "data", "kind": "sql"}},
+			{Name: "cache", Namespace: "data", Chart: "foo/cache", Labels: map[string]string{"tier": "data"}},
+			{Name: "mq", Chart: "foo/mq", Labels: map[string]string{"tier": "messaging"}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		needs    Needs
+		expected Needs
+		wantErr  string
+	}{
+		{name: "single match", needs: Needs{"label:kind=sql"}, expected: Needs{"data/db"}},
+		{name: "multiple matches", needs: Needs{"label:tier=data"}, expected: Needs{"data/db", "data/cache"}},
+		{name: "soft", needs: Needs{"?label:tier=data", "mq"}, expected: Needs{"?data/db", "?data/cache", "mq"}},
+		{name: "deduplicated", needs: Needs{"data/cache", "label:tier=data"}, expected: Needs{"data/cache", "data/db"}},
+		{name: "multiple labels", needs: Needs{"label:tier=data,kind!=sql"}, expected: Needs{"data/cache"}},
 		{
-			name:      "desired but not installed (purge=true)",
-			wantErr:   false,
-			desired:   boolValue(true),
-			installed: false,
-			purge:     true,
-			deleted:   []mockRelease{},
+			name:    "no match",
+			needs:   Needs{"label:tier=web"},
+			wantErr: `release "app" needs "label:tier=web", but no other release matches the selector "tier=web". please fix the selector or the labels of the releases`,
 		},
-		{
-			name:      "installed but filtered (purge=false)",
-			wantErr:   false,
-			desired:   boolValue(false),
-			installed: true,
-			purge:     false,
-			deleted:   []mockRelease{},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases: append(releases(), ReleaseSpec{Name: "app", Chart: "foo/app", Labels: map[string]string{"tier": "data"}, Needs: tt.needs}),
+				logger:   logger,
+			}
+
+			err := state.FilterReleases()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("unexpected error: expected=%q, got=%v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, r := range state.Releases {
+				if r.Name == "app" && !reflect.DeepEqual(tt.expected, r.Needs) {
+					t.Errorf("unexpected needs: expected=%v, got=%v", tt.expected, r.Needs)
+				}
+			}
+		})
+	}
+}
+
+func TestHelmState_PlanReleases_LabelNeeds(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Chart: "foo/app", Needs: []string{"label:tier=data"}},
+			{Name: "db", Chart: "foo/db", Labels: map[string]string{"tier": "data"}},
+			{Name: "cache", Chart: "foo/cache", Labels: map[string]string{"tier": "data"}, Needs: []string{"db"}},
 		},
-		{
-			name:      "installed but filtered (purge=true)",
-			wantErr:   false,
-			desired:   boolValue(false),
-			installed: true,
-			purge:     true,
-			deleted:   []mockRelease{},
+		logger: logger,
+	}
+
+	if err := state.FilterReleases(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batches, err := state.PlanReleases(nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual [][]string
+	for _, batch := range batches {
+		var names []string
+		for _, r := range batch {
+			names = append(names, r.Name)
+		}
+		actual = append(actual, names)
+	}
+
+	expected := [][]string{{"db"}, {"cache"}, {"app"}}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected batches: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestHelmState_SyncReleases_LabelNeeds(t *testing.T) {
+	tests := []struct {
+		name    string
+		db      string
+		synced  []string
+		skipped []string
+	}{
+		{name: "ordered", db: "db", synced: []string{"db", "cache", "app"}},
+		{name: "failed", db: "db-error", skipped: []string{"cache", "app"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var skipped []string
+
+			// FilterReleases is never called, as done without selectors
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{Name: "app", Chart: "foo/app", Needs: []string{"label:tier=data"}},
+					{Name: tt.db, Chart: "foo/db", Labels: map[string]string{"tier": "data"}},
+					{Name: "cache", Chart: "foo/cache", Labels: map[string]string{"tier": "data"}, Needs: []string{tt.db}},
+				},
+				logger:      logger,
+				valsRuntime: valsRuntime,
+				ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+					skipped = append(skipped, r.Name)
+				},
+			}
+
+			helm := &mockHelmExec{}
+			errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1, &SyncOpts{MaxFailures: -1})
+			if len(tt.skipped) == 0 && len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			var synced []string
+			for _, r := range helm.releases {
+				if r.name != "db-error" {
+					synced = append(synced, r.name)
+				}
+			}
+			if !reflect.DeepEqual(synced, tt.synced) {
+				t.Errorf("unexpected releases synced: want %v, got %v", tt.synced, synced)
+			}
+			if !reflect.DeepEqual(skipped, tt.skipped) {
+				t.Errorf("unexpected releases skipped: want %v, got %v", tt.skipped, skipped)
+			}
+		})
+	}
+}
+
+func TestHelmState_Sequential(t *testing.T) {
+	newState := func() *HelmState {
+		return &HelmState{
+			Releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", Needs: []string{"db"}},
+				{Name: "db", Chart: "foo/db"},
+				{Name: "cache", Chart: "foo/cache", Priority: 10},
+				{Name: "web", Chart: "foo/web", Needs: []string{"app"}},
+			},
+			Sequential:  true,
+			logger:      logger,
+			valsRuntime: valsRuntime,
+		}
+	}
+
+	t.Run("sync", func(t *testing.T) {
+		helm := &mockHelmExec{}
+		if errs := newState().SyncReleases(&AffectedReleases{}, helm, []string{}, 4); len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		var got []string
+		for _, r := range helm.releases {
+			got = append(got, r.name)
+		}
+		if want := []string{"app", "db", "cache", "web"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected releases synced: want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("sync follows the declaration order regardless of the concurrency", func(t *testing.T) {
+		var want []string
+		state := &HelmState{
+			Sequential:  true,
+			logger:      logger,
+			valsRuntime: valsRuntime,
+		}
+		for i := 0; i < 20; i++ {
+			name := fmt.Sprintf("release%02d", 19-i)
+			state.Releases = append(state.Releases, ReleaseSpec{Name: name, Chart: "foo/" + name})
+			want = append(want, name)
+		}
+
+		for i := 0; i < 5; i++ {
+			helm := &mockHelmExec{}
+			if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 8); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			var got []string
+			for _, r := range helm.releases {
+				got = append(got, r.name)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("unexpected releases synced: want %v, got %v", want, got)
+			}
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		helm := &mockHelmExec{lists: map[listKey]string{}}
+		for _, name := range []string{"app", "db", "cache", "web"} {
+			helm.lists[listKey{filter: "^" + name + "$"}] = name
+		}
+		if errs := newState().DeleteReleases(&AffectedReleases{}, helm, 4, true); len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		var got []string
+		for _, r := range helm.deleted {
+			got = append(got, r.name)
+		}
+		if want := []string{"web", "cache", "db", "app"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected releases deleted: want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("needs are still validated", func(t *testing.T) {
+		state := newState()
+		state.Releases[1].Needs = []string{"web"}
+		if _, err := state.PlanReleases(nil, 0); err == nil {
+			t.Errorf("expected an error for the cycle")
+		}
+
+		state = newState()
+		state.Releases[1].Needs = []string{"missing"}
+		if _, err := state.PlanReleases(nil, 0); err == nil {
+			t.Errorf("expected an error for the missing release")
+		}
+	})
+}
+
+func TestHelmState_FilterReleases_ChartAndVersion(t *testing.T) {
+	releases := []ReleaseSpec{
+		{Name: "a", Chart: "stable/nginx", Version: "1.2.3"},
+		{Name: "b", Chart: "stable/nginx", Version: "1.3.0"},
+		{Name: "c", Chart: "bitnami/nginx", Version: "2.0.0"},
+		{Name: "d", Chart: "stable/redis", Version: "1.2.4"},
+		{Name: "e", Chart: "./charts/nginx"},
+	}
+	tests := []struct {
+		selectors []string
+		want      []string
+	}{
+		{selectors: []string{"chart=nginx"}, want: []string{"a", "b", "c", "e"}},
+		{selectors: []string{"chart=stable/nginx"}, want: []string{"a", "b"}},
+		{selectors: []string{"chart!=stable/nginx"}, want: []string{"c", "d", "e"}},
+		{selectors: []string{"chart in (stable/nginx,stable/redis)"}, want: []string{"a", "b", "d"}},
+		{selectors: []string{"chart=./charts/nginx"}, want: []string{"e"}},
+		{selectors: []string{"chartVersion=1.2.3"}, want: []string{"a"}},
+		{selectors: []string{"chartVersion=1.2.x"}, want: []string{"a", "d"}},
+		{selectors: []string{"chartVersion=~1.2.0"}, want: []string{"a", "d"}},
+		{selectors: []string{"chartVersion=^1.2.0"}, want: []string{"a", "b", "d"}},
+		{selectors: []string{"chartVersion=>=1.3.0"}, want: []string{"b", "c"}},
+		{selectors: []string{"chartVersion=>=1.2.4,chartVersion=<2.0.0"}, want: []string{"b", "d"}},
+		{selectors: []string{"chartVersion!=1.2.x"}, want: []string{"b", "c", "e"}},
+		{selectors: []string{"chartVersion in (1.2.3,2.x)"}, want: []string{"a", "c"}},
+		{selectors: []string{"chart=stable/nginx,chartVersion=<1.3.0"}, want: []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.selectors, " "), func(t *testing.T) {
+			rs := make([]ReleaseSpec, len(releases))
+			copy(rs, releases)
+			state := &HelmState{
+				Releases:  rs,
+				Selectors: tt.selectors,
+				logger:    logger,
+			}
+			if err := state.FilterReleases(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, r := range state.Releases {
+				got = append(got, r.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected releases: want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_FilteredOutNeeds(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Chart: "foo/app", Needs: []string{"cache"}, Labels: map[string]string{"group": "x"}},
+			{Name: "cache", Chart: "foo/cache", Needs: []string{"db"}},
+			{Name: "db", Chart: "foo/db", Labels: map[string]string{"group": "x"}},
 		},
-		{
-			name:      "not installed, and filtered (purge=false)",
-			wantErr:   false,
-			desired:   boolValue(false),
-			installed: false,
-			purge:     false,
-			deleted:   []mockRelease{},
+		Selectors:   []string{"group=x"},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+	if err := state.FilterReleases(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var got []string
+	for _, r := range helm.releases {
+		got = append(got, r.name)
+	}
+	if want := []string{"db", "app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected releases synced: want %v, got %v", want, got)
+	}
+}
+
+func TestHelmState_NoopRelease(t *testing.T) {
+	newState := func() *HelmState {
+		return &HelmState{
+			Releases: []ReleaseSpec{
+				{Name: "app1", Chart: "foo/app", Needs: []string{"infra-ready"}},
+				{Name: "app2", Chart: "foo/app", Needs: []string{"infra-ready"}},
+				{Name: "infra-ready", Type: ReleaseTypeNoop, Needs: []string{"db", "cache"}},
+				{Name: "db", Chart: "foo/db"},
+				{Name: "cache", Chart: "foo/cache"},
+			},
+			logger:      logger,
+			valsRuntime: valsRuntime,
+		}
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		groups, err := newState().Validate()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := [][]string{{"db", "cache"}, {"infra-ready"}, {"app1", "app2"}}
+		if !reflect.DeepEqual(groups, want) {
+			t.Errorf("unexpected groups: want %v, got %v", want, groups)
+		}
+
+		state := newState()
+		state.Releases[2].Type = "none"
+		if _, err := state.Validate(); err == nil || err.Error() != `release "infra-ready" has unknown type "none". it must be either omitted or "noop"` {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("sync", func(t *testing.T) {
+		helm := &mockHelmExec{}
+		affected := &AffectedReleases{}
+		if errs := newState().SyncReleases(affected, helm, []string{}, 1); len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		var got []string
+		for _, r := range helm.releases {
+			got = append(got, r.name)
+		}
+		if want := []string{"db", "cache", "app1", "app2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected releases synced: want %v, got %v", want, got)
+		}
+		if len(affected.Upgraded) != 4 {
+			t.Errorf("unexpected releases upgraded: %v", affected.Upgraded)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		// Every release including the noop one is reported as installed, so that only the noop one is left undeleted
+		helm := &mockHelmExec{lists: map[listKey]string{}}
+		for _, name := range []string{"app1", "app2", "infra-ready", "db", "cache"} {
+			helm.lists[listKey{filter: "^" + name + "$"}] = name
+		}
+		affected := &AffectedReleases{}
+		if errs := newState().DeleteReleases(affected, helm, 1, true); len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		var got []string
+		for _, r := range helm.deleted {
+			got = append(got, r.name)
+		}
+		if want := []string{"app1", "app2", "db", "cache"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected releases deleted: want %v, got %v", want, got)
+		}
+	})
+}
+
+func TestHelmState_SyncReleases_HelmBinary(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "releaseA", Chart: "foo/bar"},
+			{Name: "releaseB", Chart: "foo/bar", HelmBinary: "helm3"},
 		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if len(helm.releases) != 2 {
+		t.Fatalf("unexpected releases synced: %v", helm.releases)
+	}
+	// releaseB is both listed and synced with its own helm binary
+	if want := []string{"helm3", "helm3"}; !reflect.DeepEqual(helm.binaries, want) {
+		t.Errorf("unexpected helm binaries: want %v, got %v", want, helm.binaries)
+	}
+}
+
+func TestHelmState_SyncReleases_After(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		want     []string
+		wantErrs int
+	}{
 		{
-			name:      "not installed, and filtered (purge=true)",
-			wantErr:   false,
-			desired:   boolValue(false),
-			installed: false,
-			purge:     true,
-			deleted:   []mockRelease{},
+			name: "after",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", After: []string{"db", "nonexistent"}},
+				{Name: "db", Chart: "foo/db"},
+			},
+			want: []string{"db", "app"},
 		},
 		{
-			name:            "with tiller args",
-			wantErr:         false,
-			desired:         nil,
-			installed:       true,
-			purge:           true,
-			tillerNamespace: "tillerns",
-			flags:           "--tiller-namespacetillerns",
-			deleted:         []mockRelease{{"releaseA", []string{"--purge", "--tiller-namespace", "tillerns"}}},
+			name: "before",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app"},
+				{Name: "db", Chart: "foo/db", Before: []string{"app", "nonexistent"}},
+			},
+			want: []string{"db", "app"},
 		},
 		{
-			name:        "with kubecontext",
-			wantErr:     false,
-			desired:     nil,
-			installed:   true,
-			purge:       true,
-			kubeContext: "ctx",
-			flags:       "--kube-contextctx",
-			deleted:     []mockRelease{{"releaseA", []string{"--purge", "--kube-context", "ctx"}}},
+			name: "after-failed",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", After: []string{"db-error"}},
+				{Name: "db-error", Chart: "foo/db"},
+			},
+			want:     []string{"app"},
+			wantErrs: 1,
 		},
 		{
-			name:           "with default kubecontext",
-			wantErr:        false,
-			desired:        nil,
-			installed:      true,
-			purge:          true,
-			defKubeContext: "defctx",
-			flags:          "--kube-contextdefctx",
-			deleted:        []mockRelease{{"releaseA", []string{"--purge", "--kube-context", "defctx"}}},
+			name: "needs-after-failed",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", Needs: []string{"db-error"}, After: []string{"db-error"}},
+				{Name: "db-error", Chart: "foo/db"},
+			},
+			want:     nil,
+			wantErrs: 1,
 		},
 		{
-			name:           "with non-default and default kubecontexts",
-			wantErr:        false,
-			desired:        nil,
-			installed:      true,
-			purge:          true,
-			kubeContext:    "ctx",
-			defKubeContext: "defctx",
-			flags:          "--kube-contextctx",
-			deleted:        []mockRelease{{"releaseA", []string{"--purge", "--kube-context", "ctx"}}},
+			name: "after-not-installed",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", Needs: []string{"cache"}, After: []string{"db"}},
+				{Name: "cache", Chart: "foo/cache", After: []string{"db"}},
+				{Name: "db", Chart: "foo/db", Installed: boolValue(false)},
+			},
+			want: []string{"cache", "app"},
 		},
 	}
-	for i := range tests {
-		tt := tests[i]
-		f := func(t *testing.T) {
-			name := "releaseA"
-			if tt.wantErr {
-				name = "releaseA-error"
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases:    tt.releases,
+				logger:      logger,
+				valsRuntime: valsRuntime,
 			}
-			release := ReleaseSpec{
-				Name:            name,
-				Installed:       tt.desired,
-				TillerNamespace: tt.tillerNamespace,
-				KubeContext:     tt.kubeContext,
+
+			helm := &mockHelmExec{}
+			errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1)
+			if len(errs) != tt.wantErrs {
+				t.Fatalf("unexpected errors: %v", errs)
 			}
-			releases := []ReleaseSpec{
-				release,
+
+			var got []string
+			for _, r := range helm.releases {
+				got = append(got, r.name)
 			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected releases synced: want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_Wave(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		want     []string
+		wantErrs int
+	}{
+		{
+			name: "waves",
+			releases: []ReleaseSpec{
+				{Name: "smoketests", Chart: "foo/smoketests", Wave: 2},
+				{Name: "app", Chart: "foo/app", Wave: 1},
+				{Name: "db", Chart: "foo/db"},
+				{Name: "crds", Chart: "foo/crds", Wave: -1},
+			},
+			want: []string{"crds", "db", "app", "smoketests"},
+		},
+		{
+			name: "waves-and-needs",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", Wave: 1, Needs: []string{"migrations"}},
+				{Name: "migrations", Chart: "foo/migrations", Wave: 1},
+				{Name: "web", Chart: "foo/web", Wave: 1},
+				{Name: "smoketests", Chart: "foo/smoketests", Wave: 2},
+				{Name: "db", Chart: "foo/db", Needs: []string{"cache"}},
+				{Name: "cache", Chart: "foo/cache"},
+			},
+			want: []string{"cache", "db", "migrations", "web", "app", "smoketests"},
+		},
+		{
+			name: "wave-failed",
+			releases: []ReleaseSpec{
+				{Name: "app", Chart: "foo/app", Wave: 1},
+				{Name: "db-error", Chart: "foo/db"},
+			},
+			want:     []string{"app"},
+			wantErrs: 1,
+		},
+		{
+			name: "wave-not-installed",
+			releases: []ReleaseSpec{
+				{Name: "smoketests", Chart: "foo/smoketests", Wave: 2},
+				{Name: "app", Chart: "foo/app", Wave: 1, Installed: boolValue(false)},
+				{Name: "db", Chart: "foo/db"},
+			},
+			want: []string{"db", "smoketests"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
 			state := &HelmState{
-				HelmDefaults: HelmSpec{
-					KubeContext: tt.defKubeContext,
-				},
-				Releases: releases,
-				logger:   logger,
+				Releases:    tt.releases,
+				logger:      logger,
+				valsRuntime: valsRuntime,
 			}
-			helm := &mockHelmExec{
-				lists:   map[listKey]string{},
-				deleted: []mockRelease{},
+
+			helm := &mockHelmExec{}
+			errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1)
+			if len(errs) != tt.wantErrs {
+				t.Fatalf("unexpected errors: %v", errs)
 			}
-			if tt.installed {
-				helm.lists[listKey{filter: "^" + name + "$", flags: tt.flags}] = name
+
+			var got []string
+			for _, r := range helm.releases {
+				got = append(got, r.name)
 			}
-			affectedReleases := AffectedReleases{}
-			errs := state.DeleteReleases(&affectedReleases, helm, 1, tt.purge)
-			if errs != nil {
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected releases synced: want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_WaveCycle(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "foo/db", Needs: []string{"app"}},
+			{Name: "app", Chart: "foo/app", Wave: 1},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+
+	helm := &mockHelmExec{}
+	errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "cycl") {
+		t.Fatalf("expected a cycle error, got %v", errs)
+	}
+	if len(helm.releases) != 0 {
+		t.Errorf("unexpected releases synced: %v", helm.releases)
+	}
+}
+
+func TestHelmState_SyncReleases_MaxFailures(t *testing.T) {
+	releases := []ReleaseSpec{
+		{Name: "db-error", Chart: "foo/db"},
+		{Name: "cache", Chart: "foo/cache"},
+		{Name: "app", Chart: "foo/app", Needs: []string{"db-error"}},
+		{Name: "web", Chart: "foo/web", Needs: []string{"cache"}},
+		{Name: "queue-error", Chart: "foo/queue", Needs: []string{"cache"}},
+		{Name: "worker", Chart: "foo/worker", Needs: []string{"app"}},
+		{Name: "api", Chart: "foo/api", Needs: []string{"web"}},
+	}
+
+	tests := []struct {
+		name        string
+		maxFailures int
+		want        []string
+		wantSkipped []string
+		wantErrs    int
+	}{
+		{
+			name:        "zero",
+			maxFailures: 0,
+			want:        []string{"cache"},
+			wantErrs:    1,
+		},
+		{
+			name:        "one",
+			maxFailures: 1,
+			want:        []string{"cache"},
+			wantErrs:    1,
+		},
+		{
+			name:        "two",
+			maxFailures: 2,
+			want:        []string{"cache", "web"},
+			wantSkipped: []string{"app"},
+			wantErrs:    3,
+		},
+		{
+			name:        "unlimited",
+			maxFailures: -1,
+			want:        []string{"cache", "web", "api"},
+			wantSkipped: []string{"app", "worker"},
+			wantErrs:    4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var skipped []string
+
+			state := &HelmState{
+				Releases:    append([]ReleaseSpec{}, releases...),
+				logger:      logger,
+				valsRuntime: valsRuntime,
+				ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+					if reason != SkipReasonNeedsFailed {
+						t.Errorf("unexpected reason for skipping %q: %s", r.Name, reason)
+					}
+					skipped = append(skipped, r.Name)
+				},
+			}
+
+			helm := &mockHelmExec{}
+			errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1, &SyncOpts{MaxFailures: tt.maxFailures})
+			if len(errs) != tt.wantErrs {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			var got []string
+			for _, r := range helm.releases {
+				got = append(got, r.name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected releases synced: want %v, got %v", tt.want, got)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("unexpected releases skipped: want %v, got %v", tt.wantSkipped, skipped)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_MaxFailures_NeedsFilteredOut(t *testing.T) {
+	var skipped []string
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db-error", Chart: "foo/db"},
+			{Name: "worker", Chart: "foo/worker", Needs: []string{"app"}},
+			{Name: "cache", Chart: "foo/cache"},
+		},
+		filteredOutReleases: []ReleaseSpec{
+			{Name: "app", Chart: "foo/app", Needs: []string{"db-error"}},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+			skipped = append(skipped, r.Name)
+		},
+	}
+
+	helm := &mockHelmExec{}
+	errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1, &SyncOpts{MaxFailures: -1})
+	if len(errs) != 2 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var got []string
+	for _, r := range helm.releases {
+		got = append(got, r.name)
+	}
+	if want := []string{"cache"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected releases synced: want %v, got %v", want, got)
+	}
+	if want := []string{"worker"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("unexpected releases skipped: want %v, got %v", want, skipped)
+	}
+}
+
+func TestHelmState_SyncReleases_AtomicRun(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "foo/db"},
+			{Name: "cache", Chart: "foo/cache"},
+			{Name: "app", Chart: "foo/app", Needs: []string{"db"}},
+			{Name: "web", Chart: "foo/web", Needs: []string{"cache"}},
+			{Name: "worker-error", Chart: "foo/worker", Needs: []string{"app"}},
+			{Name: "api", Chart: "foo/api", Needs: []string{"web"}},
+			{Name: "legacy", Chart: "foo/legacy", Installed: boolValue(false)},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+
+	helm := &mockHelmExec{
+		lists: map[listKey]string{
+			{filter: "^db$", flags: ""}:     "db\t1\tdeployed",
+			{filter: "^legacy$", flags: ""}: "",
+		},
+	}
+
+	errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1, &SyncOpts{AtomicRun: true, MaxFailures: -1})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "worker-error") {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	var synced []string
+	for _, r := range helm.releases {
+		synced = append(synced, r.name)
+	}
+	if want := []string{"db", "cache", "app", "web", "api"}; !reflect.DeepEqual(synced, want) {
+		t.Errorf("unexpected releases synced: want %v, got %v", want, synced)
+	}
+
+	// The release installed before the run is rolled back, whereas the ones newly installed are deleted,
+	// both in the reverse order of syncing them
+	var rolledBack []string
+	for _, r := range helm.rolledBack {
+		rolledBack = append(rolledBack, r.name)
+	}
+	if want := []string{"db"}; !reflect.DeepEqual(rolledBack, want) {
+		t.Errorf("unexpected releases rolled back: want %v, got %v", want, rolledBack)
+	}
+
+	var deleted []string
+	for _, r := range helm.deleted {
+		deleted = append(deleted, r.name)
+	}
+	if want := []string{"api", "web", "app", "cache"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("unexpected releases deleted: want %v, got %v", want, deleted)
+	}
+}
+
+func TestHelmState_SyncReleases_DryRun(t *testing.T) {
+	var skipped []string
+
+	dir, err := ioutil.TempDir("", "helmfile-dry-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hooked := filepath.Join(dir, "hooked")
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			// Neither the hooks nor the readiness probe, which is invalid, are run for the release in the dry-run mode
+			{
+				Name:       "db",
+				Chart:      "foo/db",
+				DryRunMode: boolValue(true),
+				Hooks:      []event.Hook{{Name: "touch", Events: []string{"presync", "postsync", "cleanup"}, Command: "touch", Args: []string{hooked}}},
+				WaitFor:    []ReadinessProbe{{Name: "invalid"}},
+			},
+			{Name: "cache", Chart: "foo/cache"},
+			{Name: "app", Chart: "foo/app", Needs: []string{"db"}},
+			{Name: "web", Chart: "foo/web", Needs: []string{"cache", "?db"}},
+			{Name: "worker", Chart: "foo/worker", Needs: []string{"app"}},
+			{Name: "legacy", Chart: "foo/legacy", Installed: boolValue(false), DryRunMode: boolValue(true)},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+			if reason != SkipReasonNeedsDryRun {
+				t.Errorf("unexpected reason for skipping %q: %s", r.Name, reason)
+			}
+			skipped = append(skipped, r.Name)
+		},
+	}
+
+	helm := &mockHelmExec{
+		lists: map[listKey]string{
+			{filter: "^legacy$", flags: ""}: "legacy\t1\tdeployed",
+		},
+	}
+
+	affected := AffectedReleases{}
+	if errs := state.SyncReleases(&affected, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// The releases hard-needing the one in the dry-run mode are skipped transitively without errors,
+	// whereas the ones only softly needing it are synced
+	if want := []string{"app", "worker"}; !reflect.DeepEqual(skipped, want) {
+		t.Errorf("unexpected releases skipped: want %v, got %v", want, skipped)
+	}
+
+	dryRun := map[string]bool{}
+	var synced []string
+	for _, r := range helm.releases {
+		synced = append(synced, r.name)
+		for _, f := range r.flags {
+			if f == "--dry-run" {
+				dryRun[r.name] = true
+			}
+		}
+	}
+	if want := []string{"db", "cache", "web"}; !reflect.DeepEqual(synced, want) {
+		t.Errorf("unexpected releases synced: want %v, got %v", want, synced)
+	}
+	if want := map[string]bool{"db": true}; !reflect.DeepEqual(dryRun, want) {
+		t.Errorf("unexpected releases synced with --dry-run: want %v, got %v", want, dryRun)
+	}
+
+	if len(helm.deleted) != 1 || !strings.Contains(strings.Join(helm.deleted[0].flags, " "), "--dry-run") {
+		t.Errorf("unexpected releases deleted: %v", helm.deleted)
+	}
+
+	var upgraded, dryRunAffected []string
+	for _, r := range affected.Upgraded {
+		upgraded = append(upgraded, r.Name)
+	}
+	for _, r := range affected.DryRun {
+		dryRunAffected = append(dryRunAffected, r.Name)
+	}
+	if want := []string{"cache", "web"}; !reflect.DeepEqual(upgraded, want) {
+		t.Errorf("unexpected releases upgraded: want %v, got %v", want, upgraded)
+	}
+	if want := []string{"db", "legacy"}; !reflect.DeepEqual(dryRunAffected, want) {
+		t.Errorf("unexpected releases dry-run: want %v, got %v", want, dryRunAffected)
+	}
+	if len(affected.Deleted) != 0 {
+		t.Errorf("unexpected releases deleted: %v", affected.Deleted)
+	}
+
+	if _, err := os.Stat(hooked); !os.IsNotExist(err) {
+		t.Errorf("unexpected hooks run for the release in the dry-run mode: %v", err)
+	}
+}
+
+func TestHelmState_PrepareCharts(t *testing.T) {
+	tillerless := true
+	state := &HelmState{
+		basePath: "/src",
+		Releases: []ReleaseSpec{
+			{Name: "local1", Chart: "./charts/app"},
+			{Name: "local2", Chart: "./charts/app"},
+			{Name: "remote", Chart: "stable/mysql", Version: "1.0.0", Tillerless: &tillerless},
+			{Name: "uninstalled", Chart: "stable/redis", Installed: boolValue(false)},
+		},
+		logger: logger,
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.PrepareCharts(helm, "/tmp/charts", 1, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if want := []string{"/src/charts/app"}; !reflect.DeepEqual(helm.charts, want) {
+		t.Errorf("unexpected charts built: want %v, got %v", want, helm.charts)
+	}
+	if want := []string{"stable/mysql"}; !reflect.DeepEqual(helm.fetched, want) {
+		t.Errorf("unexpected charts fetched: want %v, got %v", want, helm.fetched)
+	}
+
+	want := map[string]string{
+		"local1":      "/src/charts/app",
+		"local2":      "/src/charts/app",
+		"remote":      "/tmp/charts/remote/1.0.0/stable/mysql",
+		"uninstalled": "stable/redis",
+	}
+	for i := range state.Releases {
+		r := &state.Releases[i]
+		if got := state.chartFor(r); got != want[r.Name] {
+			t.Errorf("unexpected chart for %s: want %s, got %s", r.Name, want[r.Name], got)
+		}
+	}
+
+	helm = &mockHelmExec{}
+	if errs := state.PrepareCharts(helm, "/tmp/charts", 1, true); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if len(helm.charts) > 0 {
+		t.Errorf("unexpected charts built with skipDeps: %v", helm.charts)
+	}
+	if len(helm.fetched) > 0 {
+		t.Errorf("unexpected charts fetched with skipDeps: %v", helm.fetched)
+	}
+}
+
+// concurrencyRecordingHelmExec records the peak number of concurrent `helm fetch`es and `helm list`s
+type concurrencyRecordingHelmExec struct {
+	*mockHelmExec
+	mu            sync.Mutex
+	running, peak int
+}
+
+func (helm *concurrencyRecordingHelmExec) track() func() {
+	helm.mu.Lock()
+	helm.running++
+	if helm.running > helm.peak {
+		helm.peak = helm.running
+	}
+	helm.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	return func() {
+		helm.mu.Lock()
+		defer helm.mu.Unlock()
+		helm.running--
+	}
+}
+
+func (helm *concurrencyRecordingHelmExec) Fetch(chart string, flags ...string) error {
+	defer helm.track()()
+	helm.mu.Lock()
+	defer helm.mu.Unlock()
+	return helm.mockHelmExec.Fetch(chart, flags...)
+}
+
+func (helm *concurrencyRecordingHelmExec) List(context helmexec.HelmContext, filter string, flags ...string) (string, error) {
+	defer helm.track()()
+	return helm.mockHelmExec.List(context, filter, flags...)
+}
+
+func TestHelmState_PrepareCharts_MaxConcurrency(t *testing.T) {
+	var releases []ReleaseSpec
+	for i := 0; i < 20; i++ {
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("release%d", i), Chart: "stable/mysql"})
+	}
+
+	state := &HelmState{
+		Releases:       releases,
+		MaxConcurrency: 3,
+		logger:         logger,
+	}
+
+	helm := &concurrencyRecordingHelmExec{mockHelmExec: &mockHelmExec{}}
+	if errs := state.PrepareCharts(helm, "/tmp/charts", 0, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if len(helm.fetched) != 20 {
+		t.Errorf("unexpected number of charts fetched: expected 20, got %d", len(helm.fetched))
+	}
+	if helm.peak > 3 {
+		t.Errorf("unexpected number of concurrent fetches: expected at most 3, got %d", helm.peak)
+	}
+}
+
+func TestHelmState_PrepareCharts_Tillerless(t *testing.T) {
+	var releases []ReleaseSpec
+	for i := 0; i < 20; i++ {
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("release%d", i), Chart: "stable/mysql"})
+	}
+
+	state := &HelmState{
+		Releases:       releases,
+		HelmDefaults:   HelmSpec{Tillerless: true},
+		MaxConcurrency: 3,
+		logger:         logger,
+	}
+
+	helm := &concurrencyRecordingHelmExec{mockHelmExec: &mockHelmExec{}}
+	if errs := state.PrepareCharts(helm, "/tmp/charts", 0, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if helm.peak < 2 || helm.peak > 3 {
+		t.Errorf("unexpected number of concurrent fetches: expected 2 to 3, got %d", helm.peak)
+	}
+}
+
+func TestHelmState_releasesInstalled(t *testing.T) {
+	var releases []*ReleaseSpec
+	for i := 0; i < 10; i++ {
+		releases = append(releases, &ReleaseSpec{Name: fmt.Sprintf("release%d", i), Chart: "stable/mysql"})
+	}
+
+	state := &HelmState{
+		MaxConcurrency: 3,
+		logger:         logger,
+	}
+
+	helm := &concurrencyRecordingHelmExec{mockHelmExec: &mockHelmExec{lists: map[listKey]string{
+		{filter: "^release3$"}: "release3",
+		{filter: "^release7$"}: "release7",
+	}}}
+	installed, err := state.releasesInstalled(helm, releases, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]bool{}
+	for _, r := range releases {
+		expected[r.Name] = r.Name == "release3" || r.Name == "release7"
+	}
+	if !reflect.DeepEqual(expected, installed) {
+		t.Errorf("unexpected installed releases: expected=%v, got=%v", expected, installed)
+	}
+	if helm.peak < 2 || helm.peak > 3 {
+		t.Errorf("unexpected number of concurrent `helm list`s: expected 2 or 3, got %d", helm.peak)
+	}
+}
+
+// archiveFetchingHelmExec writes the archive of the chart into the destination on `helm fetch --destination`
+type archiveFetchingHelmExec struct {
+	*mockHelmExec
+	flags [][]string
+}
+
+func (helm *archiveFetchingHelmExec) Fetch(chart string, flags ...string) error {
+	helm.flags = append(helm.flags, flags)
+	for i := 0; i < len(flags)-1; i++ {
+		if flags[i] == "--destination" {
+			if err := ioutil.WriteFile(filepath.Join(flags[i+1], "mysql-1.0.0.tgz"), nil, 0644); err != nil {
+				return err
+			}
+		}
+	}
+	return helm.mockHelmExec.Fetch(chart, flags...)
+}
+
+func TestHelmState_PrepareCharts_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "remote", Chart: "stable/mysql", Version: "1.0.0", Verify: boolValue(true)},
+		},
+		logger: logger,
+	}
+
+	helm := &archiveFetchingHelmExec{mockHelmExec: &mockHelmExec{}}
+	if errs := state.PrepareCharts(helm, dir, 1, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	destination := filepath.Join(dir, "remote", "1.0.0", "archive")
+	if want := [][]string{{"--prov", "--destination", destination, "--version", "1.0.0"}}; !reflect.DeepEqual(helm.flags, want) {
+		t.Errorf("unexpected fetch flags: want %v, got %v", want, helm.flags)
+	}
+
+	// The archive is verified against the provenance file next to it, instead of the untarred chart
+	if want, got := filepath.Join(destination, "mysql-1.0.0.tgz"), state.chartFor(&state.Releases[0]); got != want {
+		t.Errorf("unexpected chart: want %s, got %s", want, got)
+	}
+}
+
+func TestHelmState_PrepareCharts_SkipDeps(t *testing.T) {
+	tests := []struct {
+		name        string
+		helmDefault bool
+		skipDeps    map[string]*bool
+		want        []string
+	}{
+		{name: "unset", want: []string{"/src/charts/app", "/src/charts/vendored"}},
+		{name: "release", skipDeps: map[string]*bool{"vendored": boolValue(true)}, want: []string{"/src/charts/app"}},
+		{name: "helmDefaults", helmDefault: true, want: nil},
+		{
+			name:        "release overrides helmDefaults",
+			helmDefault: true,
+			skipDeps:    map[string]*bool{"app": boolValue(false)},
+			want:        []string{"/src/charts/app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newState := func() *HelmState {
+				return &HelmState{
+					basePath:     "/src",
+					HelmDefaults: HelmSpec{SkipDeps: tt.helmDefault},
+					Releases: []ReleaseSpec{
+						{Name: "app", Chart: "./charts/app", SkipDeps: tt.skipDeps["app"]},
+						{Name: "vendored", Chart: "./charts/vendored", SkipDeps: tt.skipDeps["vendored"]},
+					},
+					logger: logger,
+				}
+			}
+
+			helm := &mockHelmExec{}
+			if errs := newState().PrepareCharts(helm, "/tmp/charts", 1, false); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if !reflect.DeepEqual(helm.charts, tt.want) {
+				t.Errorf("unexpected charts built by PrepareCharts: want %v, got %v", tt.want, helm.charts)
+			}
+
+			helm = &mockHelmExec{}
+			if errs := newState().BuildDeps(helm); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if !reflect.DeepEqual(helm.charts, tt.want) {
+				t.Errorf("unexpected charts built by BuildDeps: want %v, got %v", tt.want, helm.charts)
+			}
+		})
+	}
+}
+
+func TestHelmState_downloadChart_Cache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "helmfile-chart-cache-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	state := &HelmState{
+		basePath:      "/src",
+		ChartCacheDir: cacheDir,
+		Repositories: []RepositorySpec{
+			{Name: "stable", URL: "https://example.com/charts"},
+		},
+		logger: logger,
+	}
+
+	cached := &ReleaseSpec{Name: "a", Chart: "stable/mysql", Version: "1.0.0"}
+	sameChart := &ReleaseSpec{Name: "b", Chart: "stable/mysql", Version: "1.0.0"}
+	ranged := &ReleaseSpec{Name: "c", Chart: "stable/mysql", Version: "~1.0.0"}
+
+	helm := &mockHelmExec{}
+
+	want := filepath.Join(cacheDir, "https:%2F%2Fexample.com%2Fcharts", "mysql", "1.0.0")
+	for _, r := range []*ReleaseSpec{cached, sameChart} {
+		chartPath, err := state.downloadChart(helm, r, "/tmp/charts")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if chartPath != want {
+			t.Errorf("unexpected chart path for %s: want %s, got %s", r.Name, want, chartPath)
+		}
+	}
+
+	if want := []string{"stable/mysql"}; !reflect.DeepEqual(helm.fetched, want) {
+		t.Errorf("unexpected charts fetched: want %v, got %v", want, helm.fetched)
+	}
+
+	chartPath, err := state.downloadChart(helm, ranged, "/tmp/charts")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "/tmp/charts/c/~1.0.0/stable/mysql"; chartPath != want {
+		t.Errorf("unexpected chart path for a version range: want %s, got %s", want, chartPath)
+	}
+}
+
+func TestHelmState_Delete(t *testing.T) {
+	tests := []struct {
+		name            string
+		deleted         []mockRelease
+		wantErr         bool
+		desired         *bool
+		installed       bool
+		purge           bool
+		flags           string
+		tillerNamespace string
+		kubeContext     string
+		defKubeContext  string
+	}{
+		{
+			name:      "desired and installed (purge=false)",
+			wantErr:   false,
+			desired:   boolValue(true),
+			installed: true,
+			purge:     false,
+			deleted:   []mockRelease{{"releaseA", []string{}}},
+		},
+		{
+			name:      "desired(default) and installed (purge=false)",
+			wantErr:   false,
+			desired:   nil,
+			installed: true,
+			purge:     false,
+			deleted:   []mockRelease{{"releaseA", []string{}}},
+		},
+		{
+			name:      "desired(default) and installed (purge=false) but error",
+			wantErr:   true,
+			desired:   nil,
+			installed: true,
+			purge:     false,
+			deleted:   []mockRelease{{"releaseA", []string{}}},
+		},
+		{
+			name:      "desired and installed (purge=true)",
+			wantErr:   false,
+			desired:   boolValue(true),
+			installed: true,
+			purge:     true,
+			deleted:   []mockRelease{{"releaseA", []string{"--purge"}}},
+		},
+		{
+			name:      "desired but not installed (purge=false)",
+			wantErr:   false,
+			desired:   boolValue(true),
+			installed: false,
+			purge:     false,
+			deleted:   []mockRelease{},
+		},
+		{
+			name:      "desired but not installed (purge=true)",
+			wantErr:   false,
+			desired:   boolValue(true),
+			installed: false,
+			purge:     true,
+			deleted:   []mockRelease{},
+		},
+		{
+			name:      "installed but filtered (purge=false)",
+			wantErr:   false,
+			desired:   boolValue(false),
+			installed: true,
+			purge:     false,
+			deleted:   []mockRelease{},
+		},
+		{
+			name:      "installed but filtered (purge=true)",
+			wantErr:   false,
+			desired:   boolValue(false),
+			installed: true,
+			purge:     true,
+			deleted:   []mockRelease{},
+		},
+		{
+			name:      "not installed, and filtered (purge=false)",
+			wantErr:   false,
+			desired:   boolValue(false),
+			installed: false,
+			purge:     false,
+			deleted:   []mockRelease{},
+		},
+		{
+			name:      "not installed, and filtered (purge=true)",
+			wantErr:   false,
+			desired:   boolValue(false),
+			installed: false,
+			purge:     true,
+			deleted:   []mockRelease{},
+		},
+		{
+			name:            "with tiller args",
+			wantErr:         false,
+			desired:         nil,
+			installed:       true,
+			purge:           true,
+			tillerNamespace: "tillerns",
+			flags:           "--tiller-namespacetillerns",
+			deleted:         []mockRelease{{"releaseA", []string{"--purge", "--tiller-namespace", "tillerns"}}},
+		},
+		{
+			name:        "with kubecontext",
+			wantErr:     false,
+			desired:     nil,
+			installed:   true,
+			purge:       true,
+			kubeContext: "ctx",
+			flags:       "--kube-contextctx",
+			deleted:     []mockRelease{{"releaseA", []string{"--purge", "--kube-context", "ctx"}}},
+		},
+		{
+			name:           "with default kubecontext",
+			wantErr:        false,
+			desired:        nil,
+			installed:      true,
+			purge:          true,
+			defKubeContext: "defctx",
+			flags:          "--kube-contextdefctx",
+			deleted:        []mockRelease{{"releaseA", []string{"--purge", "--kube-context", "defctx"}}},
+		},
+		{
+			name:           "with non-default and default kubecontexts",
+			wantErr:        false,
+			desired:        nil,
+			installed:      true,
+			purge:          true,
+			kubeContext:    "ctx",
+			defKubeContext: "defctx",
+			flags:          "--kube-contextctx",
+			deleted:        []mockRelease{{"releaseA", []string{"--purge", "--kube-context", "ctx"}}},
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		f := func(t *testing.T) {
+			name := "releaseA"
+			if tt.wantErr {
+				name = "releaseA-error"
+			}
+			release := ReleaseSpec{
+				Name:            name,
+				Installed:       tt.desired,
+				TillerNamespace: tt.tillerNamespace,
+				KubeContext:     tt.kubeContext,
+			}
+			releases := []ReleaseSpec{
+				release,
+			}
+			state := &HelmState{
+				HelmDefaults: HelmSpec{
+					KubeContext: tt.defKubeContext,
+				},
+				Releases: releases,
+				logger:   logger,
+			}
+			helm := &mockHelmExec{
+				lists:   map[listKey]string{},
+				deleted: []mockRelease{},
+			}
+			if tt.installed {
+				helm.lists[listKey{filter: "^" + name + "$", flags: tt.flags}] = name
+			}
+			affectedReleases := AffectedReleases{}
+			errs := state.DeleteReleases(&affectedReleases, helm, 1, tt.purge)
+			if errs != nil {
 				if !tt.wantErr || len(affectedReleases.Failed) != 1 || affectedReleases.Failed[0].Name != release.Name {
 					t.Errorf("DeleteReleases() for %s error = %v, wantErr %v", tt.name, errs, tt.wantErr)
 					return
 				}
-			} else if !(reflect.DeepEqual(tt.deleted, helm.deleted) && (len(affectedReleases.Deleted) == len(tt.deleted))) {
-				t.Errorf("unexpected deletions happened: expected %v, got %v", tt.deleted, helm.deleted)
+			} else if !(reflect.DeepEqual(tt.deleted, helm.deleted) && (len(affectedReleases.Deleted) == len(tt.deleted))) {
+				t.Errorf("unexpected deletions happened: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+		}
+		t.Run(tt.name, f)
+	}
+}
+
+func TestHelmState_DeleteReleases_Batch(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		deleted  []mockRelease
+		failed   []string
+		wantErr  string
+	}{
+		{
+			name: "releases sharing the same kube context are deleted at once",
+			releases: []ReleaseSpec{
+				{Name: "a", KubeContext: "ctx1"},
+				{Name: "b", KubeContext: "ctx2"},
+				{Name: "c", KubeContext: "ctx1"},
+			},
+			deleted: []mockRelease{
+				{"a,c", []string{"--purge", "--kube-context", "ctx1"}},
+				{"b", []string{"--purge", "--kube-context", "ctx2"}},
+			},
+		},
+		{
+			name: "failed batch is retried one by one",
+			releases: []ReleaseSpec{
+				{Name: "a", KubeContext: "ctx1"},
+				{Name: "b-error", KubeContext: "ctx1"},
+			},
+			deleted: []mockRelease{
+				{"a", []string{"--purge", "--kube-context", "ctx1"}},
+			},
+			failed:  []string{"b-error"},
+			wantErr: `release "b-error" failed: error`,
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases: tt.releases,
+				logger:   logger,
+			}
+			helm := &mockHelmExec{
+				lists:   map[listKey]string{},
+				deleted: []mockRelease{},
+			}
+			for _, r := range tt.releases {
+				helm.lists[listKey{filter: "^" + r.Name + "$", flags: "--kube-context" + r.KubeContext}] = r.Name
+			}
+			affectedReleases := AffectedReleases{}
+			errs := state.DeleteReleases(&affectedReleases, helm, 1, true, &DeleteOpts{Batch: true})
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+			} else if len(errs) != 1 || errs[0].Error() != tt.wantErr {
+				t.Fatalf("unexpected errors: expected %q, got %v", tt.wantErr, errs)
+			}
+			if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+				t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+			var failed []string
+			for _, r := range affectedReleases.Failed {
+				failed = append(failed, r.Name)
+			}
+			if d := cmp.Diff(tt.failed, failed); d != "" {
+				t.Errorf("unexpected failed releases:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_SyncReleases_Batch(t *testing.T) {
+	tests := []struct {
+		name     string
+		releases []ReleaseSpec
+		deleted  []mockRelease
+		synced   []string
+		failed   []string
+		wantErr  string
+	}{
+		{
+			name: "releases with installed: false sharing the same kube context are deleted at once",
+			releases: []ReleaseSpec{
+				{Name: "a", Chart: "foo/a", KubeContext: "ctx1", Installed: boolValue(false)},
+				{Name: "b", Chart: "foo/b", KubeContext: "ctx2", Installed: boolValue(false)},
+				{Name: "c", Chart: "foo/c", KubeContext: "ctx1", Installed: boolValue(false)},
+				{Name: "d", Chart: "foo/d", KubeContext: "ctx1"},
+			},
+			deleted: []mockRelease{
+				{"a,c", []string{"--purge", "--kube-context", "ctx1"}},
+				{"b", []string{"--purge", "--kube-context", "ctx2"}},
+			},
+			synced: []string{"d"},
+		},
+		{
+			name: "failed batch is retried one by one",
+			releases: []ReleaseSpec{
+				{Name: "a", Chart: "foo/a", KubeContext: "ctx1", Installed: boolValue(false)},
+				{Name: "b-error", Chart: "foo/b", KubeContext: "ctx1", Installed: boolValue(false)},
+			},
+			deleted: []mockRelease{
+				{"a", []string{"--purge", "--kube-context", "ctx1"}},
+			},
+			failed:  []string{"b-error"},
+			wantErr: `failed processing release b-error: error`,
+		},
+	}
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases:    tt.releases,
+				logger:      logger,
+				valsRuntime: valsRuntime,
+			}
+			helm := &mockHelmExec{
+				lists:   map[listKey]string{},
+				deleted: []mockRelease{},
+			}
+			for _, r := range tt.releases {
+				helm.lists[listKey{filter: "^" + r.Name + "$", flags: "--kube-context" + r.KubeContext}] = r.Name
+			}
+			affectedReleases := AffectedReleases{}
+			errs := state.SyncReleases(&affectedReleases, helm, []string{}, 1, &SyncOpts{Batch: true})
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+			} else if len(errs) != 1 || errs[0].Error() != tt.wantErr {
+				t.Fatalf("unexpected errors: expected %q, got %v", tt.wantErr, errs)
+			}
+			if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+				t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+			var synced []string
+			for _, r := range helm.releases {
+				synced = append(synced, r.name)
+			}
+			if !reflect.DeepEqual(tt.synced, synced) {
+				t.Errorf("unexpected releases synced: expected %v, got %v", tt.synced, synced)
+			}
+			var failed []string
+			for _, r := range affectedReleases.Failed {
+				failed = append(failed, r.Name)
+			}
+			if !reflect.DeepEqual(tt.failed, failed) {
+				t.Errorf("unexpected failed releases: expected %v, got %v", tt.failed, failed)
+			}
+		})
+	}
+}
+
+func TestHelmState_DeleteReleases_SoftNeeds(t *testing.T) {
+	tests := []struct {
+		needs   string
+		deleted []mockRelease
+	}{
+		{needs: "?app", deleted: []mockRelease{{"app", []string{"--purge"}}}},
+		{needs: "app", deleted: []mockRelease{}},
+	}
+	for _, tt := range tests {
+		for _, batch := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s batch=%t", tt.needs, batch), func(t *testing.T) {
+				state := &HelmState{
+					Releases: []ReleaseSpec{
+						{Name: "app"},
+						{Name: "frontend-error", Needs: []string{tt.needs}},
+					},
+					logger: logger,
+				}
+				helm := &mockHelmExec{
+					lists: map[listKey]string{
+						{filter: "^app$"}:            "app",
+						{filter: "^frontend-error$"}: "frontend-error",
+					},
+					deleted: []mockRelease{},
+				}
+				errs := state.DeleteReleases(&AffectedReleases{}, helm, 1, true, &DeleteOpts{Batch: batch})
+				if len(errs) != 1 || errs[0].Error() != `release "frontend-error" failed: error` {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+					t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+				}
+			})
+		}
+	}
+}
+
+func TestHelmState_DeleteReleases_Group(t *testing.T) {
+	tests := []struct {
+		group   int
+		deleted []mockRelease
+		wantErr string
+	}{
+		{group: 0, deleted: []mockRelease{{"frontend", []string{"--purge"}}, {"backend", []string{"--purge"}}}},
+		{group: 1, deleted: []mockRelease{{"backend", []string{"--purge"}}}},
+		{group: 2, deleted: []mockRelease{{"frontend", []string{"--purge"}}}},
+		{group: 3, deleted: []mockRelease{}, wantErr: "group 3 is out of range: it must be between 1 and 2"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("group %d", tt.group), func(t *testing.T) {
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{Name: "backend"},
+					{Name: "frontend", Needs: []string{"backend"}},
+				},
+				logger: logger,
+			}
+			helm := &mockHelmExec{
+				lists: map[listKey]string{
+					{filter: "^backend$"}:  "backend",
+					{filter: "^frontend$"}: "frontend",
+				},
+				deleted: []mockRelease{},
+			}
+			errs := state.DeleteReleases(&AffectedReleases{}, helm, 1, true, &DeleteOpts{Group: tt.group})
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+			} else if len(errs) != 1 || errs[0].Error() != tt.wantErr {
+				t.Fatalf("unexpected errors: expected %q, got %v", tt.wantErr, errs)
+			}
+			if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+				t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+		})
+	}
+}
+
+func TestHelmState_DeleteReleases_KeepReleaseOrder(t *testing.T) {
+	tests := []struct {
+		keepOrder bool
+		deleted   []mockRelease
+	}{
+		{keepOrder: false, deleted: []mockRelease{{"b", []string{"--purge"}}, {"a", []string{"--purge"}}, {"c", []string{"--purge"}}}},
+		{keepOrder: true, deleted: []mockRelease{{"c", []string{"--purge"}}, {"b", []string{"--purge"}}, {"a", []string{"--purge"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("keepOrder=%t", tt.keepOrder), func(t *testing.T) {
+			// Sorted by `--reverse-sort-key priority` on loading, which deletes releases with lower priorities first
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{Name: "c"},
+					{Name: "b", Priority: 1},
+					{Name: "a", Priority: 1},
+				},
+				KeepReleaseOrder: tt.keepOrder,
+				logger:           logger,
+			}
+			helm := &mockHelmExec{
+				lists: map[listKey]string{
+					{filter: "^a$"}: "a",
+					{filter: "^b$"}: "b",
+					{filter: "^c$"}: "c",
+				},
+				deleted: []mockRelease{},
+			}
+			if errs := state.DeleteReleases(&AffectedReleases{}, helm, 1, true); len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+				t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+		})
+	}
+}
+
+func TestHelmState_DeleteReleases_ContinueOnError(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     *DeleteOpts
+		deleted  []mockRelease
+		wantErrs []string
+	}{
+		{
+			name:     "stop at the first failure",
+			opts:     &DeleteOpts{},
+			deleted:  []mockRelease{},
+			wantErrs: []string{`release "frontend-error" failed: error`},
+		},
+		{
+			name:    "continue on error",
+			opts:    &DeleteOpts{ContinueOnError: true},
+			deleted: []mockRelease{{"worker", []string{"--purge"}}, {"cache", []string{"--purge"}}},
+			wantErrs: []string{
+				`release "frontend-error" failed: error`,
+				`release "backend" skipped: "frontend-error" needing it failed or was skipped`,
+				`release "db" skipped: "backend" needing it failed or was skipped`,
+			},
+		},
+		{
+			name:    "continue on error in batches",
+			opts:    &DeleteOpts{ContinueOnError: true, Batch: true},
+			deleted: []mockRelease{{"worker", []string{"--purge"}}, {"cache", []string{"--purge"}}},
+			wantErrs: []string{
+				`release "frontend-error" failed: error`,
+				`release "backend" skipped: "frontend-error" needing it failed or was skipped`,
+				`release "db" skipped: "backend" needing it failed or was skipped`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{Name: "db"},
+					{Name: "cache"},
+					{Name: "backend", Needs: []string{"db"}},
+					{Name: "worker", Needs: []string{"cache"}},
+					{Name: "frontend-error", Needs: []string{"backend"}},
+				},
+				logger: logger,
+			}
+			helm := &mockHelmExec{
+				lists:   map[listKey]string{},
+				deleted: []mockRelease{},
+			}
+			for _, r := range state.Releases {
+				helm.lists[listKey{filter: "^" + r.Name + "$"}] = r.Name
+			}
+			errs := state.DeleteReleases(&AffectedReleases{}, helm, 1, true, tt.opts)
+			var actual []string
+			for _, err := range errs {
+				actual = append(actual, err.Error())
+			}
+			if d := cmp.Diff(tt.wantErrs, actual); d != "" {
+				t.Errorf("unexpected errors:\n%s", d)
+			}
+			if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+				t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+		})
+	}
+}
+
+func TestHelmState_dagAwareReverseIterateOnReleases_Eagerly(t *testing.T) {
+	var mu sync.Mutex
+	var finished []string
+	cacheDeleted := make(chan struct{})
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db"},
+			{Name: "slow", Needs: []string{"db"}},
+			{Name: "cache"},
+			{Name: "fast", Needs: []string{"cache"}},
+			{Name: "app", Needs: []string{"proxy"}},
+			{Name: "storage"},
+		},
+		filteredOutReleases: []ReleaseSpec{
+			{Name: "proxy", Needs: []string{"storage"}},
+		},
+		logger: logger,
+	}
+
+	// `slow` and `cache` are in different groups of the DAG, but `cache` is needed only by `fast`.
+	// `storage` is needed by `app` only via `proxy` filtered out by selectors, so it must still wait for `app`.
+	errs := state.dagAwareReverseIterateOnReleases(&mockHelmExec{}, 2, &DeleteOpts{}, func(r ReleaseSpec, _ int) error {
+		switch r.Name {
+		case "slow":
+			select {
+			case <-cacheDeleted:
+			case <-time.After(10 * time.Second):
+				return errors.New("cache was never deleted while deleting slow")
+			}
+		case "cache":
+			close(cacheDeleted)
+		case "app":
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		finished = append(finished, r.Name)
+
+		return nil
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	index := map[string]int{}
+	for i, name := range finished {
+		index[name] = i
+	}
+	if len(index) != len(state.Releases) {
+		t.Fatalf("unexpected releases processed: %v", finished)
+	}
+	for _, order := range [][2]string{{"fast", "cache"}, {"cache", "slow"}, {"slow", "db"}, {"app", "storage"}} {
+		if index[order[0]] > index[order[1]] {
+			t.Errorf("%q must be processed before %q: %v", order[0], order[1], finished)
+		}
+	}
+}
+
+func TestHelmState_DeleteReleases_StrictDependents(t *testing.T) {
+	no := false
+	tests := []struct {
+		name     string
+		opts     *DeleteOpts
+		deleted  []mockRelease
+		wantErrs []string
+		wantWarn string
+	}{
+		{
+			name:     "warn",
+			opts:     &DeleteOpts{},
+			deleted:  []mockRelease{{"db", []string{"--purge"}}},
+			wantWarn: `deleting "db" breaks "backend", "worker" needing it, which are not going to be deleted. run with --strict-dependents to make it an error`,
+		},
+		{
+			name:     "strict",
+			opts:     &DeleteOpts{StrictDependents: true},
+			deleted:  []mockRelease{},
+			wantErrs: []string{`deleting "db" breaks "backend", "worker" needing it, which are not going to be deleted`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{Name: "db"},
+				},
+				filteredOutReleases: []ReleaseSpec{
+					{Name: "backend", Needs: []string{"db"}},
+					{Name: "worker", Needs: []string{"db"}},
+					{Name: "cache", Needs: []string{"?db"}},
+					{Name: "legacy", Needs: []string{"db"}, Installed: &no},
+				},
+				logger: zap.New(core).Sugar(),
+			}
+			helm := &mockHelmExec{
+				lists: map[listKey]string{
+					{filter: "^db$"}: "db",
+				},
+				deleted: []mockRelease{},
+			}
+			errs := state.DeleteReleases(&AffectedReleases{}, helm, 1, true, tt.opts)
+			var actual []string
+			for _, err := range errs {
+				actual = append(actual, err.Error())
+			}
+			if d := cmp.Diff(tt.wantErrs, actual); d != "" {
+				t.Errorf("unexpected errors:\n%s", d)
+			}
+			if !reflect.DeepEqual(tt.deleted, helm.deleted) {
+				t.Errorf("unexpected deletions: expected %v, got %v", tt.deleted, helm.deleted)
+			}
+			var warns []string
+			for _, e := range logs.All() {
+				warns = append(warns, e.Message)
+			}
+			var wantWarns []string
+			if tt.wantWarn != "" {
+				wantWarns = []string{tt.wantWarn}
+			}
+			if d := cmp.Diff(wantWarns, warns); d != "" {
+				t.Errorf("unexpected warnings:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_PreviewApply(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "new", Chart: "stable/new"},
+			{Name: "existing", Chart: "stable/existing"},
+			{Name: "same", Chart: "stable/same"},
+			{Name: "removed", Chart: "stable/removed", Installed: boolValue(false)},
+			{Name: "gone", Chart: "stable/gone", Installed: boolValue(false)},
+		},
+		logger: logger,
+	}
+
+	helm := &concurrencyRecordingHelmExec{mockHelmExec: &mockHelmExec{lists: map[listKey]string{}}}
+	for _, name := range []string{"existing", "same", "removed"} {
+		helm.lists[listKey{filter: "^" + name + "$"}] = name
+	}
+
+	summary := &DiffSummary{
+		Changed: []ReleaseDiff{
+			{ReleaseSpec: &state.Releases[0], Changes: 2},
+			{ReleaseSpec: &state.Releases[1], Changes: 1},
+		},
+		Unchanged: []*ReleaseSpec{&state.Releases[2]},
+	}
+
+	preview, err := state.PreviewApply(helm, summary, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := func(rs []*ReleaseSpec) []string {
+		var names []string
+		for _, r := range rs {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+	diffNames := func(ds []ReleaseDiff) []string {
+		var rs []*ReleaseSpec
+		for _, d := range ds {
+			rs = append(rs, d.ReleaseSpec)
+		}
+		return names(rs)
+	}
+
+	if got := diffNames(preview.Installed); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("unexpected releases to be installed: %v", got)
+	}
+	if got := diffNames(preview.Upgraded); !reflect.DeepEqual(got, []string{"existing"}) {
+		t.Errorf("unexpected releases to be upgraded: %v", got)
+	}
+	// Releases with `installed: false` that are not installed have nothing to be uninstalled
+	if got := names(preview.Uninstalled); !reflect.DeepEqual(got, []string{"removed"}) {
+		t.Errorf("unexpected releases to be uninstalled: %v", got)
+	}
+	if got := names(preview.Unchanged); !reflect.DeepEqual(got, []string{"same"}) {
+		t.Errorf("unexpected releases unchanged: %v", got)
+	}
+	// The changed releases and the ones with `installed: false` are listed concurrently
+	if helm.peak != 2 {
+		t.Errorf("unexpected number of concurrent `helm list`s: expected 2, got %d", helm.peak)
+	}
+
+	var affected []string
+	for _, r := range preview.Affected(state.Releases) {
+		affected = append(affected, r.Name)
+	}
+	if want := []string{"new", "existing", "removed"}; !reflect.DeepEqual(affected, want) {
+		t.Errorf("unexpected affected releases: want %v, got %v", want, affected)
+	}
+}
+
+func TestHelmState_SelectAffectedReleases(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "stable/db"},
+			{Name: "app", Chart: "stable/app", Needs: Needs{"db"}},
+			{Name: "web", Chart: "stable/web", Needs: Needs{"app"}},
+			{Name: "worker", Chart: "stable/worker", Needs: Needs{"web"}},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+
+	preview := &ApplyPreview{
+		Installed: []ReleaseDiff{{ReleaseSpec: &state.Releases[3], Changes: 1}},
+		Upgraded:  []ReleaseDiff{{ReleaseSpec: &state.Releases[1], Changes: 2}},
+		Unchanged: []*ReleaseSpec{&state.Releases[0], &state.Releases[2]},
+	}
+
+	state.SelectAffectedReleases(preview)
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// The unchanged releases are never synced, while worker still waits for app via the unchanged web
+	var synced []string
+	for _, r := range helm.releases {
+		synced = append(synced, r.name)
+	}
+	if want := []string{"app", "worker"}; !reflect.DeepEqual(synced, want) {
+		t.Errorf("unexpected synced releases: want %v, got %v", want, synced)
+	}
+
+	groups, err := state.PlanReleases(nil, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Errorf("unexpected plan: app and worker must be in different groups: %v", groups)
+	}
+}
+
+func TestHelmState_Build(t *testing.T) {
+	state := &HelmState{
+		FilePath: "helmfile.yaml",
+		DefaultValues: []interface{}{
+			"values.yaml",
+		},
+		Env: environment.Environment{
+			Name: "prod",
+			Values: map[string]interface{}{
+				"zone": "b",
+				"db": map[string]interface{}{
+					"replicas": 3,
+				},
+			},
+			Defaults: map[string]interface{}{
+				"zone": "a",
+				"app":  "myapp",
+			},
+		},
+		Releases: []ReleaseSpec{
+			{
+				Name:  "foo",
+				Chart: "charts/foo",
+				Labels: map[string]string{
+					"tier": "backend",
+					"app":  "foo",
+				},
+			},
+			{
+				Name:  "bar",
+				Chart: "charts/bar",
+			},
+		},
+	}
+
+	expected := `filepath: helmfile.yaml
+values:
+- app: myapp
+  db:
+    replicas: 3
+  zone: b
+releases:
+- chart: charts/foo
+  name: foo
+  labels:
+    app: foo
+    tier: backend
+- chart: charts/bar
+  name: bar
+templates: {}
+`
+
+	for i := 0; i < 3; i++ {
+		actual, err := state.Build()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if d := cmp.Diff(expected, actual); d != "" {
+			t.Errorf("unexpected result: want (-), got (+):\n%s", d)
+		}
+	}
+}
+
+func TestHelmState_iterateOnReleases_RecoversFromPanic(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "foo"},
+			{Name: "bar"},
+			{Name: "baz"},
+		},
+		logger: logger,
+	}
+
+	processed := []string{}
+	mut := &sync.Mutex{}
+
+	errs := state.scatterGatherReleases(&mockHelmExec{}, 1, func(release ReleaseSpec, workerIndex int) error {
+		if release.Name == "bar" {
+			var m map[string]string
+			m["a"] = "b"
+		}
+		mut.Lock()
+		processed = append(processed, release.Name)
+		mut.Unlock()
+		return nil
+	})
+
+	if len(errs) != 1 {
+		t.Fatalf("unexpected number of errors: expected 1, got %d: %v", len(errs), errs)
+	}
+	if expected := `release "bar" failed: panic: assignment to entry in nil map`; errs[0].Error() != expected {
+		t.Errorf("unexpected error: expected=%s, got=%s", expected, errs[0].Error())
+	}
+	if expected := []string{"foo", "baz"}; !reflect.DeepEqual(processed, expected) {
+		t.Errorf("unexpected processed releases: expected=%v, got=%v", expected, processed)
+	}
+}
+
+func TestHelmState_scatterGather_NoItems(t *testing.T) {
+	state := &HelmState{
+		logger: logger,
+	}
+
+	called := false
+	state.scatterGather(0, 0,
+		func() { called = true },
+		func(int) { called = true },
+		func() { called = true },
+	)
+	if called {
+		t.Error("unexpected call with no items")
+	}
+}
+
+func TestHelmState_scatterGather_DefaultConcurrency(t *testing.T) {
+	tests := []struct {
+		defaultConcurrency int
+		concurrency        int
+		expected           int
+	}{
+		{defaultConcurrency: 0, concurrency: 0, expected: 5},
+		{defaultConcurrency: 2, concurrency: 0, expected: 2},
+		{defaultConcurrency: 2, concurrency: 3, expected: 3},
+		{defaultConcurrency: 8, concurrency: 0, expected: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("defaultConcurrency=%d,concurrency=%d", tt.defaultConcurrency, tt.concurrency), func(t *testing.T) {
+			state := &HelmState{
+				DefaultConcurrency: tt.defaultConcurrency,
+				logger:             logger,
+			}
+
+			var mu sync.Mutex
+			workers := 0
+			state.scatterGather(tt.concurrency, 5,
+				func() {},
+				func(int) {
+					mu.Lock()
+					workers++
+					mu.Unlock()
+				},
+				func() {},
+			)
+			if workers != tt.expected {
+				t.Errorf("unexpected number of workers: expected=%d, got=%d", tt.expected, workers)
+			}
+		})
+	}
+}
+
+func TestHelmState_iterateOnReleases_MaxConcurrency(t *testing.T) {
+	var releases []ReleaseSpec
+	for i := 0; i < 300; i++ {
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("release%d", i)})
+	}
+
+	state := &HelmState{
+		Releases:       releases,
+		MaxConcurrency: 10,
+		logger:         logger,
+	}
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	errs := state.iterateOnReleases(nil, 0, releases, func(r ReleaseSpec, workerIndex int) error {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if peak > 10 {
+		t.Errorf("unexpected number of concurrent releases: expected at most 10, got %d", peak)
+	}
+}
+
+func TestHelmState_iterateOnReleases_MaxConcurrencyPerNamespace(t *testing.T) {
+	var releases []ReleaseSpec
+	for i := 0; i < 20; i++ {
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("foo%d", i), Namespace: "foo"})
+		// The rest are installed into the helmfile's namespace
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("bar%d", i)})
+	}
+
+	state := &HelmState{
+		Namespace:                  "bar",
+		Releases:                   releases,
+		MaxConcurrencyPerNamespace: 2,
+		logger:                     logger,
+	}
+
+	var mu sync.Mutex
+	running, peak := map[string]int{}, map[string]int{}
+	total, totalPeak := 0, 0
+	errs := state.iterateOnReleases(nil, 0, releases, func(r ReleaseSpec, workerIndex int) error {
+		ns := state.ReleaseNamespace(&r)
+
+		mu.Lock()
+		running[ns]++
+		total++
+		if running[ns] > peak[ns] {
+			peak[ns] = running[ns]
+		}
+		if total > totalPeak {
+			totalPeak = total
+		}
+		mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mu.Lock()
+		running[ns]--
+		total--
+		mu.Unlock()
+		return nil
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	for _, ns := range []string{"foo", "bar"} {
+		if peak[ns] < 1 || peak[ns] > 2 {
+			t.Errorf("unexpected number of concurrent releases in namespace %s: expected at most 2, got %d", ns, peak[ns])
+		}
+	}
+
+	if totalPeak <= 2 {
+		t.Errorf("unexpected number of concurrent releases: expected releases in different namespaces to run at once, got at most %d", totalPeak)
+	}
+}
+
+func TestHelmState_iterateOnReleases_MaxConcurrencyPerNamespace_NoStarvation(t *testing.T) {
+	for _, orderedDispatch := range []bool{false, true} {
+		t.Run(fmt.Sprintf("orderedDispatch=%t", orderedDispatch), func(t *testing.T) {
+			var releases []ReleaseSpec
+			for i := 0; i < 5; i++ {
+				releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("foo%d", i), Namespace: "foo"})
+			}
+			releases = append(releases, ReleaseSpec{Name: "bar0", Namespace: "bar"})
+
+			state := &HelmState{
+				Releases:                   releases,
+				MaxConcurrencyPerNamespace: 1,
+				OrderedDispatch:            orderedDispatch,
+				logger:                     logger,
+			}
+
+			var mu sync.Mutex
+			var started []string
+			errs := state.iterateOnReleases(nil, 2, releases, func(r ReleaseSpec, workerIndex int) error {
+				mu.Lock()
+				started = append(started, r.Name)
+				mu.Unlock()
+
+				time.Sleep(5 * time.Millisecond)
+				return nil
+			})
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			// bar0 is dispatched to the idle worker while foo0 holds the only slot of foo, instead of after all the foo releases
+			if len(started) != 6 || !(started[0] == "foo0" && started[1] == "bar0" || started[0] == "bar0" && started[1] == "foo0") {
+				t.Errorf("unexpected order of releases started: %v", started)
+			}
+		})
+	}
+}
+
+// startRecordingHelmExec records the releases in the order their syncs started, each of which takes a while
+type startRecordingHelmExec struct {
+	*mockHelmExec
+	mu      sync.Mutex
+	started []string
+}
+
+func (helm *startRecordingHelmExec) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	helm.mu.Lock()
+	helm.started = append(helm.started, name)
+	helm.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	helm.mu.Lock()
+	defer helm.mu.Unlock()
+	return helm.mockHelmExec.SyncRelease(context, name, chart, flags...)
+}
+
+func TestHelmState_SyncReleases_MaxConcurrencyPerNamespace_NoStarvation(t *testing.T) {
+	var releases []ReleaseSpec
+	for i := 0; i < 5; i++ {
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("foo%d", i), Chart: "stable/app", Namespace: "foo"})
+	}
+	releases = append(releases, ReleaseSpec{Name: "bar0", Chart: "stable/app", Namespace: "bar"})
+
+	state := &HelmState{
+		Releases:                   releases,
+		MaxConcurrencyPerNamespace: 1,
+		OrderedDispatch:            true,
+		logger:                     logger,
+		valsRuntime:                valsRuntime,
+	}
+
+	helm := &startRecordingHelmExec{mockHelmExec: &mockHelmExec{}}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 2); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// bar0 is dispatched to the idle worker while the first foo release holds the only slot of foo, instead of after all the foo releases
+	if len(helm.started) != 6 || helm.started[0] != "bar0" && helm.started[1] != "bar0" {
+		t.Errorf("unexpected order of releases started: %v", helm.started)
+	}
+}
+
+func TestHelmState_iterateOnReleases_OrderedDispatch(t *testing.T) {
+	var releases []ReleaseSpec
+	var expected []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("release%d", i)
+		releases = append(releases, ReleaseSpec{Name: name})
+		expected = append(expected, name)
+	}
+
+	var mu sync.Mutex
+	var started []string
+
+	state := &HelmState{
+		Releases:        releases,
+		OrderedDispatch: true,
+		// BeforeRelease of each release is called before the previous release is started, and so records the dispatch order
+		BeforeRelease: func(r ReleaseSpec) error {
+			mu.Lock()
+			started = append(started, r.Name)
+			mu.Unlock()
+			return nil
+		},
+		logger: logger,
+	}
+
+	errs := state.iterateOnReleases(nil, 4, releases, func(r ReleaseSpec, workerIndex int) error {
+		// Vary the durations so that workers become free in an order different from the order of declaration
+		time.Sleep(time.Duration(len(r.Name)%3) * time.Millisecond)
+		return nil
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if d := cmp.Diff(expected, started); d != "" {
+		t.Errorf("unexpected dispatch order:\n%s", d)
+	}
+}
+
+func TestHelmState_iterateOnReleasesUntil_Abort(t *testing.T) {
+	var releases []ReleaseSpec
+	for i := 0; i < 100; i++ {
+		releases = append(releases, ReleaseSpec{Name: fmt.Sprintf("release%d", i), Namespace: fmt.Sprintf("ns%d", i%2)})
+	}
+
+	tests := []struct {
+		name  string
+		state *HelmState
+	}{
+		{
+			name:  "default",
+			state: &HelmState{Releases: releases, logger: logger},
+		},
+		{
+			name:  "max concurrency per namespace",
+			state: &HelmState{Releases: releases, MaxConcurrencyPerNamespace: 1, logger: logger},
+		},
+		{
+			name:  "ordered dispatch",
+			state: &HelmState{Releases: releases, OrderedDispatch: true, logger: logger},
+		},
+	}
+
+	for i := range tests {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			processed := 0
+			returned := make(chan []error)
+			go func() {
+				returned <- tt.state.iterateOnReleasesUntil(nil, 2, releases, func(r ReleaseSpec, workerIndex int) error {
+					mu.Lock()
+					processed++
+					mu.Unlock()
+					if r.Name == "release0" {
+						return fmt.Errorf("failed")
+					}
+					time.Sleep(time.Millisecond)
+					return nil
+				}, func(errs []error) bool {
+					return len(errs) > 0
+				})
+			}()
+
+			var errs []error
+			select {
+			case errs = <-returned:
+			case <-time.After(10 * time.Second):
+				t.Fatal("iterateOnReleasesUntil did not return after aborting")
+			}
+
+			if len(errs) != 1 || errs[0].Error() != `release "release0" failed: failed` {
+				t.Errorf("unexpected errors: %v", errs)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if processed >= len(releases) {
+				t.Errorf("unexpected number of processed releases: expected less than %d, got %d", len(releases), processed)
+			}
+		})
+	}
+}
+
+// stallingWriter discards log entries, but stalls on the first entry containing the substring like a slow progress rendering would
+type stallingWriter struct {
+	substr string
+	stall  time.Duration
+	once   sync.Once
+}
+
+func (w *stallingWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), w.substr) {
+		w.once.Do(func() { time.Sleep(w.stall) })
+	}
+	return len(p), nil
+}
+
+func BenchmarkHelmState_iterateOnReleases_SlowAggregation(b *testing.B) {
+	releases := make([]ReleaseSpec, 64)
+	for i := range releases {
+		releases[i] = ReleaseSpec{Name: fmt.Sprintf("release%d", i)}
+	}
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				state := &HelmState{
+					Releases: releases,
+					logger:   helmexec.NewLogger(&stallingWriter{substr: "receiving result 0", stall: 20 * time.Millisecond}, "debug"),
+				}
+				errs := state.scatterGatherReleases(&mockHelmExec{}, concurrency, func(_ ReleaseSpec, _ int) error {
+					time.Sleep(time.Millisecond)
+					return nil
+				})
+				if len(errs) > 0 {
+					b.Fatalf("unexpected errors: %v", errs)
+				}
+			}
+		})
+	}
+}
+
+func TestHelmState_EmptyReleases(t *testing.T) {
+	state := &HelmState{
+		logger:      logger,
+		valsRuntime: valsRuntime,
+	}
+	helm := &mockHelmExec{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 0); len(errs) > 0 {
+			t.Errorf("unexpected errors from SyncReleases: %v", errs)
+		}
+		if errs := state.DeleteReleases(&AffectedReleases{}, helm, 0, true); len(errs) > 0 {
+			t.Errorf("unexpected errors from DeleteReleases: %v", errs)
+		}
+		if errs := state.ReleaseStatuses(helm, 0); len(errs) > 0 {
+			t.Errorf("unexpected errors from ReleaseStatuses: %v", errs)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out processing no releases")
+	}
+}
+
+func TestHelmState_iterateOnReleases_SourceFile(t *testing.T) {
+	state := &HelmState{
+		logger: logger,
+	}
+
+	releases := []ReleaseSpec{
+		{Name: "foo", SourceFile: "sub/app.yaml"},
+		{Name: "bar"},
+	}
+
+	errs := state.iterateOnReleases(nil, 1, releases, func(release ReleaseSpec, workerIndex int) error {
+		return errors.New("error")
+	})
+
+	var actual []string
+	for _, err := range errs {
+		actual = append(actual, err.Error())
+	}
+
+	expected := []string{`release "foo" (from sub/app.yaml) failed: error`, `release "bar" failed: error`}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("unexpected errors: expected=%v, got=%v", expected, actual)
+	}
+}
+
+func TestHelmState_iterateOnReleases_WorkerLogger(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "foo"},
+			{Name: "bar"},
+		},
+		logger: zap.New(core).Sugar(),
+	}
+
+	errs := state.scatterGatherReleases(&mockHelmExec{}, 2, func(release ReleaseSpec, workerIndex int) error {
+		state.workerLogger(workerIndex).Infof("processing %s", release.Name)
+		return nil
+	})
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	entries := logs.FilterMessageSnippet("processing ").All()
+	if len(entries) != 2 {
+		t.Fatalf("unexpected number of log entries: expected 2, got %d", len(entries))
+	}
+	for _, e := range entries {
+		worker, ok := e.ContextMap()["worker"]
+		if !ok {
+			t.Errorf("log entry %q is not tagged with the worker", e.Message)
+		} else if w := worker.(int64); w < 1 || w > 2 {
+			t.Errorf("unexpected worker of log entry %q: %d", e.Message, w)
+		}
+	}
+}
+
+func TestHelmState_TransitiveNeeds(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "default", Needs: []string{"default/servicemesh", "?monitoring/prometheus"}},
+			{Name: "servicemesh", Namespace: "default", Needs: []string{"logging/fluentd"}},
+			{Name: "prometheus", Namespace: "monitoring", Needs: []string{"logging/fluentd"}},
+			{Name: "fluentd", Namespace: "logging"},
+			{Name: "a", Needs: []string{"b"}},
+			{Name: "b", Needs: []string{"a"}},
+		},
+		logger: logger,
+	}
+
+	tests := []struct {
+		id       string
+		expected []string
+	}{
+		{id: "default/app", expected: []string{"default/servicemesh", "monitoring/prometheus", "logging/fluentd"}},
+		{id: "logging/fluentd", expected: nil},
+		{id: "a", expected: []string{"b"}},
+		{id: "nonexistent", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if d := cmp.Diff(tt.expected, state.TransitiveNeeds(tt.id)); d != "" {
+				t.Errorf("unexpected transitive needs:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_TransitiveDependents(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db"},
+			{Name: "app", Needs: []string{"db"}},
+			{Name: "worker", Needs: []string{"app", "?db"}},
+			{Name: "cache"},
+			{Name: "api", Namespace: "web", Needs: []string{"app", "worker"}},
+			{Name: "gateway", Namespace: "web", Needs: []string{"worker", "web/api"}},
+			{Name: "a", Needs: []string{"b"}},
+			{Name: "b", Needs: []string{"a"}},
+			{Name: "c", Needs: []string{"a"}},
+		},
+	}
+
+	tests := []struct {
+		id       string
+		expected []string
+	}{
+		{id: "db", expected: []string{"app", "worker", "web/api", "web/gateway"}},
+		{id: "app", expected: []string{"worker", "web/api", "web/gateway"}},
+		{id: "web/api", expected: []string{"web/gateway"}},
+		{id: "cache", expected: nil},
+		{id: "a", expected: []string{"b", "c"}},
+		{id: "b", expected: []string{"a", "c"}},
+		{id: "nonexistent", expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if d := cmp.Diff(tt.expected, state.TransitiveDependents(tt.id)); d != "" {
+				t.Errorf("unexpected transitive dependents:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_SelectChangedReleases(t *testing.T) {
+	files := map[string]string{
+		"/path/to/db.yaml":    `size: 1`,
+		"/path/to/cache.yaml": `size: 1`,
+	}
+
+	newState := func() *HelmState {
+		st := &HelmState{
+			basePath: "/path/to",
+			FilePath: "/path/to/helmfile.yaml",
+			Releases: []ReleaseSpec{
+				{Name: "db", Chart: "stable/db", Values: []interface{}{"db.yaml"}},
+				{Name: "app", Chart: "stable/app", Needs: []string{"db"}},
+				{Name: "worker", Chart: "stable/worker", Needs: []string{"app"}},
+				{Name: "cache", Chart: "stable/cache", Values: []interface{}{"cache.yaml"}},
+			},
+			logger: logger,
+		}
+		return injectFs(st, testhelper.NewTestFs(files))
+	}
+
+	first := newState()
+	hashes, err := first.SelectChangedReleases(ReleaseHashes{}, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(first.Releases) != 4 || len(hashes) != 4 {
+		t.Fatalf("all the releases must be selected on the first run: releases=%v, hashes=%v", first.Releases, hashes)
+	}
+
+	files["/path/to/db.yaml"] = `size: 2`
+
+	second := newState()
+	changed, err := second.SelectChangedReleases(hashes, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var actual []string
+	for _, r := range second.Releases {
+		actual = append(actual, r.Name)
+	}
+	if d := cmp.Diff([]string{"db", "app", "worker"}, actual); d != "" {
+		t.Errorf("unexpected releases:\n%s", d)
+	}
+	if changed["db"] == hashes["db"] || changed["app"] != hashes["app"] || len(changed) != 3 {
+		t.Errorf("unexpected hashes: previous=%v, current=%v", hashes, changed)
+	}
+	if len(second.filteredOutReleases) != 1 || second.filteredOutReleases[0].Name != "cache" {
+		t.Errorf("unexpected unchanged releases: %v", second.filteredOutReleases)
+	}
+
+	third := newState()
+	if _, err := third.SelectChangedReleases(hashes, nil, []string{"foo=bar"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(third.Releases) != 4 {
+		t.Errorf("all the releases must be selected when --set changed: %v", third.Releases)
+	}
+}
+
+func TestHelmState_ReleaseInputsHash(t *testing.T) {
+	type input struct {
+		release ReleaseSpec
+		files   map[string]string
+		env     map[string]interface{}
+		set     []string
+	}
+
+	newInput := func() input {
+		return input{
+			release: ReleaseSpec{
+				Name:    "app",
+				Chart:   "stable/app",
+				Version: "1.0.0",
+				Values: []interface{}{
+					"values.yaml",
+					"values.yaml.gotmpl",
+					map[interface{}]interface{}{"a": 1, "b": 2, "c": map[interface{}]interface{}{"d": 3, "e": 4}},
+				},
+				Secrets: []string{"secrets.yaml"},
+			},
+			files: map[string]string{
+				"/path/to/values.yaml":        "replicas: 1\nimage: app\n",
+				"/path/to/values.yaml.gotmpl": "zone: {{ .Values.zone }}\n",
+				"/path/to/secrets.yaml":       "password: ENC[abc]\n",
+			},
+			env: map[string]interface{}{"zone": "a"},
+		}
+	}
+
+	hash := func(in input) string {
+		st := injectFs(&HelmState{
+			basePath: "/path/to",
+			FilePath: "/path/to/helmfile.yaml",
+			Env:      environment.Environment{Name: "default", Values: in.env},
+			Releases: []ReleaseSpec{in.release},
+			logger:   logger,
+		}, testhelper.NewTestFs(in.files))
+
+		hashes, err := st.ReleaseInputsHashes(nil, in.set)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return hashes["app"]
+	}
+
+	base := hash(newInput())
+
+	t.Run("stable", func(t *testing.T) {
+		// Maps are iterated in random orders, so hashing repeatedly catches non-canonical serializations
+		for i := 0; i < 10; i++ {
+			if h := hash(newInput()); h != base {
+				t.Fatalf("unexpected hash: expected=%s, got=%s", base, h)
+			}
+		}
+	})
+
+	t.Run("reformatted values file", func(t *testing.T) {
+		in := newInput()
+		in.files["/path/to/values.yaml"] = "# the image\nimage:   app\nreplicas: 1\n"
+		if h := hash(in); h != base {
+			t.Errorf("unexpected hash: expected=%s, got=%s", base, h)
+		}
+	})
+
+	changes := []struct {
+		name   string
+		change func(*input)
+	}{
+		{name: "chart", change: func(in *input) { in.release.Chart = "stable/other" }},
+		{name: "version", change: func(in *input) { in.release.Version = "1.0.1" }},
+		{name: "inline values", change: func(in *input) {
+			in.release.Values[2] = map[interface{}]interface{}{"a": 1, "b": 2, "c": map[interface{}]interface{}{"d": 3, "e": 5}}
+		}},
+		{name: "values file", change: func(in *input) { in.files["/path/to/values.yaml"] = "replicas: 2\nimage: app\n" }},
+		{name: "environment values rendered into values file", change: func(in *input) { in.env["zone"] = "b" }},
+		{name: "secrets file", change: func(in *input) { in.files["/path/to/secrets.yaml"] = "password: ENC[def]\n" }},
+		{name: "missing values file", change: func(in *input) { delete(in.files, "/path/to/values.yaml") }},
+		{name: "set", change: func(in *input) { in.set = []string{"replicas=2"} }},
+	}
+
+	for _, c := range changes {
+		t.Run(c.name, func(t *testing.T) {
+			in := newInput()
+			c.change(&in)
+			if h := hash(in); h == base {
+				t.Errorf("hash must change when %s changes", c.name)
+			}
+		})
+	}
+}
+
+func TestHelmState_SaveReleaseHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmfile-hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &HelmState{
+		basePath: dir,
+		FilePath: "helmfile.yaml",
+		readFile: ioutil.ReadFile,
+		fileExists: func(path string) (bool, error) {
+			_, err := os.Stat(path)
+			return err == nil, nil
+		},
+	}
+
+	loaded, err := st.LoadReleaseHashes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(loaded) != 0 {
+		t.Errorf("unexpected hashes without a record: %v", loaded)
+	}
+
+	hashes := ReleaseHashes{"default/app": "abc"}
+	if err := st.SaveReleaseHashes(hashes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "helmfile.hashes")); err != nil {
+		t.Errorf("hashes must be recorded in helmfile.hashes: %v", err)
+	}
+
+	loaded, err = st.LoadReleaseHashes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := cmp.Diff(hashes, loaded); d != "" {
+		t.Errorf("unexpected hashes:\n%s", d)
+	}
+}
+
+// failingHelmExec fails syncing the releases in fail
+type failingHelmExec struct {
+	*mockHelmExec
+	fail map[string]bool
+}
+
+func (helm *failingHelmExec) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	if helm.fail[name] {
+		return errors.New("error")
+	}
+	return helm.mockHelmExec.SyncRelease(context, name, chart, flags...)
+}
+
+func TestHelmState_SelectUnfinishedReleases(t *testing.T) {
+	files := map[string]string{
+		"/path/to/db.yaml": `size: 1`,
+	}
+
+	newState := func() *HelmState {
+		st := &HelmState{
+			basePath: "/path/to",
+			FilePath: "/path/to/helmfile.yaml",
+			Releases: []ReleaseSpec{
+				{Name: "db", Chart: "stable/db", Values: []interface{}{"db.yaml"}},
+				{Name: "cache", Chart: "stable/cache"},
+				{Name: "app", Chart: "stable/app", Needs: []string{"db"}},
+				{Name: "worker", Chart: "stable/worker", Needs: []string{"app"}},
+			},
+			logger:      logger,
+			valsRuntime: valsRuntime,
+		}
+		return injectFs(st, testhelper.NewTestFs(files))
+	}
+
+	names := func(releases []mockRelease) []string {
+		var names []string
+		for _, r := range releases {
+			names = append(names, r.name)
+		}
+		return names
+	}
+
+	// The first run fails at app, after syncing db and cache in the first group
+	first := newState()
+	progress, err := first.SelectUnfinishedReleases(nil, "sync", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(first.Releases) != 4 {
+		t.Fatalf("all the releases must be selected without progress: %v", first.Releases)
+	}
+
+	helm := &failingHelmExec{mockHelmExec: &mockHelmExec{}, fail: map[string]bool{"app": true}}
+	affected := AffectedReleases{}
+	if errs := first.SyncReleases(&affected, helm, nil, 1); len(errs) == 0 {
+		t.Fatalf("expected the first run to fail")
+	}
+	progress.Record(&affected)
+
+	if d := cmp.Diff([]string{"cache", "db"}, progress.Succeeded); d != "" {
+		t.Fatalf("unexpected succeeded releases:\n%s", d)
+	}
+
+	// The resumed run starts from the failed group
+	second := newState()
+	resumed, err := second.SelectUnfinishedReleases(progress, "sync", nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := cmp.Diff(progress.Succeeded, resumed.Succeeded); d != "" {
+		t.Errorf("succeeded releases must be carried over:\n%s", d)
+	}
+
+	helm = &failingHelmExec{mockHelmExec: &mockHelmExec{}}
+	if errs := second.SyncReleases(&AffectedReleases{}, helm, nil, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if d := cmp.Diff([]string{"app", "worker"}, names(helm.releases)); d != "" {
+		t.Errorf("unexpected synced releases:\n%s", d)
+	}
+
+	// The progress is ignored when recorded by another command
+	third := newState()
+	if _, err := third.SelectUnfinishedReleases(progress, "apply", nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(third.Releases) != 4 {
+		t.Errorf("all the releases must be selected for another command: %v", third.Releases)
+	}
+
+	// The progress is invalidated when the helmfile changed since the failed run
+	files["/path/to/db.yaml"] = `size: 2`
+
+	fourth := newState()
+	if _, err := fourth.SelectUnfinishedReleases(progress, "sync", nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fourth.Releases) != 4 {
+		t.Errorf("all the releases must be selected when the helmfile changed: %v", fourth.Releases)
+	}
+}
+
+func TestHelmState_SaveRunProgress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helmfile-progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st := &HelmState{
+		basePath: dir,
+		FilePath: "helmfile.yaml",
+		readFile: ioutil.ReadFile,
+		fileExists: func(path string) (bool, error) {
+			_, err := os.Stat(path)
+			return err == nil, nil
+		},
+	}
+
+	loaded, err := st.LoadRunProgress()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded != nil {
+		t.Errorf("unexpected progress without a record: %v", loaded)
+	}
+
+	progress := &RunProgress{Command: "sync", Hashes: ReleaseHashes{"default/app": "abc"}, Succeeded: []string{"default/app"}}
+	if err := st.SaveRunProgress(progress); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "helmfile.progress")); err != nil {
+		t.Errorf("progress must be recorded in helmfile.progress: %v", err)
+	}
+
+	loaded, err = st.LoadRunProgress()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := cmp.Diff(progress, loaded); d != "" {
+		t.Errorf("unexpected progress:\n%s", d)
+	}
+
+	if err := st.RemoveRunProgress(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded, err := st.LoadRunProgress(); err != nil || loaded != nil {
+		t.Errorf("progress must be removed: progress=%v, err=%v", loaded, err)
+	}
+	if err := st.RemoveRunProgress(); err != nil {
+		t.Errorf("removing no progress must succeed: %v", err)
+	}
+}
+
+func TestHelmState_PlanReleases(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Needs: []string{"db"}},
+			{Name: "db"},
+			{Name: "old", Installed: boolValue(false)},
+			{Name: "worker", After: []string{"app", "old"}},
+		},
+		logger: logger,
+	}
+
+	names := func(groups [][]ReleaseSpec) [][]string {
+		var res [][]string
+		for _, g := range groups {
+			var names []string
+			for _, r := range g {
+				names = append(names, r.Name)
+			}
+			res = append(res, names)
+		}
+		return res
+	}
+
+	tests := []struct {
+		reverse  bool
+		expected [][]string
+	}{
+		{reverse: false, expected: [][]string{{"db", "old"}, {"app"}, {"worker"}}},
+		{reverse: true, expected: [][]string{{"worker"}, {"app"}, {"db"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("reverse=%t", tt.reverse), func(t *testing.T) {
+			groups, err := state.PlanReleases(nil, 0, &PlanOpts{Reverse: tt.reverse})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d := cmp.Diff(tt.expected, names(groups)); d != "" {
+				t.Errorf("unexpected plan:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_PlanReleases_SelectorsAndConcurrency(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Needs: []string{"db"}, Labels: map[string]string{"tier": "app"}},
+			{Name: "db", Labels: map[string]string{"tier": "data"}},
+			{Name: "cache", Labels: map[string]string{"tier": "data"}},
+			{Name: "queue", Labels: map[string]string{"tier": "data"}},
+			{Name: "worker", Needs: []string{"app"}, Labels: map[string]string{"tier": "app"}},
+		},
+		MaxConcurrency: 2,
+		logger:         logger,
+	}
+
+	names := func(groups [][]ReleaseSpec) [][]string {
+		var res [][]string
+		for _, g := range groups {
+			var names []string
+			for _, r := range g {
+				names = append(names, r.Name)
+			}
+			sort.Strings(names)
+			res = append(res, names)
+		}
+		return res
+	}
+
+	// The releases in a group are split in no particular order, so that only the sizes of the split groups are compared
+	tests := []struct {
+		selectors   []string
+		concurrency int
+		expected    [][]string
+		sizes       []int
+	}{
+		{expected: [][]string{{"cache", "db", "queue"}, {"app"}, {"worker"}}},
+		{selectors: []string{"tier=app"}, expected: [][]string{{"app"}, {"worker"}}},
+		{selectors: []string{"tier=data"}, concurrency: 1, sizes: []int{1, 1, 1}},
+		// MaxConcurrency caps the concurrency
+		{selectors: []string{"tier=data"}, concurrency: 3, sizes: []int{2, 1}},
+		{concurrency: 2, sizes: []int{2, 1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("selectors=%v,concurrency=%d", tt.selectors, tt.concurrency), func(t *testing.T) {
+			groups, err := state.PlanReleases(tt.selectors, tt.concurrency)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.sizes != nil {
+				var sizes []int
+				for _, g := range groups {
+					sizes = append(sizes, len(g))
+				}
+				if d := cmp.Diff(tt.sizes, sizes); d != "" {
+					t.Errorf("unexpected sizes of groups:\n%s", d)
+				}
+				return
+			}
+			if d := cmp.Diff(tt.expected, names(groups)); d != "" {
+				t.Errorf("unexpected plan:\n%s", d)
+			}
+		})
+	}
+
+	if len(state.Releases) != 5 || state.filteredOutReleases != nil {
+		t.Errorf("planning must leave the releases as they are: %v, %v", state.Releases, state.filteredOutReleases)
+	}
+	if _, ok := state.Releases[0].Labels["name"]; ok {
+		t.Errorf("planning must not add labels to the releases: %v", state.Releases[0].Labels)
+	}
+}
+
+func TestHelmState_PlanReleases_MaxDAGDepth(t *testing.T) {
+	tests := []struct {
+		maxDAGDepth int
+		wantErr     bool
+	}{
+		{maxDAGDepth: 0, wantErr: false},
+		{maxDAGDepth: 2, wantErr: true},
+		{maxDAGDepth: 3, wantErr: false},
+		{maxDAGDepth: 4, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("maxDAGDepth=%d", tt.maxDAGDepth), func(t *testing.T) {
+			state := &HelmState{
+				Releases: []ReleaseSpec{
+					{Name: "app", Needs: []string{"cache"}},
+					{Name: "cache", Needs: []string{"db"}},
+					{Name: "db"},
+					{Name: "worker", Needs: []string{"db"}},
+				},
+				MaxDAGDepth: tt.maxDAGDepth,
+				logger:      logger,
+			}
+
+			for _, reverse := range []bool{false, true} {
+				_, err := state.PlanReleases(nil, 0, &PlanOpts{Reverse: reverse})
+				if tt.wantErr {
+					if err == nil {
+						t.Fatalf("expected error did not occur with reverse=%t", reverse)
+					}
+					if !strings.Contains(err.Error(), "planned in 3 groups") {
+						t.Errorf("unexpected error: %v", err)
+					}
+				} else if err != nil {
+					t.Fatalf("unexpected error with reverse=%t: %v", reverse, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHelmState_DOT(t *testing.T) {
+	state := &HelmState{
+		FilePath: "helmfile.yaml",
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "default", Needs: []string{"default/servicemesh", "?monitoring/prometheus", "default/db"}},
+			{Name: "servicemesh", Namespace: "default"},
+			{Name: "prometheus", Namespace: "monitoring"},
+			{Name: "old", Installed: boolValue(false)},
+		},
+		filteredOutReleases: []ReleaseSpec{
+			{Name: "db", Namespace: "default"},
+		},
+		logger: logger,
+	}
+
+	actual, err := state.DOT()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `digraph "helmfile.yaml" {
+  subgraph "cluster_0" {
+    label="default";
+    "default/app";
+    "default/servicemesh";
+  }
+  subgraph "cluster_1" {
+    label="monitoring";
+    "monitoring/prometheus";
+  }
+  "old" [color=gray, fontcolor=gray];
+  "default/app" -> "default/servicemesh";
+  "default/app" -> "monitoring/prometheus" [style=dashed];
+}
+`
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("unexpected graph:\n%s", d)
+	}
+
+	state.Releases[1].Needs = []string{"default/app"}
+	if _, err := state.DOT(); err == nil {
+		t.Error("expected error did not occur")
+	}
+}
+
+func TestHelmState_Degrees(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "default", Needs: []string{"default/servicemesh", "?monitoring/prometheus"}},
+			{Name: "servicemesh", Namespace: "default"},
+			{Name: "prometheus", Namespace: "monitoring"},
+			{Name: "cron", Namespace: "default", Needs: []string{"default/db"}},
+			{Name: "tools", Namespace: "default"},
+		},
+		filteredOutReleases: []ReleaseSpec{
+			{Name: "db", Namespace: "default"},
+		},
+		logger: logger,
+	}
+
+	actual, err := state.Degrees()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []ReleaseDegree{
+		{Release: "default/app", InDegree: 0, OutDegree: 2},
+		{Release: "default/servicemesh", InDegree: 1, OutDegree: 0},
+		{Release: "monitoring/prometheus", InDegree: 1, OutDegree: 0},
+		{Release: "default/cron", InDegree: 0, OutDegree: 0},
+		{Release: "default/tools", InDegree: 0, OutDegree: 0},
+	}
+	if d := cmp.Diff(expected, actual); d != "" {
+		t.Errorf("unexpected degrees:\n%s", d)
+	}
+
+	var orphans []string
+	for _, d := range actual {
+		if d.Orphan() {
+			orphans = append(orphans, d.Release)
+		}
+	}
+	if d := cmp.Diff([]string{"default/cron", "default/tools"}, orphans); d != "" {
+		t.Errorf("unexpected orphans:\n%s", d)
+	}
+}
+
+func TestHelmState_ValidateDAG(t *testing.T) {
+	testcases := []struct {
+		name     string
+		releases []ReleaseSpec
+		want     []string
+	}{
+		{
+			name: "valid",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"default/db", "?monitoring/prometheus"}},
+				{Name: "db", Namespace: "default"},
+				{Name: "prometheus", Namespace: "monitoring"},
+			},
+		},
+		{
+			name: "self-reference",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"default/app"}},
+			},
+			want: []string{
+				`release "default/app" cannot depend on itself. please remove it from its needs`,
+			},
+		},
+		{
+			name: "dangling",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"default/db"}},
+				{Name: "web", Namespace: "default"},
+			},
+			want: []string{
+				`"default/app" needs "default/db", but it must be one of default/app, default/web`,
+			},
+		},
+		{
+			name: "ambiguous",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default", Needs: []string{"db"}},
+				{Name: "db", Namespace: "ns1"},
+				{Name: "db", Namespace: "ns2"},
+			},
+			want: []string{
+				`"default/app" needs "db", but it is ambiguous as it matches 2 releases: ns1/db, ns2/db. please specify one of them in the form of [TILLER_NS/][NS/]NAME`,
+			},
+		},
+		{
+			name: "duplicate",
+			releases: []ReleaseSpec{
+				{Name: "app", Namespace: "default"},
+				{Name: "app", Namespace: "default"},
+			},
+			want: []string{
+				`found multiple releases with the same id "default/app". each release must have a unique combination of tiller namespace, namespace and name`,
+			},
+		},
+		{
+			name: "cycles",
+			releases: []ReleaseSpec{
+				{Name: "a", Needs: []string{"b"}},
+				{Name: "b", Needs: []string{"?c"}},
+				{Name: "c", Needs: []string{"a"}},
+				{Name: "d", Needs: []string{"e"}},
+				{Name: "e", After: []string{"d"}},
+				{Name: "f", Needs: []string{"a"}},
+			},
+			want: []string{
+				`releases a, b, c form a cycle of dependencies. please remove one of the needs among them`,
+				`releases d, e form a cycle of dependencies. please remove one of the needs among them`,
+			},
+		},
+		{
+			name: "all problems at once",
+			releases: []ReleaseSpec{
+				{Name: "app", Needs: []string{"app", "db"}},
+				{Name: "a", Needs: []string{"b"}},
+				{Name: "b", Needs: []string{"a"}},
+			},
+			want: []string{
+				`release "app" cannot depend on itself. please remove it from its needs`,
+				`"app" needs "db", but it must be one of app, a, b`,
+				`releases a, b form a cycle of dependencies. please remove one of the needs among them`,
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := &HelmState{
+				Releases: tc.releases,
+				logger:   logger,
+			}
+
+			var actual []string
+			for _, err := range state.ValidateDAG(false) {
+				actual = append(actual, err.Error())
+			}
+
+			if d := cmp.Diff(tc.want, actual); d != "" {
+				t.Errorf("unexpected errors:\n%s", d)
+			}
+		})
+	}
+}
+
+func TestHelmState_ValidateDAG_WarnDisconnected(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "default", Needs: []string{"default/servicemesh"}},
+			{Name: "servicemesh", Namespace: "default"},
+			{Name: "tools", Namespace: "default"},
+			{Name: "cron", Namespace: "default", Before: []string{"default/tools"}},
+			{Name: "web", Namespace: "default", Needs: []string{"default/db"}},
+		},
+		filteredOutReleases: []ReleaseSpec{
+			{Name: "db", Namespace: "default"},
+		},
+		logger: zap.New(core).Sugar(),
+	}
+
+	expected := [][]string{
+		{"default/app", "default/servicemesh"},
+		{"default/tools", "default/cron"},
+		{"default/web", "default/db"},
+	}
+	if d := cmp.Diff(expected, state.DisconnectedGroups()); d != "" {
+		t.Errorf("unexpected groups:\n%s", d)
+	}
+
+	if errs := state.ValidateDAG(false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("unexpected warnings: %v", logs.All())
+	}
+
+	if errs := state.ValidateDAG(true); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	want := "releases form 3 groups disconnected from each other: [default/app, default/servicemesh], [default/tools, default/cron], [default/web, default/db]. please make sure that no need is missing"
+	if entries := logs.All(); len(entries) != 1 || entries[0].Message != want {
+		t.Errorf("unexpected warnings: %v", entries)
+	}
+}
+
+func TestHelmState_UnresolvedNeeds(t *testing.T) {
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "app", Namespace: "default", Needs: []string{"default/servicemesh", "?monitoring/prometheus", "default/db"}},
+			{Name: "servicemesh", Namespace: "default", Needs: []string{"fluentd"}},
+			{Name: "fluentd", Namespace: "logging"},
+		},
+		filteredOutReleases: []ReleaseSpec{
+			{Name: "db", Namespace: "default"},
+		},
+		logger: logger,
+	}
+
+	expected := []UnresolvedNeed{
+		{Release: "default/app", Need: "?monitoring/prometheus"},
+		{Release: "default/servicemesh", Need: "fluentd"},
+	}
+
+	if d := cmp.Diff(expected, state.UnresolvedNeeds()); d != "" {
+		t.Errorf("unexpected unresolved needs:\n%s", d)
+	}
+}
+
+func TestHelmState_ResolveConcurrency(t *testing.T) {
+	state := &HelmState{
+		Environments: map[string]EnvironmentSpec{
+			"production": {Concurrency: 1},
+			"dev":        {},
+		},
+	}
+
+	tests := []struct {
+		env         string
+		concurrency int
+		expected    int
+	}{
+		{env: "production", concurrency: 0, expected: 1},
+		{env: "production", concurrency: 5, expected: 5},
+		{env: "dev", concurrency: 0, expected: 0},
+		{env: "default", concurrency: 0, expected: 0},
+	}
+
+	for _, tt := range tests {
+		state.Env.Name = tt.env
+		if actual := state.ResolveConcurrency(tt.concurrency); actual != tt.expected {
+			t.Errorf("unexpected concurrency for env %s and --concurrency %d: expected=%d, got=%d", tt.env, tt.concurrency, tt.expected, actual)
+		}
+	}
+
+	// The top-level concurrency applies only when neither --concurrency nor the environment's concurrency is specified
+	state.Concurrency = "3"
+
+	for _, tt := range []struct {
+		env         string
+		concurrency int
+		expected    int
+	}{
+		{env: "production", concurrency: 0, expected: 1},
+		{env: "production", concurrency: 5, expected: 5},
+		{env: "dev", concurrency: 0, expected: 3},
+		{env: "dev", concurrency: 5, expected: 5},
+	} {
+		state.Env.Name = tt.env
+		if actual := state.ResolveConcurrency(tt.concurrency); actual != tt.expected {
+			t.Errorf("unexpected concurrency for env %s, --concurrency %d and top-level concurrency 3: expected=%d, got=%d", tt.env, tt.concurrency, tt.expected, actual)
+		}
+	}
+}
+
+func TestHelmState_iterateOnReleases_TillerlessConcurrency(t *testing.T) {
+	tests := []struct {
+		allowConcurrency bool
+		expected         int
+	}{
+		{allowConcurrency: false, expected: 1},
+		{allowConcurrency: true, expected: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("tillerlessAllowConcurrency=%v", tt.allowConcurrency), func(t *testing.T) {
+			state := &HelmState{
+				HelmDefaults: HelmSpec{
+					Tillerless:                 true,
+					TillerlessAllowConcurrency: tt.allowConcurrency,
+				},
+				Releases: []ReleaseSpec{
+					{Name: "foo"},
+					{Name: "bar"},
+				},
+				logger: logger,
+			}
+
+			var workers sync.Map
+			var started sync.WaitGroup
+			started.Add(2)
+
+			errs := state.scatterGatherReleases(&mockHelmExec{}, 2, func(release ReleaseSpec, workerIndex int) error {
+				workers.Store(workerIndex, true)
+				// Wait for the other release to start, so that both releases are processed by different workers when allowed
+				if tt.allowConcurrency {
+					started.Done()
+					started.Wait()
+				}
+				return nil
+			})
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+
+			var actual int
+			workers.Range(func(_, _ interface{}) bool {
+				actual++
+				return true
+			})
+			if actual != tt.expected {
+				t.Errorf("unexpected number of workers: expected=%d, got=%d", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestHelmState_PlanMetricsSink(t *testing.T) {
+	var metrics []PlanMetrics
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "logging", Chart: "charts/logging"},
+			{Name: "servicemesh", Chart: "charts/servicemesh", Needs: []string{"logging"}},
+			{Name: "app1", Chart: "charts/app", Needs: []string{"logging", "servicemesh"}},
+			{Name: "app2", Chart: "charts/app", Needs: []string{"logging", "servicemesh"}},
+			{Name: "app3", Chart: "charts/app", Needs: []string{"servicemesh"}},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		PlanMetricsSink: func(m PlanMetrics) {
+			metrics = append(metrics, m)
+		},
+	}
+
+	if errs := state.SyncReleases(&AffectedReleases{}, &mockHelmExec{}, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := []PlanMetrics{{Groups: 3, MaxGroupWidth: 3, Releases: 5, Needs: 6}}
+	if d := cmp.Diff(expected, metrics); d != "" {
+		t.Errorf("unexpected metrics:\n%s", d)
+	}
+}
+
+// fakeClock is a Clock advanced only explicitly
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestHelmState_ReleaseTimingsSink(t *testing.T) {
+	var timings [][]ReleaseTiming
+
+	clock := &fakeClock{now: time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)}
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "fast"},
+			{Name: "slow", Namespace: "ns1"},
+			{Name: "error"},
+		},
+		logger: logger,
+		Clock:  clock,
+		ReleaseTimingsSink: func(t []ReleaseTiming) {
+			timings = append(timings, t)
+		},
+	}
+
+	errs := state.scatterGatherReleases(&mockHelmExec{}, 1, func(release ReleaseSpec, workerIndex int) error {
+		switch release.Name {
+		case "fast":
+			clock.Advance(10 * time.Millisecond)
+		case "slow":
+			clock.Advance(50 * time.Millisecond)
+		case "error":
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if len(timings) != 1 || len(timings[0]) != 3 {
+		t.Fatalf("unexpected timings: %v", timings)
+	}
+
+	slowest := timings[0][0]
+	if slowest.Release != "ns1/slow" || slowest.Duration != 50*time.Millisecond || slowest.Err != nil {
+		t.Errorf("unexpected timing of the slowest release: %+v", slowest)
+	}
+
+	var failed []string
+	for _, timing := range timings[0] {
+		if timing.Err != nil {
+			failed = append(failed, timing.Release)
+		}
+	}
+	if expected := []string{"error"}; !reflect.DeepEqual(failed, expected) {
+		t.Errorf("unexpected failed releases: expected=%v, got=%v", expected, failed)
+	}
+}
+
+func TestHelmState_BeforeAndAfterRelease(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)}
+
+	var mu sync.Mutex
+	var events []string
+
+	record := func(e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "ok"},
+			{Name: "failed"},
+			{Name: "locked"},
+		},
+		logger: logger,
+		Clock:  clock,
+		BeforeRelease: func(r ReleaseSpec) error {
+			record("before " + r.Name)
+			if r.Name == "locked" {
+				return errors.New("lock held by someone else")
 			}
+			return nil
+		},
+		AfterRelease: func(r ReleaseSpec, err error, d time.Duration) {
+			record(fmt.Sprintf("after %s: %v in %s", r.Name, err, d))
+		},
+	}
+
+	errs := state.scatterGatherReleases(&mockHelmExec{}, 1, func(release ReleaseSpec, workerIndex int) error {
+		record("do " + release.Name)
+		clock.Advance(time.Second)
+		if release.Name == "failed" {
+			return errors.New("upgrade failed")
+		}
+		return nil
+	})
+	if len(errs) != 2 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := []string{
+		"before ok",
+		"do ok",
+		"after ok: <nil> in 1s",
+		"before failed",
+		"do failed",
+		"after failed: upgrade failed in 1s",
+		"before locked",
+		"after locked: lock held by someone else in 0s",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("unexpected events: expected=%v, got=%v", expected, events)
+	}
+}
+
+func TestHelmState_ReleaseSkipped(t *testing.T) {
+	var mu sync.Mutex
+	skipped := map[string]SkipReason{}
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "foo/db", Installed: boolValue(false), Labels: map[string]string{"group": "x"}},
+			{Name: "app", Chart: "foo/app", Needs: []string{"db"}, Labels: map[string]string{"group": "x"}},
+			{Name: "cache", Chart: "foo/cache", Labels: map[string]string{"group": "x"}},
+			{Name: "web", Chart: "foo/web", Labels: map[string]string{"group": "y"}},
+		},
+		Selectors:   []string{"group=x"},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped[r.Name] = reason
+		},
+	}
+
+	if err := state.FilterReleases(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	helm := &mockHelmExec{}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1, &SyncOpts{SkipNeedsNotInstalled: true}); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := map[string]SkipReason{
+		"db":  SkipReasonNotInstalled,
+		"app": SkipReasonNeedsNotInstalled,
+		"web": SkipReasonFilteredBySelector,
+	}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Errorf("unexpected skipped releases: expected=%v, got=%v", expected, skipped)
+	}
+
+	var synced []string
+	for _, r := range helm.releases {
+		synced = append(synced, r.name)
+	}
+	if !reflect.DeepEqual(synced, []string{"cache"}) {
+		t.Errorf("unexpected releases synced: %v", synced)
+	}
+}
+
+func TestHelmState_ReleaseSkipped_Diff(t *testing.T) {
+	var mu sync.Mutex
+	skipped := map[string]SkipReason{}
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "foo/db", Installed: boolValue(false)},
+			{Name: "app", Chart: "foo/app"},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		ReleaseSkipped: func(r ReleaseSpec, reason SkipReason) {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped[r.Name] = reason
+		},
+	}
+
+	if _, errs := state.DiffReleases(&mockHelmExec{}, []string{}, 1, false, false, false); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// The release is not diffed, but is going to be deleted rather than skipped on sync
+	expected := map[string]SkipReason{
+		"db": SkipReasonToBeDeleted,
+	}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Errorf("unexpected skipped releases: expected=%v, got=%v", expected, skipped)
+	}
+}
+
+func TestHelmState_ReleaseWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var events []ReleaseEvent
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e ReleaseEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		// A failure to deliver never fails the release
+		if e.Release == "ns1/db" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{now: time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)}
+	webhook := NewReleaseWebhook(server.URL, logger)
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "db", Chart: "foo/db", Namespace: "ns1"},
+			{Name: "app-error", Chart: "foo/app", Needs: []string{"ns1/db"}},
+			{Name: "legacy", Chart: "foo/legacy", Installed: boolValue(false)},
+		},
+		logger:         logger,
+		valsRuntime:    valsRuntime,
+		Clock:          clock,
+		ReleaseWebhook: webhook,
+	}
+
+	errs := state.SyncReleases(&AffectedReleases{}, &mockHelmExec{}, []string{}, 1)
+	if len(errs) != 1 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	webhook.Close()
+
+	expected := []ReleaseEvent{
+		{Release: "ns1/db", Namespace: "ns1", Operation: "sync", Outcome: ReleaseOutcomeSucceeded},
+		{Release: "app-error", Operation: "sync", Outcome: ReleaseOutcomeFailed, Error: errs[0].Error()},
+	}
+	if d := cmp.Diff(expected, events); d != "" {
+		t.Errorf("unexpected events:\n%s", d)
+	}
+}
+
+// probeRunner is a helmexec.Runner failing the commands until they are run the number of times given in passAt
+type probeRunner struct {
+	mu     sync.Mutex
+	passAt map[string]int
+	runs   map[string]int
+}
+
+func (r *probeRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[cmd]++
+	if r.runs[cmd] < r.passAt[cmd] {
+		return nil, errors.New("not ready")
+	}
+	return nil, nil
+}
+
+func TestHelmState_WaitForReadiness(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)}
+	runner := &probeRunner{
+		passAt: map[string]int{"db-ready": 3, "never-ready": 1000},
+		runs:   map[string]int{},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "backend", WaitFor: []ReadinessProbe{
+				{Command: "db-ready", Interval: 10},
+				{Name: "api", HTTPGet: server.URL + "/healthz"},
+			}},
+			{Name: "frontend", WaitFor: []ReadinessProbe{
+				{Command: "never-ready", Timeout: 60, Interval: 10},
+			}},
+			{Name: "unavailable", WaitFor: []ReadinessProbe{
+				{HTTPGet: server.URL + "/unavailable", Timeout: 1, Interval: 1},
+			}},
+			{Name: "uninstalled", Installed: boolValue(false), WaitFor: []ReadinessProbe{
+				{Command: "never-ready"},
+			}},
+		},
+		logger: logger,
+		Clock:  clock,
+		runner: runner,
+		sleep:  clock.Advance,
+	}
+
+	var mu sync.Mutex
+	var processed []string
+
+	errs := state.scatterGatherReleases(&mockHelmExec{}, 1, func(release ReleaseSpec, workerIndex int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		processed = append(processed, release.Name)
+		return nil
+	})
+
+	expectedProcessed := []string{"backend", "uninstalled"}
+	if !reflect.DeepEqual(processed, expectedProcessed) {
+		t.Errorf("unexpected processed releases: expected=%v, got=%v", expectedProcessed, processed)
+	}
+
+	expectedErrs := []string{
+		`release "frontend" failed: readiness probe "never-ready" did not pass within 1m0s: command ` + "`never-ready`" + ` failed: not ready`,
+		`release "unavailable" failed: readiness probe "` + server.URL + `/unavailable" did not pass within 1s: GET ` + server.URL + `/unavailable returned 503 Service Unavailable`,
+	}
+	var actualErrs []string
+	for _, err := range errs {
+		actualErrs = append(actualErrs, err.Error())
+	}
+	if !reflect.DeepEqual(actualErrs, expectedErrs) {
+		t.Errorf("unexpected errors: expected=%v, got=%v", expectedErrs, actualErrs)
+	}
+
+	// db-ready passes at the 3rd attempt, and never-ready is attempted every 10s until the timeout, at 0s, 10s, ..., 60s
+	expectedRuns := map[string]int{"db-ready": 3, "never-ready": 7}
+	if !reflect.DeepEqual(runner.runs, expectedRuns) {
+		t.Errorf("unexpected runs of probes: expected=%v, got=%v", expectedRuns, runner.runs)
+	}
+}
+
+func TestHelmState_ValidateReadinessProbes(t *testing.T) {
+	tests := []struct {
+		probe   ReadinessProbe
+		wantErr string
+	}{
+		{probe: ReadinessProbe{Command: "pg_isready"}},
+		{probe: ReadinessProbe{HTTPGet: "https://auth.example.com/healthz"}},
+		{probe: ReadinessProbe{}, wantErr: `release "myapp" has invalid waitFor[0]: either command or httpGet must be specified`},
+		{probe: ReadinessProbe{Command: "pg_isready", HTTPGet: "https://auth.example.com/healthz"}, wantErr: `release "myapp" has invalid waitFor[0]: either command or httpGet must be specified, but not both`},
+		{probe: ReadinessProbe{HTTPGet: "auth.example.com/healthz"}, wantErr: `release "myapp" has invalid waitFor[0]: invalid httpGet "auth.example.com/healthz": it must be an absolute http or https URL`},
+		{probe: ReadinessProbe{HTTPGet: "ftp://auth.example.com/healthz"}, wantErr: `release "myapp" has invalid waitFor[0]: invalid httpGet "ftp://auth.example.com/healthz": it must be an absolute http or https URL`},
+	}
+
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			state := &HelmState{
+				Releases: []ReleaseSpec{{Name: "myapp", Chart: "charts/myapp", WaitFor: []ReadinessProbe{tt.probe}}},
+				logger:   logger,
+			}
+
+			err := state.ValidateReadinessProbes()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("unexpected error: expected=%s, got=%v", tt.wantErr, err)
+			}
+
+			if _, err := state.Validate(); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("unexpected error from Validate: expected=%s, got=%v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHelmState_WaitForReadiness_InvalidProbe(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2019, 11, 1, 0, 0, 0, 0, time.UTC)}
+	runner := &probeRunner{runs: map[string]int{}}
+
+	state := &HelmState{
+		Releases: []ReleaseSpec{
+			{Name: "myapp", WaitFor: []ReadinessProbe{{Name: "auth", HTTPGet: "auth.example.com/healthz"}}},
+		},
+		logger: logger,
+		Clock:  clock,
+		runner: runner,
+		sleep:  clock.Advance,
+	}
+
+	start := clock.Now()
+	err := state.waitForReadiness(state.Releases[0], logger)
+	if err == nil || err.Error() != `readiness probe "auth" is invalid: invalid httpGet "auth.example.com/healthz": it must be an absolute http or https URL` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !clock.Now().Equal(start) {
+		t.Errorf("an invalid probe must fail without being retried, but waited for %s", clock.Now().Sub(start))
+	}
+}
+
+// orderRecordingHelmExec records the releases synced into the log shared with kubectlRecordingRunner
+type orderRecordingHelmExec struct {
+	*mockHelmExec
+	log *[]string
+}
+
+func (helm *orderRecordingHelmExec) SyncRelease(context helmexec.HelmContext, name, chart string, flags ...string) error {
+	*helm.log = append(*helm.log, "helm upgrade "+name)
+	return helm.mockHelmExec.SyncRelease(context, name, chart, flags...)
+}
+
+type kubectlRecordingRunner struct {
+	log  *[]string
+	fail string
+}
+
+func (r *kubectlRecordingRunner) Execute(cmd string, args []string, env map[string]string) ([]byte, error) {
+	c := strings.Join(append([]string{cmd}, args...), " ")
+	*r.log = append(*r.log, c)
+	if r.fail != "" && strings.Contains(c, r.fail) {
+		return nil, errors.New("error")
+	}
+	return nil, nil
+}
+
+func TestHelmState_SyncReleases_KubectlHooks(t *testing.T) {
+	var log []string
+
+	state := &HelmState{
+		basePath:     "/path/to",
+		HelmDefaults: HelmSpec{KubeContext: "default"},
+		Releases: []ReleaseSpec{
+			{
+				Name:      "app",
+				Chart:     "stable/app",
+				Namespace: "apps",
+				BaseDir:   "/path/to/sub",
+				KubectlHooks: []KubectlHook{
+					{Events: []string{"presync"}, Apply: []string{"crds", "/abs/ns.yaml"}},
+					{Events: []string{"postsync"}, Args: []string{"rollout", "status", "deployment/app"}},
+				},
+			},
+			{
+				Name:        "db",
+				Chart:       "stable/db",
+				KubeContext: "db-cluster",
+				KubectlHooks: []KubectlHook{
+					{Events: []string{"presync", "postsync"}, Args: []string{"get", "pods"}},
+				},
+			},
+			{
+				Name:      "uninstalled",
+				Chart:     "stable/uninstalled",
+				Installed: boolValue(false),
+				KubectlHooks: []KubectlHook{
+					{Events: []string{"presync"}, Args: []string{"get", "pods"}},
+				},
+			},
+		},
+		logger:      logger,
+		valsRuntime: valsRuntime,
+		runner:      &kubectlRecordingRunner{log: &log},
+	}
+
+	helm := &orderRecordingHelmExec{mockHelmExec: &mockHelmExec{}, log: &log}
+	if errs := state.SyncReleases(&AffectedReleases{}, helm, []string{}, 1); len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	expected := []string{
+		"kubectl apply -f /path/to/sub/crds -f /abs/ns.yaml --context default --namespace apps",
+		"helm upgrade app",
+		"kubectl rollout status deployment/app --context default --namespace apps",
+		"kubectl get pods --context db-cluster",
+		"helm upgrade db",
+		"kubectl get pods --context db-cluster",
+	}
+	if !reflect.DeepEqual(log, expected) {
+		t.Errorf("unexpected commands:\nexpected=%v\nactual=%v", expected, log)
+	}
+
+	// A failed presync hook fails the release before syncing it, and a failed postsync hook fails the release synced
+	for _, tt := range []struct {
+		fail     string
+		expected []string
+	}{
+		{fail: "apply", expected: []string{"kubectl apply -f /path/to/sub/crds -f /abs/ns.yaml --context default --namespace apps"}},
+		{fail: "rollout", expected: expected[:3]},
+	} {
+		log = nil
+		state.runner = &kubectlRecordingRunner{log: &log, fail: tt.fail}
+		state.Releases = state.Releases[:1]
+
+		errs := state.SyncReleases(&AffectedReleases{}, &orderRecordingHelmExec{mockHelmExec: &mockHelmExec{}, log: &log}, []string{}, 1)
+		if len(errs) != 1 {
+			t.Fatalf("%s: expected an error, got %v", tt.fail, errs)
+		}
+		if !reflect.DeepEqual(log, tt.expected) {
+			t.Errorf("%s: unexpected commands:\nexpected=%v\nactual=%v", tt.fail, tt.expected, log)
+		}
+	}
+}
+
+func TestHelmState_SyncReleases_PriorityTieBreakWithConcurrency(t *testing.T) {
+	var releases []ReleaseSpec
+	var want []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("release%02d", 19-i)
+		releases = append(releases, ReleaseSpec{Name: name, Chart: "foo/" + name, Priority: i % 2})
+	}
+	// Releases with the higher priority come first, and the ones with the same priority in the declared order
+	for _, p := range []int{1, 0} {
+		for _, r := range releases {
+			if r.Priority == p {
+				want = append(want, r.Name)
+			}
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		state := &HelmState{
+			Releases:    append([]ReleaseSpec{}, releases...),
+			logger:      logger,
+			valsRuntime: valsRuntime,
+		}
+
+		preps, errs := state.prepareSyncReleases(&mockHelmExec{}, []string{}, 8)
+		if len(errs) > 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		var prepared []*ReleaseSpec
+		for _, p := range preps {
+			prepared = append(prepared, p.release)
+		}
+
+		plan, err := state.planReleases(prepared, true, rejectNotInstalledNeeds)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var got []string
+		for _, node := range plan[0] {
+			got = append(got, strings.TrimPrefix(node.Id, "default/"))
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected order of releases: want %v, got %v", want, got)
 		}
-		t.Run(tt.name, f)
 	}
 }
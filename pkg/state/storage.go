@@ -85,6 +85,7 @@ func (st *Storage) ExpandPaths(globPattern string) ([]string, error) {
 
 // normalizes relative path to absolute one
 func (st *Storage) normalizePath(path string) string {
+	path = ExpandPath(path)
 	u, _ := url.Parse(path)
 	if u.Scheme != "" || filepath.IsAbs(path) {
 		return path
@@ -1,11 +1,16 @@
 package state
 
 import (
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 )
 
+// ExpandPathsEnvVar is the environment variable to set to `true` to make helmfile expand `~` and environment variables in
+// paths to files. It is opt-in, so that literal paths that happen to contain `$` keep working.
+const ExpandPathsEnvVar = "HELMFILE_EXPAND_PATHS"
+
 func isLocalChart(chart string) bool {
 	regex, _ := regexp.Compile("^[.]?./")
 	matched := regex.MatchString(chart)
@@ -50,3 +55,25 @@ func normalizeChart(basePath, chart string) string {
 	}
 	return filepath.Join(basePath, chart)
 }
+
+// ExpandPath expands the leading `~` to the home directory, and `$VAR` and `${VAR}` to the values of the environment variables in the path,
+// only when enabled via ExpandPathsEnvVar. Otherwise it returns the path as-is.
+// An undefined environment variable is left unexpanded, so that an error on accessing the file tells which one is missing.
+func ExpandPath(path string) string {
+	if os.Getenv(ExpandPathsEnvVar) != "true" {
+		return path
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + path[1:]
+		}
+	}
+
+	return os.Expand(path, func(name string) string {
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		return "${" + name + "}"
+	})
+}
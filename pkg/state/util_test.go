@@ -1,6 +1,9 @@
 package state
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func TestIsLocalChart(t *testing.T) {
 	testcases := []struct {
@@ -145,3 +148,72 @@ func TestNormalizeChart(t *testing.T) {
 		}
 	}
 }
+
+func TestExpandPath(t *testing.T) {
+	defer patchEnv(t, map[string]string{
+		"HOME":            "/home/user",
+		"VALUES_DIR":      "/etc/values",
+		"EMPTY":           "",
+		ExpandPathsEnvVar: "true",
+	})()
+
+	testcases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "~", expected: "/home/user"},
+		{input: "~/values.yaml", expected: "/home/user/values.yaml"},
+		{input: "~user/values.yaml", expected: "~user/values.yaml"},
+		{input: "dir/~/values.yaml", expected: "dir/~/values.yaml"},
+		{input: "$VALUES_DIR/values.yaml", expected: "/etc/values/values.yaml"},
+		{input: "${VALUES_DIR}/values.yaml", expected: "/etc/values/values.yaml"},
+		{input: "~/$VALUES_DIR", expected: "/home/user//etc/values"},
+		{input: "$EMPTY/values.yaml", expected: "/values.yaml"},
+		{input: "$UNDEFINED_VAR/values.yaml", expected: "${UNDEFINED_VAR}/values.yaml"},
+		{input: "values.yaml", expected: "values.yaml"},
+	}
+
+	for _, tc := range testcases {
+		if actual := ExpandPath(tc.input); actual != tc.expected {
+			t.Errorf("unexpected result of expanding %q: expected=%q, actual=%q", tc.input, tc.expected, actual)
+		}
+	}
+}
+
+func TestExpandPath_Disabled(t *testing.T) {
+	defer patchEnv(t, map[string]string{
+		"HOME":            "/home/user",
+		"VALUES_DIR":      "/etc/values",
+		ExpandPathsEnvVar: "",
+	})()
+
+	for _, path := range []string{"~/values.yaml", "$VALUES_DIR/values.yaml", "${VALUES_DIR}/values.yaml"} {
+		if actual := ExpandPath(path); actual != path {
+			t.Errorf("unexpected result of expanding %q while disabled: %q", path, actual)
+		}
+	}
+}
+
+// patchEnv sets the environment variables, and returns the function to restore them
+func patchEnv(t *testing.T, envs map[string]string) func() {
+	t.Helper()
+
+	restores := []func(){}
+	for k, v := range envs {
+		k := k
+		if prev, ok := os.LookupEnv(k); ok {
+			restores = append(restores, func() { os.Setenv(k, prev) })
+		} else {
+			restores = append(restores, func() { os.Unsetenv(k) })
+		}
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	return func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+}
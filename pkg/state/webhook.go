@@ -0,0 +1,144 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// releaseWebhookQueueSize is the number of events queued for delivery at most. Events are dropped when the queue is full
+	releaseWebhookQueueSize = 100
+	// releaseWebhookTimeout is the timeout of delivering each event
+	releaseWebhookTimeout = 5 * time.Second
+	// releaseWebhookFlushTimeout is the time to wait for the queued events to be delivered on closing the webhook
+	releaseWebhookFlushTimeout = 10 * time.Second
+)
+
+const (
+	// ReleaseOutcomeSucceeded is the outcome of an operation on a release that succeeded
+	ReleaseOutcomeSucceeded = "succeeded"
+	// ReleaseOutcomeFailed is the outcome of an operation on a release that failed
+	ReleaseOutcomeFailed = "failed"
+)
+
+// ReleaseEvent is the outcome of an operation on a release, posted to the release webhook as JSON.
+type ReleaseEvent struct {
+	// Release is the [TILLER_NS/][NS/]NAME of the release
+	Release   string `json:"release"`
+	Namespace string `json:"namespace"`
+	// Operation is the operation on the release, like `sync`, `delete`, `test` or `status`
+	Operation string `json:"operation"`
+	// Outcome is either ReleaseOutcomeSucceeded or ReleaseOutcomeFailed
+	Outcome string `json:"outcome"`
+	// DurationSeconds is the time taken to process the release
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Error is the error occurred while processing the release, if any
+	Error string `json:"error,omitempty"`
+}
+
+// ReleaseWebhook posts a ReleaseEvent to the URL after each operation on a release, e.g. for ChatOps or auditing.
+//
+// Events are queued and delivered one by one in the background, so that a slow webhook never blocks processing releases.
+// An event is dropped when the queue is full, and a failure to deliver an event is just logged, never failing the release.
+type ReleaseWebhook struct {
+	url    string
+	client *http.Client
+	logger *zap.SugaredLogger
+	queue  chan ReleaseEvent
+	done   chan struct{}
+}
+
+// NewReleaseWebhook returns a ReleaseWebhook posting to the URL, which delivers events until Close is called.
+func NewReleaseWebhook(url string, logger *zap.SugaredLogger) *ReleaseWebhook {
+	w := &ReleaseWebhook{
+		url:    url,
+		client: &http.Client{Timeout: releaseWebhookTimeout},
+		logger: logger,
+		queue:  make(chan ReleaseEvent, releaseWebhookQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		for e := range w.queue {
+			if err := w.deliver(e); err != nil {
+				w.logger.Warnf("failed delivering the event of %s on release %q to the release webhook: %v", e.Operation, e.Release, err)
+			}
+		}
+	}()
+
+	return w
+}
+
+// Notify queues the event for delivery without blocking. The event is dropped with a warning when the queue is full.
+func (w *ReleaseWebhook) Notify(e ReleaseEvent) {
+	select {
+	case w.queue <- e:
+	default:
+		w.logger.Warnf("dropped the event of %s on release %q as the release webhook is too slow to deliver %d queued events", e.Operation, e.Release, releaseWebhookQueueSize)
+	}
+}
+
+// Close stops accepting events, and waits for the queued events to be delivered up to releaseWebhookFlushTimeout.
+func (w *ReleaseWebhook) Close() {
+	close(w.queue)
+
+	select {
+	case <-w.done:
+	case <-time.After(releaseWebhookFlushTimeout):
+		w.logger.Warnf("gave up delivering the remaining events to the release webhook after %s", releaseWebhookFlushTimeout)
+	}
+}
+
+func (w *ReleaseWebhook) deliver(e ReleaseEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	res, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	return nil
+}
+
+// withReleaseWebhook runs the operation on the release, and notifies ReleaseWebhook of the outcome.
+func (st *HelmState) withReleaseWebhook(operation string, release ReleaseSpec, run func() error) error {
+	start := st.clock().Now()
+	err := run()
+	st.notifyReleaseWebhook(operation, release, err, st.clock().Now().Sub(start))
+	return err
+}
+
+// notifyReleaseWebhook sends the outcome of the operation on the release to ReleaseWebhook when set.
+func (st *HelmState) notifyReleaseWebhook(operation string, release ReleaseSpec, err error, duration time.Duration) {
+	if st.ReleaseWebhook == nil {
+		return
+	}
+
+	e := ReleaseEvent{
+		Release:         releaseToID(&release),
+		Namespace:       st.ReleaseNamespace(&release),
+		Operation:       operation,
+		Outcome:         ReleaseOutcomeSucceeded,
+		DurationSeconds: duration.Seconds(),
+	}
+	if err != nil {
+		e.Outcome = ReleaseOutcomeFailed
+		e.Error = err.Error()
+	}
+
+	st.ReleaseWebhook.Notify(e)
+}
@@ -0,0 +1,180 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/variantdev/dag/pkg/dag"
+)
+
+// reverseIterateOnReleasesEagerly calls `do` for each release in the plan in the reverse order of the DAG, starting each release
+// as soon as all the releases needing it are done, instead of waiting for the whole group preceding it in the plan.
+//
+// Releases become ready when all their children in the DAG, i.e. the releases needing them via `needs`, `after`, `before` or `wave`,
+// are done, and ready releases are dispatched to workers in the order they would be processed group by group.
+// So it processes releases in exactly the same order as the groups with the concurrency of 1, while never starting a release
+// before all the releases needing it finish.
+//
+// A failure stops dispatching more releases unless it is soft, or opts.ContinueOnError is true, as done by
+// dagAwareReverseIterateOnReleaseGroups. The releases already dispatched are still waited for.
+func (st *HelmState) reverseIterateOnReleasesEagerly(concurrency int, releases []*ReleaseSpec, idToRelease map[string]ReleaseSpec,
+	plan dag.Topology, opts *DeleteOpts, do func(ReleaseSpec, int) error) []error {
+
+	nodes := map[string]*dag.NodeInfo{}
+	// rank is the position of each release when processed group by group, used to dispatch ready releases in a stable order
+	rank := map[string]int{}
+	for groupIndex := len(plan) - 1; groupIndex >= 0; groupIndex-- {
+		for _, node := range plan[groupIndex] {
+			nodes[node.Id] = node
+			rank[node.Id] = len(rank)
+		}
+	}
+
+	// pending is the number of the releases needing each release that are not done yet
+	pending := map[string]int{}
+	var ready []string
+	for groupIndex := len(plan) - 1; groupIndex >= 0; groupIndex-- {
+		for _, node := range plan[groupIndex] {
+			for _, c := range node.ChildIds {
+				if _, ok := nodes[c]; ok {
+					pending[node.Id]++
+				}
+			}
+			if pending[node.Id] == 0 {
+				ready = append(ready, node.Id)
+			}
+		}
+	}
+
+	st.logger.Debugf("processing %d releases as soon as all the releases needing each of them are done, starting from: %v", len(nodes), ready)
+
+	var errs []error
+	var timings []ReleaseTiming
+
+	// failed is the IDs of the failed and skipped releases, used only when opts.ContinueOnError is true
+	failed := map[string]bool{}
+
+	// done marks the release as done, and makes the releases it needs ready when all the releases needing them are done.
+	// With opts.ContinueOnError, a release that would become ready is skipped instead when a release hard-needing it failed
+	// or was skipped, which in turn is done.
+	var done func(id string)
+	done = func(id string) {
+		for _, p := range nodes[id].ParentIds {
+			if _, ok := nodes[p]; !ok {
+				continue
+			}
+
+			pending[p]--
+			if pending[p] > 0 {
+				continue
+			}
+
+			if opts.ContinueOnError {
+				if dependent, ok := skippedByFailedDependents(releases, failed, p); ok {
+					st.logger.Warnf("skipping %q as %q needing it failed or was skipped", p, dependent)
+					errs = append(errs, fmt.Errorf("release \"%s\" skipped: %q needing it failed or was skipped", idToRelease[p].Name, dependent))
+					failed[p] = true
+					done(p)
+					continue
+				}
+			}
+
+			ready = append(ready, p)
+		}
+
+		sort.SliceStable(ready, func(i, j int) bool {
+			return rank[ready[i]] < rank[ready[j]]
+		})
+	}
+
+	// Releases are dispatched only to idle workers, so that a result is always handled before dispatching the release
+	// that would be processed next with the concurrency of 1
+	workers := st.workers(concurrency, len(nodes))
+
+	jobs := make(chan ReleaseSpec)
+	// Buffered so that workers never wait for the coordinator to receive their results, as it may be dispatching a release
+	results := make(chan result, len(nodes))
+	slots := st.newNamespaceSlots()
+	order := st.newDispatchOrder()
+
+	st.scatterGather(
+		concurrency,
+		len(nodes),
+		func() {
+			// Releases are dispatched by the coordinator below, as they become ready only after the results of others are received
+		},
+		func(id int) {
+			for release := range jobs {
+				results <- st.processRelease(release, id, slots, order, do)
+			}
+		},
+		func() {
+			aborted := false
+			inFlight := 0
+
+			for inFlight > 0 || !aborted && len(ready) > 0 {
+				// Sending to the nil channel blocks forever, which disables dispatching while aborted, nothing is ready, or no worker is idle
+				// The next release is the first ready one with a free slot of its namespace, which is taken until it is dispatched
+				var dispatch chan ReleaseSpec
+				var next ReleaseSpec
+				n := -1
+				if !aborted && inFlight < workers {
+					namespaces := make([]string, len(ready))
+					for i, id := range ready {
+						r := idToRelease[id]
+						namespaces[i] = st.ReleaseNamespace(&r)
+					}
+					if n = slots.next(namespaces, false); n >= 0 {
+						dispatch = jobs
+						next = idToRelease[ready[n]]
+					}
+				}
+
+				select {
+				case dispatch <- next:
+					st.logger.Debugf("dispatched release %q as all the releases needing it are done", ready[n])
+					ready = append(ready[:n], ready[n+1:]...)
+					inFlight++
+					order.wait()
+				case r := <-results:
+					inFlight--
+					if n >= 0 {
+						slots.free(st.ReleaseNamespace(&next))
+					}
+
+					id := releaseToID(&r.release)
+					timings = append(timings, ReleaseTiming{Release: id, Duration: r.duration, Err: r.err})
+
+					if r.err == nil {
+						done(id)
+						continue
+					}
+
+					errs = append(errs, r.failure())
+
+					switch {
+					case opts.ContinueOnError:
+						failed[id] = true
+						done(id)
+					case isSoftFailure(releases, id, true):
+						st.logger.Warnf("continuing as the failed release is only softly needed: %s", id)
+						done(id)
+					default:
+						st.logger.Debugf("aborting as %q failed", id)
+						aborted = true
+					}
+				}
+			}
+
+			close(jobs)
+		},
+	)
+
+	st.sinkReleaseTimings(timings)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
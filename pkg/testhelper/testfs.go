@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 type TestFs struct {
@@ -14,6 +15,8 @@ type TestFs struct {
 
 	GlobFixtures map[string][]string
 
+	// mu guards the counters below, as files can be read concurrently like by App.LoadAll
+	mu              sync.Mutex
 	fileReaderCalls int
 	successfulReads []string
 }
@@ -73,6 +76,9 @@ func (f *TestFs) ReadFile(filename string) ([]byte, error) {
 		return []byte(nil), fmt.Errorf("no registered file found: %s", filename)
 	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	f.fileReaderCalls += 1
 
 	f.successfulReads = append(f.successfulReads, filename)
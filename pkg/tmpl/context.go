@@ -1,7 +1,20 @@
 package tmpl
 
+import "text/template"
+
 type Context struct {
 	preRender bool
 	basePath  string
 	readFile  func(string) ([]byte, error)
+
+	// funcs is the additional template functions available along with the built-in ones
+	funcs template.FuncMap
+
+	// deterministicSeed, when set, replaces the randomized template functions with the ones seeded by it and the template.
+	// See deterministicFuncMap
+	deterministicSeed string
+
+	// strict fails rendering a template that prints `<no value>`, which text/template prints for nil values, like the ones
+	// of keys missing in a map looked up via `index` or defined as null, instead of leaking it into the result
+	strict bool
 }
@@ -2,26 +2,45 @@ package tmpl
 
 import (
 	"bytes"
-	"github.com/Masterminds/sprig"
+	"fmt"
+	"strings"
 	"text/template"
+
+	"github.com/Masterminds/sprig"
 )
 
-func (c *Context) stringTemplate() *template.Template {
+func (c *Context) stringTemplate(text string) (*template.Template, error) {
 	funcMap := sprig.TxtFuncMap()
 	for name, f := range c.createFuncMap() {
 		funcMap[name] = f
 	}
+	if c.deterministicSeed != "" {
+		for name, f := range deterministicFuncMap(c.deterministicSeed, text) {
+			funcMap[name] = f
+		}
+	}
+	for name, f := range c.funcs {
+		if _, ok := funcMap[name]; ok {
+			return nil, fmt.Errorf("template function %q conflicts with the built-in one. please rename it", name)
+		}
+		funcMap[name] = f
+	}
 	tmpl := template.New("stringTemplate").Funcs(funcMap)
 	if c.preRender {
 		tmpl = tmpl.Option("missingkey=zero")
 	} else {
 		tmpl = tmpl.Option("missingkey=error")
 	}
-	return tmpl
+	return tmpl, nil
 }
 
 func (c *Context) RenderTemplateToBuffer(s string, data ...interface{}) (*bytes.Buffer, error) {
-	var t, parseErr = c.stringTemplate().Parse(s)
+	tmpl, err := c.stringTemplate(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var t, parseErr = tmpl.Parse(s)
 	if parseErr != nil {
 		return nil, parseErr
 	}
@@ -37,5 +56,25 @@ func (c *Context) RenderTemplateToBuffer(s string, data ...interface{}) (*bytes.
 		return &tplString, execErr
 	}
 
+	if c.strict && !c.preRender {
+		if err := checkNoValue(tplString.String()); err != nil {
+			return &tplString, err
+		}
+	}
+
 	return &tplString, nil
 }
+
+// noValue is what text/template prints for nil values
+const noValue = "<no value>"
+
+// checkNoValue returns an error pointing at the first line of the result containing noValue.
+// The line is of the result rather than the template, as the template can't tell which action printed it.
+func checkNoValue(rendered string) error {
+	for i, line := range strings.Split(rendered, "\n") {
+		if strings.Contains(line, noValue) {
+			return fmt.Errorf("rendered %q for an undefined or null value at line %d of the result: %s. use `default` or `hasKey` for an optional one", noValue, i+1, strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package tmpl
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"text/template"
+)
+
+const (
+	alphabetic   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	numeric      = "0123456789"
+	alphanumeric = alphabetic + numeric
+)
+
+// deterministicFuncMap returns the replacements of the randomized template functions of sprig, which generate the same
+// results for the same seed and template, so that rendering a helmfile repeatedly produces identical output.
+//
+// The random sequence is seeded by the hash of the seed and the template, so that different templates get different results,
+// and the results can't be predicted from the template alone, as long as the seed is kept secret.
+// The functions generating keys and certificates are disabled, as keys generated from a predictable seed are never secure.
+func deterministicFuncMap(seed, text string) template.FuncMap {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte{0})
+	h.Write([]byte(text))
+	rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	randFrom := func(chars string) func(int) string {
+		return func(count int) string {
+			bs := make([]byte, count)
+			for i := range bs {
+				bs[i] = chars[rnd.Intn(len(chars))]
+			}
+			return string(bs)
+		}
+	}
+
+	disabled := func(name string) func(...interface{}) (string, error) {
+		return func(...interface{}) (string, error) {
+			return "", fmt.Errorf("%s is disabled while rendering deterministically, as it would generate insecure keys", name)
+		}
+	}
+
+	funcMap := template.FuncMap{
+		"randAlphaNum": randFrom(alphanumeric),
+		"randAlpha":    randFrom(alphabetic),
+		"randNumeric":  randFrom(numeric),
+		"randAscii": func(count int) string {
+			bs := make([]byte, count)
+			for i := range bs {
+				// Printable characters from ` ` to `~`, like sprig
+				bs[i] = byte(32 + rnd.Intn(95))
+			}
+			return string(bs)
+		},
+		"shuffle": func(s string) string {
+			rs := []rune(s)
+			rnd.Shuffle(len(rs), func(i, j int) { rs[i], rs[j] = rs[j], rs[i] })
+			return string(rs)
+		},
+		"uuidv4": func() string {
+			var u [16]byte
+			rnd.Read(u[:])
+			u[6] = (u[6] & 0x0f) | 0x40
+			u[8] = (u[8] & 0x3f) | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+		},
+	}
+
+	for _, name := range []string{"genPrivateKey", "genCA", "genSelfSignedCert", "genSignedCert"} {
+		funcMap[name] = disabled(name)
+	}
+
+	return funcMap
+}
@@ -6,6 +6,7 @@ import (
 
 	"fmt"
 	"strings"
+	"text/template"
 )
 
 type FileRenderer struct {
@@ -37,6 +38,27 @@ func NewFirstPassRenderer(basePath string, data interface{}) *FileRenderer {
 	}
 }
 
+// WithFuncs makes the additional template functions available along with the built-in ones.
+// Rendering fails when any of them has the same name as a built-in function.
+func (r *FileRenderer) WithFuncs(funcs template.FuncMap) *FileRenderer {
+	r.Context.funcs = funcs
+	return r
+}
+
+// WithDeterministic makes the randomized template functions, like `randAlphaNum` and `uuidv4`, return the same results
+// for the same seed and template when the seed is not empty. The functions generating keys and certificates fail instead.
+func (r *FileRenderer) WithDeterministic(seed string) *FileRenderer {
+	r.Context.deterministicSeed = seed
+	return r
+}
+
+// WithStrict makes rendering fail when strict is true and the template prints `<no value>` for an undefined or null value,
+// like `{{ index .Values "typo" }}`. Looking up a key missing in a map via a field like `.Values.typo` always fails.
+func (r *FileRenderer) WithStrict(strict bool) *FileRenderer {
+	r.Context.strict = strict
+	return r
+}
+
 func (r *FileRenderer) RenderTemplateFileToBuffer(file string) (*bytes.Buffer, error) {
 	content, err := r.ReadFile(file)
 	if err != nil {